@@ -0,0 +1,216 @@
+package api
+
+import (
+	"main/calculate"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminHandler handles operator-facing maintenance requests
+type AdminHandler struct {
+	scheduler   *calculate.BackgroundScheduler
+	maintenance *calculate.MaintenanceService
+	warmup      *calculate.WarmupService
+	branches    *calculate.BranchService
+	quarantine  *calculate.QuarantineService
+	audit       *calculate.AuditService
+}
+
+func NewAdminHandler() *AdminHandler {
+	return &AdminHandler{
+		scheduler:   calculate.BackgroundJobs(),
+		maintenance: calculate.NewMaintenanceService(),
+		warmup:      calculate.NewWarmupService(),
+		branches:    calculate.NewBranchService(),
+		quarantine:  calculate.NewQuarantineService(),
+		audit:       calculate.NewAuditService(),
+	}
+}
+
+// RebuildDerived reconstructs indexes, branch refs and history caches from the raw metadata
+func (h *AdminHandler) RebuildDerived(c *gin.Context) {
+	report, err := h.maintenance.RebuildDerived()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// CheckConsistency reports dangling metadata references, and removes the ones that are safe to remove with repair
+func (h *AdminHandler) CheckConsistency(c *gin.Context) {
+	var req CheckConsistencyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	report, err := h.maintenance.CheckConsistency(req.Content.Repair)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "report": report})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// ListMetadataRecoveries reports the metadata files restored from a backup because they were corrupt
+func (h *AdminHandler) ListMetadataRecoveries(c *gin.Context) {
+	recoveries, err := h.maintenance.MetadataRecoveries()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recoveries": recoveries})
+}
+
+// ConvertMetadataEncoding rewrites version files and file trees into the configured metadata encoding
+func (h *AdminHandler) ConvertMetadataEncoding(c *gin.Context) {
+	conversion, err := h.maintenance.ConvertMetadataEncoding()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "conversion": conversion})
+		return
+	}
+	c.JSON(http.StatusOK, conversion)
+}
+
+// CollectGarbage deletes stored objects no file index references, or lists them on a dry run
+func (h *AdminHandler) CollectGarbage(c *gin.Context) {
+	var req CollectGarbageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	report, err := h.maintenance.CollectGarbage(req.Content.DryRun)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "report": report})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// MigrateToGlobalBlobs moves name-prefixed objects into the global blob namespace, or reports what would move on a dry run
+func (h *AdminHandler) MigrateToGlobalBlobs(c *gin.Context) {
+	var req MigrateGlobalBlobsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	report, err := h.maintenance.MigrateToGlobalBlobs(req.Content.DryRun)
+	if err != nil {
+		if strings.Contains(err.Error(), "invalid") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "report": report})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// GetBackgroundStatus lists running and queued background jobs
+func (h *AdminHandler) GetBackgroundStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, h.scheduler.Status())
+}
+
+// PauseBackground stops queued background jobs from starting
+func (h *AdminHandler) PauseBackground(c *gin.Context) {
+	h.scheduler.Pause()
+	c.JSON(http.StatusOK, h.scheduler.Status())
+}
+
+// ResumeBackground lets queued background jobs start again
+func (h *AdminHandler) ResumeBackground(c *gin.Context) {
+	h.scheduler.Resume()
+	c.JSON(http.StatusOK, h.scheduler.Status())
+}
+
+// GetCacheWarmupStatus reports warm-up progress and the freshness of each history cache
+func (h *AdminHandler) GetCacheWarmupStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, h.warmup.Status())
+}
+
+// GetCacheStats reports the size, budget and hit and eviction counters of the in-memory caches
+func (h *AdminHandler) GetCacheStats(c *gin.Context) {
+	c.JSON(http.StatusOK, h.maintenance.CacheStats())
+}
+
+// StartCacheWarmup runs the history cache warm-up again
+func (h *AdminHandler) StartCacheWarmup(c *gin.Context) {
+	if !h.warmup.Start() {
+		c.JSON(http.StatusConflict, gin.H{"error": "cache warm-up already running"})
+		return
+	}
+	c.JSON(http.StatusAccepted, h.warmup.Status())
+}
+
+// GetBranchCollisions lists branches whose names differ only in case
+func (h *AdminHandler) GetBranchCollisions(c *gin.Context) {
+	var req BranchCollisionsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	collisions, err := h.branches.FindCaseCollisions(req.Positions.CodebaseID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"collisions": collisions})
+}
+
+// ListQuarantine lists objects found corrupt at read time with the versions and paths referencing them
+func (h *AdminHandler) ListQuarantine(c *gin.Context) {
+	entries, err := h.quarantine.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
+
+// ListAuditLog lists audit entries of permanent changes made without a request, such as trash purges
+func (h *AdminHandler) ListAuditLog(c *gin.Context) {
+	var req ListAuditLogRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+	entries, err := h.audit.List(req.Content.Action, req.Content.CodebaseID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
+
+// ResolveQuarantine re-uploads, re-checks or purges a quarantined object
+func (h *AdminHandler) ResolveQuarantine(c *gin.Context) {
+	var req ResolveQuarantineRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	entry, err := h.quarantine.Resolve(req.Content.StorageKey, req.Content.Action, req.Content.Content)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case strings.Contains(err.Error(), "invalid"):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
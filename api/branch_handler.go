@@ -0,0 +1,100 @@
+package api
+
+import (
+	"main/calculate"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BranchHandler handles branch management requests
+type BranchHandler struct {
+	service *calculate.BranchService
+}
+
+func NewBranchHandler() *BranchHandler {
+	return &BranchHandler{
+		service: calculate.NewBranchService(),
+	}
+}
+
+// CreateBranch declares a new branch pointing at an existing version
+func (h *BranchHandler) CreateBranch(c *gin.Context) {
+	var req CreateBranchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	source := calculate.VersionIdentifier{
+		Branch:  req.Content.Source.Branch,
+		Version: req.Content.Source.Version,
+	}
+
+	ref, err := h.service.CreateBranch(req.Positions.CodebaseID, req.Content.Branch, source)
+	if err != nil {
+		if writeNameError(c, err) {
+			return
+		}
+		switch {
+		case strings.Contains(err.Error(), "already exists"):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case strings.Contains(err.Error(), "invalid"):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, ref)
+}
+
+// MergeBranchCasing folds a branch into another spelling of the same name
+func (h *BranchHandler) MergeBranchCasing(c *gin.Context) {
+	var req MergeBranchCasingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	result, err := h.service.MergeBranchCasing(req.Positions.CodebaseID, req.Content.From, req.Content.Into)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "already exists"):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case strings.Contains(err.Error(), "invalid"):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// CheckHeads reports branches whose lineage has more than one head
+func (h *BranchHandler) CheckHeads(c *gin.Context) {
+	var req CheckBranchHeadsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	splits, err := h.service.CheckHeads(req.Positions.CodebaseID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"splits": splits})
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"main/calculate"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BundleHandler handles export and import of codebase bundles
+type BundleHandler struct {
+	service *calculate.BundleService
+}
+
+func NewBundleHandler() *BundleHandler {
+	return &BundleHandler{
+		service: calculate.NewBundleService(),
+	}
+}
+
+// Export streams a full or incremental bundle of a codebase
+func (h *BundleHandler) Export(c *gin.Context) {
+	var req ExportBundleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	zipPath, manifest, err := h.service.Export(req.Positions.CodebaseID, calculate.ExportOptions{
+		Since:          req.Content.SinceManifest,
+		SinceVersionID: req.Content.SinceVersionID,
+	})
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case strings.Contains(err.Error(), "invalid"):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	defer os.Remove(zipPath)
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s-%s.zip", manifest.Codebase.Name, manifest.BundleID))
+	c.Header("X-CVCS-Bundle-ID", manifest.BundleID)
+	c.Header("X-CVCS-Parent-Bundle-ID", manifest.ParentBundleID)
+	c.File(zipPath)
+}
+
+// Import applies one or more bundles, uploaded in chain order under the "bundles" field
+func (h *BundleHandler) Import(c *gin.Context) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid multipart/form-data: " + err.Error()})
+		return
+	}
+
+	result, err := h.service.Import(form.File["bundles"])
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "already exists"):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case strings.Contains(err.Error(), "invalid"):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "result": result})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// ExportMetadata streams the metadata of a codebase as one JSON document
+func (h *BundleHandler) ExportMetadata(c *gin.Context) {
+	var req ExportMetadataRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	includeTrees := req.Content.IncludeTrees == nil || *req.Content.IncludeTrees
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	err := h.service.ExportMetadata(c.Writer, req.Positions.CodebaseID, includeTrees)
+	if err == nil {
+		return
+	}
+	if c.Writer.Written() {
+		// The document is already partly sent; the client sees it truncated
+		log.Printf("Metadata export of codebase %s aborted: %v", req.Positions.CodebaseID, err)
+		c.Abort()
+		return
+	}
+	if strings.Contains(err.Error(), "not found") {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	} else {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"errors"
+	"main/calculate"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CodebaseHandler handles requests about a codebase as a whole
+type CodebaseHandler struct {
+	service      *calculate.CodebaseService
+	usageService *calculate.UsageService
+}
+
+func NewCodebaseHandler() *CodebaseHandler {
+	return &CodebaseHandler{
+		service:      calculate.NewCodebaseService(),
+		usageService: calculate.NewUsageService(),
+	}
+}
+
+// ListCodebases lists the codebases in use, ephemeral ones only on request
+func (h *CodebaseHandler) ListCodebases(c *gin.Context) {
+	var req ListCodebasesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	codebases, err := h.service.ListCodebases(req.Content.IncludeEphemeral)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"codebases": codebases})
+}
+
+// GetCodebase returns a codebase record with branch, version and storage summaries
+func (h *CodebaseHandler) GetCodebase(c *gin.Context) {
+	var req GetCodebaseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	details, err := h.service.GetCodebaseDetails(req.Positions.CodebaseID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, details)
+}
+
+// SetDefaultBranch changes which branch of a codebase is the default
+func (h *CodebaseHandler) SetDefaultBranch(c *gin.Context) {
+	var req SetDefaultBranchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	codebase, err := h.service.SetDefaultBranch(req.Positions.CodebaseID, req.Content.Branch)
+	if err != nil {
+		var notFound *calculate.BranchNotFoundError
+		switch {
+		case errors.As(err, &notFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error(), "available_branches": notFound.AvailableBranches})
+		case strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, codebase)
+}
+
+// RenameCodebase changes the name of a codebase
+func (h *CodebaseHandler) RenameCodebase(c *gin.Context) {
+	var req RenameCodebaseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	result, err := h.service.RenameCodebase(req.Positions.CodebaseID, req.Content.Name)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case strings.Contains(err.Error(), "invalid"):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// CloneCodebase copies a codebase with its whole history into a new codebase
+func (h *CodebaseHandler) CloneCodebase(c *gin.Context) {
+	var req CloneCodebaseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	result, err := h.service.CloneCodebase(req.Positions.CodebaseID, req.Content.Name, req.Content.Description)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case strings.Contains(err.Error(), "invalid"):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusCreated, result)
+}
+
+// UpdateCodebase changes the description, the default branch and/or the ignore patterns of a codebase
+func (h *CodebaseHandler) UpdateCodebase(c *gin.Context) {
+	var req UpdateCodebaseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	codebase, err := h.service.UpdateCodebase(req.Positions.CodebaseID, req.Content.Description, req.Content.Branch, req.Content.IgnorePatterns)
+	if err != nil {
+		var notFound *calculate.BranchNotFoundError
+		switch {
+		case errors.As(err, &notFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error(), "available_branches": notFound.AvailableBranches})
+		case strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case strings.Contains(err.Error(), "invalid"):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, codebase)
+}
+
+// GetStats reports the storage usage of a codebase with a per-branch breakdown
+func (h *CodebaseHandler) GetStats(c *gin.Context) {
+	var req GetStatsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	usage, err := h.usageService.GetCodebaseUsage(req.Positions.CodebaseID, req.Content.Refresh)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, usage)
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"main/core"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// postJSON calls handler with a JSON request body.
+func postJSON(handler gin.HandlerFunc, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	handler(c)
+	return rec
+}
+
+func TestUpdateCodebase(t *testing.T) {
+	core.SetProvidersForTesting(core.NewMemoryProvider(), core.NewMemoryStorage())
+	codebase := uploadSnapshot(t, "update", map[string]string{"a.txt": "main"})
+	postSnapshot(t, codebase.ID, "dev", "d1", map[string]string{"a.txt": "dev"})
+	update := NewCodebaseHandler().UpdateCodebase
+
+	if rec := postJSON(update, fmt.Sprintf(`{"positions":{"codebase_id":%q},"content":{}}`, codebase.ID)); rec.Code != http.StatusBadRequest {
+		t.Errorf("empty update = %d %s, want 400", rec.Code, rec.Body.String())
+	}
+
+	rec := postJSON(update, fmt.Sprintf(`{"positions":{"codebase_id":%q},"content":{"branch":"release"}}`, codebase.ID))
+	var missing struct {
+		AvailableBranches []string `json:"available_branches"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &missing)
+	if rec.Code != http.StatusNotFound || strings.Join(missing.AvailableBranches, ",") != "main,dev" {
+		t.Errorf("default branch set to a missing branch = %d %s, want 404 listing main and dev", rec.Code, rec.Body.String())
+	}
+
+	rec = postJSON(update, fmt.Sprintf(`{"positions":{"codebase_id":%q},"content":{"description":"fixed typo","branch":"dev"}}`, codebase.ID))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update = %d %s", rec.Code, rec.Body.String())
+	}
+	stored, err := core.GetProvider().GetCodebaseByID(codebase.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Description != "fixed typo" || stored.Branch != "dev" || !stored.UpdatedAt.After(codebase.UpdatedAt) {
+		t.Errorf("stored codebase = %+v, want the new description and branch with UpdatedAt bumped", stored)
+	}
+
+	// Fields left out keep their value
+	rec = postJSON(update, fmt.Sprintf(`{"positions":{"codebase_id":%q},"content":{"description":""}}`, codebase.ID))
+	if stored, _ = core.GetProvider().GetCodebaseByID(codebase.ID); rec.Code != http.StatusOK || stored.Description != "" || stored.Branch != "dev" {
+		t.Errorf("clearing the description = %d, stored %+v, want the branch kept", rec.Code, stored)
+	}
+
+	if rec := postJSON(update, `{"positions":{"codebase_id":"missing"},"content":{"description":"x"}}`); rec.Code != http.StatusNotFound {
+		t.Errorf("update of a missing codebase = %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"main/calculate"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DiffHandler compares versions
+type DiffHandler struct {
+	service *calculate.DiffService
+}
+
+func NewDiffHandler() *DiffHandler {
+	return &DiffHandler{
+		service: calculate.NewDiffService(),
+	}
+}
+
+// GetDiff lists the files added, deleted and modified between two versions
+func (h *DiffHandler) GetDiff(c *gin.Context) {
+	var req DiffRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	from, ok := resolveSelector(c, req.Positions.CodebaseID, req.Content.From)
+	if !ok {
+		return
+	}
+	to, ok := resolveSelector(c, req.Positions.CodebaseID, req.Content.To)
+	if !ok {
+		return
+	}
+
+	diff, err := h.service.Diff(req.Positions.CodebaseID, from, to)
+	if err != nil {
+		writeVersionLookupError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, diff)
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"main/calculate"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EphemeralHandler handles lifetime requests for temporary codebases
+type EphemeralHandler struct {
+	service *calculate.EphemeralService
+}
+
+func NewEphemeralHandler() *EphemeralHandler {
+	return &EphemeralHandler{
+		service: calculate.NewEphemeralService(),
+	}
+}
+
+// writeEphemeralError maps ephemeral codebase errors to status codes
+func writeEphemeralError(c *gin.Context, err error) {
+	switch {
+	case strings.Contains(err.Error(), "invalid"):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case strings.Contains(err.Error(), "not found"):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// ExtendTTL keeps an ephemeral codebase alive for ttl_seconds from now
+func (h *EphemeralHandler) ExtendTTL(c *gin.Context) {
+	var req ExtendEphemeralCodebaseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	codebase, err := h.service.ExtendTTL(req.Positions.CodebaseID, time.Duration(req.Content.TTLSeconds)*time.Second)
+	if err != nil {
+		writeEphemeralError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, codebase)
+}
+
+// Release purges an ephemeral codebase immediately
+func (h *EphemeralHandler) Release(c *gin.Context) {
+	var req ReleaseEphemeralCodebaseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	if err := h.service.Release(req.Positions.CodebaseID); err != nil {
+		writeEphemeralError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Ephemeral codebase released"})
+}
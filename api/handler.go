@@ -1,31 +1,52 @@
 package api
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"main/calculate"
+	"main/core"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
-
-	"mime/multipart"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type SnapshotHandler struct {
 	uploadService *calculate.UploadService
+	jobService    *calculate.SnapshotJobService
+	gitService    *calculate.GitImportService
+	idempotency   *calculate.IdempotencyService
 }
 
 func NewSnapshotHandler() *SnapshotHandler {
 	return &SnapshotHandler{
 		uploadService: calculate.NewUploadService(),
+		jobService:    calculate.NewSnapshotJobService(),
+		gitService:    calculate.NewGitImportService(),
+		idempotency:   calculate.NewIdempotencyService(),
 	}
 }
 
 func (h *SnapshotHandler) CreateSnapshot(c *gin.Context) {
-	// 1. Parse multipart/form-data
+	// 1. Parse multipart/form-data, giving up as soon as it holds more files than a snapshot may have
+	limiter := limitSnapshotParts(c.Request)
 	form, err := c.MultipartForm()
+	if limiter != nil && limiter.exceeded {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf(
+			"snapshot too large: the upload holds more than %d files, the limit per snapshot; split the tree "+
+				"across several snapshots, e.g. one incremental snapshot per part through /codebases/snapshots/session/*", limiter.limit)})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid multipart/form-data: " + err.Error()})
 		return
@@ -44,57 +65,352 @@ func (h *SnapshotHandler) CreateSnapshot(c *gin.Context) {
 		return
 	}
 
+	// Reject oversized trees before any file is processed
+	received := 0
+	for _, fileHeaders := range form.File {
+		received += len(fileHeaders)
+	}
+	if err := calculate.CheckSnapshotFileCount(received); err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	}
+
 	// 3. Get files
-	files := make(map[string]*multipart.FileHeader)
+	files := make(map[string]*calculate.SnapshotFile)
 	for key, fileHeaders := range form.File {
 		if len(fileHeaders) > 0 {
-			files[key] = fileHeaders[0]
+			files[key] = calculate.UploadedFile(fileHeaders[0])
 		}
 	}
 
-	if len(files) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No files found in request"})
+	// Without files the server may read them from codebase_path, when local snapshots are enabled
+	local := len(files) == 0 && req.Content.CodebasePath != "" && calculate.LocalSnapshotsEnabled()
+	if len(files) == 0 && !local && !emptySnapshotAllowed(req.Content) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No files found in request (set allow_empty to record an empty snapshot)"})
 		return
 	}
 
-	// 4. Set default values
-	branch := req.Content.Branch
-	if branch == "" {
-		branch = "main"
+	// A retry carrying the key of an earlier snapshot gets its response instead of a new version
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		key = req.Content.IdempotencyKey
 	}
-	version := req.Content.Version
-	if version == "" {
-		version = "v1"
+	if key != "" && req.Content.Async {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "idempotency keys are not supported with async, the job ID identifies the snapshot"})
+		return
 	}
-	message := req.Content.Message
-	autoLinkage := req.Content.AutoLinkage
 
-	// 5. Convert BranchFrom parameter
-	var branchFrom *calculate.BranchFrom
-	if req.Content.BranchFrom != nil {
-		branchFrom = &calculate.BranchFrom{
-			Branch:  req.Content.BranchFrom.Branch,
-			Version: req.Content.BranchFrom.Version,
+	// 4. Call refactored service (an empty branch means the codebase's default branch)
+	version, branchFrom, opts := snapshotParams(req.Content)
+	opts.Author = snapshotAuthor(c, opts.Author)
+	if local {
+		h.createLocalSnapshot(c, req, key, version, branchFrom, opts)
+		return
+	}
+	if req.Content.Async {
+		// Stage the parts and answer with the job, the snapshot is processed in the background
+		job, err := h.jobService.Submit(req.Positions.CodebaseID, version, req.Content.Branch, req.Content.Message, files, branchFrom, req.Content.AutoLinkage, opts)
+		if err != nil {
+			writeSnapshotError(c, err)
+			return
+		}
+		c.JSON(http.StatusAccepted, job)
+		return
+	}
+	h.writeSnapshot(c, req, key, files, func() (*core.SnapshotResponse, error) {
+		return h.uploadService.ProcessSnapshot(
+			req.Positions.CodebaseID,
+			version,
+			req.Content.Branch,
+			req.Content.Message,
+			files,
+			branchFrom,              // Pass branch source information
+			req.Content.AutoLinkage, // Pass automatic lineage flag
+			opts,
+		)
+	})
+}
+
+// partLimitReader fails reading a multipart body once it holds more than limit files besides the
+// metadata part, so an upload over max_files_per_snapshot is refused before its files are spooled to
+// disk. It counts the boundary delimiters as they stream past.
+type partLimitReader struct {
+	r         io.ReadCloser
+	delimiter []byte
+	limit     int
+	seen      int
+	tail      []byte // the end of the data read so far, for a delimiter split across reads
+	exceeded  bool
+}
+
+var errTooManyParts = errors.New("too many files in the upload")
+
+// limitSnapshotParts wraps the body of a multipart request when the server limits the files per
+// snapshot, and returns nil otherwise.
+func limitSnapshotParts(req *http.Request) *partLimitReader {
+	limit := core.GetConfig().MaxFilesPerSnapshot
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if limit <= 0 || err != nil || params["boundary"] == "" {
+		return nil
+	}
+	r := &partLimitReader{
+		r:         req.Body,
+		delimiter: []byte("\r\n--" + params["boundary"]),
+		limit:     limit,
+		tail:      []byte("\r\n"), // the first delimiter starts the body without a line break
+	}
+	req.Body = r
+	return r
+}
+
+func (r *partLimitReader) Read(p []byte) (int, error) {
+	if r.exceeded {
+		return 0, errTooManyParts
+	}
+	n, err := r.r.Read(p)
+	data := append(r.tail, p[:n]...)
+	// A delimiter found here ends in the new data, the tail is shorter than one
+	r.seen += bytes.Count(data, r.delimiter)
+	if keep := len(r.delimiter) - 1; len(data) > keep {
+		data = data[len(data)-keep:]
+	}
+	r.tail = append(r.tail[:0], data...)
+	// Every part starts with a delimiter and one more closes the body: the metadata part, the files and the end
+	if r.seen > r.limit+2 {
+		r.exceeded = true
+		return 0, errTooManyParts
+	}
+	return n, err
+}
+
+func (r *partLimitReader) Close() error {
+	return r.r.Close()
+}
+
+// writeSnapshot runs a snapshot and writes its response. With an idempotency key the snapshot runs
+// only if the key wasn't recorded for the codebase; otherwise the recorded response is written again,
+// marked with the Idempotent-Replayed header.
+func (h *SnapshotHandler) writeSnapshot(c *gin.Context, req CreateSnapshotRequest, key string, files map[string]*calculate.SnapshotFile, snapshot func() (*core.SnapshotResponse, error)) {
+	if key == "" {
+		resp, err := snapshot()
+		if err != nil {
+			writeSnapshotError(c, err)
+			return
 		}
+		c.JSON(http.StatusOK, resp)
+		return
 	}
 
-	// 6. Call refactored service
-	resp, err := h.uploadService.ProcessSnapshot(
-		req.Positions.CodebaseID,
-		version,
-		branch,
-		message,
-		files,
-		branchFrom,  // Pass branch source information
-		autoLinkage, // Pass automatic lineage flag
-	)
+	// The key itself isn't part of the request it identifies, whether it came as header or field
+	req.Content.IdempotencyKey = ""
+	metadata, err := json.Marshal(req)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	resp, replayed, err := h.idempotency.Snapshot(req.Positions.CodebaseID, key, calculate.SnapshotFingerprint(metadata, files), snapshot)
+	if err != nil {
+		writeSnapshotError(c, err)
+		return
+	}
+	if replayed {
+		c.Header("Idempotent-Replayed", "true")
+	}
 	c.JSON(http.StatusOK, resp)
 }
 
+// createLocalSnapshot snapshots the server directory named by codebase_path
+func (h *SnapshotHandler) createLocalSnapshot(c *gin.Context, req CreateSnapshotRequest, key, version string, branchFrom *calculate.BranchFrom, opts calculate.SnapshotOptions) {
+	if req.Content.Async {
+		job, err := h.jobService.SubmitLocal(req.Positions.CodebaseID, req.Content.CodebasePath, version, req.Content.Branch, req.Content.Message, branchFrom, req.Content.AutoLinkage, opts)
+		if err != nil {
+			writeSnapshotError(c, err)
+			return
+		}
+		c.JSON(http.StatusAccepted, job)
+		return
+	}
+	h.writeSnapshot(c, req, key, nil, func() (*core.SnapshotResponse, error) {
+		return h.uploadService.ProcessLocalSnapshot(req.Positions.CodebaseID, req.Content.CodebasePath, version, req.Content.Branch, req.Content.Message, branchFrom, req.Content.AutoLinkage, opts)
+	})
+}
+
+// ImportGit creates a snapshot from a commit of a git repository
+func (h *SnapshotHandler) ImportGit(c *gin.Context) {
+	var req ImportGitSnapshotRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	content := req.Content
+	version, branchFrom, opts := snapshotParams(CreateSnapshotContent{
+		Version:         content.Version,
+		BranchFrom:      content.BranchFrom,
+		InferBranchFrom: content.InferBranchFrom,
+		Attributes:      content.Attributes,
+		Modes:           content.Modes,
+		AllowEmpty:      content.AllowEmpty,
+		Durable:         content.Durable,
+		Overwrite:       content.Overwrite,
+		Ignore:          content.Ignore,
+		Directories:     content.Directories,
+		FailureMode:     content.FailureMode,
+		Author:          content.Author,
+	})
+	opts.Author = snapshotAuthor(c, opts.Author)
+	src := calculate.GitImport{URL: content.URL, Ref: content.Ref}
+	if content.Async {
+		job, err := h.jobService.SubmitGit(req.Positions.CodebaseID, src, version, content.Branch, content.Message, branchFrom, content.AutoLinkage, opts)
+		if err != nil {
+			writeSnapshotError(c, err)
+			return
+		}
+		c.JSON(http.StatusAccepted, job)
+		return
+	}
+	resp, err := h.gitService.Import(req.Positions.CodebaseID, src, version, content.Branch, content.Message, branchFrom, content.AutoLinkage, opts)
+	if err != nil {
+		writeSnapshotError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// GetJob returns the state and progress of an asynchronous snapshot, with its result once it finished
+func (h *SnapshotHandler) GetJob(c *gin.Context) {
+	var req GetJobRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	job, err := h.jobService.Get(req.Positions.JobID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// emptySnapshotAllowed reports whether a snapshot without uploaded files is intended: an explicit empty
+// snapshot, an incremental one, one whose manifest lists files the server has already or one that only
+// records directories
+func emptySnapshotAllowed(content CreateSnapshotContent) bool {
+	return content.AllowEmpty || content.Base != nil || len(content.Manifest) > 0 || len(content.Directories) > 0
+}
+
+// snapshotParams applies the defaults of a snapshot request: the branch source and the options. An empty
+// version name is left to the service, which generates the next one of the branch
+func snapshotParams(content CreateSnapshotContent) (string, *calculate.BranchFrom, calculate.SnapshotOptions) {
+	var branchFrom *calculate.BranchFrom
+	if content.BranchFrom != nil {
+		branchFrom = &calculate.BranchFrom{
+			Branch:  content.BranchFrom.Branch,
+			Version: content.BranchFrom.Version,
+		}
+	}
+	return content.Version, branchFrom, calculate.SnapshotOptions{
+		Manifest:        content.Manifest,
+		InferBranchFrom: content.InferBranchFrom,
+		Attributes:      content.Attributes,
+		Modes:           content.Modes,
+		AllowEmpty:      content.AllowEmpty,
+		Durable:         content.Durable,
+		Overwrite:       content.Overwrite,
+		Base:            content.Base,
+		Deleted:         content.Deleted,
+		Ignore:          content.Ignore,
+		Directories:     content.Directories,
+		FailureMode:     content.FailureMode,
+		Author:          content.Author,
+	}
+}
+
+// snapshotAuthor returns the author given in the request content, or else the one of the X-CVCS-Author header
+func snapshotAuthor(c *gin.Context, author *core.VersionAuthor) *core.VersionAuthor {
+	if author != nil {
+		return author
+	}
+	return calculate.ParseAuthorHeader(c.GetHeader("X-CVCS-Author"))
+}
+
+// writeSnapshotError maps the errors of ProcessSnapshot to status codes
+func writeSnapshotError(c *gin.Context, err error) {
+	if writeNameError(c, err) {
+		return
+	}
+	var manifestErr *calculate.ManifestError
+	var portabilityErr *calculate.PortabilityError
+	var attributeErr *calculate.AttributeError
+	var localPathErr *calculate.LocalPathError
+	var gitErr *calculate.GitImportError
+	var filesErr *calculate.SnapshotFilesError
+	var existsErr *core.VersionExistsError
+	var notFound *calculate.VersionNotFoundError
+	var keyReuseErr *calculate.IdempotencyKeyReuseError
+	var versionGoneErr *calculate.IdempotencyVersionGoneError
+	status, body := http.StatusInternalServerError, gin.H{"error": err.Error()}
+	switch {
+	case errors.As(err, &notFound):
+		status, body["details"] = http.StatusNotFound, notFound
+	case strings.HasPrefix(err.Error(), "base version:") && strings.Contains(err.Error(), "not found"):
+		status = http.StatusNotFound
+	case errors.As(err, &existsErr):
+		status, body["existing_version_id"] = http.StatusConflict, existsErr.VersionID
+	case errors.As(err, &manifestErr):
+		status, body["manifest"] = http.StatusBadRequest, manifestErr
+	case errors.As(err, &portabilityErr):
+		status, body["paths"] = http.StatusBadRequest, portabilityErr.Issues
+	case errors.As(err, &attributeErr):
+		status, body["attributes"] = http.StatusBadRequest, attributeErr
+	case errors.As(err, &localPathErr):
+		status, body["unreadable"] = http.StatusBadRequest, localPathErr.Unreadable
+	case errors.As(err, &filesErr):
+		// Files that couldn't be read point at the upload, files that couldn't be stored at the server
+		if filesErr.ReadFailuresOnly() {
+			status = http.StatusBadRequest
+		}
+		body["failed_files"] = filesErr.Failed
+	case errors.As(err, &keyReuseErr):
+		status, body["idempotency_key"] = http.StatusConflict, keyReuseErr
+	case errors.As(err, &versionGoneErr):
+		status, body["idempotency_key"] = http.StatusConflict, versionGoneErr
+	case errors.As(err, &gitErr):
+		status, body["url"], body["reason"] = http.StatusBadGateway, gitErr.URL, gitErr.Reason
+	case strings.Contains(err.Error(), "requires a manifest"), strings.Contains(err.Error(), "invalid snapshot"):
+		status = http.StatusBadRequest
+	case strings.Contains(err.Error(), "too large"):
+		status = http.StatusRequestEntityTooLarge
+	}
+	// Objects of the failed snapshot that couldn't be deleted again
+	var rollbackErr *calculate.RollbackError
+	if errors.As(err, &rollbackErr) {
+		body["rollback"] = rollbackErr
+	}
+	c.JSON(status, body)
+}
+
+// NegotiateSnapshot reports which files of a manifest the server lacks, so the snapshot uploads only those
+func (h *SnapshotHandler) NegotiateSnapshot(c *gin.Context) {
+	var req NegotiateSnapshotRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	result, err := h.uploadService.NegotiateSnapshot(req.Positions.CodebaseID, req.Content.Manifest)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
 type InitHandler struct {
 	service *calculate.InitService
 }
@@ -112,9 +428,19 @@ func (h *InitHandler) Initialize(c *gin.Context) {
 		return
 	}
 
-	codebase, err := h.service.InitializeCodebase(req.Content.Name, req.Content.Description, req.Content.Branch)
+	codebase, err := h.service.InitializeCodebase(req.Content.Name, req.Content.Description, req.Content.Branch, req.Content.Settings, calculate.InitOptions{
+		Ephemeral: req.Content.Ephemeral,
+		TTL:       time.Duration(req.Content.TTLSeconds) * time.Second,
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if writeNameError(c, err) {
+			return
+		}
+		if strings.Contains(err.Error(), "invalid") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
 		return
 	}
 	c.JSON(http.StatusOK, codebase)
@@ -138,22 +464,79 @@ func (h *ArchiveHandler) GetCodebaseArchive(c *gin.Context) {
 		return
 	}
 
+	format, err := calculate.ParseArchiveFormat(req.Content.Format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	codebaseName, err := h.service.GetCodebaseName(req.Positions.CodebaseID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Specified codebase not found"})
 		return
 	}
 
-	zipPath, err := h.service.CreateArchiveForVersion(req.Positions.CodebaseID, req.Content.Branch, req.Content.Version)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	id, ok := resolveSelector(c, req.Positions.CodebaseID, VersionSelector{Branch: req.Content.Branch, Version: req.Content.Version, Tag: req.Content.Tag, VersionID: req.Content.VersionID})
+	if !ok {
+		return
+	}
+
+	// The name of the file is also the top-level directory of tarballs
+	archiveName := fmt.Sprintf("%s-%s-%s", codebaseName, sanitizeFilenamePart(id.Branch), sanitizeFilenamePart(id.Version))
+	if req.Content.Tag != "" {
+		archiveName = fmt.Sprintf("%s-%s", codebaseName, sanitizeFilenamePart(req.Content.Tag))
+	}
+	if prefix := calculate.NormalizePathPrefix(req.Content.PathPrefix); prefix != "" {
+		archiveName += "-" + sanitizeFilenamePart(strings.TrimSuffix(prefix, "/"))
+	}
+	archiveFilename := archiveName + "." + format.Extension()
+
+	if core.GetConfig().SpoolArchives {
+		archivePath, corrupt, err := h.service.CreateArchiveForVersion(req.Positions.CodebaseID, id.Branch, id.Version, req.Content.PathPrefix, format, archiveName, req.Content.AllowPartial)
+		if err != nil {
+			writeVersionLookupError(c, err)
+			return
+		}
+		defer os.Remove(archivePath)
+		if len(corrupt) > 0 {
+			c.Header("X-CVCS-Corrupt-Files", strings.Join(corrupt, ","))
+		}
+		c.Header("Content-Disposition", "attachment; filename="+archiveFilename)
+		c.Header("Content-Type", format.ContentType())
+		c.File(archivePath)
 		return
 	}
-	defer os.Remove(zipPath)
 
-	archiveFilename := fmt.Sprintf("%s-%s-%s.zip", codebaseName, req.Content.Branch, req.Content.Version)
-	c.Header("Content-Disposition", "attachment; filename="+archiveFilename)
-	c.File(zipPath)
+	archive, err := h.service.PrepareArchive(req.Positions.CodebaseID, id.Branch, id.Version, req.Content.PathPrefix)
+	if err != nil {
+		writeVersionLookupError(c, err)
+		return
+	}
+	header := c.Writer.Header()
+	header.Set("Content-Disposition", "attachment; filename="+archiveFilename)
+	header.Set("Content-Type", format.ContentType())
+	if req.Content.AllowPartial {
+		// The corrupt files are only known once the archive is written
+		header.Set("Trailer", "X-CVCS-Corrupt-Files")
+	}
+	c.Status(http.StatusOK)
+	corrupt, err := h.service.WriteArchive(c.Writer, archive, format, archiveName, req.Content.AllowPartial)
+	if err != nil {
+		if !c.Writer.Written() {
+			// Nothing was sent yet, so the client still gets the error instead of a broken archive
+			header.Del("Content-Disposition")
+			header.Del("Content-Type")
+			header.Del("Trailer")
+			writeVersionLookupError(c, fmt.Errorf("archive creation failed: %w", err))
+			return
+		}
+		// Headers and part of the archive are sent, the client sees an archive without its central directory or end marker
+		log.Printf("Archive download of %s/%s aborted (codebaseID: %s): %v", id.Branch, id.Version, req.Positions.CodebaseID, err)
+		return
+	}
+	if len(corrupt) > 0 {
+		header.Set("X-CVCS-Corrupt-Files", strings.Join(corrupt, ","))
+	}
 }
 
 func (h *ArchiveHandler) GetSingleFile(c *gin.Context) {
@@ -163,24 +546,268 @@ func (h *ArchiveHandler) GetSingleFile(c *gin.Context) {
 		return
 	}
 
-	fileContent, fileName, err := h.service.GetSingleFile(req.Positions.CodebaseID, req.Content.Branch, req.Content.Version, req.Content.Path)
+	disposition := req.Content.Disposition
+	switch disposition {
+	case "":
+		disposition = "attachment"
+	case "attachment", "inline":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: disposition must be inline or attachment"})
+		return
+	}
+	id, ok := resolveSelector(c, req.Positions.CodebaseID, VersionSelector{Branch: req.Content.Branch, Version: req.Content.Version, Tag: req.Content.Tag, VersionID: req.Content.VersionID})
+	if !ok {
+		return
+	}
+
+	file, err := h.service.GetSingleFile(req.Positions.CodebaseID, id.Branch, id.Version, req.Content.Path)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		writeVersionLookupError(c, err)
+		return
+	}
+	defer file.Content.Close()
+
+	// Sniffing reads the first block, so a small corrupt file still fails with an error response
+	body := bufio.NewReaderSize(file.Content, 512)
+	head, err := body.Peek(512)
+	if err != nil && err != io.EOF {
+		writeVersionLookupError(c, fmt.Errorf("file download failed: %w", err))
+		return
+	}
+
+	if len(file.Attrs) > 0 {
+		encoded, _ := json.Marshal(file.Attrs)
+		c.Header("X-CVCS-Attributes", string(encoded))
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("%s; filename=\"%s\"", disposition, file.Name))
+	// A read error after this point cuts the response short of its Content-Length
+	c.DataFromReader(http.StatusOK, file.Size, detectContentType(file.Name, head), body, nil)
+	if err := c.Errors.Last(); err != nil {
+		log.Printf("Download of %s aborted: %v", req.Content.Path, err.Err)
+	}
+}
+
+// GetFileBatch streams a zip holding the requested files of one version
+func (h *ArchiveHandler) GetFileBatch(c *gin.Context) {
+	var req GetFileBatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+	codebaseName, err := h.service.GetCodebaseName(req.Positions.CodebaseID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Specified codebase not found"})
+		return
+	}
+	id, ok := resolveSelector(c, req.Positions.CodebaseID, VersionSelector{Branch: req.Content.Branch, Version: req.Content.Version, Tag: req.Content.Tag, VersionID: req.Content.VersionID})
+	if !ok {
+		return
+	}
+
+	batch, err := h.service.GetFiles(req.Positions.CodebaseID, id.Branch, id.Version, req.Content.Paths, req.Content.Strict)
+	if err != nil {
+		var pathErr *calculate.PathNotFoundError
+		switch {
+		case errors.As(err, &pathErr):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error(), "path": pathErr.Path})
+		case strings.Contains(err.Error(), "invalid"):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			writeVersionLookupError(c, err)
+		}
+		return
+	}
+
+	if len(batch.Missing) > 0 {
+		c.Header("X-Missing-Files", strings.Join(batch.Missing, ","))
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s-%s-%s-files.zip", codebaseName, sanitizeFilenamePart(id.Branch), sanitizeFilenamePart(id.Version)))
+	c.Header("Content-Type", "application/zip")
+	c.Status(http.StatusOK)
+
+	writer := zip.NewWriter(c.Writer)
+	for _, f := range batch.Files {
+		header := &zip.FileHeader{Name: f.Path, Method: zip.Deflate}
+		header.SetMode(f.Mode)
+		entry, err := writer.CreateHeader(header)
+		if err == nil {
+			_, err = entry.Write(f.Content)
+		}
+		if err != nil {
+			// Headers are already sent, the client sees a truncated archive
+			log.Printf("Failed to stream file batch (codebaseID: %s): %v", req.Positions.CodebaseID, err)
+			return
+		}
+	}
+	if err := writer.Close(); err != nil {
+		log.Printf("Failed to finish file batch archive (codebaseID: %s): %v", req.Positions.CodebaseID, err)
+	}
+}
+
+// detectContentType guesses the MIME type of a file from its extension, falling back to sniffing its content.
+func detectContentType(fileName string, content []byte) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(fileName)); contentType != "" {
+		return contentType
+	}
+	return http.DetectContentType(content)
+}
+
+// StatFile returns the index record of a single file and whether its content is present in storage
+func (h *ArchiveHandler) StatFile(c *gin.Context) {
+	var req StatFileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	id, ok := resolveSelector(c, req.Positions.CodebaseID, VersionSelector{Branch: req.Content.Branch, Version: req.Content.Version, Tag: req.Content.Tag, VersionID: req.Content.VersionID})
+	if !ok {
+		return
+	}
+
+	stat, err := h.service.StatFile(req.Positions.CodebaseID, id.Branch, id.Version, req.Content.Path)
+	if err != nil {
+		var pathErr *calculate.PathNotFoundError
+		if errors.As(err, &pathErr) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error(), "path": pathErr.Path})
+			return
+		}
+		writeVersionLookupError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, stat)
+}
+
+// SearchFiles lists the files of a version matching a glob pattern and attribute filters
+func (h *ArchiveHandler) SearchFiles(c *gin.Context) {
+	var req SearchFilesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	result, err := h.service.SearchFiles(req.Positions.CodebaseID, req.Content.Branch, req.Content.Version,
+		req.Content.Pattern, req.Content.CaseInsensitive, req.Content.Filters)
+	if err != nil {
+		if strings.Contains(err.Error(), "invalid") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		writeVersionLookupError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// GetTree returns the file tree of a version without downloading its content
+func (h *ArchiveHandler) GetTree(c *gin.Context) {
+	var req GetTreeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	tree, err := h.service.GetTree(req.Positions.CodebaseID, req.Content.Branch, req.Content.Version, req.Content.Nested)
+	if err != nil {
+		writeVersionLookupError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, tree)
+}
+
+// GetArchivePortability lists the paths of a version that can't be extracted on every platform
+func (h *ArchiveHandler) GetArchivePortability(c *gin.Context) {
+	var req GetArchiveRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	id, ok := resolveSelector(c, req.Positions.CodebaseID, VersionSelector{Branch: req.Content.Branch, Version: req.Content.Version, Tag: req.Content.Tag, VersionID: req.Content.VersionID})
+	if !ok {
 		return
 	}
 
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileName))
-	c.Data(http.StatusOK, "application/octet-stream", fileContent)
+	issues, err := h.service.CheckPortability(req.Positions.CodebaseID, id.Branch, id.Version)
+	if err != nil {
+		writeVersionLookupError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"portability_warnings": issues})
+}
+
+// sanitizeFilenamePart replaces every character that isn't safe in a download filename with '_'.
+func sanitizeFilenamePart(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// resolveSelector turns a version selector into the branch and label of the version it addresses.
+// On failure the error response is written and false returned.
+func resolveSelector(c *gin.Context, codebaseID string, sel VersionSelector) (calculate.VersionIdentifier, bool) {
+	id, err := calculate.LocateVersion(codebaseID, calculate.VersionSelector{
+		Branch:    sel.Branch,
+		Version:   sel.Version,
+		Tag:       sel.Tag,
+		VersionID: sel.VersionID,
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "invalid version selector") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		} else {
+			writeVersionLookupError(c, err)
+		}
+		return calculate.VersionIdentifier{}, false
+	}
+	return id, true
+}
+
+// writeNameError answers 400 with the field of an invalid branch or version name and reports whether
+// err was one
+func writeNameError(c *gin.Context, err error) bool {
+	var nameErr *calculate.NameError
+	if !errors.As(err, &nameErr) {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "field": nameErr.Field})
+	return true
+}
+
+// writeVersionLookupError maps errors of requests addressing a version by branch and label.
+// When the label exists on another branch the response includes where it was found.
+func writeVersionLookupError(c *gin.Context, err error) {
+	if writeNameError(c, err) {
+		return
+	}
+	var notFound *calculate.VersionNotFoundError
+	var corrupt *calculate.CorruptObjectError
+	switch {
+	case errors.As(err, &notFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error(), "details": notFound})
+	case errors.As(err, &corrupt):
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "quarantined": corrupt.StorageKey})
+	case strings.Contains(err.Error(), "not found"):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
 }
 
 // DeleteHandler handles delete requests
 type DeleteHandler struct {
-	service *calculate.DeleteService
+	service      *calculate.DeleteService
+	trashService *calculate.TrashService
 }
 
 func NewDeleteHandler() *DeleteHandler {
 	return &DeleteHandler{
-		service: calculate.NewDeleteService(),
+		service:      calculate.NewDeleteService(),
+		trashService: calculate.NewTrashService(),
 	}
 }
 
@@ -191,6 +818,23 @@ func (h *DeleteHandler) DeleteCodebase(c *gin.Context) {
 		return
 	}
 
+	if req.Content.Trash {
+		codebase, err := h.trashService.TrashCodebase(req.Positions.CodebaseID)
+		if err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":  fmt.Sprintf("Codebase %s has been moved to trash", req.Positions.CodebaseID),
+			"codebase": codebase,
+		})
+		return
+	}
+
 	if err := h.service.DeleteCodebase(req.Positions.CodebaseID); err != nil {
 		// Distinguish between "not found" and "other internal errors"
 		if strings.Contains(err.Error(), "not found") || strings.Contains(err.Error(), "找不到") {
@@ -204,6 +848,88 @@ func (h *DeleteHandler) DeleteCodebase(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Codebase %s has been successfully deleted", req.Positions.CodebaseID)})
 }
 
+// DeleteVersion deletes a single version and reports how its lineage edges were handled
+func (h *DeleteHandler) DeleteVersion(c *gin.Context) {
+	var req DeleteVersionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	result, err := h.service.DeleteVersion(req.Positions.CodebaseID, req.Content.Branch, req.Content.Version)
+	if err != nil {
+		if writeNameError(c, err) {
+			return
+		}
+		if strings.Contains(err.Error(), "invalid") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		writeVersionLookupError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// DeleteBranch deletes every version of a branch and reports what was reclaimed
+func (h *DeleteHandler) DeleteBranch(c *gin.Context) {
+	var req DeleteBranchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	result, err := h.service.DeleteBranch(req.Positions.CodebaseID, req.Content.Branch, req.Content.Force)
+	if err != nil {
+		var notFound *calculate.BranchNotFoundError
+		switch {
+		case errors.As(err, &notFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error(), "available_branches": notFound.AvailableBranches})
+		case strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case strings.Contains(err.Error(), "invalid"):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// ListTrash reports trashed codebases, live versus trashed storage usage and the purge schedule
+func (h *DeleteHandler) ListTrash(c *gin.Context) {
+	report, err := h.trashService.GetTrashReport()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// RestoreCodebase takes a codebase out of the trash
+func (h *DeleteHandler) RestoreCodebase(c *gin.Context) {
+	var req RestoreCodebaseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	codebase, err := h.trashService.RestoreCodebase(req.Positions.CodebaseID)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case strings.Contains(err.Error(), "not in trash"):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, codebase)
+}
+
 // ConfigHandler handles configuration requests
 type ConfigHandler struct {
 	service *calculate.ConfigService
@@ -215,6 +941,11 @@ func NewConfigHandler() *ConfigHandler {
 	}
 }
 
+// GetConfig returns the effective server configuration
+func (h *ConfigHandler) GetConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, h.service.GetConfig())
+}
+
 func (h *ConfigHandler) UpdateStoragePath(c *gin.Context) {
 	var req UpdateStoragePathRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
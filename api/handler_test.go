@@ -0,0 +1,617 @@
+package api
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"main/calculate"
+	"main/core"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestWriteSnapshotErrorVersionExists(t *testing.T) {
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	existsErr := &core.VersionExistsError{Branch: "main", Version: "v2", VersionID: "old-id"}
+	writeSnapshotError(c, fmt.Errorf("failed to insert version and file indexes: %w", existsErr))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("status = %d, want 409", rec.Code)
+	}
+	var body struct {
+		ExistingVersionID string `json:"existing_version_id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.ExistingVersionID != "old-id" {
+		t.Errorf("body = %s, %v, want existing_version_id old-id", rec.Body.String(), err)
+	}
+}
+
+// Snapshots failing because of their files list them; failures reading the upload are the client's.
+func TestWriteSnapshotErrorFailedFiles(t *testing.T) {
+	for _, tt := range []struct {
+		failed []core.FailedFile
+		want   int
+	}{
+		{[]core.FailedFile{{Path: "a.txt", Stage: "read", Error: "unexpected EOF"}}, http.StatusBadRequest},
+		{[]core.FailedFile{{Path: "a.txt", Stage: "read", Error: "unexpected EOF"}, {Path: "b.bin", Stage: "store", Error: "disk full"}}, http.StatusInternalServerError},
+	} {
+		rec := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(rec)
+		writeSnapshotError(c, &calculate.SnapshotFilesError{Failed: tt.failed, Total: 3})
+		var body struct {
+			FailedFiles []core.FailedFile `json:"failed_files"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != tt.want || !reflect.DeepEqual(body.FailedFiles, tt.failed) {
+			t.Errorf("%v: %d %s, want %d listing the files", tt.failed, rec.Code, rec.Body.String(), tt.want)
+		}
+	}
+}
+
+// The author of the request body takes precedence over the X-CVCS-Author header.
+func TestSnapshotAuthor(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		body   *core.VersionAuthor
+		want   *core.VersionAuthor
+	}{
+		{"", nil, nil},
+		{"Jane Doe <jane@example.com>", nil, &core.VersionAuthor{Name: "Jane Doe", Email: "jane@example.com"}},
+		{"Jane Doe <jane@example.com>", &core.VersionAuthor{ClientID: "ci"}, &core.VersionAuthor{ClientID: "ci"}},
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+		if tt.header != "" {
+			c.Request.Header.Set("X-CVCS-Author", tt.header)
+		}
+		if got := snapshotAuthor(c, tt.body); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("header %q, body %+v: author = %+v, want %+v", tt.header, tt.body, got, tt.want)
+		}
+	}
+}
+
+// The errors of an incremental snapshot with a bad base answer 404 for a missing base version and 400 for
+// deleted paths that don't match it.
+func TestWriteSnapshotErrorIncremental(t *testing.T) {
+	core.SetProvidersForTesting(core.NewMemoryProvider(), core.NewMemoryStorage())
+	codebase := uploadSnapshot(t, "incremental", map[string]string{"a.txt": "alpha"})
+	for _, tt := range []struct {
+		opts calculate.SnapshotOptions
+		want int
+	}{
+		{calculate.SnapshotOptions{Base: &calculate.SnapshotBase{Version: "v9"}}, http.StatusNotFound},
+		{calculate.SnapshotOptions{Base: &calculate.SnapshotBase{Version: "v1"}, Deleted: []string{"b.txt"}}, http.StatusBadRequest},
+		{calculate.SnapshotOptions{Deleted: []string{"a.txt"}}, http.StatusBadRequest},
+	} {
+		_, err := calculate.NewUploadService().ProcessSnapshot(codebase.ID, "v2", "main", "", nil, nil, true, tt.opts)
+		if err == nil {
+			t.Fatalf("snapshot with %+v succeeded", tt.opts)
+		}
+		rec := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(rec)
+		writeSnapshotError(c, err)
+		if rec.Code != tt.want {
+			t.Errorf("%v: status = %d, want %d", err, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestNegotiateSnapshot(t *testing.T) {
+	core.SetProvidersForTesting(core.NewMemoryProvider(), core.NewMemoryStorage())
+	codebase := uploadSnapshot(t, "negotiate", map[string]string{"a.txt": "alpha"})
+	negotiate := NewSnapshotHandler().NegotiateSnapshot
+	hash := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+
+	rec := postJSON(negotiate, fmt.Sprintf(`{"positions":{"codebase_id":%q},"content":{"manifest":[
+		{"path":"a.txt","size":5,"hash":%q},{"path":"b.txt","size":4,"hash":%q}]}}`, codebase.ID, hash("alpha"), hash("beta")))
+	var result calculate.NegotiationResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("negotiate: %d %s", rec.Code, rec.Body.String())
+	}
+	want := calculate.NegotiationResult{MissingHashes: []string{hash("beta")}, MissingPaths: []string{"b.txt"}, KnownFiles: 1}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("negotiation = %+v, want %+v", result, want)
+	}
+
+	if rec := postJSON(negotiate, `{"positions":{"codebase_id":"missing"},"content":{"manifest":[]}}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown codebase: %d %s, want 404", rec.Code, rec.Body.String())
+	}
+	if rec := postJSON(negotiate, fmt.Sprintf(`{"positions":{"codebase_id":%q},"content":{}}`, codebase.ID)); rec.Code != http.StatusBadRequest {
+		t.Errorf("no manifest: %d %s, want 400", rec.Code, rec.Body.String())
+	}
+}
+
+// countingBody counts the bytes the handler reads from a request body.
+type countingBody struct {
+	r    io.Reader
+	read int
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.read += n
+	return n, err
+}
+
+func (b *countingBody) Close() error { return nil }
+
+// snapshotUpload builds a snapshot request with files parts of size bytes each.
+func snapshotUpload(t *testing.T, files, size int) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("metadata", `{"positions":{"codebase_id":"missing"},"content":{"version":"v1"}}`)
+	for i := 0; i < files; i++ {
+		part, err := writer.CreateFormFile(fmt.Sprintf("f%d.txt", i), fmt.Sprintf("f%d.txt", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(bytes.Repeat([]byte{'x'}, size))
+	}
+	writer.Close()
+	return &body, writer.FormDataContentType()
+}
+
+// An upload with more files than max_files_per_snapshot is refused while it is read, not after.
+func TestCreateSnapshotTooManyFiles(t *testing.T) {
+	core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), MaxFilesPerSnapshot: 3})
+	t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+
+	tests := []struct {
+		files    int
+		tooLarge bool
+	}{
+		{3, false}, // within the limit, refused later for the missing codebase
+		{4, true},
+		{50, true},
+	}
+	for _, tt := range tests {
+		upload, contentType := snapshotUpload(t, tt.files, 32<<10)
+		total := upload.Len()
+		body := &countingBody{r: upload}
+		rec := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(rec)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/codebases/snapshots/create", body)
+		c.Request.Header.Set("Content-Type", contentType)
+		NewSnapshotHandler().CreateSnapshot(c)
+
+		if got := rec.Code == http.StatusRequestEntityTooLarge; got != tt.tooLarge {
+			t.Errorf("%d files: status %d (%s), want 413 = %v", tt.files, rec.Code, rec.Body.String(), tt.tooLarge)
+			continue
+		}
+		if !tt.tooLarge {
+			continue
+		}
+		if !strings.Contains(rec.Body.String(), "/codebases/snapshots/session/") {
+			t.Errorf("%d files: error %s doesn't point to upload sessions", tt.files, rec.Body.String())
+		}
+		// Reading stops at the fifth part, the fourth file
+		if body.read > 5*(32<<10)+64<<10 {
+			t.Errorf("%d files: read %d of %d bytes before refusing the upload", tt.files, body.read, total)
+		}
+	}
+}
+
+// A retry with the Idempotency-Key header gets the first response again; the key with another body is
+// a conflict.
+func TestCreateSnapshotIdempotencyKey(t *testing.T) {
+	core.SetProvidersForTesting(core.NewMemoryProvider(), core.NewMemoryStorage())
+	codebase, err := calculate.NewInitService().InitializeCodebase("retried", "", "main", nil, calculate.InitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(version, content string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		writer.WriteField("metadata", fmt.Sprintf(`{"positions":{"codebase_id":%q},"content":{"branch":"main","version":%q}}`, codebase.ID, version))
+		part, _ := writer.CreateFormFile("a.txt", "a.txt")
+		part.Write([]byte(content))
+		writer.Close()
+		rec := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(rec)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/codebases/snapshots/create", &body)
+		c.Request.Header.Set("Content-Type", writer.FormDataContentType())
+		c.Request.Header.Set("Idempotency-Key", "build-1042")
+		NewSnapshotHandler().CreateSnapshot(c)
+		return rec
+	}
+	versionID := func(rec *httptest.ResponseRecorder) string {
+		var resp core.SnapshotResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Version == nil {
+			t.Fatalf("response %s: %v", rec.Body.String(), err)
+		}
+		return resp.Version.ID
+	}
+
+	first := post("v1", "alpha")
+	if first.Code != http.StatusOK || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first request: %d %s", first.Code, first.Body.String())
+	}
+	retry := post("v1", "alpha")
+	if retry.Code != http.StatusOK || retry.Header().Get("Idempotent-Replayed") != "true" || versionID(retry) != versionID(first) {
+		t.Errorf("retry: %d, replayed %q, %s, want the first version replayed", retry.Code, retry.Header().Get("Idempotent-Replayed"), retry.Body.String())
+	}
+	if versions, _ := core.GetProvider().ListVersions(codebase.ID); len(versions) != 1 {
+		t.Errorf("%d versions after the retry, want 1", len(versions))
+	}
+
+	for _, tt := range []struct{ version, content string }{{"v2", "alpha"}, {"v1", "longer content"}} {
+		rec := post(tt.version, tt.content)
+		var body struct {
+			Key struct {
+				Key       string `json:"key"`
+				VersionID string `json:"version_id"`
+			} `json:"idempotency_key"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		if rec.Code != http.StatusConflict || body.Key.Key != "build-1042" || body.Key.VersionID != versionID(first) {
+			t.Errorf("key reused for %s with %q: %d %s, want 409 naming the first version", tt.version, tt.content, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestCreateSnapshotAsync(t *testing.T) {
+	core.SetProvidersForTesting(core.NewMemoryProvider(), core.NewMemoryStorage())
+	core.SetConfigForTesting(core.AppConfig{StoragePath: t.TempDir()})
+	t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+	codebase, err := calculate.NewInitService().InitializeCodebase("async", "", "main", nil, calculate.InitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(idempotencyKey string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		writer.WriteField("metadata", fmt.Sprintf(`{"positions":{"codebase_id":%q},"content":{"branch":"main","version":"v1","async":true}}`, codebase.ID))
+		part, _ := writer.CreateFormFile("a.txt", "a.txt")
+		part.Write([]byte("alpha"))
+		writer.Close()
+		rec := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(rec)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/codebases/snapshots/create", &body)
+		c.Request.Header.Set("Content-Type", writer.FormDataContentType())
+		if idempotencyKey != "" {
+			c.Request.Header.Set("Idempotency-Key", idempotencyKey)
+		}
+		NewSnapshotHandler().CreateSnapshot(c)
+		return rec
+	}
+
+	if rec := post("build-1"); rec.Code != http.StatusBadRequest {
+		t.Errorf("async with an idempotency key: %d %s, want 400", rec.Code, rec.Body.String())
+	}
+	rec := post("")
+	var job calculate.SnapshotJob
+	if err := json.Unmarshal(rec.Body.Bytes(), &job); rec.Code != http.StatusAccepted || err != nil || job.ID == "" {
+		t.Fatalf("async snapshot: %d %s, want 202 with the job", rec.Code, rec.Body.String())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := calculate.WaitForSnapshotJobs(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	getJob := NewSnapshotHandler().GetJob
+	rec = postJSON(getJob, fmt.Sprintf(`{"positions":{"job_id":%q}}`, job.ID))
+	if err := json.Unmarshal(rec.Body.Bytes(), &job); rec.Code != http.StatusOK || err != nil || job.State != calculate.SnapshotJobSucceeded || job.Result == nil {
+		t.Fatalf("finished job: %d %s", rec.Code, rec.Body.String())
+	}
+	if v, err := core.GetProvider().GetVersion(codebase.ID, "main", "v1"); err != nil || v.ID != job.Result.Version.ID {
+		t.Errorf("v1 = %v, %v, want the version of the job", v, err)
+	}
+	if rec := postJSON(getJob, `{"positions":{"job_id":"missing"}}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown job: %d, want 404", rec.Code)
+	}
+}
+
+// A label that exists on another branch is answered with the branches holding it; an unknown
+// label is a plain 404.
+func TestVersionNotFoundSuggestsBranches(t *testing.T) {
+	core.SetProvidersForTesting(core.NewMemoryProvider(), core.NewMemoryStorage())
+	codebase := uploadSnapshot(t, "suggest", map[string]string{"a.txt": "v1"})
+	postSnapshot(t, codebase.ID, "main", "v2", map[string]string{"a.txt": "v2"})
+	postSnapshot(t, codebase.ID, "feature-x", "v3", map[string]string{"a.txt": "v3"})
+
+	archives, history := NewArchiveHandler(), NewHistoryHandler()
+	r := gin.New()
+	r.POST("/file", archives.GetSingleFile)
+	r.POST("/archive", archives.GetCodebaseArchive)
+	r.POST("/link", history.CreateVersionLink)
+	bodies := map[string]string{
+		"/file":    `{"positions":{"codebase_id":%q},"content":{"branch":"main","version":%q,"path":"a.txt"}}`,
+		"/archive": `{"positions":{"codebase_id":%q},"content":{"branch":"main","version":%q}}`,
+		"/link": `{"positions":{"codebase_id":%q},"content":{"child_version":{"branch":"main","version":%q},` +
+			`"parent_version":{"branch":"main","version":"v1"}}}`,
+	}
+	for path, body := range bodies {
+		post := func(version string) (int, map[string]json.RawMessage) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(fmt.Sprintf(body, codebase.ID, version)))
+			req.Header.Set("Content-Type", "application/json")
+			r.ServeHTTP(rec, req)
+			var resp map[string]json.RawMessage
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			return rec.Code, resp
+		}
+
+		code, resp := post("v3")
+		var details struct {
+			FoundOnBranches []string `json:"found_on_branches"`
+			NearestVersions []string `json:"nearest_versions"`
+		}
+		if code != http.StatusNotFound || json.Unmarshal(resp["details"], &details) != nil {
+			t.Errorf("%s main/v3 = %d %s, want 404 with details", path, code, resp["error"])
+			continue
+		}
+		if strings.Join(details.FoundOnBranches, ",") != "feature-x" || len(details.NearestVersions) == 0 {
+			t.Errorf("%s main/v3 details = %+v, want feature-x and the nearest versions on main", path, details)
+		}
+
+		code, resp = post("v9")
+		if _, ok := resp["details"]; code != http.StatusNotFound || ok {
+			t.Errorf("%s main/v9 = %d %v, want a 404 without suggestions", path, code, resp)
+		}
+	}
+}
+
+// A partial archive is served with the corrupt file replaced while its object goes into quarantine.
+func TestPartialArchiveDownload(t *testing.T) {
+	for _, spool := range []bool{false, true} {
+		dir := t.TempDir()
+		storage, err := core.NewLocalStorage(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		core.SetProvidersForTesting(core.NewMemoryProvider(), storage)
+		core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), SpoolArchives: spool})
+		t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+		codebase := uploadSnapshot(t, "partial", map[string]string{"a.txt": "intact", "b.txt": "gets corrupted"})
+		version, err := core.GetProvider().GetVersion(codebase.ID, "main", "v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, err := core.GetProvider().GetFileIndexesByTreeID(version.TreeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			if f.Path == "b.txt" {
+				os.WriteFile(filepath.Join(dir, f.StorageKey), []byte("bit rot"), 0644)
+			}
+		}
+
+		download := func(allowPartial bool) *http.Response {
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			body := fmt.Sprintf(`{"positions":{"codebase_id":%q},"content":{"branch":"main","version":"v1","allow_partial":%v}}`, codebase.ID, allowPartial)
+			c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/codebases/archive/get", strings.NewReader(body))
+			c.Request.Header.Set("Content-Type", "application/json")
+			NewArchiveHandler().GetCodebaseArchive(c)
+			return rec.Result()
+		}
+
+		if resp := download(false); resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("spool=%v: archive without allow_partial = %d, want 500", spool, resp.StatusCode)
+		}
+		resp := download(true)
+		data, _ := io.ReadAll(resp.Body)
+		corrupt := resp.Header.Get("X-CVCS-Corrupt-Files") + resp.Trailer.Get("X-CVCS-Corrupt-Files")
+		if resp.StatusCode != http.StatusOK || corrupt != "b.txt" {
+			t.Errorf("spool=%v: partial archive = %d with corrupt files %q, want 200 naming b.txt", spool, resp.StatusCode, corrupt)
+		}
+		names := make(map[string]bool)
+		if r, err := zip.NewReader(bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Errorf("spool=%v: partial archive is not a zip: %v", spool, err)
+		} else {
+			for _, f := range r.File {
+				names[f.Name] = true
+			}
+		}
+		if !names["a.txt"] || !names["b.txt.CORRUPT"] || names["b.txt"] {
+			t.Errorf("spool=%v: partial archive holds %v", spool, names)
+		}
+
+		entries, err := calculate.NewQuarantineService().List()
+		if err != nil || len(entries) != 1 || len(entries[0].Affected) != 1 || entries[0].Affected[0].Path != "b.txt" {
+			t.Errorf("spool=%v: quarantine = %+v, %v, want the object of b.txt", spool, entries, err)
+		}
+	}
+}
+
+// zipNames returns the entries of a zip archive with their content.
+func zipNames(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("not a zip archive: %v", err)
+	}
+	entries := make(map[string]string)
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		entries[f.Name] = string(content)
+	}
+	return entries
+}
+
+// An archive of a subdirectory holds its files rooted at the directory and names it in the filename.
+func TestArchivePathPrefix(t *testing.T) {
+	core.SetProvidersForTesting(core.NewMemoryProvider(), core.NewMemoryStorage())
+	codebase := uploadSnapshot(t, "docs", map[string]string{"docs/a.md": "a", "docs/sub/b.md": "b", "docsx/c.md": "c", "main.go": "go"})
+	archive := func(prefix string) *httptest.ResponseRecorder {
+		return postJSON(NewArchiveHandler().GetCodebaseArchive,
+			fmt.Sprintf(`{"positions":{"codebase_id":%q},"content":{"branch":"main","version":"v1","path_prefix":%q}}`, codebase.ID, prefix))
+	}
+
+	for _, prefix := range []string{"docs", "/docs/", "docs/"} {
+		rec := archive(prefix)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("archive of %s = %d %s", prefix, rec.Code, rec.Body.String())
+		}
+		if got, want := zipNames(t, rec.Body.Bytes()), map[string]string{"a.md": "a", "sub/b.md": "b"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("archive of %s holds %v, want %v", prefix, got, want)
+		}
+		if disposition := rec.Header().Get("Content-Disposition"); !strings.HasSuffix(disposition, "-docs.zip") {
+			t.Errorf("archive of %s is named %q", prefix, disposition)
+		}
+	}
+	if rec := archive("docs/sub"); rec.Code != http.StatusOK || !strings.HasSuffix(rec.Header().Get("Content-Disposition"), "-docs_sub.zip") {
+		t.Errorf("archive of docs/sub = %d named %q, want the slash replaced", rec.Code, rec.Header().Get("Content-Disposition"))
+	}
+	if rec := archive("doc"); rec.Code != http.StatusNotFound {
+		t.Errorf("archive of a prefix without files = %d %s, want 404", rec.Code, rec.Body.String())
+	}
+	if rec := archive(""); rec.Code != http.StatusOK || len(zipNames(t, rec.Body.Bytes())) != 4 {
+		t.Errorf("archive without a prefix = %d, want all 4 files", rec.Code)
+	}
+}
+
+func TestArchiveFormat(t *testing.T) {
+	core.SetProvidersForTesting(core.NewMemoryProvider(), core.NewMemoryStorage())
+	codebase := uploadSnapshot(t, "formats", map[string]string{"docs/a.md": "a", "main.go": "go"})
+	archive := func(format, prefix string) *httptest.ResponseRecorder {
+		return postJSON(NewArchiveHandler().GetCodebaseArchive,
+			fmt.Sprintf(`{"positions":{"codebase_id":%q},"content":{"branch":"main","version":"v1","format":%q,"path_prefix":%q}}`, codebase.ID, format, prefix))
+	}
+
+	for _, spool := range []bool{false, true} {
+		core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), SpoolArchives: spool})
+		rec := archive("tar.gz", "docs")
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/gzip" ||
+			rec.Header().Get("Content-Disposition") != "attachment; filename=formats-main-v1-docs.tar.gz" {
+			t.Fatalf("spool=%v: tar.gz archive = %d %q %q", spool, rec.Code, rec.Header().Get("Content-Type"), rec.Header().Get("Content-Disposition"))
+		}
+		gz, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(gz)
+		var names []string
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, header.Name)
+		}
+		if want := []string{"formats-main-v1-docs/", "formats-main-v1-docs/a.md"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("spool=%v: tarball holds %v, want %v", spool, names, want)
+		}
+	}
+	core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()})
+
+	if rec := archive("zip", ""); rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/zip" || len(zipNames(t, rec.Body.Bytes())) != 2 {
+		t.Errorf("zip archive = %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if rec := archive("rar", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("rar archive = %d %s, want 400", rec.Code, rec.Body.String())
+	}
+}
+
+func TestGetSingleFileContentType(t *testing.T) {
+	core.SetProvidersForTesting(core.NewMemoryProvider(), core.NewMemoryStorage())
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00"
+	codebase := uploadSnapshot(t, "preview", map[string]string{
+		"logo.png":  png,
+		"data.json": `{"a": 1}`,
+		"LICENSE":   "Permission is hereby granted, free of charge, to any person",
+		"image":     png, // no extension, recognized by its content
+	})
+	get := func(path, disposition string) *httptest.ResponseRecorder {
+		return postJSON(NewArchiveHandler().GetSingleFile,
+			fmt.Sprintf(`{"positions":{"codebase_id":%q},"content":{"branch":"main","version":"v1","path":%q,"disposition":%q}}`, codebase.ID, path, disposition))
+	}
+
+	for _, tt := range []struct {
+		path, contentType string
+		content           string
+	}{
+		{"logo.png", "image/png", png},
+		{"data.json", "application/json", `{"a": 1}`},
+		{"LICENSE", "text/plain; charset=utf-8", "Permission is hereby granted, free of charge, to any person"},
+		{"image", "image/png", png},
+	} {
+		rec := get(tt.path, "inline")
+		if rec.Code != http.StatusOK || rec.Body.String() != tt.content {
+			t.Errorf("%s = %d %q", tt.path, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("content type of %s = %s, want %s", tt.path, got, tt.contentType)
+		}
+		if got := rec.Header().Get("Content-Disposition"); got != fmt.Sprintf(`inline; filename="%s"`, tt.path) {
+			t.Errorf("disposition of %s = %s", tt.path, got)
+		}
+	}
+
+	// Attachment stays the default
+	if got := get("logo.png", "").Header().Get("Content-Disposition"); got != `attachment; filename="logo.png"` {
+		t.Errorf("default disposition = %s", got)
+	}
+	if rec := get("logo.png", "download"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown disposition = %d, want 400", rec.Code)
+	}
+}
+
+func TestGetFileBatch(t *testing.T) {
+	core.SetProvidersForTesting(core.NewMemoryProvider(), core.NewMemoryStorage())
+	codebase := uploadSnapshot(t, "configs", map[string]string{
+		"config/app.yaml": "app", "config/db/db.yaml": "db", "README.md": "readme", "other.txt": "other",
+	})
+	batch := func(strict bool, paths ...string) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(paths)
+		return postJSON(NewArchiveHandler().GetFileBatch,
+			fmt.Sprintf(`{"positions":{"codebase_id":%q},"content":{"branch":"main","version":"v1","paths":%s,"strict":%v}}`, codebase.ID, encoded, strict))
+	}
+
+	rec := batch(false, "config/app.yaml", "config/db/db.yaml", "README.md", "missing.txt", "config/gone.yaml")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("batch = %d %s", rec.Code, rec.Body.String())
+	}
+	want := map[string]string{"config/app.yaml": "app", "config/db/db.yaml": "db", "README.md": "readme"}
+	if got := zipNames(t, rec.Body.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("batch holds %v, want %v", got, want)
+	}
+	if got := rec.Header().Get("X-Missing-Files"); got != "missing.txt,config/gone.yaml" {
+		t.Errorf("X-Missing-Files = %q, want both missing paths in request order", got)
+	}
+	if rec := batch(false, "README.md"); rec.Header().Get("X-Missing-Files") != "" {
+		t.Errorf("batch without missing files reports %q", rec.Header().Get("X-Missing-Files"))
+	}
+
+	// Strict batches fail on the first missing path
+	rec = batch(true, "README.md", "missing.txt")
+	var body struct {
+		Path string `json:"path"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusNotFound || body.Path != "missing.txt" {
+		t.Errorf("strict batch with a missing path = %d %s, want 404 naming it", rec.Code, rec.Body.String())
+	}
+	if rec := batch(false); rec.Code != http.StatusBadRequest {
+		t.Errorf("batch without paths = %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"main/calculate"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HealthHandler reports readiness and keeps requests away from unavailable storage
+type HealthHandler struct {
+	service *calculate.StorageHealthService
+}
+
+func NewHealthHandler() *HealthHandler {
+	return &HealthHandler{
+		service: calculate.NewStorageHealthService(),
+	}
+}
+
+// Readyz reports whether the service can serve requests, with the status of every storage backend
+func (h *HealthHandler) Readyz(c *gin.Context) {
+	backends := h.service.Status()
+	if err := h.service.Available(); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"ready": false, "error": err.Error(), "storage": backends})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ready": true, "storage": backends})
+}
+
+// Metrics reports the storage probe state and counters in the Prometheus text format
+func (h *HealthHandler) Metrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	h.service.WriteMetrics(c.Writer)
+}
+
+// RequireStorage fails requests that read or write stored content with 503 while the storage backend
+// is unhealthy, instead of letting them fail halfway through
+func (h *HealthHandler) RequireStorage() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := h.service.Available(); err != nil {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		}
+		c.Next()
+	}
+}
@@ -2,7 +2,9 @@ package api
 
 import (
 	"main/calculate"
+	"main/core"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -35,6 +37,23 @@ func (h *HistoryHandler) GetVersionMap(c *gin.Context) {
 	c.Data(http.StatusOK, "application/json; charset=utf-8", historyJSON)
 }
 
+// GetVersionMapChanges returns the version graph delta since a generation the client already has
+func (h *HistoryHandler) GetVersionMapChanges(c *gin.Context) {
+	var req GetVersionMapChangesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	changes, err := h.service.GetVersionMapChanges(req.Positions.CodebaseID, req.Content.SinceGeneration)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, changes)
+}
+
 // CreateVersionLink creates version link
 func (h *HistoryHandler) CreateVersionLink(c *gin.Context) {
 	var req CreateVersionLinkRequest
@@ -53,9 +72,170 @@ func (h *HistoryHandler) CreateVersionLink(c *gin.Context) {
 	}
 
 	if err := h.service.CreateVersionLink(req.Positions.CodebaseID, child, parent); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		writeVersionLookupError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Version link created successfully"})
 }
+
+// DeleteVersionLink removes a version link
+func (h *HistoryHandler) DeleteVersionLink(c *gin.Context) {
+	var req CreateVersionLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	child := calculate.VersionIdentifier{
+		Branch:  req.Content.ChildVersion.Branch,
+		Version: req.Content.ChildVersion.Version,
+	}
+	parent := calculate.VersionIdentifier{
+		Branch:  req.Content.ParentVersion.Branch,
+		Version: req.Content.ParentVersion.Version,
+	}
+
+	if err := h.service.DeleteVersionLink(req.Positions.CodebaseID, child, parent); err != nil {
+		writeVersionLookupError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Version link deleted successfully"})
+}
+
+// GetVersion returns a version with its parents, addressed by branch and label, tag or version ID
+func (h *HistoryHandler) GetVersion(c *gin.Context) {
+	var req GetVersionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	details, err := h.service.GetVersionDetails(req.Positions.CodebaseID, calculate.VersionSelector{
+		Branch:    req.Content.Branch,
+		Version:   req.Content.Version,
+		Tag:       req.Content.Tag,
+		VersionID: req.Content.VersionID,
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "invalid version selector") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+			return
+		}
+		writeVersionLookupError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, details)
+}
+
+// SetVersionFlags locks or pins a version
+func (h *HistoryHandler) SetVersionFlags(c *gin.Context) {
+	var req SetVersionFlagsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+	if req.Content.Locked == nil && req.Content.Pinned == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: give locked, pinned or both"})
+		return
+	}
+
+	version, err := h.service.SetVersionFlags(req.Positions.CodebaseID, calculate.VersionSelector{
+		Branch:    req.Content.Branch,
+		Version:   req.Content.Version,
+		Tag:       req.Content.Tag,
+		VersionID: req.Content.VersionID,
+	}, calculate.VersionFlags{Locked: req.Content.Locked, Pinned: req.Content.Pinned})
+	if err != nil {
+		if strings.Contains(err.Error(), "invalid version selector") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+			return
+		}
+		writeVersionLookupError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, version)
+}
+
+// GetMergeBase returns the nearest common ancestor of two versions
+func (h *HistoryHandler) GetMergeBase(c *gin.Context) {
+	var req MergeBaseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	a, ok := resolveSelector(c, req.Positions.CodebaseID, req.Content.A)
+	if !ok {
+		return
+	}
+	b, ok := resolveSelector(c, req.Positions.CodebaseID, req.Content.B)
+	if !ok {
+		return
+	}
+
+	base, err := h.service.CommonAncestor(req.Positions.CodebaseID, a, b)
+	if err != nil {
+		writeVersionLookupError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, base)
+}
+
+// CreateVersionLinkBatch creates many version links with a single history cache rebuild
+func (h *HistoryHandler) CreateVersionLinkBatch(c *gin.Context) {
+	var req CreateVersionLinkBatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	links := make([]calculate.LinkRequest, len(req.Content.Links))
+	for i, l := range req.Content.Links {
+		links[i] = calculate.LinkRequest{
+			Child:       calculate.VersionIdentifier{Branch: l.Child.Branch, Version: l.Child.Version},
+			Parent:      calculate.VersionIdentifier{Branch: l.Parent.Branch, Version: l.Parent.Version},
+			LinkageType: core.LinkageType(l.LinkageType),
+		}
+	}
+
+	result, err := h.service.CreateVersionLinks(req.Positions.CodebaseID, links, req.Content.Atomic)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "invalid"):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if result.Atomic && result.Rejected > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "link batch rejected: some links are invalid", "result": result})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// GetFileHistory lists the versions in which a path was added, modified or deleted
+func (h *HistoryHandler) GetFileHistory(c *gin.Context) {
+	var req FileHistoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	history, err := h.service.GetFileHistory(req.Positions.CodebaseID, req.Content.Branch, req.Content.Path)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error(), "path": req.Content.Path})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, history)
+}
@@ -1,6 +1,9 @@
 package api
 
-import "main/core"
+import (
+	"main/calculate"
+	"main/core"
+)
 
 // GenericRequest 是所有请求的基础结构
 type GenericRequest struct {
@@ -13,15 +16,26 @@ type InitCodebasePositions struct {
 	// 初始化时通常不需要位置信息，但可以保留以备将来使用（如租户ID）
 }
 type InitCodebaseContent struct {
-	Name        string `json:"name" binding:"required"`
-	Description string `json:"description"`
-	Branch      string `json:"branch" binding:"required"`
+	Name        string                 `json:"name" binding:"required"`
+	Description string                 `json:"description"`
+	Branch      string                 `json:"branch" binding:"required"`
+	Settings    *core.CodebaseSettings `json:"settings,omitempty"`
+	Ephemeral   bool                   `json:"ephemeral"`   // 临时代码库，到期后自动清除
+	TTLSeconds  int64                  `json:"ttl_seconds"` // 临时代码库的存活时间，默认 3600
 }
 type InitCodebaseRequest struct {
 	Positions InitCodebasePositions `json:"positions" binding:"required"`
 	Content   InitCodebaseContent   `json:"content" binding:"required"`
 }
 
+// === 列出代码库 ===
+type ListCodebasesContent struct {
+	IncludeEphemeral bool `json:"include_ephemeral"` // 同时列出临时代码库，默认不列出
+}
+type ListCodebasesRequest struct {
+	Content ListCodebasesContent `json:"content"`
+}
+
 // === 创建快照 ===
 type CreateSnapshotPositions struct {
 	CodebaseID string `json:"codebase_id" binding:"required"`
@@ -33,25 +47,317 @@ type BranchFrom struct {
 }
 
 type CreateSnapshotContent struct {
+	// CodebasePath 请求不带文件且配置了 local_snapshot_roots 时，为服务端上要创建快照的目录；否则不使用
 	CodebasePath string      `json:"codebase_path" binding:"required"`
 	Version      string      `json:"version"`
 	Branch       string      `json:"branch"`
 	Message      string      `json:"message,omitempty"`
 	BranchFrom   *BranchFrom `json:"branch_from,omitempty"` // 新增：分支来源
 	AutoLinkage  bool        `json:"auto_linkage"`          // 新增：是否自动建立血缘关系，默认true
+	// Manifest 列出客户端打算上传的全部文件，服务端会据此校验收到的文件
+	Manifest []calculate.ManifestEntry `json:"manifest,omitempty"`
+	// InferBranchFrom 新分支未指定 branch_from 时，关联到内容最接近的分支头而不是默认分支
+	InferBranchFrom bool `json:"infer_branch_from,omitempty"`
+	// Attributes 按路径附加的文件属性，路径必须是本次上传的文件
+	Attributes map[string]map[string]string `json:"attributes,omitempty"`
+	// Modes 按路径记录的权限位，八进制字符串如 "755"；multipart 上传不带权限，未提供的文件恢复为 0644
+	Modes map[string]string `json:"modes,omitempty"`
+	// AllowEmpty 允许不带文件的快照，用于记录时间点标记；默认拒绝以发现客户端错误
+	AllowEmpty bool `json:"allow_empty,omitempty"`
+	// Durable 要求在响应前将元数据写入磁盘，而不是等待批量刷新
+	Durable bool `json:"durable,omitempty"`
+	// Overwrite 替换分支上同名的已有版本；默认拒绝并返回 409
+	Overwrite bool `json:"overwrite,omitempty"`
+	// Base 增量快照的基础版本：只上传修改和新增的文件，其余文件从基础版本沿用
+	Base *calculate.SnapshotBase `json:"base,omitempty"`
+	// Deleted 增量快照中相对基础版本删除的路径
+	Deleted []string `json:"deleted,omitempty"`
+	// Ignore 本次快照额外的 gitignore 风格忽略模式，排在代码库的 ignore_patterns 之后，可用 "!" 重新包含
+	Ignore []string `json:"ignore,omitempty"`
+	// Directories 需要保留的目录（通常是空目录），以 "dir" 类型条目存入文件树并在恢复时创建
+	Directories []string `json:"directories,omitempty"`
+	// FailureMode 文件无法存储时的处理方式："strict"（默认）放弃快照并在 failed_files 中列出失败的文件；
+	// "partial" 用成功的文件创建版本，失败的文件列在响应和版本的 failed_files 中
+	FailureMode string `json:"failure_mode,omitempty"`
+	// Async 暂存上传的文件后立即返回任务 ID，快照在后台处理，通过 /jobs/get 查询结果；上传会话的提交不支持
+	Async bool `json:"async,omitempty"`
+	// Author 版本作者（name、email 或 client_id），未提供时取 X-CVCS-Author 请求头，两者都没有时版本不记录作者
+	Author *core.VersionAuthor `json:"author,omitempty"`
+	// IdempotencyKey 与 Idempotency-Key 请求头相同（两者都给出时以请求头为准）：保留期内同一代码库以同一键重试时返回首次创建快照的响应，不再创建版本；不能与 async 同时使用，上传会话的提交不支持
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
 }
 type CreateSnapshotRequest struct {
 	Positions CreateSnapshotPositions `json:"positions" binding:"required"`
 	Content   CreateSnapshotContent   `json:"content" binding:"required"`
 }
 
+// === 从 git 仓库导入快照 ===
+type ImportGitSnapshotContent struct {
+	// URL 仓库的克隆地址（https、http、ssh 或 git），需要认证时把令牌写在地址中：https://<token>@host/repo.git
+	URL string `json:"url" binding:"required"`
+	// Ref 要导入的分支、标签或提交，为空时取远端的 HEAD
+	Ref         string      `json:"ref,omitempty"`
+	Version     string      `json:"version"`
+	Branch      string      `json:"branch"`
+	Message     string      `json:"message,omitempty"` // 为空时使用提交说明
+	BranchFrom  *BranchFrom `json:"branch_from,omitempty"`
+	AutoLinkage bool        `json:"auto_linkage"`
+	// 以下字段含义同创建快照
+	InferBranchFrom bool                         `json:"infer_branch_from,omitempty"`
+	Attributes      map[string]map[string]string `json:"attributes,omitempty"`
+	Modes           map[string]string            `json:"modes,omitempty"`
+	AllowEmpty      bool                         `json:"allow_empty,omitempty"`
+	Durable         bool                         `json:"durable,omitempty"`
+	Overwrite       bool                         `json:"overwrite,omitempty"`
+	Ignore          []string                     `json:"ignore,omitempty"`
+	Directories     []string                     `json:"directories,omitempty"`
+	FailureMode     string                       `json:"failure_mode,omitempty"`
+	Async           bool                         `json:"async,omitempty"`
+	Author          *core.VersionAuthor          `json:"author,omitempty"`
+}
+type ImportGitSnapshotRequest struct {
+	Positions CreateSnapshotPositions  `json:"positions" binding:"required"`
+	Content   ImportGitSnapshotContent `json:"content" binding:"required"`
+}
+
+// === 协商快照需上传的文件 ===
+type NegotiateSnapshotRequest struct {
+	Positions CreateSnapshotPositions `json:"positions" binding:"required"`
+	Content   struct {
+		// Manifest 列出快照的全部文件，hash 为原始内容的 sha256
+		Manifest []calculate.ManifestEntry `json:"manifest" binding:"required"`
+	} `json:"content" binding:"required"`
+}
+
+// === 分段上传会话 ===
+type UploadSessionPositions struct {
+	SessionID string `json:"session_id" binding:"required"`
+}
+
+type StartUploadSessionRequest struct {
+	Positions CreateSnapshotPositions `json:"positions" binding:"required"`
+	Content   struct {
+		TTLSeconds int64 `json:"ttl_seconds"` // 最后一次上传后会话的保留时间，默认取配置（24 小时）
+	} `json:"content"`
+}
+
+// UploadSessionFileRequest 是上传文件片段时 multipart 的 metadata 字段，内容放在 file 字段
+type UploadSessionFileRequest struct {
+	Positions UploadSessionPositions `json:"positions" binding:"required"`
+	Content   struct {
+		Path string `json:"path" binding:"required"`
+		// Offset 片段在文件中的起始位置，必须等于已暂存的大小；为 0 时重新上传整个文件
+		Offset int64 `json:"offset"`
+	} `json:"content" binding:"required"`
+}
+
+type GetUploadSessionRequest struct {
+	Positions UploadSessionPositions `json:"positions" binding:"required"`
+}
+
+// CommitUploadSessionRequest 的 content 与创建快照的 metadata 相同，代码库取自会话
+type CommitUploadSessionRequest struct {
+	Positions UploadSessionPositions `json:"positions" binding:"required"`
+	Content   CreateSnapshotContent  `json:"content"`
+}
+
+// === 查询异步快照任务 ===
+type JobPositions struct {
+	JobID string `json:"job_id" binding:"required"`
+}
+
+type GetJobRequest struct {
+	Positions JobPositions `json:"positions" binding:"required"`
+}
+
+// === 获取代码库详情 ===
+type GetCodebaseRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+}
+
+// === 重命名 Codebase ===
+type RenameCodebaseContent struct {
+	Name string `json:"name" binding:"required"`
+}
+
+type RenameCodebaseRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+	Content RenameCodebaseContent `json:"content" binding:"required"`
+}
+
+// === 克隆 Codebase ===
+type CloneCodebaseContent struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"` // 为空时沿用源代码库的描述
+}
+
+type CloneCodebaseRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+	Content CloneCodebaseContent `json:"content" binding:"required"`
+}
+
+// === 更新 Codebase ===
+type UpdateCodebaseContent struct {
+	Description *string `json:"description"` // 为 null 或省略时不修改
+	Branch      *string `json:"branch"`      // 新的默认分支，必须已存在
+	// IgnorePatterns 替换代码库默认的快照忽略模式，为 null 或省略时不修改
+	IgnorePatterns *[]string `json:"ignore_patterns"`
+}
+
+type UpdateCodebaseRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+	Content UpdateCodebaseContent `json:"content"`
+}
+
+// === 存储用量统计 ===
+type GetStatsRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+	Content struct {
+		Refresh bool `json:"refresh"` // 为 true 时忽略缓存重新统计
+	} `json:"content"`
+}
+
+// === 设置默认分支 ===
+type SetDefaultBranchContent struct {
+	Branch string `json:"branch" binding:"required"`
+}
+
+type SetDefaultBranchRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+	Content SetDefaultBranchContent `json:"content" binding:"required"`
+}
+
+// === 导出 / 导入 ===
+type ExportBundleContent struct {
+	// SinceManifest 上一次导出的 manifest.json，只导出其未覆盖的版本和对象
+	SinceManifest *calculate.BundleManifest `json:"since_manifest,omitempty"`
+	// SinceVersionID 只导出在该版本之后创建的版本
+	SinceVersionID string `json:"since_version_id,omitempty"`
+}
+
+type ExportBundleRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+	Content ExportBundleContent `json:"content"`
+}
+
+// === 导出元数据 ===
+type ExportMetadataContent struct {
+	IncludeTrees *bool `json:"include_trees"` // 为 false 时不导出文件列表，默认 true
+}
+
+type ExportMetadataRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+	Content ExportMetadataContent `json:"content"`
+}
+
+// === 代码库设置 ===
+type CodebaseSettingsPositions struct {
+	CodebaseID string `json:"codebase_id" binding:"required"`
+}
+type GetCodebaseSettingsRequest struct {
+	Positions CodebaseSettingsPositions `json:"positions" binding:"required"`
+}
+type SetCodebaseSettingsRequest struct {
+	Positions CodebaseSettingsPositions `json:"positions" binding:"required"`
+	Content   core.CodebaseSettings     `json:"content"`
+}
+
+// === 获取单个文件的元数据 ===
+type StatFileRequest struct {
+	Positions GetFilePositions `json:"positions" binding:"required"`
+	Content   GetFileContent   `json:"content" binding:"required"`
+}
+
+// === 批量下载文件 ===
+type GetFileBatchContent struct {
+	Branch    string   `json:"branch"`
+	Version   string   `json:"version"`
+	Tag       string   `json:"tag"`        // 可代替 branch + version
+	VersionID string   `json:"version_id"` // 可代替 branch + version
+	Paths     []string `json:"paths" binding:"required"`
+	// Strict 为 true 时任一路径不存在即返回 404，否则在 X-Missing-Files 响应头中列出缺失的路径
+	Strict bool `json:"strict"`
+}
+type GetFileBatchRequest struct {
+	Positions GetFilePositions    `json:"positions" binding:"required"`
+	Content   GetFileBatchContent `json:"content" binding:"required"`
+}
+
+// === 按路径搜索文件 ===
+type SearchFilesContent struct {
+	Branch          string   `json:"branch" binding:"required"`
+	Version         string   `json:"version" binding:"required"`
+	Pattern         string   `json:"pattern" binding:"required"` // 例如 src/**/*.{go,mod}，** 段匹配任意层目录，{a,b} 为可选项
+	CaseInsensitive bool     `json:"case_insensitive"`
+	Filters         []string `json:"filters,omitempty"` // 属性过滤，例如 attr:license=MIT 或 attr:generated
+}
+type SearchFilesRequest struct {
+	Positions GetArchivePositions `json:"positions" binding:"required"`
+	Content   SearchFilesContent  `json:"content" binding:"required"`
+}
+
+// === 版本对比 ===
+type DiffContent struct {
+	From VersionSelector `json:"from" binding:"required"` // 基准版本
+	To   VersionSelector `json:"to" binding:"required"`   // 对比版本，可以在其他分支
+}
+type DiffRequest struct {
+	Positions GetArchivePositions `json:"positions" binding:"required"`
+	Content   DiffContent         `json:"content" binding:"required"`
+}
+
+// === 文件变更历史 ===
+type FileHistoryContent struct {
+	Branch string `json:"branch"` // 为空时检查所有分支
+	Path   string `json:"path" binding:"required"`
+}
+type FileHistoryRequest struct {
+	Positions GetArchivePositions `json:"positions" binding:"required"`
+	Content   FileHistoryContent  `json:"content" binding:"required"`
+}
+
+// === 获取文件树 ===
+type GetTreeContent struct {
+	Branch  string `json:"branch" binding:"required"`
+	Version string `json:"version" binding:"required"`
+	Nested  bool   `json:"nested"` // 为 true 时按目录层级返回，并附带每个目录的文件数和大小汇总
+}
+type GetTreeRequest struct {
+	Positions GetArchivePositions `json:"positions" binding:"required"`
+	Content   GetTreeContent      `json:"content" binding:"required"`
+}
+
 // === 获取归档 ===
 type GetArchivePositions struct {
 	CodebaseID string `json:"codebase_id" binding:"required"`
 }
 type GetArchiveContent struct {
-	Branch  string `json:"branch" binding:"required"`
-	Version string `json:"version" binding:"required"`
+	Branch    string `json:"branch"`
+	Version   string `json:"version"`
+	Tag       string `json:"tag"`        // 可代替 branch + version
+	VersionID string `json:"version_id"` // 可代替 branch + version
+	// PathPrefix 只打包该目录下的文件，压缩包内路径相对于该目录
+	PathPrefix string `json:"path_prefix,omitempty"`
+	// AllowPartial 内容损坏的文件以 <path>.CORRUPT 占位文件代替，而不是使整个下载失败
+	AllowPartial bool `json:"allow_partial,omitempty"`
+	// Format 压缩包格式，zip（默认）或 tar.gz；tar.gz 的内容位于以 codebase-branch-version 命名的顶层目录下
+	Format string `json:"format,omitempty"`
 }
 type GetArchiveRequest struct {
 	Positions GetArchivePositions `json:"positions" binding:"required"`
@@ -63,9 +369,13 @@ type GetFilePositions struct {
 	CodebaseID string `json:"codebase_id" binding:"required"`
 }
 type GetFileContent struct {
-	Branch  string `json:"branch" binding:"required"`
-	Version string `json:"version" binding:"required"`
-	Path    string `json:"path" binding:"required"`
+	Branch    string `json:"branch"`
+	Version   string `json:"version"`
+	Tag       string `json:"tag"`        // 可代替 branch + version
+	VersionID string `json:"version_id"` // 可代替 branch + version
+	Path      string `json:"path" binding:"required"`
+	// Disposition 为 inline 时浏览器直接展示文件，默认 attachment 作为下载
+	Disposition string `json:"disposition,omitempty"`
 }
 type GetFileRequest struct {
 	Positions GetFilePositions `json:"positions" binding:"required"`
@@ -76,8 +386,36 @@ type GetFileRequest struct {
 type DeleteCodebasePositions struct {
 	CodebaseID string `json:"codebase_id" binding:"required"`
 }
+type DeleteCodebaseContent struct {
+	Trash bool `json:"trash"` // 为 true 时移入回收站，保留期后再永久删除
+}
 type DeleteCodebaseRequest struct {
 	Positions DeleteCodebasePositions `json:"positions" binding:"required"`
+	Content   DeleteCodebaseContent   `json:"content"`
+}
+
+// === 删除单个版本 ===
+type DeleteVersionContent struct {
+	Branch  string `json:"branch" binding:"required"`
+	Version string `json:"version" binding:"required"`
+}
+type DeleteVersionRequest struct {
+	Positions DeleteCodebasePositions `json:"positions" binding:"required"`
+	Content   DeleteVersionContent    `json:"content" binding:"required"`
+}
+
+// === 回收站 ===
+type RestoreCodebaseRequest struct {
+	Positions DeleteCodebasePositions `json:"positions" binding:"required"`
+}
+
+// === 按哈希获取内容 ===
+type GetObjectByHashContent struct {
+	Hash      string `json:"hash" binding:"required"` // 文件内容的 sha256
+	Locations bool   `json:"locations"`               // 为 true 时在响应头中返回引用该内容的位置
+}
+type GetObjectByHashRequest struct {
+	Content GetObjectByHashContent `json:"content" binding:"required"`
 }
 
 // === 通用响应 ===
@@ -100,12 +438,29 @@ type GetVersionMapRequest struct {
 	Positions GetVersionMapPositions `json:"positions" binding:"required"`
 }
 
+// === 获取版本历史增量 ===
+type GetVersionMapChangesContent struct {
+	SinceGeneration int64 `json:"since_generation"`
+}
+type GetVersionMapChangesRequest struct {
+	Positions GetVersionMapPositions      `json:"positions" binding:"required"`
+	Content   GetVersionMapChangesContent `json:"content"`
+}
+
 // === 创建版本链接 ===
 type VersionIdentifier struct {
 	Branch  string `json:"branch" binding:"required"`
 	Version string `json:"version" binding:"required"`
 }
 
+// VersionSelector 通过 branch + version、tag 或 version_id 定位版本
+type VersionSelector struct {
+	Branch    string `json:"branch"`
+	Version   string `json:"version"`
+	Tag       string `json:"tag"`
+	VersionID string `json:"version_id"`
+}
+
 type CreateVersionLinkContent struct {
 	ChildVersion  VersionIdentifier `json:"child_version" binding:"required"`
 	ParentVersion VersionIdentifier `json:"parent_version" binding:"required"`
@@ -118,6 +473,59 @@ type CreateVersionLinkRequest struct {
 	Content CreateVersionLinkContent `json:"content" binding:"required"`
 }
 
+type VersionLinkBatchItem struct {
+	Child       VersionIdentifier `json:"child" binding:"required"`
+	Parent      VersionIdentifier `json:"parent" binding:"required"`
+	LinkageType string            `json:"linkage_type"` // 默认为 sequential
+}
+
+type CreateVersionLinkBatchContent struct {
+	Links  []VersionLinkBatchItem `json:"links" binding:"required,dive"`
+	Atomic bool                   `json:"atomic"` // 为 true 时任一条校验失败则整批拒绝
+}
+
+// === 获取版本 ===
+type GetVersionRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+	Content VersionSelector `json:"content" binding:"required"`
+}
+
+// === 版本锁定与固定 ===
+type SetVersionFlagsContent struct {
+	VersionSelector
+	Locked *bool `json:"locked"` // 锁定的版本不能被删除或覆盖，省略时不变
+	Pinned *bool `json:"pinned"` // 固定的版本不会被自动清理，省略时不变
+}
+
+type SetVersionFlagsRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+	Content SetVersionFlagsContent `json:"content" binding:"required"`
+}
+
+// === 共同祖先 ===
+type MergeBaseContent struct {
+	A VersionSelector `json:"a" binding:"required"`
+	B VersionSelector `json:"b" binding:"required"`
+}
+
+type MergeBaseRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+	Content MergeBaseContent `json:"content" binding:"required"`
+}
+
+type CreateVersionLinkBatchRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+	Content CreateVersionLinkBatchContent `json:"content" binding:"required"`
+}
+
 // === 版本血缘关系结构 ===
 
 // LinkageType 血缘关系类型
@@ -143,3 +551,160 @@ type VersionEdge struct {
 	To          string      `json:"to"`           // child_version_id
 	LinkageType LinkageType `json:"linkage_type"` // 血缘关系类型
 }
+
+// === 创建分支 ===
+type CreateBranchContent struct {
+	Branch string            `json:"branch" binding:"required"`
+	Source VersionIdentifier `json:"source" binding:"required"`
+}
+
+type CreateBranchRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+	Content CreateBranchContent `json:"content" binding:"required"`
+}
+
+// === 标签 ===
+type CreateTagContent struct {
+	Name    string `json:"name" binding:"required"`
+	Branch  string `json:"branch" binding:"required"`
+	Version string `json:"version" binding:"required"` // 支持 HEAD 与 latest
+	Message string `json:"message"`
+}
+
+type CreateTagRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+	Content CreateTagContent `json:"content" binding:"required"`
+}
+
+type DeleteTagRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+	Content struct {
+		Name string `json:"name" binding:"required"`
+	} `json:"content" binding:"required"`
+}
+
+type ListTagsRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+}
+
+// === 分支头检查 ===
+type CheckBranchHeadsRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+}
+
+// === 分支大小写冲突 ===
+type MergeBranchCasingContent struct {
+	From string `json:"from" binding:"required"` // 要并入的分支写法
+	Into string `json:"into" binding:"required"` // 保留的规范写法
+}
+
+type MergeBranchCasingRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+	Content MergeBranchCasingContent `json:"content" binding:"required"`
+}
+
+// === 删除分支 ===
+type DeleteBranchContent struct {
+	Branch string `json:"branch" binding:"required"`
+	Force  bool   `json:"force"` // 为 true 时允许删除默认分支
+}
+type DeleteBranchRequest struct {
+	Positions DeleteCodebasePositions `json:"positions" binding:"required"`
+	Content   DeleteBranchContent     `json:"content" binding:"required"`
+}
+
+type BranchCollisionsRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id"` // 为空时检查所有代码库
+	} `json:"positions"`
+}
+
+// === 损坏对象隔离 ===
+type ResolveQuarantineContent struct {
+	StorageKey string `json:"storage_key" binding:"required"`
+	Action     string `json:"action" binding:"required"` // reupload、recheck 或 purge
+	Content    []byte `json:"content_base64,omitempty"`  // reupload 时提供的原始文件内容（base64）
+}
+
+type ResolveQuarantineRequest struct {
+	Content ResolveQuarantineContent `json:"content" binding:"required"`
+}
+
+// === 审计日志 ===
+type ListAuditLogRequest struct {
+	Content struct {
+		Action     string `json:"action"`      // 只返回该操作的记录，例如 "trash_purge"
+		CodebaseID string `json:"codebase_id"` // 只返回该代码库的记录
+	} `json:"content"`
+}
+
+// === 存储垃圾回收 ===
+type CollectGarbageRequest struct {
+	Content struct {
+		DryRun bool `json:"dry_run"` // 为 true 时只列出待删除对象
+	} `json:"content"`
+}
+
+// === 元数据一致性检查 ===
+type CheckConsistencyRequest struct {
+	Content struct {
+		Repair bool `json:"repair"` // 为 true 时移除悬空的血缘边、分支引用、标签和孤立的历史缓存
+	} `json:"content"`
+}
+
+// === 全局对象命名空间迁移 ===
+type MigrateGlobalBlobsRequest struct {
+	Content struct {
+		DryRun bool `json:"dry_run"` // 为 true 时只统计待迁移对象
+	} `json:"content"`
+}
+
+// === 临时代码库 ===
+type ReleaseEphemeralCodebaseRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+}
+
+type ExtendEphemeralCodebaseContent struct {
+	TTLSeconds int64 `json:"ttl_seconds" binding:"required"` // 从当前时间起重新计算的存活时间
+}
+
+type ExtendEphemeralCodebaseRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id" binding:"required"`
+	} `json:"positions" binding:"required"`
+	Content ExtendEphemeralCodebaseContent `json:"content" binding:"required"`
+}
+
+// === Webhook ===
+type CreateWebhookContent struct {
+	URL    string   `json:"url" binding:"required"`
+	Secret string   `json:"secret"` // 为空时由服务端生成，仅在创建响应中返回
+	Events []string `json:"events"` // snapshot.created、version_link.created、codebase.deleted、storage.unhealthy、storage.recovered，为空表示全部
+}
+
+type CreateWebhookRequest struct {
+	Positions struct {
+		CodebaseID string `json:"codebase_id"` // 为空时订阅所有代码库
+	} `json:"positions"`
+	Content CreateWebhookContent `json:"content" binding:"required"`
+}
+
+type DeleteWebhookRequest struct {
+	Content struct {
+		ID string `json:"id" binding:"required"`
+	} `json:"content" binding:"required"`
+}
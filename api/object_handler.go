@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"main/calculate"
+	"main/core"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ObjectHandler serves file content addressed by hash
+type ObjectHandler struct {
+	service *calculate.ObjectService
+}
+
+func NewObjectHandler() *ObjectHandler {
+	return &ObjectHandler{
+		service: calculate.NewObjectService(),
+	}
+}
+
+// RequireObjectKey admits requests carrying one of the object_api_keys as a bearer token, and keeps
+// the codebases the key is scoped to for the handler. Without any keys configured the download is off.
+func (h *ObjectHandler) RequireObjectKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(core.GetConfig().ObjectAPIKeys) == 0 {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "hash-addressed downloads are disabled: no object_api_keys are configured"})
+			return
+		}
+		key, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing object API key: send Authorization: Bearer <key>"})
+			return
+		}
+		scope, ok := calculate.ObjectKeyScope(key)
+		if !ok {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid object API key"})
+			return
+		}
+		c.Set(objectScopeKey, scope)
+		c.Next()
+	}
+}
+
+// objectScopeKey holds the codebase IDs the object API key of a request is scoped to, nil for all
+const objectScopeKey = "objectScope"
+
+// GetByHash returns the content of a hash named in the request body
+func (h *ObjectHandler) GetByHash(c *gin.Context) {
+	var req GetObjectByHashRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+	h.writeObject(c, req.Content.Hash, req.Content.Locations)
+}
+
+// GetByHashPermalink is the GET form of GetByHash, usable as a stable URL for a piece of content
+func (h *ObjectHandler) GetByHashPermalink(c *gin.Context) {
+	h.writeObject(c, c.Param("hash"), c.Query("locations") == "true")
+}
+
+func (h *ObjectHandler) writeObject(c *gin.Context, hash string, withLocations bool) {
+	scope := c.GetStringSlice(objectScopeKey)
+	object, locations, err := h.service.GetByHash(hash, withLocations, scope)
+	if err != nil {
+		var corrupt *calculate.CorruptObjectError
+		switch {
+		case errors.As(err, &corrupt):
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "quarantined": corrupt.StorageKey})
+		case strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case strings.Contains(err.Error(), "invalid"):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	etag := fmt.Sprintf("\"%s\"", strings.ToLower(hash))
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	if withLocations {
+		encoded, _ := json.Marshal(locations)
+		c.Header("X-CVCS-Locations", string(encoded))
+	}
+	defer object.Content.Close()
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	// A read error after this point cuts the response short of its Content-Length
+	c.DataFromReader(http.StatusOK, object.Size, "application/octet-stream", object.Content, nil)
+	if err := c.Errors.Last(); err != nil {
+		log.Printf("Download of object %s aborted: %v", hash, err.Err)
+	}
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"main/calculate"
+	"main/core"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploadSnapshot stores contents as version v1 of a new codebase through the snapshot handler.
+func uploadSnapshot(t *testing.T, name string, contents map[string]string) *core.Codebase {
+	t.Helper()
+	codebase, err := calculate.NewInitService().InitializeCodebase(name, "", "main", nil, calculate.InitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	postSnapshot(t, codebase.ID, "main", "v1", contents)
+	return codebase
+}
+
+// postSnapshot stores contents as a version of an existing codebase through the snapshot handler.
+func postSnapshot(t *testing.T, codebaseID, branch, version string, contents map[string]string) {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("metadata", fmt.Sprintf(`{"positions":{"codebase_id":%q},"content":{"branch":%q,"version":%q,"auto_linkage":true}}`, codebaseID, branch, version))
+	for path, content := range contents {
+		part, err := writer.CreateFormFile(path, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(content))
+	}
+	writer.Close()
+
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/codebases/snapshots/create", &body)
+	c.Request.Header.Set("Content-Type", writer.FormDataContentType())
+	NewSnapshotHandler().CreateSnapshot(c)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("snapshot %s/%s: %d %s", branch, version, rec.Code, rec.Body.String())
+	}
+}
+
+func TestGetByHashPermalink(t *testing.T) {
+	core.SetProvidersForTesting(core.NewMemoryProvider(), core.NewMemoryStorage())
+	public := uploadSnapshot(t, "public", map[string]string{"a.txt": "public content"})
+	uploadSnapshot(t, "private", map[string]string{"b.txt": "private content"})
+	core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), ObjectAPIKeys: []core.ObjectAPIKey{
+		{Key: "all-codebases"},
+		{Key: "public-only", Codebases: []string{public.ID}},
+	}})
+	t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+
+	handler := NewObjectHandler()
+	r := gin.New()
+	r.GET("/objects/by-hash/:hash", handler.RequireObjectKey(), handler.GetByHashPermalink)
+	hashOf := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+	get := func(hash, key, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/objects/by-hash/"+hash, nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	publicHash, privateHash := hashOf("public content"), hashOf("private content")
+	etag := `"` + publicHash + `"`
+	tests := []struct {
+		name        string
+		hash, key   string
+		ifNoneMatch string
+		wantStatus  int
+		wantBody    string
+	}{
+		{"no key", publicHash, "", "", http.StatusUnauthorized, ""},
+		{"unknown key", publicHash, "guessed", "", http.StatusUnauthorized, ""},
+		{"unscoped key", privateHash, "all-codebases", "", http.StatusOK, "private content"},
+		{"in scope", publicHash, "public-only", "", http.StatusOK, "public content"},
+		{"out of scope", privateHash, "public-only", "", http.StatusNotFound, ""},
+		{"unknown hash", hashOf("never stored"), "all-codebases", "", http.StatusNotFound, ""},
+		{"etag matches", publicHash, "all-codebases", etag, http.StatusNotModified, ""},
+		{"etag differs", publicHash, "all-codebases", `"` + privateHash + `"`, http.StatusOK, "public content"},
+	}
+	for _, tt := range tests {
+		rec := get(tt.hash, tt.key, tt.ifNoneMatch)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status %d (%s), want %d", tt.name, rec.Code, rec.Body.String(), tt.wantStatus)
+			continue
+		}
+		if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+			t.Errorf("%s: body %q, want %q", tt.name, rec.Body.String(), tt.wantBody)
+		}
+		if rec.Code == http.StatusOK || rec.Code == http.StatusNotModified {
+			if got := rec.Header().Get("ETag"); got != `"`+tt.hash+`"` {
+				t.Errorf("%s: ETag %s, want the quoted hash", tt.name, got)
+			}
+			if rec.Code == http.StatusNotModified && rec.Body.Len() != 0 {
+				t.Errorf("%s: 304 with a body of %d bytes", tt.name, rec.Body.Len())
+			}
+		}
+	}
+
+	// Without any keys configured the download is off altogether
+	core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()})
+	if rec := get(publicHash, "all-codebases", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("download without object_api_keys: status %d, want 403", rec.Code)
+	}
+}
@@ -0,0 +1,513 @@
+package api
+
+import (
+	"log"
+	"main/calculate"
+	"main/core"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routeDoc describes one route in the generated OpenAPI document. Request and Response hold a value
+// of the Go type the route binds and answers with; their schemas are derived from its json and
+// binding tags, so the document follows model.go without being edited by hand.
+type routeDoc struct {
+	Summary  string
+	Request  interface{} // JSON body, or the multipart "metadata" field when Multipart is set
+	Response interface{} // nil when the body isn't JSON or has no fixed shape
+	Status   int         // success status, 200 when zero
+	Produces string      // success content type, application/json when empty
+	// Multipart names the file fields of a multipart/form-data request; "*" means any field name
+	Multipart []string
+	// Mirrors is the POST route a GET route adapts with fromQuery; its content fields become query parameters
+	Mirrors string
+}
+
+// Wrappers for handlers that answer with a single-key object
+type (
+	collisionsResponse struct {
+		Collisions []calculate.BranchCollision `json:"collisions"`
+	}
+	quarantineListResponse struct {
+		Entries []*core.QuarantineEntry `json:"entries"`
+	}
+	auditLogResponse struct {
+		Entries []*core.AuditEntry `json:"entries"`
+	}
+	recoveriesResponse struct {
+		Recoveries []core.MetadataRecovery `json:"recoveries"`
+	}
+	headSplitsResponse struct {
+		Splits []calculate.BranchHeadSplit `json:"splits"`
+	}
+	portabilityResponse struct {
+		PortabilityWarnings []core.PortabilityIssue `json:"portability_warnings"`
+	}
+	codebasesResponse struct {
+		Codebases []core.Codebase `json:"codebases"`
+	}
+	tagsResponse struct {
+		Tags []calculate.TagInfo `json:"tags"`
+	}
+	webhooksResponse struct {
+		Webhooks []core.Webhook `json:"webhooks"`
+	}
+	messageResponse struct {
+		Message string `json:"message"`
+	}
+)
+
+// routeDocs documents every route registered by NewRouter, keyed by "METHOD path"
+var routeDocs = map[string]routeDoc{
+	"GET /readyz":                               {Summary: "Readiness check including the probe state of each storage backend"},
+	"GET /metrics":                              {Summary: "Storage probe state and counters in the Prometheus text format", Produces: "text/plain"},
+	"GET /api/v1/openapi.json":                  {Summary: "This OpenAPI document"},
+	"POST /api/v1/codebases/init":               {Summary: "Create a codebase", Request: InitCodebaseRequest{}, Response: core.Codebase{}},
+	"POST /api/v1/codebases/list":               {Summary: "List codebases, ephemeral ones with include_ephemeral", Request: ListCodebasesRequest{}, Response: codebasesResponse{}},
+	"POST /api/v1/codebases/get":                {Summary: "Get codebase details", Request: GetCodebaseRequest{}, Response: calculate.CodebaseDetails{}},
+	"POST /api/v1/codebases/default-branch/set": {Summary: "Set the default branch", Request: SetDefaultBranchRequest{}, Response: core.Codebase{}},
+	"POST /api/v1/codebases/rename":             {Summary: "Rename a codebase", Request: RenameCodebaseRequest{}, Response: calculate.CodebaseRenameResult{}},
+	"POST /api/v1/codebases/clone":              {Summary: "Clone a codebase with its full history", Request: CloneCodebaseRequest{}, Response: calculate.CodebaseCloneResult{}, Status: http.StatusCreated},
+	"POST /api/v1/codebases/update":             {Summary: "Update codebase metadata", Request: UpdateCodebaseRequest{}, Response: core.Codebase{}},
+	"POST /api/v1/codebases/stats/get":          {Summary: "Get storage usage of a codebase", Request: GetStatsRequest{}, Response: calculate.CodebaseUsage{}},
+	"POST /api/v1/codebases/snapshots/create": {
+		Summary:   "Upload a snapshot; metadata is a JSON-encoded request, every other file field is stored under its field name. With content.async the files are staged and a pending job is returned with 202, see /jobs/get. The X-CVCS-Author header gives the version author when content.author is absent. A retry with the Idempotency-Key header or content.idempotency_key of an earlier snapshot gets its response again",
+		Request:   CreateSnapshotRequest{},
+		Response:  core.SnapshotResponse{},
+		Multipart: []string{"*"},
+	},
+	"POST /api/v1/codebases/snapshots/negotiate": {Summary: "List the files of a manifest whose content the server lacks", Request: NegotiateSnapshotRequest{}, Response: calculate.NegotiationResult{}},
+	"POST /api/v1/codebases/archive/get":         {Summary: "Download a version as a zip or tar.gz archive", Request: GetArchiveRequest{}, Produces: "application/zip"},
+	"POST /api/v1/codebases/file/get":            {Summary: "Download a single file", Request: GetFileRequest{}, Produces: "application/octet-stream"},
+	"POST /api/v1/codebases/files/get-batch":     {Summary: "Download selected files as one zip archive", Request: GetFileBatchRequest{}, Produces: "application/zip"},
+	"POST /api/v1/codebases/file/stat":           {Summary: "Get file metadata without its content", Request: StatFileRequest{}, Response: calculate.FileStat{}},
+	"POST /api/v1/codebases/tree/get":            {Summary: "List the files of a version", Request: GetTreeRequest{}, Response: calculate.VersionTree{}},
+	"POST /api/v1/codebases/files/search":        {Summary: "Search file paths of a version", Request: SearchFilesRequest{}, Response: calculate.FileSearchResult{}},
+	"POST /api/v1/codebases/diff/get":            {Summary: "Compare two versions", Request: DiffRequest{}, Response: calculate.VersionDiff{}},
+	"POST /api/v1/codebases/archive/portability": {Summary: "Report paths that can't be extracted on every platform", Request: GetArchiveRequest{}, Response: portabilityResponse{}},
+	"POST /api/v1/codebases/delete":              {Summary: "Delete a codebase, or move it to the trash when a retention period is configured", Request: DeleteCodebaseRequest{}},
+	"POST /api/v1/codebases/versions/get":        {Summary: "Get a version and its parents", Request: GetVersionRequest{}, Response: calculate.VersionDetails{}},
+	"POST /api/v1/codebases/versions/flags/set":  {Summary: "Lock or pin a version", Request: SetVersionFlagsRequest{}, Response: core.Version{}},
+	"POST /api/v1/codebases/versions/delete":     {Summary: "Delete a version", Request: DeleteVersionRequest{}, Response: calculate.VersionDeleteResult{}},
+	"POST /api/v1/codebases/export":              {Summary: "Export a codebase as a bundle", Request: ExportBundleRequest{}, Produces: "application/zip"},
+	"POST /api/v1/codebases/export/metadata":     {Summary: "Export all metadata of a codebase as one JSON document", Request: ExportMetadataRequest{}},
+	"POST /api/v1/codebases/import": {
+		Summary:   "Import one or more bundles",
+		Response:  calculate.ImportResult{},
+		Multipart: []string{"bundles"},
+	},
+	"POST /api/v1/objects/by-hash":             {Summary: "Download content by its sha256; needs one of object_api_keys as a bearer token", Request: GetObjectByHashRequest{}, Produces: "application/octet-stream"},
+	"GET /api/v1/objects/by-hash/:hash":        {Summary: "Permalink to content by its sha256; ?locations=true lists where it is referenced. Needs one of object_api_keys as a bearer token", Produces: "application/octet-stream"},
+	"POST /api/v1/codebases/settings/get":      {Summary: "Get codebase settings", Request: GetCodebaseSettingsRequest{}, Response: core.CodebaseSettings{}},
+	"POST /api/v1/codebases/settings/set":      {Summary: "Replace codebase settings", Request: SetCodebaseSettingsRequest{}, Response: core.CodebaseSettings{}},
+	"POST /api/v1/codebases/trash/list":        {Summary: "List trashed codebases", Response: calculate.TrashReport{}},
+	"POST /api/v1/codebases/trash/restore":     {Summary: "Restore a trashed codebase", Request: RestoreCodebaseRequest{}, Response: core.Codebase{}},
+	"POST /api/v1/codebases/ephemeral/extend":  {Summary: "Extend the lifetime of an ephemeral codebase", Request: ExtendEphemeralCodebaseRequest{}, Response: core.Codebase{}},
+	"POST /api/v1/codebases/ephemeral/release": {Summary: "Delete an ephemeral codebase now", Request: ReleaseEphemeralCodebaseRequest{}, Response: messageResponse{}},
+
+	"POST /api/v1/codebases/snapshots/from-git": {Summary: "Create a snapshot from a commit of a git repository, cloned by the server; with content.async a pending job is returned with 202", Request: ImportGitSnapshotRequest{}, Response: core.SnapshotResponse{}},
+	"POST /api/v1/jobs/get":                     {Summary: "Get the state, progress and result of an asynchronous snapshot", Request: GetJobRequest{}, Response: calculate.SnapshotJob{}},
+
+	"POST /api/v1/codebases/snapshots/session/start": {Summary: "Open an upload session to send a snapshot file by file", Request: StartUploadSessionRequest{}, Response: calculate.UploadSession{}, Status: http.StatusCreated},
+	"POST /api/v1/codebases/snapshots/session/file": {
+		Summary:   "Stage a file, or a piece of one at content.offset, in an upload session; metadata is a JSON-encoded request",
+		Request:   UploadSessionFileRequest{},
+		Response:  calculate.UploadSessionFile{},
+		Multipart: []string{"file"},
+	},
+	"POST /api/v1/codebases/snapshots/session/get":    {Summary: "List the files staged in an upload session", Request: GetUploadSessionRequest{}, Response: calculate.UploadSession{}},
+	"POST /api/v1/codebases/snapshots/session/commit": {Summary: "Create the snapshot from the files staged in an upload session", Request: CommitUploadSessionRequest{}, Response: core.SnapshotResponse{}},
+	"POST /api/v1/codebases/snapshots/session/abort":  {Summary: "Remove an upload session and its staged files", Request: GetUploadSessionRequest{}, Response: messageResponse{}},
+
+	"POST /api/v1/codebases/map/get":        {Summary: "Get the version graph", Request: GetVersionMapRequest{}, Response: core.VersionMapResponse{}},
+	"POST /api/v1/codebases/map/changes":    {Summary: "Get version graph changes since a generation", Request: GetVersionMapChangesRequest{}, Response: core.VersionMapChanges{}},
+	"POST /api/v1/codebases/map/link":       {Summary: "Link a version to a parent", Request: CreateVersionLinkRequest{}, Response: messageResponse{}},
+	"POST /api/v1/codebases/map/link-batch": {Summary: "Create several version links", Request: CreateVersionLinkBatchRequest{}, Response: calculate.LinkBatchResult{}},
+	"POST /api/v1/codebases/map/unlink":     {Summary: "Remove a version link", Request: CreateVersionLinkRequest{}, Response: messageResponse{}},
+	"POST /api/v1/codebases/map/merge-base": {Summary: "Find the nearest common ancestor of two versions", Request: MergeBaseRequest{}, Response: calculate.MergeBase{}},
+	"POST /api/v1/codebases/file/history":   {Summary: "List the versions in which a file changed", Request: FileHistoryRequest{}, Response: calculate.FileHistory{}},
+
+	"POST /api/v1/codebases/branches/create":      {Summary: "Create a branch from an existing version", Request: CreateBranchRequest{}, Response: core.BranchRef{}},
+	"POST /api/v1/codebases/branches/merge-case":  {Summary: "Merge branches whose names differ only in case", Request: MergeBranchCasingRequest{}, Response: calculate.BranchCaseMergeResult{}},
+	"POST /api/v1/codebases/branches/delete":      {Summary: "Delete a branch", Request: DeleteBranchRequest{}, Response: calculate.BranchDeleteResult{}},
+	"POST /api/v1/codebases/branches/heads/check": {Summary: "Report branches with more than one head", Request: CheckBranchHeadsRequest{}, Response: headSplitsResponse{}},
+	"POST /api/v1/codebases/tags/create":          {Summary: "Tag a version", Request: CreateTagRequest{}, Response: calculate.TagInfo{}, Status: http.StatusCreated},
+	"POST /api/v1/codebases/tags/delete":          {Summary: "Delete a tag", Request: DeleteTagRequest{}, Response: messageResponse{}},
+	"POST /api/v1/codebases/tags/list":            {Summary: "List the tags of a codebase", Request: ListTagsRequest{}, Response: tagsResponse{}},
+
+	"POST /api/v1/config/get":            {Summary: "Get the effective configuration", Response: calculate.EffectiveConfig{}},
+	"POST /api/v1/config/storage/update": {Summary: "Change the storage path", Request: UpdateStoragePathRequest{}},
+
+	"POST /api/v1/webhooks/create": {Summary: "Subscribe a URL to codebase events", Request: CreateWebhookRequest{}, Response: core.Webhook{}, Status: http.StatusCreated},
+	"POST /api/v1/webhooks/delete": {Summary: "Delete a webhook subscription", Request: DeleteWebhookRequest{}, Response: messageResponse{}},
+	"POST /api/v1/webhooks/list":   {Summary: "List webhook subscriptions without their secrets", Response: webhooksResponse{}},
+
+	"POST /api/v1/admin/background/status":          {Summary: "Get background job status", Response: calculate.BackgroundStatus{}},
+	"POST /api/v1/admin/background/pause":           {Summary: "Pause background jobs", Response: calculate.BackgroundStatus{}},
+	"POST /api/v1/admin/background/resume":          {Summary: "Resume background jobs", Response: calculate.BackgroundStatus{}},
+	"POST /api/v1/admin/rebuild-derived":            {Summary: "Rebuild derived data from the primary records", Response: calculate.DerivedRebuildReport{}},
+	"POST /api/v1/admin/cache/warmup/status":        {Summary: "Get history cache warm-up status", Response: calculate.WarmupStatus{}},
+	"POST /api/v1/admin/cache/warmup":               {Summary: "Start the history cache warm-up", Response: calculate.WarmupStatus{}, Status: http.StatusAccepted},
+	"POST /api/v1/admin/cache/stats":                {Summary: "Get size and counters of the file tree and read caches", Response: calculate.CacheStats{}},
+	"POST /api/v1/admin/branches/collisions":        {Summary: "List branches whose names differ only in case", Request: BranchCollisionsRequest{}, Response: collisionsResponse{}},
+	"POST /api/v1/admin/quarantine/list":            {Summary: "List quarantined objects", Response: quarantineListResponse{}},
+	"POST /api/v1/admin/quarantine/resolve":         {Summary: "Resolve a quarantined object", Request: ResolveQuarantineRequest{}, Response: core.QuarantineEntry{}},
+	"POST /api/v1/admin/audit/list":                 {Summary: "List audit entries of trash purges and purges held back by locked or pinned versions", Request: ListAuditLogRequest{}, Response: auditLogResponse{}},
+	"POST /api/v1/maintenance/gc":                   {Summary: "Delete stored objects no file index references", Request: CollectGarbageRequest{}, Response: calculate.GCReport{}},
+	"POST /api/v1/maintenance/blobs/migrate-global": {Summary: "Move name-prefixed objects into the global blob namespace", Request: MigrateGlobalBlobsRequest{}, Response: calculate.BlobMigrationReport{}},
+	"POST /api/v1/maintenance/recoveries":           {Summary: "List metadata files restored from a backup", Response: recoveriesResponse{}},
+	"POST /api/v1/maintenance/fsck":                 {Summary: "Check metadata for dangling references, optionally removing them", Request: CheckConsistencyRequest{}, Response: core.ConsistencyReport{}},
+	"POST /api/v1/maintenance/metadata/convert":     {Summary: "Rewrite version files and file trees in the configured metadata encoding", Response: core.EncodingConversion{}},
+
+	"GET /api/v1/codebases":                         {Mirrors: "/api/v1/codebases/list"},
+	"GET /api/v1/codebases/:id":                     {Mirrors: "/api/v1/codebases/get"},
+	"GET /api/v1/codebases/:id/stats":               {Mirrors: "/api/v1/codebases/stats/get"},
+	"GET /api/v1/codebases/:id/settings":            {Mirrors: "/api/v1/codebases/settings/get"},
+	"GET /api/v1/codebases/:id/archive":             {Mirrors: "/api/v1/codebases/archive/get"},
+	"GET /api/v1/codebases/:id/archive/portability": {Mirrors: "/api/v1/codebases/archive/portability"},
+	"GET /api/v1/codebases/:id/file":                {Mirrors: "/api/v1/codebases/file/get"},
+	"GET /api/v1/codebases/:id/file/stat":           {Mirrors: "/api/v1/codebases/file/stat"},
+	"GET /api/v1/codebases/:id/file/history":        {Mirrors: "/api/v1/codebases/file/history"},
+	"GET /api/v1/codebases/:id/files":               {Mirrors: "/api/v1/codebases/files/get-batch"},
+	"GET /api/v1/codebases/:id/files/search":        {Mirrors: "/api/v1/codebases/files/search"},
+	"GET /api/v1/codebases/:id/tree":                {Mirrors: "/api/v1/codebases/tree/get"},
+	"GET /api/v1/codebases/:id/diff":                {Mirrors: "/api/v1/codebases/diff/get"},
+	"GET /api/v1/codebases/:id/version":             {Mirrors: "/api/v1/codebases/versions/get"},
+	"GET /api/v1/codebases/:id/map":                 {Mirrors: "/api/v1/codebases/map/get"},
+	"GET /api/v1/codebases/:id/map/changes":         {Mirrors: "/api/v1/codebases/map/changes"},
+	"GET /api/v1/codebases/:id/map/merge-base":      {Mirrors: "/api/v1/codebases/map/merge-base"},
+	"GET /api/v1/codebases/:id/tags":                {Mirrors: "/api/v1/codebases/tags/list"},
+	"GET /api/v1/config":                            {Mirrors: "/api/v1/config/get"},
+}
+
+// buildOpenAPISpec describes the given routes as an OpenAPI 3 document. Routes without an entry in
+// routeDocs are still listed and returned so the caller can report them.
+func buildOpenAPISpec(routes gin.RoutesInfo) (map[string]interface{}, []string) {
+	schemas := &schemaSet{components: map[string]interface{}{}}
+	paths := map[string]map[string]interface{}{}
+	var undocumented []string
+
+	sorted := append(gin.RoutesInfo(nil), routes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Path != sorted[j].Path {
+			return sorted[i].Path < sorted[j].Path
+		}
+		return sorted[i].Method < sorted[j].Method
+	})
+
+	for _, route := range sorted {
+		key := route.Method + " " + route.Path
+		doc, ok := routeDocs[key]
+		if !ok {
+			undocumented = append(undocumented, key)
+			doc = routeDoc{Summary: "Undocumented"}
+		}
+		if doc.Mirrors != "" {
+			mirrored := routeDocs["POST "+doc.Mirrors]
+			doc.Summary = mirrored.Summary + " (GET form of " + doc.Mirrors + ")"
+			doc.Response, doc.Status, doc.Produces = mirrored.Response, mirrored.Status, mirrored.Produces
+			doc.Request = mirrored.Request
+		}
+
+		op := map[string]interface{}{"summary": doc.Summary}
+		params := pathParameters(route.Path)
+		if doc.Mirrors != "" {
+			params = append(params, queryParameters(schemas, doc.Request)...)
+		} else if body := requestBody(schemas, doc); body != nil {
+			op["requestBody"] = body
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		op["responses"] = responses(schemas, doc)
+
+		openPath := openAPIPath(route.Path)
+		if paths[openPath] == nil {
+			paths[openPath] = map[string]interface{}{}
+		}
+		paths[openPath][strings.ToLower(route.Method)] = op
+	}
+
+	spec := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "CVCS API",
+			"version": "1",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas.components},
+	}
+	return spec, undocumented
+}
+
+func requestBody(schemas *schemaSet, doc routeDoc) map[string]interface{} {
+	if doc.Multipart != nil {
+		props := map[string]interface{}{}
+		form := map[string]interface{}{"type": "object", "properties": props}
+		if doc.Request != nil {
+			props["metadata"] = map[string]interface{}{
+				"type":        "string",
+				"description": "JSON-encoded " + schemaName(reflect.TypeOf(doc.Request)),
+			}
+			form["required"] = []string{"metadata"}
+		}
+		file := map[string]interface{}{"type": "string", "format": "binary"}
+		for _, field := range doc.Multipart {
+			if field == "*" {
+				form["additionalProperties"] = file
+			} else {
+				props[field] = map[string]interface{}{"type": "array", "items": file}
+			}
+		}
+		return map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"multipart/form-data": map[string]interface{}{"schema": form}},
+		}
+	}
+	if doc.Request == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"required": true,
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemas.schemaFor(reflect.TypeOf(doc.Request))},
+		},
+	}
+}
+
+func responses(schemas *schemaSet, doc routeDoc) map[string]interface{} {
+	status := doc.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	contentType := doc.Produces
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	var schema map[string]interface{}
+	switch {
+	case doc.Response != nil:
+		schema = schemas.schemaFor(reflect.TypeOf(doc.Response))
+	case contentType == "application/json":
+		schema = map[string]interface{}{"type": "object"}
+	default:
+		schema = map[string]interface{}{"type": "string", "format": "binary"}
+	}
+	return map[string]interface{}{
+		strconv.Itoa(status): map[string]interface{}{
+			"description": http.StatusText(status),
+			"content":     map[string]interface{}{contentType: map[string]interface{}{"schema": schema}},
+		},
+		"default": map[string]interface{}{
+			"description": "Error",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemas.schemaFor(reflect.TypeOf(ErrorResponse{}))},
+			},
+		},
+	}
+}
+
+// pathParameters lists the :name segments of a gin path
+func pathParameters(ginPath string) []interface{} {
+	var params []interface{}
+	for _, segment := range strings.Split(ginPath, "/") {
+		if strings.HasPrefix(segment, ":") {
+			params = append(params, map[string]interface{}{
+				"name":     segment[1:],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+	}
+	return params
+}
+
+// queryParameters lists the content fields of a POST request as the query parameters of its GET
+// form, addressing nested objects with dotted names the way fromQuery reads them.
+func queryParameters(schemas *schemaSet, request interface{}) []interface{} {
+	if request == nil {
+		return nil
+	}
+	content, ok := reflect.TypeOf(request).FieldByName("Content")
+	if !ok {
+		return nil
+	}
+	var params []interface{}
+	var walk func(t reflect.Type, prefix string)
+	walk = func(t reflect.Type, prefix string) {
+		for _, f := range jsonFields(t) {
+			ft := f.typ
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct && ft != timeType {
+				walk(ft, prefix+f.name+".")
+				continue
+			}
+			schema := schemas.schemaFor(f.typ)
+			if ft.Kind() == reflect.Slice {
+				schema["description"] = "repeat the parameter or separate values with commas"
+			}
+			params = append(params, map[string]interface{}{
+				"name":   prefix + f.name,
+				"in":     "query",
+				"schema": schema,
+			})
+		}
+	}
+	ct := content.Type
+	for ct.Kind() == reflect.Ptr {
+		ct = ct.Elem()
+	}
+	if ct.Kind() == reflect.Struct {
+		walk(ct, "")
+	}
+	return params
+}
+
+// openAPIPath turns "/codebases/:id" into "/codebases/{id}"
+func openAPIPath(ginPath string) string {
+	segments := strings.Split(ginPath, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaSet collects the schemas of named struct types under components/schemas
+type schemaSet struct {
+	components map[string]interface{}
+}
+
+// schemaName qualifies a type with its package, since model.go reuses names from calculate and core
+func schemaName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return path.Base(t.PkgPath()) + "." + t.Name()
+}
+
+func (s *schemaSet) schemaFor(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t == timeType {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		if t.Name() == "" {
+			return s.objectSchema(t)
+		}
+		name := schemaName(t)
+		if _, ok := s.components[name]; !ok {
+			s.components[name] = nil // placeholder so recursive types terminate
+			s.components[name] = s.objectSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func (s *schemaSet) objectSchema(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	var required []string
+	for _, f := range jsonFields(t) {
+		props[f.name] = s.schemaFor(f.typ)
+		if f.required {
+			required = append(required, f.name)
+		}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+type jsonField struct {
+	name     string
+	typ      reflect.Type
+	required bool
+}
+
+// jsonFields lists the fields encoding/json writes for t, flattening embedded structs
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			et := f.Type
+			for et.Kind() == reflect.Ptr {
+				et = et.Elem()
+			}
+			if et.Kind() == reflect.Struct {
+				fields = append(fields, jsonFields(et)...)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, jsonField{
+			name:     name,
+			typ:      f.Type,
+			required: strings.Contains(f.Tag.Get("binding"), "required"),
+		})
+	}
+	return fields
+}
+
+// serveOpenAPI serves the document built for the router's routes
+func serveOpenAPI(spec *map[string]interface{}) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, *spec)
+	}
+}
+
+// registerOpenAPI builds the document once every route is registered and logs the routes that
+// routeDocs doesn't describe, so a new endpoint without documentation shows up at startup.
+func registerOpenAPI(r *gin.Engine, spec *map[string]interface{}) {
+	built, undocumented := buildOpenAPISpec(r.Routes())
+	for _, route := range undocumented {
+		log.Printf("Warning: route %s is missing from the OpenAPI route documentation", route)
+	}
+	*spec = built
+}
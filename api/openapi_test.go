@@ -0,0 +1,61 @@
+package api
+
+import (
+	"encoding/json"
+	"main/core"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The router is built on the in-memory backends and never touches the config file or a data directory.
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()})
+	core.SetProvidersForTesting(core.NewMemoryProvider(), core.NewMemoryStorage())
+	os.Exit(m.Run())
+}
+
+// TestEveryRouteIsDocumented fails when NewRouter registers a route without a routeDocs entry, or
+// routeDocs describes a route NewRouter doesn't register.
+func TestEveryRouteIsDocumented(t *testing.T) {
+	routes := NewRouter().Routes()
+	_, undocumented := buildOpenAPISpec(routes)
+	for _, route := range undocumented {
+		t.Errorf("route %s has no entry in routeDocs", route)
+	}
+
+	registered := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		registered[route.Method+" "+route.Path] = true
+	}
+	for key, doc := range routeDocs {
+		if !registered[key] {
+			t.Errorf("routeDocs describes %s, which NewRouter doesn't register", key)
+		}
+		if doc.Mirrors != "" && !registered["POST "+doc.Mirrors] {
+			t.Errorf("%s mirrors %s, which NewRouter doesn't register", key, doc.Mirrors)
+		}
+	}
+}
+
+func TestServeOpenAPI(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/v1/openapi.json = %d", rec.Code)
+	}
+	var spec struct {
+		OpenAPI string                            `json:"openapi"`
+		Paths   map[string]map[string]interface{} `json:"paths"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.OpenAPI == "" || spec.Paths["/api/v1/codebases/init"]["post"] == nil {
+		t.Errorf("document without the openapi version or POST /api/v1/codebases/init: %.300s", rec.Body.String())
+	}
+}
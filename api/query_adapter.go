@@ -0,0 +1,111 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// queryKind is how a query parameter is converted into its JSON request field
+type queryKind int
+
+const (
+	queryString queryKind = iota
+	queryBool
+	queryInt
+	queryList // repeated or comma-separated values
+)
+
+// queryParam maps a query parameter to a content field. Dotted names address nested objects,
+// e.g. "from.branch" becomes content.from.branch.
+type queryParam struct {
+	name string
+	kind queryKind
+}
+
+func q(name string) queryParam     { return queryParam{name, queryString} }
+func qBool(name string) queryParam { return queryParam{name, queryBool} }
+func qInt(name string) queryParam  { return queryParam{name, queryInt} }
+func qList(name string) queryParam { return queryParam{name, queryList} }
+
+// withSelector adds the parameters addressing a version, prefixed for nested selectors such as "from."
+func withSelector(prefix string, params ...queryParam) []queryParam {
+	return append([]queryParam{q(prefix + "branch"), q(prefix + "version"), q(prefix + "tag"), q(prefix + "version_id")}, params...)
+}
+
+// fromQuery adapts a POST handler to a GET route. The :id path parameter becomes positions.codebase_id
+// and the listed query parameters become content fields; the resulting JSON body is handed to the
+// handler, so requests are validated and answered exactly like their POST form.
+func fromQuery(handler gin.HandlerFunc, params ...queryParam) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		content := map[string]interface{}{}
+		for _, p := range params {
+			values, ok := c.GetQueryArray(p.name)
+			if !ok {
+				continue
+			}
+			var value interface{}
+			switch p.kind {
+			case queryBool:
+				b, err := strconv.ParseBool(values[0])
+				if err != nil {
+					writeQueryError(c, p.name, err)
+					return
+				}
+				value = b
+			case queryInt:
+				n, err := strconv.ParseInt(values[0], 10, 64)
+				if err != nil {
+					writeQueryError(c, p.name, err)
+					return
+				}
+				value = n
+			case queryList:
+				var list []string
+				for _, v := range values {
+					for _, item := range strings.Split(v, ",") {
+						if item != "" {
+							list = append(list, item)
+						}
+					}
+				}
+				value = list
+			default:
+				value = values[0]
+			}
+			setNested(content, strings.Split(p.name, "."), value)
+		}
+
+		body := map[string]interface{}{"content": content}
+		if id := c.Param("id"); id != "" {
+			body["positions"] = map[string]string{"codebase_id": id}
+		}
+		encoded, _ := json.Marshal(body)
+		c.Request.Body = io.NopCloser(bytes.NewReader(encoded))
+		c.Request.ContentLength = int64(len(encoded))
+		c.Request.Header.Set("Content-Type", "application/json")
+		handler(c)
+	}
+}
+
+func setNested(m map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		child, ok := m[key].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			m[key] = child
+		}
+		m = child
+	}
+	m[path[len(path)-1]] = value
+}
+
+func writeQueryError(c *gin.Context, name string, err error) {
+	c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Request body does not conform to specification: invalid query parameter %s: %v", name, err)})
+}
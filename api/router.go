@@ -18,23 +18,144 @@ func NewRouter() *gin.Engine {
 	deleteHandler := NewDeleteHandler()
 	historyHandler := NewHistoryHandler()
 	configHandler := NewConfigHandler()
+	branchHandler := NewBranchHandler()
+	adminHandler := NewAdminHandler()
+	ephemeralHandler := NewEphemeralHandler()
+	settingsHandler := NewSettingsHandler()
+	codebaseHandler := NewCodebaseHandler()
+	bundleHandler := NewBundleHandler()
+	objectHandler := NewObjectHandler()
+	healthHandler := NewHealthHandler()
+	diffHandler := NewDiffHandler()
+	tagHandler := NewTagHandler()
+	webhookHandler := NewWebhookHandler()
+	uploadSessionHandler := NewUploadSessionHandler()
 
+	// 就绪检查，包含各存储后端的探测状态
+	r.GET("/readyz", healthHandler.Readyz)
+	// 存储探测的状态和计数，Prometheus 文本格式
+	r.GET("/metrics", healthHandler.Metrics)
+	// 读写存储内容的端点在存储不可用时直接返回 503
+	requireStorage := healthHandler.RequireStorage()
+
+	var spec map[string]interface{}
 	api := r.Group("/api/v1")
 	{
-		// 所有端点统一为 POST
+		// 由已注册路由和 model.go 中的结构体生成的 OpenAPI 文档
+		api.GET("/openapi.json", serveOpenAPI(&spec))
+
+		// 所有端点均提供 POST 形式，只读操作另有 GET 形式（见下方）
 		api.POST("/codebases/init", initHandler.Initialize)
-		api.POST("/codebases/snapshots/create", snapshotHandler.CreateSnapshot)
-		api.POST("/codebases/archive/get", archiveHandler.GetCodebaseArchive)
-		api.POST("/codebases/file/get", archiveHandler.GetSingleFile)
-		api.POST("/codebases/delete", deleteHandler.DeleteCodebase)
+		api.POST("/codebases/list", codebaseHandler.ListCodebases)
+		api.POST("/codebases/get", codebaseHandler.GetCodebase)
+		api.POST("/codebases/default-branch/set", codebaseHandler.SetDefaultBranch)
+		api.POST("/codebases/rename", codebaseHandler.RenameCodebase)
+		api.POST("/codebases/clone", codebaseHandler.CloneCodebase)
+		api.POST("/codebases/update", codebaseHandler.UpdateCodebase)
+		api.POST("/codebases/stats/get", codebaseHandler.GetStats)
+		api.POST("/codebases/snapshots/create", requireStorage, snapshotHandler.CreateSnapshot)
+		api.POST("/codebases/snapshots/negotiate", requireStorage, snapshotHandler.NegotiateSnapshot)
+		api.POST("/codebases/snapshots/from-git", requireStorage, snapshotHandler.ImportGit)
+		api.POST("/codebases/snapshots/session/start", uploadSessionHandler.Start)
+		api.POST("/codebases/snapshots/session/file", uploadSessionHandler.UploadFile)
+		api.POST("/codebases/snapshots/session/get", uploadSessionHandler.GetSession)
+		api.POST("/codebases/snapshots/session/commit", requireStorage, uploadSessionHandler.Commit)
+		api.POST("/codebases/snapshots/session/abort", uploadSessionHandler.Abort)
+		api.POST("/codebases/archive/get", requireStorage, archiveHandler.GetCodebaseArchive)
+		api.POST("/codebases/file/get", requireStorage, archiveHandler.GetSingleFile)
+		api.POST("/codebases/files/get-batch", requireStorage, archiveHandler.GetFileBatch)
+		api.POST("/codebases/file/stat", archiveHandler.StatFile)
+		api.POST("/codebases/tree/get", archiveHandler.GetTree)
+		api.POST("/codebases/files/search", archiveHandler.SearchFiles)
+		api.POST("/codebases/diff/get", diffHandler.GetDiff)
+		api.POST("/codebases/archive/portability", archiveHandler.GetArchivePortability)
+		api.POST("/codebases/delete", requireStorage, deleteHandler.DeleteCodebase)
+		api.POST("/codebases/versions/get", historyHandler.GetVersion)
+		api.POST("/codebases/versions/flags/set", historyHandler.SetVersionFlags)
+		api.POST("/codebases/versions/delete", requireStorage, deleteHandler.DeleteVersion)
+		api.POST("/codebases/export", requireStorage, bundleHandler.Export)
+		api.POST("/codebases/export/metadata", bundleHandler.ExportMetadata)
+		api.POST("/codebases/import", requireStorage, bundleHandler.Import)
+		api.POST("/objects/by-hash", objectHandler.RequireObjectKey(), requireStorage, objectHandler.GetByHash)
+		api.GET("/objects/by-hash/:hash", objectHandler.RequireObjectKey(), requireStorage, objectHandler.GetByHashPermalink)
+		api.POST("/codebases/settings/get", settingsHandler.GetSettings)
+		api.POST("/codebases/settings/set", settingsHandler.SetSettings)
+		api.POST("/codebases/trash/list", deleteHandler.ListTrash)
+		api.POST("/codebases/trash/restore", deleteHandler.RestoreCodebase)
+		api.POST("/codebases/ephemeral/extend", ephemeralHandler.ExtendTTL)
+		api.POST("/codebases/ephemeral/release", ephemeralHandler.Release)
 
 		// 历史相关API
 		api.POST("/codebases/map/get", historyHandler.GetVersionMap)
+		api.POST("/codebases/map/changes", historyHandler.GetVersionMapChanges)
 		api.POST("/codebases/map/link", historyHandler.CreateVersionLink)
+		api.POST("/codebases/map/link-batch", historyHandler.CreateVersionLinkBatch)
+		api.POST("/codebases/map/unlink", historyHandler.DeleteVersionLink)
+		api.POST("/codebases/map/merge-base", historyHandler.GetMergeBase)
+		api.POST("/codebases/file/history", historyHandler.GetFileHistory)
+
+		// 分支相关API
+		api.POST("/codebases/branches/create", branchHandler.CreateBranch)
+		api.POST("/codebases/branches/merge-case", branchHandler.MergeBranchCasing)
+		api.POST("/codebases/branches/delete", requireStorage, deleteHandler.DeleteBranch)
+		api.POST("/codebases/branches/heads/check", branchHandler.CheckHeads)
+		api.POST("/codebases/tags/create", tagHandler.CreateTag)
+		api.POST("/codebases/tags/delete", tagHandler.DeleteTag)
+		api.POST("/codebases/tags/list", tagHandler.ListTags)
+
+		// 异步快照任务
+		api.POST("/jobs/get", snapshotHandler.GetJob)
 
 		// 配置相关API
+		api.POST("/config/get", configHandler.GetConfig)
 		api.POST("/config/storage/update", configHandler.UpdateStoragePath)
+
+		// Webhook 订阅
+		api.POST("/webhooks/create", webhookHandler.CreateWebhook)
+		api.POST("/webhooks/delete", webhookHandler.DeleteWebhook)
+		api.POST("/webhooks/list", webhookHandler.ListWebhooks)
+
+		// 运维管理API
+		api.POST("/admin/background/status", adminHandler.GetBackgroundStatus)
+		api.POST("/admin/background/pause", adminHandler.PauseBackground)
+		api.POST("/admin/background/resume", adminHandler.ResumeBackground)
+		api.POST("/admin/rebuild-derived", adminHandler.RebuildDerived)
+		api.POST("/admin/cache/warmup/status", adminHandler.GetCacheWarmupStatus)
+		api.POST("/admin/cache/warmup", adminHandler.StartCacheWarmup)
+		api.POST("/admin/cache/stats", adminHandler.GetCacheStats)
+		api.POST("/admin/branches/collisions", adminHandler.GetBranchCollisions)
+		api.POST("/admin/quarantine/list", adminHandler.ListQuarantine)
+		api.POST("/admin/quarantine/resolve", requireStorage, adminHandler.ResolveQuarantine)
+		api.POST("/admin/audit/list", adminHandler.ListAuditLog)
+		api.POST("/maintenance/gc", requireStorage, adminHandler.CollectGarbage)
+		api.POST("/maintenance/blobs/migrate-global", requireStorage, adminHandler.MigrateToGlobalBlobs)
+		api.POST("/maintenance/recoveries", adminHandler.ListMetadataRecoveries)
+		api.POST("/maintenance/fsck", adminHandler.CheckConsistency)
+		api.POST("/maintenance/metadata/convert", adminHandler.ConvertMetadataEncoding)
+
+		// 只读操作的 GET 形式，参数来自 URL，由 fromQuery 转换为对应 POST 请求体
+		api.GET("/codebases", fromQuery(codebaseHandler.ListCodebases, qBool("include_ephemeral")))
+		api.GET("/codebases/:id", fromQuery(codebaseHandler.GetCodebase))
+		api.GET("/codebases/:id/stats", fromQuery(codebaseHandler.GetStats, qBool("refresh")))
+		api.GET("/codebases/:id/settings", fromQuery(settingsHandler.GetSettings))
+		api.GET("/codebases/:id/archive", requireStorage, fromQuery(archiveHandler.GetCodebaseArchive, withSelector("", q("path_prefix"), qBool("allow_partial"), q("format"))...))
+		api.GET("/codebases/:id/archive/portability", fromQuery(archiveHandler.GetArchivePortability, withSelector("")...))
+		api.GET("/codebases/:id/file", requireStorage, fromQuery(archiveHandler.GetSingleFile, withSelector("", q("path"), q("disposition"))...))
+		api.GET("/codebases/:id/file/stat", fromQuery(archiveHandler.StatFile, withSelector("", q("path"))...))
+		api.GET("/codebases/:id/file/history", fromQuery(historyHandler.GetFileHistory, q("branch"), q("path")))
+		api.GET("/codebases/:id/files", requireStorage, fromQuery(archiveHandler.GetFileBatch, withSelector("", qList("paths"), qBool("strict"))...))
+		api.GET("/codebases/:id/files/search", fromQuery(archiveHandler.SearchFiles, q("branch"), q("version"), q("pattern"), qBool("case_insensitive"), qList("filters")))
+		api.GET("/codebases/:id/tree", fromQuery(archiveHandler.GetTree, q("branch"), q("version"), qBool("nested")))
+		api.GET("/codebases/:id/diff", fromQuery(diffHandler.GetDiff, append(withSelector("from."), withSelector("to.")...)...))
+		api.GET("/codebases/:id/version", fromQuery(historyHandler.GetVersion, withSelector("")...))
+		api.GET("/codebases/:id/map", fromQuery(historyHandler.GetVersionMap))
+		api.GET("/codebases/:id/map/changes", fromQuery(historyHandler.GetVersionMapChanges, qInt("since_generation")))
+		api.GET("/codebases/:id/map/merge-base", fromQuery(historyHandler.GetMergeBase, append(withSelector("a."), withSelector("b.")...)...))
+		api.GET("/codebases/:id/tags", fromQuery(tagHandler.ListTags))
+		api.GET("/config", fromQuery(configHandler.GetConfig))
 	}
 
+	// 所有路由注册完成后生成文档，未在 routeDocs 中描述的路由会在启动时告警
+	registerOpenAPI(r, &spec)
 	return r
 }
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"context"
+	"log"
+	"main/calculate"
+	"main/core"
+	"net/http"
+	"time"
+)
+
+// Shutdown stops accepting requests, waits up to timeout for running requests, background jobs, snapshot
+// jobs and webhook deliveries, then writes pending metadata changes and releases the metadata directory.
+// stop is closed once the requests are drained, ending the periodic workers started with it. The
+// returned error is that of closing the provider; work cut off by the timeout is only logged.
+func Shutdown(server *http.Server, stop chan struct{}, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Requests still running at shutdown were cut off: %v", err)
+	}
+	close(stop)
+	if err := calculate.BackgroundJobs().Shutdown(ctx); err != nil {
+		log.Printf("Background jobs still running at shutdown were cut off: %v", err)
+	}
+	if err := calculate.WaitForSnapshotJobs(ctx); err != nil {
+		log.Printf("Snapshot jobs still running at shutdown were cut off: %v", err)
+	}
+	if err := calculate.WaitForWebhooks(ctx); err != nil {
+		log.Printf("Webhook deliveries still running at shutdown were cut off: %v", err)
+	}
+	return core.CloseProvider()
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"io"
+	"main/core"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A request running when shutdown starts completes before the metadata it wrote is flushed and the
+// provider closed.
+func TestShutdownDrainsSlowRequests(t *testing.T) {
+	dir := t.TempDir()
+	provider, err := core.NewJSONFileProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Changes are only written by the flush at shutdown
+	if err := provider.SetFlushPolicy(time.Hour, 1000); err != nil {
+		t.Fatal(err)
+	}
+	core.SetProvidersForTesting(provider, core.NewMemoryStorage())
+	t.Cleanup(func() { core.SetProvidersForTesting(core.NewMemoryProvider(), core.NewMemoryStorage()) })
+
+	started := make(chan struct{})
+	r := gin.New()
+	r.POST("/slow", func(c *gin.Context) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		now := time.Now()
+		if err := core.GetProvider().CreateCodebase(&core.Codebase{ID: "slow", Name: "slow", Branch: "main", CreatedAt: now, UpdatedAt: now}); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.String(http.StatusOK, "finished")
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: r}
+	go server.Serve(listener)
+	url := "http://" + listener.Addr().String() + "/slow"
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.Post(url, "application/json", nil)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		done <- result{resp.StatusCode, string(body), err}
+	}()
+	<-started
+
+	begin := time.Now()
+	if err := Shutdown(server, make(chan struct{}), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(begin); elapsed < 200*time.Millisecond {
+		t.Errorf("Shutdown returned after %s, before the request finished", elapsed)
+	}
+	if res := <-done; res.err != nil || res.status != http.StatusOK || res.body != "finished" {
+		t.Errorf("request running at shutdown = %d %q, %v; want it to finish", res.status, res.body, res.err)
+	}
+	if _, err := http.Post(url, "application/json", nil); err == nil {
+		t.Error("a request after shutdown was accepted")
+	}
+
+	// Closing the provider wrote the codebase and released the directory
+	reopened, err := core.NewJSONFileProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if _, err := reopened.GetCodebaseByID("slow"); err != nil {
+		t.Errorf("codebase written by the drained request: %v", err)
+	}
+}
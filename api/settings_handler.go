@@ -0,0 +1,63 @@
+package api
+
+import (
+	"main/calculate"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SettingsHandler handles per-codebase settings requests
+type SettingsHandler struct {
+	service *calculate.SettingsService
+}
+
+func NewSettingsHandler() *SettingsHandler {
+	return &SettingsHandler{
+		service: calculate.NewSettingsService(),
+	}
+}
+
+// GetSettings returns the effective settings of a codebase
+func (h *SettingsHandler) GetSettings(c *gin.Context) {
+	var req GetCodebaseSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	settings, err := h.service.GetSettings(req.Positions.CodebaseID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
+
+// SetSettings replaces the settings of a codebase
+func (h *SettingsHandler) SetSettings(c *gin.Context) {
+	var req SetCodebaseSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	settings, err := h.service.SetSettings(req.Positions.CodebaseID, req.Content)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "invalid"):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case strings.Contains(err.Error(), "not found"):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"main/calculate"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TagHandler handles tag management requests
+type TagHandler struct {
+	service *calculate.TagService
+}
+
+func NewTagHandler() *TagHandler {
+	return &TagHandler{
+		service: calculate.NewTagService(),
+	}
+}
+
+// CreateTag names an existing version
+func (h *TagHandler) CreateTag(c *gin.Context) {
+	var req CreateTagRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	tag, err := h.service.CreateTag(req.Positions.CodebaseID, req.Content.Name, req.Content.Message, calculate.VersionIdentifier{
+		Branch:  req.Content.Branch,
+		Version: req.Content.Version,
+	})
+	if err != nil {
+		if writeNameError(c, err) {
+			return
+		}
+		switch {
+		case strings.Contains(err.Error(), "already exists"):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case strings.Contains(err.Error(), "invalid"):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			writeVersionLookupError(c, err)
+		}
+		return
+	}
+	c.JSON(http.StatusCreated, tag)
+}
+
+// DeleteTag removes a tag
+func (h *TagHandler) DeleteTag(c *gin.Context) {
+	var req DeleteTagRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	if err := h.service.DeleteTag(req.Positions.CodebaseID, req.Content.Name); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Tag " + req.Content.Name + " has been deleted"})
+}
+
+// ListTags lists the tags of a codebase
+func (h *TagHandler) ListTags(c *gin.Context) {
+	var req ListTagsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	tags, err := h.service.ListTags(req.Positions.CodebaseID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tags": tags})
+}
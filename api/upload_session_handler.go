@@ -0,0 +1,176 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"main/calculate"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UploadSessionHandler handles snapshots uploaded file by file through an upload session
+type UploadSessionHandler struct {
+	service *calculate.UploadSessionService
+}
+
+func NewUploadSessionHandler() *UploadSessionHandler {
+	return &UploadSessionHandler{
+		service: calculate.NewUploadSessionService(),
+	}
+}
+
+// writeUploadSessionError maps upload session errors to status codes
+func writeUploadSessionError(c *gin.Context, err error) {
+	var offsetErr *calculate.UploadOffsetError
+	switch {
+	case errors.As(err, &offsetErr):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "path": offsetErr.Path, "received": offsetErr.Received})
+	case strings.Contains(err.Error(), "being committed"):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case strings.Contains(err.Error(), "too large"):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case strings.Contains(err.Error(), "invalid"):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case strings.Contains(err.Error(), "not found"):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// Start opens an upload session for a snapshot of a codebase
+func (h *UploadSessionHandler) Start(c *gin.Context) {
+	var req StartUploadSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	session, err := h.service.Start(req.Positions.CodebaseID, time.Duration(req.Content.TTLSeconds)*time.Second)
+	if err != nil {
+		writeUploadSessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, session)
+}
+
+// UploadFile stages a file, or a piece of one at content.offset, in a session
+func (h *UploadSessionHandler) UploadFile(c *gin.Context) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid multipart/form-data: " + err.Error()})
+		return
+	}
+	metadataValues := form.Value["metadata"]
+	if len(metadataValues) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing 'metadata' field"})
+		return
+	}
+	var req UploadSessionFileRequest
+	if err := json.Unmarshal([]byte(metadataValues[0]), &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid metadata JSON format: " + err.Error()})
+		return
+	}
+	if req.Positions.SessionID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing positions.session_id"})
+		return
+	}
+	if len(form.File["file"]) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing 'file' field"})
+		return
+	}
+
+	content, err := form.File["file"][0].Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read the uploaded file: " + err.Error()})
+		return
+	}
+	defer content.Close()
+
+	file, err := h.service.WriteFile(req.Positions.SessionID, req.Content.Path, req.Content.Offset, content)
+	if err != nil {
+		writeUploadSessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, file)
+}
+
+// GetSession lists the files staged in a session and how much of each was received
+func (h *UploadSessionHandler) GetSession(c *gin.Context) {
+	var req GetUploadSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	session, err := h.service.Get(req.Positions.SessionID)
+	if err != nil {
+		writeUploadSessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, session)
+}
+
+// Commit creates the snapshot from the staged files; the content is that of a snapshot upload
+func (h *UploadSessionHandler) Commit(c *gin.Context) {
+	// Decoded like the metadata of a snapshot upload, whose fields it shares
+	var req CommitUploadSessionRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request JSON format: " + err.Error()})
+		return
+	}
+	if req.Positions.SessionID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing positions.session_id"})
+		return
+	}
+	if req.Content.Async {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "async is not supported when committing an upload session"})
+		return
+	}
+	if req.Content.IdempotencyKey != "" || c.GetHeader("Idempotency-Key") != "" {
+		// The session is gone once committed, a retried commit can't be replayed
+		c.JSON(http.StatusBadRequest, gin.H{"error": "idempotency keys are not supported when committing an upload session"})
+		return
+	}
+
+	session, err := h.service.Get(req.Positions.SessionID)
+	if err != nil {
+		writeUploadSessionError(c, err)
+		return
+	}
+	if len(session.Files) == 0 && !emptySnapshotAllowed(req.Content) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No files staged in the session (set allow_empty to record an empty snapshot)"})
+		return
+	}
+
+	version, branchFrom, opts := snapshotParams(req.Content)
+	opts.Author = snapshotAuthor(c, opts.Author)
+	resp, err := h.service.Commit(req.Positions.SessionID, version, req.Content.Branch, req.Content.Message, branchFrom, req.Content.AutoLinkage, opts)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "upload session") {
+			writeUploadSessionError(c, err)
+		} else {
+			writeSnapshotError(c, err)
+		}
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// Abort removes a session and its staged files
+func (h *UploadSessionHandler) Abort(c *gin.Context) {
+	var req GetUploadSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body does not conform to specification: " + err.Error()})
+		return
+	}
+
+	if err := h.service.Abort(req.Positions.SessionID); err != nil {
+		writeUploadSessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Upload session aborted"})
+}
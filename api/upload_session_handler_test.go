@@ -0,0 +1,47 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/calculate"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestWriteUploadSessionError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{&calculate.UploadOffsetError{Path: "big.bin", Offset: 10, Received: 4096}, http.StatusConflict},
+		{errors.New("upload session s1 is being committed"), http.StatusConflict},
+		{errors.New("snapshot too large: file big.bin exceeds the limit of 10 bytes per file"), http.StatusRequestEntityTooLarge},
+		{errors.New(`invalid upload: "../x": path escapes the root`), http.StatusBadRequest},
+		{errors.New("upload session s1 not found"), http.StatusNotFound},
+		{fmt.Errorf("failed to stage a.txt: %w", errors.New("disk full")), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(rec)
+		writeUploadSessionError(c, tt.err)
+		if rec.Code != tt.want {
+			t.Errorf("%v: status = %d, want %d", tt.err, rec.Code, tt.want)
+		}
+	}
+
+	// A wrong offset tells the client where to continue
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	writeUploadSessionError(c, &calculate.UploadOffsetError{Path: "big.bin", Offset: 10, Received: 4096})
+	var body struct {
+		Path     string `json:"path"`
+		Received int64  `json:"received"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Path != "big.bin" || body.Received != 4096 {
+		t.Errorf("body = %s, want the path and the received count", rec.Body.String())
+	}
+}
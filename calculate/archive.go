@@ -1,59 +1,263 @@
 package calculate
 
 import (
-	"archive/zip"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"main/core"
-	"main/utils"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 // ArchiveService handles codebase archiving logic
-type ArchiveService struct{}
+type ArchiveService struct {
+	quarantine *QuarantineService
+}
 
 func NewArchiveService() *ArchiveService {
-	return &ArchiveService{}
+	return &ArchiveService{
+		quarantine: NewQuarantineService(),
+	}
 }
 
-// CreateArchiveForVersion creates a zip archive for the specified version
-// Returns the path of the temporarily generated zip file
-func (s *ArchiveService) CreateArchiveForVersion(codebaseID, branch, version string) (string, error) {
-	files, err := s.getFilesForVersion(codebaseID, branch, version)
+// Archives are written as their files are read, without restoring the tree on disk first: up to
+// fileWorkers() files are fetched ahead of the archive writer, which takes them in tree order. Files
+// up to archiveBufferSize are read whole by the fetchers, larger ones are streamed from storage when
+// their turn comes, so memory stays bounded whatever the size of the version. A file that fails once
+// the archive is under way leaves it unfinished, without the zip central directory or the tar end
+// marker, rather than short of a file. The format only decides how entries are written, see
+// archive_format.go. CreateArchiveForVersion writes the same archive to a temporary file for callers
+// that need a seekable file.
+
+// archiveBufferSize is the largest file an archive reads ahead of the archive writer
+const archiveBufferSize = 4 << 20
+
+// VersionArchive is the content of an archive: the files of a version in the order they are written
+type VersionArchive struct {
+	codebaseID string
+	files      []core.File
+	createdAt  time.Time // of the version, the date of tarball entries
+}
+
+// PrepareArchive looks up the files of a version for WriteArchive, so that a missing version or prefix
+// is reported before anything is written. With a pathPrefix only the files below that directory are
+// archived, with entries rooted at the prefix.
+func (s *ArchiveService) PrepareArchive(codebaseID, branch, version, pathPrefix string) (*VersionArchive, error) {
+	v, files, err := s.getVersionFiles(codebaseID, branch, version)
 	if err != nil {
-		return "", fmt.Errorf("unable to get file list: %w", err)
+		return nil, fmt.Errorf("unable to get file list: %w", err)
 	}
-	if len(files) == 0 {
-		return "", fmt.Errorf("no files found: codebase %s, branch %s, version %s", codebaseID, branch, version)
+	if prefix := NormalizePathPrefix(pathPrefix); prefix != "" {
+		if files = filesUnderPrefix(files, prefix); len(files) == 0 {
+			return nil, fmt.Errorf("path prefix %s not found in version %s/%s", prefix, branch, version)
+		}
 	}
-
-	reconstructionDir, err := os.MkdirTemp("", "codebase-reconstruction-*")
+	files, err = archiveEntries(files)
 	if err != nil {
-		return "", fmt.Errorf("unable to create temporary reconstruction directory: %w", err)
+		return nil, err
 	}
-	defer os.RemoveAll(reconstructionDir)
-	log.Printf("Reconstructing codebase in temporary directory: %s", reconstructionDir)
+	return &VersionArchive{codebaseID: codebaseID, files: files, createdAt: v.CreatedAt}, nil
+}
 
-	if err := s.reconstructFiles(files, reconstructionDir); err != nil {
-		return "", fmt.Errorf("file reconstruction failed: %w", err)
+// archiveEntries names files by their restored paths, sorted, and keeps only the directories nothing
+// else is below: the others come with their files. Of entries restored under the same name the first
+// one is kept.
+func archiveEntries(files []core.File) ([]core.File, error) {
+	entries := make([]core.File, 0, len(files))
+	seen := make(map[string]bool, len(files))
+	parents := make(map[string]bool)
+	for _, f := range files {
+		name, err := restoreName(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		f.Path = name
+		entries = append(entries, f)
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			parents[dir] = true
+		}
+	}
+	kept := entries[:0]
+	for _, f := range entries {
+		if !f.IsDir() || !parents[f.Path] {
+			kept = append(kept, f)
+		}
 	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Path < kept[j].Path })
+	return kept, nil
+}
+
+// archiveFile is a file of an archive as fetched ahead of the archive writer
+type archiveFile struct {
+	content  []byte
+	buffered bool  // content holds the whole file; otherwise it is streamed when written
+	err      error // the content can't be read
+}
 
-	zipPath, err := s.createZipArchive(reconstructionDir)
+// WriteArchive writes an archive to w in format; tarballs have their entries below the directory root.
+// Corrupt objects are quarantined; with allowPartial the affected files (and files whose object was
+// purged from quarantine) are replaced by a "<path>.CORRUPT" placeholder and their paths returned,
+// otherwise the first error is returned and the archive is left unfinished.
+func (s *ArchiveService) WriteArchive(w io.Writer, archive *VersionArchive, format ArchiveFormat, root string, allowPartial bool) ([]string, error) {
+	storage := core.GetStore()
+	purged := s.quarantine.purgedKeys()
+	files := archive.files
+
+	// A slot is taken for every file fetched and given back once the file is written
+	fetched := make([]chan archiveFile, len(files))
+	for i := range fetched {
+		fetched[i] = make(chan archiveFile, 1)
+	}
+	slots := make(chan struct{}, fileWorkers())
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for i := range files {
+			select {
+			case slots <- struct{}{}:
+			case <-stop:
+				return
+			}
+			go func(i int) { fetched[i] <- fetchArchiveFile(storage, files[i], allowPartial) }(i)
+		}
+	}()
+
+	writer := newArchiveWriter(format, w, root, archive.createdAt)
+	var corrupted []string
+	for i, f := range files {
+		file := <-fetched[i]
+		err := file.err
+		if err == nil {
+			err = writeArchiveFile(writer, storage, f, file)
+		}
+		<-slots
+		if err == nil {
+			continue
+		}
+		s.quarantine.recordIfCorrupt(archive.codebaseID, err)
+		var corrupt *CorruptObjectError
+		// Only a file that failed before it was written can still be replaced
+		if file.err == nil || !allowPartial || !(errors.As(err, &corrupt) || referencesAny(f, purged)) {
+			return nil, err
+		}
+		placeholder := fmt.Sprintf("The content of %s could not be restored: %v\nSee /api/v1/admin/quarantine/list.\n", f.Path, err)
+		entry, err := writer.file(f.Path+corruptPlaceholderSuffix, defaultFileMode, int64(len(placeholder)))
+		if err == nil {
+			_, err = io.WriteString(entry, placeholder)
+		}
+		if err != nil {
+			return nil, err
+		}
+		corrupted = append(corrupted, f.Path)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return corrupted, nil
+}
+
+// fetchArchiveFile reads a file small enough to be buffered. A larger one is read through only with
+// allowPartial, to find out whether it is corrupt before its entry is started.
+func fetchArchiveFile(storage core.Storage, f core.File, allowPartial bool) archiveFile {
+	switch {
+	case f.IsDir():
+		return archiveFile{buffered: true}
+	case f.Size <= archiveBufferSize:
+		content, err := readFileContent(storage, f)
+		return archiveFile{content: content, buffered: true, err: err}
+	case allowPartial:
+		content, err := openFileContent(storage, f)
+		if err == nil {
+			_, err = io.Copy(io.Discard, content)
+			content.Close()
+		}
+		return archiveFile{err: err}
+	}
+	return archiveFile{}
+}
+
+// writeArchiveFile adds the entry of one file, streaming its content from storage unless it was
+// buffered.
+func writeArchiveFile(writer archiveWriter, storage core.Storage, f core.File, file archiveFile) error {
+	if f.IsDir() {
+		return writer.dir(f.Path)
+	}
+	entry, err := writer.file(f.Path, fileMode(f), f.Size)
+	if err != nil {
+		return err
+	}
+	if file.buffered {
+		_, err = entry.Write(file.content)
+		return err
+	}
+	content, err := openFileContent(storage, f)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	_, err = io.Copy(entry, content)
+	return err
+}
+
+// CreateArchiveForVersion writes the archive of a version to a temporary file and returns its path
+// and, with allowPartial, the paths of the files replaced by placeholders. See PrepareArchive and
+// WriteArchive.
+func (s *ArchiveService) CreateArchiveForVersion(codebaseID, branch, version, pathPrefix string, format ArchiveFormat, root string, allowPartial bool) (string, []string, error) {
+	archive, err := s.PrepareArchive(codebaseID, branch, version, pathPrefix)
+	if err != nil {
+		return "", nil, err
+	}
+	archiveFile, err := os.CreateTemp("", "codebase-archive-*."+format.Extension())
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to create temporary archive: %w", err)
+	}
+	corrupt, err := s.WriteArchive(archiveFile, archive, format, root, allowPartial)
+	if closeErr := archiveFile.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
 	if err != nil {
-		return "", fmt.Errorf("zip archive creation failed: %w", err)
+		os.Remove(archiveFile.Name())
+		return "", nil, fmt.Errorf("%s archive creation failed: %w", format, err)
 	}
+	log.Printf("Archive file created successfully: %s", archiveFile.Name())
+	return archiveFile.Name(), corrupt, nil
+}
 
-	log.Printf("Archive file created successfully: %s", zipPath)
-	return zipPath, nil
+// NormalizePathPrefix turns a directory given as "docs", "/docs" or "docs/" into "docs/". Empty means the whole tree.
+func NormalizePathPrefix(prefix string) string {
+	prefix = strings.Trim(filepath.ToSlash(prefix), "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
+// filesUnderPrefix returns the files below prefix with their paths made relative to it.
+func filesUnderPrefix(files []core.File, prefix string) []core.File {
+	var selected []core.File
+	for _, f := range files {
+		if strings.HasPrefix(f.Path, prefix) {
+			f.Path = strings.TrimPrefix(f.Path, prefix)
+			selected = append(selected, f)
+		}
+	}
+	return selected
 }
 
 // GetCodebaseName gets codebase name from metadata
 func (s *ArchiveService) GetCodebaseName(codebaseID string) (string, error) {
 	provider := core.GetProvider()
-	codebase, err := provider.GetCodebaseByID(codebaseID)
+	codebase, err := getActiveCodebase(provider, codebaseID)
 	if err != nil {
 		return "", err
 	}
@@ -61,148 +265,197 @@ func (s *ArchiveService) GetCodebaseName(codebaseID string) (string, error) {
 }
 
 func (s *ArchiveService) getFilesForVersion(codebaseID, branch, version string) ([]core.File, error) {
+	_, files, err := s.getVersionFiles(codebaseID, branch, version)
+	return files, err
+}
+
+func (s *ArchiveService) getVersionFiles(codebaseID, branch, version string) (*core.Version, []core.File, error) {
 	provider := core.GetProvider()
-	v, err := provider.GetVersion(codebaseID, branch, version)
+	v, err := resolveVersion(provider, codebaseID, branch, version)
 	if err != nil {
-		return nil, fmt.Errorf("specified version not found: %w", err)
+		return nil, nil, fmt.Errorf("specified version not found: %w", err)
 	}
 
 	files, err := provider.GetFileIndexesByTreeID(v.TreeID)
 	if err != nil {
-		return nil, fmt.Errorf("file index query failed: %w", err)
+		return nil, nil, fmt.Errorf("file index query failed: %w", err)
 	}
-	return files, nil
+	return v, files, nil
 }
 
-func (s *ArchiveService) reconstructFiles(files []core.File, destDir string) error {
-	storage := core.GetStore()
-	var wg sync.WaitGroup
-	errChan := make(chan error, len(files))
-
-	for _, file := range files {
-		wg.Add(1)
-		go func(f core.File) {
-			defer wg.Done()
-			log.Printf("Processing file: %s (type: %s)", f.Path, f.Type)
-
-			content, err := storage.GetObject(f.StorageKey)
-			if err != nil {
-				errChan <- fmt.Errorf("download %s failed: %w", f.StorageKey, err)
-				return
-			}
-
-			if f.Type != "image" {
-				content, err = utils.DecompressData(content)
-				if err != nil {
-					errChan <- fmt.Errorf("decompression %s failed: %w", f.Path, err)
-					return
-				}
-			}
-
-			destPath := filepath.Join(destDir, f.Path)
-			if err := os.MkdirAll(filepath.Dir(destPath), os.ModePerm); err != nil {
-				errChan <- fmt.Errorf("directory creation for %s failed: %w", f.Path, err)
-				return
-			}
-			if err := os.WriteFile(destPath, content, 0644); err != nil {
-				errChan <- fmt.Errorf("file write %s failed: %w", f.Path, err)
-				return
-			}
-		}(file)
+// referencesAny reports whether any object of f is in keys.
+func referencesAny(f core.File, keys map[string]bool) bool {
+	for _, key := range f.StorageKeys() {
+		if keys[key] {
+			return true
+		}
 	}
-
-	wg.Wait()
-	close(errChan)
-
-	// Return the first error encountered
-	return <-errChan
+	return false
 }
 
-func (s *ArchiveService) createZipArchive(sourceDir string) (string, error) {
-	zipFile, err := os.CreateTemp("", "codebase-archive-*.zip")
+// CheckPortability reports the paths of a version that can't be extracted on every platform,
+// including files renamed by the sanitize policy when the snapshot was taken.
+func (s *ArchiveService) CheckPortability(codebaseID, branch, version string) ([]core.PortabilityIssue, error) {
+	if _, err := getActiveCodebase(core.GetProvider(), codebaseID); err != nil {
+		return nil, err
+	}
+	files, err := s.getFilesForVersion(codebaseID, branch, version)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer zipFile.Close()
-
-	writer := zip.NewWriter(zipFile)
-	defer writer.Close()
-
-	err = filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
-
-		relPath, err := filepath.Rel(sourceDir, path)
-		if err != nil {
-			return err
-		}
-
-		zipEntry, err := writer.Create(filepath.ToSlash(relPath))
-		if err != nil {
-			return err
-		}
-
-		fileToZip, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer fileToZip.Close()
-
-		_, err = io.Copy(zipEntry, fileToZip)
-		return err
-	})
+	return portabilityIssuesOf(files), nil
+}
 
-	return zipFile.Name(), err
+// SingleFile is an opened file of a version. Content streams the original content and must be closed.
+type SingleFile struct {
+	Content io.ReadCloser
+	Name    string
+	Size    int64
+	Attrs   map[string]string
 }
 
-// GetSingleFile downloads a single file
-func (s *ArchiveService) GetSingleFile(codebaseID, branch, version, filePath string) ([]byte, string, error) {
+// GetSingleFile opens a single file for download. The content is streamed from storage and verified
+// while it is read; a corrupt object fails the read and is quarantined.
+func (s *ArchiveService) GetSingleFile(codebaseID, branch, version, filePath string) (*SingleFile, error) {
 	provider := core.GetProvider()
 	storage := core.GetStore()
 
 	// 1. Get version information
-	v, err := provider.GetVersion(codebaseID, branch, version)
+	v, err := resolveVersion(provider, codebaseID, branch, version)
 	if err != nil {
-		return nil, "", fmt.Errorf("specified version not found: %w", err)
+		return nil, fmt.Errorf("specified version not found: %w", err)
 	}
 
 	// 2. Find specific file from file index
 	files, err := provider.GetFileIndexesByTreeID(v.TreeID)
 	if err != nil {
-		return nil, "", fmt.Errorf("file index for tree_id %s not found: %w", v.TreeID, err)
+		return nil, fmt.Errorf("file index for tree_id %s not found: %w", v.TreeID, err)
 	}
 
 	var targetFile *core.File
 	for i := range files {
-		if files[i].Path == filePath {
+		if files[i].Path == filePath && !files[i].IsDir() {
 			targetFile = &files[i]
 			break
 		}
 	}
 
 	if targetFile == nil {
-		return nil, "", fmt.Errorf("file '%s' not found in version %s", filePath, version)
+		return nil, fmt.Errorf("file '%s' not found in version %s", filePath, version)
 	}
 
-	// 3. Download file from storage
-	content, err := storage.GetObject(targetFile.StorageKey)
+	// 3. Open the file in storage (or the read cache), decompressing as it is read
+	content, err := openFileContent(storage, *targetFile)
 	if err != nil {
-		return nil, "", fmt.Errorf("file download failed: %w", err)
+		s.quarantine.recordIfCorrupt(codebaseID, err)
+		return nil, fmt.Errorf("file download failed: %w", err)
 	}
 
-	// 4. Decompress if not an image file
-	if targetFile.Type != "image" {
-		content, err = utils.DecompressData(content)
-		if err != nil {
-			return nil, "", fmt.Errorf("file decompression failed: %w", err)
+	// Return file content, original filename and the attributes recorded at snapshot time
+	return &SingleFile{
+		Content: &quarantiningReader{ReadCloser: content, quarantine: s.quarantine, codebaseID: codebaseID},
+		Name:    filepath.Base(filePath),
+		Size:    targetFile.Size,
+		Attrs:   targetFile.Attrs,
+	}, nil
+}
+
+// quarantiningReader quarantines the object behind a corrupt read of a streamed download.
+type quarantiningReader struct {
+	io.ReadCloser
+	quarantine *QuarantineService
+	codebaseID string
+}
+
+func (q *quarantiningReader) Read(p []byte) (int, error) {
+	n, err := q.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		q.quarantine.recordIfCorrupt(q.codebaseID, err)
+	}
+	return n, err
+}
+
+// batchReadConcurrency bounds how many blobs GetFiles reads at once
+const batchReadConcurrency = 8
+
+// BatchFile is the restored content of one requested file
+type BatchFile struct {
+	Path    string
+	Content []byte
+	Mode    os.FileMode
+}
+
+// FileBatch holds the files found by GetFiles in request order and the requested paths that don't exist
+type FileBatch struct {
+	Files   []BatchFile
+	Missing []string
+}
+
+// GetFiles restores several files of one version, reading their blobs concurrently. Paths that aren't
+// part of the version are returned in Missing, or fail the request with a PathNotFoundError when strict.
+func (s *ArchiveService) GetFiles(codebaseID, branch, version string, paths []string, strict bool) (*FileBatch, error) {
+	if _, err := getActiveCodebase(core.GetProvider(), codebaseID); err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("invalid request: no paths given")
+	}
+	files, err := s.getFilesForVersion(codebaseID, branch, version)
+	if err != nil {
+		return nil, err
+	}
+	byPath := make(map[string]core.File, len(files))
+	for _, f := range files {
+		if !f.IsDir() {
+			byPath[f.Path] = f
 		}
 	}
 
-	// Return file content and original filename
-	fileName := filepath.Base(filePath)
-	return content, fileName, nil
+	batch := &FileBatch{}
+	var wanted []core.File
+	seen := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		p = strings.TrimPrefix(filepath.ToSlash(p), "/")
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		f, ok := byPath[p]
+		if !ok {
+			if strict {
+				return nil, &PathNotFoundError{Path: p, Branch: branch, Version: version}
+			}
+			batch.Missing = append(batch.Missing, p)
+			continue
+		}
+		wanted = append(wanted, f)
+	}
+
+	storage := core.GetStore()
+	batch.Files = make([]BatchFile, len(wanted))
+	errs := make([]error, len(wanted))
+	slots := make(chan struct{}, batchReadConcurrency)
+	var wg sync.WaitGroup
+	for i := range wanted {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, f core.File) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			content, err := readFileContent(storage, f)
+			if err != nil {
+				s.quarantine.recordIfCorrupt(codebaseID, err)
+				errs[i] = fmt.Errorf("file download failed: %w", err)
+				return
+			}
+			batch.Files[i] = BatchFile{Path: f.Path, Content: content, Mode: fileMode(f)}
+		}(i, wanted[i])
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return batch, nil
 }
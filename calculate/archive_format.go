@@ -0,0 +1,162 @@
+package calculate
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ArchiveFormat is the file format a version archive is written in
+type ArchiveFormat string
+
+const (
+	ArchiveZip   ArchiveFormat = "zip"
+	ArchiveTarGz ArchiveFormat = "tar.gz"
+)
+
+// ParseArchiveFormat reads the format of an archive request; empty means zip.
+func ParseArchiveFormat(value string) (ArchiveFormat, error) {
+	switch format := ArchiveFormat(strings.ToLower(strings.TrimSpace(value))); format {
+	case "":
+		return ArchiveZip, nil
+	case ArchiveZip, ArchiveTarGz:
+		return format, nil
+	}
+	return "", fmt.Errorf("invalid archive format %q, expected %q or %q", value, ArchiveZip, ArchiveTarGz)
+}
+
+// Extension returns the file name extension of the format, without the dot
+func (f ArchiveFormat) Extension() string {
+	return string(f)
+}
+
+// ContentType returns the media type archives of the format are sent as
+func (f ArchiveFormat) ContentType() string {
+	if f == ArchiveTarGz {
+		return "application/gzip"
+	}
+	return "application/zip"
+}
+
+// archiveWriter adds the entries of an archive in one format. Names are slash paths; directories are
+// given without a trailing slash.
+type archiveWriter interface {
+	dir(name string) error
+	// file starts a file entry of size bytes and returns the writer its content goes to
+	file(name string, mode os.FileMode, size int64) (io.Writer, error)
+	// Close finishes the archive; an archive that isn't closed lacks its index or end marker
+	Close() error
+}
+
+// newArchiveWriter returns the writer of format on w. Tarballs put their entries below a root
+// directory, the way source tarballs are laid out, and date them at modTime; zip entries stay at the
+// top level.
+func newArchiveWriter(format ArchiveFormat, w io.Writer, root string, modTime time.Time) archiveWriter {
+	if format == ArchiveTarGz {
+		gz := gzip.NewWriter(w)
+		return &tarArchiveWriter{gz: gz, tw: tar.NewWriter(gz), root: root, modTime: modTime.Truncate(time.Second)}
+	}
+	return &zipArchiveWriter{zw: zip.NewWriter(w)}
+}
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (z *zipArchiveWriter) dir(name string) error {
+	header := &zip.FileHeader{Name: name + "/"}
+	header.SetMode(os.ModeDir | dirEntryMode)
+	_, err := z.zw.CreateHeader(header)
+	return err
+}
+
+func (z *zipArchiveWriter) file(name string, mode os.FileMode, size int64) (io.Writer, error) {
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	header.SetMode(mode)
+	return z.zw.CreateHeader(header)
+}
+
+func (z *zipArchiveWriter) Close() error {
+	return z.zw.Close()
+}
+
+type tarArchiveWriter struct {
+	gz      *gzip.Writer
+	tw      *tar.Writer
+	root    string
+	modTime time.Time
+	// dirs holds the directories written so far, tar has no implicit parents
+	dirs map[string]bool
+}
+
+func (t *tarArchiveWriter) dir(name string) error {
+	if t.dirs == nil {
+		t.dirs = make(map[string]bool)
+	}
+	if t.dirs[name] {
+		return nil
+	}
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		if err := t.dir(name[:i]); err != nil {
+			return err
+		}
+	} else if name != "" {
+		if err := t.dir(""); err != nil {
+			return err
+		}
+	}
+	t.dirs[name] = true
+	if t.root == "" && name == "" {
+		return nil
+	}
+	return t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     t.name(name) + "/",
+		Mode:     int64(dirEntryMode),
+		ModTime:  t.modTime,
+	})
+}
+
+func (t *tarArchiveWriter) file(name string, mode os.FileMode, size int64) (io.Writer, error) {
+	parent := ""
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		parent = name[:i]
+	}
+	if err := t.dir(parent); err != nil {
+		return nil, err
+	}
+	err := t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     t.name(name),
+		Mode:     int64(mode & os.ModePerm),
+		Size:     size,
+		ModTime:  t.modTime,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t.tw, nil
+}
+
+// name places an entry below the root directory
+func (t *tarArchiveWriter) name(name string) string {
+	switch {
+	case t.root == "":
+		return name
+	case name == "":
+		return t.root
+	}
+	return t.root + "/" + name
+}
+
+func (t *tarArchiveWriter) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
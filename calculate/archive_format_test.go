@@ -0,0 +1,126 @@
+package calculate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseArchiveFormat(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    ArchiveFormat
+		wantErr bool
+	}{
+		{"", ArchiveZip, false},
+		{"zip", ArchiveZip, false},
+		{" TAR.GZ ", ArchiveTarGz, false},
+		{"rar", "", true},
+		{"tgz", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseArchiveFormat(tt.value)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseArchiveFormat(%q) = %q, %v", tt.value, got, err)
+		}
+	}
+	if ArchiveTarGz.ContentType() != "application/gzip" || ArchiveZip.ContentType() != "application/zip" || ArchiveTarGz.Extension() != "tar.gz" {
+		t.Error("content types or extensions of the formats changed")
+	}
+}
+
+// tarEntry is an entry of a tarball as read back
+type tarEntry struct {
+	typeflag byte
+	mode     int64
+	content  string
+}
+
+func tarEntries(t *testing.T, data []byte) (map[string]tarEntry, []string, time.Time) {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	entries := make(map[string]tarEntry)
+	var order []string
+	var modTime time.Time
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[header.Name] = tarEntry{typeflag: header.Typeflag, mode: header.Mode, content: string(content)}
+		order = append(order, header.Name)
+		modTime = header.ModTime
+	}
+	return entries, order, modTime
+}
+
+func TestWriteArchiveTarGz(t *testing.T) {
+	useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "tarball")
+	big := strings.Repeat("streamed into the tarball ", archiveBufferSize/20)
+	files := snapshotFiles(map[string]string{"run.sh": "#!/bin/sh\n", "src/pkg/a.go": "package pkg", "big.txt": big})
+	resp, err := NewUploadService().ProcessSnapshot(codebase.ID, "v1", "main", "", files, nil, true,
+		SnapshotOptions{Modes: map[string]string{"run.sh": "755"}, Directories: []string{"empty"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archives := NewArchiveService()
+	archive, err := archives.PrepareArchive(codebase.ID, "main", "v1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if _, err := archives.WriteArchive(&out, archive, ArchiveTarGz, "tarball-main-v1", false); err != nil {
+		t.Fatal(err)
+	}
+	entries, order, modTime := tarEntries(t, out.Bytes())
+	want := map[string]tarEntry{
+		"tarball-main-v1/":             {tar.TypeDir, int64(dirEntryMode), ""},
+		"tarball-main-v1/big.txt":      {tar.TypeReg, int64(defaultFileMode), big},
+		"tarball-main-v1/empty/":       {tar.TypeDir, int64(dirEntryMode), ""},
+		"tarball-main-v1/run.sh":       {tar.TypeReg, 0755, "#!/bin/sh\n"},
+		"tarball-main-v1/src/":         {tar.TypeDir, int64(dirEntryMode), ""},
+		"tarball-main-v1/src/pkg/":     {tar.TypeDir, int64(dirEntryMode), ""},
+		"tarball-main-v1/src/pkg/a.go": {tar.TypeReg, int64(defaultFileMode), "package pkg"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("tarball entries = %v, want %v", order, want)
+	}
+	// Directories come before what is below them, tar has no implicit parents
+	seen := make(map[string]bool)
+	for _, name := range order {
+		if i := strings.LastIndex(strings.TrimSuffix(name, "/"), "/"); i >= 0 && !seen[name[:i+1]] {
+			t.Errorf("%s comes before its directory", name)
+		}
+		seen[name] = true
+	}
+	if !modTime.Equal(resp.Version.CreatedAt.Truncate(time.Second)) {
+		t.Errorf("entries dated %v, want the version's creation time %v", modTime, resp.Version.CreatedAt)
+	}
+
+	// Without a root the entries are at the top level
+	out.Reset()
+	if _, err := archives.WriteArchive(&out, archive, ArchiveTarGz, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _, _ := tarEntries(t, out.Bytes()); entries["run.sh"].content != "#!/bin/sh\n" || len(entries) != 6 {
+		t.Errorf("tarball without a root = %v", entries)
+	}
+}
@@ -0,0 +1,154 @@
+package calculate
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"main/core"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// countingStorage counts the objects read through it
+type countingStorage struct {
+	*core.MemoryStorage
+	mu    sync.Mutex
+	reads int
+}
+
+func (s *countingStorage) count() {
+	s.mu.Lock()
+	s.reads++
+	s.mu.Unlock()
+}
+
+func (s *countingStorage) GetObject(name string) ([]byte, error) {
+	s.count()
+	return s.MemoryStorage.GetObject(name)
+}
+
+func (s *countingStorage) GetObjectStream(name string) (io.ReadCloser, error) {
+	s.count()
+	return s.MemoryStorage.GetObjectStream(name)
+}
+
+func (s *countingStorage) takeReads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reads := s.reads
+	s.reads = 0
+	return reads
+}
+
+func TestArchiveUsesBlobCache(t *testing.T) {
+	provider, memory := useMemoryBackends(t)
+	storage := &countingStorage{MemoryStorage: memory}
+	core.SetProvidersForTesting(provider, storage)
+	core.SetBlobCacheForTesting(core.NewBlobCache(1<<20, 0))
+	t.Cleanup(func() { core.SetBlobCacheForTesting(nil) })
+
+	codebase := mustInitCodebase(t, "archive")
+	contents := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		contents[fmt.Sprintf("dir/file%02d.txt", i)] = fmt.Sprintf("content of file %d", i)
+	}
+	mustSnapshot(t, codebase.ID, "main", "v1", contents)
+
+	archives := NewArchiveService()
+	build := func() {
+		t.Helper()
+		archive, err := archives.PrepareArchive(codebase.ID, "main", "v1", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archives.WriteArchive(io.Discard, archive, ArchiveZip, "", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storage.takeReads()
+	build()
+	first := storage.takeReads()
+	build()
+	second := storage.takeReads()
+	if first < len(contents) {
+		t.Fatalf("the first archive read %d objects, want at least one per file (%d)", first, len(contents))
+	}
+	if second > first/10 {
+		t.Errorf("the second archive read %d objects, want far fewer than the first (%d)", second, first)
+	}
+	if stats := core.GetBlobCache().Stats(); stats.Hits < int64(len(contents)) {
+		t.Errorf("read cache stats = %+v, want a hit per file of the second archive", stats)
+	}
+}
+
+// Archives are written in path order while only a few files are read ahead, files larger than the
+// read-ahead buffer included, and match the spooled archive byte for byte.
+func TestWriteArchiveStreams(t *testing.T) {
+	_, storage := useMemoryBackends(t)
+	core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), FileWorkers: 2})
+	t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+	codebase := mustInitCodebase(t, "streamed")
+	contents := map[string]string{"big.bin": strings.Repeat("larger than the read-ahead buffer ", archiveBufferSize/20)}
+	for i := 0; i < 12; i++ {
+		contents[fmt.Sprintf("dir%d/file%02d.txt", i%3, i)] = fmt.Sprintf("content of file %d", i)
+	}
+	mustSnapshot(t, codebase.ID, "main", "v1", contents)
+
+	archives := NewArchiveService()
+	archive, err := archives.PrepareArchive(codebase.ID, "main", "v1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var streamed bytes.Buffer
+	if _, err := archives.WriteArchive(&streamed, archive, ArchiveZip, "", false); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(streamed.Bytes()), int64(streamed.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	if !sort.StringsAreSorted(names) || len(names) != len(contents) {
+		t.Errorf("entries %v, want the %d files in path order", names, len(contents))
+	}
+	if got := zipContents(t, streamed.Bytes()); !reflect.DeepEqual(got, contents) {
+		t.Errorf("archive holds %d files that don't match the %d of the version", len(got), len(contents))
+	}
+
+	path, _, err := archives.CreateArchiveForVersion(codebase.ID, "main", "v1", "", ArchiveZip, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	spooled, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(spooled, streamed.Bytes()) {
+		t.Errorf("spooled archive (%d bytes) differs from the streamed one (%d bytes)", len(spooled), streamed.Len())
+	}
+
+	// A file failing once the archive is under way leaves it unfinished rather than short of the file
+	last := archive.files[len(archive.files)-1]
+	if err := storage.PutObject(last.StorageKey, []byte("not the content")); err != nil {
+		t.Fatal(err)
+	}
+	var unfinished bytes.Buffer
+	_, err = archives.WriteArchive(&unfinished, archive, ArchiveZip, "", false)
+	var corrupt *CorruptObjectError
+	if !errors.As(err, &corrupt) || corrupt.Path != last.Path {
+		t.Errorf("archive with %s corrupt = %v, want a CorruptObjectError", last.Path, err)
+	}
+	if _, err := zip.NewReader(bytes.NewReader(unfinished.Bytes()), int64(unfinished.Len())); err == nil {
+		t.Error("the archive was finished without the corrupt file")
+	}
+}
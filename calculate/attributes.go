@@ -0,0 +1,105 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Limits on per-file attributes, checked before anything is stored so the file index stays small
+const (
+	maxAttrsPerFile         = 32
+	maxAttrBytesPerFile     = 4 << 10 // keys plus values of one file
+	maxAttrBytesPerSnapshot = 1 << 20 // keys plus values of every file in a snapshot
+)
+
+// AttributeError lists every problem found in the attributes of a snapshot request
+type AttributeError struct {
+	UnknownPaths   []string `json:"unknown_paths,omitempty"`   // paths that are not part of the upload
+	OversizedPaths []string `json:"oversized_paths,omitempty"` // paths over the per-file count or size limit
+	EmptyKeys      []string `json:"empty_keys,omitempty"`      // paths with an empty attribute name
+	SnapshotBytes  int      `json:"snapshot_bytes,omitempty"`  // set when the whole snapshot is over its limit
+}
+
+func (e *AttributeError) Error() string {
+	msg := fmt.Sprintf("invalid attributes: %d paths not in the upload, %d paths over the per-file limit (%d attributes, %d bytes), %d paths with empty names",
+		len(e.UnknownPaths), len(e.OversizedPaths), maxAttrsPerFile, maxAttrBytesPerFile, len(e.EmptyKeys))
+	if e.SnapshotBytes > 0 {
+		msg += fmt.Sprintf(", %d bytes exceed the snapshot limit of %d bytes", e.SnapshotBytes, maxAttrBytesPerSnapshot)
+	}
+	return msg
+}
+
+func (e *AttributeError) empty() bool {
+	return len(e.UnknownPaths) == 0 && len(e.OversizedPaths) == 0 && len(e.EmptyKeys) == 0 && e.SnapshotBytes == 0
+}
+
+// checkAttributes validates attributes against the uploaded paths, and those of manifest entries
+// resolved to stored content, and the size limits.
+func checkAttributes(attrs map[string]map[string]string, files map[string]*SnapshotFile, known []core.File) error {
+	if len(attrs) == 0 {
+		return nil
+	}
+	received := make(map[string]bool, len(files)+len(known))
+	for relPath := range files {
+		received[filepath.ToSlash(relPath)] = true
+	}
+	for _, f := range known {
+		received[f.Path] = true
+	}
+
+	result := &AttributeError{}
+	total := 0
+	for relPath, fileAttrs := range attrs {
+		if !received[filepath.ToSlash(relPath)] {
+			result.UnknownPaths = append(result.UnknownPaths, relPath)
+			continue
+		}
+		size := 0
+		for k, v := range fileAttrs {
+			if strings.TrimSpace(k) == "" {
+				result.EmptyKeys = append(result.EmptyKeys, relPath)
+			}
+			size += len(k) + len(v)
+		}
+		if len(fileAttrs) > maxAttrsPerFile || size > maxAttrBytesPerFile {
+			result.OversizedPaths = append(result.OversizedPaths, relPath)
+		}
+		total += size
+	}
+	if total > maxAttrBytesPerSnapshot {
+		result.SnapshotBytes = total
+	}
+	if result.empty() {
+		return nil
+	}
+	sort.Strings(result.UnknownPaths)
+	sort.Strings(result.OversizedPaths)
+	sort.Strings(result.EmptyKeys)
+	return result
+}
+
+// applyAttributes attaches attributes to processed files. Files renamed by the path policy
+// are matched by the path they were uploaded as.
+func applyAttributes(files []core.File, attrs map[string]map[string]string) {
+	if len(attrs) == 0 {
+		return
+	}
+	byPath := make(map[string]map[string]string, len(attrs))
+	for relPath, fileAttrs := range attrs {
+		if len(fileAttrs) > 0 {
+			byPath[filepath.ToSlash(relPath)] = fileAttrs
+		}
+	}
+	for i := range files {
+		uploadedAs := files[i].Path
+		if files[i].OriginalPath != "" {
+			uploadedAs = files[i].OriginalPath
+		}
+		if fileAttrs, ok := byPath[uploadedAs]; ok {
+			files[i].Attrs = fileAttrs
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package calculate
+
+import (
+	"log"
+	"main/core"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Actions recorded in the audit log
+const (
+	AuditTrashPurge        = "trash_purge"         // a trashed codebase was deleted for good once its retention window passed
+	AuditTrashPurgeSkipped = "trash_purge_skipped" // an expired trashed codebase was kept because of a locked or pinned version
+)
+
+// AuditService reads the audit log, which records permanent changes made without a request, such as
+// trash purges, and the ones retention rules held back
+type AuditService struct{}
+
+func NewAuditService() *AuditService {
+	return &AuditService{}
+}
+
+// List returns the audit entries, oldest first, optionally only those of one action or codebase.
+func (s *AuditService) List(action, codebaseID string) ([]*core.AuditEntry, error) {
+	entries, err := core.GetProvider().ListAuditEntries()
+	if err != nil {
+		return nil, err
+	}
+	filtered := make([]*core.AuditEntry, 0, len(entries))
+	for _, e := range entries {
+		if (action == "" || e.Action == action) && (codebaseID == "" || e.CodebaseID == codebaseID) {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered, nil
+}
+
+// recordAudit appends an entry to the audit log. A failure is logged; the change it describes has
+// happened anyway.
+func recordAudit(provider core.DataProvider, at time.Time, action, codebaseID, detail string) {
+	entry := &core.AuditEntry{ID: uuid.NewString(), Time: at, Action: action, CodebaseID: codebaseID, Detail: detail}
+	if err := provider.AppendAuditEntry(entry); err != nil {
+		log.Printf("Failed to write audit entry %s for codebase %s: %v", action, codebaseID, err)
+	}
+}
@@ -0,0 +1,56 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"net/mail"
+	"strings"
+	"unicode"
+)
+
+// A version records who created it in Version.Author: a name and an email, or an opaque ID a client
+// chooses for itself, e.g. a CI job. The author comes from content.author of the snapshot request or,
+// without it, from the X-CVCS-Author header. A snapshot without either is stored without an author.
+
+// maxAuthorFieldLength caps each field of an author, in bytes
+const maxAuthorFieldLength = 255
+
+// ParseAuthorHeader reads an X-CVCS-Author header: an address such as "Jane Doe <jane@example.com>"
+// or "jane@example.com", otherwise the whole value is taken as the name.
+func ParseAuthorHeader(value string) *core.VersionAuthor {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	if addr, err := mail.ParseAddress(value); err == nil {
+		return &core.VersionAuthor{Name: addr.Name, Email: addr.Address}
+	}
+	return &core.VersionAuthor{Name: value}
+}
+
+// normalizeAuthor trims the fields of an author and checks them. An author with only empty fields is
+// no author.
+func normalizeAuthor(author *core.VersionAuthor) (*core.VersionAuthor, error) {
+	if author == nil {
+		return nil, nil
+	}
+	normalized := core.VersionAuthor{
+		Name:     strings.TrimSpace(author.Name),
+		Email:    strings.TrimSpace(author.Email),
+		ClientID: strings.TrimSpace(author.ClientID),
+	}
+	if normalized == (core.VersionAuthor{}) {
+		return nil, nil
+	}
+	for _, field := range []struct{ name, value string }{
+		{"name", normalized.Name}, {"email", normalized.Email}, {"client_id", normalized.ClientID},
+	} {
+		switch {
+		case len(field.value) > maxAuthorFieldLength:
+			return nil, fmt.Errorf("invalid snapshot: author %s is %d bytes long, the limit is %d", field.name, len(field.value), maxAuthorFieldLength)
+		case strings.IndexFunc(field.value, unicode.IsControl) >= 0:
+			return nil, fmt.Errorf("invalid snapshot: author %s must not contain control characters", field.name)
+		}
+	}
+	return &normalized, nil
+}
@@ -0,0 +1,83 @@
+package calculate
+
+import (
+	"main/core"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAuthorHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		want   *core.VersionAuthor
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"Jane Doe <jane@example.com>", &core.VersionAuthor{Name: "Jane Doe", Email: "jane@example.com"}},
+		{"jane@example.com", &core.VersionAuthor{Email: "jane@example.com"}},
+		{" ci-job-42 ", &core.VersionAuthor{Name: "ci-job-42"}},
+		{"Jane <not an address", &core.VersionAuthor{Name: "Jane <not an address"}},
+	}
+	for _, tt := range tests {
+		if got := ParseAuthorHeader(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseAuthorHeader(%q) = %+v, want %+v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestSnapshotAuthor(t *testing.T) {
+	useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "authors")
+	snapshot := func(version string, author *core.VersionAuthor) (*core.SnapshotResponse, error) {
+		files := snapshotFiles(map[string]string{"a.txt": "content of " + version})
+		return NewUploadService().ProcessSnapshot(codebase.ID, version, "main", "", files, nil, true, SnapshotOptions{Author: author})
+	}
+
+	resp, err := snapshot("v1", &core.VersionAuthor{Name: " Jane Doe ", Email: "jane@example.com", ClientID: "laptop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &core.VersionAuthor{Name: "Jane Doe", Email: "jane@example.com", ClientID: "laptop"}
+	stored, err := core.GetProvider().GetVersionByID(resp.Version.ID)
+	if err != nil || !reflect.DeepEqual(stored.Author, want) {
+		t.Errorf("author of v1 = %+v, %v, want %+v", stored.Author, err, want)
+	}
+	if nodes := versionMap(t, codebase.ID).Nodes; len(nodes) != 1 || !reflect.DeepEqual(nodes[0].Author, want) {
+		t.Errorf("map nodes = %+v, want v1 by %+v", nodes, want)
+	}
+
+	// Without an author, or with blank fields only, none is stored
+	for _, tt := range []struct {
+		version string
+		author  *core.VersionAuthor
+	}{{"v2", nil}, {"v3", &core.VersionAuthor{Name: "  "}}} {
+		resp, err := snapshot(tt.version, tt.author)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored, _ := core.GetProvider().GetVersionByID(resp.Version.ID); stored.Author != nil {
+			t.Errorf("author of %s = %+v, want none", tt.version, stored.Author)
+		}
+	}
+
+	history, err := NewHistoryService().GetFileHistory(codebase.ID, "main", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range history.Events {
+		if wantAuthor := event.Version == "v1"; (event.Author != nil) != wantAuthor {
+			t.Errorf("history event of %s has author %+v", event.Version, event.Author)
+		}
+	}
+
+	for _, author := range []*core.VersionAuthor{
+		{Name: strings.Repeat("n", maxAuthorFieldLength+1)},
+		{Email: "jane@\nexample.com"},
+		{ClientID: "job\x00"},
+	} {
+		if _, err := snapshot("v4", author); err == nil || !strings.Contains(err.Error(), "invalid snapshot: author") {
+			t.Errorf("author %+v = %v, want it refused", author, err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package calculate
+
+import (
+	"fmt"
+	"log"
+	"main/core"
+	"sort"
+	"strings"
+)
+
+// BlobMigrationReport describes a migration of name-prefixed objects into the global blob namespace
+type BlobMigrationReport struct {
+	DryRun         bool     `json:"dry_run"`
+	LegacyObjects  int      `json:"legacy_objects"`  // referenced objects outside the global namespace
+	CopiedObjects  int      `json:"copied_objects"`  // written to their global key
+	CopiedBytes    int64    `json:"copied_bytes"`    // stored size of the copied objects
+	SharedObjects  int      `json:"shared_objects"`  // whose global key already existed, e.g. from another codebase
+	UpdatedFiles   int      `json:"updated_files"`   // file index entries pointed at a global key
+	DeletedObjects int      `json:"deleted_objects"` // legacy objects removed afterwards
+	Quarantined    []string `json:"quarantined"`     // legacy objects left in place until their quarantine is resolved
+}
+
+// legacyObject is a referenced object outside the global namespace and where it belongs in it
+type legacyObject struct {
+	key    string
+	target string
+}
+
+// MigrateToGlobalBlobs rewrites every referenced object stored under a codebase name prefix into the
+// global namespace and points the file indexes at the new keys. Objects whose global key already exists
+// are not copied again, so identical content of different codebases ends up stored once. The old objects
+// are deleted once nothing references them. Running it again only picks up what is left, e.g. after an
+// interruption. With dryRun nothing is changed.
+func (s *MaintenanceService) MigrateToGlobalBlobs(dryRun bool) (*BlobMigrationReport, error) {
+	if !core.GetConfig().GlobalBlobNamespace {
+		return nil, fmt.Errorf("invalid request: global_blob_namespace is not enabled, new snapshots would keep using the old keys")
+	}
+
+	// Keep snapshot uploads, imports and garbage collection out while keys move
+	objectWriters.Lock()
+	defer objectWriters.Unlock()
+
+	provider := core.GetProvider()
+	storage := core.GetStore()
+
+	legacy, err := legacyObjects(provider)
+	if err != nil {
+		return nil, err
+	}
+	quarantined := make(map[string]bool)
+	entries, err := provider.ListQuarantineEntries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		quarantined[e.StorageKey] = true
+	}
+
+	report := &BlobMigrationReport{DryRun: dryRun, LegacyObjects: len(legacy), Quarantined: []string{}}
+	keys := make(map[string]string, len(legacy))
+	candidates := make(map[string]int64, len(legacy))
+	copied := make(map[string]bool)
+	for _, obj := range legacy {
+		if quarantined[obj.key] {
+			report.Quarantined = append(report.Quarantined, obj.key)
+			continue
+		}
+		info, err := storage.StatObject(obj.key)
+		if err != nil {
+			return report, fmt.Errorf("object %s: %w", obj.key, err)
+		}
+		if copied[obj.target] {
+			report.SharedObjects++
+		} else if _, err := storage.StatObject(obj.target); err == nil {
+			report.SharedObjects++
+		} else {
+			if !dryRun {
+				if err := copyObject(storage, obj.key, obj.target); err != nil {
+					return report, fmt.Errorf("copying %s to %s failed after %d objects: %w", obj.key, obj.target, report.CopiedObjects, err)
+				}
+			}
+			copied[obj.target] = true
+			report.CopiedObjects++
+			report.CopiedBytes += info.Size
+		}
+		keys[obj.key] = obj.target
+		candidates[obj.key] = info.Size
+	}
+	if dryRun || len(keys) == 0 {
+		return report, nil
+	}
+
+	if report.UpdatedFiles, err = provider.RewriteStorageKeys(keys); err != nil {
+		return report, fmt.Errorf("file index update failed: %w", err)
+	}
+	if report.DeletedObjects, _, err = NewDeleteService().deleteUnreferencedObjectsLocked(provider, storage, candidates); err != nil {
+		return report, fmt.Errorf("removing migrated objects failed (reclaim them with /maintenance/gc): %w", err)
+	}
+	log.Printf("event=blob_migration_done legacy=%d copied=%d shared=%d files=%d deleted=%d quarantined=%d",
+		report.LegacyObjects, report.CopiedObjects, report.SharedObjects, report.UpdatedFiles, report.DeletedObjects, len(report.Quarantined))
+	return report, nil
+}
+
+// legacyObjects returns the objects referenced by any codebase, trashed ones included, that are stored
+// outside the global namespace, sorted by key. The target key follows from the content hash and from
+// the encoding of the object, which the file index records.
+func legacyObjects(provider core.DataProvider) ([]legacyObject, error) {
+	codebases, err := provider.ListCodebases()
+	if err != nil {
+		return nil, err
+	}
+	targets := make(map[string]string)
+	add := func(key, hash, encoding string) {
+		if !strings.HasPrefix(key, globalBlobPrefix) {
+			targets[key] = globalObjectKey(hash, encoding)
+		}
+	}
+	for _, codebase := range codebases {
+		versions, err := provider.ListVersions(codebase.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range versions {
+			files, err := provider.GetFileIndexesByTreeID(v.TreeID)
+			if err != nil {
+				return nil, fmt.Errorf("file index for version %s not found: %w", v.ID, err)
+			}
+			for _, f := range files {
+				if f.IsDir() {
+					continue
+				}
+				if len(f.Chunks) == 0 {
+					add(f.StorageKey, f.Hash, f.ContentEncoding())
+					continue
+				}
+				for _, c := range f.Chunks {
+					add(c.StorageKey, c.Hash, core.EncodingZlib)
+				}
+			}
+		}
+	}
+
+	objects := make([]legacyObject, 0, len(targets))
+	for key, target := range targets {
+		objects = append(objects, legacyObject{key: key, target: target})
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].key < objects[j].key })
+	return objects, nil
+}
+
+// copyObject streams a stored object to another key as it is stored, still compressed.
+func copyObject(storage core.Storage, from, to string) error {
+	r, err := storage.GetObjectStream(from)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return storage.PutObjectStream(to, r, -1)
+}
@@ -0,0 +1,97 @@
+package calculate
+
+import (
+	"main/core"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// referencedKeys returns the storage keys the file indexes of a codebase reference.
+func referencedKeys(t *testing.T, codebaseID string) map[string]bool {
+	t.Helper()
+	versions, err := core.GetProvider().ListVersions(codebaseID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[string]bool)
+	for _, v := range versions {
+		for _, key := range fileKeys(t, v.ID) {
+			if key != "" {
+				keys[key] = true
+			}
+		}
+	}
+	return keys
+}
+
+func TestMigrateToGlobalBlobs(t *testing.T) {
+	provider, storage := useMemoryBackends(t)
+	first, second := mustInitCodebase(t, "first"), mustInitCodebase(t, "second")
+	mustSnapshot(t, first.ID, "main", "v1", map[string]string{"shared.txt": "in both codebases", "a.txt": "only in first"})
+	mustSnapshot(t, first.ID, "main", "v2", map[string]string{"shared.txt": "in both codebases", "a.txt": "first, changed"})
+	kept := mustSnapshot(t, second.ID, "main", "v1", map[string]string{"shared.txt": "in both codebases", "b.txt": "quarantined in second"})
+	wantFirst, wantSecond := versionContents(t, storage, first.ID), versionContents(t, storage, second.ID)
+	firstKeys := referencedKeys(t, first.ID)
+	oldKeys := referencedKeys(t, first.ID)
+	for key := range referencedKeys(t, second.ID) {
+		oldKeys[key] = true
+	}
+
+	// A quarantined object stays where it is, referenced by its old key
+	quarantinedKey := fileKeys(t, kept.Version.ID)["b.txt"]
+	if err := provider.SaveQuarantineEntry(&core.QuarantineEntry{StorageKey: quarantinedKey, CodebaseID: second.ID, Reason: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	maintenance := NewMaintenanceService()
+	if _, err := maintenance.MigrateToGlobalBlobs(false); err == nil || !strings.Contains(err.Error(), "global_blob_namespace") {
+		t.Errorf("migration with the namespace disabled = %v, want it refused", err)
+	}
+	core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), GlobalBlobNamespace: true})
+	t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+
+	dry, err := maintenance.MigrateToGlobalBlobs(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := referencedKeys(t, first.ID); !reflect.DeepEqual(got, firstKeys) {
+		t.Errorf("a dry run changed the keys of first to %v, want %v", got, firstKeys)
+	}
+
+	report, err := maintenance.MigrateToGlobalBlobs(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// shared.txt of second and the first codebase's copy end up in one object
+	if report.LegacyObjects != len(oldKeys) || report.SharedObjects != 1 || report.CopiedObjects != len(oldKeys)-2 ||
+		report.DeletedObjects != len(oldKeys)-1 || !reflect.DeepEqual(report.Quarantined, []string{quarantinedKey}) {
+		t.Errorf("report = %+v for %d referenced objects", report, len(oldKeys))
+	}
+	if report.CopiedObjects != dry.CopiedObjects || report.SharedObjects != dry.SharedObjects {
+		t.Errorf("dry run predicted %+v, migration did %+v", dry, report)
+	}
+
+	if got := versionContents(t, storage, first.ID); !reflect.DeepEqual(got, wantFirst) {
+		t.Errorf("contents of first after the migration = %v, want %v", got, wantFirst)
+	}
+	if got := versionContents(t, storage, second.ID); !reflect.DeepEqual(got, wantSecond) {
+		t.Errorf("contents of second after the migration = %v, want %v", got, wantSecond)
+	}
+	for _, codebaseID := range []string{first.ID, second.ID} {
+		for key := range referencedKeys(t, codebaseID) {
+			if !strings.HasPrefix(key, globalBlobPrefix) && key != quarantinedKey {
+				t.Errorf("%s still references %s", codebaseID, key)
+			}
+		}
+	}
+	for key := range oldKeys {
+		checkStored(t, storage, key, key == quarantinedKey)
+	}
+
+	again, err := maintenance.MigrateToGlobalBlobs(false)
+	if err != nil || again.LegacyObjects != 1 || again.CopiedObjects != 0 || again.DeletedObjects != 0 {
+		t.Errorf("second migration = %+v, %v, want only the quarantined object left", again, err)
+	}
+}
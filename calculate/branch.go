@@ -0,0 +1,74 @@
+package calculate
+
+import (
+	"fmt"
+	"log"
+	"main/core"
+	"time"
+)
+
+// BranchService handles branch management logic
+type BranchService struct {
+	historyService *HistoryService
+}
+
+func NewBranchService() *BranchService {
+	return &BranchService{
+		historyService: NewHistoryService(),
+	}
+}
+
+// CreateBranch records a branch ref pointing at an existing version without creating a snapshot.
+// The first snapshot uploaded to the branch is linked to the source version with a branch_from edge.
+func (s *BranchService) CreateBranch(codebaseID, branch string, source VersionIdentifier) (*core.BranchRef, error) {
+	provider := core.GetProvider()
+
+	codebase, err := getActiveCodebase(provider, codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	if branch, err = branchForWrite(provider, codebase, branch); err != nil {
+		return nil, err
+	}
+
+	// 1. Branch name must not be taken by versions or another ref
+	isNew, err := provider.IsNewBranch(codebaseID, branch, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to check branch: %w", err)
+	}
+	if !isNew {
+		return nil, fmt.Errorf("branch %s already exists", branch)
+	}
+	existing, err := provider.GetBranchRef(codebaseID, branch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check branch ref: %w", err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("branch %s already exists", branch)
+	}
+
+	// 2. Resolve source version
+	sourceVersion, err := resolveVersion(provider, codebaseID, source.Branch, source.Version)
+	if err != nil {
+		return nil, fmt.Errorf("source version %s/%s not found: %w", source.Branch, source.Version, err)
+	}
+
+	// 3. Record the ref
+	ref := &core.BranchRef{
+		CodebaseID: codebaseID,
+		Branch:     branch,
+		VersionID:  sourceVersion.ID,
+		CreatedAt:  time.Now(),
+	}
+	if err := provider.CreateBranchRef(ref); err != nil {
+		return nil, fmt.Errorf("failed to create branch ref: %w", err)
+	}
+
+	// The new branch shows up in the map refs immediately
+	if _, err := s.historyService.RebuildHistoryCache(codebaseID); err != nil {
+		log.Printf("Failed to rebuild history cache after creating branch %s: %v", branch, err)
+	}
+
+	log.Printf("Branch created: codebase=%s, branch=%s, source=%s", codebaseID, branch, sourceVersion.ID)
+	return ref, nil
+}
@@ -0,0 +1,208 @@
+package calculate
+
+import (
+	"fmt"
+	"log"
+	"main/core"
+	"sort"
+	"strings"
+)
+
+// Branch case policies available in codebase settings
+const (
+	BranchCaseSensitive         = "case_sensitive" // default, "Main" and "main" are different branches
+	BranchCaseInsensitiveReject = "case_insensitive_reject"
+	BranchCaseNormalizeLower    = "normalize_lower"
+)
+
+// BranchCasing is one spelling of a branch name that collides with others
+type BranchCasing struct {
+	Branch   string `json:"branch"`
+	Versions int    `json:"versions"`
+	Head     string `json:"head"` // version ID the branch currently points at
+}
+
+// BranchCollision groups the branches of a codebase whose names differ only in case
+type BranchCollision struct {
+	CodebaseID string         `json:"codebase_id"`
+	Canonical  string         `json:"canonical"` // lower-case form shared by all branches in the group
+	Branches   []BranchCasing `json:"branches"`
+}
+
+// BranchCaseMergeResult reports a completed merge of one branch casing into another
+type BranchCaseMergeResult struct {
+	CodebaseID     string `json:"codebase_id"`
+	From           string `json:"from"`
+	Into           string `json:"into"`
+	MovedVersions  int    `json:"moved_versions"`
+	DefaultChanged bool   `json:"default_branch_changed"`
+}
+
+// branchForWrite checks the name of a branch that is about to receive a version or a ref and applies
+// the codebase's branch case policy to it, returning the name to store it under.
+func branchForWrite(provider core.DataProvider, codebase *core.Codebase, branch string) (string, error) {
+	if err := validateName("branch", branch); err != nil {
+		return "", err
+	}
+	switch settingsFor(codebase).BranchCasePolicy {
+	case BranchCaseNormalizeLower:
+		return strings.ToLower(branch), nil
+	case BranchCaseInsensitiveReject:
+		heads, err := provider.GetBranchHeadsForMap(codebase.ID)
+		if err != nil {
+			return "", err
+		}
+		for existing := range heads {
+			if existing != branch && strings.EqualFold(existing, branch) {
+				return "", fmt.Errorf("invalid branch name %q: differs only in case from existing branch %q", branch, existing)
+			}
+		}
+	}
+	return branch, nil
+}
+
+// branchForLookup maps a requested branch onto a stored branch. Under the case-insensitive
+// policies an exact match wins, then the lower-case spelling, then the only branch that
+// matches ignoring case. Anything else is returned unchanged and fails the lookup as usual.
+func branchForLookup(provider core.DataProvider, codebaseID, branch string) string {
+	codebase, err := provider.GetCodebaseByID(codebaseID)
+	if err != nil || settingsFor(codebase).BranchCasePolicy == "" || settingsFor(codebase).BranchCasePolicy == BranchCaseSensitive {
+		return branch
+	}
+	heads, err := provider.GetBranchHeadsForMap(codebaseID)
+	if err != nil {
+		return branch
+	}
+	if _, ok := heads[branch]; ok {
+		return branch
+	}
+	if _, ok := heads[strings.ToLower(branch)]; ok {
+		return strings.ToLower(branch)
+	}
+	var matches []string
+	for existing := range heads {
+		if strings.EqualFold(existing, branch) {
+			matches = append(matches, existing)
+		}
+	}
+	if len(matches) == 1 {
+		return matches[0]
+	}
+	return branch
+}
+
+// FindCaseCollisions lists branches whose names differ only in case, for one codebase or,
+// when codebaseID is empty, for every active codebase.
+func (s *BranchService) FindCaseCollisions(codebaseID string) ([]BranchCollision, error) {
+	provider := core.GetProvider()
+
+	var ids []string
+	if codebaseID != "" {
+		if _, err := getActiveCodebase(provider, codebaseID); err != nil {
+			return nil, err
+		}
+		ids = []string{codebaseID}
+	} else {
+		codebases, err := provider.ListCodebases()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range codebases {
+			if c.TrashedAt == nil {
+				ids = append(ids, c.ID)
+			}
+		}
+		sort.Strings(ids)
+	}
+
+	collisions := []BranchCollision{}
+	for _, id := range ids {
+		found, err := s.caseCollisions(provider, id)
+		if err != nil {
+			return nil, err
+		}
+		collisions = append(collisions, found...)
+	}
+	return collisions, nil
+}
+
+func (s *BranchService) caseCollisions(provider core.DataProvider, codebaseID string) ([]BranchCollision, error) {
+	heads, err := provider.GetBranchHeadsForMap(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := provider.ListVersions(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, v := range versions {
+		counts[v.Branch]++
+	}
+
+	groups := make(map[string][]string)
+	for branch := range heads {
+		canonical := strings.ToLower(branch)
+		groups[canonical] = append(groups[canonical], branch)
+	}
+
+	var collisions []BranchCollision
+	for canonical, branches := range groups {
+		if len(branches) < 2 {
+			continue
+		}
+		sort.Strings(branches)
+		collision := BranchCollision{CodebaseID: codebaseID, Canonical: canonical}
+		for _, b := range branches {
+			collision.Branches = append(collision.Branches, BranchCasing{Branch: b, Versions: counts[b], Head: heads[b]})
+		}
+		collisions = append(collisions, collision)
+	}
+	sort.Slice(collisions, func(i, j int) bool { return collisions[i].Canonical < collisions[j].Canonical })
+	return collisions, nil
+}
+
+// MergeBranchCasing re-labels every version of branch from onto branch into, which must differ from it
+// only in case. Lineage edges are kept, so the map shows one branch with the combined history.
+func (s *BranchService) MergeBranchCasing(codebaseID, from, into string) (*BranchCaseMergeResult, error) {
+	provider := core.GetProvider()
+	codebase, err := getActiveCodebase(provider, codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	if from == into || !strings.EqualFold(from, into) {
+		return nil, fmt.Errorf("invalid merge: %q and %q must be distinct spellings of the same branch name", from, into)
+	}
+	for _, protected := range settingsFor(codebase).ProtectedBranches {
+		if protected == from {
+			return nil, fmt.Errorf("invalid merge: branch %s is protected", from)
+		}
+	}
+
+	versions, err := provider.ListVersions(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	moved := 0
+	for _, v := range versions {
+		if v.Branch == from {
+			moved++
+		}
+	}
+
+	if err := provider.RelabelBranch(codebaseID, from, into); err != nil {
+		return nil, fmt.Errorf("failed to merge branch %s into %s: %w", from, into, err)
+	}
+	if _, err := s.historyService.RebuildHistoryCache(codebaseID); err != nil {
+		log.Printf("Failed to rebuild history cache after merging branch %s into %s: %v", from, into, err)
+	}
+
+	log.Printf("Branch casing merged: codebase=%s, from=%s, into=%s, versions=%d", codebaseID, from, into, moved)
+	return &BranchCaseMergeResult{
+		CodebaseID:     codebaseID,
+		From:           from,
+		Into:           into,
+		MovedVersions:  moved,
+		DefaultChanged: codebase.Branch == from,
+	}, nil
+}
@@ -0,0 +1,459 @@
+package calculate
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"main/core"
+	"mime/multipart"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// BundleFormat identifies the layout of export bundles written by this service
+const BundleFormat = "cvcs-bundle/1"
+
+// Entries of a bundle zip; stored objects are kept under bundleObjectsDir exactly as they are in storage
+const (
+	bundleManifestEntry = "manifest.json"
+	bundleVersionsEntry = "versions.json"
+	bundleTreesEntry    = "trees.json"
+	bundleEdgesEntry    = "edges.json"
+	bundleObjectsDir    = "objects/"
+)
+
+// BundleManifest describes an export bundle and its place in a chain of bundles.
+// Versions and Objects are cumulative over the chain, so the manifest of the latest
+// bundle is all that is needed to export the next increment.
+type BundleManifest struct {
+	Format         string         `json:"format"`
+	BundleID       string         `json:"bundle_id"`
+	ParentBundleID string         `json:"parent_bundle_id,omitempty"` // previous bundle of the chain, empty for a base bundle
+	SinceVersionID string         `json:"since_version_id,omitempty"` // watermark the bundle was cut from, if any
+	Codebase       *core.Codebase `json:"codebase"`
+	CreatedAt      time.Time      `json:"created_at"`
+	BaseVersions   []string       `json:"base_versions"` // versions the target must already have before this bundle is applied
+	Versions       []string       `json:"versions"`      // versions covered once this bundle is applied
+	Objects        []string       `json:"objects"`       // storage keys covered once this bundle is applied
+	NewVersions    int            `json:"new_versions"`
+	NewObjects     int            `json:"new_objects"`
+}
+
+// bundleEdge is a lineage edge as written to edges.json
+type bundleEdge struct {
+	ChildID     string           `json:"child_id"`
+	ParentID    string           `json:"parent_id"`
+	Branch      string           `json:"branch"`
+	LinkageType core.LinkageType `json:"linkage_type"`
+}
+
+// ExportOptions selects what an export contains. With neither field set a full bundle is written.
+type ExportOptions struct {
+	// Since is the manifest of the previous bundle; only versions and objects it doesn't cover are exported
+	Since *BundleManifest
+	// SinceVersionID exports the versions created after this version
+	SinceVersionID string
+}
+
+// ImportResult summarizes an applied chain of bundles
+type ImportResult struct {
+	CodebaseID       string   `json:"codebase_id"`
+	AppliedBundles   []string `json:"applied_bundles"`
+	ImportedVersions int      `json:"imported_versions"`
+	ImportedObjects  int      `json:"imported_objects"`
+}
+
+// BundleService exports codebases to self-contained bundles and imports chains of them
+type BundleService struct {
+	historyService *HistoryService
+}
+
+func NewBundleService() *BundleService {
+	return &BundleService{
+		historyService: NewHistoryService(),
+	}
+}
+
+// Export writes a bundle of a codebase to a temporary zip file and returns its path and manifest.
+func (s *BundleService) Export(codebaseID string, opts ExportOptions) (string, *BundleManifest, error) {
+	provider := core.GetProvider()
+	storage := core.GetStore()
+	codebase, err := getActiveCodebase(provider, codebaseID)
+	if err != nil {
+		return "", nil, err
+	}
+	if opts.Since != nil && opts.SinceVersionID != "" {
+		return "", nil, fmt.Errorf("invalid export: give either a previous manifest or a since version, not both")
+	}
+
+	versions, err := provider.ListVersions(codebaseID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	manifest := &BundleManifest{
+		Format:         BundleFormat,
+		BundleID:       uuid.NewString(),
+		SinceVersionID: opts.SinceVersionID,
+		Codebase:       codebase,
+		CreatedAt:      time.Now(),
+		BaseVersions:   []string{},
+	}
+
+	// 1. Work out what the target already has
+	baseVersions := make(map[string]bool)
+	baseObjects := make(map[string]bool)
+	switch {
+	case opts.Since != nil:
+		if opts.Since.Codebase == nil || opts.Since.Codebase.ID != codebaseID {
+			return "", nil, fmt.Errorf("invalid export: previous manifest belongs to another codebase")
+		}
+		manifest.ParentBundleID = opts.Since.BundleID
+		for _, id := range opts.Since.Versions {
+			baseVersions[id] = true
+		}
+		for _, key := range opts.Since.Objects {
+			baseObjects[key] = true
+		}
+	case opts.SinceVersionID != "":
+		watermark, err := provider.GetVersionByID(opts.SinceVersionID)
+		if err != nil || watermark.CodebaseID != codebaseID {
+			return "", nil, fmt.Errorf("since version %s not found", opts.SinceVersionID)
+		}
+		for _, v := range versions {
+			if v.CreatedAt.After(watermark.CreatedAt) {
+				continue
+			}
+			baseVersions[v.ID] = true
+			files, err := provider.GetFileIndexesByTreeID(v.TreeID)
+			if err != nil {
+				return "", nil, fmt.Errorf("file index for version %s not found: %w", v.ID, err)
+			}
+			for _, f := range files {
+				for _, key := range f.StorageKeys() {
+					baseObjects[key] = true
+				}
+			}
+		}
+	}
+	for id := range baseVersions {
+		manifest.BaseVersions = append(manifest.BaseVersions, id)
+	}
+
+	// 2. Collect new versions (oldest first, so imports create them in order), their trees and edges
+	var newVersions []*core.Version
+	for i := len(versions) - 1; i >= 0; i-- {
+		if !baseVersions[versions[i].ID] {
+			newVersions = append(newVersions, versions[i])
+		}
+	}
+	trees := make(map[string][]core.File, len(newVersions))
+	objects := make(map[string]bool, len(baseObjects))
+	for key := range baseObjects {
+		objects[key] = true
+	}
+	var newObjects []string
+	for _, v := range newVersions {
+		files, err := provider.GetFileIndexesByTreeID(v.TreeID)
+		if err != nil {
+			return "", nil, fmt.Errorf("file index for version %s not found: %w", v.ID, err)
+		}
+		trees[v.TreeID] = files
+		for _, f := range files {
+			for _, key := range f.StorageKeys() {
+				if !objects[key] {
+					objects[key] = true
+					newObjects = append(newObjects, key)
+				}
+			}
+		}
+	}
+
+	versionByID := make(map[string]*core.Version, len(versions))
+	for _, v := range versions {
+		versionByID[v.ID] = v
+	}
+	allEdges, err := provider.GetAllVersionEdgesForMap(codebaseID)
+	if err != nil {
+		return "", nil, err
+	}
+	var edges []bundleEdge
+	for _, e := range allEdges {
+		child, ok := versionByID[e.To]
+		if !ok || baseVersions[e.To] {
+			continue
+		}
+		edges = append(edges, bundleEdge{ChildID: e.To, ParentID: e.From, Branch: child.Branch, LinkageType: e.LinkageType})
+	}
+
+	for id := range baseVersions {
+		manifest.Versions = append(manifest.Versions, id)
+	}
+	for _, v := range newVersions {
+		manifest.Versions = append(manifest.Versions, v.ID)
+	}
+	for key := range objects {
+		manifest.Objects = append(manifest.Objects, key)
+	}
+	sort.Strings(manifest.BaseVersions)
+	sort.Strings(manifest.Versions)
+	sort.Strings(manifest.Objects)
+	manifest.NewVersions = len(newVersions)
+	manifest.NewObjects = len(newObjects)
+
+	// 3. Write the bundle
+	zipFile, err := os.CreateTemp("", "codebase-bundle-*.zip")
+	if err != nil {
+		return "", nil, err
+	}
+	defer zipFile.Close()
+	writer := zip.NewWriter(zipFile)
+	if err := s.writeBundle(writer, storage, manifest, newVersions, trees, edges, newObjects); err != nil {
+		writer.Close()
+		os.Remove(zipFile.Name())
+		return "", nil, err
+	}
+	if err := writer.Close(); err != nil {
+		os.Remove(zipFile.Name())
+		return "", nil, err
+	}
+
+	log.Printf("Bundle exported: codebase=%s, bundle=%s, parent=%s, versions=%d, objects=%d",
+		codebaseID, manifest.BundleID, manifest.ParentBundleID, manifest.NewVersions, manifest.NewObjects)
+	return zipFile.Name(), manifest, nil
+}
+
+func (s *BundleService) writeBundle(writer *zip.Writer, storage core.Storage, manifest *BundleManifest, versions []*core.Version, trees map[string][]core.File, edges []bundleEdge, objects []string) error {
+	entries := []struct {
+		name string
+		data interface{}
+	}{
+		{bundleManifestEntry, manifest},
+		{bundleVersionsEntry, versions},
+		{bundleTreesEntry, trees},
+		{bundleEdgesEntry, edges},
+	}
+	for _, e := range entries {
+		data, err := json.MarshalIndent(e.data, "", "  ")
+		if err != nil {
+			return err
+		}
+		w, err := writer.Create(e.name)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	for _, key := range objects {
+		data, err := storage.GetObject(key)
+		if err != nil {
+			return fmt.Errorf("failed to read object %s: %w", key, err)
+		}
+		w, err := writer.Create(bundleObjectsDir + key)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openedBundle is a bundle read back from an upload
+type openedBundle struct {
+	manifest BundleManifest
+	versions []*core.Version
+	trees    map[string][]core.File
+	edges    []bundleEdge
+	objects  map[string]*zip.File
+	reader   *zip.Reader
+}
+
+func readBundleEntry(f *zip.File, target interface{}) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return json.NewDecoder(rc).Decode(target)
+}
+
+func openBundle(header *multipart.FileHeader) (*openedBundle, io.Closer, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := zip.NewReader(file, header.Size)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("invalid bundle %s: %w", header.Filename, err)
+	}
+
+	b := &openedBundle{trees: make(map[string][]core.File), objects: make(map[string]*zip.File), reader: reader}
+	found := make(map[string]bool)
+	for _, f := range reader.File {
+		switch {
+		case f.Name == bundleManifestEntry:
+			err = readBundleEntry(f, &b.manifest)
+		case f.Name == bundleVersionsEntry:
+			err = readBundleEntry(f, &b.versions)
+		case f.Name == bundleTreesEntry:
+			err = readBundleEntry(f, &b.trees)
+		case f.Name == bundleEdgesEntry:
+			err = readBundleEntry(f, &b.edges)
+		case strings.HasPrefix(f.Name, bundleObjectsDir):
+			b.objects[strings.TrimPrefix(f.Name, bundleObjectsDir)] = f
+		}
+		if err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("invalid bundle %s: %s: %w", header.Filename, f.Name, err)
+		}
+		found[f.Name] = true
+	}
+	if !found[bundleManifestEntry] || b.manifest.Format != BundleFormat || b.manifest.Codebase == nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("invalid bundle %s: missing or unsupported manifest", header.Filename)
+	}
+	return b, file, nil
+}
+
+// Import applies a chain of bundles in order. The first bundle is either a base bundle for a codebase
+// that doesn't exist yet, or an increment whose base versions are all present already. Every later
+// bundle must continue the one before it; chains with gaps are refused before anything is written.
+func (s *BundleService) Import(bundles []*multipart.FileHeader) (*ImportResult, error) {
+	if len(bundles) == 0 {
+		return nil, fmt.Errorf("invalid import: no bundles given")
+	}
+	provider := core.GetProvider()
+	storage := core.GetStore()
+	// Increments rely on objects already in storage; keep garbage collection out until the imported indexes are saved
+	objectWriters.RLock()
+	defer objectWriters.RUnlock()
+
+	opened := make([]*openedBundle, 0, len(bundles))
+	for _, header := range bundles {
+		b, closer, err := openBundle(header)
+		if err != nil {
+			return nil, err
+		}
+		defer closer.Close()
+		opened = append(opened, b)
+	}
+
+	// 1. Verify the chain before writing anything
+	codebaseID := opened[0].manifest.Codebase.ID
+	existing, lookupErr := provider.GetCodebaseByID(codebaseID)
+	present := make(map[string]bool)
+	if lookupErr == nil {
+		if len(opened[0].manifest.BaseVersions) == 0 {
+			return nil, fmt.Errorf("codebase %s already exists, only incremental bundles can be applied to it", codebaseID)
+		}
+		if existing.TrashedAt != nil {
+			return nil, fmt.Errorf("codebase %s not found (in trash)", codebaseID)
+		}
+		versions, err := provider.ListVersions(codebaseID)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range versions {
+			present[v.ID] = true
+		}
+	}
+	for i, b := range opened {
+		m := b.manifest
+		if m.Codebase.ID != codebaseID {
+			return nil, fmt.Errorf("invalid bundle chain: bundle %s belongs to codebase %s, not %s", m.BundleID, m.Codebase.ID, codebaseID)
+		}
+		if i > 0 && m.ParentBundleID != "" && m.ParentBundleID != opened[i-1].manifest.BundleID {
+			return nil, fmt.Errorf("invalid bundle chain: bundle %s continues %s, not %s", m.BundleID, m.ParentBundleID, opened[i-1].manifest.BundleID)
+		}
+		var missing []string
+		for _, id := range m.BaseVersions {
+			if !present[id] {
+				missing = append(missing, id)
+			}
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("invalid bundle chain: bundle %s needs %d versions that are not present (first: %s), apply the missing bundles first", m.BundleID, len(missing), missing[0])
+		}
+		covered := make(map[string]bool, len(m.Objects))
+		for _, key := range m.Objects {
+			covered[key] = true
+		}
+		for treeID, files := range b.trees {
+			for _, f := range files {
+				for _, key := range f.StorageKeys() {
+					if _, inBundle := b.objects[key]; !inBundle && !covered[key] {
+						return nil, fmt.Errorf("invalid bundle %s: tree %s references object %s that no bundle of the chain contains", m.BundleID, treeID, key)
+					}
+				}
+			}
+		}
+		for _, v := range b.versions {
+			if present[v.ID] {
+				return nil, fmt.Errorf("version %s already exists, bundle %s has been applied before", v.ID, m.BundleID)
+			}
+			if _, ok := b.trees[v.TreeID]; !ok {
+				return nil, fmt.Errorf("invalid bundle %s: tree of version %s is missing", m.BundleID, v.ID)
+			}
+			present[v.ID] = true
+		}
+	}
+
+	// 2. Apply the bundles in order
+	result := &ImportResult{CodebaseID: codebaseID, AppliedBundles: []string{}}
+	if lookupErr != nil {
+		codebase := *opened[0].manifest.Codebase
+		if err := provider.CreateCodebase(&codebase); err != nil {
+			return nil, fmt.Errorf("failed to create codebase: %w", err)
+		}
+	}
+	for _, b := range opened {
+		for key, f := range b.objects {
+			rc, err := f.Open()
+			if err != nil {
+				return result, err
+			}
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return result, fmt.Errorf("failed to read object %s from bundle %s: %w", key, b.manifest.BundleID, err)
+			}
+			if err := storage.PutObject(key, data); err != nil {
+				return result, fmt.Errorf("failed to store object %s: %w", key, err)
+			}
+			result.ImportedObjects++
+		}
+		for _, v := range b.versions {
+			if err := provider.CreateVersion(v, b.trees[v.TreeID]); err != nil {
+				return result, fmt.Errorf("failed to import version %s: %w", v.ID, err)
+			}
+			result.ImportedVersions++
+		}
+		links := make([]core.VersionLink, 0, len(b.edges))
+		for _, e := range b.edges {
+			links = append(links, core.VersionLink{CodebaseID: codebaseID, ChildID: e.ChildID, ParentID: e.ParentID, Branch: e.Branch, LinkageType: e.LinkageType})
+		}
+		if len(links) > 0 {
+			if err := provider.CreateVersionLinks(links); err != nil {
+				return result, fmt.Errorf("failed to import lineage of bundle %s: %w", b.manifest.BundleID, err)
+			}
+		}
+		result.AppliedBundles = append(result.AppliedBundles, b.manifest.BundleID)
+		log.Printf("Bundle imported: codebase=%s, bundle=%s, versions=%d, objects=%d", codebaseID, b.manifest.BundleID, len(b.versions), len(b.objects))
+	}
+
+	if _, err := s.historyService.RebuildHistoryCache(codebaseID); err != nil {
+		log.Printf("Failed to rebuild history cache after import (codebaseID: %s): %v", codebaseID, err)
+	}
+	return result, nil
+}
@@ -0,0 +1,129 @@
+package calculate
+
+import (
+	"bytes"
+	"main/core"
+	"mime/multipart"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// uploadedFiles turns files on disk into the file headers of a multipart upload, as the handlers get them.
+func uploadedFiles(t *testing.T, paths ...string) []*multipart.FileHeader {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part, err := writer.CreateFormFile("files", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	writer.Close()
+	form, err := multipart.NewReader(&body, writer.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { form.RemoveAll() })
+	return form.File["files"]
+}
+
+// versionContents reads every file of every version of a codebase back from storage, by version ID and path.
+func versionContents(t *testing.T, storage core.Storage, codebaseID string) map[string]map[string]string {
+	t.Helper()
+	provider := core.GetProvider()
+	versions, err := provider.ListVersions(codebaseID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make(map[string]map[string]string, len(versions))
+	for _, v := range versions {
+		files, err := provider.GetFileIndexesByTreeID(v.TreeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[v.ID] = make(map[string]string, len(files))
+		for _, f := range files {
+			if !f.IsDir() {
+				contents[v.ID][f.Path] = readStoredFile(t, storage, v.ID, f.Path)
+			}
+		}
+	}
+	return contents
+}
+
+// comparableMap is the part of a version map that an import must reproduce, in a stable order
+func comparableMap(m *core.VersionMapResponse) *core.VersionMapResponse {
+	sort.Slice(m.Nodes, func(i, j int) bool { return m.Nodes[i].ID < m.Nodes[j].ID })
+	sort.Slice(m.Edges, func(i, j int) bool { return m.Edges[i].From+m.Edges[i].To < m.Edges[j].From+m.Edges[j].To })
+	return &core.VersionMapResponse{CodebaseID: m.CodebaseID, DefaultBranch: m.DefaultBranch, Nodes: m.Nodes, Edges: m.Edges, Refs: m.Refs}
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	_, source := useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "bundled")
+	mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"a.txt": "alpha", "dir/b.txt": "beta"})
+	mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{"a.txt": "alpha", "dir/b.txt": "beta 2"})
+	mustSnapshot(t, codebase.ID, "feature", "f1", map[string]string{"a.txt": "alpha", "c.txt": "feature work"})
+
+	bundles := NewBundleService()
+	basePath, base, err := bundles.Export(codebase.ID, ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(basePath)
+
+	mustSnapshot(t, codebase.ID, "main", "v3", map[string]string{"a.txt": "alpha", "dir/b.txt": "beta 3", "d.txt": "new"})
+	incrementPath, increment, err := bundles.Export(codebase.ID, ExportOptions{Since: base})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(incrementPath)
+	if increment.ParentBundleID != base.BundleID || increment.NewVersions != 1 || increment.NewObjects != 2 {
+		t.Errorf("increment = parent %s, %d new versions, %d new objects; want parent %s, 1 version and the 2 objects of v3",
+			increment.ParentBundleID, increment.NewVersions, increment.NewObjects, base.BundleID)
+	}
+
+	wantMap := comparableMap(versionMap(t, codebase.ID))
+	wantContents := versionContents(t, source, codebase.ID)
+	if len(wantMap.Nodes) != 4 || len(wantMap.Edges) != 3 {
+		t.Fatalf("source map = %+v, want 4 versions and 3 edges", wantMap)
+	}
+
+	// A fresh instance refuses the increment without its base, then takes the chain in order
+	_, target := useMemoryBackends(t)
+	if _, err := bundles.Import(uploadedFiles(t, incrementPath)); err == nil || !strings.Contains(err.Error(), "apply the missing bundles first") {
+		t.Errorf("import of the increment alone = %v, want the gap refused", err)
+	}
+	if _, err := bundles.Import(uploadedFiles(t, incrementPath, basePath)); err == nil {
+		t.Error("import of the chain in the wrong order succeeded")
+	}
+	if _, err := core.GetProvider().GetCodebaseByID(codebase.ID); err == nil {
+		t.Fatal("a refused chain created the codebase")
+	}
+	result, err := bundles.Import(uploadedFiles(t, basePath, incrementPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ImportedVersions != 4 || len(result.AppliedBundles) != 2 {
+		t.Errorf("import result = %+v, want 4 versions from 2 bundles", result)
+	}
+
+	if got := comparableMap(versionMap(t, codebase.ID)); !reflect.DeepEqual(got, wantMap) {
+		t.Errorf("imported version map = %+v\nwant %+v", got, wantMap)
+	}
+	if got := versionContents(t, target, codebase.ID); !reflect.DeepEqual(got, wantContents) {
+		t.Errorf("imported contents = %v\nwant %v", got, wantContents)
+	}
+	if _, err := bundles.Import(uploadedFiles(t, incrementPath)); err == nil || !strings.Contains(err.Error(), "applied before") {
+		t.Errorf("second import of the increment = %v, want it refused", err)
+	}
+}
@@ -0,0 +1,237 @@
+package calculate
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"main/core"
+	"math/rand"
+	"mime/multipart"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chunksOf returns the chunk list recorded for path in a version.
+func chunksOf(t *testing.T, versionID, path string) []core.FileChunk {
+	t.Helper()
+	provider := core.GetProvider()
+	v, err := provider.GetVersionByID(versionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := provider.GetFileIndexesByTreeID(v.TreeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.Path == path {
+			return f.Chunks
+		}
+	}
+	t.Fatalf("%s is not in version %s", path, versionID)
+	return nil
+}
+
+// Appending to a chunked file stores only the chunks at its new tail, the rest are shared with the
+// previous version.
+func TestChunkedAppendStoresTail(t *testing.T) {
+	core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), ChunkingThresholdBytes: 1 << 20})
+	t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+	_, storage := useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "chunked")
+
+	// Random content doesn't compress, so every stored byte is one of the file
+	dump := make([]byte, 16<<20)
+	rand.New(rand.NewSource(1)).Read(dump)
+	appended := make([]byte, 2<<20)
+	rand.New(rand.NewSource(2)).Read(appended)
+
+	v1 := mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"dump.sql": string(dump)})
+	before := len(storedObjects(t, storage))
+	grown := string(dump) + string(appended)
+	v2 := mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{"dump.sql": grown})
+	written := len(storedObjects(t, storage)) - before
+
+	old, chunks := chunksOf(t, v1.Version.ID, "dump.sql"), chunksOf(t, v2.Version.ID, "dump.sql")
+	if len(old) < 4 {
+		t.Fatalf("v1 is stored in %d chunks, want the file split", len(old))
+	}
+	// Every chunk but the last of v1 ends at a content-defined boundary, which the append can't move
+	shared := len(old) - 1
+	for i := 0; i < shared; i++ {
+		if chunks[i].StorageKey != old[i].StorageKey {
+			t.Fatalf("chunk %d of v2 is %s, want %s of v1", i, chunks[i].StorageKey, old[i].StorageKey)
+		}
+	}
+	if written != len(chunks)-shared {
+		t.Errorf("v2 wrote %d objects, want only its %d tail chunks", written, len(chunks)-shared)
+	}
+	var tail int64
+	for _, c := range chunks[shared:] {
+		tail += c.Size
+	}
+	if limit := int64(len(appended)) + int64(old[shared].Size); tail > limit {
+		t.Errorf("the new tail chunks hold %d bytes, more than the last old chunk and the append (%d)", tail, limit)
+	}
+	if v2.Version.Stats.ReusedBytes == 0 {
+		t.Errorf("stats of v2 = %+v, want reused bytes counted", v2.Version.Stats)
+	}
+
+	if got := readStoredFile(t, storage, v2.Version.ID, "dump.sql"); got != grown {
+		t.Errorf("v2 reads back %d bytes, want the %d written", len(got), len(grown))
+	}
+	if got := readStoredFile(t, storage, v1.Version.ID, "dump.sql"); got != string(dump) {
+		t.Errorf("v1 reads back %d bytes, want the %d written", len(got), len(dump))
+	}
+}
+
+// discardingStorage keeps track of which objects exist but throws their content away, so a benchmark
+// measures the memory of processing an upload rather than of holding what it stored.
+type discardingStorage struct {
+	*core.MemoryStorage
+}
+
+func (s discardingStorage) PutObject(name string, data []byte) error {
+	return s.MemoryStorage.PutObject(name, nil)
+}
+
+func (s discardingStorage) PutObjectStream(name string, r io.Reader, size int64) error {
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	return s.MemoryStorage.PutObject(name, nil)
+}
+
+// peakHeap samples the heap in use while fn runs and returns its highest value above the heap before.
+func peakHeap(fn func()) uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	base, peak := stats.HeapInuse, stats.HeapInuse
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapInuse > peak {
+				peak = stats.HeapInuse
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+	fn()
+	close(done)
+	wg.Wait()
+	return peak - base
+}
+
+// generatedFile is a file of pseudo-random content computed from the offset, so that a benchmark
+// doesn't hold the content it uploads in memory. Every other 4 KiB block repeats, to compress a little.
+type generatedFile struct {
+	size, offset int64
+}
+
+func (f *generatedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	n := len(p)
+	if remaining := f.size - off; int64(n) > remaining {
+		n = int(remaining)
+	}
+	for i := 0; i < n; i++ {
+		pos := uint64(off) + uint64(i)
+		word := pos / 8
+		if pos/4096%2 == 1 {
+			word %= 512
+		}
+		// splitmix64
+		z := word*0x9e3779b97f4a7c15 + 0x9e3779b97f4a7c15
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		p[i] = byte((z ^ z>>31) >> (8 * (pos % 8)))
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *generatedFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *generatedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *generatedFile) Close() error { return nil }
+
+// BenchmarkLargeFileSnapshotMemory reports the peak heap of a snapshot of one large file. Whole files are
+// hashed and compressed as a stream and chunked files go through a buffer of one maximum chunk, so
+// the peak must stay the same as the file grows.
+func BenchmarkLargeFileSnapshotMemory(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, bench := range []struct {
+		size      int64
+		threshold int64
+	}{
+		{16 << 20, 0},
+		{256 << 20, 0},
+		{16 << 20, 1 << 20},
+		{256 << 20, 1 << 20},
+	} {
+		mode := "whole"
+		if bench.threshold > 0 {
+			mode = "chunked"
+		}
+		b.Run(fmt.Sprintf("%s/%dMiB", mode, bench.size>>20), func(b *testing.B) {
+			core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), ChunkingThresholdBytes: bench.threshold})
+			defer core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()})
+			files := map[string]*SnapshotFile{"dump.sql": {Size: bench.size, open: func() (multipart.File, error) {
+				return &generatedFile{size: bench.size}, nil
+			}}}
+
+			var peak uint64
+			b.SetBytes(bench.size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				provider, _ := useMemoryBackends(b)
+				core.SetProvidersForTesting(provider, discardingStorage{core.NewMemoryStorage()})
+				codebase := mustInitCodebase(b, "large")
+				b.StartTimer()
+				heap := peakHeap(func() {
+					if _, err := NewUploadService().ProcessSnapshot(codebase.ID, "v1", "main", "", files, nil, false, SnapshotOptions{}); err != nil {
+						b.Fatal(err)
+					}
+				})
+				if heap > peak {
+					peak = heap
+				}
+			}
+			b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MiB")
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package calculate
+
+import (
+	"fmt"
+	"log"
+	"main/core"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// CodebaseCloneResult reports the codebase created by CloneCodebase
+type CodebaseCloneResult struct {
+	Codebase     *core.Codebase    `json:"codebase"`
+	SourceID     string            `json:"source_id"`
+	VersionCount int               `json:"version_count"`
+	VersionIDMap map[string]string `json:"version_id_map"` // source version ID -> cloned version ID
+	BlobsShared  bool              `json:"blobs_shared"`   // always true, the clone references the source's stored objects
+}
+
+// CloneCodebase copies a codebase with all its versions, file indexes, lineage and branch refs into a new
+// codebase named name. Versions get new IDs but keep their branch, label, message and timestamps. Stored
+// objects are not copied: the clone's file indexes point at the source's keys, and deletion only removes
+// objects no other codebase references, so either side can be deleted independently.
+func (s *CodebaseService) CloneCodebase(sourceID, name, description string) (*CodebaseCloneResult, error) {
+	provider := core.GetProvider()
+	source, err := getActiveCodebase(provider, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid codebase name %q", name)
+	}
+	if description == "" {
+		description = source.Description
+	}
+
+	now := time.Now()
+	target := &core.Codebase{
+		ID:          uuid.NewString(),
+		Name:        name,
+		Description: description,
+		Branch:      source.Branch,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if source.Settings != nil {
+		settings := *source.Settings
+		settings.IgnorePatterns = append([]string(nil), source.Settings.IgnorePatterns...)
+		settings.ProtectedBranches = append([]string(nil), source.Settings.ProtectedBranches...)
+		target.Settings = &settings
+	}
+
+	idMap, err := provider.CloneCodebase(sourceID, target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clone codebase: %w", err)
+	}
+	if _, err := s.historyService.RebuildHistoryCache(target.ID); err != nil {
+		log.Printf("Unable to build version graph of cloned codebase (codebaseID: %s): %v", target.ID, err)
+	}
+
+	log.Printf("Codebase cloned: source=%s, clone=%s, name=%s, versions=%d", sourceID, target.ID, name, len(idMap))
+	return &CodebaseCloneResult{
+		Codebase:     target,
+		SourceID:     sourceID,
+		VersionCount: len(idMap),
+		VersionIDMap: idMap,
+		BlobsShared:  true,
+	}, nil
+}
@@ -0,0 +1,71 @@
+package calculate
+
+import (
+	"main/core"
+	"reflect"
+	"testing"
+)
+
+// A clone has its own versions with the names, messages and timestamps of the source and shares its
+// objects, which survive deleting the source.
+func TestCloneCodebase(t *testing.T) {
+	forEachRefCountingProvider(t, func(t *testing.T, storage *core.MemoryStorage) {
+		source := mustInitCodebase(t, "source")
+		v1 := mustSnapshot(t, source.ID, "main", "v1", map[string]string{"a.txt": "one"})
+		v2 := mustSnapshot(t, source.ID, "main", "v2", map[string]string{"a.txt": "two"})
+		d1 := mustSnapshot(t, source.ID, "dev", "d1", map[string]string{"a.txt": "dev"})
+		sourceContents := versionContents(t, storage, source.ID)
+
+		service := NewCodebaseService()
+		if _, err := service.CloneCodebase(source.ID, "../escape", ""); err == nil {
+			t.Error("clone with an invalid name succeeded")
+		}
+		result, err := service.CloneCodebase(source.ID, "fork", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.VersionCount != 3 || !result.BlobsShared || result.Codebase.Description != source.Description || result.Codebase.Branch != "main" {
+			t.Errorf("clone result = %+v", result)
+		}
+		provider := core.GetProvider()
+		for _, original := range []*core.SnapshotResponse{v1, v2, d1} {
+			cloneID := result.VersionIDMap[original.Version.ID]
+			cloned, err := provider.GetVersionByID(cloneID)
+			if err != nil {
+				t.Fatalf("clone of %s: %v", original.Version.Version, err)
+			}
+			if cloned.ID == original.Version.ID || cloned.CodebaseID != result.Codebase.ID || cloned.Branch != original.Version.Branch ||
+				cloned.Version != original.Version.Version || cloned.Message != original.Version.Message || !cloned.CreatedAt.Equal(original.Version.CreatedAt) {
+				t.Errorf("clone of %s/%s = %+v", original.Version.Branch, original.Version.Version, cloned)
+			}
+			if !reflect.DeepEqual(fileKeys(t, cloneID), fileKeys(t, original.Version.ID)) {
+				t.Errorf("clone of %s stores its files under other keys", original.Version.Version)
+			}
+		}
+
+		// The edges of the map connect the cloned versions
+		remapped := make(map[core.VersionEdge]bool)
+		for _, edge := range versionMap(t, source.ID).Edges {
+			edge.From, edge.To = result.VersionIDMap[edge.From], result.VersionIDMap[edge.To]
+			remapped[edge] = true
+		}
+		cloned := make(map[core.VersionEdge]bool)
+		for _, edge := range versionMap(t, result.Codebase.ID).Edges {
+			cloned[edge] = true
+		}
+		if len(cloned) == 0 || !reflect.DeepEqual(cloned, remapped) {
+			t.Errorf("edges of the clone = %v, want those of the source remapped %v", cloned, remapped)
+		}
+
+		if err := NewDeleteService().DeleteCodebase(source.ID); err != nil {
+			t.Fatal(err)
+		}
+		wantContents := make(map[string]map[string]string)
+		for id, contents := range sourceContents {
+			wantContents[result.VersionIDMap[id]] = contents
+		}
+		if got := versionContents(t, storage, result.Codebase.ID); !reflect.DeepEqual(got, wantContents) {
+			t.Errorf("contents of the clone after deleting the source = %v, want %v", got, wantContents)
+		}
+	})
+}
@@ -1,38 +1,43 @@
 package calculate
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"main/core"
 	"main/utils"
-	"mime/multipart"
 	"path/filepath"
-	"strings"
+	"runtime"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-func CreateSnapshot(storage core.Storage, files map[string]*multipart.FileHeader, codebaseName, branch, version, message string) ([]byte, []byte, []byte, error) {
+// CreateSnapshot stores the files and returns the version and file tree as JSON. With partial, files
+// that fail are left out and listed in the version's FailedFiles instead of failing the snapshot. The
+// objects it wrote are added to written, so they can be rolled back if the version isn't saved.
+func CreateSnapshot(storage core.Storage, files map[string]*SnapshotFile, codebaseName, branch, version, message, compression string, progress *SnapshotProgress, partial bool, written *writtenObjects) ([]byte, []byte, []byte, error) {
 	// 1. 处理文件并创建版本
 	versionID := uuid.NewString()
 	treeID := uuid.NewString()
 
-	processedFiles, stats, err := processFiles(storage, files, codebaseName)
+	processedFiles, stats, failed, err := processFiles(storage, files, codebaseName, compression, progress, partial, written)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
 	versionData := core.Version{
-		ID:        versionID,
-		Version:   version,
-		Branch:    branch,
-		Message:   message,
-		TreeID:    treeID,
-		CreatedAt: time.Now(),
-		Stats:     stats,
+		ID:          versionID,
+		Version:     version,
+		Branch:      branch,
+		Message:     message,
+		TreeID:      treeID,
+		CreatedAt:   time.Now(),
+		Stats:       stats,
+		FailedFiles: failed,
 	}
 
 	// 2. 创建文件树
@@ -50,111 +55,391 @@ func CreateSnapshot(storage core.Storage, files map[string]*multipart.FileHeader
 	return nil, versionJSON, fileTreeJSON, nil
 }
 
-func processFiles(storage core.Storage, files map[string]*multipart.FileHeader, codebaseName string) ([]core.File, core.VersionStats, error) {
-	var (
-		processedFiles []core.File
-		stats          core.VersionStats
-		wg             sync.WaitGroup
-		mu             sync.Mutex
-		errChan        = make(chan error, len(files))
-	)
+// fileWorkers returns how many files of a snapshot or archive are processed at once
+func fileWorkers() int {
+	if n := core.GetConfig().FileWorkers; n > 0 {
+		return n
+	}
+	return runtime.NumCPU() * 2
+}
 
-	for relativePath, fileHeader := range files {
+// runFileWorkers calls fn for each index below n from a fixed number of worker goroutines and waits
+// for them to finish.
+func runFileWorkers(n int, fn func(i int)) {
+	workers := fileWorkers()
+	if workers > n {
+		workers = n
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
 		wg.Add(1)
-		go func(relPath string, header *multipart.FileHeader) {
+		go func() {
 			defer wg.Done()
-
-			file, err := processFile(storage, relPath, header, codebaseName)
-			if err != nil {
-				errChan <- err
-				return
+			for i := range jobs {
+				fn(i)
 			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
 
+// processFiles stores every file and returns the stored ones with their stats and the failed ones. A
+// failure fails the whole snapshot with a SnapshotFilesError unless partial is set and some file was
+// stored; the objects written for whatever isn't kept are tracked as orphans. The objects of a snapshot
+// that goes on are added to written.
+func processFiles(storage core.Storage, files map[string]*SnapshotFile, codebaseName, compression string, progress *SnapshotProgress, partial bool, written *writtenObjects) ([]core.File, core.VersionStats, []core.FailedFile, error) {
+	var (
+		processedFiles = []core.File{} // non-nil so empty snapshots store an empty file list
+		stats          core.VersionStats
+		mu             sync.Mutex
+		failed         []core.FailedFile
+		stored         []string // objects written for stored files
+		orphaned       []string // objects written for failed files
+	)
+
+	paths := make([]string, 0, len(files))
+	for relativePath := range files {
+		paths = append(paths, relativePath)
+	}
+	runFileWorkers(len(paths), func(i int) {
+		relPath := paths[i]
+		var keys []string
+		file, reused, err := processFile(storage, relPath, files[relPath], codebaseName, compression, func(key string) { keys = append(keys, key) })
+		if err != nil {
 			mu.Lock()
-			processedFiles = append(processedFiles, file)
-			stats.TotalFiles++
-			stats.TotalSize += file.Size
-			stats.CompressedSize += file.CompressedSize
+			failed = append(failed, failedFile(filepath.ToSlash(relPath), err))
+			orphaned = append(orphaned, keys...)
 			mu.Unlock()
-		}(relativePath, fileHeader)
-	}
+			return
+		}
+		progress.fileDone(file)
 
-	wg.Wait()
-	close(errChan)
+		mu.Lock()
+		stored = append(stored, keys...)
+		processedFiles = append(processedFiles, file)
+		stats.TotalFiles++
+		stats.TotalSize += file.Size
+		stats.CompressedSize += file.CompressedSize
+		if reused.file {
+			stats.ReusedFiles++
+		}
+		stats.ReusedBytes += reused.bytes
+		if file.Type == "raw" && compression != CompressionNone {
+			stats.RawFiles++
+		}
+		mu.Unlock()
+	})
 
-	for err := range errChan {
-		if err != nil {
-			return nil, core.VersionStats{}, err
+	if len(failed) > 0 {
+		sortFailedFiles(failed)
+		if !partial || len(failed) == len(paths) {
+			trackOrphanedObjects(codebaseName, append(orphaned, stored...))
+			return nil, core.VersionStats{}, nil, &SnapshotFilesError{Failed: failed, Total: len(paths)}
 		}
+		trackOrphanedObjects(codebaseName, orphaned)
 	}
+	written.add(stored...)
+	written.add(orphaned...)
 
+	stats.UploadedFiles = stats.TotalFiles
 	if stats.TotalSize > 0 {
 		stats.CompressionRatio = float64(stats.CompressedSize) / float64(stats.TotalSize)
 	}
 
-	return processedFiles, stats, nil
+	return processedFiles, stats, failed, nil
 }
 
-func processFile(storage core.Storage, relativePath string, header *multipart.FileHeader, codebaseName string) (core.File, error) {
-	// 1. 从文件头中读取文件内容
+// processFile 存储一个文件，wrote 收到本次新写入的每个对象的存储键
+func processFile(storage core.Storage, relativePath string, header *SnapshotFile, codebaseName, compression string, wrote func(key string)) (core.File, reuse, error) {
+	// 1. 从文件头中打开文件内容流
 	file, err := header.Open()
 	if err != nil {
-		return core.File{}, fmt.Errorf("打开上传的文件流失败 %s: %w", relativePath, err)
+		return core.File{}, reuse{}, readFailure(fmt.Errorf("打开上传的文件流失败 %s: %w", relativePath, err))
 	}
 	defer file.Close()
 
-	data, err := io.ReadAll(file)
+	// 大文件按内容分块存储，使跨版本的重复内容以分块为粒度去重
+	if threshold := core.GetConfig().ChunkingThresholdBytes; threshold > 0 && header.Size > threshold {
+		return processChunkedFile(storage, relativePath, file, codebaseName, wrote)
+	}
+
+	// 2-3. 按文件开头的内容和压缩策略确定存储方式
+	sample := make([]byte, utils.SniffLen)
+	sampled, err := io.ReadFull(file, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return core.File{}, reuse{}, readFailure(fmt.Errorf("读取上传的文件流失败 %s: %w", relativePath, err))
+	}
+	sample = sample[:sampled]
+
+	// 4. 先计算内容哈希（样本之后接着读取其余内容）：内容寻址的对象已存在时（例如未修改的文件）跳过压缩和上传
+	hasher := sha256.New()
+	hasher.Write(sample)
+	rest, err := io.Copy(hasher, file)
 	if err != nil {
-		return core.File{}, fmt.Errorf("读取上传的文件流失败 %s: %w", relativePath, err)
+		return core.File{}, reuse{}, readFailure(fmt.Errorf("读取上传的文件流失败 %s: %w", relativePath, err))
 	}
-	originalSize := int64(len(data))
+	originalSize := int64(sampled) + rest
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	// The storage key is now based on the content hash for deduplication and consistency.
+	storageKey, fileType, encoding := wholeFileObject(codebaseName, compression, relativePath, hash, sample)
 
-	// 2. 根据扩展名判断是否为图片
-	ext := strings.ToLower(filepath.Ext(relativePath))
-	imageExts := []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".bmp", ".tiff"}
-	isImage := false
-	for _, imgExt := range imageExts {
-		if ext == imgExt {
-			isImage = true
-			break
+	fileInfo := core.File{
+		Path:       filepath.ToSlash(relativePath),
+		Hash:       hash,
+		Size:       originalSize,
+		StorageKey: storageKey,
+		Type:       fileType,
+		Encoding:   encoding,
+	}
+	// A concurrent writer creating the same object between the check and the write is harmless,
+	// the content is identical
+	existing, statErr := storage.StatObject(storageKey)
+	if statErr == nil && (compressionGrew(fileInfo, existing.Size) || !storedAs(storage, fileInfo, sample)) {
+		// 压缩对象比内容还大说明之前的上传已改为原样存储，沿用原样存储的对象；键下的对象不是所需的编码时
+		// （旧版本在 "<codebase>/<hash>" 下原样存储过内容）不能覆盖仍被引用的它，同样改为原样存储
+		fileInfo = rawFileObject(fileInfo, codebaseName)
+		existing, statErr = storage.StatObject(fileInfo.StorageKey)
+		if statErr == nil && !storedAs(storage, fileInfo, sample) {
+			statErr = fmt.Errorf("object %s holds other content", fileInfo.StorageKey)
 		}
 	}
+	if statErr == nil {
+		fileInfo.CompressedSize = existing.Size
+		return fileInfo, reuse{file: true, bytes: originalSize}, nil
+	}
 
-	var contentToUpload []byte
-	var compressedSize int64
-	var fileType string
+	// 5. 回到内容开头，边（压缩）边流式写入存储，内容不在内存中整体驻留
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return core.File{}, reuse{}, readFailure(fmt.Errorf("读取上传的文件流失败 %s: %w", relativePath, err))
+	}
+	if fileInfo.CompressedSize, err = storeObject(storage, fileInfo.StorageKey, file, originalSize, fileInfo.Encoding); err != nil {
+		return core.File{}, reuse{}, storeFailure(fmt.Errorf("存储上传失败 %s: %w", relativePath, err))
+	}
+	wrote(fileInfo.StorageKey)
 
-	// 3. 分类处理：图片不压缩，其他文件压缩
-	if isImage {
-		contentToUpload = data
-		compressedSize = originalSize
-		fileType = "image"
-	} else {
-		compressedData, err := utils.CompressData(data)
-		if err != nil {
-			return core.File{}, fmt.Errorf("压缩文件失败 %s: %w", relativePath, err)
+	// 6. 压缩后反而变大时改为原样存储。压缩对象不删除（同内容的并发上传可能已在引用它），
+	// 它让之后的上传无需再次压缩即可得知结果，未被引用时由 /maintenance/gc 回收
+	if compressionGrew(fileInfo, fileInfo.CompressedSize) {
+		fileInfo = rawFileObject(fileInfo, codebaseName)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return core.File{}, reuse{}, readFailure(fmt.Errorf("读取上传的文件流失败 %s: %w", relativePath, err))
 		}
-		contentToUpload = compressedData
-		compressedSize = int64(len(compressedData))
-		fileType = "other"
+		if fileInfo.CompressedSize, err = storeObject(storage, fileInfo.StorageKey, file, originalSize, ""); err != nil {
+			return core.File{}, reuse{}, storeFailure(fmt.Errorf("存储上传失败 %s: %w", relativePath, err))
+		}
+		wrote(fileInfo.StorageKey)
 	}
+	return fileInfo, reuse{}, nil
+}
 
-	// 4. 公共处理流程: 计算哈希、生成Key、上传
-	hash := utils.CalculateHash(data)
-	// The storage key is now based on the content hash for deduplication and consistency.
-	storageKey := fmt.Sprintf("%s/%s", codebaseName, hash)
+// compressionGrew 报告 f 的压缩对象（大小为 storedSize）是否比原始内容还大
+func compressionGrew(f core.File, storedSize int64) bool {
+	return f.Encoding != "" && storedSize > f.Size
+}
+
+// rawFileObject 返回改为原样存储的 f
+func rawFileObject(f core.File, codebaseName string) core.File {
+	f.StorageKey = objectKey(codebaseName, f.Hash, "")
+	f.Type = "raw"
+	f.Encoding = ""
+	return f
+}
+
+// storedFileType 返回整文件对象的存储方式：代码库压缩策略为 none、格式在跳过压缩的列表中或样本显示内容已压缩时
+// 原样存储（raw），其他内容按配置的算法压缩（compressed）
+func storedFileType(relativePath string, sample []byte, compression string) string {
+	if compression == CompressionNone {
+		return "raw"
+	}
+	skipTypes := core.GetConfig().CompressionSkipTypes()
+	if len(skipTypes) == 0 {
+		skipTypes = utils.DefaultIncompressibleTypes
+	}
+	if !utils.IsCompressible(relativePath, sample, skipTypes) {
+		return "raw"
+	}
+	return "compressed"
+}
+
+// wholeFileObject 返回整文件对象的存储键、存储方式和压缩算法（原样存储时为空）
+func wholeFileObject(codebaseName, compression, relativePath, hash string, sample []byte) (string, string, string) {
+	fileType := storedFileType(relativePath, sample, compression)
+	encoding := ""
+	if fileType == "compressed" {
+		encoding = core.GetConfig().CompressionAlgorithm()
+	}
+	return objectKey(codebaseName, hash, encoding), fileType, encoding
+}
+
+// globalBlobPrefix 是全局内容寻址命名空间的键前缀，启用 global_blob_namespace 后所有代码库的新对象都存放于此
+const globalBlobPrefix = "blobs/"
+
+// objectKey 返回整文件对象的存储键，encoding 为压缩算法，原样存储时为空：zlib 压缩的对象为 "<codebase>/<hash>"，
+// zstd 压缩的对象为 "<codebase>/zstd/<hash>"，原样存储的对象为 "<codebase>/raw/<hash>"；全局命名空间下分别为
+// "blobs/<hash>"、"blobs/zstd/<hash>" 和 "blobs/raw/<hash>"。同一内容的不同编码因此互不覆盖。
+// 旧版本曾把压缩策略为 none 的代码库的内容和带图片扩展名的文件原样存储在 "<codebase>/<hash>"，这些对象仍由引用它们
+// 的文件索引按记录的方式读取，复用前由 storedAs 检查编码
+func objectKey(codebaseName, hash, encoding string) string {
+	if core.GetConfig().GlobalBlobNamespace {
+		return globalObjectKey(hash, encoding)
+	}
+	return codebaseObjectKey(codebaseName, hash, encoding)
+}
+
+// codebaseObjectKey 返回代码库命名空间下的整文件对象存储键，不受 global_blob_namespace 配置影响
+func codebaseObjectKey(codebaseName, hash, encoding string) string {
+	switch encoding {
+	case "":
+		return fmt.Sprintf("%s/raw/%s", codebaseName, hash)
+	case core.EncodingZstd:
+		return fmt.Sprintf("%s/zstd/%s", codebaseName, hash)
+	}
+	return fmt.Sprintf("%s/%s", codebaseName, hash)
+}
+
+// chunkKey 返回分块对象的存储键；分块总是 zlib 压缩，全局命名空间下与同内容的整文件对象共用一个键
+func chunkKey(codebaseName, hash string) string {
+	if !core.GetConfig().GlobalBlobNamespace {
+		return fmt.Sprintf("%s/chunks/%s", codebaseName, hash)
+	}
+	return globalObjectKey(hash, core.EncodingZlib)
+}
+
+func globalObjectKey(hash, encoding string) string {
+	switch encoding {
+	case "":
+		return globalBlobPrefix + "raw/" + hash
+	case core.EncodingZstd:
+		return globalBlobPrefix + "zstd/" + hash
+	}
+	return globalBlobPrefix + hash
+}
+
+// reuse 记录上传时因对象已存在而跳过写入的内容
+type reuse struct {
+	file  bool  // 整个文件的对象均已存在
+	bytes int64 // 未重新写入的原始内容字节数
+}
+
+// storeObject 将 r 的 size 字节内容按 encoding 压缩（为空时原样）流式写入存储，返回存储的字节数
+func storeObject(storage core.Storage, key string, r io.Reader, size int64, encoding string) (int64, error) {
+	if encoding == "" {
+		return size, storage.PutObjectStream(key, r, size)
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		zw, err := newCompressor(pw, encoding)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		_, err = io.Copy(zw, r)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	compressed := &countingReader{r: pr}
+	err := storage.PutObjectStream(key, compressed, -1)
+	pr.CloseWithError(err) // unblocks the compressor when storage gave up early
+	<-done
+	return compressed.n, err
+}
+
+// countingReader 统计经过的字节数
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// 内容分块参数
+const (
+	chunkMinSize = 256 << 10
+	chunkAvgSize = 1 << 20
+	chunkMaxSize = 4 << 20
+)
+
+// processChunkedFile 将大文件切分为内容定义的分块，每个分块压缩后按自身哈希存储；已存在的分块不再压缩上传。
+// 内容以流的方式读取，同时只缓冲一个最大分块，整个文件的哈希在读取过程中计算
+func processChunkedFile(storage core.Storage, relativePath string, r io.Reader, codebaseName string, wrote func(key string)) (core.File, reuse, error) {
+	var (
+		chunks         []core.FileChunk
+		compressedSize int64
+		size           int64
+		reused         = reuse{file: true}
+		hasher         = sha256.New()
+		buf            = make([]byte, chunkMaxSize)
+		buffered       int
+		eof            bool
+	)
+	for {
+		// 补满缓冲区，使分块边界与一次性读入全部内容时相同
+		if !eof && buffered < len(buf) {
+			n, err := io.ReadFull(r, buf[buffered:])
+			buffered += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return core.File{}, reuse{}, readFailure(fmt.Errorf("读取上传的文件流失败 %s: %w", relativePath, err))
+			}
+		}
+		if buffered == 0 {
+			break
+		}
+		end := utils.NextChunkBoundary(buf[:buffered], chunkMinSize, chunkAvgSize, chunkMaxSize)
+		piece := buf[:end]
+		hasher.Write(piece)
+		size += int64(end)
+
+		chunkHash := utils.CalculateHash(piece)
+		storageKey := chunkKey(codebaseName, chunkHash)
+		var storedSize int64
+		if existing, err := storage.StatObject(storageKey); err == nil {
+			storedSize = existing.Size
+			reused.bytes += int64(len(piece))
+		} else {
+			compressed, err := utils.CompressData(piece)
+			if err != nil {
+				return core.File{}, reuse{}, storeFailure(fmt.Errorf("压缩分块失败 %s: %w", relativePath, err))
+			}
+			if err := storage.PutObject(storageKey, compressed); err != nil {
+				return core.File{}, reuse{}, storeFailure(fmt.Errorf("分块存储上传失败 %s: %w", relativePath, err))
+			}
+			wrote(storageKey)
+			storedSize = int64(len(compressed))
+			reused.file = false
+		}
 
-	if err := storage.PutObject(storageKey, contentToUpload); err != nil {
-		return core.File{}, fmt.Errorf("存储上传失败 %s: %w", relativePath, err)
+		chunks = append(chunks, core.FileChunk{
+			Hash:           chunkHash,
+			Size:           int64(len(piece)),
+			CompressedSize: storedSize,
+			StorageKey:     storageKey,
+		})
+		compressedSize += storedSize
+		buffered = copy(buf, buf[end:buffered])
 	}
 
-	// 5. 返回文件元数据
 	return core.File{
 		Path:           filepath.ToSlash(relativePath),
-		Hash:           hash,
-		Size:           originalSize,
+		Hash:           hex.EncodeToString(hasher.Sum(nil)),
+		Size:           size,
 		CompressedSize: compressedSize,
-		StorageKey:     storageKey,
-		Type:           fileType,
-	}, nil
+		Type:           "chunked",
+		Chunks:         chunks,
+	}, reused, nil
 }
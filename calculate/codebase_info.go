@@ -0,0 +1,226 @@
+package calculate
+
+import (
+	"fmt"
+	"log"
+	"main/core"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CodebaseService reads and updates a codebase as a whole
+type CodebaseService struct {
+	historyService *HistoryService
+}
+
+func NewCodebaseService() *CodebaseService {
+	return &CodebaseService{
+		historyService: NewHistoryService(),
+	}
+}
+
+// CodebaseDetails is the codebase record together with summary figures derived from its versions
+type CodebaseDetails struct {
+	*core.Codebase
+	DefaultBranch string `json:"default_branch"`
+	BranchCount   int    `json:"branch_count"` // branches with versions plus explicitly created branches without snapshots
+	VersionCount  int    `json:"version_count"`
+	StoredBytes   int64  `json:"stored_bytes"` // distinct stored objects, shared content counted once
+	// LatestVersions maps every branch that has versions to its most recent version
+	LatestVersions map[string]*core.Version `json:"latest_versions"`
+	Branches       []string                 `json:"branches"` // default branch first, then alphabetical
+}
+
+// BranchNotFoundError reports a branch that has neither versions nor a ref, with the branches that do exist
+type BranchNotFoundError struct {
+	Branch            string   `json:"branch"`
+	AvailableBranches []string `json:"available_branches"`
+}
+
+func (e *BranchNotFoundError) Error() string {
+	return fmt.Sprintf("branch %s not found (available: %s)", e.Branch, strings.Join(e.AvailableBranches, ", "))
+}
+
+// sortedBranches lists the branches of a codebase with the default branch first, then alphabetically.
+func sortedBranches(heads map[string]string, defaultBranch string) []string {
+	branches := make([]string, 0, len(heads))
+	for b := range heads {
+		branches = append(branches, b)
+	}
+	sort.Slice(branches, func(i, j int) bool {
+		if (branches[i] == defaultBranch) != (branches[j] == defaultBranch) {
+			return branches[i] == defaultBranch
+		}
+		return branches[i] < branches[j]
+	})
+	return branches
+}
+
+// ListCodebases returns the codebases in use sorted by name. Ephemeral codebases are left out unless
+// includeEphemeral is set; trashed and expired ones never show up.
+func (s *CodebaseService) ListCodebases(includeEphemeral bool) ([]*core.Codebase, error) {
+	provider := core.GetProvider()
+	codebases, err := provider.ListCodebases()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*core.Codebase, 0, len(codebases))
+	for _, codebase := range codebases {
+		if codebase.Ephemeral && !includeEphemeral {
+			continue
+		}
+		if _, err := getActiveCodebase(provider, codebase.ID); err != nil {
+			continue
+		}
+		list = append(list, codebase)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+// GetCodebaseDetails returns a codebase with its branch and version counts, stored size and branch heads.
+func (s *CodebaseService) GetCodebaseDetails(codebaseID string) (*CodebaseDetails, error) {
+	provider := core.GetProvider()
+	codebase, err := getActiveCodebase(provider, codebaseID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Versions come newest first, so the first one seen on a branch is its latest
+	versions, err := provider.ListVersions(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]*core.Version)
+	for _, v := range versions {
+		if _, ok := latest[v.Branch]; !ok {
+			latest[v.Branch] = v
+		}
+	}
+
+	heads, err := provider.GetBranchHeadsForMap(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	branches := sortedBranches(heads, defaultBranchOf(codebase))
+
+	stored, err := storedBytesForCodebase(provider, codebaseID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CodebaseDetails{
+		Codebase:       codebase,
+		DefaultBranch:  defaultBranchOf(codebase),
+		BranchCount:    len(branches),
+		VersionCount:   len(versions),
+		StoredBytes:    stored,
+		LatestVersions: latest,
+		Branches:       branches,
+	}, nil
+}
+
+// SetDefaultBranch makes an existing branch (one with versions or a ref) the default branch of a codebase.
+func (s *CodebaseService) SetDefaultBranch(codebaseID, branch string) (*core.Codebase, error) {
+	return s.UpdateCodebase(codebaseID, nil, &branch, nil)
+}
+
+// UpdateCodebase changes the description, the default branch and/or the snapshot ignore patterns of a
+// codebase; nil fields are left as they are. The default branch must already exist (have versions or a
+// ref), create it through /branches/create first otherwise.
+func (s *CodebaseService) UpdateCodebase(codebaseID string, description, branch *string, ignorePatterns *[]string) (*core.Codebase, error) {
+	if description == nil && branch == nil && ignorePatterns == nil {
+		return nil, fmt.Errorf("invalid update: nothing to change, pass description, branch and/or ignore_patterns")
+	}
+	if ignorePatterns != nil {
+		if err := validateIgnorePatterns(*ignorePatterns); err != nil {
+			return nil, fmt.Errorf("invalid update: %w", err)
+		}
+	}
+	provider := core.GetProvider()
+	codebase, err := getActiveCodebase(provider, codebaseID)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := *codebase
+	if description != nil {
+		updated.Description = *description
+	}
+	if branch != nil {
+		heads, err := provider.GetBranchHeadsForMap(codebaseID)
+		if err != nil {
+			return nil, err
+		}
+		name := branchForLookup(provider, codebaseID, *branch)
+		if _, ok := heads[name]; !ok {
+			return nil, &BranchNotFoundError{Branch: name, AvailableBranches: sortedBranches(heads, defaultBranchOf(codebase))}
+		}
+		updated.Branch = name
+	}
+	if ignorePatterns != nil {
+		settings := *settingsFor(codebase)
+		settings.IgnorePatterns = append([]string(nil), (*ignorePatterns)...)
+		updated.Settings = &settings
+	}
+	updated.UpdatedAt = time.Now()
+	if err := provider.UpdateCodebase(&updated); err != nil {
+		return nil, fmt.Errorf("failed to update codebase: %w", err)
+	}
+
+	if updated.Branch != codebase.Branch {
+		// The map carries the default branch
+		if _, err := s.historyService.RebuildHistoryCache(codebaseID); err != nil {
+			log.Printf("Failed to rebuild history cache after changing the default branch of %s: %v", codebaseID, err)
+		}
+		log.Printf("Default branch changed: codebase=%s, from=%s, to=%s", codebaseID, codebase.Branch, updated.Branch)
+	}
+	return &updated, nil
+}
+
+// CodebaseRenameResult reports a rename and what happened to the objects stored under the old name
+type CodebaseRenameResult struct {
+	Codebase        *core.Codebase `json:"codebase"`
+	PreviousName    string         `json:"previous_name"`
+	ObjectsMigrated bool           `json:"objects_migrated"` // always false, existing objects keep their keys
+	LegacyPrefix    string         `json:"legacy_prefix"`    // storage prefix still holding objects written before the rename
+}
+
+// RenameCodebase changes the name of a codebase. Objects are stored under "<name>/<hash>" and their keys are
+// recorded in the file indexes, so existing objects stay where they are and are read through their recorded
+// keys; new snapshots store under the new name. Deletion works from recorded keys, so both prefixes are cleaned up.
+func (s *CodebaseService) RenameCodebase(codebaseID, name string) (*CodebaseRenameResult, error) {
+	provider := core.GetProvider()
+	codebase, err := getActiveCodebase(provider, codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid codebase name %q", name)
+	}
+	if name == codebase.Name {
+		return nil, fmt.Errorf("invalid rename: codebase %s is already named %s", codebaseID, name)
+	}
+
+	updated := *codebase
+	updated.Name = name
+	updated.UpdatedAt = time.Now()
+	if err := provider.UpdateCodebase(&updated); err != nil {
+		return nil, fmt.Errorf("failed to rename codebase: %w", err)
+	}
+
+	log.Printf("Codebase renamed: codebase=%s, from=%s, to=%s", codebaseID, codebase.Name, name)
+	return &CodebaseRenameResult{
+		Codebase:        &updated,
+		PreviousName:    codebase.Name,
+		ObjectsMigrated: false,
+		LegacyPrefix:    codebase.Name + "/",
+	}, nil
+}
@@ -0,0 +1,45 @@
+package calculate
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// A new branch is linked to the head of the default branch, whichever branch that is.
+func TestSetDefaultBranch(t *testing.T) {
+	useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "default")
+	mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"a.txt": "main"})
+	dev := mustSnapshot(t, codebase.ID, "dev", "d1", map[string]string{"a.txt": "dev"})
+
+	service := NewCodebaseService()
+	_, err := service.SetDefaultBranch(codebase.ID, "release")
+	var notFound *BranchNotFoundError
+	if !errors.As(err, &notFound) || !reflect.DeepEqual(notFound.AvailableBranches, []string{"main", "dev"}) {
+		t.Fatalf("default branch set to a missing branch = %v, want a BranchNotFoundError listing main and dev", err)
+	}
+
+	updated, err := service.SetDefaultBranch(codebase.ID, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Branch != "dev" {
+		t.Errorf("default branch = %s, want dev", updated.Branch)
+	}
+	details, err := service.GetCodebaseDetails(codebase.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.DefaultBranch != "dev" || !reflect.DeepEqual(details.Branches, []string{"dev", "main"}) {
+		t.Errorf("details list default %s and branches %v, want dev first", details.DefaultBranch, details.Branches)
+	}
+	if m := versionMap(t, codebase.ID); m.DefaultBranch != "dev" {
+		t.Errorf("version map default branch = %s, want dev", m.DefaultBranch)
+	}
+
+	feature := mustSnapshot(t, codebase.ID, "feature", "f1", map[string]string{"a.txt": "feature"})
+	if feature.Linkage == nil || feature.Linkage.ParentVersionID != dev.Version.ID {
+		t.Errorf("new branch linked as %+v, want to the head of dev %s", feature.Linkage, dev.Version.ID)
+	}
+}
@@ -2,6 +2,8 @@ package calculate
 
 import (
 	"main/core"
+	"os"
+	"path/filepath"
 )
 
 type ConfigService struct{}
@@ -10,19 +12,103 @@ func NewConfigService() *ConfigService {
 	return &ConfigService{}
 }
 
+// EffectiveConfig is the saved configuration together with the storage locations the providers actually use
+type EffectiveConfig struct {
+	core.AppConfig
+	ConfigFile string        `json:"config_file,omitempty"`
+	Active     ActiveStorage `json:"active"`
+}
+
+// ActiveStorage describes the storage location the running providers were created with
+type ActiveStorage struct {
+	ProviderType string `json:"provider_type"`
+	StorageType  string `json:"storage_type"`
+	StoragePath  string `json:"storage_path"`       // absolute
+	DBPath       string `json:"db_path,omitempty"`  // empty when the provider isn't file based
+	OSSPath      string `json:"oss_path,omitempty"` // empty when the storage isn't file based
+	Encrypted    bool   `json:"encrypted"`          // stored objects are encrypted at rest
+	Writable     bool   `json:"writable"`
+	WriteError   string `json:"write_error,omitempty"`
+}
+
+// GetConfig returns the configuration the server is currently using, with resolved absolute paths and
+// whether the storage location accepts writes.
+func (s *ConfigService) GetConfig() EffectiveConfig {
+	effective := EffectiveConfig{AppConfig: core.GetConfig()}
+	if effective.EncryptionKey != "" {
+		effective.EncryptionKey = "********" // never hand out the key itself
+	}
+	if path, err := core.ConfigFilePath(); err == nil {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		effective.ConfigFile = path
+	}
+
+	active := core.ActiveConfig()
+	root := absPath(active.StoragePath)
+	dbPath, ossPath := core.BackendPaths(active)
+	effective.Active = ActiveStorage{
+		ProviderType: active.ProviderTypeOrDefault(),
+		StorageType:  active.StorageTypeOrDefault(),
+		StoragePath:  root,
+		DBPath:       absPath(dbPath),
+		OSSPath:      absPath(ossPath),
+		Encrypted:    active.EncryptionEnabled(),
+	}
+	if err := checkWritable(root); err != nil {
+		effective.Active.WriteError = err.Error()
+	} else {
+		effective.Active.Writable = true
+	}
+	return effective
+}
+
+// absPath resolves path against the working directory, leaving it as is on failure or when empty.
+func absPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// checkWritable creates and removes a temporary file in dir.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".cvcs-write-check-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
 // SetStoragePath updates storage path configuration.
-// It updates the configuration in memory, saves it to file, and triggers data/storage provider reinitialization.
+// It reinitializes the data/storage providers at the new path and, once they were created, updates the
+// configuration in memory and saves it to file. A path the configured backends can't use is not saved.
 func (s *ConfigService) SetStoragePath(newPath string) error {
 	// 1. Get copy of current configuration to update field
 	currentConfig := core.GetConfig()
 	currentConfig.StoragePath = newPath
 
-	// 2. Update configuration in memory and save to file
+	// 2. Trigger provider manager to reinitialize with new path
+	//    (As requested, data migration is not handled here)
+	if err := core.UpdateProviders(currentConfig); err != nil {
+		return err
+	}
+
+	// 3. Update configuration in memory and save to file
 	if err := core.UpdateConfig(currentConfig); err != nil {
 		return err
 	}
 
-	// 3. Trigger provider manager to reinitialize with new path
-	//    (As requested, data migration is not handled here)
-	return core.UpdateProviders(currentConfig)
+	// 4. Re-check storage health right away instead of reporting the old location until the next probe
+	NewStorageHealthService().Probe()
+
+	// 5. Warm up the history caches found at the new location
+	NewWarmupService().Start()
+	return nil
 }
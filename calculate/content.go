@@ -0,0 +1,340 @@
+package calculate
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"main/core"
+)
+
+// CorruptObjectError reports a stored object that can't be turned back into the content it was stored for
+type CorruptObjectError struct {
+	StorageKey string
+	Path       string
+	Reason     string
+}
+
+func (e *CorruptObjectError) Error() string {
+	return fmt.Sprintf("corrupt object %s (%s): %s", e.StorageKey, e.Path, e.Reason)
+}
+
+// readFileContent returns the original (decompressed) content of a stored file,
+// serving it from the blob read cache when possible. Content read from storage is
+// checked against the recorded hash, mismatches are reported as *CorruptObjectError.
+func readFileContent(storage core.Storage, f core.File) ([]byte, error) {
+	if len(f.Chunks) > 0 {
+		return readChunkedContent(storage, f)
+	}
+
+	cache := core.GetBlobCache()
+	if content, ok := cache.Get(f.StorageKey); ok {
+		return content, nil
+	}
+
+	r, err := openObjectContent(storage, f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.Add(f.StorageKey, content)
+	return content, nil
+}
+
+// readChunkedContent reassembles a chunked file by reading its chunks in order.
+func readChunkedContent(storage core.Storage, f core.File) ([]byte, error) {
+	content := make([]byte, 0, f.Size)
+	for _, chunk := range f.Chunks {
+		piece, err := readFileContent(storage, chunkFile(f, chunk))
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, piece...)
+	}
+	return content, nil
+}
+
+// chunkFile describes one chunk of f as a file of its own.
+func chunkFile(f core.File, chunk core.FileChunk) core.File {
+	return core.File{
+		Path:       f.Path,
+		Hash:       chunk.Hash,
+		StorageKey: chunk.StorageKey,
+		Type:       "compressed",
+	}
+}
+
+// openFileContent returns a reader over the original content of a stored file that doesn't hold the
+// file in memory; files small enough for the read cache go through it. The content is checked
+// against the recorded hash as it is read, see verifyingReader.
+func openFileContent(storage core.Storage, f core.File) (io.ReadCloser, error) {
+	if len(f.Chunks) > 0 {
+		return newVerifyingReader(&chunkedReader{storage: storage, file: f}, f), nil
+	}
+	// Content the read cache would keep is read whole so the cache gets filled
+	if core.GetBlobCache().Admits(f.Size) {
+		content, err := readFileContent(storage, f)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+	return openObjectContent(storage, f)
+}
+
+// openObjectContent streams the object of a non-chunked file from storage, decompressing it if needed.
+func openObjectContent(storage core.Storage, f core.File) (io.ReadCloser, error) {
+	obj, err := openObject(storage, f)
+	if err != nil {
+		return nil, err
+	}
+	return newVerifyingReader(obj, f), nil
+}
+
+// openObject streams the object of a non-chunked file decoded the way the file says it was stored,
+// without checking the content against its hash.
+func openObject(storage core.Storage, f core.File) (*objectReader, error) {
+	rc, err := storage.GetObjectStream(f.StorageKey)
+	if errors.Is(err, core.ErrEncryptedObjectCorrupt) {
+		return nil, &CorruptObjectError{StorageKey: f.StorageKey, Path: f.Path, Reason: "decryption failed, the object fails authentication"}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("download %s failed: %w", f.StorageKey, err)
+	}
+
+	obj := &objectReader{file: f, raw: &errorTrackingReader{r: rc}, closer: rc}
+	obj.content = obj.raw
+	// The type and encoding recorded at upload say how the object was stored
+	switch encoding := f.ContentEncoding(); encoding {
+	case "":
+	case core.EncodingZlib:
+		zr, err := zlib.NewReader(obj.raw)
+		if err != nil {
+			rc.Close()
+			return nil, obj.classify(err)
+		}
+		obj.content = zr
+	case core.EncodingZstd:
+		zr, release, err := newZstdDecoder(obj.raw)
+		if err != nil {
+			rc.Close()
+			return nil, obj.classify(err)
+		}
+		obj.content = zr
+		obj.release = release
+	default:
+		rc.Close()
+		return nil, &CorruptObjectError{StorageKey: f.StorageKey, Path: f.Path, Reason: fmt.Sprintf("unknown encoding %q", encoding)}
+	}
+	return obj, nil
+}
+
+// storedContentSize reads the stored object of a non-chunked file through, checking it against the
+// hash of f, and returns the size of its content.
+func storedContentSize(storage core.Storage, f core.File) (int64, error) {
+	r, err := openObjectContent(storage, f)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return io.Copy(io.Discard, r)
+}
+
+// storedAs reports whether the stored object of f decodes, in the encoding f records, to content that
+// starts with prefix. It tells an object stored for the same hash in another encoding apart, such as a
+// raw object under the key zlib objects now use, without reading the whole object.
+func storedAs(storage core.Storage, f core.File, prefix []byte) bool {
+	obj, err := openObject(storage, f)
+	if err != nil {
+		return false
+	}
+	defer obj.Close()
+	// One byte past the prefix tells content that ends with it from content that goes on
+	head := make([]byte, len(prefix)+1)
+	n, err := io.ReadFull(obj, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false
+	}
+	if !bytes.Equal(head[:min(n, len(prefix))], prefix) {
+		return false
+	}
+	return int64(n) == min(f.Size, int64(len(prefix))+1)
+}
+
+// errorTrackingReader remembers the error of the storage stream below a decompressor.
+type errorTrackingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (t *errorTrackingReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && err != io.EOF {
+		t.err = err
+	}
+	return n, err
+}
+
+// objectReader reads one stored object, telling storage read errors apart from content that
+// doesn't decompress; the latter are reported as *CorruptObjectError.
+type objectReader struct {
+	file    core.File
+	raw     *errorTrackingReader
+	content io.Reader
+	closer  io.Closer
+	release func() // hands a pooled decompressor back, if one is used
+}
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	n, err := o.content.Read(p)
+	if err != nil && err != io.EOF {
+		err = o.classify(err)
+	}
+	return n, err
+}
+
+func (o *objectReader) Close() error {
+	if o.release != nil {
+		o.release()
+	}
+	return o.closer.Close()
+}
+
+func (o *objectReader) classify(err error) error {
+	if o.raw.err != nil {
+		return fmt.Errorf("download %s failed: %w", o.file.StorageKey, o.raw.err)
+	}
+	return &CorruptObjectError{StorageKey: o.file.StorageKey, Path: o.file.Path, Reason: "decompression failed: " + err.Error()}
+}
+
+// chunkedReader concatenates the chunks of a file, opening one at a time.
+type chunkedReader struct {
+	storage core.Storage
+	file    core.File
+	next    int
+	current io.ReadCloser
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if c.next == len(c.file.Chunks) {
+				return 0, io.EOF
+			}
+			r, err := openFileContent(c.storage, chunkFile(c.file, c.file.Chunks[c.next]))
+			if err != nil {
+				return 0, err
+			}
+			c.current = r
+			c.next++
+		}
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			c.current.Close()
+			c.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *chunkedReader) Close() error {
+	if c.current != nil {
+		return c.current.Close()
+	}
+	return nil
+}
+
+// verifyBlockSize is the piece of content a verifyingReader holds back
+const verifyBlockSize = 64 << 10
+
+// verifyingReader hashes content as it passes through and compares it with the hash recorded for the
+// file at the end. The last block read is held back until the next one arrives, so when the hash
+// doesn't match that block is never released and Read fails with *CorruptObjectError: a reader
+// never receives the complete content of an object that failed verification.
+type verifyingReader struct {
+	src   io.ReadCloser
+	file  core.File
+	hash  hash.Hash
+	ready []byte // released to the reader
+	held  []byte // read but not released yet
+	free  []byte // buffer to read the next block into
+	err   error  // returned once ready is drained
+}
+
+func newVerifyingReader(src io.ReadCloser, f core.File) *verifyingReader {
+	return &verifyingReader{src: src, file: f, hash: sha256.New()}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	for len(v.ready) == 0 {
+		if v.err != nil {
+			return 0, v.err
+		}
+		v.advance()
+	}
+	n := copy(p, v.ready)
+	v.ready = v.ready[n:]
+	return n, nil
+}
+
+// advance reads the next block and releases the one held before it. At the end of the content the
+// held block is released only if the hash matches.
+func (v *verifyingReader) advance() {
+	block := v.free
+	if block == nil {
+		block = make([]byte, verifyBlockSize)
+	}
+	n, err := readBlock(v.src, block)
+	if n > 0 {
+		v.hash.Write(block[:n])
+		v.ready, v.held = v.held, block[:n]
+		v.free = v.ready[:cap(v.ready)] // only reused once ready is drained
+		if cap(v.free) == 0 {
+			v.free = nil
+		}
+	}
+	if err == nil {
+		return
+	}
+	if err != io.EOF {
+		v.err = err
+		return
+	}
+	if v.file.Hash != "" && hex.EncodeToString(v.hash.Sum(nil)) != v.file.Hash {
+		v.err = &CorruptObjectError{StorageKey: v.file.StorageKey, Path: v.file.Path, Reason: "content hash mismatch"}
+		return
+	}
+	v.ready = append(v.ready, v.held...)
+	v.held = nil
+	v.err = io.EOF
+}
+
+func (v *verifyingReader) Close() error {
+	return v.src.Close()
+}
+
+// readBlock fills buf from r unless r ends or fails first.
+func readBlock(r io.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,67 @@
+package calculate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"main/core"
+	"testing"
+)
+
+func TestVerifyingReader(t *testing.T) {
+	content := bytes.Repeat([]byte("verified "), 3*verifyBlockSize/9+100)
+	sum := sha256.Sum256(content)
+	open := func(hash string) io.ReadCloser {
+		f := core.File{Path: "big.bin", StorageKey: "cb/big.bin", Hash: hash}
+		return newVerifyingReader(io.NopCloser(bytes.NewReader(content)), f)
+	}
+
+	got, err := io.ReadAll(open(hex.EncodeToString(sum[:])))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("read %d bytes, %v, want the %d bytes of content", len(got), err, len(content))
+	}
+
+	// The last block is held back when the hash doesn't match
+	got, err = io.ReadAll(open(hex.EncodeToString(make([]byte, sha256.Size))))
+	var corrupt *CorruptObjectError
+	if !errors.As(err, &corrupt) || corrupt.Path != "big.bin" || corrupt.StorageKey != "cb/big.bin" {
+		t.Errorf("reading content that doesn't match its hash = %v, want a CorruptObjectError", err)
+	}
+	if held := len(content) % verifyBlockSize; len(got) != len(content)-held || !bytes.Equal(got, content[:len(got)]) {
+		t.Errorf("released %d of %d bytes before the mismatch, want all but the last %d", len(got), len(content), held)
+	}
+}
+
+// Files too large for the read cache are streamed from storage and still verified.
+func TestOpenFileContentStreams(t *testing.T) {
+	_, storage := useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "stream")
+	content := string(bytes.Repeat([]byte("streamed file "), 100000))
+	resp := mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"big.txt": content})
+	if core.GetBlobCache().Admits(int64(len(content))) {
+		t.Fatal("the read cache admits the file, it wouldn't be streamed")
+	}
+	if got := readStoredFile(t, storage, resp.Version.ID, "big.txt"); got != content {
+		t.Errorf("streamed %d bytes, want %d", len(got), len(content))
+	}
+
+	key := fileKeys(t, resp.Version.ID)["big.txt"]
+	if err := storage.PutObject(key, []byte("not zlib")); err != nil {
+		t.Fatal(err)
+	}
+	files, err := core.GetProvider().GetFileIndexesByTreeID(resp.Version.TreeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := openFileContent(storage, files[0])
+	if err == nil {
+		_, err = io.ReadAll(r)
+		r.Close()
+	}
+	var corrupt *CorruptObjectError
+	if !errors.As(err, &corrupt) {
+		t.Errorf("streaming a corrupt object = %v, want a CorruptObjectError", err)
+	}
+}
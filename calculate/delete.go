@@ -2,14 +2,20 @@ package calculate
 
 import (
 	"fmt"
+	"log"
 	"main/core"
+	"strings"
 )
 
 // DeleteService handles deletion logic
-type DeleteService struct{}
+type DeleteService struct {
+	historyService *HistoryService
+}
 
 func NewDeleteService() *DeleteService {
-	return &DeleteService{}
+	return &DeleteService{
+		historyService: NewHistoryService(),
+	}
 }
 
 // DeleteCodebase deletes a codebase and all its associated data
@@ -22,18 +28,353 @@ func (s *DeleteService) DeleteCodebase(codebaseID string) error {
 	if err != nil {
 		return fmt.Errorf("codebase with ID %s not found: %w", codebaseID, err)
 	}
-
-	// 2. Delete all related files from object storage
-	prefix := fmt.Sprintf("%s/", codebase.Name)
-	if err := storage.DeleteObjectsWithPrefix(prefix); err != nil {
-		// If storage deletion fails, terminate operation to avoid data inconsistency
-		return fmt.Errorf("failed to delete files from storage: %w", err)
+	keys, err := storageKeysForCodebase(provider, codebaseID)
+	if err != nil {
+		return err
 	}
 
-	// 3. Delete codebase record from metadata
+	// 2. Delete codebase record from metadata, releasing its references to stored objects
 	if err := provider.DeleteCodebaseByID(codebaseID); err != nil {
 		return fmt.Errorf("metadata deletion failed: %w", err)
 	}
+	dropPinnedHistory(codebaseID)
+	notifyWebhooks(WebhookEvent{Event: WebhookEventCodebaseDeleted, CodebaseID: codebaseID})
 
+	// 3. Delete the objects nothing references anymore. The codebase is gone at this point, objects
+	//    left behind by a failure are only unreferenced and reclaimed by garbage collection.
+	if err := s.deleteObjects(provider, storage, codebase, keys); err != nil {
+		log.Printf("Codebase %s deleted, but removing its stored objects failed (reclaim them with /maintenance/gc): %v", codebaseID, err)
+	}
 	return nil
 }
+
+// deleteObjects removes the stored objects of a deleted codebase that no remaining file tree references.
+// Objects live under "<name>/", which other codebases may share, and a renamed codebase keeps referencing
+// objects under its previous name. The prefix is wiped, stray objects included, only when no codebase
+// has the name and no remaining tree references anything under it. Objects in the global namespace are
+// only ever deleted by their reference counts. Like garbage collection it holds objectWriters
+// exclusively, so no snapshot deduplicates against an object while it decides to delete it.
+func (s *DeleteService) deleteObjects(provider core.DataProvider, storage core.Storage, codebase *core.Codebase, keys map[string]bool) error {
+	prefix := fmt.Sprintf("%s/", codebase.Name)
+
+	objectWriters.Lock()
+	defer objectWriters.Unlock()
+
+	codebases, err := provider.ListCodebases()
+	if err != nil {
+		return err
+	}
+	// A codebase named like the global namespace never owns it, its objects are left to the reference counts
+	sharesPrefix := prefix == globalBlobPrefix
+	for _, other := range codebases {
+		if other.Name == codebase.Name {
+			sharesPrefix = true
+		}
+	}
+	if !sharesPrefix {
+		err := provider.ListBlobRefs(prefix, func(string, int) error {
+			sharesPrefix = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if !sharesPrefix {
+		if err := storage.DeleteObjectsWithPrefix(prefix); err != nil {
+			return err
+		}
+		core.GetBlobCache().RemovePrefix(prefix)
+	}
+
+	candidates := make(map[string]int64, len(keys))
+	for key := range keys {
+		if sharesPrefix || !strings.HasPrefix(key, prefix) {
+			candidates[key] = 0
+		}
+	}
+	_, _, err = s.deleteUnreferencedObjectsLocked(provider, storage, candidates)
+	return err
+}
+
+// VersionDeleteResult reports what deleting a single version removed and how its lineage was repaired
+type VersionDeleteResult struct {
+	CodebaseID      string   `json:"codebase_id"`
+	Branch          string   `json:"branch"`
+	Version         string   `json:"version"`
+	VersionID       string   `json:"version_id"`
+	ParentVersionID string   `json:"parent_version_id,omitempty"`
+	EdgePolicy      string   `json:"edge_policy"`      // how edges into the deleted version were handled
+	RestitchedEdges []string `json:"restitched_edges"` // child version IDs now linked to the deleted version's parent
+	RemovedEdges    []string `json:"removed_edges"`    // child version IDs whose edge was dropped because there is no parent
+	DeletedObjects  int      `json:"deleted_objects"`  // storage objects no longer referenced by any tree
+	DeletedBytes    int64    `json:"deleted_bytes"`    // stored size of the deleted objects
+	BranchRemoved   bool     `json:"branch_removed"`   // the deleted version was the last one of its branch
+}
+
+// Edge policies reported by DeleteVersion
+const (
+	EdgePolicyRestitch = "restitch_to_parent" // children of the deleted version now descend from its parent
+	EdgePolicyRemove   = "remove"             // the deleted version was a root, edges to its children are dropped
+)
+
+// DeleteVersion deletes one version, its file tree and its lineage. Children of the deleted version are
+// re-stitched to its parent so the map stays connected; when it has no parent their edges are removed.
+// Objects are only deleted once no remaining tree of any codebase references them.
+func (s *DeleteService) DeleteVersion(codebaseID, branch, version string) (*VersionDeleteResult, error) {
+	provider := core.GetProvider()
+	storage := core.GetStore()
+
+	codebase, err := getActiveCodebase(provider, codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	v, err := lookupVersion(provider, codebaseID, branch, version)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUnlocked("delete", v); err != nil {
+		return nil, err
+	}
+
+	versions, err := provider.ListVersions(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	remainingOnBranch := 0
+	for _, other := range versions {
+		if other.ID != v.ID && other.Branch == v.Branch {
+			remainingOnBranch++
+		}
+	}
+	if remainingOnBranch == 0 {
+		for _, protected := range settingsFor(codebase).ProtectedBranches {
+			if protected == v.Branch {
+				return nil, fmt.Errorf("invalid delete: version %s is the last version of protected branch %s", v.Version, v.Branch)
+			}
+		}
+	}
+
+	edges, err := provider.GetAllVersionEdgesForMap(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	result := &VersionDeleteResult{
+		CodebaseID:      codebaseID,
+		Branch:          v.Branch,
+		Version:         v.Version,
+		VersionID:       v.ID,
+		EdgePolicy:      EdgePolicyRemove,
+		RestitchedEdges: []string{},
+		RemovedEdges:    []string{},
+		BranchRemoved:   remainingOnBranch == 0,
+	}
+	for _, e := range edges {
+		if e.To == v.ID {
+			result.ParentVersionID = e.From
+		}
+	}
+	if result.ParentVersionID != "" {
+		result.EdgePolicy = EdgePolicyRestitch
+	}
+	for _, e := range edges {
+		if e.From != v.ID {
+			continue
+		}
+		if result.ParentVersionID != "" {
+			result.RestitchedEdges = append(result.RestitchedEdges, e.To)
+		} else {
+			result.RemovedEdges = append(result.RemovedEdges, e.To)
+		}
+	}
+
+	candidates := make(map[string]int64)
+	if err := s.collectTreeObjects(provider, v.TreeID, candidates); err != nil {
+		return nil, err
+	}
+	if err := provider.DeleteVersion(v.ID, result.ParentVersionID); err != nil {
+		return nil, fmt.Errorf("metadata deletion failed: %w", err)
+	}
+	if result.BranchRemoved {
+		if err := provider.DeleteBranchRef(codebaseID, v.Branch); err != nil {
+			return nil, err
+		}
+	}
+
+	if result.DeletedObjects, result.DeletedBytes, err = s.deleteUnreferencedObjects(provider, storage, candidates); err != nil {
+		return nil, fmt.Errorf("failed to delete files from storage: %w", err)
+	}
+
+	dropPinnedHistory(codebaseID)
+	if _, err := s.historyService.RebuildHistoryCache(codebaseID); err != nil {
+		log.Printf("Failed to rebuild history cache after deleting version %s: %v", v.ID, err)
+	}
+
+	log.Printf("Version deleted: codebase=%s, branch=%s, version=%s, edge_policy=%s, objects=%d", codebaseID, v.Branch, v.Version, result.EdgePolicy, result.DeletedObjects)
+	return result, nil
+}
+
+// collectTreeObjects adds the storage keys of a tree to objects, with their stored size.
+func (s *DeleteService) collectTreeObjects(provider core.DataProvider, treeID string, objects map[string]int64) error {
+	files, err := provider.GetFileIndexesByTreeID(treeID)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if len(f.Chunks) == 0 {
+			objects[f.StorageKey] = f.CompressedSize
+			continue
+		}
+		for _, c := range f.Chunks {
+			objects[c.StorageKey] = c.CompressedSize
+		}
+	}
+	return nil
+}
+
+// deleteUnreferencedObjects deletes the candidate objects whose reference count has dropped to zero,
+// returning how many were deleted and their stored size. Objects shared with any remaining tree, of this
+// or another codebase, are kept. The caller must not hold objectWriters.
+func (s *DeleteService) deleteUnreferencedObjects(provider core.DataProvider, storage core.Storage, candidates map[string]int64) (int, int64, error) {
+	// A snapshot that deduplicated against a candidate holds objectWriters until its reference is
+	// persisted, so the counts can only be trusted with it held exclusively, as garbage collection does
+	objectWriters.Lock()
+	defer objectWriters.Unlock()
+	return s.deleteUnreferencedObjectsLocked(provider, storage, candidates)
+}
+
+// deleteUnreferencedObjectsLocked is deleteUnreferencedObjects for callers holding objectWriters exclusively.
+func (s *DeleteService) deleteUnreferencedObjectsLocked(provider core.DataProvider, storage core.Storage, candidates map[string]int64) (int, int64, error) {
+	keys := make([]string, 0, len(candidates))
+	for key := range candidates {
+		keys = append(keys, key)
+	}
+	refs, err := provider.BlobRefCounts(keys)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	cache := core.GetBlobCache()
+	deleted := 0
+	var bytes int64
+	for key, size := range candidates {
+		if refs[key] > 0 {
+			continue
+		}
+		if err := storage.DeleteObject(key); err != nil {
+			return deleted, bytes, err
+		}
+		cache.Remove(key)
+		deleted++
+		bytes += size
+	}
+	return deleted, bytes, nil
+}
+
+// BranchDeleteResult reports what deleting a branch reclaimed
+type BranchDeleteResult struct {
+	CodebaseID      string `json:"codebase_id"`
+	Branch          string `json:"branch"`
+	DeletedVersions int    `json:"deleted_versions"`
+	DeletedObjects  int    `json:"deleted_objects"`
+	ReclaimedBytes  int64  `json:"reclaimed_bytes"` // stored size of objects no surviving tree referenced
+	DefaultDeleted  bool   `json:"default_branch_deleted"`
+}
+
+// DeleteBranch deletes every version of a branch and its ref. Versions on other branches that descend from
+// the deleted ones are re-stitched to the version the branch started from, like DeleteVersion does.
+// The default branch is only deleted with force; protected branches are never deleted.
+func (s *DeleteService) DeleteBranch(codebaseID, branch string, force bool) (*BranchDeleteResult, error) {
+	provider := core.GetProvider()
+	storage := core.GetStore()
+
+	codebase, err := getActiveCodebase(provider, codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	heads, err := provider.GetBranchHeadsForMap(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	branch = branchForLookup(provider, codebaseID, branch)
+	if _, ok := heads[branch]; !ok {
+		return nil, &BranchNotFoundError{Branch: branch, AvailableBranches: sortedBranches(heads, defaultBranchOf(codebase))}
+	}
+	for _, protected := range settingsFor(codebase).ProtectedBranches {
+		if protected == branch {
+			return nil, fmt.Errorf("invalid delete: branch %s is protected", branch)
+		}
+	}
+	isDefault := branch == defaultBranchOf(codebase)
+	if isDefault && !force {
+		return nil, fmt.Errorf("invalid delete: branch %s is the default branch, pass force to delete it anyway", branch)
+	}
+
+	versions, err := provider.ListVersions(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	edges, err := provider.GetAllVersionEdgesForMap(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	parentOf := make(map[string]string, len(edges))
+	for _, e := range edges {
+		parentOf[e.To] = e.From
+	}
+
+	var doomed []*core.Version
+	doomedIDs := make(map[string]bool)
+	candidates := make(map[string]int64)
+	for _, v := range versions {
+		if v.Branch != branch {
+			continue
+		}
+		if err := checkUnlocked("delete", v); err != nil {
+			return nil, err
+		}
+		doomed = append(doomed, v)
+		doomedIDs[v.ID] = true
+		if err := s.collectTreeObjects(provider, v.TreeID, candidates); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, v := range doomed {
+		// Children are handed to the nearest ancestor that survives, usually the branch's source version
+		parent := parentOf[v.ID]
+		for hops := 0; doomedIDs[parent] && hops <= len(doomed); hops++ {
+			parent = parentOf[parent]
+		}
+		if doomedIDs[parent] {
+			parent = ""
+		}
+		if err := provider.DeleteVersion(v.ID, parent); err != nil {
+			return nil, fmt.Errorf("metadata deletion failed: %w", err)
+		}
+	}
+	if err := provider.DeleteBranchRef(codebaseID, branch); err != nil {
+		return nil, err
+	}
+
+	result := &BranchDeleteResult{
+		CodebaseID:      codebaseID,
+		Branch:          branch,
+		DeletedVersions: len(doomed),
+		DefaultDeleted:  isDefault,
+	}
+	if result.DeletedObjects, result.ReclaimedBytes, err = s.deleteUnreferencedObjects(provider, storage, candidates); err != nil {
+		return nil, fmt.Errorf("failed to delete files from storage: %w", err)
+	}
+
+	dropPinnedHistory(codebaseID)
+	if _, err := s.historyService.RebuildHistoryCache(codebaseID); err != nil {
+		log.Printf("Failed to rebuild history cache after deleting branch %s: %v", branch, err)
+	}
+
+	log.Printf("Branch deleted: codebase=%s, branch=%s, versions=%d, objects=%d, bytes=%d", codebaseID, branch, result.DeletedVersions, result.DeletedObjects, result.ReclaimedBytes)
+	return result, nil
+}
@@ -0,0 +1,104 @@
+package calculate
+
+import (
+	"main/core"
+	"os"
+	"testing"
+)
+
+// forEachRefCountingProvider runs test on memory storage with each provider that keeps reference counts
+// in its own way: the JSON provider persists them, the memory provider counts in place.
+func forEachRefCountingProvider(t *testing.T, test func(t *testing.T, storage *core.MemoryStorage)) {
+	providers := map[string]func(t *testing.T) core.DataProvider{
+		core.ProviderTypeJSON: func(t *testing.T) core.DataProvider {
+			p, err := core.NewJSONFileProvider(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { p.Close() })
+			return p
+		},
+		core.ProviderTypeMemory: func(t *testing.T) core.DataProvider { return core.NewMemoryProvider() },
+	}
+	for _, name := range []string{core.ProviderTypeJSON, core.ProviderTypeMemory} {
+		t.Run(name, func(t *testing.T) {
+			storage := core.NewMemoryStorage()
+			core.SetProvidersForTesting(providers[name](t), storage)
+			test(t, storage)
+		})
+	}
+}
+
+func checkStored(t *testing.T, storage core.Storage, key string, want bool) {
+	t.Helper()
+	if exists, _ := storage.ObjectExists(key); exists != want {
+		t.Errorf("object %s stored = %v, want %v", key, exists, want)
+	}
+}
+
+func TestDeleteVersionKeepsSharedObjects(t *testing.T) {
+	forEachRefCountingProvider(t, func(t *testing.T, storage *core.MemoryStorage) {
+		codebase := mustInitCodebase(t, "refs")
+		v1 := mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"shared.txt": "in both versions", "own.txt": "only in v1"})
+		v2 := mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{"shared.txt": "in both versions", "own.txt": "only in v2"})
+		keys1, keys2 := fileKeys(t, v1.Version.ID), fileKeys(t, v2.Version.ID)
+		if keys1["shared.txt"] != keys2["shared.txt"] {
+			t.Fatal("shared.txt was not deduplicated across the versions")
+		}
+
+		deletes := NewDeleteService()
+		if _, err := deletes.DeleteVersion(codebase.ID, "main", "v1"); err != nil {
+			t.Fatal(err)
+		}
+		checkStored(t, storage, keys1["own.txt"], false)
+		checkStored(t, storage, keys1["shared.txt"], true)
+		checkStored(t, storage, keys2["own.txt"], true)
+		if counts, _ := core.GetProvider().BlobRefCounts([]string{keys1["shared.txt"]}); counts[keys1["shared.txt"]] != 1 {
+			t.Errorf("reference count of shared.txt after deleting v1 = %d, want 1", counts[keys1["shared.txt"]])
+		}
+
+		result, err := deletes.DeleteVersion(codebase.ID, "main", "v2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.BranchRemoved || result.DeletedObjects < 2 {
+			t.Errorf("deleting the last version = %+v, want the branch and both of its objects removed", result)
+		}
+		checkStored(t, storage, keys2["shared.txt"], false)
+		checkStored(t, storage, keys2["own.txt"], false)
+	})
+}
+
+func TestDeleteCodebaseKeepsSharedObjects(t *testing.T) {
+	core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), GlobalBlobNamespace: true})
+	t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+	forEachRefCountingProvider(t, func(t *testing.T, storage *core.MemoryStorage) {
+		first, second := mustInitCodebase(t, "first"), mustInitCodebase(t, "second")
+		a := mustSnapshot(t, first.ID, "main", "v1", map[string]string{"shared.txt": "in both codebases", "own.txt": "only in first"})
+		b := mustSnapshot(t, second.ID, "main", "v1", map[string]string{"shared.txt": "in both codebases", "own.txt": "only in second"})
+		keysA, keysB := fileKeys(t, a.Version.ID), fileKeys(t, b.Version.ID)
+		if keysA["shared.txt"] != keysB["shared.txt"] {
+			t.Fatal("shared.txt was not deduplicated across the codebases")
+		}
+
+		deletes := NewDeleteService()
+		if err := deletes.DeleteCodebase(first.ID); err != nil {
+			t.Fatal(err)
+		}
+		checkStored(t, storage, keysA["own.txt"], false)
+		checkStored(t, storage, keysA["shared.txt"], true)
+		checkStored(t, storage, keysB["own.txt"], true)
+
+		if err := deletes.DeleteCodebase(second.ID); err != nil {
+			t.Fatal(err)
+		}
+		checkStored(t, storage, keysB["shared.txt"], false)
+		checkStored(t, storage, keysB["own.txt"], false)
+		if err := core.GetProvider().ListBlobRefs("", func(key string, refs int) error {
+			t.Errorf("%s still has %d references", key, refs)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
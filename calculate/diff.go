@@ -0,0 +1,111 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"sort"
+)
+
+// DiffEntry is one file that differs between two versions
+type DiffEntry struct {
+	Path      string `json:"path"`
+	OldHash   string `json:"old_hash,omitempty"`
+	NewHash   string `json:"new_hash,omitempty"`
+	OldSize   int64  `json:"old_size"`
+	NewSize   int64  `json:"new_size"`
+	SizeDelta int64  `json:"size_delta"`
+	Type      string `json:"type,omitempty"` // "dir" for directory entries, see directories.go
+}
+
+// VersionDiff lists the files added, deleted and modified going from version A to version B
+type VersionDiff struct {
+	CodebaseID string        `json:"codebase_id"`
+	From       *core.Version `json:"from"`
+	To         *core.Version `json:"to"`
+	Added      []DiffEntry   `json:"added"`
+	Deleted    []DiffEntry   `json:"deleted"`
+	Modified   []DiffEntry   `json:"modified"`
+	Unchanged  int           `json:"unchanged"`
+	SizeDelta  int64         `json:"size_delta"` // change of the total original size
+}
+
+// DiffService compares the file trees of two versions
+type DiffService struct{}
+
+func NewDiffService() *DiffService {
+	return &DiffService{}
+}
+
+// Diff compares the trees of versions a and b by path and content hash. Files with the same hash are
+// unchanged even if they were stored differently. The versions may be on different branches.
+func (s *DiffService) Diff(codebaseID string, a, b VersionIdentifier) (*VersionDiff, error) {
+	provider := core.GetProvider()
+	if _, err := getActiveCodebase(provider, codebaseID); err != nil {
+		return nil, err
+	}
+	from, fromFiles, err := s.loadTree(provider, codebaseID, a)
+	if err != nil {
+		return nil, err
+	}
+	to, toFiles, err := s.loadTree(provider, codebaseID, b)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &VersionDiff{
+		CodebaseID: codebaseID,
+		From:       from,
+		To:         to,
+		Added:      []DiffEntry{},
+		Deleted:    []DiffEntry{},
+		Modified:   []DiffEntry{},
+	}
+	for path, old := range fromFiles {
+		current, ok := toFiles[path]
+		switch {
+		case !ok:
+			diff.Deleted = append(diff.Deleted, DiffEntry{Path: path, OldHash: old.Hash, OldSize: old.Size, SizeDelta: -old.Size, Type: dirType(old)})
+		case current.Hash != old.Hash || current.IsDir() != old.IsDir():
+			diff.Modified = append(diff.Modified, DiffEntry{Path: path, OldHash: old.Hash, NewHash: current.Hash, OldSize: old.Size, NewSize: current.Size, SizeDelta: current.Size - old.Size, Type: dirType(current)})
+		default:
+			diff.Unchanged++
+		}
+	}
+	for path, current := range toFiles {
+		if _, ok := fromFiles[path]; !ok {
+			diff.Added = append(diff.Added, DiffEntry{Path: path, NewHash: current.Hash, NewSize: current.Size, SizeDelta: current.Size, Type: dirType(current)})
+		}
+	}
+
+	for _, list := range [][]DiffEntry{diff.Added, diff.Deleted, diff.Modified} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+		for _, e := range list {
+			diff.SizeDelta += e.SizeDelta
+		}
+	}
+	return diff, nil
+}
+
+// dirType returns the type of a diff entry for f: "dir" for directories, empty for files.
+func dirType(f core.File) string {
+	if f.IsDir() {
+		return f.Type
+	}
+	return ""
+}
+
+func (s *DiffService) loadTree(provider core.DataProvider, codebaseID string, id VersionIdentifier) (*core.Version, map[string]core.File, error) {
+	v, err := resolveVersion(provider, codebaseID, id.Branch, id.Version)
+	if err != nil {
+		return nil, nil, err
+	}
+	files, err := provider.GetFileIndexesByTreeID(v.TreeID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("file tree of version %s/%s not found: %w", v.Branch, v.Version, err)
+	}
+	byPath := make(map[string]core.File, len(files))
+	for _, f := range files {
+		byPath[f.Path] = f
+	}
+	return v, byPath, nil
+}
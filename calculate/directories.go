@@ -0,0 +1,84 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Directories listed with a snapshot are stored in its file tree as entries of type "dir" without
+// content, so directories that hold no files survive a restore. They don't count in the version stats.
+
+// dirEntryMode is the mode directories are restored with
+const dirEntryMode = 0755
+
+// normalizeDirectories validates the directories of a snapshot request and returns them as slash paths
+// without surrounding slashes, sorted and without duplicates.
+func normalizeDirectories(dirs []string, files map[string]*SnapshotFile) ([]string, error) {
+	if len(dirs) == 0 {
+		return nil, nil
+	}
+	uploaded := make(map[string]bool, len(files))
+	for relPath := range files {
+		uploaded[filepath.ToSlash(relPath)] = true
+	}
+
+	seen := make(map[string]bool, len(dirs))
+	var normalized, problems []string
+	for _, dir := range dirs {
+		p := strings.Trim(filepath.ToSlash(dir), "/")
+		switch {
+		case p == "":
+			problems = append(problems, fmt.Sprintf("%q is not a directory path", dir))
+		case uploaded[p]:
+			problems = append(problems, fmt.Sprintf("%s is uploaded as a file", p))
+		case hasDotSegment(p):
+			problems = append(problems, fmt.Sprintf("%s contains . or .. segments", p))
+		default:
+			if issues := portabilityProblems(p); len(issues) > 0 {
+				problems = append(problems, fmt.Sprintf("%s: %s", p, strings.Join(issues, ", ")))
+			} else if !seen[p] {
+				seen[p] = true
+				normalized = append(normalized, p)
+			}
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("invalid snapshot: directories: %s", strings.Join(problems, "; "))
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+func hasDotSegment(p string) bool {
+	for _, name := range strings.Split(p, "/") {
+		if name == "" || name == "." || name == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// filterIgnoredDirectories drops the directories matching the ignore patterns or lying below an ignored one.
+func filterIgnoredDirectories(dirs []string, patterns []string) []string {
+	if len(patterns) == 0 {
+		return dirs
+	}
+	var kept []string
+	for _, dir := range dirs {
+		if !isIgnoredDir(patterns, dir) {
+			kept = append(kept, dir)
+		}
+	}
+	return kept
+}
+
+// addDirectories adds directory entries to the tree, leaving the version stats alone.
+func addDirectories(tree *core.FileTree, dirs []string) {
+	for _, dir := range dirs {
+		tree.Files = append(tree.Files, core.File{Path: dir, Type: "dir"})
+	}
+}
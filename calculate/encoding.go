@@ -0,0 +1,81 @@
+package calculate
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"main/core"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstd encoders and decoders allocate their tables and windows up front, which costs more than compressing
+// a typical source file. They are pooled and reset per object instead of created for each one.
+var (
+	zstdEncoders = sync.Pool{New: func() any {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+		return enc
+	}}
+	zstdDecoders = sync.Pool{New: func() any {
+		dec, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		return dec
+	}}
+)
+
+// newCompressor returns a writer compressing into w with the encoding. Closing it flushes the compressed
+// stream but leaves w open.
+func newCompressor(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case core.EncodingZlib:
+		return zlib.NewWriter(w), nil
+	case core.EncodingZstd:
+		enc := zstdEncoders.Get().(*zstd.Encoder)
+		enc.Reset(w)
+		return &pooledZstdWriter{enc}, nil
+	}
+	return nil, fmt.Errorf("unknown compression algorithm %q", encoding)
+}
+
+// pooledZstdWriter hands its encoder back to the pool once the stream is complete. An encoder abandoned
+// after a failed write is left to the garbage collector.
+type pooledZstdWriter struct {
+	*zstd.Encoder
+}
+
+func (w *pooledZstdWriter) Close() error {
+	err := w.Encoder.Close()
+	w.Encoder.Reset(nil)
+	zstdEncoders.Put(w.Encoder)
+	return err
+}
+
+// newZstdDecoder returns a pooled decoder reading from r and the function handing it back to the pool.
+func newZstdDecoder(r io.Reader) (io.Reader, func(), error) {
+	dec := zstdDecoders.Get().(*zstd.Decoder)
+	if err := dec.Reset(r); err != nil {
+		zstdDecoders.Put(dec)
+		return nil, nil, err
+	}
+	return dec, func() {
+		dec.Reset(nil)
+		zstdDecoders.Put(dec)
+	}, nil
+}
+
+// compressContent returns content compressed with the encoding.
+func compressContent(content []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := newCompressor(&buf, encoding)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(content); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
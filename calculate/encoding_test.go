@@ -0,0 +1,75 @@
+package calculate
+
+import (
+	"io"
+	"io/fs"
+	"log"
+	"main/core"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sourceTree returns the Go and Markdown files of this repository as path -> content, a representative
+// tree of source code.
+func sourceTree(tb testing.TB) map[string]string {
+	tb.Helper()
+	contents := make(map[string]string)
+	err := filepath.WalkDir("..", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ext := filepath.Ext(path); ext != ".go" && ext != ".md" {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel("..", path)
+		contents[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return contents
+}
+
+// BenchmarkSnapshotCompression compares the snapshot time and the stored size of a source tree with
+// each compression algorithm.
+func BenchmarkSnapshotCompression(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	tree := sourceTree(b)
+	var total int64
+	for _, content := range tree {
+		total += int64(len(content))
+	}
+
+	for _, algorithm := range []string{core.EncodingZlib, core.EncodingZstd} {
+		b.Run(algorithm, func(b *testing.B) {
+			core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), Compression: &core.CompressionConfig{Algorithm: algorithm}})
+			defer core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()})
+
+			var stored int64
+			b.SetBytes(total)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				useMemoryBackends(b)
+				codebase := mustInitCodebase(b, "tree")
+				b.StartTimer()
+				resp := mustSnapshot(b, codebase.ID, "main", "v1", tree)
+				stored = resp.Version.Stats.CompressedSize
+			}
+			b.ReportMetric(float64(stored), "stored-bytes")
+			b.ReportMetric(float64(stored)/float64(total), "ratio")
+		})
+	}
+}
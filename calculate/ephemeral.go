@@ -0,0 +1,131 @@
+package calculate
+
+import (
+	"fmt"
+	"log"
+	"main/core"
+	"time"
+)
+
+const (
+	defaultEphemeralTTL           = time.Hour
+	defaultEphemeralSweepInterval = time.Minute
+)
+
+// EphemeralService manages the lifetime of temporary codebases
+type EphemeralService struct {
+	deleteService *DeleteService
+	now           func() time.Time
+}
+
+func NewEphemeralService() *EphemeralService {
+	return &EphemeralService{
+		deleteService: NewDeleteService(),
+		now:           time.Now,
+	}
+}
+
+func ephemeralSweepInterval() time.Duration {
+	if seconds := core.GetConfig().EphemeralSweepIntervalSeconds; seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultEphemeralSweepInterval
+}
+
+// getEphemeralCodebase returns a live ephemeral codebase.
+func (s *EphemeralService) getEphemeralCodebase(provider core.DataProvider, codebaseID string) (*core.Codebase, error) {
+	codebase, err := getActiveCodebase(provider, codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	if !codebase.Ephemeral {
+		return nil, fmt.Errorf("invalid request: codebase %s is not ephemeral", codebaseID)
+	}
+	return codebase, nil
+}
+
+// ExtendTTL moves the expiry of an ephemeral codebase to ttl from now.
+func (s *EphemeralService) ExtendTTL(codebaseID string, ttl time.Duration) (*core.Codebase, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("invalid ttl: must be positive")
+	}
+	provider := core.GetProvider()
+	codebase, err := s.getEphemeralCodebase(provider, codebaseID)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := *codebase
+	expiresAt := s.now().Add(ttl)
+	updated.ExpiresAt = &expiresAt
+	if err := provider.UpdateCodebase(&updated); err != nil {
+		return nil, fmt.Errorf("failed to extend ttl: %w", err)
+	}
+	return &updated, nil
+}
+
+// Release purges an ephemeral codebase before its TTL runs out.
+func (s *EphemeralService) Release(codebaseID string) error {
+	if _, err := s.getEphemeralCodebase(core.GetProvider(), codebaseID); err != nil {
+		return err
+	}
+	if err := s.deleteService.DeleteCodebase(codebaseID); err != nil {
+		return err
+	}
+	log.Printf("Released ephemeral codebase: ID=%s", codebaseID)
+	return nil
+}
+
+// PurgeExpired deletes ephemeral codebases whose TTL has passed, returning their IDs.
+// Objects shared with other codebases are left in place by the regular deletion path.
+func (s *EphemeralService) PurgeExpired() ([]string, error) {
+	return s.purgeExpired(nil)
+}
+
+func (s *EphemeralService) purgeExpired(throttle *IOThrottle) ([]string, error) {
+	provider := core.GetProvider()
+	codebases, err := provider.ListCodebases()
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	var purged []string
+	for _, c := range codebases {
+		if !c.Ephemeral || c.ExpiresAt == nil || now.Before(*c.ExpiresAt) {
+			continue
+		}
+		if throttle != nil {
+			if bytes, err := storedBytesForCodebase(provider, c.ID); err == nil {
+				throttle.Wait(bytes)
+			}
+		}
+		if err := s.deleteService.DeleteCodebase(c.ID); err != nil {
+			log.Printf("Failed to purge ephemeral codebase %s: %v", c.ID, err)
+			continue
+		}
+		log.Printf("Purged expired ephemeral codebase: ID=%s, name=%s, expired at %s", c.ID, c.Name, c.ExpiresAt.Format(time.RFC3339))
+		purged = append(purged, c.ID)
+	}
+	return purged, nil
+}
+
+// StartSweeper runs PurgeExpired periodically in the background until stop is closed.
+func (s *EphemeralService) StartSweeper(stop <-chan struct{}) {
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(ephemeralSweepInterval()):
+			}
+			err := BackgroundJobs().Run("ephemeral-sweep", func(throttle *IOThrottle) error {
+				_, err := s.purgeExpired(throttle)
+				return err
+			})
+			if err != nil {
+				log.Printf("Ephemeral codebase sweep failed: %v", err)
+			}
+		}
+	}()
+}
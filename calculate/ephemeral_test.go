@@ -0,0 +1,86 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"os"
+	"testing"
+	"time"
+)
+
+func codebaseNames(codebases []*core.Codebase) []string {
+	names := make([]string, len(codebases))
+	for i, c := range codebases {
+		names[i] = c.Name
+	}
+	return names
+}
+
+func TestListCodebasesEphemeral(t *testing.T) {
+	useMemoryBackends(t)
+	mustInitCodebase(t, "permanent")
+	if _, err := NewInitService().InitializeCodebase("scratch", "", "main", nil, InitOptions{Ephemeral: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	codebases := NewCodebaseService()
+	for _, tt := range []struct {
+		includeEphemeral bool
+		want             string
+	}{
+		{false, "[permanent]"},
+		{true, "[permanent scratch]"},
+	} {
+		list, err := codebases.ListCodebases(tt.includeEphemeral)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(codebaseNames(list)); got != tt.want {
+			t.Errorf("ListCodebases(%v) = %s, want %s", tt.includeEphemeral, got, tt.want)
+		}
+	}
+}
+
+func TestEphemeralSweeper(t *testing.T) {
+	core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), GlobalBlobNamespace: true})
+	t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+	provider, storage := useMemoryBackends(t)
+	permanent := mustInitCodebase(t, "permanent")
+	scratch, err := NewInitService().InitializeCodebase("scratch", "", "main", nil, InitOptions{Ephemeral: true, TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := mustSnapshot(t, permanent.ID, "main", "v1", map[string]string{"shared.txt": "in both codebases", "own.txt": "only in permanent"})
+	temp := mustSnapshot(t, scratch.ID, "main", "v1", map[string]string{"shared.txt": "in both codebases", "own.txt": "only in scratch"})
+	keptKeys, tempKeys := fileKeys(t, kept.Version.ID), fileKeys(t, temp.Version.ID)
+
+	clock := &fakeClock{t: time.Now()}
+	ephemeral := &EphemeralService{deleteService: NewDeleteService(), now: clock.now}
+	if _, err := ephemeral.ExtendTTL(scratch.ID, 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.t = clock.t.Add(90 * time.Minute)
+	if purged, err := ephemeral.PurgeExpired(); err != nil || len(purged) != 0 {
+		t.Fatalf("PurgeExpired after the original TTL but before the extended one = %v, %v", purged, err)
+	}
+
+	clock.t = clock.t.Add(time.Hour)
+	purged, err := ephemeral.PurgeExpired()
+	if err != nil || len(purged) != 1 || purged[0] != scratch.ID {
+		t.Fatalf("PurgeExpired after the TTL = %v, %v, want [%s]", purged, err, scratch.ID)
+	}
+	if _, err := provider.GetCodebaseByID(scratch.ID); err == nil {
+		t.Error("the purged codebase is still stored")
+	}
+	checkStored(t, storage, tempKeys["own.txt"], false)
+	checkStored(t, storage, tempKeys["shared.txt"], true)
+	checkStored(t, storage, keptKeys["own.txt"], true)
+	if got := readStoredFile(t, storage, kept.Version.ID, "shared.txt"); got != "in both codebases" {
+		t.Errorf("shared.txt of the permanent codebase = %q", got)
+	}
+
+	if purged, err := ephemeral.PurgeExpired(); err != nil || len(purged) != 0 {
+		t.Errorf("second sweep = %v, %v, want nothing left to purge", purged, err)
+	}
+}
@@ -0,0 +1,144 @@
+package calculate
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"main/core"
+	"sort"
+	"sync"
+)
+
+// A file of a snapshot that can't be read or stored doesn't stop the others: every file is processed and
+// the failures are collected with their paths. With the default failure_mode "strict" the snapshot then
+// fails with a SnapshotFilesError listing them; with "partial" the version is created from the files
+// that were stored and lists the others in Version.FailedFiles. Objects written for a snapshot that
+// failed, or for its failed files, aren't referenced by any file index: garbage collection deletes them
+// like any unreferenced object, and counts the ones tracked here in its report.
+
+// Values of SnapshotOptions.FailureMode
+const (
+	FailureModeStrict  = "strict"
+	FailureModePartial = "partial"
+)
+
+// Stages of core.FailedFile
+const (
+	failureStageRead  = "read"
+	failureStageStore = "store"
+)
+
+// validateFailureMode checks the failure_mode of a snapshot request; empty means strict.
+func validateFailureMode(mode string) error {
+	switch mode {
+	case "", FailureModeStrict, FailureModePartial:
+		return nil
+	}
+	return fmt.Errorf("invalid snapshot: failure_mode %q is not supported, use %q or %q", mode, FailureModeStrict, FailureModePartial)
+}
+
+// fileStageError tells whether a file failed while its upload was read or while it was stored
+type fileStageError struct {
+	stage string
+	err   error
+}
+
+func (e *fileStageError) Error() string { return e.err.Error() }
+func (e *fileStageError) Unwrap() error { return e.err }
+
+func readFailure(err error) error  { return &fileStageError{stage: failureStageRead, err: err} }
+func storeFailure(err error) error { return &fileStageError{stage: failureStageStore, err: err} }
+
+// failedFile describes the failure of the file at relPath.
+func failedFile(relPath string, err error) core.FailedFile {
+	stage := failureStageStore
+	var stageErr *fileStageError
+	if errors.As(err, &stageErr) {
+		stage = stageErr.stage
+	}
+	return core.FailedFile{Path: relPath, Stage: stage, Error: err.Error()}
+}
+
+// SnapshotFilesError fails a strict snapshot with every file that couldn't be processed
+type SnapshotFilesError struct {
+	Failed []core.FailedFile `json:"failed_files"`
+	Total  int               `json:"total_files"`
+}
+
+func (e *SnapshotFilesError) Error() string {
+	msg := fmt.Sprintf("%d of %d files of the snapshot failed, the version was not created: %s", len(e.Failed), e.Total, e.Failed[0].Error)
+	if len(e.Failed) > 1 {
+		msg += fmt.Sprintf(" (and %d more)", len(e.Failed)-1)
+	}
+	return msg
+}
+
+// ReadFailuresOnly reports whether every failure happened while reading the upload rather than in storage.
+func (e *SnapshotFilesError) ReadFailuresOnly() bool {
+	for _, f := range e.Failed {
+		if f.Stage != failureStageRead {
+			return false
+		}
+	}
+	return true
+}
+
+// failedPaths returns the paths of the failed files, with the original path of files renamed by the path
+// policy.
+func failedPaths(failed []core.FailedFile, renames map[string]string) []string {
+	paths := make([]string, 0, len(failed))
+	for _, f := range failed {
+		paths = append(paths, f.Path)
+		if original := renames[f.Path]; original != "" {
+			paths = append(paths, original)
+		}
+	}
+	return paths
+}
+
+func sortFailedFiles(failed []core.FailedFile) {
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Path < failed[j].Path })
+}
+
+// failedSnapshotObjects remembers the objects written by failed snapshots and failed files until garbage
+// collection deletes them or finds them referenced. It is kept in memory only: after a restart the objects
+// are still collected, just no longer counted apart.
+var failedSnapshotObjects = struct {
+	sync.Mutex
+	keys map[string]bool
+}{keys: make(map[string]bool)}
+
+// trackOrphanedObjects records objects that no file index will reference.
+func trackOrphanedObjects(codebaseName string, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	failedSnapshotObjects.Lock()
+	defer failedSnapshotObjects.Unlock()
+	for _, key := range keys {
+		failedSnapshotObjects.keys[key] = true
+	}
+	log.Printf("event=snapshot_orphans codebase=%q objects=%d (left for garbage collection)", codebaseName, len(keys))
+}
+
+// countFailedSnapshotObjects returns how many of the unreferenced objects were written by failed snapshots
+// and forgets the tracked objects that are referenced or gone by now.
+func countFailedSnapshotObjects(unreferenced []string) int {
+	failedSnapshotObjects.Lock()
+	defer failedSnapshotObjects.Unlock()
+	current := make(map[string]bool, len(failedSnapshotObjects.keys))
+	for _, key := range unreferenced {
+		if failedSnapshotObjects.keys[key] {
+			current[key] = true
+		}
+	}
+	failedSnapshotObjects.keys = current
+	return len(current)
+}
+
+// forgetFailedSnapshotObject drops a deleted object from the tracked ones.
+func forgetFailedSnapshotObject(key string) {
+	failedSnapshotObjects.Lock()
+	defer failedSnapshotObjects.Unlock()
+	delete(failedSnapshotObjects.keys, key)
+}
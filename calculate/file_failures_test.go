@@ -0,0 +1,137 @@
+package calculate
+
+import (
+	"errors"
+	"io"
+	"main/core"
+	"mime/multipart"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// rejectingStorage fails to store the objects of the contents it was given, as a full volume does for
+// the objects that don't fit anymore.
+type rejectingStorage struct {
+	*core.MemoryStorage
+	hashes []string
+}
+
+func (s rejectingStorage) rejects(name string) bool {
+	for _, hash := range s.hashes {
+		if strings.Contains(name, hash) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s rejectingStorage) PutObject(name string, data []byte) error {
+	if s.rejects(name) {
+		return errors.New("no space left on device")
+	}
+	return s.MemoryStorage.PutObject(name, data)
+}
+
+func (s rejectingStorage) PutObjectStream(name string, r io.Reader, size int64) error {
+	if s.rejects(name) {
+		return errors.New("no space left on device")
+	}
+	return s.MemoryStorage.PutObjectStream(name, r, size)
+}
+
+// unreadableFile is an upload whose content can't be read.
+func unreadableFile() *SnapshotFile {
+	return &SnapshotFile{Size: 10, open: func() (multipart.File, error) {
+		return nil, errors.New("unexpected EOF")
+	}}
+}
+
+// failingUpload is an upload of good.txt, of rejected.txt that can't be stored and of unread.txt that can't be read.
+func failingUpload(t *testing.T) map[string]*SnapshotFile {
+	provider, memory := useMemoryBackends(t)
+	core.SetProvidersForTesting(provider, rejectingStorage{memory, []string{sha256Hex("rejected by storage")}})
+	files := snapshotFiles(map[string]string{"good.txt": strings.Repeat("stored fine ", 20), "rejected.txt": "rejected by storage"})
+	files["unread.txt"] = unreadableFile()
+	return files
+}
+
+func TestSnapshotFailuresStrict(t *testing.T) {
+	files := failingUpload(t)
+	codebase := mustInitCodebase(t, "strict")
+	_, err := NewUploadService().ProcessSnapshot(codebase.ID, "v1", "main", "", files, nil, true, SnapshotOptions{})
+	var filesErr *SnapshotFilesError
+	if !errors.As(err, &filesErr) {
+		t.Fatalf("snapshot = %v, want a SnapshotFilesError", err)
+	}
+	if filesErr.Total != 3 || len(filesErr.Failed) != 2 || filesErr.ReadFailuresOnly() {
+		t.Fatalf("failures = %+v", filesErr)
+	}
+	rejected, unread := filesErr.Failed[0], filesErr.Failed[1]
+	if rejected.Path != "rejected.txt" || rejected.Stage != failureStageStore || !strings.Contains(rejected.Error, "no space left") {
+		t.Errorf("failure of rejected.txt = %+v", rejected)
+	}
+	if unread.Path != "unread.txt" || unread.Stage != failureStageRead || !strings.Contains(unread.Error, "unexpected EOF") {
+		t.Errorf("failure of unread.txt = %+v", unread)
+	}
+	if versions, _ := core.GetProvider().ListVersions(codebase.ID); len(versions) != 0 {
+		t.Errorf("%d versions created by a failed strict snapshot", len(versions))
+	}
+	// The objects of good.txt are left for garbage collection
+	objects := storedObjects(t, core.GetStore())
+	if len(objects) == 0 || countFailedSnapshotObjects(objects) != len(objects) {
+		t.Errorf("%d of the objects %v are tracked as orphans", countFailedSnapshotObjects(objects), objects)
+	}
+
+	// Failures reading the upload only are the client's
+	_, err = NewUploadService().ProcessSnapshot(codebase.ID, "v1", "main", "", map[string]*SnapshotFile{"unread.txt": unreadableFile()}, nil, true, SnapshotOptions{})
+	if !errors.As(err, &filesErr) || !filesErr.ReadFailuresOnly() {
+		t.Errorf("snapshot failing only to read = %v, want read failures only", err)
+	}
+
+	if _, err := NewUploadService().ProcessSnapshot(codebase.ID, "v1", "main", "", snapshotFiles(map[string]string{"a.txt": "a"}), nil, true, SnapshotOptions{FailureMode: "lenient"}); err == nil || !strings.Contains(err.Error(), "invalid snapshot") {
+		t.Errorf("unknown failure mode = %v", err)
+	}
+}
+
+func TestSnapshotFailuresPartial(t *testing.T) {
+	files := failingUpload(t)
+	codebase := mustInitCodebase(t, "partial")
+	mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"unread.txt": "in the base", "kept.txt": "carried forward"})
+
+	resp, err := NewUploadService().ProcessSnapshot(codebase.ID, "v2", "main", "", files, nil, true,
+		SnapshotOptions{FailureMode: FailureModePartial, Base: &SnapshotBase{Version: "v1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := func(failed []core.FailedFile) []string {
+		var paths []string
+		for _, f := range failed {
+			paths = append(paths, f.Path)
+		}
+		return paths
+	}
+	want := []string{"rejected.txt", "unread.txt"}
+	if got := paths(resp.FailedFiles); !reflect.DeepEqual(got, want) {
+		t.Errorf("failed files of the response = %v, want %v", got, want)
+	}
+	stored, err := core.GetProvider().GetVersionByID(resp.Version.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := paths(stored.FailedFiles); !reflect.DeepEqual(got, want) {
+		t.Errorf("failed files of the version = %v, want %v", got, want)
+	}
+	// A failed file isn't carried forward from the base in its place
+	keys := fileKeys(t, resp.Version.ID)
+	if _, ok := keys["unread.txt"]; ok || len(keys) != 2 || keys["good.txt"] == "" || keys["kept.txt"] == "" {
+		t.Errorf("files of v2 = %v, want good.txt and kept.txt", keys)
+	}
+
+	// A partial snapshot that stores nothing still fails
+	_, err = NewUploadService().ProcessSnapshot(codebase.ID, "v3", "main", "", map[string]*SnapshotFile{"unread.txt": unreadableFile()}, nil, true, SnapshotOptions{FailureMode: FailureModePartial})
+	var filesErr *SnapshotFilesError
+	if !errors.As(err, &filesErr) {
+		t.Errorf("partial snapshot without a stored file = %v, want a SnapshotFilesError", err)
+	}
+}
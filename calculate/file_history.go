@@ -0,0 +1,103 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"sort"
+	"time"
+)
+
+// Kinds of file history events
+const (
+	FileAdded    = "added"
+	FileModified = "modified"
+	FileDeleted  = "deleted"
+)
+
+// FileHistoryEvent is a version in which a path changed compared to the previous version of the same branch
+type FileHistoryEvent struct {
+	Kind      string    `json:"kind"`
+	VersionID string    `json:"version_id"`
+	Branch    string    `json:"branch"`
+	Version   string    `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Message   string    `json:"message"`
+	Hash      string    `json:"hash,omitempty"` // content after the change, empty for deletions
+	Size      int64     `json:"size"`
+	// Author of the version, when one was recorded
+	Author *core.VersionAuthor `json:"author,omitempty"`
+}
+
+// FileHistory lists the changes of one path, oldest first
+type FileHistory struct {
+	CodebaseID string             `json:"codebase_id"`
+	Path       string             `json:"path"`
+	Branch     string             `json:"branch,omitempty"` // empty when every branch was searched
+	Events     []FileHistoryEvent `json:"events"`
+}
+
+// GetFileHistory walks the versions of a codebase, or of one branch, in creation order and reports every
+// version where the content of path differs from the previous version of the same branch, including
+// versions where it disappeared. Each tree is loaded once.
+func (s *HistoryService) GetFileHistory(codebaseID, branch, path string) (*FileHistory, error) {
+	provider := core.GetProvider()
+	if _, err := getActiveCodebase(provider, codebaseID); err != nil {
+		return nil, err
+	}
+	if branch != "" {
+		branch = branchForLookup(provider, codebaseID, branch)
+	}
+	versions, err := provider.ListVersions(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+
+	var walk []*core.Version
+	for _, v := range versions {
+		if branch == "" || v.Branch == branch {
+			walk = append(walk, v)
+		}
+	}
+	sort.SliceStable(walk, func(i, j int) bool { return walk[i].CreatedAt.Before(walk[j].CreatedAt) })
+
+	history := &FileHistory{CodebaseID: codebaseID, Path: path, Branch: branch, Events: []FileHistoryEvent{}}
+	// Last known hash of the path per branch, "" when absent
+	last := make(map[string]string)
+	for _, v := range walk {
+		files, err := provider.GetFileIndexesByTreeID(v.TreeID)
+		if err != nil {
+			return nil, err
+		}
+		var current *core.File
+		for i := range files {
+			if files[i].Path == path && !files[i].IsDir() {
+				current = &files[i]
+				break
+			}
+		}
+
+		previous := last[v.Branch]
+		event := FileHistoryEvent{VersionID: v.ID, Branch: v.Branch, Version: v.Version, CreatedAt: v.CreatedAt, Message: v.Message, Author: v.Author}
+		switch {
+		case current == nil && previous != "":
+			event.Kind = FileDeleted
+			last[v.Branch] = ""
+		case current != nil && previous == "":
+			event.Kind = FileAdded
+		case current != nil && current.Hash != previous:
+			event.Kind = FileModified
+		default:
+			continue
+		}
+		if current != nil {
+			event.Hash = current.Hash
+			event.Size = current.Size
+			last[v.Branch] = current.Hash
+		}
+		history.Events = append(history.Events, event)
+	}
+	if len(history.Events) == 0 {
+		return nil, fmt.Errorf("file '%s' not found in any version", path)
+	}
+	return history, nil
+}
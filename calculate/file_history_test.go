@@ -0,0 +1,64 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"strings"
+	"testing"
+)
+
+func TestGetFileHistory(t *testing.T) {
+	provider, storage := useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "history")
+	steps := []struct {
+		branch, version string
+		contents        map[string]string
+	}{
+		{"main", "v1", map[string]string{"config.yaml": "port: 80", "other.txt": "1"}},
+		{"main", "v2", map[string]string{"config.yaml": "port: 80", "other.txt": "2"}},
+		{"main", "v3", map[string]string{"config.yaml": "port: 8080", "other.txt": "2"}},
+		{"dev", "d1", map[string]string{"config.yaml": "port: 9000"}},
+		{"main", "v4", map[string]string{"other.txt": "2"}},
+		{"main", "v5", map[string]string{"config.yaml": "port: 8080"}},
+	}
+	for _, step := range steps {
+		if _, err := NewUploadService().ProcessSnapshot(codebase.ID, step.version, step.branch, "change "+step.version,
+			snapshotFiles(step.contents), nil, true, SnapshotOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	counting := &treeCountingProvider{MemoryProvider: provider}
+	core.SetProvidersForTesting(counting, storage)
+
+	events := func(branch string) string {
+		t.Helper()
+		history, err := NewHistoryService().GetFileHistory(codebase.ID, branch, "config.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range history.Events {
+			if e.Message != "change "+e.Version || (e.Kind == FileDeleted) != (e.Hash == "") {
+				t.Errorf("event %+v doesn't carry the message and content of its version", e)
+			}
+			got = append(got, fmt.Sprintf("%s/%s:%s", e.Branch, e.Version, e.Kind))
+		}
+		return strings.Join(got, " ")
+	}
+
+	// Unchanged versions are left out, the deletion and the re-adding are events
+	if got, want := events("main"), "main/v1:added main/v3:modified main/v4:deleted main/v5:added"; got != want {
+		t.Errorf("history on main = %s, want %s", got, want)
+	}
+	if counting.treeReads != 5 {
+		t.Errorf("history of the 5 versions on main read %d file trees", counting.treeReads)
+	}
+	// Across branches each branch is compared with its own previous version
+	if got, want := events(""), "main/v1:added main/v3:modified dev/d1:added main/v4:deleted main/v5:added"; got != want {
+		t.Errorf("history on all branches = %s, want %s", got, want)
+	}
+
+	if _, err := NewHistoryService().GetFileHistory(codebase.ID, "", "missing.txt"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("history of a path no version has = %v, want not found", err)
+	}
+}
@@ -0,0 +1,85 @@
+package calculate
+
+import (
+	"fmt"
+	"log"
+	"main/core"
+	"strings"
+	"sync"
+)
+
+// objectWriters is held shared by every operation that writes objects and then persists the file
+// indexes referencing them, from the first object write until the indexes are saved. Garbage
+// collection holds it exclusively, so it never sees an object whose index isn't persisted yet,
+// nor one a running snapshot has just deduplicated against.
+var objectWriters sync.RWMutex
+
+// GCReport describes the objects found unreferenced by a garbage collection run
+type GCReport struct {
+	DryRun            bool     `json:"dry_run"`
+	ScannedObjects    int      `json:"scanned_objects"`
+	ReferencedObjects int      `json:"referenced_objects"`
+	Unreferenced      []string `json:"unreferenced"` // deleted, or only listed on a dry run
+	UnreferencedBytes int64    `json:"unreferenced_bytes"`
+	DeletedObjects    int      `json:"deleted_objects"`
+	// FailedSnapshotObjects counts the unreferenced objects that snapshots or files which failed since the
+	// service started had written
+	FailedSnapshotObjects int `json:"failed_snapshot_objects"`
+}
+
+// CollectGarbage deletes stored objects that no file index of any codebase, trashed ones included,
+// references. With dryRun the candidates are only reported. Snapshot uploads and bundle imports
+// wait while it runs.
+func (s *MaintenanceService) CollectGarbage(dryRun bool) (*GCReport, error) {
+	objectWriters.Lock()
+	defer objectWriters.Unlock()
+
+	provider := core.GetProvider()
+	storage := core.GetStore()
+
+	// Every file tree, trashed codebases included, holds a reference on its objects
+	referenced := make(map[string]bool)
+	err := provider.ListBlobRefs("", func(key string, _ int) error {
+		referenced[key] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &GCReport{DryRun: dryRun, Unreferenced: []string{}}
+	var candidates []core.ObjectInfo
+	err = storage.ListObjects("", func(obj core.ObjectInfo) error {
+		report.ScannedObjects++
+		switch {
+		case referenced[obj.Name]:
+			report.ReferencedObjects++
+		case strings.HasPrefix(obj.Name, storageProbePrefix):
+			// Canary of a storage probe in flight
+		default:
+			candidates = append(candidates, obj)
+			report.Unreferenced = append(report.Unreferenced, obj.Name)
+			report.UnreferencedBytes += obj.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("storage listing failed: %w", err)
+	}
+	report.FailedSnapshotObjects = countFailedSnapshotObjects(report.Unreferenced)
+	if dryRun {
+		return report, nil
+	}
+
+	cache := core.GetBlobCache()
+	for _, obj := range candidates {
+		if err := storage.DeleteObject(obj.Name); err != nil {
+			return report, fmt.Errorf("deleting %s failed after %d objects: %w", obj.Name, report.DeletedObjects, err)
+		}
+		cache.Remove(obj.Name)
+		forgetFailedSnapshotObject(obj.Name)
+		report.DeletedObjects++
+	}
+	log.Printf("event=gc_done scanned=%d referenced=%d deleted=%d bytes=%d failed_snapshot_objects=%d", report.ScannedObjects, report.ReferencedObjects, report.DeletedObjects, report.UnreferencedBytes, report.FailedSnapshotObjects)
+	return report, nil
+}
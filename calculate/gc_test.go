@@ -0,0 +1,136 @@
+package calculate
+
+import (
+	"io"
+	"main/core"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	_, storage := useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "gc")
+	v1 := mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"kept.txt": "in both versions", "old.txt": "only in v1"})
+	mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{"kept.txt": "in both versions"})
+	oldKey := fileKeys(t, v1.Version.ID)["old.txt"]
+	// A version deleted without its objects, as after a crash, and an object nothing ever referenced
+	if err := core.GetProvider().DeleteVersion(v1.Version.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.PutObject("gc/raw/stray", []byte("stray")); err != nil {
+		t.Fatal(err)
+	}
+	before := storedObjects(t, storage)
+
+	maintenance := NewMaintenanceService()
+	dry, err := maintenance.CollectGarbage(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dry.DryRun || dry.DeletedObjects != 0 || !reflect.DeepEqual(storedObjects(t, storage), before) {
+		t.Errorf("dry run = %+v, it must not delete anything", dry)
+	}
+	unreferenced := make(map[string]bool)
+	for _, key := range dry.Unreferenced {
+		unreferenced[key] = true
+	}
+	if !unreferenced[oldKey] || !unreferenced["gc/raw/stray"] || dry.ScannedObjects != len(before) ||
+		dry.ReferencedObjects+len(dry.Unreferenced) != dry.ScannedObjects || dry.UnreferencedBytes == 0 {
+		t.Errorf("dry run = %+v, want old.txt and the stray object among the candidates", dry)
+	}
+
+	report, err := maintenance.CollectGarbage(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DeletedObjects != len(dry.Unreferenced) || !reflect.DeepEqual(report.Unreferenced, dry.Unreferenced) {
+		t.Errorf("collection = %+v, want what the dry run listed %v deleted", report, dry.Unreferenced)
+	}
+	checkStored(t, storage, oldKey, false)
+	checkStored(t, storage, "gc/raw/stray", false)
+	if got := readStoredFile(t, storage, mustVersionID(t, codebase.ID, "v2"), "kept.txt"); got != "in both versions" {
+		t.Errorf("kept.txt of v2 = %q after the collection", got)
+	}
+	if again, err := maintenance.CollectGarbage(false); err != nil || again.DeletedObjects != 0 {
+		t.Errorf("second collection = %+v, %v, want nothing left to delete", again, err)
+	}
+}
+
+func mustVersionID(t *testing.T, codebaseID, version string) string {
+	t.Helper()
+	v, err := core.GetProvider().GetVersion(codebaseID, "main", version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v.ID
+}
+
+// blockingStorage signals the first object written and then holds the writer until released.
+type blockingStorage struct {
+	*core.MemoryStorage
+	wrote, release chan struct{}
+}
+
+func (s *blockingStorage) hold() {
+	select {
+	case s.wrote <- struct{}{}:
+		<-s.release
+	default:
+	}
+}
+
+func (s *blockingStorage) PutObject(name string, data []byte) error {
+	err := s.MemoryStorage.PutObject(name, data)
+	s.hold()
+	return err
+}
+
+func (s *blockingStorage) PutObjectStream(name string, r io.Reader, size int64) error {
+	err := s.MemoryStorage.PutObjectStream(name, r, size)
+	s.hold()
+	return err
+}
+
+// An object a running snapshot has written but not yet indexed is not collected.
+func TestCollectGarbageWaitsForSnapshots(t *testing.T) {
+	provider, memory := useMemoryBackends(t)
+	storage := &blockingStorage{MemoryStorage: memory, wrote: make(chan struct{}), release: make(chan struct{})}
+	core.SetProvidersForTesting(provider, storage)
+	codebase := mustInitCodebase(t, "gc")
+
+	// Long enough to compress, so the snapshot leaves no unreferenced object of its own
+	content := strings.Repeat("fresh content ", 100)
+	snapshotDone := make(chan error, 1)
+	go func() {
+		_, err := NewUploadService().ProcessSnapshot(codebase.ID, "v1", "main", "", snapshotFiles(map[string]string{"a.txt": content}), nil, true, SnapshotOptions{})
+		snapshotDone <- err
+	}()
+	<-storage.wrote
+
+	gcDone := make(chan *GCReport, 1)
+	go func() {
+		report, err := NewMaintenanceService().CollectGarbage(false)
+		if err != nil {
+			t.Error(err)
+		}
+		gcDone <- report
+	}()
+	select {
+	case report := <-gcDone:
+		t.Fatalf("collection ran during the snapshot: %+v", report)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(storage.release)
+	if err := <-snapshotDone; err != nil {
+		t.Fatal(err)
+	}
+	if report := <-gcDone; report == nil || report.DeletedObjects != 0 {
+		t.Errorf("collection after the snapshot = %+v, want nothing deleted", report)
+	}
+	if got := readStoredFile(t, memory, mustVersionID(t, codebase.ID, "v1"), "a.txt"); got != content {
+		t.Errorf("a.txt = %q after the collection", got)
+	}
+}
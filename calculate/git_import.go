@@ -0,0 +1,254 @@
+package calculate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"main/core"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A snapshot can be imported from a git repository to seed a codebase: the ref is fetched with depth 1
+// into a temporary directory, the .git directory is dropped and the tree is stored like a snapshot of a
+// server directory (see local_path.go). The commit is recorded in Version.Source and its message becomes
+// the version message unless the request has one. Credentials can only be given in the URL for now
+// (https://<token>@host/repo.git); they are neither stored nor logged. Since the server fetches whatever
+// URL a request names, imports are off unless git_import_enabled is set, and then only reach the hosts
+// listed in git_import_hosts, the way local_snapshot_roots limits the directories a snapshot reads.
+
+// gitImportTimeout bounds the clone of a repository
+const gitImportTimeout = 10 * time.Minute
+
+// gitURLSchemes are the transports a repository may be cloned over; file and ext would read or run
+// things on the server
+var gitURLSchemes = map[string]bool{"https": true, "http": true, "ssh": true, "git": true}
+
+// GitCommit is the commit a GitCloner checked out
+type GitCommit struct {
+	SHA     string
+	Message string
+}
+
+// GitCloner checks out the tree of ref in the repository at url into dir, an existing empty directory.
+// An empty ref means the remote HEAD.
+type GitCloner interface {
+	Clone(ctx context.Context, url, ref, dir string) (*GitCommit, error)
+}
+
+// GitImportError reports a repository that couldn't be cloned, with git's message without credentials
+type GitImportError struct {
+	URL    string `json:"url"`
+	Reason string `json:"reason"`
+}
+
+func (e *GitImportError) Error() string {
+	return fmt.Sprintf("git clone of %s failed: %s", e.URL, e.Reason)
+}
+
+// errEmptyRepository is returned by a GitCloner for a repository without commits
+var errEmptyRepository = errors.New("repository is empty")
+
+// GitImport names the repository and the ref of a snapshot imported from git
+type GitImport struct {
+	URL string
+	Ref string
+}
+
+// GitImportService creates snapshots from git repositories
+type GitImportService struct {
+	uploadService *UploadService
+	cloner        GitCloner
+}
+
+func NewGitImportService() *GitImportService {
+	return &GitImportService{
+		uploadService: NewUploadService(),
+		cloner:        execGitCloner{},
+	}
+}
+
+// checkGitImport validates the repository URL and ref of an import and returns the URL without credentials.
+func checkGitImport(src GitImport, opts SnapshotOptions) (string, error) {
+	u, err := url.Parse(src.URL)
+	switch {
+	case err == nil && u.Scheme != "" && !gitURLSchemes[u.Scheme]:
+		return "", fmt.Errorf("invalid snapshot: git URL scheme %q is not supported, use https, http, ssh or git", u.Scheme)
+	case err != nil || u.Scheme == "" || u.Host == "":
+		return "", fmt.Errorf("invalid snapshot: %q is not a git URL, use scheme://host/path", redactURL(src.URL))
+	}
+	if err := checkGitHost(core.GetConfig(), u); err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(src.Ref, "-") || strings.Contains(src.Ref, ":") || strings.IndexFunc(src.Ref, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return "", fmt.Errorf("invalid snapshot: %q is not a git ref", src.Ref)
+	}
+	if err := checkWholeTree("a git import", opts); err != nil {
+		return "", err
+	}
+	return redactURL(src.URL), nil
+}
+
+// checkGitHost refuses imports while cfg disables them and URLs whose host isn't listed in git_import_hosts.
+// Hosts compare without the port and case.
+func checkGitHost(cfg core.AppConfig, u *url.URL) error {
+	if !cfg.GitImportEnabled {
+		return fmt.Errorf("invalid snapshot: git imports are disabled on this server, see git_import_enabled")
+	}
+	for _, host := range cfg.GitImportHosts {
+		if strings.EqualFold(host, u.Hostname()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid snapshot: git host %s is not in the git_import_hosts of the server", u.Hostname())
+}
+
+// redactURL drops the user information, tokens included, from a URL.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		if at := strings.LastIndex(raw, "@"); at >= 0 {
+			return "***" + raw[at:]
+		}
+		return raw
+	}
+	u.User = nil
+	return u.String()
+}
+
+// Import clones the repository and creates a snapshot of the commit with ProcessSnapshot. The clone is
+// removed whatever the outcome.
+func (s *GitImportService) Import(codebaseID string, src GitImport, ver, branch, message string, branchFrom *BranchFrom, autoLinkage bool, opts SnapshotOptions) (*core.SnapshotResponse, error) {
+	codebase, err := getActiveCodebase(core.GetProvider(), codebaseID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid codebase_id: %s, error: %w", codebaseID, err)
+	}
+	safeURL, err := checkGitImport(src, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "git-import-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create clone directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), gitImportTimeout)
+	defer cancel()
+	started := time.Now()
+	commit, err := s.cloner.Clone(ctx, src.URL, src.Ref, dir)
+	switch {
+	case errors.Is(err, errEmptyRepository):
+		return nil, fmt.Errorf("invalid snapshot: git repository %s is empty", safeURL)
+	case ctx.Err() == context.DeadlineExceeded:
+		return nil, &GitImportError{URL: safeURL, Reason: fmt.Sprintf("timed out after %s", gitImportTimeout)}
+	case err != nil:
+		return nil, &GitImportError{URL: safeURL, Reason: redactSecrets(err.Error(), src.URL)}
+	}
+	log.Printf("Cloned %s at %s (commit %s) in %s", safeURL, refOrHead(src.Ref), commit.SHA, time.Since(started).Round(time.Millisecond))
+
+	if err := os.RemoveAll(filepath.Join(dir, ".git")); err != nil {
+		return nil, fmt.Errorf("failed to remove .git from the clone: %w", err)
+	}
+	files, skipped, err := readTree(dir, fmt.Sprintf("commit %s of %s", commit.SHA, safeURL), codebase, &opts)
+	if err != nil {
+		return nil, err
+	}
+	opts.source = &core.VersionSource{Type: "git", URL: safeURL, Ref: refOrHead(src.Ref), Commit: commit.SHA, Message: commit.Message}
+	if message == "" {
+		message = commit.Message
+	}
+
+	resp, err := s.uploadService.ProcessSnapshot(codebaseID, ver, branch, message, files, branchFrom, autoLinkage, opts)
+	if err != nil {
+		return nil, err
+	}
+	resp.SkippedPaths = skipped
+	return resp, nil
+}
+
+func refOrHead(ref string) string {
+	if ref == "" {
+		return "HEAD"
+	}
+	return ref
+}
+
+// redactSecrets removes the credentials of rawURL from a message of git.
+func redactSecrets(msg, rawURL string) string {
+	msg = strings.ReplaceAll(msg, rawURL, redactURL(rawURL))
+	if u, err := url.Parse(rawURL); err == nil && u.User != nil {
+		if password, ok := u.User.Password(); ok && password != "" {
+			msg = strings.ReplaceAll(msg, password, "***")
+		}
+		// Over http a token usually takes the place of the user name; ssh user names such as "git" aren't secret
+		if name := u.User.Username(); name != "" && strings.HasPrefix(u.Scheme, "http") {
+			msg = strings.ReplaceAll(msg, name, "***")
+		}
+	}
+	return msg
+}
+
+// execGitCloner runs the git command line, which has to be installed on the server
+type execGitCloner struct{}
+
+func (execGitCloner) Clone(ctx context.Context, repoURL, ref, dir string) (*GitCommit, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("git is not installed on the server")
+	}
+	// ls-remote tells an empty repository from a missing ref, which fetch reports alike
+	refs, err := runGit(ctx, "", "ls-remote", repoURL)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(refs) == "" {
+		return nil, errEmptyRepository
+	}
+	if _, err := runGit(ctx, "", "init", "--quiet", dir); err != nil {
+		return nil, err
+	}
+	if _, err := runGit(ctx, dir, "fetch", "--quiet", "--depth", "1", "--no-tags", repoURL, refOrHead(ref)); err != nil {
+		return nil, err
+	}
+	if _, err := runGit(ctx, dir, "checkout", "--quiet", "--detach", "FETCH_HEAD"); err != nil {
+		return nil, err
+	}
+	out, err := runGit(ctx, dir, "log", "-1", "--format=%H%n%B")
+	if err != nil {
+		return nil, err
+	}
+	sha, message, _ := strings.Cut(out, "\n")
+	return &GitCommit{SHA: strings.TrimSpace(sha), Message: strings.TrimSpace(message)}, nil
+}
+
+// runGit runs a git command in dir without prompting for credentials and returns its output, or its
+// error output as the error.
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	// A redirect would lead past the host check
+	args = append([]string{"-c", "http.followRedirects=false"}, args...)
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if os.Getenv("GIT_SSH_COMMAND") == "" {
+		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND=ssh -o BatchMode=yes")
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", errors.New(msg)
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
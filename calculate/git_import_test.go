@@ -0,0 +1,44 @@
+package calculate
+
+import (
+	"main/core"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCheckGitHost(t *testing.T) {
+	allowed := core.AppConfig{GitImportEnabled: true, GitImportHosts: []string{"github.com", "Git.Internal"}}
+	tests := []struct {
+		name    string
+		cfg     core.AppConfig
+		url     string
+		wantErr string
+	}{
+		{"disabled by default", core.AppConfig{GitImportHosts: []string{"github.com"}}, "https://github.com/a/b.git", "disabled"},
+		{"enabled without hosts", core.AppConfig{GitImportEnabled: true}, "https://github.com/a/b.git", "not in the git_import_hosts"},
+		{"listed host", allowed, "https://github.com/a/b.git", ""},
+		{"port and case are ignored", allowed, "ssh://git@GIT.internal:2222/a/b.git", ""},
+		{"token in the URL", allowed, "https://token@github.com/a/b.git", ""},
+		{"other host", allowed, "https://gitlab.com/a/b.git", "not in the git_import_hosts"},
+		{"suffix of a listed host", allowed, "https://evilgithub.com/a/b.git", "not in the git_import_hosts"},
+		{"subdomain of a listed host", allowed, "https://api.github.com/a/b.git", "not in the git_import_hosts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = checkGitHost(tt.cfg, u)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("checkGitHost(%s) = %v, want nil", tt.url, err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("checkGitHost(%s) = %v, want an error containing %q", tt.url, err, tt.wantErr)
+			case err != nil && !strings.HasPrefix(err.Error(), "invalid snapshot"):
+				t.Errorf("checkGitHost(%s) = %v, want a request error", tt.url, err)
+			}
+		})
+	}
+}
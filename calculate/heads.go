@@ -0,0 +1,102 @@
+package calculate
+
+import (
+	"fmt"
+	"log"
+	"main/core"
+	"sort"
+	"strings"
+)
+
+// SnapshotWarningSplitHeads is reported when a branch has more than one head after a snapshot
+const SnapshotWarningSplitHeads = "split_heads"
+
+// BranchHeadSplit is a branch whose history has more than one head
+type BranchHeadSplit struct {
+	CodebaseID string            `json:"codebase_id"`
+	Branch     string            `json:"branch"`
+	Heads      []core.BranchHead `json:"heads"`
+}
+
+// branchHeads returns the versions of each branch that have no lineage child on the same branch.
+// Only edges are considered, so versions uploaded without linkage show up as separate heads.
+func branchHeads(provider core.DataProvider, codebaseID string) (map[string][]core.BranchHead, error) {
+	versions, err := provider.ListVersions(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	edges, err := provider.GetAllVersionEdgesForMap(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	branchOf := make(map[string]string, len(versions))
+	for _, v := range versions {
+		branchOf[v.ID] = v.Branch
+	}
+	continued := make(map[string]bool)
+	for _, e := range edges {
+		if branch, ok := branchOf[e.From]; ok && branchOf[e.To] == branch {
+			continued[e.From] = true
+		}
+	}
+
+	heads := make(map[string][]core.BranchHead)
+	for _, v := range versions {
+		if !continued[v.ID] {
+			heads[v.Branch] = append(heads[v.Branch], core.BranchHead{VersionID: v.ID, Version: v.Version, CreatedAt: v.CreatedAt})
+		}
+	}
+	for _, list := range heads {
+		sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	}
+	return heads, nil
+}
+
+// splitHeadWarning checks one branch after a snapshot and returns a warning when it has more than one head.
+func splitHeadWarning(provider core.DataProvider, codebaseID, branch string) *core.SnapshotWarning {
+	heads, err := branchHeads(provider, codebaseID)
+	if err != nil {
+		log.Printf("Failed to check branch heads (codebase: %s, branch: %s): %v", codebaseID, branch, err)
+		return nil
+	}
+	candidates := heads[branch]
+	if len(candidates) < 2 {
+		return nil
+	}
+
+	labels := make([]string, len(candidates))
+	ids := make([]string, len(candidates))
+	for i, h := range candidates {
+		labels[i] = h.Version
+		ids[i] = h.VersionID
+	}
+	log.Printf("event=branch_heads_split codebase_id=%s branch=%q heads=%d versions=%q version_ids=%s",
+		codebaseID, branch, len(candidates), strings.Join(labels, ","), strings.Join(ids, ","))
+	return &core.SnapshotWarning{
+		Kind:    SnapshotWarningSplitHeads,
+		Message: fmt.Sprintf("branch %s has %d heads (%s); link them to restore a linear history", branch, len(candidates), strings.Join(labels, ", ")),
+		Branch:  branch,
+		Heads:   candidates,
+	}
+}
+
+// CheckHeads reports every branch of a codebase that has more than one head.
+func (s *BranchService) CheckHeads(codebaseID string) ([]BranchHeadSplit, error) {
+	provider := core.GetProvider()
+	if _, err := getActiveCodebase(provider, codebaseID); err != nil {
+		return nil, err
+	}
+	heads, err := branchHeads(provider, codebaseID)
+	if err != nil {
+		return nil, err
+	}
+
+	splits := []BranchHeadSplit{}
+	for branch, candidates := range heads {
+		if len(candidates) > 1 {
+			splits = append(splits, BranchHeadSplit{CodebaseID: codebaseID, Branch: branch, Heads: candidates})
+		}
+	}
+	sort.Slice(splits, func(i, j int) bool { return splits[i].Branch < splits[j].Branch })
+	return splits, nil
+}
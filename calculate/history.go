@@ -3,6 +3,7 @@ package calculate
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"main/core"
 )
 
@@ -12,6 +13,11 @@ type VersionIdentifier struct {
 	Version string
 }
 
+// historyCacheFormat is stored in every history cache; raise it when the nodes or the map gain a field,
+// so caches written before are rebuilt on first access. 2 added the version author, 3 the tag, lock and
+// pin annotations.
+const historyCacheFormat = 3
+
 type HistoryService struct{}
 
 func NewHistoryService() *HistoryService {
@@ -22,12 +28,16 @@ func NewHistoryService() *HistoryService {
 // Returns raw JSON bytes that can be used directly for API response.
 func (s *HistoryService) GetVersionMap(codebaseID string) ([]byte, error) {
 	provider := core.GetProvider()
+	if pinned := getPinnedHistory(provider, codebaseID); pinned != nil {
+		return pinned, nil
+	}
+
 	historyJSON, err := provider.GetHistoryCache(codebaseID)
-	if err == nil {
+	if err == nil && currentHistoryCache(historyJSON) {
 		return historyJSON, nil
 	}
 
-	// Cache miss or error, need to rebuild
+	// Cache miss, error, unparseable cache or one of an older format, need to rebuild
 	_, err = s.RebuildHistoryCache(codebaseID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build history cache: %w", err)
@@ -42,6 +52,14 @@ func (s *HistoryService) GetVersionMap(codebaseID string) ([]byte, error) {
 	return historyJSON, nil
 }
 
+// currentHistoryCache reports whether a stored cache parses and was written in the current format.
+func currentHistoryCache(historyJSON []byte) bool {
+	var header struct {
+		CacheFormat int `json:"cache_format"`
+	}
+	return json.Unmarshal(historyJSON, &header) == nil && header.CacheFormat >= historyCacheFormat
+}
+
 // CreateVersionLink creates parent-child link between two versions.
 func (s *HistoryService) CreateVersionLink(codebaseID string, child, parent VersionIdentifier) error {
 	return s.CreateVersionLinkWithType(codebaseID, child, parent, core.LinkageTypeSequential)
@@ -49,13 +67,16 @@ func (s *HistoryService) CreateVersionLink(codebaseID string, child, parent Vers
 
 // CreateVersionLinkWithType creates version link of specified type
 func (s *HistoryService) CreateVersionLinkWithType(codebaseID string, child, parent VersionIdentifier, linkageType core.LinkageType) error {
+	if err := validateLinkEnds(child, parent); err != nil {
+		return err
+	}
 	provider := core.GetProvider()
-	childVersion, err := provider.GetVersion(codebaseID, child.Branch, child.Version)
+	childVersion, err := lookupVersion(provider, codebaseID, child.Branch, child.Version)
 	if err != nil {
 		return fmt.Errorf("child version '%s' (branch: %s) not found: %w", child.Version, child.Branch, err)
 	}
 
-	parentVersion, err := provider.GetVersion(codebaseID, parent.Branch, parent.Version)
+	parentVersion, err := lookupVersion(provider, codebaseID, parent.Branch, parent.Version)
 	if err != nil {
 		return fmt.Errorf("parent version '%s' (branch: %s) not found: %w", parent.Version, parent.Branch, err)
 	}
@@ -65,89 +86,166 @@ func (s *HistoryService) CreateVersionLinkWithType(codebaseID string, child, par
 		return fmt.Errorf("version link insertion failed: %w", err)
 	}
 
-	// After success, asynchronously rebuild cache
-	go s.RebuildHistoryCache(codebaseID)
+	// After success, asynchronously rebuild cache through the background scheduler
+	BackgroundJobs().Submit("rebuild-history-cache "+codebaseID, func(throttle *IOThrottle) error {
+		_, err := s.rebuildHistoryCache(codebaseID, throttle)
+		return err
+	})
+	notifyLinkCreated(codebaseID, childVersion, parentVersion)
 
 	return nil
 }
 
+// notifyLinkCreated tells webhook subscribers about a new parent-child link
+func notifyLinkCreated(codebaseID string, child, parent *core.Version) {
+	notifyWebhooks(WebhookEvent{
+		Event:      WebhookEventVersionLinkCreated,
+		CodebaseID: codebaseID,
+		Branch:     child.Branch,
+		Version:    child.Version,
+		VersionID:  child.ID,
+		Parent:     &WebhookVersion{Branch: parent.Branch, Version: parent.Version, VersionID: parent.ID},
+	})
+}
+
+// DeleteVersionLink removes the parent-child link between two versions. The history cache is rebuilt
+// synchronously so the next map request no longer shows the edge.
+func (s *HistoryService) DeleteVersionLink(codebaseID string, child, parent VersionIdentifier) error {
+	if err := validateLinkEnds(child, parent); err != nil {
+		return err
+	}
+	provider := core.GetProvider()
+	if _, err := getActiveCodebase(provider, codebaseID); err != nil {
+		return err
+	}
+	childVersion, err := lookupVersion(provider, codebaseID, child.Branch, child.Version)
+	if err != nil {
+		return fmt.Errorf("child version '%s' (branch: %s) not found: %w", child.Version, child.Branch, err)
+	}
+	parentVersion, err := lookupVersion(provider, codebaseID, parent.Branch, parent.Version)
+	if err != nil {
+		return fmt.Errorf("parent version '%s' (branch: %s) not found: %w", parent.Version, parent.Branch, err)
+	}
+
+	if err := provider.DeleteVersionLink(childVersion.ID, parentVersion.ID); err != nil {
+		return err
+	}
+	log.Printf("Version link removed: codebase=%s, parent=%s/%s, child=%s/%s", codebaseID, parent.Branch, parent.Version, child.Branch, child.Version)
+
+	if _, err := s.RebuildHistoryCache(codebaseID); err != nil {
+		return fmt.Errorf("version link removed but history cache rebuild failed: %w", err)
+	}
+	return nil
+}
+
 // AutoCreateSequentialLink automatically creates time-series lineage relationships for the same branch
-func (s *HistoryService) AutoCreateSequentialLink(codebaseID, branch, currentVersionID string) error {
+func (s *HistoryService) AutoCreateSequentialLink(codebaseID, branch, currentVersionID string) (*core.LinkageDecision, error) {
 	provider := core.GetProvider()
 	// Find the latest version in the same branch (excluding current version)
 	parentVersion, err := provider.FindLatestVersionInBranch(codebaseID, branch, currentVersionID)
 	if err != nil {
-		return fmt.Errorf("failed to find parent version: %w", err)
+		return nil, fmt.Errorf("failed to find parent version: %w", err)
 	}
 	if parentVersion == nil {
 		// This is the first version in this branch, no need to establish lineage relationship
-		return nil
+		return nil, nil
 	}
 
 	// Create lineage relationship
 	err = provider.CreateVersionLink(codebaseID, currentVersionID, parentVersion.ID, branch, core.LinkageTypeSequential)
 	if err != nil {
-		return fmt.Errorf("failed to create sequential lineage relationship: %w", err)
+		return nil, fmt.Errorf("failed to create sequential lineage relationship: %w", err)
 	}
 
-	return nil
+	return newLinkageDecision(parentVersion, core.LinkageTypeSequential, "previous version on the same branch"), nil
 }
 
 // AutoCreateBranchFromLink automatically creates lineage relationship for cross-branch
-func (s *HistoryService) AutoCreateBranchFromLink(codebaseID, newVersionID, childBranch string, branchFrom VersionIdentifier) error {
+func (s *HistoryService) AutoCreateBranchFromLink(codebaseID, newVersionID, childBranch string, branchFrom VersionIdentifier) (*core.LinkageDecision, error) {
 	provider := core.GetProvider()
 	// Find source version ID
 	parentVersion, err := provider.GetVersion(codebaseID, branchFrom.Branch, branchFrom.Version)
 	if err != nil {
-		return fmt.Errorf("source version %s/%s not found: %w", branchFrom.Branch, branchFrom.Version, err)
+		return nil, fmt.Errorf("source version %s/%s not found: %w", branchFrom.Branch, branchFrom.Version, err)
 	}
 
 	// Create lineage relationship
 	err = provider.CreateVersionLink(codebaseID, newVersionID, parentVersion.ID, childBranch, core.LinkageTypeBranchFrom)
 	if err != nil {
-		return fmt.Errorf("failed to create branch lineage relationship: %w", err)
+		return nil, fmt.Errorf("failed to create branch lineage relationship: %w", err)
 	}
 
-	return nil
+	return newLinkageDecision(parentVersion, core.LinkageTypeBranchFrom, "explicit branch_from"), nil
 }
 
 // RebuildHistoryCache rebuilds complete history graph for specified codebase and stores in cache.
 // It now returns the built graph so callers can use it directly.
 func (s *HistoryService) RebuildHistoryCache(codebaseID string) (*core.VersionMapResponse, error) {
-	provider := core.GetProvider()
+	return s.rebuildHistoryCache(codebaseID, nil)
+}
+
+// rebuildHistoryCache rebuilds the cache, accounting the cache write against throttle when running as a background job.
+func (s *HistoryService) rebuildHistoryCache(codebaseID string, throttle *IOThrottle) (*core.VersionMapResponse, error) {
+	historyMap, historyJSON, err := storeHistoryCache(core.GetProvider(), codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	// The write is accounted after the changelog lock is released, a background rebuild waiting for
+	// its IO budget must not hold up the rebuilds of foreground requests
+	throttle.Wait(int64(len(historyJSON)))
+	return historyMap, nil
+}
+
+// storeHistoryCache builds the history graph of a codebase, numbers its generation and stores it,
+// returning the graph and the cached JSON.
+func storeHistoryCache(provider core.DataProvider, codebaseID string) (*core.VersionMapResponse, []byte, error) {
+	// Concurrent rebuilds are serialized from the queries to the cache write, so a rebuild that read
+	// the graph earlier can't overwrite the cache of a later one, and generation numbering can't interleave
+	mapChangelog.Lock()
+	defer mapChangelog.Unlock()
+
 	nodes, err := provider.GetAllVersionsForMap(codebaseID)
 	if err != nil {
-		return nil, fmt.Errorf("node query failed: %w", err)
+		return nil, nil, fmt.Errorf("node query failed: %w", err)
 	}
 
 	edges, err := provider.GetAllVersionEdgesForMap(codebaseID)
 	if err != nil {
-		return nil, fmt.Errorf("edge query failed: %w", err)
+		return nil, nil, fmt.Errorf("edge query failed: %w", err)
 	}
 
 	refs, err := provider.GetBranchHeadsForMap(codebaseID)
 	if err != nil {
-		return nil, fmt.Errorf("reference query failed: %w", err)
+		return nil, nil, fmt.Errorf("reference query failed: %w", err)
+	}
+
+	codebase, err := provider.GetCodebaseByID(codebaseID)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// Assemble response and serialize
-	historyMap := core.VersionMapResponse{
-		CodebaseID: codebaseID,
-		Nodes:      nodes,
-		Edges:      edges,
-		Refs:       refs,
+	historyMap := &core.VersionMapResponse{
+		CodebaseID:    codebaseID,
+		DefaultBranch: defaultBranchOf(codebase),
+		Nodes:         nodes,
+		Edges:         edges,
+		Refs:          refs,
+		CacheFormat:   historyCacheFormat,
 	}
+	assignGeneration(provider, historyMap)
+
 	historyJSON, err := json.Marshal(historyMap)
 	if err != nil {
-		return nil, fmt.Errorf("history graph serialization failed: %w", err)
+		return nil, nil, fmt.Errorf("history graph serialization failed: %w", err)
 	}
 
 	// Use UPSERT to update cache
 	if err := provider.UpdateHistoryCache(codebaseID, historyJSON); err != nil {
-		return nil, fmt.Errorf("cache update failed: %w", err)
+		return nil, nil, fmt.Errorf("cache update failed: %w", err)
 	}
-
-	return &historyMap, nil
+	storePinnedHistory(provider, codebaseID, historyJSON)
+	return historyMap, historyJSON, nil
 }
 
 // isNewBranch checks if a branch is completely new (no other versions except the current one being created)
@@ -156,25 +254,67 @@ func (s *HistoryService) isNewBranch(codebaseID, branch, currentVersionID string
 	return provider.IsNewBranch(codebaseID, branch, currentVersionID)
 }
 
-// AutoCreateLinkForNewBranch automatically creates link for a completely new branch, usually linking from the latest version of main branch
-func (s *HistoryService) AutoCreateLinkForNewBranch(codebaseID, newVersionID, childBranch string) error {
+// AutoCreateLinkForNewBranch automatically creates link for a completely new branch.
+// Branches created explicitly through a branch ref are linked to the ref's source version, and the ref is consumed.
+// With inferSource the branch is linked to the head of the other branch whose content is closest to the new
+// version; otherwise (or when nothing is shared) it is linked to the latest version of the codebase's default branch.
+func (s *HistoryService) AutoCreateLinkForNewBranch(codebaseID, newVersionID, childBranch string, inferSource bool) (*core.LinkageDecision, error) {
 	provider := core.GetProvider()
-	// Find the latest version of main branch as parent version
-	parentVersion, err := provider.FindLatestVersionInMain(codebaseID)
+	ref, err := provider.GetBranchRef(codebaseID, childBranch)
 	if err != nil {
-		return fmt.Errorf("failed to find parent version in main branch: %w", err)
+		return nil, fmt.Errorf("failed to look up branch ref: %w", err)
+	}
+	if ref != nil {
+		parentVersion, err := provider.GetVersionByID(ref.VersionID)
+		if err != nil {
+			return nil, fmt.Errorf("branch ref source version not found: %w", err)
+		}
+		err = provider.CreateVersionLink(codebaseID, newVersionID, ref.VersionID, childBranch, core.LinkageTypeBranchFrom)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create 'branch_from' link from branch ref: %w", err)
+		}
+		// The branch now has its own head, the explicit ref is no longer needed
+		if err := provider.DeleteBranchRef(codebaseID, childBranch); err != nil {
+			return nil, err
+		}
+		return newLinkageDecision(parentVersion, core.LinkageTypeBranchFrom, "source of the explicitly created branch"), nil
+	}
+
+	var (
+		parentVersion *core.Version
+		reason        string
+	)
+	if inferSource {
+		parentVersion, reason, err = s.closestBranchHead(provider, codebaseID, newVersionID, childBranch)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if parentVersion == nil {
+		codebase, err := provider.GetCodebaseByID(codebaseID)
+		if err != nil {
+			return nil, err
+		}
+		defaultBranch := defaultBranchOf(codebase)
+		// Find the latest version of the default branch as parent version
+		parentVersion, err = provider.FindLatestVersionInBranch(codebaseID, defaultBranch, newVersionID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find parent version in default branch: %w", err)
+		}
+		reason = fmt.Sprintf("latest version of the default branch %q", defaultBranch)
 	}
 
 	if parentVersion == nil {
-		// If main branch doesn't exist (or has no versions), this is the first version of an orphan branch, no linking needed
-		return nil
+		// If the default branch has no versions, this is the first version of an orphan branch, no linking needed
+		return nil, nil
 	}
 
 	// Create 'branch_from' type lineage relationship
 	err = provider.CreateVersionLink(codebaseID, newVersionID, parentVersion.ID, childBranch, core.LinkageTypeBranchFrom)
 	if err != nil {
-		return fmt.Errorf("failed to create 'branch_from' link for new branch: %w", err)
+		return nil, fmt.Errorf("failed to create 'branch_from' link for new branch: %w", err)
 	}
 
-	return nil
+	return newLinkageDecision(parentVersion, core.LinkageTypeBranchFrom, reason), nil
 }
@@ -0,0 +1,220 @@
+package calculate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"main/core"
+	"sync"
+)
+
+// maxMapChangelogEntries bounds the number of recent mutations remembered per codebase
+const maxMapChangelogEntries = 64
+
+// mapChange records how the version map changed when a generation was built
+type mapChange struct {
+	Generation   int64
+	AddedNodes   []core.VersionNode
+	UpdatedNodes []core.VersionNode
+	RemovedNodes []string
+	AddedEdges   []core.VersionEdge
+	RemovedEdges []core.VersionEdge
+}
+
+// mapChangelog is shared by all HistoryService instances. It lives in memory only:
+// after a restart clients are told to do a full refresh until new generations accumulate.
+var mapChangelog = struct {
+	sync.Mutex
+	entries map[string][]mapChange // codebase_id -> changes ordered by generation
+}{entries: make(map[string][]mapChange)}
+
+type edgeKey struct {
+	From, To string
+	Type     core.LinkageType
+}
+
+func keyOfEdge(e core.VersionEdge) edgeKey {
+	return edgeKey{From: e.From, To: e.To, Type: e.LinkageType}
+}
+
+// assignGeneration compares the new map with the previously cached one, sets the next generation
+// number on it and records the difference in the changelog. Callers must hold mapChangelog's lock.
+func assignGeneration(provider core.DataProvider, historyMap *core.VersionMapResponse) {
+	var previous core.VersionMapResponse
+	cached, err := provider.GetHistoryCache(historyMap.CodebaseID)
+	if err != nil || json.Unmarshal(cached, &previous) != nil {
+		// Cache rebuilt from scratch, earlier deltas can no longer be composed
+		historyMap.Generation = 1
+		delete(mapChangelog.entries, historyMap.CodebaseID)
+		return
+	}
+	historyMap.Generation = previous.Generation + 1
+
+	change := mapChange{Generation: historyMap.Generation}
+	oldNodes := make(map[string][]byte, len(previous.Nodes))
+	for _, n := range previous.Nodes {
+		oldNodes[n.ID], _ = json.Marshal(n)
+	}
+	for _, n := range historyMap.Nodes {
+		old, existed := oldNodes[n.ID]
+		delete(oldNodes, n.ID)
+		if !existed {
+			change.AddedNodes = append(change.AddedNodes, n)
+			continue
+		}
+		if current, _ := json.Marshal(n); !bytes.Equal(old, current) {
+			change.UpdatedNodes = append(change.UpdatedNodes, n)
+		}
+	}
+	for id := range oldNodes {
+		change.RemovedNodes = append(change.RemovedNodes, id)
+	}
+
+	oldEdges := make(map[edgeKey]bool, len(previous.Edges))
+	for _, e := range previous.Edges {
+		oldEdges[keyOfEdge(e)] = true
+	}
+	for _, e := range historyMap.Edges {
+		if oldEdges[keyOfEdge(e)] {
+			delete(oldEdges, keyOfEdge(e))
+			continue
+		}
+		change.AddedEdges = append(change.AddedEdges, e)
+	}
+	for k := range oldEdges {
+		change.RemovedEdges = append(change.RemovedEdges, core.VersionEdge{From: k.From, To: k.To, LinkageType: k.Type})
+	}
+
+	entries := append(mapChangelog.entries[historyMap.CodebaseID], change)
+	if len(entries) > maxMapChangelogEntries {
+		entries = entries[len(entries)-maxMapChangelogEntries:]
+	}
+	mapChangelog.entries[historyMap.CodebaseID] = entries
+}
+
+// GetVersionMapChanges returns the nodes and edges added or removed since the given generation.
+// When the delta can't be computed, FullRefresh is set and the client should fetch the full map.
+func (s *HistoryService) GetVersionMapChanges(codebaseID string, sinceGeneration int64) (*core.VersionMapChanges, error) {
+	historyJSON, err := s.GetVersionMap(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	var current core.VersionMapResponse
+	if err := json.Unmarshal(historyJSON, &current); err != nil {
+		return nil, fmt.Errorf("failed to parse version map: %w", err)
+	}
+
+	result := &core.VersionMapChanges{
+		CodebaseID:     codebaseID,
+		DefaultBranch:  current.DefaultBranch,
+		Generation:     current.Generation,
+		AddedNodes:     []core.VersionNode{},
+		UpdatedNodes:   []core.VersionNode{},
+		RemovedNodeIDs: []string{},
+		AddedEdges:     []core.VersionEdge{},
+		RemovedEdges:   []core.VersionEdge{},
+		Refs:           current.Refs,
+	}
+	if sinceGeneration == current.Generation {
+		return result, nil
+	}
+	if sinceGeneration <= 0 || sinceGeneration > current.Generation {
+		result.FullRefresh = true
+		return result, nil
+	}
+
+	mapChangelog.Lock()
+	var window []mapChange
+	for _, change := range mapChangelog.entries[codebaseID] {
+		if change.Generation > sinceGeneration && change.Generation <= current.Generation {
+			window = append(window, change)
+		}
+	}
+	mapChangelog.Unlock()
+
+	// The window must cover every generation after the client's one
+	if int64(len(window)) != current.Generation-sinceGeneration || window[0].Generation != sinceGeneration+1 {
+		result.FullRefresh = true
+		return result, nil
+	}
+
+	composeMapChanges(result, window)
+	return result, nil
+}
+
+// composeMapChanges folds consecutive changes into one net delta. An element first seen as
+// added within the window is new to the client; anything else already existed on its side.
+func composeMapChanges(result *core.VersionMapChanges, window []mapChange) {
+	type nodeState struct {
+		firstAdded bool
+		node       *core.VersionNode
+	}
+	nodes := make(map[string]*nodeState)
+	var nodeOrder []string
+	touchNode := func(id string, added bool) *nodeState {
+		st, ok := nodes[id]
+		if !ok {
+			st = &nodeState{firstAdded: added}
+			nodes[id] = st
+			nodeOrder = append(nodeOrder, id)
+		}
+		return st
+	}
+
+	type edgeState struct {
+		firstAdded bool
+		present    bool
+		edge       core.VersionEdge
+	}
+	edges := make(map[edgeKey]*edgeState)
+	var edgeOrder []edgeKey
+	touchEdge := func(e core.VersionEdge, added bool) *edgeState {
+		k := keyOfEdge(e)
+		st, ok := edges[k]
+		if !ok {
+			st = &edgeState{firstAdded: added, edge: e}
+			edges[k] = st
+			edgeOrder = append(edgeOrder, k)
+		}
+		return st
+	}
+
+	for _, change := range window {
+		for i := range change.AddedNodes {
+			touchNode(change.AddedNodes[i].ID, true).node = &change.AddedNodes[i]
+		}
+		for i := range change.UpdatedNodes {
+			touchNode(change.UpdatedNodes[i].ID, false).node = &change.UpdatedNodes[i]
+		}
+		for _, id := range change.RemovedNodes {
+			touchNode(id, false).node = nil
+		}
+		for _, e := range change.AddedEdges {
+			touchEdge(e, true).present = true
+		}
+		for _, e := range change.RemovedEdges {
+			touchEdge(e, false).present = false
+		}
+	}
+
+	for _, id := range nodeOrder {
+		st := nodes[id]
+		switch {
+		case st.node != nil && st.firstAdded:
+			result.AddedNodes = append(result.AddedNodes, *st.node)
+		case st.node != nil:
+			result.UpdatedNodes = append(result.UpdatedNodes, *st.node)
+		case !st.firstAdded:
+			result.RemovedNodeIDs = append(result.RemovedNodeIDs, id)
+		}
+	}
+	for _, k := range edgeOrder {
+		st := edges[k]
+		switch {
+		case st.present && st.firstAdded:
+			result.AddedEdges = append(result.AddedEdges, st.edge)
+		case !st.present && !st.firstAdded:
+			result.RemovedEdges = append(result.RemovedEdges, st.edge)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package calculate
+
+import (
+	"encoding/json"
+	"main/core"
+	"reflect"
+	"testing"
+)
+
+// mapState is a version map reduced to what a client keeps of it, for comparing maps
+type mapState struct {
+	nodes map[string]string // id -> node JSON
+	edges map[edgeKey]bool
+	refs  map[string]string
+}
+
+func stateOf(t *testing.T, historyMap *core.VersionMapResponse) mapState {
+	t.Helper()
+	state := mapState{nodes: make(map[string]string), edges: make(map[edgeKey]bool), refs: historyMap.Refs}
+	for _, n := range historyMap.Nodes {
+		data, err := json.Marshal(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state.nodes[n.ID] = string(data)
+	}
+	for _, e := range historyMap.Edges {
+		state.edges[keyOfEdge(e)] = true
+	}
+	return state
+}
+
+// apply updates the state the way a client applies a delta.
+func (s mapState) apply(t *testing.T, changes *core.VersionMapChanges) mapState {
+	t.Helper()
+	next := mapState{nodes: make(map[string]string), edges: make(map[edgeKey]bool), refs: changes.Refs}
+	for id, n := range s.nodes {
+		next.nodes[id] = n
+	}
+	for k := range s.edges {
+		next.edges[k] = true
+	}
+	for _, id := range changes.RemovedNodeIDs {
+		if _, ok := next.nodes[id]; !ok {
+			t.Errorf("delta removes node %s the client doesn't have", id)
+		}
+		delete(next.nodes, id)
+	}
+	for _, nodes := range [][]core.VersionNode{changes.AddedNodes, changes.UpdatedNodes} {
+		for _, n := range nodes {
+			data, _ := json.Marshal(n)
+			next.nodes[n.ID] = string(data)
+		}
+	}
+	for _, e := range changes.RemovedEdges {
+		delete(next.edges, keyOfEdge(e))
+	}
+	for _, e := range changes.AddedEdges {
+		next.edges[keyOfEdge(e)] = true
+	}
+	return next
+}
+
+// Applying the delta since any earlier generation to the map of that generation gives the current map.
+func TestVersionMapChangesCompose(t *testing.T) {
+	provider, _ := useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "map-changes")
+	history := NewHistoryService()
+	truth := true
+
+	steps := []func(){
+		func() { mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"a.txt": "1"}) },
+		func() { mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{"a.txt": "2"}) },
+		func() {
+			_, err := NewUploadService().ProcessSnapshot(codebase.ID, "f1", "feature", "", snapshotFiles(map[string]string{"a.txt": "f"}),
+				&BranchFrom{Branch: "main", Version: "v1"}, true, SnapshotOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+		},
+		func() {
+			// Locking changes a node without adding or removing one
+			if _, err := history.SetVersionFlags(codebase.ID, VersionSelector{Branch: "main", Version: "v1"}, VersionFlags{Locked: &truth}); err != nil {
+				t.Fatal(err)
+			}
+		},
+		func() {
+			if err := history.DeleteVersionLink(codebase.ID, VersionIdentifier{Branch: "main", Version: "v2"}, VersionIdentifier{Branch: "main", Version: "v1"}); err != nil {
+				t.Fatal(err)
+			}
+		},
+		func() {
+			mustSnapshot(t, codebase.ID, "main", "v3", map[string]string{"a.txt": "3"})
+			mustSnapshot(t, codebase.ID, "main", "v4", map[string]string{"a.txt": "4"})
+		},
+		func() {
+			if _, err := NewDeleteService().DeleteVersion(codebase.ID, "feature", "f1"); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+
+	generations := make(map[int64]mapState)
+	var order []int64
+	for _, step := range steps {
+		step()
+		historyMap := versionMap(t, codebase.ID)
+		if _, seen := generations[historyMap.Generation]; !seen {
+			order = append(order, historyMap.Generation)
+		}
+		generations[historyMap.Generation] = stateOf(t, historyMap)
+	}
+	current := order[len(order)-1]
+	if len(order) < len(steps) {
+		t.Fatalf("%d steps built only generations %v", len(steps), order)
+	}
+
+	for _, since := range order {
+		changes, err := history.GetVersionMapChanges(codebase.ID, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changes.FullRefresh || changes.Generation != current {
+			t.Errorf("changes since %d: full_refresh %v at generation %d, want a delta to %d", since, changes.FullRefresh, changes.Generation, current)
+			continue
+		}
+		if got := generations[since].apply(t, changes); !reflect.DeepEqual(got, generations[current]) {
+			t.Errorf("map of generation %d with the delta since = %+v, want %+v", since, got, generations[current])
+		}
+	}
+
+	for _, since := range []int64{0, current + 1} {
+		if changes, err := history.GetVersionMapChanges(codebase.ID, since); err != nil || !changes.FullRefresh {
+			t.Errorf("changes since %d = %+v, %v, want full_refresh", since, changes, err)
+		}
+	}
+
+	// A cache rebuilt from scratch can't be reached by deltas from before
+	if err := provider.DeleteHistoryCache(codebase.ID); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := history.GetVersionMapChanges(codebase.ID, current)
+	if err != nil || !changes.FullRefresh || changes.Generation != 1 {
+		t.Errorf("changes after the cache was dropped = %+v, %v, want full_refresh at generation 1", changes, err)
+	}
+}
@@ -0,0 +1,263 @@
+package calculate
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"main/core"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func versionMap(t *testing.T, codebaseID string) *core.VersionMapResponse {
+	t.Helper()
+	data, err := NewHistoryService().GetVersionMap(codebaseID)
+	if err != nil {
+		t.Fatalf("GetVersionMap: %v", err)
+	}
+	var historyMap core.VersionMapResponse
+	if err := json.Unmarshal(data, &historyMap); err != nil {
+		t.Fatal(err)
+	}
+	return &historyMap
+}
+
+func TestVersionMapLinksSnapshots(t *testing.T) {
+	useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "history")
+	v1 := mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"a.txt": "1"})
+	v2 := mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{"a.txt": "2"})
+
+	historyMap := versionMap(t, codebase.ID)
+	if len(historyMap.Nodes) != 2 {
+		t.Fatalf("map has %d nodes, want 2", len(historyMap.Nodes))
+	}
+	if len(historyMap.Edges) != 1 || historyMap.Edges[0].From != v1.Version.ID || historyMap.Edges[0].To != v2.Version.ID {
+		t.Errorf("map edges = %+v, want v1 -> v2", historyMap.Edges)
+	}
+	if historyMap.Refs["main"] != v2.Version.ID {
+		t.Errorf("head of main = %s, want v2", historyMap.Refs["main"])
+	}
+
+	// Removing the link shows in the next map
+	err := NewHistoryService().DeleteVersionLink(codebase.ID,
+		VersionIdentifier{Branch: "main", Version: "v2"}, VersionIdentifier{Branch: "main", Version: "v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if historyMap := versionMap(t, codebase.ID); len(historyMap.Edges) != 0 {
+		t.Errorf("map edges after DeleteVersionLink = %+v, want none", historyMap.Edges)
+	}
+}
+
+func TestDeleteCodebaseDropsMemoryHistoryCache(t *testing.T) {
+	provider, _ := useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "history-delete")
+	mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"a.txt": "1"})
+	versionMap(t, codebase.ID)
+	if _, err := provider.GetHistoryCache(codebase.ID); err != nil {
+		t.Fatalf("no history cache after GetVersionMap: %v", err)
+	}
+
+	if err := provider.DeleteCodebaseByID(codebase.ID); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := provider.ListHistoryCaches(); len(ids) != 0 {
+		t.Errorf("history caches left after deleting the codebase: %v", ids)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden compares got with testdata/name, or rewrites the file with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file:\ngot  %s\nwant %s", name, got, want)
+	}
+}
+
+// goldenCodebase stores a codebase with versions v1 and v2 on main, with fixed IDs and times, directly
+// through the provider.
+func goldenCodebase(t *testing.T, provider core.DataProvider, id string) {
+	t.Helper()
+	epoch := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := provider.CreateCodebase(&core.Codebase{ID: id, Name: id, Branch: "main", CreatedAt: epoch, UpdatedAt: epoch}); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"v1", "v2"} {
+		v := &core.Version{
+			ID:         id + "-" + name,
+			CodebaseID: id,
+			Version:    name,
+			Branch:     "main",
+			TreeID:     id + "-tree-" + name,
+			Message:    "snapshot " + name,
+			CreatedAt:  epoch.Add(time.Duration(i) * time.Hour),
+		}
+		v.Stats.TotalFiles, v.Stats.TotalSize = 1, 5
+		files := []core.File{{Path: "a.txt", Hash: name, Size: 5, StorageKey: id + "/" + name}}
+		if err := provider.CreateVersion(v, files); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := provider.CreateVersionLink(id, id+"-v2", id+"-v1", "main", core.LinkageTypeSequential); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func rebuiltHistoryCache(t *testing.T, provider core.DataProvider, codebaseID string) []byte {
+	t.Helper()
+	if _, err := NewHistoryService().RebuildHistoryCache(codebaseID); err != nil {
+		t.Fatal(err)
+	}
+	data, err := provider.GetHistoryCache(codebaseID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestHistoryCacheGoldenWithoutAnnotations(t *testing.T) {
+	provider, _ := useMemoryBackends(t)
+	goldenCodebase(t, provider, "golden-plain")
+	checkGolden(t, "history_cache_plain.json", rebuiltHistoryCache(t, provider, "golden-plain"))
+}
+
+func TestHistoryCacheGoldenWithAnnotations(t *testing.T) {
+	provider, _ := useMemoryBackends(t)
+	goldenCodebase(t, provider, "golden-annotated")
+	for _, name := range []string{"release", "beta"} {
+		tag := &core.Tag{CodebaseID: "golden-annotated", Name: name, VersionID: "golden-annotated-v1", CreatedAt: time.Now()}
+		if err := provider.CreateTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	locked, pinned := true, true
+	if _, err := NewHistoryService().SetVersionFlags("golden-annotated", VersionSelector{VersionID: "golden-annotated-v1"},
+		VersionFlags{Locked: &locked, Pinned: &pinned}); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "history_cache_annotated.json", rebuiltHistoryCache(t, provider, "golden-annotated"))
+}
+
+func TestVersionFlagsRefreshMapAndBlockDeletes(t *testing.T) {
+	useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "flags")
+	mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"a.txt": "1"})
+	mustSnapshot(t, codebase.ID, "feature", "f1", map[string]string{"a.txt": "2"})
+	versionMap(t, codebase.ID)
+
+	locked := true
+	v, err := NewHistoryService().SetVersionFlags(codebase.ID, VersionSelector{Branch: "feature", Version: "f1"}, VersionFlags{Locked: &locked})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range versionMap(t, codebase.ID).Nodes {
+		if node.Locked != (node.ID == v.ID) || node.Pinned {
+			t.Errorf("node %s/%s locked=%t pinned=%t after locking feature/f1", node.Branch, node.Version, node.Locked, node.Pinned)
+		}
+	}
+
+	if _, err := NewDeleteService().DeleteVersion(codebase.ID, "feature", "f1"); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("DeleteVersion of a locked version = %v, want a locked error", err)
+	}
+	if _, err := NewDeleteService().DeleteBranch(codebase.ID, "feature", false); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("DeleteBranch with a locked version = %v, want a locked error", err)
+	}
+	_, err = NewUploadService().ProcessSnapshot(codebase.ID, "f1", "feature", "", snapshotFiles(map[string]string{"a.txt": "3"}), nil, true, SnapshotOptions{Overwrite: true})
+	if err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("overwriting a locked version = %v, want a locked error", err)
+	}
+
+	locked = false
+	if _, err := NewHistoryService().SetVersionFlags(codebase.ID, VersionSelector{VersionID: v.ID}, VersionFlags{Locked: &locked}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDeleteService().DeleteVersion(codebase.ID, "feature", "f1"); err != nil {
+		t.Errorf("DeleteVersion after unlocking: %v", err)
+	}
+}
+
+// Map reads racing continuous link creation, each of which rewrites the cache file, always get
+// a complete cache. Run with -race to also check the locking.
+func TestVersionMapReadsDuringLinkCreation(t *testing.T) {
+	provider := openJSONBackends(t, t.TempDir())
+	codebase := mustInitCodebase(t, "stress")
+	const versions = 40
+	for i := 1; i <= versions; i++ {
+		version := fmt.Sprintf("v%d", i)
+		files := snapshotFiles(map[string]string{"a.txt": version})
+		if _, err := NewUploadService().ProcessSnapshot(codebase.ID, version, "main", "", files, nil, false, SnapshotOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history := NewHistoryService()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for reads := 0; ; reads++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var data []byte
+				var err error
+				if r%2 == 0 {
+					data, err = history.GetVersionMap(codebase.ID)
+				} else if data, err = provider.GetHistoryCache(codebase.ID); err != nil {
+					continue // not built yet
+				}
+				if err != nil || !json.Valid(data) {
+					t.Errorf("read %d of reader %d = %d bytes, %v: not a complete cache", reads, r, len(data), err)
+					return
+				}
+			}
+		}(r)
+	}
+
+	for i := 2; i <= versions; i++ {
+		child := VersionIdentifier{"main", fmt.Sprintf("v%d", i)}
+		parent := VersionIdentifier{"main", fmt.Sprintf("v%d", i-1)}
+		if err := history.CreateVersionLink(codebase.ID, child, parent); err != nil {
+			t.Error(err)
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	// The links rebuild the cache in the background, the last rebuild has to leave every edge in it
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		status := BackgroundJobs().Status()
+		if len(status.Running)+len(status.Queued) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("background rebuilds still pending: %+v", status)
+		}
+	}
+	if m := versionMap(t, codebase.ID); len(m.Edges) != versions-1 {
+		t.Errorf("%d edges after the links, want %d", len(m.Edges), versions-1)
+	}
+}
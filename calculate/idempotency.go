@@ -0,0 +1,233 @@
+package calculate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/core"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// A snapshot request can carry an idempotency key so a client that lost the response can retry it
+// without creating a second version. The first request that succeeds records the key with the version it
+// created and the response; a retry with the same key in the same codebase gets that response again,
+// with the file tree and the version map read anew, until idempotency_key_retention_seconds have passed.
+// A request with the key of another, still running request waits for it. Records are kept by the
+// provider, so keys survive restarts; failed requests record nothing and can be retried. A key reused
+// for a request that differs in its metadata or its files is rejected.
+const (
+	defaultIdempotencyKeyRetention = 24 * time.Hour
+	idempotencyKeySweepInterval    = 10 * time.Minute
+
+	// maxIdempotencyKeyLength caps idempotency keys, in bytes
+	maxIdempotencyKeyLength = 255
+)
+
+// IdempotencyKeyReuseError rejects a key that was recorded for a different request
+type IdempotencyKeyReuseError struct {
+	Key       string `json:"key"`
+	VersionID string `json:"version_id,omitempty"` // the version of the first request, if it succeeded
+}
+
+func (e *IdempotencyKeyReuseError) Error() string {
+	return fmt.Sprintf("idempotency key %q was used for a different snapshot request", e.Key)
+}
+
+// IdempotencyVersionGoneError reports a recorded key whose version has since been deleted
+type IdempotencyVersionGoneError struct {
+	Key       string `json:"key"`
+	VersionID string `json:"version_id"`
+}
+
+func (e *IdempotencyVersionGoneError) Error() string {
+	return fmt.Sprintf("idempotency key %q created version %s, which has been deleted", e.Key, e.VersionID)
+}
+
+func idempotencyKeyRetention() time.Duration {
+	if seconds := core.GetConfig().IdempotencyKeyRetentionSeconds; seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultIdempotencyKeyRetention
+}
+
+// validateIdempotencyKey checks a key like a name: not blank, printable and at most maxIdempotencyKeyLength bytes.
+func validateIdempotencyKey(key string) error {
+	switch {
+	case strings.TrimSpace(key) == "":
+		return fmt.Errorf("invalid snapshot: idempotency key must not be blank")
+	case len(key) > maxIdempotencyKeyLength:
+		return fmt.Errorf("invalid snapshot: idempotency key is %d bytes long, the limit is %d", len(key), maxIdempotencyKeyLength)
+	case strings.IndexFunc(key, unicode.IsControl) >= 0:
+		return fmt.Errorf("invalid snapshot: idempotency key must not contain control characters")
+	}
+	return nil
+}
+
+// SnapshotFingerprint identifies a snapshot request by its metadata, without the key, and the paths and
+// sizes of its files. Contents aren't read: a retry sends the same files.
+func SnapshotFingerprint(metadata []byte, files map[string]*SnapshotFile) string {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	h := sha256.New()
+	h.Write(metadata)
+	for _, p := range paths {
+		fmt.Fprintf(h, "\x00%s\x00%d", p, files[p].Size)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotentCall is a request holding a key until its snapshot succeeded or failed
+type idempotentCall struct {
+	fingerprint string
+	done        chan struct{}
+}
+
+// idempotentCalls holds the running requests of this process by "codebaseID/key"
+var idempotentCalls = struct {
+	sync.Mutex
+	calls map[string]*idempotentCall
+}{calls: make(map[string]*idempotentCall)}
+
+// IdempotencyService runs snapshot requests at most once per key
+type IdempotencyService struct {
+	historyService *HistoryService
+	now            func() time.Time
+}
+
+func NewIdempotencyService() *IdempotencyService {
+	return &IdempotencyService{
+		historyService: NewHistoryService(),
+		now:            time.Now,
+	}
+}
+
+// Snapshot runs snapshot unless the key was recorded in the codebase, in which case the recorded response
+// is returned and replayed is true. A successful snapshot is recorded under the key.
+func (s *IdempotencyService) Snapshot(codebaseID, key, fingerprint string, snapshot func() (*core.SnapshotResponse, error)) (resp *core.SnapshotResponse, replayed bool, err error) {
+	if err := validateIdempotencyKey(key); err != nil {
+		return nil, false, err
+	}
+	provider := core.GetProvider()
+	codebase, err := getActiveCodebase(provider, codebaseID)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid codebase_id: %s, error: %w", codebaseID, err)
+	}
+	callKey := codebase.ID + "/" + key
+
+	for {
+		idempotentCalls.Lock()
+		if call, ok := idempotentCalls.calls[callKey]; ok {
+			idempotentCalls.Unlock()
+			if call.fingerprint != fingerprint {
+				return nil, false, &IdempotencyKeyReuseError{Key: key}
+			}
+			// Wait for the first request, then look for its record again
+			<-call.done
+			continue
+		}
+		if record, err := provider.GetIdempotencyRecord(codebase.ID, key); err == nil && s.now().Before(record.ExpiresAt) {
+			idempotentCalls.Unlock()
+			resp, err := s.replay(record, fingerprint)
+			return resp, err == nil, err
+		}
+		call := &idempotentCall{fingerprint: fingerprint, done: make(chan struct{})}
+		idempotentCalls.calls[callKey] = call
+		idempotentCalls.Unlock()
+
+		defer func() {
+			idempotentCalls.Lock()
+			delete(idempotentCalls.calls, callKey)
+			idempotentCalls.Unlock()
+			close(call.done)
+		}()
+		break
+	}
+
+	resp, err = snapshot()
+	if err != nil {
+		return nil, false, err
+	}
+	s.record(codebase.ID, key, fingerprint, resp)
+	return resp, false, nil
+}
+
+// record saves the response of a snapshot under its key. The snapshot exists whether or not this works,
+// so a failure is only logged: a retry would then be processed again.
+func (s *IdempotencyService) record(codebaseID, key, fingerprint string, resp *core.SnapshotResponse) {
+	stored := *resp
+	stored.FileTree, stored.VersionMap = nil, nil
+	now := s.now()
+	record := &core.IdempotencyRecord{
+		CodebaseID:  codebaseID,
+		Key:         key,
+		Fingerprint: fingerprint,
+		VersionID:   resp.Version.ID,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(idempotencyKeyRetention()),
+		Response:    &stored,
+	}
+	if err := core.GetProvider().SaveIdempotencyRecord(record); err != nil {
+		log.Printf("Failed to record idempotency key %q of version %s: %v", key, resp.Version.ID, err)
+	}
+}
+
+// replay rebuilds the response of a recorded key with the current file tree and version map of its version.
+func (s *IdempotencyService) replay(record *core.IdempotencyRecord, fingerprint string) (*core.SnapshotResponse, error) {
+	if record.Fingerprint != fingerprint {
+		return nil, &IdempotencyKeyReuseError{Key: record.Key, VersionID: record.VersionID}
+	}
+	provider := core.GetProvider()
+	version, err := provider.GetVersionByID(record.VersionID)
+	if err != nil {
+		return nil, &IdempotencyVersionGoneError{Key: record.Key, VersionID: record.VersionID}
+	}
+	files, err := provider.GetFileIndexesByTreeID(version.TreeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the file tree of version %s: %w", version.ID, err)
+	}
+
+	resp := *record.Response
+	resp.FileTree = &core.FileTree{TreeID: version.TreeID, VersionID: version.ID, Files: files, GeneratedAt: version.CreatedAt}
+	if historyJSON, err := s.historyService.GetVersionMap(record.CodebaseID); err != nil {
+		log.Printf("Unable to get version graph to replay idempotency key %q (codebaseID: %s): %v", record.Key, record.CodebaseID, err)
+	} else {
+		var versionMap core.VersionMapResponse
+		if err := json.Unmarshal(historyJSON, &versionMap); err == nil {
+			resp.VersionMap = &versionMap
+		}
+	}
+	log.Printf("Replayed snapshot for idempotency key %q: version %s", record.Key, version.ID)
+	return &resp, nil
+}
+
+// StartSweeper deletes expired idempotency keys periodically in the background until stop is closed.
+func (s *IdempotencyService) StartSweeper(stop <-chan struct{}) {
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(idempotencyKeySweepInterval):
+			}
+			err := BackgroundJobs().Run("idempotency-key-sweep", func(throttle *IOThrottle) error {
+				purged, err := core.GetProvider().DeleteExpiredIdempotencyRecords(s.now())
+				if purged > 0 {
+					log.Printf("Deleted %d expired idempotency keys", purged)
+				}
+				return err
+			})
+			if err != nil {
+				log.Printf("Idempotency key sweep failed: %v", err)
+			}
+		}
+	}()
+}
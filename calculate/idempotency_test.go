@@ -0,0 +1,185 @@
+package calculate
+
+import (
+	"errors"
+	"fmt"
+	"main/core"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingSnapshot returns a snapshot function creating version name on main and counting its calls.
+func countingSnapshot(codebaseID, name string, calls *int32) func() (*core.SnapshotResponse, error) {
+	return func() (*core.SnapshotResponse, error) {
+		atomic.AddInt32(calls, 1)
+		return NewUploadService().ProcessSnapshot(codebaseID, name, "main", "", snapshotFiles(map[string]string{"a.txt": name}), nil, true, SnapshotOptions{})
+	}
+}
+
+func TestIdempotentSnapshotReplay(t *testing.T) {
+	useMemoryBackends(t)
+	codebase, other := mustInitCodebase(t, "retried"), mustInitCodebase(t, "other")
+	clock := &fakeClock{t: time.Date(2026, 1, 2, 15, 0, 0, 0, time.UTC)}
+	service := NewIdempotencyService()
+	service.now = clock.now
+
+	var calls int32
+	first, replayed, err := service.Snapshot(codebase.ID, "build-1042", "fingerprint", countingSnapshot(codebase.ID, "v1", &calls))
+	if err != nil || replayed {
+		t.Fatalf("first request = %v, replayed %v", err, replayed)
+	}
+	again, replayed, err := service.Snapshot(codebase.ID, "build-1042", "fingerprint", countingSnapshot(codebase.ID, "v2", &calls))
+	if err != nil || !replayed || calls != 1 {
+		t.Fatalf("retry = %v, replayed %v after %d snapshots, want the first response replayed", err, replayed, calls)
+	}
+	if again.Version.ID != first.Version.ID || again.FileTree == nil || len(again.FileTree.Files) != 1 {
+		t.Errorf("replayed version %s with tree %+v, want version %s with its file", again.Version.ID, again.FileTree, first.Version.ID)
+	}
+
+	// Other metadata or files under the same key
+	_, _, err = service.Snapshot(codebase.ID, "build-1042", "other fingerprint", countingSnapshot(codebase.ID, "v2", &calls))
+	var reuseErr *IdempotencyKeyReuseError
+	if !errors.As(err, &reuseErr) || reuseErr.VersionID != first.Version.ID {
+		t.Errorf("key reused for another request = %v, want an IdempotencyKeyReuseError naming %s", err, first.Version.ID)
+	}
+
+	// Keys are scoped to their codebase
+	if _, replayed, err := service.Snapshot(other.ID, "build-1042", "fingerprint", countingSnapshot(other.ID, "v1", &calls)); err != nil || replayed {
+		t.Errorf("same key in another codebase = %v, replayed %v, want a new snapshot", err, replayed)
+	}
+
+	if _, err := NewDeleteService().DeleteVersion(codebase.ID, "main", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = service.Snapshot(codebase.ID, "build-1042", "fingerprint", countingSnapshot(codebase.ID, "v2", &calls))
+	var goneErr *IdempotencyVersionGoneError
+	if !errors.As(err, &goneErr) || goneErr.VersionID != first.Version.ID {
+		t.Errorf("retry after deleting the version = %v, want an IdempotencyVersionGoneError", err)
+	}
+
+	// Once the key expired the request is processed again
+	clock.t = clock.t.Add(defaultIdempotencyKeyRetention + time.Second)
+	calls = 0
+	if _, replayed, err := service.Snapshot(codebase.ID, "build-1042", "fingerprint", countingSnapshot(codebase.ID, "v2", &calls)); err != nil || replayed || calls != 1 {
+		t.Errorf("request with an expired key = %v, replayed %v, %d snapshots", err, replayed, calls)
+	}
+}
+
+func TestIdempotentSnapshotFailureIsNotRecorded(t *testing.T) {
+	useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "retried")
+	service := NewIdempotencyService()
+	failed := errors.New("upload interrupted")
+	if _, _, err := service.Snapshot(codebase.ID, "key", "fingerprint", func() (*core.SnapshotResponse, error) { return nil, failed }); !errors.Is(err, failed) {
+		t.Fatalf("failing request = %v", err)
+	}
+	var calls int32
+	if _, replayed, err := service.Snapshot(codebase.ID, "key", "fingerprint", countingSnapshot(codebase.ID, "v1", &calls)); err != nil || replayed || calls != 1 {
+		t.Errorf("retry of a failed request = %v, replayed %v, %d snapshots, want it processed", err, replayed, calls)
+	}
+}
+
+// Concurrent requests with one key create one version; a concurrent request with another body is rejected.
+func TestIdempotentSnapshotConcurrent(t *testing.T) {
+	useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "retried")
+	service := NewIdempotencyService()
+
+	started, proceed := make(chan struct{}), make(chan struct{})
+	var calls int32
+	slow := func() (*core.SnapshotResponse, error) {
+		close(started)
+		<-proceed
+		return countingSnapshot(codebase.ID, "v1", &calls)()
+	}
+	results := make(chan *core.SnapshotResponse, 6)
+	errs := make(chan error, 6)
+	var wg sync.WaitGroup
+	run := func(snapshot func() (*core.SnapshotResponse, error)) {
+		defer wg.Done()
+		resp, _, err := service.Snapshot(codebase.ID, "key", "fingerprint", snapshot)
+		results <- resp
+		errs <- err
+	}
+	wg.Add(1)
+	go run(slow)
+	<-started
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go run(countingSnapshot(codebase.ID, fmt.Sprintf("v%d", i+2), &calls))
+	}
+
+	if _, _, err := service.Snapshot(codebase.ID, "key", "other fingerprint", countingSnapshot(codebase.ID, "x", &calls)); !errors.As(err, new(*IdempotencyKeyReuseError)) {
+		t.Errorf("request with another body while the key is in use = %v, want an IdempotencyKeyReuseError", err)
+	}
+	close(proceed)
+	wg.Wait()
+	close(results)
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	ids := make(map[string]bool)
+	for resp := range results {
+		if resp != nil {
+			ids[resp.Version.ID] = true
+		}
+	}
+	if calls != 1 || len(ids) != 1 {
+		t.Errorf("%d snapshots created versions %v, want one", calls, ids)
+	}
+}
+
+func TestCodebaseLocksAreEvicted(t *testing.T) {
+	useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "locks")
+	held := func() bool {
+		codebaseLocks.Lock()
+		defer codebaseLocks.Unlock()
+		_, ok := codebaseLocks.codebases[codebase.ID]
+		return ok
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, unlock := lockCodebase(codebase.ID)
+			unlock()
+		}()
+	}
+	wg.Wait()
+	if held() {
+		t.Error("lock kept after all its users released it")
+	}
+
+	// A reservation keeps the lock until it is released
+	first, releaseFirst, err := reserveVersionName(core.GetProvider(), codebase.ID, "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !held() {
+		t.Fatal("lock dropped while it holds a reservation")
+	}
+	second, releaseSecond, err := reserveVersionName(core.GetProvider(), codebase.ID, "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != "v1" || second != "v2" {
+		t.Errorf("reserved %s and %s, want v1 and v2", first, second)
+	}
+	releaseFirst()
+	if !held() {
+		t.Error("lock dropped while it holds a reservation")
+	}
+	releaseSecond()
+	if held() {
+		t.Error("lock kept after its reservations were released")
+	}
+}
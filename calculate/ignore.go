@@ -0,0 +1,90 @@
+package calculate
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Ignore patterns follow .gitignore: a pattern ending in "/" matches only directories, a pattern
+// containing another "/" is anchored at the root, otherwise it matches a name at any depth, and a
+// leading "!" re-includes what an earlier pattern ignored. The last matching pattern decides, and as
+// in git a file stays ignored when one of its parent directories is, whatever later negations say.
+
+// validateIgnorePattern checks that a pattern can be used with matchIgnorePattern.
+func validateIgnorePattern(pattern string) error {
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(pattern, "!"), "/"), "/")
+	if trimmed == "" {
+		return fmt.Errorf("empty ignore pattern %q", pattern)
+	}
+	if _, err := path.Match(trimmed, ""); err != nil {
+		return fmt.Errorf("invalid ignore pattern %q: %w", pattern, err)
+	}
+	return nil
+}
+
+// validateIgnorePatterns checks every pattern of a list.
+func validateIgnorePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if err := validateIgnorePattern(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchIgnorePattern reports whether a pattern, without its "!", matches an entry given by its
+// slash-separated path segments: a directory when isDir is set, a file otherwise.
+func matchIgnorePattern(pattern string, segments []string, isDir bool) bool {
+	dirOnly := strings.HasSuffix(pattern, "/")
+	if dirOnly && !isDir {
+		return false
+	}
+	pattern = strings.TrimSuffix(pattern, "/")
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	subject := segments[len(segments)-1]
+	if anchored {
+		subject = strings.Join(segments, "/")
+	}
+	ok, _ := path.Match(pattern, subject)
+	return ok
+}
+
+// ignoredEntry applies the patterns in order to one entry; the last one matching it decides.
+func ignoredEntry(patterns []string, segments []string, isDir bool) bool {
+	ignored := false
+	for _, p := range patterns {
+		negated := strings.HasPrefix(p, "!")
+		if matchIgnorePattern(strings.TrimPrefix(p, "!"), segments, isDir) {
+			ignored = !negated
+		}
+	}
+	return ignored
+}
+
+// isIgnored reports whether the patterns exclude the file path, or one of its parent directories.
+func isIgnored(patterns []string, filePath string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	segments := strings.Split(filePath, "/")
+	for i := 1; i < len(segments); i++ {
+		if ignoredEntry(patterns, segments[:i], true) {
+			return true
+		}
+	}
+	return ignoredEntry(patterns, segments, false)
+}
+
+// isIgnoredDir reports whether the patterns exclude the directory path or one of its parents.
+func isIgnoredDir(patterns []string, dirPath string) bool {
+	segments := strings.Split(dirPath, "/")
+	for i := 1; i <= len(segments); i++ {
+		if ignoredEntry(patterns, segments[:i], true) {
+			return true
+		}
+	}
+	return false
+}
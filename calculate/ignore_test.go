@@ -0,0 +1,119 @@
+package calculate
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestIsIgnored(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		want     bool
+	}{
+		// Names at any depth
+		{[]string{"*.log"}, "debug.log", true},
+		{[]string{"*.log"}, "logs/debug.log", true},
+		{[]string{"*.log"}, "debug.log.txt", false},
+		{[]string{".git"}, ".git/config", true},
+		// Directory patterns match directories only, and everything below them
+		{[]string{"vendor/"}, "vendor/lib.go", true},
+		{[]string{"vendor/"}, "src/vendor/lib.go", true},
+		{[]string{"vendor/"}, "vendor", false},
+		{[]string{"vendor/"}, "vendorlib/a.go", false},
+		{[]string{"node_modules/"}, "web/node_modules/pkg/index.js", true},
+		// A pattern with a "/" is anchored at the root
+		{[]string{"build/out"}, "build/out/a.bin", true},
+		{[]string{"build/out"}, "src/build/out/a.bin", false},
+		{[]string{"/todo.txt"}, "todo.txt", true},
+		{[]string{"/todo.txt"}, "docs/todo.txt", false},
+		// Negation re-includes; the last matching pattern decides
+		{[]string{"*.txt", "!keep.txt"}, "keep.txt", false},
+		{[]string{"*.txt", "!keep.txt"}, "docs/keep.txt", false},
+		{[]string{"*.txt", "!keep.txt"}, "drop.txt", true},
+		{[]string{"!keep.txt", "*.txt"}, "keep.txt", true},
+		{[]string{"!keep.txt"}, "keep.txt", false},
+		// A file stays ignored when its directory is, whatever later negations say
+		{[]string{"vendor/", "!vendor/keep.go"}, "vendor/keep.go", true},
+		{[]string{"vendor/*", "!vendor/keep.go"}, "vendor/keep.go", false},
+		{[]string{"vendor/*", "!vendor/keep.go"}, "vendor/drop.go", true},
+		{nil, "anything", false},
+	}
+	for _, tt := range tests {
+		if got := isIgnored(tt.patterns, tt.path); got != tt.want {
+			t.Errorf("isIgnored(%q, %q) = %v, want %v", tt.patterns, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestValidateIgnorePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		wantErr string
+	}{
+		{"*.log", ""},
+		{"vendor/", ""},
+		{"!keep.txt", ""},
+		{"/build", ""},
+		{"", "empty"},
+		{"!", "empty"},
+		{"/", "empty"},
+		{"[a-", "invalid"},
+	}
+	for _, tt := range tests {
+		err := validateIgnorePattern(tt.pattern)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("validateIgnorePattern(%q) = %v, want an error containing %q", tt.pattern, err, tt.wantErr)
+		}
+	}
+}
+
+// Files matched by the codebase's patterns or the snapshot's are not stored and not counted in the stats.
+func TestProcessSnapshotIgnoredFiles(t *testing.T) {
+	provider, _ := useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "ignore")
+	patterns := []string{"node_modules/", "*.log"}
+	if _, err := NewCodebaseService().UpdateCodebase(codebase.ID, nil, nil, &patterns); err != nil {
+		t.Fatal(err)
+	}
+
+	files := snapshotFiles(map[string]string{
+		"main.go":                      "package main",
+		"debug.log":                    "ignored by the codebase",
+		"keep.log":                     "re-included by the snapshot",
+		"node_modules/pkg/index.js":    "ignored by the codebase",
+		"vendor/lib.go":                "ignored by the snapshot",
+		"docs/vendor/readme.md":        "ignored by the snapshot",
+		"docs/vendored-notes/guide.md": "kept",
+	})
+	resp, err := NewUploadService().ProcessSnapshot(codebase.ID, "v1", "main", "", files, nil, true, SnapshotOptions{Ignore: []string{"vendor/", "!keep.log"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.IgnoredFiles != 4 {
+		t.Errorf("IgnoredFiles = %d, want 4", resp.IgnoredFiles)
+	}
+	wantSize := int64(len("package main") + len("re-included by the snapshot") + len("kept"))
+	if stats := resp.Version.Stats; stats.TotalFiles != 3 || stats.UploadedFiles != 3 || stats.TotalSize != wantSize {
+		t.Errorf("stats = %+v, want 3 files of %d bytes", stats, wantSize)
+	}
+	stored, err := provider.GetFileIndexesByTreeID(resp.Version.TreeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range stored {
+		if !f.IsDir() {
+			paths = append(paths, f.Path)
+		}
+	}
+	sort.Strings(paths)
+	if got := strings.Join(paths, ","); got != "docs/vendored-notes/guide.md,keep.log,main.go" {
+		t.Errorf("stored files = %s", got)
+	}
+
+	if _, err := NewUploadService().ProcessSnapshot(codebase.ID, "v2", "main", "", snapshotFiles(map[string]string{"a.log": "x"}), nil, true, SnapshotOptions{}); err == nil || !strings.Contains(err.Error(), "matched the ignore patterns") {
+		t.Errorf("snapshot of ignored files only = %v, want it rejected", err)
+	}
+}
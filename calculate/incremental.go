@@ -0,0 +1,89 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SnapshotBase names the version an incremental snapshot starts from. The upload then holds only the
+// changed and added files; the others are carried forward from the base unless listed as deleted.
+type SnapshotBase struct {
+	Branch  string `json:"branch"` // defaults to the branch of the snapshot
+	Version string `json:"version"`
+}
+
+// loadSnapshotBase resolves the base version and returns its files, checking the deleted paths against
+// them and against the upload. It runs before anything is stored.
+func loadSnapshotBase(provider core.DataProvider, codebaseID, branch string, base *SnapshotBase, deleted []string, files map[string]*SnapshotFile) ([]core.File, error) {
+	if base.Version == "" {
+		return nil, fmt.Errorf("invalid snapshot: base needs a version")
+	}
+	if base.Branch == "" {
+		base.Branch = branch
+	}
+	version, err := lookupVersion(provider, codebaseID, base.Branch, base.Version)
+	if err != nil {
+		return nil, fmt.Errorf("base version: %w", err)
+	}
+	baseFiles, err := provider.GetFileIndexesByTreeID(version.TreeID)
+	if err != nil {
+		return nil, fmt.Errorf("base version %s/%s: %w", base.Branch, base.Version, err)
+	}
+
+	inBase := make(map[string]bool, len(baseFiles))
+	for _, f := range baseFiles {
+		inBase[f.Path] = true
+	}
+	var problems []string
+	for _, p := range deleted {
+		p = filepath.ToSlash(p)
+		switch {
+		case !inBase[p]:
+			problems = append(problems, fmt.Sprintf("%s is not in the base version", p))
+		case files[p] != nil || files[filepath.FromSlash(p)] != nil:
+			problems = append(problems, fmt.Sprintf("%s is both uploaded and deleted", p))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("invalid snapshot: deleted paths don't match base version %s/%s: %s", base.Branch, base.Version, strings.Join(problems, "; "))
+	}
+	return baseFiles, nil
+}
+
+// carryForward adds the files of the base that were neither uploaded nor deleted to the tree and counts
+// them in the version stats. Uploads renamed by the path policy replace the base file at their original
+// path too.
+func carryForward(version *core.Version, tree *core.FileTree, baseFiles []core.File, deleted []string) {
+	skip := make(map[string]bool, len(tree.Files)+len(deleted))
+	for _, f := range tree.Files {
+		skip[f.Path] = true
+		if f.OriginalPath != "" {
+			skip[f.OriginalPath] = true
+		}
+	}
+	for _, p := range deleted {
+		skip[filepath.ToSlash(p)] = true
+	}
+	stats := &version.Stats
+	for _, f := range baseFiles {
+		if skip[f.Path] {
+			continue
+		}
+		tree.Files = append(tree.Files, f)
+		if f.IsDir() {
+			continue
+		}
+		stats.TotalFiles++
+		stats.TotalSize += f.Size
+		stats.CompressedSize += f.CompressedSize
+		stats.CarriedFiles++
+	}
+	stats.CompressionRatio = 0
+	if stats.TotalSize > 0 {
+		stats.CompressionRatio = float64(stats.CompressedSize) / float64(stats.TotalSize)
+	}
+}
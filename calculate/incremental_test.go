@@ -0,0 +1,72 @@
+package calculate
+
+import (
+	"main/core"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIncrementalSnapshot(t *testing.T) {
+	_, storage := useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "incremental")
+	v1 := mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{
+		"kept.txt":    "carried forward",
+		"changed.txt": "before",
+		"gone.txt":    "deleted in v2",
+		"dir/d.txt":   "also carried",
+	})
+	snapshot := func(version string, contents map[string]string, opts SnapshotOptions) (*core.SnapshotResponse, error) {
+		return NewUploadService().ProcessSnapshot(codebase.ID, version, "main", "", snapshotFiles(contents), nil, true, opts)
+	}
+
+	v2, err := snapshot("v2", map[string]string{"changed.txt": "after", "added.txt": "new in v2"},
+		SnapshotOptions{Base: &SnapshotBase{Version: "v1"}, Deleted: []string{"gone.txt"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"kept.txt": "carried forward", "changed.txt": "after", "added.txt": "new in v2", "dir/d.txt": "also carried"}
+	if got := versionContents(t, storage, codebase.ID)[v2.Version.ID]; !reflect.DeepEqual(got, want) {
+		t.Errorf("contents of v2 = %v, want %v", got, want)
+	}
+	if stats := v2.Version.Stats; stats.TotalFiles != 4 || stats.UploadedFiles != 2 || stats.CarriedFiles != 2 {
+		t.Errorf("stats of v2 = %+v, want 2 files uploaded and 2 carried", stats)
+	}
+	keys1, keys2 := fileKeys(t, v1.Version.ID), fileKeys(t, v2.Version.ID)
+	if keys2["kept.txt"] != keys1["kept.txt"] || keys2["dir/d.txt"] != keys1["dir/d.txt"] {
+		t.Error("carried files don't keep the objects of the base")
+	}
+
+	// A snapshot that only deletes files; the base branch defaults to the snapshot's
+	v3, err := snapshot("v3", nil, SnapshotOptions{Base: &SnapshotBase{Branch: "main", Version: "v2"}, Deleted: []string{"dir/d.txt"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := versionContents(t, storage, codebase.ID)[v3.Version.ID]; len(got) != 3 || got["dir/d.txt"] != "" {
+		t.Errorf("contents of v3 = %v, want v2 without dir/d.txt", got)
+	}
+
+	before := storedObjects(t, storage)
+	for _, tt := range []struct {
+		name     string
+		contents map[string]string
+		opts     SnapshotOptions
+		wantErr  string
+	}{
+		{"missing base", map[string]string{"a.txt": "a"}, SnapshotOptions{Base: &SnapshotBase{Version: "v9"}}, "base version:"},
+		{"base without version", nil, SnapshotOptions{Base: &SnapshotBase{Branch: "main"}}, "base needs a version"},
+		{"deleted without base", map[string]string{"a.txt": "a"}, SnapshotOptions{Deleted: []string{"kept.txt"}}, "need a base version"},
+		{"deleted path not in base", nil, SnapshotOptions{Base: &SnapshotBase{Version: "v1"}, Deleted: []string{"added.txt"}}, "added.txt is not in the base version"},
+		{"uploaded and deleted", map[string]string{"kept.txt": "x"}, SnapshotOptions{Base: &SnapshotBase{Version: "v1"}, Deleted: []string{"kept.txt"}}, "kept.txt is both uploaded and deleted"},
+	} {
+		if _, err := snapshot("v4", tt.contents, tt.opts); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: snapshot = %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+	if got := storedObjects(t, storage); !reflect.DeepEqual(got, before) {
+		t.Errorf("rejected snapshots stored %v, had %v", got, before)
+	}
+	if _, err := core.GetProvider().GetVersion(codebase.ID, "main", "v4"); err == nil {
+		t.Error("a rejected snapshot created v4")
+	}
+}
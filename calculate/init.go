@@ -15,18 +15,46 @@ func NewInitService() *InitService {
 	return &InitService{}
 }
 
+// InitOptions carries optional codebase creation parameters
+type InitOptions struct {
+	// Ephemeral codebases are purged automatically once TTL has passed
+	Ephemeral bool
+	TTL       time.Duration
+}
+
 // InitializeCodebase creates new codebase record
-func (s *InitService) InitializeCodebase(name, description, branch string) (*core.Codebase, error) {
+func (s *InitService) InitializeCodebase(name, description, branch string, settings *core.CodebaseSettings, opts InitOptions) (*core.Codebase, error) {
 	log.Printf("Starting codebase initialization: name=%s, branch=%s", name, branch)
 
+	// Settings are validated up front and persisted together with the codebase record
+	if err := validateSettings(settings); err != nil {
+		return nil, err
+	}
+	if err := validateName("branch", branch); err != nil {
+		return nil, err
+	}
+	if opts.TTL < 0 || (opts.TTL > 0 && !opts.Ephemeral) {
+		return nil, fmt.Errorf("invalid ttl: only ephemeral codebases take a positive ttl")
+	}
+
 	codebase := &core.Codebase{
 		ID:          uuid.NewString(),
 		Name:        name,
 		Description: description,
 		Branch:      branch,
+		Settings:    seedSettings(settings),
 		CreatedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
 	}
+	if opts.Ephemeral {
+		ttl := opts.TTL
+		if ttl == 0 {
+			ttl = defaultEphemeralTTL
+		}
+		expiresAt := codebase.CreatedAt.Add(ttl)
+		codebase.Ephemeral = true
+		codebase.ExpiresAt = &expiresAt
+	}
 
 	if err := core.GetProvider().CreateCodebase(codebase); err != nil {
 		log.Printf("Data provider write failed: %v", err)
@@ -0,0 +1,160 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+)
+
+// maxLinkBatchSize bounds the number of links accepted in one batch
+const maxLinkBatchSize = 1000
+
+// Per-link outcomes of a batch
+const (
+	LinkStatusCreated  = "created"
+	LinkStatusRejected = "rejected"
+	LinkStatusSkipped  = "skipped" // valid, but not applied because an atomic batch was rejected
+)
+
+// LinkRequest is one link of a batch
+type LinkRequest struct {
+	Child       VersionIdentifier
+	Parent      VersionIdentifier
+	LinkageType core.LinkageType
+}
+
+// LinkResult reports what happened to one link of a batch
+type LinkResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// LinkBatchResult reports the outcome of a whole batch
+type LinkBatchResult struct {
+	Atomic     bool         `json:"atomic"`
+	Created    int          `json:"created"`
+	Rejected   int          `json:"rejected"`
+	Generation int64        `json:"generation,omitempty"` // history map generation after the batch
+	Results    []LinkResult `json:"results"`
+}
+
+// CreateVersionLinks validates a batch of links against the existing graph and each other,
+// inserts the valid ones in a single provider write and rebuilds the history cache once.
+// With atomic set, a single invalid link rejects the whole batch.
+func (s *HistoryService) CreateVersionLinks(codebaseID string, links []LinkRequest, atomic bool) (*LinkBatchResult, error) {
+	if len(links) == 0 {
+		return nil, fmt.Errorf("invalid link batch: no links given")
+	}
+	if len(links) > maxLinkBatchSize {
+		return nil, fmt.Errorf("invalid link batch: %d links exceeds the limit of %d", len(links), maxLinkBatchSize)
+	}
+
+	provider := core.GetProvider()
+	if _, err := getActiveCodebase(provider, codebaseID); err != nil {
+		return nil, err
+	}
+	edges, err := provider.GetAllVersionEdgesForMap(codebaseID)
+	if err != nil {
+		return nil, fmt.Errorf("edge query failed: %w", err)
+	}
+	// Every version has at most one parent: child_version_id -> parent_version_id
+	parents := make(map[string]string, len(edges)+len(links))
+	for _, e := range edges {
+		parents[e.To] = e.From
+	}
+
+	result := &LinkBatchResult{Atomic: atomic, Results: make([]LinkResult, len(links))}
+	var valid []core.VersionLink
+	var validIndexes []int
+	for i, l := range links {
+		link, err := validateLink(provider, codebaseID, l, parents)
+		if err != nil {
+			result.Results[i] = LinkResult{Index: i, Status: LinkStatusRejected, Error: err.Error()}
+			result.Rejected++
+			continue
+		}
+		// Later links in the batch are validated against the earlier valid ones
+		parents[link.ChildID] = link.ParentID
+		valid = append(valid, link)
+		validIndexes = append(validIndexes, i)
+	}
+
+	if atomic && result.Rejected > 0 {
+		for _, i := range validIndexes {
+			result.Results[i] = LinkResult{Index: i, Status: LinkStatusSkipped}
+		}
+		return result, nil
+	}
+	if len(valid) == 0 {
+		return result, nil
+	}
+
+	if err := provider.CreateVersionLinks(valid); err != nil {
+		return nil, fmt.Errorf("version link insertion failed: %w", err)
+	}
+	for _, i := range validIndexes {
+		result.Results[i] = LinkResult{Index: i, Status: LinkStatusCreated}
+	}
+	result.Created = len(valid)
+	for _, link := range valid {
+		child, childErr := provider.GetVersionByID(link.ChildID)
+		parent, parentErr := provider.GetVersionByID(link.ParentID)
+		if childErr == nil && parentErr == nil {
+			notifyLinkCreated(codebaseID, child, parent)
+		}
+	}
+
+	historyMap, err := s.RebuildHistoryCache(codebaseID)
+	if err != nil {
+		return nil, fmt.Errorf("links created but history cache rebuild failed: %w", err)
+	}
+	result.Generation = historyMap.Generation
+	return result, nil
+}
+
+// validateLink resolves both ends of a link and checks it against the current parent relation.
+func validateLink(provider core.DataProvider, codebaseID string, l LinkRequest, parents map[string]string) (core.VersionLink, error) {
+	linkageType := l.LinkageType
+	switch linkageType {
+	case "":
+		linkageType = core.LinkageTypeSequential
+	case core.LinkageTypeSequential, core.LinkageTypeBranchFrom:
+	default:
+		return core.VersionLink{}, fmt.Errorf("invalid linkage type %q", l.LinkageType)
+	}
+
+	child, err := lookupVersion(provider, codebaseID, l.Child.Branch, l.Child.Version)
+	if err != nil {
+		return core.VersionLink{}, fmt.Errorf("child version not found: %w", err)
+	}
+	parent, err := lookupVersion(provider, codebaseID, l.Parent.Branch, l.Parent.Version)
+	if err != nil {
+		return core.VersionLink{}, fmt.Errorf("parent version not found: %w", err)
+	}
+	if child.ID == parent.ID {
+		return core.VersionLink{}, fmt.Errorf("invalid link: a version cannot be its own parent")
+	}
+
+	if existing, ok := parents[child.ID]; ok {
+		if existing == parent.ID {
+			return core.VersionLink{}, fmt.Errorf("duplicate link: %s/%s is already linked to %s/%s", l.Child.Branch, l.Child.Version, l.Parent.Branch, l.Parent.Version)
+		}
+		return core.VersionLink{}, fmt.Errorf("duplicate link: %s/%s already has a parent", l.Child.Branch, l.Child.Version)
+	}
+
+	// Walking up from the parent must never reach the child
+	for id, steps := parent.ID, 0; id != "" && steps <= len(parents); id, steps = parents[id], steps+1 {
+		if id == child.ID {
+			return core.VersionLink{}, fmt.Errorf("invalid link: %s/%s is an ancestor of %s/%s, linking would create a cycle",
+				l.Child.Branch, l.Child.Version, l.Parent.Branch, l.Parent.Version)
+		}
+	}
+
+	return core.VersionLink{
+		CodebaseID:  codebaseID,
+		ChildID:     child.ID,
+		ParentID:    parent.ID,
+		Branch:      l.Child.Branch,
+		LinkageType: linkageType,
+	}, nil
+}
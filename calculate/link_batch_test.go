@@ -0,0 +1,56 @@
+package calculate
+
+import (
+	"main/core"
+	"strings"
+	"testing"
+)
+
+// Each link of the batch is valid on its own against the unlinked versions; together the last one
+// closes the loop v1 -> v2 -> v3 -> v1.
+func TestCreateVersionLinksCycleWithinBatch(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		useMemoryBackends(t)
+		codebase := mustInitCodebase(t, "links")
+		for _, version := range []string{"v1", "v2", "v3"} {
+			files := snapshotFiles(map[string]string{"a.txt": version})
+			if _, err := NewUploadService().ProcessSnapshot(codebase.ID, version, "main", "", files, nil, false, SnapshotOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		link := func(child, parent string) LinkRequest {
+			return LinkRequest{Child: VersionIdentifier{"main", child}, Parent: VersionIdentifier{"main", parent}}
+		}
+		batch := []LinkRequest{link("v2", "v1"), link("v3", "v2"), link("v1", "v3")}
+
+		for i, l := range batch {
+			if _, err := validateLink(core.GetProvider(), codebase.ID, l, map[string]string{}); err != nil {
+				t.Fatalf("link %d on its own: %v", i, err)
+			}
+		}
+
+		result, err := NewHistoryService().CreateVersionLinks(codebase.ID, batch, atomic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := result.Results[2]
+		if last.Status != LinkStatusRejected || !strings.Contains(last.Error, "cycle") {
+			t.Errorf("atomic=%v: last link = %+v, want it rejected as a cycle", atomic, last)
+		}
+		wantStatus, wantCreated := LinkStatusCreated, 2
+		if atomic {
+			wantStatus, wantCreated = LinkStatusSkipped, 0
+		}
+		if result.Created != wantCreated || result.Rejected != 1 ||
+			result.Results[0].Status != wantStatus || result.Results[1].Status != wantStatus {
+			t.Errorf("atomic=%v: result = %+v, want the first two links %s", atomic, result, wantStatus)
+		}
+		edges, err := core.GetProvider().GetAllVersionEdgesForMap(codebase.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(edges) != wantCreated {
+			t.Errorf("atomic=%v: %d edges stored, want %d", atomic, len(edges), wantCreated)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"sort"
+)
+
+// defaultBranchOf returns the branch a codebase was initialized with.
+func defaultBranchOf(codebase *core.Codebase) string {
+	if codebase.Branch == "" {
+		return "main"
+	}
+	return codebase.Branch
+}
+
+func newLinkageDecision(parent *core.Version, linkageType core.LinkageType, reason string) *core.LinkageDecision {
+	return &core.LinkageDecision{
+		ParentVersionID: parent.ID,
+		ParentBranch:    parent.Branch,
+		ParentVersion:   parent.Version,
+		LinkageType:     linkageType,
+		Reason:          reason,
+	}
+}
+
+// closestBranchHead finds the head of another branch whose files (path and content hash) overlap
+// most with the given version. It returns nil when no head shares any file.
+func (s *HistoryService) closestBranchHead(provider core.DataProvider, codebaseID, versionID, branch string) (*core.Version, string, error) {
+	version, err := provider.GetVersionByID(versionID)
+	if err != nil {
+		return nil, "", err
+	}
+	files, err := provider.GetFileIndexesByTreeID(version.TreeID)
+	if err != nil {
+		return nil, "", fmt.Errorf("file index for version %s not found: %w", versionID, err)
+	}
+	content := make(map[string]string, len(files))
+	for _, f := range files {
+		if !f.IsDir() {
+			content[f.Path] = f.Hash
+		}
+	}
+
+	heads, err := provider.GetBranchHeadsForMap(codebaseID)
+	if err != nil {
+		return nil, "", err
+	}
+	codebase, err := provider.GetCodebaseByID(codebaseID)
+	if err != nil {
+		return nil, "", err
+	}
+	defaultBranch := defaultBranchOf(codebase)
+	branches := make([]string, 0, len(heads))
+	for b := range heads {
+		if b != branch {
+			branches = append(branches, b)
+		}
+	}
+	// Ties go to the default branch, then to the alphabetically first branch
+	sort.Slice(branches, func(i, j int) bool {
+		if (branches[i] == defaultBranch) != (branches[j] == defaultBranch) {
+			return branches[i] == defaultBranch
+		}
+		return branches[i] < branches[j]
+	})
+
+	var (
+		best      *core.Version
+		bestScore float64
+	)
+	for _, b := range branches {
+		head, err := provider.GetVersionByID(heads[b])
+		if err != nil {
+			continue
+		}
+		headFiles, err := provider.GetFileIndexesByTreeID(head.TreeID)
+		if err != nil {
+			continue
+		}
+		shared, headCount := 0, 0
+		for _, f := range headFiles {
+			if f.IsDir() {
+				continue
+			}
+			headCount++
+			if hash, ok := content[f.Path]; ok && hash == f.Hash {
+				shared++
+			}
+		}
+		// Jaccard similarity of the (path, hash) sets
+		union := len(content) + headCount - shared
+		if union == 0 || shared == 0 {
+			continue
+		}
+		if score := float64(shared) / float64(union); score > bestScore {
+			best, bestScore = head, score
+		}
+	}
+	if best == nil {
+		return nil, "", nil
+	}
+	if bestScore == 1 {
+		return best, fmt.Sprintf("content matches the head of branch %q exactly", best.Branch), nil
+	}
+	return best, fmt.Sprintf("content is closest to the head of branch %q (%.0f%% of files shared)", best.Branch, bestScore*100), nil
+}
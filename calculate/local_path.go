@@ -0,0 +1,212 @@
+package calculate
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"main/core"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A snapshot request without files can name a directory on the server in codebase_path, so a client
+// running next to the service doesn't have to upload its working copy. Only directories below one of
+// local_snapshot_roots can be read; without roots codebase_path is ignored as before. The walk doesn't
+// enter directories matching the ignore patterns, doesn't read ignored files and doesn't follow
+// symbolic links: links and entries that aren't regular files are skipped and listed in the response.
+// Files are recorded with their permission bits unless the request gives a mode. Entries that can't be
+// read fail the snapshot before anything is stored.
+
+// LocalPathError lists the entries below codebase_path that couldn't be read
+type LocalPathError struct {
+	Path       string             `json:"path"`
+	Unreadable []core.SkippedPath `json:"unreadable"`
+}
+
+func (e *LocalPathError) Error() string {
+	return fmt.Sprintf("invalid snapshot: %d entries below codebase_path %s can't be read", len(e.Unreadable), e.Path)
+}
+
+// LocalSnapshotsEnabled reports whether the config allows snapshots of server directories.
+func LocalSnapshotsEnabled() bool {
+	return len(core.GetConfig().LocalSnapshotRoots) > 0
+}
+
+// resolveLocalPath checks that dir is an existing directory below one of the configured roots and
+// returns it with symbolic links resolved, so a link can't lead out of the roots.
+func resolveLocalPath(dir string) (string, error) {
+	if !filepath.IsAbs(dir) {
+		return "", fmt.Errorf("invalid snapshot: codebase_path %s is not an absolute path", dir)
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("invalid snapshot: codebase_path %s does not exist", dir)
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid snapshot: codebase_path %s can't be read: %s", dir, pathErrorReason(err))
+	}
+	if info, err := os.Stat(resolved); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("invalid snapshot: codebase_path %s is not a directory", dir)
+	}
+	for _, root := range core.GetConfig().LocalSnapshotRoots {
+		if r, err := filepath.EvalSymlinks(root); err == nil && isWithin(r, resolved) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("invalid snapshot: codebase_path %s is outside the local_snapshot_roots of the server", dir)
+}
+
+func isWithin(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// pathErrorReason drops the path an fs error repeats, e.g. "permission denied".
+func pathErrorReason(err error) string {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err.Error()
+	}
+	return err.Error()
+}
+
+// walkLocalPath collects the regular files below root by slash path, with their permission bits as
+// octal modes, and the entries it skipped.
+func walkLocalPath(root string, patterns []string) (map[string]*SnapshotFile, map[string]string, []core.SkippedPath, error) {
+	files := make(map[string]*SnapshotFile)
+	modes := make(map[string]string)
+	var skipped, unreadable []core.SkippedPath
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		rel, relErr := filepath.Rel(root, path)
+		if relErr != nil {
+			return relErr
+		}
+		rel = filepath.ToSlash(rel)
+		if err != nil {
+			// A directory that can't be listed is reported once more after it was visited
+			if path == root {
+				return err
+			}
+			unreadable = append(unreadable, core.SkippedPath{Path: rel, Reason: pathErrorReason(err)})
+			return nil
+		}
+		if path == root {
+			return nil
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			skipped = append(skipped, core.SkippedPath{Path: rel, Reason: "symbolic link"})
+		case d.IsDir():
+			if ignoredEntry(patterns, strings.Split(rel, "/"), true) {
+				return filepath.SkipDir
+			}
+		case !d.Type().IsRegular():
+			skipped = append(skipped, core.SkippedPath{Path: rel, Reason: "not a regular file"})
+		case ignoredEntry(patterns, strings.Split(rel, "/"), false):
+			// Listed only to be counted as ignored, it is never read
+			if info, err := d.Info(); err == nil {
+				files[rel] = &SnapshotFile{Size: info.Size(), open: func() (multipart.File, error) { return os.Open(path) }}
+			}
+		default:
+			info, err := readableFile(path)
+			if err != nil {
+				unreadable = append(unreadable, core.SkippedPath{Path: rel, Reason: pathErrorReason(err)})
+				return nil
+			}
+			files[rel] = &SnapshotFile{Size: info.Size(), open: func() (multipart.File, error) { return os.Open(path) }}
+			if perm := info.Mode().Perm(); perm != 0 {
+				modes[rel] = fmt.Sprintf("%o", perm)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid snapshot: codebase_path %s can't be read: %s", root, pathErrorReason(err))
+	}
+	if len(unreadable) > 0 {
+		sort.Slice(unreadable, func(i, j int) bool { return unreadable[i].Path < unreadable[j].Path })
+		return nil, nil, nil, &LocalPathError{Path: root, Unreadable: unreadable}
+	}
+	sort.Slice(skipped, func(i, j int) bool { return skipped[i].Path < skipped[j].Path })
+	return files, modes, skipped, nil
+}
+
+// readableFile opens a file to make sure its content can be read later and returns its info.
+func readableFile(path string) (os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// checkWholeTree rejects the options that don't fit a snapshot of a whole directory tree.
+func checkWholeTree(source string, opts SnapshotOptions) error {
+	if opts.Base != nil || opts.Manifest != nil {
+		return fmt.Errorf("invalid snapshot: %s can't be combined with base or manifest, the whole tree is stored", source)
+	}
+	if err := validateIgnorePatterns(opts.Ignore); err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+	return nil
+}
+
+// checkLocalSnapshot validates the options of a snapshot read from a server directory and returns the
+// resolved directory.
+func checkLocalSnapshot(dir string, opts SnapshotOptions) (string, error) {
+	if err := checkWholeTree("codebase_path", opts); err != nil {
+		return "", err
+	}
+	return resolveLocalPath(dir)
+}
+
+// readTree collects the files of a directory for ProcessSnapshot and adds their modes to opts. A
+// directory without files needs allow_empty, like a request without files.
+func readTree(root, name string, codebase *core.Codebase, opts *SnapshotOptions) (map[string]*SnapshotFile, []core.SkippedPath, error) {
+	patterns := append(append([]string(nil), settingsFor(codebase).IgnorePatterns...), opts.Ignore...)
+	files, modes, skipped, err := walkLocalPath(root, patterns)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(files) == 0 && !opts.AllowEmpty && len(opts.Directories) == 0 {
+		return nil, nil, fmt.Errorf("invalid snapshot: %s holds no files (set allow_empty to record an empty snapshot)", name)
+	}
+	// Modes given with the request win over the permission bits on disk
+	for relPath, mode := range opts.Modes {
+		modes[filepath.ToSlash(relPath)] = mode
+	}
+	opts.Modes = modes
+	return files, skipped, nil
+}
+
+// ProcessLocalSnapshot creates a snapshot from the files below dir, a directory on the server, with
+// ProcessSnapshot.
+func (s *UploadService) ProcessLocalSnapshot(codebaseID, dir, ver, branch, message string, branchFrom *BranchFrom, autoLinkage bool, opts SnapshotOptions) (*core.SnapshotResponse, error) {
+	codebase, err := getActiveCodebase(core.GetProvider(), codebaseID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid codebase_id: %s, error: %w", codebaseID, err)
+	}
+	root, err := checkLocalSnapshot(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	files, skipped, err := readTree(root, "codebase_path "+dir, codebase, &opts)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Snapshot of local directory %s: %d files, %d skipped", root, len(files), len(skipped))
+
+	resp, err := s.ProcessSnapshot(codebaseID, ver, branch, message, files, branchFrom, autoLinkage, opts)
+	if err != nil {
+		return nil, err
+	}
+	resp.SkippedPaths = skipped
+	return resp, nil
+}
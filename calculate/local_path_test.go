@@ -0,0 +1,166 @@
+package calculate
+
+import (
+	"errors"
+	"main/core"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useLocalRoots allows local snapshots below roots for the test.
+func useLocalRoots(t *testing.T, roots ...string) {
+	core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), LocalSnapshotRoots: roots})
+	t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+}
+
+func writeTree(t *testing.T, dir string, contents map[string]string) {
+	t.Helper()
+	for path, content := range contents {
+		full := filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResolveLocalPath(t *testing.T) {
+	base := t.TempDir()
+	root, outside := filepath.Join(base, "root"), filepath.Join(base, "outside")
+	writeTree(t, root, map[string]string{"project/a.txt": "a", "file.txt": "f"})
+	writeTree(t, outside, map[string]string{"secret/key.txt": "k"})
+	// A link to the root itself is as good as the root
+	mustSymlink(t, root, filepath.Join(base, "alias"))
+	mustSymlink(t, filepath.Join(outside, "secret"), filepath.Join(root, "escape"))
+	mustSymlink(t, filepath.Join(root, "project"), filepath.Join(root, "inside"))
+	useLocalRoots(t, filepath.Join(base, "alias"))
+
+	for _, tt := range []struct {
+		dir     string
+		want    string
+		wantErr string
+	}{
+		{filepath.Join(root, "project"), filepath.Join(root, "project"), ""},
+		{root, root, ""},
+		{filepath.Join(base, "alias", "project"), filepath.Join(root, "project"), ""},
+		{filepath.Join(root, "inside"), filepath.Join(root, "project"), ""},
+		{filepath.Join(root, "escape"), "", "outside the local_snapshot_roots"},
+		{filepath.Join(outside, "secret"), "", "outside the local_snapshot_roots"},
+		{base, "", "outside the local_snapshot_roots"},
+		// A sibling whose name starts with the root's isn't below it
+		{root + "2", "", "does not exist"},
+		{filepath.Join(root, "missing"), "", "does not exist"},
+		{filepath.Join(root, "file.txt"), "", "not a directory"},
+		{"root/project", "", "not an absolute path"},
+	} {
+		got, err := resolveLocalPath(tt.dir)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("resolveLocalPath(%s) = %s, %v, want an error containing %q", tt.dir, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("resolveLocalPath(%s) = %s, %v, want %s", tt.dir, got, err, tt.want)
+		}
+	}
+
+	if err := os.MkdirAll(root+"2", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveLocalPath(root + "2"); err == nil || !strings.Contains(err.Error(), "outside the local_snapshot_roots") {
+		t.Errorf("resolveLocalPath of a sibling of the root = %v, want it refused", err)
+	}
+}
+
+func mustSymlink(t *testing.T, target, link string) {
+	t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("symbolic links aren't supported: %v", err)
+	}
+}
+
+// The walk neither follows links nor reads ignored files, and a snapshot only stores what is below
+// the directory itself.
+func TestProcessLocalSnapshot(t *testing.T) {
+	_, storage := useMemoryBackends(t)
+	base := t.TempDir()
+	root, outside := filepath.Join(base, "root"), filepath.Join(base, "outside")
+	writeTree(t, root, map[string]string{"a.txt": "alpha", "dir/b.txt": "beta", "build/out.bin": "ignored", "debug.log": "ignored"})
+	writeTree(t, outside, map[string]string{"secret.txt": "must not be read"})
+	mustSymlink(t, filepath.Join(outside, "secret.txt"), filepath.Join(root, "leak.txt"))
+	mustSymlink(t, outside, filepath.Join(root, "leakdir"))
+	if err := os.Chmod(filepath.Join(root, "a.txt"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	useLocalRoots(t, root)
+
+	codebase := mustInitCodebase(t, "local")
+	uploads := NewUploadService()
+	resp, err := uploads.ProcessLocalSnapshot(codebase.ID, root, "v1", "main", "", nil, false, SnapshotOptions{Ignore: []string{"build/", "*.log"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSkipped := []core.SkippedPath{{Path: "leak.txt", Reason: "symbolic link"}, {Path: "leakdir", Reason: "symbolic link"}}
+	if !reflect.DeepEqual(resp.SkippedPaths, wantSkipped) {
+		t.Errorf("skipped = %+v, want %+v", resp.SkippedPaths, wantSkipped)
+	}
+	// The ignored build directory isn't entered, only debug.log is counted
+	if resp.IgnoredFiles != 1 {
+		t.Errorf("ignored files = %d, want 1", resp.IgnoredFiles)
+	}
+	stored := make(map[string]string)
+	for path := range fileKeys(t, resp.Version.ID) {
+		stored[path] = readStoredFile(t, storage, resp.Version.ID, path)
+	}
+	if want := map[string]string{"a.txt": "alpha", "dir/b.txt": "beta"}; !reflect.DeepEqual(stored, want) {
+		t.Errorf("stored files = %v, want %v", stored, want)
+	}
+	files, err := core.GetProvider().GetFileIndexesByTreeID(resp.Version.TreeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if want := map[string]uint32{"a.txt": 0o755, "dir/b.txt": 0o644}[f.Path]; f.Mode != want {
+			t.Errorf("mode of %s = %o, want %o", f.Path, f.Mode, want)
+		}
+	}
+
+	if _, err := uploads.ProcessLocalSnapshot(codebase.ID, filepath.Join(root, "leakdir"), "v2", "main", "", nil, false, SnapshotOptions{}); err == nil || !strings.Contains(err.Error(), "outside the local_snapshot_roots") {
+		t.Errorf("snapshot through a link out of the root = %v, want it refused", err)
+	}
+	if _, err := uploads.ProcessLocalSnapshot(codebase.ID, outside, "v2", "main", "", nil, false, SnapshotOptions{}); err == nil || !strings.Contains(err.Error(), "outside the local_snapshot_roots") {
+		t.Errorf("snapshot outside the root = %v, want it refused", err)
+	}
+
+	// Without roots codebase_path can't be read at all
+	useLocalRoots(t)
+	if _, err := uploads.ProcessLocalSnapshot(codebase.ID, root, "v2", "main", "", nil, false, SnapshotOptions{}); err == nil {
+		t.Error("snapshot with no local_snapshot_roots configured succeeded")
+	}
+}
+
+func TestProcessLocalSnapshotUnreadableFile(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read files without read permission")
+	}
+	useMemoryBackends(t)
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a.txt": "alpha", "locked.txt": "no access"})
+	if err := os.Chmod(filepath.Join(root, "locked.txt"), 0); err != nil {
+		t.Fatal(err)
+	}
+	useLocalRoots(t, root)
+
+	codebase := mustInitCodebase(t, "local")
+	_, err := NewUploadService().ProcessLocalSnapshot(codebase.ID, root, "v1", "main", "", nil, false, SnapshotOptions{})
+	var pathErr *LocalPathError
+	if !errors.As(err, &pathErr) || len(pathErr.Unreadable) != 1 || pathErr.Unreadable[0].Path != "locked.txt" {
+		t.Fatalf("snapshot = %v, want locked.txt reported unreadable", err)
+	}
+}
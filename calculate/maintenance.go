@@ -0,0 +1,232 @@
+package calculate
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/core"
+	"sort"
+)
+
+// MaintenanceService handles repair and verification of derived metadata
+type MaintenanceService struct {
+	historyService *HistoryService
+}
+
+func NewMaintenanceService() *MaintenanceService {
+	return &MaintenanceService{
+		historyService: NewHistoryService(),
+	}
+}
+
+// StaleCache describes a history cache whose contents disagreed with the raw data
+type StaleCache struct {
+	CodebaseID   string `json:"codebase_id"`
+	Missing      bool   `json:"missing,omitempty"`       // no cache file, or it could not be parsed
+	StaleNodes   int    `json:"stale_nodes,omitempty"`   // cached nodes that no longer exist
+	MissingNodes int    `json:"missing_nodes,omitempty"` // existing nodes absent from the cache
+	StaleEdges   bool   `json:"stale_edges,omitempty"`
+	StaleRefs    bool   `json:"stale_refs,omitempty"`
+}
+
+// DerivedRebuildReport lists every discrepancy found while rebuilding derived data
+type DerivedRebuildReport struct {
+	core.IndexRebuildReport
+	StaleCaches  []StaleCache `json:"stale_caches"`
+	OrphanCaches []string     `json:"orphan_caches"` // caches of codebases that no longer exist (removed)
+	Rebuilt      int          `json:"rebuilt_caches"`
+}
+
+// Summary returns a one-line description suitable for logs.
+func (r *DerivedRebuildReport) Summary() string {
+	return fmt.Sprintf("%d stale caches, %d orphan caches, %d dangling refs, %d orphan trees, %d versions missing trees, %d dangling edges (%d caches rebuilt)",
+		len(r.StaleCaches), len(r.OrphanCaches), len(r.DanglingRefs), len(r.OrphanTrees), len(r.MissingTrees), len(r.DanglingEdges), r.Rebuilt)
+}
+
+// RebuildDerived reconstructs every derived structure (indexes, branch refs, history caches)
+// from the raw codebase, version, file index and mapping data, ignoring what is currently cached.
+func (s *MaintenanceService) RebuildDerived() (*DerivedRebuildReport, error) {
+	provider := core.GetProvider()
+
+	indexReport, err := provider.RebuildIndexes()
+	if err != nil {
+		return nil, fmt.Errorf("index rebuild failed: %w", err)
+	}
+	report := &DerivedRebuildReport{
+		IndexRebuildReport: *indexReport,
+		StaleCaches:        []StaleCache{},
+		OrphanCaches:       []string{},
+	}
+
+	codebases, err := provider.ListCodebases()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(codebases))
+	for _, c := range codebases {
+		known[c.ID] = true
+	}
+
+	cached, err := provider.ListHistoryCaches()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list history caches: %w", err)
+	}
+	for _, id := range cached {
+		if known[id] {
+			continue
+		}
+		if err := provider.DeleteHistoryCache(id); err != nil {
+			return nil, fmt.Errorf("failed to remove orphan cache %s: %w", id, err)
+		}
+		report.OrphanCaches = append(report.OrphanCaches, id)
+	}
+	sort.Strings(report.OrphanCaches)
+
+	for _, c := range codebases {
+		var previous *core.VersionMapResponse
+		if data, err := provider.GetHistoryCache(c.ID); err == nil {
+			var m core.VersionMapResponse
+			if json.Unmarshal(data, &m) == nil {
+				previous = &m
+			}
+		}
+
+		// Rebuild from scratch, the existing cache is only used for the report
+		if err := provider.DeleteHistoryCache(c.ID); err != nil {
+			return nil, fmt.Errorf("failed to remove cache of %s: %w", c.ID, err)
+		}
+		rebuilt, err := s.historyService.RebuildHistoryCache(c.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to rebuild cache of %s: %w", c.ID, err)
+		}
+		report.Rebuilt++
+
+		if stale := compareHistoryCache(c.ID, previous, rebuilt); stale != nil {
+			report.StaleCaches = append(report.StaleCaches, *stale)
+		}
+	}
+
+	log.Printf("Derived data rebuilt: %s", report.Summary())
+	return report, nil
+}
+
+// compareHistoryCache reports how a previously cached map differs from a freshly built one, nil if identical.
+func compareHistoryCache(codebaseID string, previous, current *core.VersionMapResponse) *StaleCache {
+	stale := &StaleCache{CodebaseID: codebaseID}
+	if previous == nil {
+		stale.Missing = true
+		return stale
+	}
+
+	currentNodes := make(map[string]bool, len(current.Nodes))
+	for _, n := range current.Nodes {
+		currentNodes[n.ID] = true
+	}
+	previousNodes := make(map[string]bool, len(previous.Nodes))
+	for _, n := range previous.Nodes {
+		previousNodes[n.ID] = true
+		if !currentNodes[n.ID] {
+			stale.StaleNodes++
+		}
+	}
+	for id := range currentNodes {
+		if !previousNodes[id] {
+			stale.MissingNodes++
+		}
+	}
+
+	previousEdges := make(map[edgeKey]bool, len(previous.Edges))
+	for _, e := range previous.Edges {
+		previousEdges[keyOfEdge(e)] = true
+	}
+	stale.StaleEdges = len(previous.Edges) != len(current.Edges)
+	for _, e := range current.Edges {
+		if !previousEdges[keyOfEdge(e)] {
+			stale.StaleEdges = true
+		}
+	}
+
+	stale.StaleRefs = len(previous.Refs) != len(current.Refs)
+	for branch, id := range current.Refs {
+		if previous.Refs[branch] != id {
+			stale.StaleRefs = true
+		}
+	}
+
+	if stale.StaleNodes == 0 && stale.MissingNodes == 0 && !stale.StaleEdges && !stale.StaleRefs {
+		return nil
+	}
+	return stale
+}
+
+// MetadataRecoveries lists the metadata files that were corrupt at startup and restored from a backup.
+func (s *MaintenanceService) MetadataRecoveries() ([]core.MetadataRecovery, error) {
+	return core.GetProvider().MetadataRecoveries()
+}
+
+// ConvertMetadataEncoding rewrites the metadata files that aren't in the configured encoding.
+func (s *MaintenanceService) ConvertMetadataEncoding() (*core.EncodingConversion, error) {
+	return core.GetProvider().ConvertMetadataEncoding()
+}
+
+// CacheStats reports the in-memory caches, for tuning their budgets
+type CacheStats struct {
+	TreeCache core.TreeCacheStats `json:"tree_cache"`
+	ReadCache core.BlobCacheStats `json:"read_cache"`
+}
+
+// CacheStats returns the current size and counters of the file tree cache and the read cache.
+func (s *MaintenanceService) CacheStats() CacheStats {
+	return CacheStats{
+		TreeCache: core.GetProvider().TreeCacheStats(),
+		ReadCache: core.GetBlobCache().Stats(),
+	}
+}
+
+// CheckConsistency reports dangling references in the metadata and history caches of deleted
+// codebases. With repair the dangling edges, refs and tags and the orphan caches are removed;
+// versions and trees never are.
+func (s *MaintenanceService) CheckConsistency(repair bool) (*core.ConsistencyReport, error) {
+	provider := core.GetProvider()
+	report, err := provider.CheckConsistency(repair)
+	if err != nil {
+		return nil, err
+	}
+
+	codebases, err := provider.ListCodebases()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(codebases))
+	for _, c := range codebases {
+		known[c.ID] = true
+		// Removed edges and refs may still be in the cached maps
+		if repair && report.Repaired > 0 {
+			if _, err := s.historyService.RebuildHistoryCache(c.ID); err != nil {
+				return report, fmt.Errorf("failed to rebuild cache of %s: %w", c.ID, err)
+			}
+		}
+	}
+	cached, err := provider.ListHistoryCaches()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list history caches: %w", err)
+	}
+	for _, id := range cached {
+		if known[id] {
+			continue
+		}
+		report.OrphanHistoryCaches = append(report.OrphanHistoryCaches, id)
+		if !repair {
+			continue
+		}
+		if err := provider.DeleteHistoryCache(id); err != nil {
+			return report, fmt.Errorf("failed to remove orphan cache %s: %w", id, err)
+		}
+		report.Repaired++
+	}
+	sort.Strings(report.OrphanHistoryCaches)
+	if repair && report.Repaired > 0 {
+		log.Printf("Consistency repair: %s", report.Summary())
+	}
+	return report, nil
+}
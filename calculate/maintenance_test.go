@@ -0,0 +1,127 @@
+package calculate
+
+import (
+	"encoding/json"
+	"main/core"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// openJSONBackends opens a JSON provider on dir with memory storage, for tests that edit the files.
+func openJSONBackends(t *testing.T, dir string) *core.JSONFileProvider {
+	t.Helper()
+	provider, err := core.NewJSONFileProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { provider.Close() })
+	core.SetProvidersForTesting(provider, core.NewMemoryStorage())
+	return provider
+}
+
+// editJSONFile rewrites a metadata file through edit, as someone fixing it by hand would.
+func editJSONFile(t *testing.T, path string, edit func(data map[string]interface{})) {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	edit(data)
+	if raw, err = json.Marshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mapNodeLabels(historyMap *core.VersionMapResponse) string {
+	var labels []string
+	for _, n := range historyMap.Nodes {
+		labels = append(labels, n.Branch+"/"+n.Version)
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
+
+// A history cache and a branch ref edited by hand are repaired by RebuildDerived, and the map
+// served afterwards matches the raw data.
+func TestRebuildDerivedRepairsCacheAndRefs(t *testing.T) {
+	dir := t.TempDir()
+	provider := openJSONBackends(t, dir)
+	codebase := mustInitCodebase(t, "derived")
+	v1 := mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"a.txt": "1"})
+	v2 := mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{"a.txt": "2"})
+	if _, err := NewBranchService().CreateBranch(codebase.ID, "release", VersionIdentifier{Branch: "main", Version: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	want := versionMap(t, codebase.ID)
+	if want.Refs["release"] != v1.Version.ID {
+		t.Fatalf("release points at %s, want v1", want.Refs["release"])
+	}
+	if err := provider.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cache loses v2 and gains a node that never existed; release points at a missing version
+	cachePath := filepath.Join(dir, "history_cache", codebase.ID+".json")
+	editJSONFile(t, cachePath, func(data map[string]interface{}) {
+		nodes := data["nodes"].([]interface{})
+		for i, n := range nodes {
+			if n.(map[string]interface{})["id"] == v2.Version.ID {
+				nodes[i] = map[string]interface{}{"id": "ghost", "version": "ghost", "branch": "main"}
+			}
+		}
+	})
+	editJSONFile(t, filepath.Join(dir, "codebases", codebase.ID, "refs.json"), func(data map[string]interface{}) {
+		for _, ref := range data {
+			ref.(map[string]interface{})["version_id"] = "deleted-version"
+		}
+	})
+
+	provider = openJSONBackends(t, dir)
+	if got := mapNodeLabels(versionMap(t, codebase.ID)); !strings.Contains(got, "main/ghost") {
+		t.Fatalf("map before the rebuild = %s, want the edited cache served", got)
+	}
+
+	report, err := NewMaintenanceService().RebuildDerived()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.DanglingRefs) != 1 || report.DanglingRefs[0].Branch != "release" {
+		t.Errorf("dangling refs = %+v, want release", report.DanglingRefs)
+	}
+	if len(report.StaleCaches) != 1 || report.StaleCaches[0].StaleNodes != 1 || report.StaleCaches[0].MissingNodes != 1 {
+		t.Errorf("stale caches = %+v, want one ghost node and v2 missing", report.StaleCaches)
+	}
+
+	got := versionMap(t, codebase.ID)
+	if mapNodeLabels(got) != mapNodeLabels(want) {
+		t.Errorf("map after the rebuild has %s, want %s", mapNodeLabels(got), mapNodeLabels(want))
+	}
+	if _, ok := got.Refs["release"]; ok || got.Refs["main"] != v2.Version.ID {
+		t.Errorf("refs after the rebuild = %v, want main at v2 and the dangling release gone", got.Refs)
+	}
+	if len(got.Edges) != 1 || got.Edges[0].From != v1.Version.ID || got.Edges[0].To != v2.Version.ID {
+		t.Errorf("edges after the rebuild = %+v, want v1 -> v2", got.Edges)
+	}
+
+	// The repair is persisted
+	if err := provider.Close(); err != nil {
+		t.Fatal(err)
+	}
+	openJSONBackends(t, dir)
+	if ref, err := core.GetProvider().GetBranchRef(codebase.ID, "release"); err != nil || ref != nil {
+		t.Errorf("release ref after reopening = %+v, %v, want it removed", ref, err)
+	}
+	if again, err := NewMaintenanceService().RebuildDerived(); err != nil || len(again.StaleCaches) != 0 || len(again.DanglingRefs) != 0 {
+		t.Errorf("second rebuild = %+v, %v, want nothing left to repair", again, err)
+	}
+}
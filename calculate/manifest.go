@@ -0,0 +1,115 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ManifestEntry declares a file the client intends to upload
+type ManifestEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash,omitempty"` // optional sha256 of the original content
+}
+
+// ManifestMismatch describes a declared file whose received content differs from the manifest
+type ManifestMismatch struct {
+	Path     string `json:"path"`
+	Expected string `json:"expected"`
+	Received string `json:"received"`
+}
+
+// ManifestError lists every discrepancy between the manifest and the received files
+type ManifestError struct {
+	Missing      []string           `json:"missing,omitempty"`
+	Unexpected   []string           `json:"unexpected,omitempty"`
+	SizeMismatch []ManifestMismatch `json:"size_mismatch,omitempty"`
+	HashMismatch []ManifestMismatch `json:"hash_mismatch,omitempty"`
+}
+
+func (e *ManifestError) Error() string {
+	return fmt.Sprintf("upload does not match manifest: %d missing, %d unexpected, %d size mismatches, %d hash mismatches",
+		len(e.Missing), len(e.Unexpected), len(e.SizeMismatch), len(e.HashMismatch))
+}
+
+func (e *ManifestError) empty() bool {
+	return len(e.Missing) == 0 && len(e.Unexpected) == 0 && len(e.SizeMismatch) == 0 && len(e.HashMismatch) == 0
+}
+
+func manifestByPath(manifest []ManifestEntry) map[string]ManifestEntry {
+	byPath := make(map[string]ManifestEntry, len(manifest))
+	for _, entry := range manifest {
+		byPath[filepath.ToSlash(entry.Path)] = entry
+	}
+	return byPath
+}
+
+// checkManifestFiles compares received multipart files with the manifest by path and size. Entries
+// resolved to stored content (known) count as received. It runs before any blob is written so
+// truncated uploads fail early.
+func checkManifestFiles(manifest []ManifestEntry, files map[string]*SnapshotFile, known []core.File) error {
+	expected := manifestByPath(manifest)
+	result := &ManifestError{}
+	received := make(map[string]bool, len(files)+len(known))
+	for _, f := range known {
+		received[f.Path] = true
+	}
+
+	for relPath, header := range files {
+		received[filepath.ToSlash(relPath)] = true
+		entry, ok := expected[filepath.ToSlash(relPath)]
+		if !ok {
+			result.Unexpected = append(result.Unexpected, relPath)
+			continue
+		}
+		if header.Size != entry.Size {
+			result.SizeMismatch = append(result.SizeMismatch, ManifestMismatch{
+				Path:     entry.Path,
+				Expected: fmt.Sprint(entry.Size),
+				Received: fmt.Sprint(header.Size),
+			})
+		}
+	}
+	for path := range expected {
+		if !received[path] {
+			result.Missing = append(result.Missing, path)
+		}
+	}
+
+	if result.empty() {
+		return nil
+	}
+	sort.Strings(result.Missing)
+	sort.Strings(result.Unexpected)
+	return result
+}
+
+// checkManifestHashes verifies declared hashes against the hashes computed while processing files.
+func checkManifestHashes(manifest []ManifestEntry, processed []core.File) error {
+	expected := manifestByPath(manifest)
+	result := &ManifestError{}
+	for _, f := range processed {
+		path := f.Path
+		if f.OriginalPath != "" {
+			path = f.OriginalPath
+		}
+		entry, ok := expected[path]
+		if !ok || entry.Hash == "" {
+			continue
+		}
+		if !strings.EqualFold(entry.Hash, f.Hash) {
+			result.HashMismatch = append(result.HashMismatch, ManifestMismatch{
+				Path:     path,
+				Expected: entry.Hash,
+				Received: f.Hash,
+			})
+		}
+	}
+	if result.empty() {
+		return nil
+	}
+	return result
+}
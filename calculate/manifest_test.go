@@ -0,0 +1,79 @@
+package calculate
+
+import (
+	"errors"
+	"main/core"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProcessSnapshotChecksManifest(t *testing.T) {
+	contents := map[string]string{"a.txt": "alpha", "dir/b.txt": "beta"}
+	tests := []struct {
+		name     string
+		manifest []ManifestEntry
+		want     ManifestError
+	}{
+		{
+			name: "declared file missing",
+			manifest: []ManifestEntry{
+				{Path: "a.txt", Size: 5}, {Path: "dir/b.txt", Size: 4}, {Path: "dir/c.txt", Size: 10},
+			},
+			want: ManifestError{Missing: []string{"dir/c.txt"}},
+		},
+		{
+			name:     "undeclared file",
+			manifest: []ManifestEntry{{Path: "a.txt", Size: 5}},
+			want:     ManifestError{Unexpected: []string{"dir/b.txt"}},
+		},
+		{
+			name:     "truncated file",
+			manifest: []ManifestEntry{{Path: "a.txt", Size: 5}, {Path: "dir/b.txt", Size: 400}},
+			want:     ManifestError{SizeMismatch: []ManifestMismatch{{Path: "dir/b.txt", Expected: "400", Received: "4"}}},
+		},
+		{
+			name: "wrong hash",
+			manifest: []ManifestEntry{
+				{Path: "a.txt", Size: 5, Hash: strings.ToUpper(sha256Hex("alpha"))}, {Path: "dir/b.txt", Size: 4, Hash: sha256Hex("gamma")},
+			},
+			want: ManifestError{HashMismatch: []ManifestMismatch{{Path: "dir/b.txt", Expected: sha256Hex("gamma"), Received: sha256Hex("beta")}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, storage := useMemoryBackends(t)
+			codebase := mustInitCodebase(t, "manifest")
+			_, err := NewUploadService().ProcessSnapshot(codebase.ID, "v1", "main", "", snapshotFiles(contents), nil, true, SnapshotOptions{Manifest: tt.manifest})
+			var manifestErr *ManifestError
+			if !errors.As(err, &manifestErr) {
+				t.Fatalf("snapshot = %v, want a ManifestError", err)
+			}
+			if !reflect.DeepEqual(*manifestErr, tt.want) {
+				t.Errorf("manifest error = %+v, want %+v", *manifestErr, tt.want)
+			}
+			if versions, _ := provider.ListVersions(codebase.ID); len(versions) != 0 {
+				t.Errorf("%d versions committed from an upload that doesn't match its manifest", len(versions))
+			}
+			if objects := storedObjects(t, storage); len(objects) != 0 {
+				t.Errorf("objects %v left after the refused upload", objects)
+			}
+		})
+	}
+}
+
+func TestManifestRequired(t *testing.T) {
+	useMemoryBackends(t)
+	codebase, err := NewInitService().InitializeCodebase("strict", "", "main", &core.CodebaseSettings{ManifestRequired: true}, InitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"a.txt": "alpha"}
+	if _, err := NewUploadService().ProcessSnapshot(codebase.ID, "v1", "main", "", snapshotFiles(files), nil, true, SnapshotOptions{}); err == nil || !strings.Contains(err.Error(), "requires a manifest") {
+		t.Errorf("snapshot without a manifest = %v, want it refused", err)
+	}
+	manifest := []ManifestEntry{{Path: "a.txt", Size: 5, Hash: sha256Hex("alpha")}}
+	if _, err := NewUploadService().ProcessSnapshot(codebase.ID, "v1", "main", "", snapshotFiles(files), nil, true, SnapshotOptions{Manifest: manifest}); err != nil {
+		t.Errorf("snapshot matching its manifest = %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package calculate
+
+import (
+	"main/core"
+)
+
+// MergeBase is the nearest common ancestor of two versions
+type MergeBase struct {
+	CodebaseID string        `json:"codebase_id"`
+	A          *core.Version `json:"a"`
+	B          *core.Version `json:"b"`
+	Found      bool          `json:"found"`
+	Ancestor   *core.Version `json:"ancestor,omitempty"`
+	DistanceA  int           `json:"distance_a"` // parent edges from A to the ancestor
+	DistanceB  int           `json:"distance_b"` // parent edges from B to the ancestor
+	Message    string        `json:"message,omitempty"`
+}
+
+// CommonAncestor walks parent edges from both versions and returns the shared ancestor closest to them,
+// measured by the sum of the edges walked from each side; ties go to the newer version. A version is
+// its own ancestor, so when one version descends from the other the older one is returned. Versions
+// without any shared history are reported with Found false rather than as an error.
+func (s *HistoryService) CommonAncestor(codebaseID string, a, b VersionIdentifier) (*MergeBase, error) {
+	provider := core.GetProvider()
+	if _, err := getActiveCodebase(provider, codebaseID); err != nil {
+		return nil, err
+	}
+	versionA, err := resolveVersion(provider, codebaseID, a.Branch, a.Version)
+	if err != nil {
+		return nil, err
+	}
+	versionB, err := resolveVersion(provider, codebaseID, b.Branch, b.Version)
+	if err != nil {
+		return nil, err
+	}
+	edges, err := provider.GetAllVersionEdgesForMap(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	parents := make(map[string][]string)
+	for _, e := range edges {
+		parents[e.To] = append(parents[e.To], e.From)
+	}
+
+	result := &MergeBase{CodebaseID: codebaseID, A: versionA, B: versionB}
+	fromA := ancestorDistances(parents, versionA.ID)
+	fromB := ancestorDistances(parents, versionB.ID)
+
+	var best *core.Version
+	for id, da := range fromA {
+		db, ok := fromB[id]
+		if !ok {
+			continue
+		}
+		if best != nil {
+			bestSum := result.DistanceA + result.DistanceB
+			if da+db > bestSum {
+				continue
+			}
+			if da+db == bestSum {
+				candidate, err := provider.GetVersionByID(id)
+				if err != nil || !candidate.CreatedAt.After(best.CreatedAt) {
+					continue
+				}
+			}
+		}
+		v, err := provider.GetVersionByID(id)
+		if err != nil {
+			continue
+		}
+		best, result.DistanceA, result.DistanceB = v, da, db
+	}
+
+	if best == nil {
+		result.DistanceA, result.DistanceB = 0, 0
+		result.Message = "no common ancestor"
+		return result, nil
+	}
+	result.Found = true
+	result.Ancestor = best
+	return result, nil
+}
+
+// ancestorDistances returns every ancestor of start, start included, with the length of the shortest
+// parent path to it.
+func ancestorDistances(parents map[string][]string, start string) map[string]int {
+	dist := map[string]int{start: 0}
+	queue := []string{start}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, parent := range parents[id] {
+			if _, seen := dist[parent]; seen {
+				continue
+			}
+			dist[parent] = dist[id] + 1
+			queue = append(queue, parent)
+		}
+	}
+	return dist
+}
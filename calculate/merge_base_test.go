@@ -0,0 +1,76 @@
+package calculate
+
+import (
+	"main/core"
+	"testing"
+)
+
+func TestCommonAncestor(t *testing.T) {
+	useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "merge-base")
+	history := NewHistoryService()
+	versions := []struct {
+		branch, version string
+		parents         []VersionIdentifier
+	}{
+		// v1 forks into a1 and b1, which merge again into v2: a diamond
+		{"main", "v1", nil},
+		{"feature-a", "a1", []VersionIdentifier{{"main", "v1"}}},
+		{"feature-b", "b1", []VersionIdentifier{{"main", "v1"}}},
+		{"main", "v2", []VersionIdentifier{{"feature-a", "a1"}, {"feature-b", "b1"}}},
+		{"feature-a", "a2", []VersionIdentifier{{"main", "v2"}}},
+		{"feature-b", "b2", []VersionIdentifier{{"feature-b", "b1"}}},
+		// x1 and x2 are both merged into y1 and y2, which have two nearest common ancestors
+		{"cross", "x1", []VersionIdentifier{{"main", "v1"}}},
+		{"cross", "x2", []VersionIdentifier{{"main", "v1"}}},
+		{"cross", "y1", []VersionIdentifier{{"cross", "x1"}, {"cross", "x2"}}},
+		{"cross", "y2", []VersionIdentifier{{"cross", "x1"}, {"cross", "x2"}}},
+		{"orphan", "o1", nil},
+	}
+	for _, v := range versions {
+		files := snapshotFiles(map[string]string{"a.txt": v.version})
+		if _, err := NewUploadService().ProcessSnapshot(codebase.ID, v.version, v.branch, "", files, nil, false, SnapshotOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		for _, parent := range v.parents {
+			linkageType := core.LinkageTypeSequential
+			if parent.Branch != v.branch {
+				linkageType = core.LinkageTypeBranchFrom
+			}
+			if err := history.CreateVersionLinkWithType(codebase.ID, VersionIdentifier{v.branch, v.version}, parent, linkageType); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		a, b         VersionIdentifier
+		want         string // version label of the ancestor, "" when there is none
+		wantA, wantB int
+	}{
+		{VersionIdentifier{"feature-a", "a1"}, VersionIdentifier{"feature-b", "b1"}, "v1", 1, 1},
+		{VersionIdentifier{"feature-a", "a2"}, VersionIdentifier{"feature-b", "b2"}, "b1", 2, 1},
+		{VersionIdentifier{"main", "v2"}, VersionIdentifier{"feature-a", "a1"}, "a1", 1, 0},
+		{VersionIdentifier{"feature-a", "a2"}, VersionIdentifier{"feature-a", "a2"}, "a2", 0, 0},
+		{VersionIdentifier{"cross", "y1"}, VersionIdentifier{"cross", "y2"}, "x2", 1, 1},
+		{VersionIdentifier{"cross", "y1"}, VersionIdentifier{"feature-a", "a2"}, "v1", 2, 3},
+		{VersionIdentifier{"orphan", "o1"}, VersionIdentifier{"main", "v2"}, "", 0, 0},
+	}
+	for _, tt := range tests {
+		base, err := history.CommonAncestor(codebase.ID, tt.a, tt.b)
+		if err != nil {
+			t.Errorf("merge base of %v and %v: %v", tt.a, tt.b, err)
+			continue
+		}
+		got := ""
+		if base.Found {
+			got = base.Ancestor.Version
+		} else if base.Message != "no common ancestor" {
+			t.Errorf("merge base of %v and %v without a message", tt.a, tt.b)
+		}
+		if got != tt.want || base.DistanceA != tt.wantA || base.DistanceB != tt.wantB {
+			t.Errorf("merge base of %v and %v = %q at %d/%d, want %q at %d/%d",
+				tt.a, tt.b, got, base.DistanceA, base.DistanceB, tt.want, tt.wantA, tt.wantB)
+		}
+	}
+}
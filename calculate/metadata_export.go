@@ -0,0 +1,116 @@
+package calculate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"main/core"
+	"sort"
+	"time"
+)
+
+// MetadataExportFormat identifies the layout of the document written by ExportMetadata
+const MetadataExportFormat = "cvcs-metadata/1"
+
+// ExportMetadata writes every metadata record of a codebase to w as one JSON document: the codebase,
+// its versions (oldest first), the file list of each tree unless includeTrees is false, lineage edges,
+// branch refs and tags. Stored objects are not included.
+//
+// Everything except the file lists is read before the first byte is written, so lookup errors are
+// returned with nothing written. File lists are encoded one tree at a time to keep memory flat for
+// large codebases; an error while writing them leaves a truncated document.
+func (s *BundleService) ExportMetadata(w io.Writer, codebaseID string, includeTrees bool) error {
+	provider := core.GetProvider()
+	codebase, err := getActiveCodebase(provider, codebaseID)
+	if err != nil {
+		return err
+	}
+	versions, err := provider.ListVersions(codebaseID)
+	if err != nil {
+		return fmt.Errorf("version query failed: %w", err)
+	}
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].CreatedAt.Before(versions[j].CreatedAt) })
+
+	versionByID := make(map[string]*core.Version, len(versions))
+	for _, v := range versions {
+		versionByID[v.ID] = v
+	}
+	allEdges, err := provider.GetAllVersionEdgesForMap(codebaseID)
+	if err != nil {
+		return fmt.Errorf("edge query failed: %w", err)
+	}
+	edges := make([]bundleEdge, 0, len(allEdges))
+	for _, e := range allEdges {
+		edge := bundleEdge{ChildID: e.To, ParentID: e.From, LinkageType: e.LinkageType}
+		if child, ok := versionByID[e.To]; ok {
+			edge.Branch = child.Branch
+		}
+		edges = append(edges, edge)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].ChildID != edges[j].ChildID {
+			return edges[i].ChildID < edges[j].ChildID
+		}
+		return edges[i].ParentID < edges[j].ParentID
+	})
+	refs, err := provider.ListBranchRefs(codebaseID)
+	if err != nil {
+		return fmt.Errorf("branch ref query failed: %w", err)
+	}
+	tags, err := provider.ListTags(codebaseID)
+	if err != nil {
+		return fmt.Errorf("tag query failed: %w", err)
+	}
+
+	out := &metadataWriter{w: w, enc: json.NewEncoder(w)}
+	out.raw("{")
+	out.field("format", MetadataExportFormat, true)
+	out.field("exported_at", time.Now(), false)
+	out.field("codebase", codebase, false)
+	out.field("versions", versions, false)
+	if includeTrees {
+		out.raw(`,"trees":{`)
+		seen := make(map[string]bool, len(versions))
+		for _, v := range versions {
+			if seen[v.TreeID] {
+				continue
+			}
+			files, err := provider.GetFileIndexesByTreeID(v.TreeID)
+			if err != nil {
+				return fmt.Errorf("file index for tree_id %s not found: %w", v.TreeID, err)
+			}
+			out.field(v.TreeID, files, len(seen) == 0)
+			seen[v.TreeID] = true
+		}
+		out.raw("}")
+	}
+	out.field("edges", edges, false)
+	out.field("refs", refs, false)
+	out.field("tags", tags, false)
+	out.raw("}\n")
+	return out.err
+}
+
+// metadataWriter writes a JSON object piece by piece, remembering the first write error
+type metadataWriter struct {
+	w   io.Writer
+	enc *json.Encoder
+	err error
+}
+
+func (m *metadataWriter) raw(s string) {
+	if m.err == nil {
+		_, m.err = io.WriteString(m.w, s)
+	}
+}
+
+func (m *metadataWriter) field(name string, value interface{}, first bool) {
+	if !first {
+		m.raw(",")
+	}
+	key, _ := json.Marshal(name)
+	m.raw(string(key) + ":")
+	if m.err == nil {
+		m.err = m.enc.Encode(value)
+	}
+}
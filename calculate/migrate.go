@@ -0,0 +1,283 @@
+package calculate
+
+import (
+	"fmt"
+	"log"
+	"main/core"
+	"sort"
+)
+
+// MigrationReport counts the records copied by a provider migration. Skipped records already
+// existed in the target, e.g. from an earlier interrupted run.
+type MigrationReport struct {
+	Codebases     MigrationCount `json:"codebases"`
+	Versions      MigrationCount `json:"versions"`
+	Edges         MigrationCount `json:"edges"`
+	BranchRefs    MigrationCount `json:"branch_refs"`
+	Tags          MigrationCount `json:"tags"`
+	HistoryCaches MigrationCount `json:"history_caches"`
+	Webhooks      MigrationCount `json:"webhooks"`
+	Quarantine    MigrationCount `json:"quarantine"`
+	// IdempotencyKeys counts the recorded idempotency keys of snapshots
+	IdempotencyKeys MigrationCount `json:"idempotency_keys"`
+	AuditLog        MigrationCount `json:"audit_log"`
+}
+
+// MigrationCount is the number of records of one kind copied and skipped
+type MigrationCount struct {
+	Copied  int `json:"copied"`
+	Skipped int `json:"skipped"`
+}
+
+// MigrateProviders copies all metadata from src to dst: codebases with their versions, file
+// indexes, edges, branch refs, tags and history caches, then webhooks, quarantine entries, idempotency keys
+// and the audit log.
+// Records already in dst are left alone, so an interrupted migration can simply be run again.
+// Afterwards the per-codebase counts of both providers are compared. Stored objects are not
+// touched; they stay in the storage backend.
+func MigrateProviders(src, dst core.DataProvider) (*MigrationReport, error) {
+	report := &MigrationReport{}
+
+	codebases, err := src.ListCodebases()
+	if err != nil {
+		return nil, fmt.Errorf("listing source codebases failed: %w", err)
+	}
+	sort.Slice(codebases, func(i, j int) bool { return codebases[i].CreatedAt.Before(codebases[j].CreatedAt) })
+	for i, codebase := range codebases {
+		if err := migrateCodebase(src, dst, codebase, report); err != nil {
+			return report, fmt.Errorf("codebase %s: %w", codebase.ID, err)
+		}
+		log.Printf("Migrated codebase %d/%d: %s (%s)", i+1, len(codebases), codebase.Name, codebase.ID)
+	}
+
+	hooks, err := src.ListWebhooks()
+	if err != nil {
+		return report, err
+	}
+	existingHooks, err := dst.ListWebhooks()
+	if err != nil {
+		return report, err
+	}
+	haveHook := make(map[string]bool, len(existingHooks))
+	for _, h := range existingHooks {
+		haveHook[h.ID] = true
+	}
+	for _, h := range hooks {
+		if haveHook[h.ID] {
+			report.Webhooks.Skipped++
+			continue
+		}
+		if err := dst.CreateWebhook(h); err != nil {
+			return report, fmt.Errorf("webhook %s: %w", h.ID, err)
+		}
+		report.Webhooks.Copied++
+	}
+
+	entries, err := src.ListQuarantineEntries()
+	if err != nil {
+		return report, err
+	}
+	for _, e := range entries {
+		// Saving is keyed by storage key, a second run just writes the same entry again
+		if err := dst.SaveQuarantineEntry(e); err != nil {
+			return report, fmt.Errorf("quarantine entry %s: %w", e.StorageKey, err)
+		}
+		report.Quarantine.Copied++
+	}
+
+	records, err := src.ListIdempotencyRecords()
+	if err != nil {
+		return report, err
+	}
+	for _, r := range records {
+		// Keyed by codebase and key like quarantine entries, writing one again is harmless
+		if err := dst.SaveIdempotencyRecord(r); err != nil {
+			return report, fmt.Errorf("idempotency key %s of codebase %s: %w", r.Key, r.CodebaseID, err)
+		}
+		report.IdempotencyKeys.Copied++
+	}
+
+	audit, err := src.ListAuditEntries()
+	if err != nil {
+		return report, err
+	}
+	existingAudit, err := dst.ListAuditEntries()
+	if err != nil {
+		return report, err
+	}
+	haveAudit := make(map[string]bool, len(existingAudit))
+	for _, e := range existingAudit {
+		haveAudit[e.ID] = true
+	}
+	for _, e := range audit {
+		if haveAudit[e.ID] {
+			report.AuditLog.Skipped++
+			continue
+		}
+		if err := dst.AppendAuditEntry(e); err != nil {
+			return report, fmt.Errorf("audit entry %s: %w", e.ID, err)
+		}
+		report.AuditLog.Copied++
+	}
+
+	for _, codebase := range codebases {
+		if err := verifyMigratedCodebase(src, dst, codebase.ID); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+func migrateCodebase(src, dst core.DataProvider, codebase *core.Codebase, report *MigrationReport) error {
+	if _, err := dst.GetCodebaseByID(codebase.ID); err == nil {
+		report.Codebases.Skipped++
+	} else {
+		if err := dst.CreateCodebase(codebase); err != nil {
+			return err
+		}
+		report.Codebases.Copied++
+	}
+
+	// Versions with their file indexes, oldest first so the target keeps the same order
+	versions, err := src.ListVersions(codebase.ID)
+	if err != nil {
+		return err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		if _, err := dst.GetVersionByID(v.ID); err == nil {
+			report.Versions.Skipped++
+			continue
+		}
+		files, err := src.GetFileIndexesByTreeID(v.TreeID)
+		if err != nil {
+			return fmt.Errorf("version %s: %w", v.ID, err)
+		}
+		if err := dst.CreateVersion(v, files); err != nil {
+			return fmt.Errorf("version %s: %w", v.ID, err)
+		}
+		report.Versions.Copied++
+	}
+
+	// Edges are recorded on the branch of their child version
+	branchOf := make(map[string]string, len(versions))
+	for _, v := range versions {
+		branchOf[v.ID] = v.Branch
+	}
+	edges, err := src.GetAllVersionEdgesForMap(codebase.ID)
+	if err != nil {
+		return err
+	}
+	existingEdges, err := dst.GetAllVersionEdgesForMap(codebase.ID)
+	if err != nil {
+		return err
+	}
+	haveEdge := make(map[[2]string]bool, len(existingEdges))
+	for _, e := range existingEdges {
+		haveEdge[[2]string{e.From, e.To}] = true
+	}
+	var links []core.VersionLink
+	for _, e := range edges {
+		if haveEdge[[2]string{e.From, e.To}] {
+			report.Edges.Skipped++
+			continue
+		}
+		links = append(links, core.VersionLink{
+			CodebaseID:  codebase.ID,
+			ChildID:     e.To,
+			ParentID:    e.From,
+			Branch:      branchOf[e.To],
+			LinkageType: e.LinkageType,
+		})
+	}
+	if len(links) > 0 {
+		if err := dst.CreateVersionLinks(links); err != nil {
+			return err
+		}
+		report.Edges.Copied += len(links)
+	}
+
+	refs, err := src.ListBranchRefs(codebase.ID)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if existing, _ := dst.GetBranchRef(codebase.ID, ref.Branch); existing != nil {
+			report.BranchRefs.Skipped++
+			continue
+		}
+		if err := dst.CreateBranchRef(ref); err != nil {
+			return fmt.Errorf("branch ref %s: %w", ref.Branch, err)
+		}
+		report.BranchRefs.Copied++
+	}
+
+	tags, err := src.ListTags(codebase.ID)
+	if err != nil {
+		return err
+	}
+	existingTags, err := dst.ListTags(codebase.ID)
+	if err != nil {
+		return err
+	}
+	haveTag := make(map[string]bool, len(existingTags))
+	for _, t := range existingTags {
+		haveTag[t.Name] = true
+	}
+	for _, tag := range tags {
+		if haveTag[tag.Name] {
+			report.Tags.Skipped++
+			continue
+		}
+		if err := dst.CreateTag(tag); err != nil {
+			return fmt.Errorf("tag %s: %w", tag.Name, err)
+		}
+		report.Tags.Copied++
+	}
+
+	// A missing cache is rebuilt on first use, so only existing ones are carried over
+	if data, err := src.GetHistoryCache(codebase.ID); err == nil && data != nil {
+		if err := dst.UpdateHistoryCache(codebase.ID, data); err != nil {
+			return fmt.Errorf("history cache: %w", err)
+		}
+		report.HistoryCaches.Copied++
+	}
+	return nil
+}
+
+// verifyMigratedCodebase compares the record counts of a codebase in both providers.
+func verifyMigratedCodebase(src, dst core.DataProvider, codebaseID string) error {
+	counts := func(p core.DataProvider) ([4]int, error) {
+		var c [4]int
+		versions, err := p.ListVersions(codebaseID)
+		if err != nil {
+			return c, err
+		}
+		edges, err := p.GetAllVersionEdgesForMap(codebaseID)
+		if err != nil {
+			return c, err
+		}
+		refs, err := p.ListBranchRefs(codebaseID)
+		if err != nil {
+			return c, err
+		}
+		tags, err := p.ListTags(codebaseID)
+		if err != nil {
+			return c, err
+		}
+		return [4]int{len(versions), len(edges), len(refs), len(tags)}, nil
+	}
+	want, err := counts(src)
+	if err != nil {
+		return err
+	}
+	got, err := counts(dst)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("verification failed for codebase %s: source has %d versions, %d edges, %d branch refs, %d tags; target has %d, %d, %d, %d",
+			codebaseID, want[0], want[1], want[2], want[3], got[0], got[1], got[2], got[3])
+	}
+	return nil
+}
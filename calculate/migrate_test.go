@@ -0,0 +1,69 @@
+package calculate
+
+import (
+	"main/core"
+	"reflect"
+	"testing"
+)
+
+func TestMigrateProviders(t *testing.T) {
+	targets := map[string]func(t *testing.T) core.DataProvider{
+		core.ProviderTypeJSON: func(t *testing.T) core.DataProvider {
+			p, err := core.NewJSONFileProvider(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { p.Close() })
+			return p
+		},
+		core.ProviderTypeBolt: func(t *testing.T) core.DataProvider {
+			p, err := core.NewBoltProvider(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { p.Close() })
+			return p
+		},
+	}
+	for _, name := range []string{core.ProviderTypeJSON, core.ProviderTypeBolt} {
+		t.Run(name, func(t *testing.T) {
+			src, storage := useMemoryBackends(t)
+			codebase := mustInitCodebase(t, "migrated")
+			mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"a.txt": "alpha", "dir/b.txt": "beta"})
+			mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{"a.txt": "alpha 2", "dir/b.txt": "beta"})
+			mustSnapshot(t, codebase.ID, "feature", "f1", map[string]string{"a.txt": "feature"})
+			if _, err := NewTagService().CreateTag(codebase.ID, "release-1.0", "", VersionIdentifier{Branch: "main", Version: "v1"}); err != nil {
+				t.Fatal(err)
+			}
+			wantContents, wantMap := versionContents(t, storage, codebase.ID), comparableMap(versionMap(t, codebase.ID))
+
+			dst := targets[name](t)
+			report, err := MigrateProviders(src, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Codebases.Copied != 1 || report.Versions.Copied != 3 || report.Tags.Copied != 1 || report.Edges.Copied != len(wantMap.Edges) {
+				t.Errorf("report = %+v, want 1 codebase, 3 versions, 1 tag and %d edges copied", report, len(wantMap.Edges))
+			}
+
+			// A second run skips what is already there and picks up what is new
+			mustSnapshot(t, codebase.ID, "main", "v3", map[string]string{"a.txt": "alpha 3"})
+			report, err = MigrateProviders(src, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Codebases.Skipped != 1 || report.Versions.Copied != 1 || report.Versions.Skipped != 3 || report.Tags.Skipped != 1 {
+				t.Errorf("second run = %+v, want only v3 copied", report)
+			}
+			wantContents, wantMap = versionContents(t, storage, codebase.ID), comparableMap(versionMap(t, codebase.ID))
+
+			core.SetProvidersForTesting(dst, storage)
+			if got := versionContents(t, storage, codebase.ID); !reflect.DeepEqual(got, wantContents) {
+				t.Errorf("contents in %s = %v, want %v", name, got, wantContents)
+			}
+			if got := comparableMap(versionMap(t, codebase.ID)); !reflect.DeepEqual(got, wantMap) {
+				t.Errorf("map in %s = %+v, want %+v", name, got, wantMap)
+			}
+		})
+	}
+}
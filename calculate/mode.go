@@ -0,0 +1,94 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultFileMode is the mode restored for files whose index records none: uploads without a mode and
+// indexes written before modes were recorded
+const defaultFileMode os.FileMode = 0644
+
+// fileMode returns the permission bits f is restored with.
+func fileMode(f core.File) os.FileMode {
+	if f.Mode == 0 {
+		return defaultFileMode
+	}
+	return os.FileMode(f.Mode) & os.ModePerm
+}
+
+// parseFileModes validates the modes of a snapshot request, octal permission bits such as "755" or
+// "0755" for paths of the upload or resolved to stored content, and returns them by slash path.
+func parseFileModes(modes map[string]string, files map[string]*SnapshotFile, known []core.File) (map[string]uint32, error) {
+	if len(modes) == 0 {
+		return nil, nil
+	}
+	received := make(map[string]bool, len(files)+len(known))
+	for relPath := range files {
+		received[filepath.ToSlash(relPath)] = true
+	}
+	for _, f := range known {
+		received[f.Path] = true
+	}
+
+	parsed := make(map[string]uint32, len(modes))
+	var problems []string
+	for relPath, value := range modes {
+		if !received[filepath.ToSlash(relPath)] {
+			problems = append(problems, fmt.Sprintf("%s is not part of the upload", relPath))
+			continue
+		}
+		mode, err := strconv.ParseUint(strings.TrimSpace(value), 8, 32)
+		if err != nil || mode == 0 || mode > uint64(os.ModePerm) {
+			problems = append(problems, fmt.Sprintf("%s has mode %q, expected octal permission bits between 1 and 777", relPath, value))
+			continue
+		}
+		parsed[filepath.ToSlash(relPath)] = uint32(mode)
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("invalid snapshot: file modes: %s", strings.Join(problems, "; "))
+	}
+	return parsed, nil
+}
+
+// applyFileModes sets the mode of processed files. Files renamed by the path policy are matched by the
+// path they were uploaded as.
+func applyFileModes(files []core.File, modes map[string]uint32) {
+	if len(modes) == 0 {
+		return
+	}
+	for i := range files {
+		uploadedAs := files[i].Path
+		if files[i].OriginalPath != "" {
+			uploadedAs = files[i].OriginalPath
+		}
+		if mode, ok := modes[uploadedAs]; ok {
+			files[i].Mode = mode
+		}
+	}
+}
+
+// inheritFileModes gives files of an incremental snapshot uploaded without a mode the mode of the base
+// file they replace, so editing a script doesn't drop its executable bit.
+func inheritFileModes(files []core.File, baseFiles []core.File) {
+	baseModes := make(map[string]uint32)
+	for _, f := range baseFiles {
+		if f.Mode != 0 {
+			baseModes[f.Path] = f.Mode
+		}
+	}
+	if len(baseModes) == 0 {
+		return
+	}
+	for i := range files {
+		if files[i].Mode == 0 {
+			files[i].Mode = baseModes[files[i].Path]
+		}
+	}
+}
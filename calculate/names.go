@@ -0,0 +1,99 @@
+package calculate
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Branch and version names are free-form, "/" included ("feat/login"), but must be addressable: not empty
+// or blank, without surrounding whitespace or control characters, valid UTF-8 and at most maxNameLength
+// bytes. Names are checked where they are created and where they are looked up.
+
+// maxNameLength caps branch and version names, in bytes
+const maxNameLength = 255
+
+// NameError rejects a branch or version name; Field is the request field it came from
+type NameError struct {
+	Field  string `json:"field"`
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+func (e *NameError) Error() string {
+	return fmt.Sprintf("invalid %s name %q: %s", e.Field, e.Name, e.Reason)
+}
+
+// validateName checks a branch or version name against the rules above.
+func validateName(field, name string) error {
+	reason := ""
+	switch {
+	case name == "":
+		reason = "must not be empty"
+	case strings.TrimSpace(name) == "":
+		reason = "must not be blank"
+	case len(name) > maxNameLength:
+		reason = fmt.Sprintf("is %d bytes long, the limit is %d", len(name), maxNameLength)
+	case !utf8.ValidString(name):
+		reason = "is not valid UTF-8"
+	case strings.TrimSpace(name) != name:
+		reason = "must not start or end with whitespace"
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		reason = "must not contain control characters"
+	default:
+		return nil
+	}
+	return &NameError{Field: field, Name: name, Reason: reason}
+}
+
+// validateTagName checks a tag name. Tags end up in download filenames and archive roots, so unlike branch
+// and version names they are limited to a ref-safe set: ASCII letters, digits, '.', '_', '-' and '/',
+// starting with a letter or digit, without "..", "//" or a trailing '/' or '.'.
+func validateTagName(name string) error {
+	if err := validateName("tag", name); err != nil {
+		return err
+	}
+	reason := ""
+	switch {
+	case strings.IndexFunc(name, func(r rune) bool { return !isTagNameRune(r) }) >= 0:
+		reason = "may only contain ASCII letters, digits, '.', '_', '-' and '/'"
+	case !isAlphanumeric(rune(name[0])):
+		reason = "must start with a letter or digit"
+	case strings.Contains(name, "..") || strings.Contains(name, "//"):
+		reason = "must not contain \"..\" or \"//\""
+	case strings.HasSuffix(name, "/") || strings.HasSuffix(name, "."):
+		reason = "must not end with '/' or '.'"
+	default:
+		return nil
+	}
+	return &NameError{Field: "tag", Name: name, Reason: reason}
+}
+
+func isAlphanumeric(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+}
+
+func isTagNameRune(r rune) bool {
+	return isAlphanumeric(r) || r == '.' || r == '_' || r == '-' || r == '/'
+}
+
+// validateVersionRef checks the branch and version addressing a version.
+func validateVersionRef(branch, version string) error {
+	return validateVersionRefField("", branch, version)
+}
+
+// validateLinkEnds checks the versions of a link request, naming the side an invalid name came from.
+func validateLinkEnds(child, parent VersionIdentifier) error {
+	if err := validateVersionRefField("child_version.", child.Branch, child.Version); err != nil {
+		return err
+	}
+	return validateVersionRefField("parent_version.", parent.Branch, parent.Version)
+}
+
+func validateVersionRefField(prefix, branch, version string) error {
+	if err := validateName(prefix+"branch", branch); err != nil {
+		return err
+	}
+	return validateName(prefix+"version", version)
+}
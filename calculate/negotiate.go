@@ -0,0 +1,198 @@
+package calculate
+
+import (
+	"encoding/hex"
+	"main/core"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Objects are keyed by content hash, so a client that knows the sha256 of its files can ask which
+// contents the server lacks (NegotiateSnapshot) and upload only those. The snapshot request still lists
+// every file in its manifest; entries with a hash and no uploaded file are resolved to the stored objects.
+
+// negotiateTreeScanLimit bounds how many of the newest versions are searched for files stored in
+// chunks, whose objects can't be found from the file hash alone
+const negotiateTreeScanLimit = 20
+
+// NegotiationResult tells a client which files of its manifest to upload
+type NegotiationResult struct {
+	MissingHashes []string `json:"missing_hashes"` // contents the server doesn't have
+	MissingPaths  []string `json:"missing_paths"`  // files to upload: missing contents and entries without a usable hash
+	KnownFiles    int      `json:"known_files"`    // files the snapshot can leave out of the upload
+}
+
+// NegotiateSnapshot reports which files of a manifest have to be uploaded with the next snapshot.
+func (s *UploadService) NegotiateSnapshot(codebaseID string, manifest []ManifestEntry) (*NegotiationResult, error) {
+	provider := core.GetProvider()
+	codebase, err := getActiveCodebase(provider, codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	known := newKnownContent(core.GetStore(), provider, codebase)
+
+	result := &NegotiationResult{MissingHashes: []string{}, MissingPaths: []string{}}
+	missing := make(map[string]bool)
+	for _, entry := range manifest {
+		if _, ok := known.resolve(entry); ok {
+			result.KnownFiles++
+			continue
+		}
+		result.MissingPaths = append(result.MissingPaths, filepath.ToSlash(entry.Path))
+		if hash := strings.ToLower(entry.Hash); validSHA256(hash) && !missing[hash] {
+			missing[hash] = true
+			result.MissingHashes = append(result.MissingHashes, hash)
+		}
+	}
+	sort.Strings(result.MissingHashes)
+	sort.Strings(result.MissingPaths)
+	return result, nil
+}
+
+// knownContent resolves manifest entries to objects the storage already holds.
+type knownContent struct {
+	storage  core.Storage
+	provider core.DataProvider
+	codebase *core.Codebase
+	// chunked maps hashes to files stored in chunks, read from the newest trees on first use
+	chunked map[string]core.File
+}
+
+func newKnownContent(storage core.Storage, provider core.DataProvider, codebase *core.Codebase) *knownContent {
+	return &knownContent{storage: storage, provider: provider, codebase: codebase}
+}
+
+// resolve returns the file entry of a manifest entry whose content is stored already. Entries without
+// a sha256 or with a path that isn't portable are never resolved; they go through the upload checks.
+func (k *knownContent) resolve(entry ManifestEntry) (core.File, bool) {
+	hash := strings.ToLower(entry.Hash)
+	path := filepath.ToSlash(entry.Path)
+	if !validSHA256(hash) || len(portabilityProblems(path)) > 0 {
+		return core.File{}, false
+	}
+
+	if threshold := core.GetConfig().ChunkingThresholdBytes; threshold > 0 && entry.Size > threshold {
+		f, ok := k.chunkedFile(hash)
+		if !ok || f.Size != entry.Size {
+			return core.File{}, false
+		}
+		return core.File{Path: path, Hash: hash, Size: f.Size, CompressedSize: f.CompressedSize, Type: f.Type, Chunks: f.Chunks}, true
+	}
+
+	for _, stored := range storedObjectCandidates(k.codebase.Name, hash) {
+		stored.Path, stored.Hash, stored.Size = path, hash, entry.Size
+		info, err := k.storage.StatObject(stored.StorageKey)
+		if err != nil || compressionGrew(stored, info.Size) {
+			continue
+		}
+		// A key can hold the content in another encoding than the candidate implies (see objectKey), so
+		// the object is read through once and must decode to the content of the hash. The size recorded
+		// is the one read, a manifest entry claiming another size is not resolved.
+		size, err := storedContentSize(k.storage, stored)
+		if err == nil && size == entry.Size {
+			return core.File{Path: path, Hash: hash, Size: size, CompressedSize: info.Size, StorageKey: stored.StorageKey, Type: stored.Type, Encoding: stored.Encoding}, true
+		}
+	}
+	return core.File{}, false
+}
+
+// storedObjectCandidates lists the keys a whole-file object with the hash may be stored under, with the
+// type and encoding each one implies. Without the content the upload would have sniffed, every encoding
+// is tried, the configured algorithm first, and then the raw objects older versions stored under the
+// zlib key.
+func storedObjectCandidates(codebaseName, hash string) []core.File {
+	encodings := []string{core.EncodingZlib, core.EncodingZstd}
+	if core.GetConfig().CompressionAlgorithm() == core.EncodingZstd {
+		encodings = []string{core.EncodingZstd, core.EncodingZlib}
+	}
+	candidates := make([]core.File, 0, len(encodings)+2)
+	for _, encoding := range encodings {
+		candidates = append(candidates, core.File{StorageKey: objectKey(codebaseName, hash, encoding), Type: "compressed", Encoding: encoding})
+	}
+	candidates = append(candidates, core.File{StorageKey: objectKey(codebaseName, hash, ""), Type: "raw"})
+	if !core.GetConfig().GlobalBlobNamespace {
+		candidates = append(candidates, core.File{StorageKey: objectKey(codebaseName, hash, core.EncodingZlib), Type: "raw"})
+	}
+	return candidates
+}
+
+// chunkedFile finds a file stored in chunks by its hash in the newest versions and checks its chunks
+// are still stored.
+func (k *knownContent) chunkedFile(hash string) (core.File, bool) {
+	if k.chunked == nil {
+		k.chunked = make(map[string]core.File)
+		versions, err := k.provider.ListVersions(k.codebase.ID)
+		if err != nil {
+			return core.File{}, false
+		}
+		if len(versions) > negotiateTreeScanLimit {
+			versions = versions[:negotiateTreeScanLimit]
+		}
+		for _, v := range versions {
+			files, err := k.provider.GetFileIndexesByTreeID(v.TreeID)
+			if err != nil {
+				continue
+			}
+			for _, f := range files {
+				if len(f.Chunks) > 0 {
+					k.chunked[f.Hash] = f
+				}
+			}
+		}
+	}
+	f, ok := k.chunked[hash]
+	if !ok {
+		return core.File{}, false
+	}
+	for _, c := range f.Chunks {
+		if exists, err := k.storage.ObjectExists(c.StorageKey); err != nil || !exists {
+			return core.File{}, false
+		}
+	}
+	return f, true
+}
+
+// resolveKnownFiles returns the file entries of the manifest entries that were not uploaded and whose
+// content is stored already.
+func resolveKnownFiles(known *knownContent, manifest []ManifestEntry, files map[string]*SnapshotFile) []core.File {
+	uploaded := make(map[string]bool, len(files))
+	for relPath := range files {
+		uploaded[filepath.ToSlash(relPath)] = true
+	}
+	var resolved []core.File
+	for _, entry := range manifest {
+		if uploaded[filepath.ToSlash(entry.Path)] {
+			continue
+		}
+		if f, ok := known.resolve(entry); ok {
+			resolved = append(resolved, f)
+		}
+	}
+	return resolved
+}
+
+// addKnownFiles adds the resolved files to the tree and counts them in the version stats as reused.
+func addKnownFiles(version *core.Version, tree *core.FileTree, known []core.File) {
+	stats := &version.Stats
+	for _, f := range known {
+		tree.Files = append(tree.Files, f)
+		stats.TotalFiles++
+		stats.TotalSize += f.Size
+		stats.CompressedSize += f.CompressedSize
+		stats.ReusedFiles++
+		stats.ReusedBytes += f.Size
+	}
+	stats.CompressionRatio = 0
+	if stats.TotalSize > 0 {
+		stats.CompressionRatio = float64(stats.CompressedSize) / float64(stats.TotalSize)
+	}
+}
+
+func validSHA256(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
@@ -0,0 +1,92 @@
+package calculate
+
+import (
+	"errors"
+	"main/core"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateSnapshot(t *testing.T) {
+	_, storage := useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "negotiate")
+	compressible := strings.Repeat("compressed content ", 100)
+	mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"a.txt": compressible, "tiny.txt": "x", "b.txt": "beta"})
+
+	manifest := []ManifestEntry{
+		{Path: "a.txt", Size: int64(len(compressible)), Hash: sha256Hex(compressible)},
+		{Path: "moved/a.txt", Size: int64(len(compressible)), Hash: strings.ToUpper(sha256Hex(compressible))},
+		{Path: "tiny.txt", Size: 1, Hash: sha256Hex("x")}, // stored raw, compression made it grow
+		{Path: "new.txt", Size: 3, Hash: sha256Hex("new")},
+		{Path: "nohash.txt", Size: 6},
+	}
+	uploads := NewUploadService()
+	result, err := uploads.NegotiateSnapshot(codebase.ID, append(manifest, ManifestEntry{Path: "b.txt", Size: 40, Hash: sha256Hex("beta")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	missingHashes := []string{sha256Hex("beta"), sha256Hex("new")}
+	sort.Strings(missingHashes)
+	want := &NegotiationResult{
+		MissingHashes: missingHashes,
+		MissingPaths:  []string{"b.txt", "new.txt", "nohash.txt"},
+		KnownFiles:    3,
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("negotiation = %+v, want %+v", result, want)
+	}
+
+	// The snapshot uploads only what negotiation asked for and holds the full tree
+	resp, err := uploads.ProcessSnapshot(codebase.ID, "v2", "main", "", snapshotFiles(map[string]string{"new.txt": "new", "nohash.txt": "no sum"}), nil, true, SnapshotOptions{Manifest: manifest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantContents := map[string]string{"a.txt": compressible, "moved/a.txt": compressible, "tiny.txt": "x", "new.txt": "new", "nohash.txt": "no sum"}
+	if got := versionContents(t, storage, codebase.ID)[resp.Version.ID]; !reflect.DeepEqual(got, wantContents) {
+		t.Errorf("contents of v2 = %v, want %v", got, wantContents)
+	}
+	if stats := resp.Version.Stats; stats.TotalFiles != 5 || stats.ReusedFiles != 3 || stats.TotalSize != int64(2*len(compressible)+10) {
+		t.Errorf("stats of v2 = %+v, want 5 files, 3 of them reused", stats)
+	}
+
+	// Entries the server can't resolve have to be uploaded
+	for _, entry := range []ManifestEntry{
+		{Path: "b.txt", Size: 40, Hash: sha256Hex("beta")},
+		{Path: "unknown.txt", Size: 7, Hash: sha256Hex("unknown")},
+	} {
+		_, err := uploads.ProcessSnapshot(codebase.ID, "v3", "main", "", snapshotFiles(nil), nil, true, SnapshotOptions{Manifest: []ManifestEntry{entry}})
+		var manifestErr *ManifestError
+		if !errors.As(err, &manifestErr) || !reflect.DeepEqual(manifestErr.Missing, []string{entry.Path}) {
+			t.Errorf("snapshot leaving out %s = %v, want it reported missing", entry.Path, err)
+		}
+	}
+}
+
+// Files stored in chunks are found in the trees of recent versions.
+func TestNegotiateChunkedFile(t *testing.T) {
+	useMemoryBackends(t)
+	core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), ChunkingThresholdBytes: 1 << 10})
+	t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+	codebase := mustInitCodebase(t, "chunked")
+	big := strings.Repeat("chunked content ", 4<<10)
+	v1 := mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"big.txt": big})
+	if len(chunksOf(t, v1.Version.ID, "big.txt")) == 0 {
+		t.Fatal("big.txt was not stored in chunks")
+	}
+
+	manifest := []ManifestEntry{{Path: "copy.txt", Size: int64(len(big)), Hash: sha256Hex(big)}}
+	result, err := NewUploadService().NegotiateSnapshot(codebase.ID, manifest)
+	if err != nil || result.KnownFiles != 1 || len(result.MissingPaths) != 0 {
+		t.Fatalf("negotiation = %+v, %v, want copy.txt known", result, err)
+	}
+	resp, err := NewUploadService().ProcessSnapshot(codebase.ID, "v2", "main", "", snapshotFiles(nil), nil, true, SnapshotOptions{Manifest: manifest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readStoredFile(t, core.GetStore(), resp.Version.ID, "copy.txt"); got != big {
+		t.Errorf("copy.txt reads back %d bytes, want %d", len(got), len(big))
+	}
+}
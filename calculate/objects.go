@@ -0,0 +1,232 @@
+package calculate
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"main/core"
+	"sort"
+	"strings"
+)
+
+// ObjectLocation is one place a content hash is referenced from
+type ObjectLocation struct {
+	CodebaseID string `json:"codebase_id"`
+	Branch     string `json:"branch"`
+	Version    string `json:"version"`
+	Path       string `json:"path"`
+}
+
+// ObjectService serves file content addressed by its hash rather than by version and path
+type ObjectService struct {
+	quarantine *QuarantineService
+}
+
+func NewObjectService() *ObjectService {
+	return &ObjectService{
+		quarantine: NewQuarantineService(),
+	}
+}
+
+// HashObject is the content served for a hash, decompressed as it is read
+type HashObject struct {
+	Content io.ReadCloser
+	Size    int64
+}
+
+// ObjectKeyScope returns the IDs of the codebases content is served from with an object API key, nil
+// meaning every codebase. ok is false for a key that isn't in object_api_keys.
+func ObjectKeyScope(key string) (codebases []string, ok bool) {
+	for _, k := range core.GetConfig().ObjectAPIKeys {
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 {
+			if len(k.Codebases) == 0 {
+				return nil, true
+			}
+			return k.Codebases, true
+		}
+	}
+	return nil, false
+}
+
+// objectEncodings are the encodings a whole-file object can be stored with, "" being raw
+var objectEncodings = []string{core.EncodingZlib, core.EncodingZstd, ""}
+
+// GetByHash opens the content of a file whose recorded hash is hash, and optionally lists every location
+// referencing it. Only hashes recorded in a file index of an active codebase are served, so the storage
+// can't be probed for objects that exist without being referenced. The blob reference index decides
+// whether the hash is referenced at all, file trees are only read to find a referencing file, or every
+// location when asked for. Files stored in chunks have no object under their hash and aren't served.
+// A non-nil scope limits both the content and the locations to the codebases with those IDs; a hash
+// referenced only outside of it is not found.
+func (s *ObjectService) GetByHash(hash string, withLocations bool, scope []string) (*HashObject, []ObjectLocation, error) {
+	hash = strings.ToLower(hash)
+	if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != 32 {
+		return nil, nil, fmt.Errorf("invalid hash %q: expected a hex encoded sha256", hash)
+	}
+
+	provider := core.GetProvider()
+	owners, err := hashObjectOwners(provider, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if scope != nil {
+		owners = scopeCodebases(owners, scope)
+	}
+	if len(owners) == 0 {
+		return nil, nil, fmt.Errorf("object %s not found", hash)
+	}
+
+	// Any referencing file will do, fall back to the next one when an object turns out to be corrupt
+	storage := core.GetStore()
+	var (
+		object    *HashObject
+		locations []ObjectLocation
+		readErr   error
+	)
+	err = scanHashFiles(provider, owners, hash, func(codebaseID string, v *core.Version, f core.File) bool {
+		if withLocations {
+			locations = append(locations, ObjectLocation{CodebaseID: codebaseID, Branch: v.Branch, Version: v.Version, Path: f.Path})
+		}
+		if object == nil {
+			content, err := openFileContent(storage, f)
+			if err != nil {
+				s.quarantine.recordIfCorrupt(codebaseID, err)
+				readErr = err
+			} else {
+				object = &HashObject{
+					Content: &quarantiningReader{ReadCloser: content, quarantine: s.quarantine, codebaseID: codebaseID},
+					Size:    f.Size,
+				}
+			}
+		}
+		return object == nil || withLocations
+	})
+	if err != nil {
+		if object != nil {
+			object.Content.Close()
+		}
+		return nil, nil, err
+	}
+	if object == nil {
+		if readErr == nil {
+			return nil, nil, fmt.Errorf("object %s not found", hash)
+		}
+		return nil, nil, fmt.Errorf("object %s could not be read: %w", hash, readErr)
+	}
+
+	sort.Slice(locations, func(i, j int) bool {
+		a, b := locations[i], locations[j]
+		if a.CodebaseID != b.CodebaseID {
+			return a.CodebaseID < b.CodebaseID
+		}
+		if a.Branch != b.Branch {
+			return a.Branch < b.Branch
+		}
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+		return a.Path < b.Path
+	})
+	return object, locations, nil
+}
+
+// hashObjectOwners returns the active codebases that may reference the whole-file objects of hash,
+// looked up in the blob reference index: the codebase whose name prefixes a referenced key, or every
+// active codebase when an object of the global namespace is referenced. None means the hash isn't
+// referenced.
+func hashObjectOwners(provider core.DataProvider, hash string) ([]*core.Codebase, error) {
+	codebases, err := provider.ListCodebases()
+	if err != nil {
+		return nil, err
+	}
+	keyOwner := make(map[string]*core.Codebase)
+	var keys []string
+	for _, codebase := range codebases {
+		if codebase.TrashedAt != nil {
+			continue
+		}
+		for _, encoding := range objectEncodings {
+			key := codebaseObjectKey(codebase.Name, hash, encoding)
+			keyOwner[key] = codebase
+			keys = append(keys, key)
+		}
+	}
+	for _, encoding := range objectEncodings {
+		keys = append(keys, globalObjectKey(hash, encoding))
+	}
+	refs, err := provider.BlobRefCounts(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var owners []*core.Codebase
+	seen := make(map[string]bool)
+	global := false
+	for _, key := range keys {
+		if refs[key] == 0 {
+			continue
+		}
+		codebase, ok := keyOwner[key]
+		if !ok {
+			global = true
+			continue
+		}
+		if !seen[codebase.ID] {
+			seen[codebase.ID] = true
+			owners = append(owners, codebase)
+		}
+	}
+	if !global {
+		return owners, nil
+	}
+	// Objects of the global namespace are shared; the codebases found by name are read first
+	for _, codebase := range codebases {
+		if codebase.TrashedAt == nil && !seen[codebase.ID] {
+			seen[codebase.ID] = true
+			owners = append(owners, codebase)
+		}
+	}
+	return owners, nil
+}
+
+// scopeCodebases keeps the codebases whose IDs are in scope.
+func scopeCodebases(codebases []*core.Codebase, scope []string) []*core.Codebase {
+	allowed := make(map[string]bool, len(scope))
+	for _, id := range scope {
+		allowed[id] = true
+	}
+	var kept []*core.Codebase
+	for _, codebase := range codebases {
+		if allowed[codebase.ID] {
+			kept = append(kept, codebase)
+		}
+	}
+	return kept
+}
+
+// scanHashFiles calls fn for the whole-file entries with the hash in the versions of codebases, newest
+// version first, until fn returns false.
+func scanHashFiles(provider core.DataProvider, codebases []*core.Codebase, hash string, fn func(codebaseID string, v *core.Version, f core.File) bool) error {
+	for _, codebase := range codebases {
+		versions, err := provider.ListVersions(codebase.ID)
+		if err != nil {
+			return err
+		}
+		for _, v := range versions {
+			files, err := provider.GetFileIndexesByTreeID(v.TreeID)
+			if err != nil {
+				continue
+			}
+			for _, f := range files {
+				if f.Hash != hash || f.IsDir() || len(f.Chunks) > 0 {
+					continue
+				}
+				if !fn(codebase.ID, v, f) {
+					return nil
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package calculate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"main/core"
+	"strings"
+	"testing"
+)
+
+// treeCountingProvider counts the file trees read through it
+type treeCountingProvider struct {
+	*core.MemoryProvider
+	treeReads int
+}
+
+func (p *treeCountingProvider) GetFileIndexesByTreeID(treeID string) ([]core.File, error) {
+	p.treeReads++
+	return p.MemoryProvider.GetFileIndexesByTreeID(treeID)
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestGetByHashUsesBlobRefs(t *testing.T) {
+	memory, storage := useMemoryBackends(t)
+	provider := &treeCountingProvider{MemoryProvider: memory}
+	core.SetProvidersForTesting(provider, storage)
+
+	codebase := mustInitCodebase(t, "objects")
+	mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"a.txt": "shared content", "b.txt": "other"})
+	mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{"copy.txt": "shared content"})
+
+	// An object in storage that no file index references is not served, and costs no tree reads
+	unreferenced := sha256Hex("stray")
+	if err := storage.PutObject(codebase.Name+"/raw/"+unreferenced, []byte("stray")); err != nil {
+		t.Fatal(err)
+	}
+	provider.treeReads = 0
+	if _, _, err := NewObjectService().GetByHash(unreferenced, true, nil); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("GetByHash of an unreferenced object = %v, want not found", err)
+	}
+	if provider.treeReads != 0 {
+		t.Errorf("GetByHash of an unreferenced object read %d file trees", provider.treeReads)
+	}
+
+	object, locations, err := NewObjectService().GetByHash(strings.ToUpper(sha256Hex("shared content")), true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer object.Content.Close()
+	content, err := io.ReadAll(object.Content)
+	if err != nil || string(content) != "shared content" || object.Size != int64(len(content)) {
+		t.Errorf("content = %q (size %d), %v", content, object.Size, err)
+	}
+	var paths []string
+	for _, l := range locations {
+		paths = append(paths, l.Version+":"+l.Path)
+	}
+	if got := strings.Join(paths, ","); got != "v1:a.txt,v2:copy.txt" {
+		t.Errorf("locations = %s, want v1:a.txt,v2:copy.txt", got)
+	}
+
+	// Without locations the scan stops at the first referencing file, in the newest version
+	provider.treeReads = 0
+	object, _, err = NewObjectService().GetByHash(sha256Hex("shared content"), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object.Content.Close()
+	if provider.treeReads != 1 {
+		t.Errorf("GetByHash without locations read %d file trees, want 1", provider.treeReads)
+	}
+}
@@ -0,0 +1,215 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"main/utils"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Path policies available in codebase settings
+const (
+	PathPolicyWarn     = "warn"
+	PathPolicyReject   = "reject"
+	PathPolicySanitize = "sanitize"
+)
+
+const (
+	maxPortablePathLength = 260 // Windows MAX_PATH
+	maxPortableNameLength = 255 // common file system limit for a single name
+)
+
+// windowsReservedNames are device names Windows refuses as file names, with or without an extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// PortabilityError lists the non-portable paths of a snapshot rejected by the reject policy
+type PortabilityError struct {
+	Issues []core.PortabilityIssue `json:"issues"`
+}
+
+func (e *PortabilityError) Error() string {
+	return fmt.Sprintf("invalid snapshot: %d paths are not portable across operating systems", len(e.Issues))
+}
+
+// portabilityProblems lists the reasons a slash-separated path can't be extracted on every platform.
+func portabilityProblems(filePath string) []string {
+	var problems []string
+	if n := utf8.RuneCountInString(filePath); n > maxPortablePathLength {
+		problems = append(problems, fmt.Sprintf("path is %d characters long (limit %d)", n, maxPortablePathLength))
+	}
+	for _, name := range strings.Split(filePath, "/") {
+		if n := utf8.RuneCountInString(name); n > maxPortableNameLength {
+			problems = append(problems, fmt.Sprintf("name %q is %d characters long (limit %d)", name, n, maxPortableNameLength))
+		}
+		if strings.ContainsAny(name, `<>:"|?*\`) || strings.IndexFunc(name, func(r rune) bool { return r < 0x20 }) >= 0 {
+			problems = append(problems, fmt.Sprintf("name %q contains characters invalid on Windows", name))
+		}
+		if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+			problems = append(problems, fmt.Sprintf("name %q ends with a dot or space", name))
+		}
+		if isReservedName(name) {
+			problems = append(problems, fmt.Sprintf("name %q is a reserved device name on Windows", name))
+		}
+	}
+	return problems
+}
+
+// caseCollisions maps each path to the other paths it differs from only in letter case. Such files
+// overwrite each other when extracted on a case-insensitive file system.
+func caseCollisions(paths []string) map[string][]string {
+	byFolded := make(map[string][]string)
+	for _, p := range paths {
+		folded := strings.ToLower(p)
+		byFolded[folded] = append(byFolded[folded], p)
+	}
+	collisions := make(map[string][]string)
+	for _, group := range byFolded {
+		if len(group) < 2 {
+			continue
+		}
+		sort.Strings(group)
+		for _, p := range group {
+			for _, other := range group {
+				if other != p {
+					collisions[p] = append(collisions[p], other)
+				}
+			}
+		}
+	}
+	return collisions
+}
+
+// caseCollisionProblems describes the collisions of one path found by caseCollisions.
+func caseCollisionProblems(others []string) []string {
+	problems := make([]string, len(others))
+	for i, other := range others {
+		problems[i] = fmt.Sprintf("path differs from %q only in letter case", other)
+	}
+	return problems
+}
+
+func isReservedName(name string) bool {
+	base := name
+	if i := strings.Index(base, "."); i >= 0 {
+		base = base[:i]
+	}
+	return windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))]
+}
+
+// sanitizePath deterministically renames the segments of a path that aren't portable.
+// Overly long names are shortened with a hash suffix; an overly long path made of
+// portable names is left as is and still reported.
+func sanitizePath(filePath string) string {
+	segments := strings.Split(filePath, "/")
+	for i, name := range segments {
+		name = strings.Map(func(r rune) rune {
+			if r < 0x20 || strings.ContainsRune(`<>:"|?*\`, r) {
+				return '_'
+			}
+			return r
+		}, name)
+		name = strings.TrimRight(name, ". ")
+		if name == "" {
+			name = "_"
+		}
+		if isReservedName(name) {
+			// Windows ignores everything from the first dot, so the marker goes before it
+			base := len(name)
+			if i := strings.Index(name, "."); i >= 0 {
+				base = i
+			}
+			name = name[:base] + "_" + name[base:]
+		}
+		if utf8.RuneCountInString(name) > maxPortableNameLength {
+			ext := path.Ext(name)
+			if utf8.RuneCountInString(ext) > 16 {
+				ext = ""
+			}
+			suffix := "~" + utils.CalculateHash([]byte(segments[i]))[:8] + ext
+			runes := []rune(name)
+			name = string(runes[:maxPortableNameLength-utf8.RuneCountInString(suffix)]) + suffix
+		}
+		segments[i] = name
+	}
+	return strings.Join(segments, "/")
+}
+
+// applyPathPolicy checks every uploaded path for portability. Depending on the policy the
+// snapshot is rejected, or the issues are returned as warnings, or offending files are renamed.
+// The returned renames map each sanitized path to the path it was uploaded as.
+func applyPathPolicy(files map[string]*SnapshotFile, policy string) (map[string]*SnapshotFile, []core.PortabilityIssue, map[string]string, error) {
+	paths := make([]string, 0, len(files))
+	for relPath := range files {
+		paths = append(paths, filepath.ToSlash(relPath))
+	}
+	collisions := caseCollisions(paths)
+	var issues []core.PortabilityIssue
+	for _, p := range paths {
+		problems := append(portabilityProblems(p), caseCollisionProblems(collisions[p])...)
+		if len(problems) > 0 {
+			issues = append(issues, core.PortabilityIssue{Path: p, Problems: problems})
+		}
+	}
+	if len(issues) == 0 {
+		return files, nil, nil, nil
+	}
+	sort.Slice(issues, func(i, j int) bool { return issues[i].Path < issues[j].Path })
+
+	switch policy {
+	case PathPolicyReject:
+		return nil, nil, nil, &PortabilityError{Issues: issues}
+	case PathPolicySanitize:
+	default:
+		return files, issues, nil, nil
+	}
+
+	renamed := make(map[string]*SnapshotFile, len(files))
+	for relPath, header := range files {
+		renamed[filepath.ToSlash(relPath)] = header
+	}
+	renames := make(map[string]string)
+	for i := range issues {
+		sanitized := sanitizePath(issues[i].Path)
+		if sanitized == issues[i].Path {
+			// Nothing to rename (the path is only too long or collides in case), keep it as a warning
+			continue
+		}
+		if _, taken := renamed[sanitized]; taken {
+			return nil, nil, nil, fmt.Errorf("invalid snapshot: sanitized path %q of %q collides with another file", sanitized, issues[i].Path)
+		}
+		renamed[sanitized] = renamed[issues[i].Path]
+		delete(renamed, issues[i].Path)
+		renames[sanitized] = issues[i].Path
+		issues[i].SanitizedPath = sanitized
+	}
+	return renamed, issues, renames, nil
+}
+
+// portabilityIssuesOf reports the non-portable paths of an existing file index.
+func portabilityIssuesOf(files []core.File) []core.PortabilityIssue {
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.Path
+	}
+	collisions := caseCollisions(paths)
+	issues := []core.PortabilityIssue{}
+	for _, f := range files {
+		problems := append(portabilityProblems(f.Path), caseCollisionProblems(collisions[f.Path])...)
+		if f.OriginalPath != "" {
+			problems = append(problems, fmt.Sprintf("renamed from %q at snapshot time", f.OriginalPath))
+		}
+		if len(problems) > 0 {
+			issues = append(issues, core.PortabilityIssue{Path: f.Path, Problems: problems})
+		}
+	}
+	sort.Slice(issues, func(i, j int) bool { return issues[i].Path < issues[j].Path })
+	return issues
+}
@@ -0,0 +1,148 @@
+package calculate
+
+import (
+	"errors"
+	"main/core"
+	"strings"
+	"testing"
+)
+
+func TestPortabilityProblems(t *testing.T) {
+	longName := strings.Repeat("n", 256)
+	longPath := strings.Repeat("dir/", 65) + "file.txt"
+	tests := []struct {
+		path      string
+		want      string // part of the first problem expected, "" for a portable path
+		sanitized string
+	}{
+		{"src/main.go", "", "src/main.go"},
+		{"CON", "reserved device name", "CON_"},
+		{"docs/nul.txt", "reserved device name", "docs/nul_.txt"},
+		{"lpt9.tar.gz", "reserved device name", "lpt9_.tar.gz"},
+		{"com1 /a.txt", "ends with a dot or space", "com1_/a.txt"},
+		{"console.txt", "", "console.txt"},
+		{"notes.", "ends with a dot or space", "notes"},
+		{"dir /file", "ends with a dot or space", "dir/file"},
+		{"a:b?.txt", "characters invalid on Windows", "a_b_.txt"},
+		{"tab\tname", "characters invalid on Windows", "tab_name"},
+		{longPath, "path is 268 characters long", longPath},
+	}
+	for _, tt := range tests {
+		problems := portabilityProblems(tt.path)
+		if tt.want == "" && len(problems) > 0 || tt.want != "" && (len(problems) == 0 || !strings.Contains(problems[0], tt.want)) {
+			t.Errorf("problems of %q = %q, want %q", tt.path, problems, tt.want)
+		}
+		if got := sanitizePath(tt.path); got != tt.sanitized {
+			t.Errorf("sanitizePath(%q) = %q, want %q", tt.path, got, tt.sanitized)
+		}
+		if again := sanitizePath(tt.sanitized); tt.sanitized != tt.path && again != tt.sanitized {
+			t.Errorf("sanitizing %q again renames it to %q", tt.sanitized, again)
+		}
+	}
+	if problems := portabilityProblems(longName); len(problems) != 1 || !strings.Contains(problems[0], "is 256 characters long") {
+		t.Errorf("problems of a 256 character name = %q", problems)
+	}
+	got := sanitizePath(longName)
+	if len(got) != maxPortableNameLength || !strings.HasPrefix(got, strings.Repeat("n", 246)+"~") || got != sanitizePath(longName) {
+		t.Errorf("sanitized long name %q is not a deterministic %d character name", got, maxPortableNameLength)
+	}
+}
+
+func TestCaseCollisions(t *testing.T) {
+	got := caseCollisions([]string{"README.md", "readme.md", "Readme.MD", "src/a.go", "SRC/b.go"})
+	want := map[string]string{
+		"README.md": "Readme.MD,readme.md",
+		"Readme.MD": "README.md,readme.md",
+		"readme.md": "README.md,Readme.MD",
+	}
+	if len(got) != len(want) {
+		t.Errorf("collisions = %v, want %v", got, want)
+	}
+	for path, others := range want {
+		if strings.Join(got[path], ",") != others {
+			t.Errorf("collisions of %s = %v, want %s", path, got[path], others)
+		}
+	}
+}
+
+func TestPathPolicies(t *testing.T) {
+	contents := map[string]string{
+		"ok.txt":           "portable",
+		"aux.c":            "reserved name",
+		"trailing. ":       "trailing dot and space",
+		"Makefile":         "differs only in case",
+		"makefile":         "from this one",
+		"what?.txt":        "invalid character",
+		"nested/CON/x.txt": "reserved directory name",
+	}
+
+	snapshot := func(policy string) (*core.SnapshotResponse, error) {
+		codebase, err := NewInitService().InitializeCodebase("portability-"+policy, "", "main", &core.CodebaseSettings{PathPolicy: policy}, InitOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewUploadService().ProcessSnapshot(codebase.ID, "v1", "main", "", snapshotFiles(contents), nil, true, SnapshotOptions{})
+	}
+	useMemoryBackends(t)
+
+	_, err := snapshot(PathPolicyReject)
+	var portabilityErr *PortabilityError
+	if !errors.As(err, &portabilityErr) {
+		t.Fatalf("reject policy = %v, want a PortabilityError", err)
+	}
+	var rejected []string
+	for _, issue := range portabilityErr.Issues {
+		rejected = append(rejected, issue.Path)
+	}
+	if want := "Makefile,aux.c,makefile,nested/CON/x.txt,trailing. ,what?.txt"; strings.Join(rejected, ",") != want {
+		t.Errorf("rejected paths = %v, want %s", rejected, want)
+	}
+
+	resp, err := snapshot(PathPolicyWarn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.PortabilityWarnings) != len(rejected) || len(resp.FileTree.Files) != len(contents) {
+		t.Errorf("warn policy stored %d files with warnings %+v", len(resp.FileTree.Files), resp.PortabilityWarnings)
+	}
+
+	resp, err = snapshot(PathPolicySanitize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := make(map[string]string)
+	for _, f := range resp.FileTree.Files {
+		stored[f.Path] = f.OriginalPath
+	}
+	want := map[string]string{
+		"ok.txt":            "",
+		"aux_.c":            "aux.c",
+		"trailing":          "trailing. ",
+		"Makefile":          "",
+		"makefile":          "",
+		"what_.txt":         "what?.txt",
+		"nested/CON_/x.txt": "nested/CON/x.txt",
+	}
+	if len(stored) != len(want) {
+		t.Errorf("sanitize policy stored %v, want %v", stored, want)
+	}
+	for path, original := range want {
+		if got, ok := stored[path]; !ok || got != original {
+			t.Errorf("sanitized %s stored = %v with original path %q, want %q", path, ok, got, original)
+		}
+	}
+	for _, issue := range resp.PortabilityWarnings {
+		if wantRenamed := issue.Path != "Makefile" && issue.Path != "makefile"; (issue.SanitizedPath != "") != wantRenamed {
+			t.Errorf("warning %+v, want a sanitized path = %v", issue, wantRenamed)
+		}
+	}
+
+	// The archive check reports the case collision and the renames of the stored version
+	issues, err := NewArchiveService().CheckPortability(resp.Codebase.ID, "main", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 6 {
+		t.Errorf("portability of the sanitized version = %+v, want the 2 colliding and 4 renamed paths", issues)
+	}
+}
@@ -0,0 +1,139 @@
+package calculate
+
+import (
+	"log"
+	"main/core"
+	"sync"
+	"time"
+)
+
+// Progress lines are emitted when either threshold is reached since the previous line,
+// so a snapshot logs at most files/N + duration/T of them.
+const (
+	progressLogEveryFiles = 1000
+	progressLogInterval   = 5 * time.Second
+)
+
+// SnapshotProgressStatus is a point-in-time view of a snapshot being processed
+type SnapshotProgressStatus struct {
+	CodebaseID     string    `json:"codebase_id"`
+	Branch         string    `json:"branch"`
+	Version        string    `json:"version"`
+	DeclaredFiles  int       `json:"declared_files"`
+	DeclaredBytes  int64     `json:"declared_bytes"`
+	ProcessedFiles int       `json:"processed_files"`
+	ProcessedBytes int64     `json:"processed_bytes"`
+	StoredBytes    int64     `json:"stored_bytes"`
+	DedupHits      int       `json:"dedup_hits"` // files whose content was already stored by this snapshot
+	StartedAt      time.Time `json:"started_at"`
+}
+
+// SnapshotProgress collects counters while a snapshot's files are processed and writes
+// rate-limited key=value log lines from them. The same counters back Status, so other
+// progress consumers don't have to recompute them.
+type SnapshotProgress struct {
+	mu              sync.Mutex
+	status          SnapshotProgressStatus
+	storedKeys      map[string]bool
+	lastLogAt       time.Time
+	lastLoggedFiles int
+
+	now  func() time.Time
+	logf func(format string, args ...interface{})
+}
+
+func newSnapshotProgress(codebaseID, branch, version string) *SnapshotProgress {
+	return &SnapshotProgress{
+		status:     SnapshotProgressStatus{CodebaseID: codebaseID, Branch: branch, Version: version},
+		storedKeys: make(map[string]bool),
+		now:        time.Now,
+		logf:       log.Printf,
+	}
+}
+
+// Status returns a copy of the current counters.
+func (p *SnapshotProgress) Status() SnapshotProgressStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// start records what the client sent and logs the start line.
+func (p *SnapshotProgress) start(declaredFiles int, declaredBytes int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.DeclaredFiles = declaredFiles
+	p.status.DeclaredBytes = declaredBytes
+	p.status.StartedAt = p.now()
+	p.lastLogAt = p.status.StartedAt
+	p.logf("event=snapshot_start codebase_id=%s branch=%q version=%q files=%d bytes=%d",
+		p.status.CodebaseID, p.status.Branch, p.status.Version, declaredFiles, declaredBytes)
+}
+
+// fileDone accounts a processed file and logs a progress line when a threshold is reached.
+func (p *SnapshotProgress) fileDone(f core.File) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.ProcessedFiles++
+	p.status.ProcessedBytes += f.Size
+
+	stored := false
+	if len(f.Chunks) > 0 {
+		for _, c := range f.Chunks {
+			if !p.storedKeys[c.StorageKey] {
+				p.storedKeys[c.StorageKey] = true
+				p.status.StoredBytes += c.CompressedSize
+				stored = true
+			}
+		}
+	} else if !p.storedKeys[f.StorageKey] {
+		p.storedKeys[f.StorageKey] = true
+		p.status.StoredBytes += f.CompressedSize
+		stored = true
+	}
+	if !stored {
+		p.status.DedupHits++
+	}
+
+	now := p.now()
+	if p.status.ProcessedFiles-p.lastLoggedFiles < progressLogEveryFiles && now.Sub(p.lastLogAt) < progressLogInterval {
+		return
+	}
+	p.lastLogAt = now
+	p.lastLoggedFiles = p.status.ProcessedFiles
+	p.logf("event=snapshot_progress codebase_id=%s branch=%q version=%q files=%d/%d bytes=%d/%d stored_bytes=%d dedup_hits=%d elapsed_ms=%d",
+		p.status.CodebaseID, p.status.Branch, p.status.Version,
+		p.status.ProcessedFiles, p.status.DeclaredFiles, p.status.ProcessedBytes, p.status.DeclaredBytes,
+		p.status.StoredBytes, p.status.DedupHits, now.Sub(p.status.StartedAt).Milliseconds())
+}
+
+// finish logs the summary line of a successful snapshot.
+func (p *SnapshotProgress) finish(versionID string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.logf("event=snapshot_done codebase_id=%s branch=%q version=%q version_id=%s files=%d bytes=%d stored_bytes=%d dedup_hits=%d elapsed_ms=%d",
+		p.status.CodebaseID, p.status.Branch, p.status.Version, versionID,
+		p.status.ProcessedFiles, p.status.ProcessedBytes, p.status.StoredBytes, p.status.DedupHits,
+		p.now().Sub(p.status.StartedAt).Milliseconds())
+}
+
+// fail logs the summary line of a snapshot that was aborted.
+func (p *SnapshotProgress) fail(err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.logf("event=snapshot_failed codebase_id=%s branch=%q version=%q files=%d/%d elapsed_ms=%d error=%q",
+		p.status.CodebaseID, p.status.Branch, p.status.Version,
+		p.status.ProcessedFiles, p.status.DeclaredFiles, p.now().Sub(p.status.StartedAt).Milliseconds(), err.Error())
+}
@@ -0,0 +1,62 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Progress lines stay within files/N + duration/T however the files arrive.
+func TestSnapshotProgressLogVolume(t *testing.T) {
+	tests := []struct {
+		name      string
+		files     int
+		perFile   time.Duration
+		wantLines int // progress lines, besides the start and summary lines
+	}{
+		{"many fast files", 100000, time.Millisecond, 100},
+		{"few slow files", 60, time.Second, 12},
+		{"moderate pace", 5000, 3 * time.Millisecond, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+			var lines []string
+			progress := newSnapshotProgress("cb", "main", "v1")
+			progress.now = clock.now
+			progress.logf = func(format string, args ...interface{}) { lines = append(lines, fmt.Sprintf(format, args...)) }
+
+			progress.start(tt.files, int64(tt.files)*10)
+			for i := 0; i < tt.files; i++ {
+				clock.t = clock.t.Add(tt.perFile)
+				// Every other file repeats the content of the one before it
+				progress.fileDone(core.File{Size: 10, CompressedSize: 8, StorageKey: fmt.Sprintf("obj-%d", i/2)})
+			}
+			progress.finish("version-id")
+
+			elapsed := time.Duration(tt.files) * tt.perFile
+			bound := tt.files/progressLogEveryFiles + int(elapsed/progressLogInterval)
+			if got := len(lines) - 2; got != tt.wantLines || got > bound {
+				t.Errorf("%d progress lines, want %d and at most %d", got, tt.wantLines, bound)
+			}
+			if !strings.HasPrefix(lines[0], "event=snapshot_start ") || !strings.HasPrefix(lines[len(lines)-1], "event=snapshot_done ") {
+				t.Errorf("first and last lines = %q, %q", lines[0], lines[len(lines)-1])
+			}
+			for _, line := range lines[1 : len(lines)-1] {
+				if !strings.HasPrefix(line, "event=snapshot_progress codebase_id=cb ") {
+					t.Fatalf("progress line %q", line)
+				}
+			}
+			want := fmt.Sprintf("files=%d bytes=%d stored_bytes=%d dedup_hits=%d elapsed_ms=%d",
+				tt.files, tt.files*10, (tt.files+1)/2*8, tt.files/2, elapsed.Milliseconds())
+			if !strings.HasSuffix(lines[len(lines)-1], want) {
+				t.Errorf("summary %q, want it to end with %q", lines[len(lines)-1], want)
+			}
+			if status := progress.Status(); status.ProcessedFiles != tt.files || status.DedupHits != tt.files/2 {
+				t.Errorf("status = %+v", status)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package calculate
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"main/core"
+	"main/utils"
+	"time"
+)
+
+// Ways an operator can resolve a quarantined object
+const (
+	QuarantineReupload = "reupload" // store the original content again under the same key
+	QuarantineRecheck  = "recheck"  // the object was repaired out of band, verify it and release it
+	QuarantinePurge    = "purge"    // delete the object, affected files are exported as placeholders from now on
+)
+
+// corruptPlaceholderSuffix is appended to the path of a file replaced in a partial archive
+const corruptPlaceholderSuffix = ".CORRUPT"
+
+// QuarantineService records corrupt objects found at read time and lets operators resolve them
+type QuarantineService struct {
+	now func() time.Time
+}
+
+func NewQuarantineService() *QuarantineService {
+	return &QuarantineService{now: time.Now}
+}
+
+// recordIfCorrupt quarantines the object behind err when err is a *CorruptObjectError.
+// Recording failures are logged, the read error is what the caller reports.
+func (s *QuarantineService) recordIfCorrupt(codebaseID string, err error) {
+	var corrupt *CorruptObjectError
+	if !errors.As(err, &corrupt) {
+		return
+	}
+	if recordErr := s.record(codebaseID, corrupt); recordErr != nil {
+		log.Printf("Failed to quarantine object %s: %v", corrupt.StorageKey, recordErr)
+	}
+}
+
+// record adds or refreshes the quarantine entry of a corrupt object, listing every file of the codebase that references it.
+func (s *QuarantineService) record(codebaseID string, corrupt *CorruptObjectError) error {
+	provider := core.GetProvider()
+	now := s.now()
+
+	entry := &core.QuarantineEntry{
+		StorageKey: corrupt.StorageKey,
+		CodebaseID: codebaseID,
+		Reason:     corrupt.Reason,
+		DetectedAt: now,
+		LastSeenAt: now,
+		Affected:   []core.QuarantinedFile{},
+	}
+	if existing, err := s.find(provider, corrupt.StorageKey); err == nil {
+		entry.DetectedAt = existing.DetectedAt
+		entry.PurgedAt = existing.PurgedAt
+	}
+
+	versions, err := provider.ListVersions(codebaseID)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		files, err := provider.GetFileIndexesByTreeID(v.TreeID)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			for _, key := range f.StorageKeys() {
+				if key == corrupt.StorageKey {
+					entry.Affected = append(entry.Affected, core.QuarantinedFile{VersionID: v.ID, Branch: v.Branch, Version: v.Version, Path: f.Path})
+					break
+				}
+			}
+		}
+	}
+
+	log.Printf("Object quarantined: key=%s, codebase=%s, reason=%s, affected_files=%d", entry.StorageKey, codebaseID, entry.Reason, len(entry.Affected))
+	return provider.SaveQuarantineEntry(entry)
+}
+
+func (s *QuarantineService) find(provider core.DataProvider, storageKey string) (*core.QuarantineEntry, error) {
+	entries, err := provider.ListQuarantineEntries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.StorageKey == storageKey {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("quarantine entry %s not found", storageKey)
+}
+
+// purgedKeys returns the storage keys whose objects were purged after being quarantined.
+func (s *QuarantineService) purgedKeys() map[string]bool {
+	keys := make(map[string]bool)
+	entries, err := core.GetProvider().ListQuarantineEntries()
+	if err != nil {
+		return keys
+	}
+	for _, e := range entries {
+		if e.PurgedAt != nil {
+			keys[e.StorageKey] = true
+		}
+	}
+	return keys
+}
+
+// List returns every quarantined object with the versions and paths that reference it.
+func (s *QuarantineService) List() ([]*core.QuarantineEntry, error) {
+	return core.GetProvider().ListQuarantineEntries()
+}
+
+// Resolve applies an operator decision to a quarantined object. Reupload and recheck release the
+// entry once the object verifies again; purge deletes the object and keeps the entry for reference.
+func (s *QuarantineService) Resolve(storageKey, action string, content []byte) (*core.QuarantineEntry, error) {
+	provider := core.GetProvider()
+	storage := core.GetStore()
+	entry, err := s.find(provider, storageKey)
+	if err != nil {
+		return nil, err
+	}
+
+	switch action {
+	case QuarantineReupload, QuarantineRecheck:
+		file, err := s.referencingFile(provider, entry)
+		if err != nil {
+			return nil, err
+		}
+		if action == QuarantineReupload {
+			if content == nil {
+				return nil, fmt.Errorf("invalid resolve: reupload needs the original content")
+			}
+			if utils.CalculateHash(content) != file.Hash {
+				return nil, fmt.Errorf("invalid resolve: uploaded content does not match hash %s", file.Hash)
+			}
+			stored := content
+			if encoding := file.ContentEncoding(); encoding != "" {
+				if stored, err = compressContent(content, encoding); err != nil {
+					return nil, err
+				}
+			}
+			if err := storage.PutObject(storageKey, stored); err != nil {
+				return nil, fmt.Errorf("failed to store object %s: %w", storageKey, err)
+			}
+		}
+		if _, err := readFileContent(storage, file); err != nil {
+			return nil, fmt.Errorf("invalid resolve: object %s still does not verify: %w", storageKey, err)
+		}
+		if err := provider.DeleteQuarantineEntry(storageKey); err != nil {
+			return nil, err
+		}
+		log.Printf("Quarantined object released: key=%s, action=%s", storageKey, action)
+		return entry, nil
+	case QuarantinePurge:
+		if err := storage.DeleteObject(storageKey); err != nil {
+			return nil, fmt.Errorf("failed to delete object %s: %w", storageKey, err)
+		}
+		purgedAt := s.now()
+		entry.PurgedAt = &purgedAt
+		if err := provider.SaveQuarantineEntry(entry); err != nil {
+			return nil, err
+		}
+		log.Printf("Quarantined object purged: key=%s", storageKey)
+		return entry, nil
+	default:
+		return nil, fmt.Errorf("invalid resolve action %q (supported: %s, %s, %s)", action, QuarantineReupload, QuarantineRecheck, QuarantinePurge)
+	}
+}
+
+// referencingFile returns a file description that reads exactly the quarantined object, so it can be verified on its own.
+func (s *QuarantineService) referencingFile(provider core.DataProvider, entry *core.QuarantineEntry) (core.File, error) {
+	for _, affected := range entry.Affected {
+		v, err := provider.GetVersionByID(affected.VersionID)
+		if err != nil {
+			continue
+		}
+		files, err := provider.GetFileIndexesByTreeID(v.TreeID)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if f.StorageKey == entry.StorageKey {
+				return f, nil
+			}
+			for _, c := range f.Chunks {
+				if c.StorageKey == entry.StorageKey {
+					return core.File{Path: f.Path, Hash: c.Hash, StorageKey: c.StorageKey, Type: "compressed"}, nil
+				}
+			}
+		}
+	}
+	return core.File{}, fmt.Errorf("no file referencing object %s was found", entry.StorageKey)
+}
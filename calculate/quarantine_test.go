@@ -0,0 +1,129 @@
+package calculate
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"main/core"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// zipContents reads back the entries of a zip archive.
+func zipContents(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make(map[string]string)
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[f.Name] = string(content)
+	}
+	return contents
+}
+
+func TestPartialArchiveQuarantinesCorruptObject(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := core.NewLocalStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	core.SetProvidersForTesting(core.NewMemoryProvider(), storage)
+	codebase := mustInitCodebase(t, "quarantine")
+	mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"a.txt": "intact", "b.txt": "gets corrupted"})
+	v2 := mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{"a.txt": "intact, changed", "b.txt": "gets corrupted"})
+	key := fileKeys(t, v2.Version.ID)["b.txt"]
+	if err := os.WriteFile(filepath.Join(dir, key), []byte("bit rot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archives := NewArchiveService()
+	build := func(allowPartial bool) (map[string]string, []string, error) {
+		t.Helper()
+		archive, err := archives.PrepareArchive(codebase.ID, "main", "v2", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		corrupted, err := archives.WriteArchive(&buf, archive, ArchiveZip, "", allowPartial)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zipContents(t, buf.Bytes()), corrupted, nil
+	}
+
+	var corrupt *CorruptObjectError
+	if _, _, err := build(false); !errors.As(err, &corrupt) || corrupt.StorageKey != key {
+		t.Fatalf("archive of the corrupt version = %v, want a CorruptObjectError for %s", err, key)
+	}
+	contents, corrupted, err := build(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(corrupted, []string{"b.txt"}) || contents["a.txt"] != "intact, changed" || len(contents) != 2 {
+		t.Errorf("partial archive = %v replacing %v, want a.txt and the placeholder of b.txt", contents, corrupted)
+	}
+	if _, ok := contents["b.txt"+corruptPlaceholderSuffix]; !ok {
+		t.Errorf("partial archive %v has no placeholder for b.txt", contents)
+	}
+
+	quarantine := NewQuarantineService()
+	entries, err := quarantine.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].StorageKey != key || entries[0].CodebaseID != codebase.ID {
+		t.Fatalf("quarantine = %+v, want the object of b.txt", entries)
+	}
+	var affected []string
+	for _, f := range entries[0].Affected {
+		affected = append(affected, f.Branch+"/"+f.Version+"/"+f.Path)
+	}
+	if len(affected) != 2 || affected[0] == affected[1] {
+		t.Errorf("affected files = %v, want b.txt of v1 and v2", affected)
+	}
+
+	if _, err := quarantine.Resolve(key, QuarantineReupload, []byte("something else")); err == nil {
+		t.Error("reupload of different content was accepted")
+	}
+	if _, err := quarantine.Resolve(key, QuarantineReupload, []byte("gets corrupted")); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := quarantine.List(); len(entries) != 0 {
+		t.Errorf("quarantine after the reupload = %+v, want it released", entries)
+	}
+	if contents, _, err := build(false); err != nil || contents["b.txt"] != "gets corrupted" {
+		t.Errorf("archive after the reupload = %v, %v", contents, err)
+	}
+
+	// A purged object stays quarantined and its files are exported as placeholders from then on
+	os.WriteFile(filepath.Join(dir, key), []byte("bit rot"), 0644)
+	if _, _, err := build(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := quarantine.Resolve(key, QuarantinePurge, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := build(false); err == nil {
+		t.Error("archive of a version with a purged object succeeded")
+	}
+	if _, corrupted, err := build(true); err != nil || !reflect.DeepEqual(corrupted, []string{"b.txt"}) {
+		t.Errorf("partial archive after the purge replaced %v, %v", corrupted, err)
+	}
+	if entries, _ := quarantine.List(); len(entries) != 1 || entries[0].PurgedAt == nil {
+		t.Errorf("quarantine after the purge = %+v, want the entry marked purged", entries)
+	}
+}
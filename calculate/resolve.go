@@ -0,0 +1,189 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Version aliases accepted wherever a version is addressed by branch and label
+const (
+	HeadVersion   = "HEAD"   // current head of a branch, including the source of a branch without snapshots
+	LatestVersion = "latest" // newest snapshot on a branch
+)
+
+// resolveVersion locates a version by branch and version label.
+// The HEAD alias resolves to the latest version on the branch, or to the
+// source version of an explicitly created branch that has no snapshots yet.
+// The latest alias only resolves to snapshots taken on the branch; a version
+// actually labelled "latest" takes precedence over the alias.
+func resolveVersion(provider core.DataProvider, codebaseID, branch, version string) (*core.Version, error) {
+	if err := validateVersionRef(branch, version); err != nil {
+		return nil, err
+	}
+	branch = branchForLookup(provider, codebaseID, branch)
+	if version == LatestVersion {
+		if v, err := provider.GetVersion(codebaseID, branch, version); err == nil {
+			return v, nil
+		}
+		latest, err := provider.FindLatestVersionInBranch(codebaseID, branch, "")
+		if err != nil {
+			return nil, err
+		}
+		if latest == nil {
+			return nil, fmt.Errorf("latest version of branch %s not found: the branch has no versions", branch)
+		}
+		return latest, nil
+	}
+	if version != HeadVersion {
+		return lookupVersion(provider, codebaseID, branch, version)
+	}
+
+	latest, err := provider.FindLatestVersionInBranch(codebaseID, branch, "")
+	if err != nil {
+		return nil, err
+	}
+	if latest != nil {
+		return latest, nil
+	}
+
+	ref, err := provider.GetBranchRef(codebaseID, branch)
+	if err != nil {
+		return nil, err
+	}
+	if ref == nil {
+		return nil, fmt.Errorf("branch %s not found", branch)
+	}
+	return provider.GetVersionByID(ref.VersionID)
+}
+
+// VersionSelector addresses a version by branch and label, by tag or by version ID
+type VersionSelector struct {
+	Branch    string
+	Version   string
+	Tag       string
+	VersionID string
+}
+
+// LocateVersion resolves a selector to the branch and label of the version it addresses, so that
+// endpoints working with branch and label accept tags and version IDs too.
+func LocateVersion(codebaseID string, sel VersionSelector) (VersionIdentifier, error) {
+	v, err := locateVersion(core.GetProvider(), codebaseID, sel)
+	if err != nil {
+		return VersionIdentifier{}, err
+	}
+	return VersionIdentifier{Branch: v.Branch, Version: v.Version}, nil
+}
+
+// locateVersion returns the version addressed by a selector. Exactly one form must be given.
+func locateVersion(provider core.DataProvider, codebaseID string, sel VersionSelector) (*core.Version, error) {
+	forms := 0
+	if sel.Branch != "" || sel.Version != "" {
+		forms++
+	}
+	if sel.Tag != "" {
+		forms++
+	}
+	if sel.VersionID != "" {
+		forms++
+	}
+	switch {
+	case forms > 1:
+		return nil, fmt.Errorf("invalid version selector: give only one of branch and version, tag or version_id")
+	case sel.Tag != "":
+		tag, err := provider.ResolveTag(codebaseID, sel.Tag)
+		if err != nil {
+			return nil, err
+		}
+		v, err := provider.GetVersionByID(tag.VersionID)
+		if err != nil {
+			return nil, fmt.Errorf("version of tag %s not found: %w", sel.Tag, err)
+		}
+		return v, nil
+	case sel.VersionID != "":
+		v, err := provider.GetVersionByID(sel.VersionID)
+		if err != nil || v.CodebaseID != codebaseID {
+			return nil, fmt.Errorf("version %s not found", sel.VersionID)
+		}
+		return v, nil
+	case sel.Branch == "" || sel.Version == "":
+		return nil, fmt.Errorf("invalid version selector: branch and version, tag or version_id is required")
+	}
+	return resolveVersion(provider, codebaseID, sel.Branch, sel.Version)
+}
+
+// maxNearestVersions bounds the suggestions returned with a VersionNotFoundError
+const maxNearestVersions = 3
+
+// VersionNotFoundError reports a version label that is missing on the requested branch
+// but exists on other branches of the same codebase.
+type VersionNotFoundError struct {
+	Branch          string   `json:"branch"`
+	Version         string   `json:"version"`
+	FoundOnBranches []string `json:"found_on_branches"`
+	NearestVersions []string `json:"nearest_versions"` // versions on the requested branch closest in time
+}
+
+func (e *VersionNotFoundError) Error() string {
+	return fmt.Sprintf("version %s/%s not found (version %s exists on branch %s)",
+		e.Branch, e.Version, e.Version, strings.Join(e.FoundOnBranches, ", "))
+}
+
+// lookupVersion is GetVersion with a more helpful error when the label exists on another branch.
+func lookupVersion(provider core.DataProvider, codebaseID, branch, version string) (*core.Version, error) {
+	if err := validateVersionRef(branch, version); err != nil {
+		return nil, err
+	}
+	branch = branchForLookup(provider, codebaseID, branch)
+	v, err := provider.GetVersion(codebaseID, branch, version)
+	if err == nil {
+		return v, nil
+	}
+
+	branches, lookupErr := provider.FindBranchesWithVersion(codebaseID, version)
+	if lookupErr != nil || len(branches) == 0 {
+		return nil, err
+	}
+	for _, b := range branches {
+		if b == branch {
+			// The label is indexed on this branch, the failure is something else
+			return nil, err
+		}
+	}
+
+	notFound := &VersionNotFoundError{
+		Branch:          branch,
+		Version:         version,
+		FoundOnBranches: branches,
+		NearestVersions: []string{},
+	}
+	other, otherErr := provider.GetVersion(codebaseID, branches[0], version)
+	if otherErr != nil {
+		return nil, notFound
+	}
+	versions, otherErr := provider.ListVersions(codebaseID)
+	if otherErr != nil {
+		return nil, notFound
+	}
+
+	var candidates []*core.Version
+	for _, candidate := range versions {
+		if candidate.Branch == branch {
+			candidates = append(candidates, candidate)
+		}
+	}
+	distance := func(c *core.Version) time.Duration {
+		d := c.CreatedAt.Sub(other.CreatedAt)
+		if d < 0 {
+			return -d
+		}
+		return d
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return distance(candidates[i]) < distance(candidates[j]) })
+	for i := 0; i < len(candidates) && i < maxNearestVersions; i++ {
+		notFound.NearestVersions = append(notFound.NearestVersions, candidates[i].Version)
+	}
+	return nil, notFound
+}
@@ -0,0 +1,59 @@
+package calculate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveVersionAliases(t *testing.T) {
+	provider, _ := useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "aliases")
+	mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"a.txt": "one"})
+	v2 := mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{"a.txt": "two"})
+	if _, err := NewBranchService().CreateBranch(codebase.ID, "empty", VersionIdentifier{Branch: "main", Version: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		branch, version string
+		want            string
+		wantErr         string
+	}{
+		{"main", LatestVersion, "v2", ""},
+		{"main", HeadVersion, "v2", ""},
+		// HEAD of a branch without snapshots is its source, latest only counts snapshots on the branch
+		{"empty", HeadVersion, "v1", ""},
+		{"empty", LatestVersion, "", "branch empty not found: the branch has no versions"},
+		{"missing", HeadVersion, "", "branch missing not found"},
+		{"missing", LatestVersion, "", "branch missing not found: the branch has no versions"},
+	} {
+		v, err := resolveVersion(provider, codebase.ID, tt.branch, tt.version)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s/%s = %v, want an error containing %q", tt.branch, tt.version, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || v.Version != tt.want {
+			t.Errorf("%s/%s = %v, %v, want %s", tt.branch, tt.version, v, err, tt.want)
+		}
+	}
+
+	// The read APIs take the alias
+	archives := NewArchiveService()
+	tree, err := archives.GetTree(codebase.ID, "main", LatestVersion, false)
+	if err != nil || tree.VersionID != v2.Version.ID {
+		t.Errorf("tree of main/latest = %+v, %v, want v2", tree, err)
+	}
+	diff, err := NewDiffService().Diff(codebase.ID, VersionIdentifier{Branch: "main", Version: "v1"}, VersionIdentifier{Branch: "main", Version: LatestVersion})
+	if err != nil || diff.To.ID != v2.Version.ID || len(diff.Modified) != 1 {
+		t.Errorf("diff of v1 and main/latest = %+v, %v, want a.txt modified in v2", diff, err)
+	}
+
+	// A version actually labelled latest wins over the alias
+	labelled := mustSnapshot(t, codebase.ID, "main", LatestVersion, map[string]string{"a.txt": "labelled"})
+	mustSnapshot(t, codebase.ID, "main", "v3", map[string]string{"a.txt": "three"})
+	if v, err := resolveVersion(provider, codebase.ID, "main", LatestVersion); err != nil || v.ID != labelled.Version.ID {
+		t.Errorf("main/latest with a version labelled latest = %v, %v, want that version", v, err)
+	}
+}
@@ -0,0 +1,94 @@
+package calculate
+
+import (
+	"io"
+	"main/core"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// writeCountingStorage counts the writes of each object
+type writeCountingStorage struct {
+	*core.MemoryStorage
+	mu     sync.Mutex
+	writes map[string]int
+}
+
+func (s *writeCountingStorage) count(name string) {
+	s.mu.Lock()
+	s.writes[name]++
+	s.mu.Unlock()
+}
+
+func (s *writeCountingStorage) PutObject(name string, data []byte) error {
+	s.count(name)
+	return s.MemoryStorage.PutObject(name, data)
+}
+
+func (s *writeCountingStorage) PutObjectStream(name string, r io.Reader, size int64) error {
+	s.count(name)
+	return s.MemoryStorage.PutObjectStream(name, r, size)
+}
+
+func (s *writeCountingStorage) takeWrites() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writes := s.writes
+	s.writes = make(map[string]int)
+	return writes
+}
+
+func TestProcessSnapshotSkipsExistingObjects(t *testing.T) {
+	provider, memory := useMemoryBackends(t)
+	storage := &writeCountingStorage{MemoryStorage: memory, writes: make(map[string]int)}
+	core.SetProvidersForTesting(provider, storage)
+	codebase := mustInitCodebase(t, "reuse")
+
+	asset := strings.Repeat("an asset that doesn't change ", 200)
+	v1 := mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"asset.txt": asset, "tiny.txt": "x", "a.txt": strings.Repeat("first ", 50)})
+	if stats := v1.Version.Stats; stats.ReusedFiles != 0 || stats.ReusedBytes != 0 {
+		t.Errorf("the first snapshot reused %d files, %d bytes", stats.ReusedFiles, stats.ReusedBytes)
+	}
+	storage.takeWrites()
+
+	// tiny.txt grew when compressed and is stored raw; the raw object is found again as well
+	v2 := mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{"asset.txt": asset, "tiny.txt": "x", "a.txt": strings.Repeat("second ", 50)})
+	if stats := v2.Version.Stats; stats.ReusedFiles != 2 || stats.ReusedBytes != int64(len(asset)+1) {
+		t.Errorf("stats of v2 = %+v, want asset.txt and tiny.txt reused, %d bytes", stats, len(asset)+1)
+	}
+	keys := fileKeys(t, v2.Version.ID)
+	writes := storage.takeWrites()
+	if writes[keys["asset.txt"]] != 0 || writes[keys["tiny.txt"]] != 0 || writes[keys["a.txt"]] != 1 {
+		t.Errorf("writes during v2 = %v, want only a.txt (%s) written", writes, keys["a.txt"])
+	}
+	if keys["asset.txt"] != fileKeys(t, v1.Version.ID)["asset.txt"] {
+		t.Error("asset.txt is stored under a new key")
+	}
+	if got := readStoredFile(t, storage, v2.Version.ID, "asset.txt"); got != asset {
+		t.Errorf("reused asset.txt reads back %d bytes, want %d", len(got), len(asset))
+	}
+}
+
+// A chunked file whose chunks all exist writes nothing and counts as reused.
+func TestProcessSnapshotSkipsExistingChunks(t *testing.T) {
+	provider, memory := useMemoryBackends(t)
+	storage := &writeCountingStorage{MemoryStorage: memory, writes: make(map[string]int)}
+	core.SetProvidersForTesting(provider, storage)
+	core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), ChunkingThresholdBytes: 1 << 10})
+	t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+	codebase := mustInitCodebase(t, "chunks")
+
+	big := strings.Repeat("chunked content ", 4<<10)
+	mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"big.txt": big})
+	storage.takeWrites()
+
+	v2 := mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{"big.txt": big, "copy.txt": big})
+	if stats := v2.Version.Stats; stats.ReusedFiles != 2 || stats.ReusedBytes != 2*int64(len(big)) {
+		t.Errorf("stats of v2 = %+v, want both files reused", stats)
+	}
+	if writes := storage.takeWrites(); len(writes) != 0 {
+		t.Errorf("v2 wrote %v, want nothing", writes)
+	}
+}
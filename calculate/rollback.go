@@ -0,0 +1,114 @@
+package calculate
+
+import (
+	"fmt"
+	"log"
+	"main/core"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A snapshot writes its objects before the file index referencing them is saved. When the snapshot fails
+// after that, e.g. because the version can't be persisted, the objects it wrote are deleted again. Only
+// objects that didn't exist when the snapshot checked for them are candidates, and the deletion waits for
+// exclusive use of objectWriters like garbage collection does: by then every concurrent snapshot that
+// deduplicated against one of them has saved its index, and objects referenced by any index are kept.
+// Objects that can't be deleted are left to garbage collection.
+
+// writtenObjects collects the keys of the objects a snapshot wrote itself
+type writtenObjects struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+func (w *writtenObjects) add(keys ...string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.keys = append(w.keys, keys...)
+}
+
+// list returns the distinct keys; files with the same content may both have written their object
+func (w *writtenObjects) list() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	seen := make(map[string]bool, len(w.keys))
+	var keys []string
+	for _, key := range w.keys {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// RollbackError reports the objects of a failed snapshot that couldn't be deleted. It wraps the error
+// that failed the snapshot, which decides the status of the response.
+type RollbackError struct {
+	Err      error    `json:"-"`
+	Objects  []string `json:"objects"` // left for garbage collection
+	Reason   string   `json:"reason"`
+	Attempts int      `json:"attempted_objects"`
+}
+
+func (e *RollbackError) Error() string {
+	return fmt.Sprintf("%v (rolling back the stored objects failed, %d of %d left for garbage collection: %s)", e.Err, len(e.Objects), e.Attempts, e.Reason)
+}
+
+func (e *RollbackError) Unwrap() error { return e.Err }
+
+// rollbackObjects deletes the objects a failed snapshot wrote that no file index references and returns
+// cause, as a *RollbackError when some of them couldn't be deleted. The caller must not hold objectWriters.
+func rollbackObjects(codebaseName string, keys []string, cause error) error {
+	if len(keys) == 0 {
+		return cause
+	}
+	objectWriters.Lock()
+	defer objectWriters.Unlock()
+
+	refs, err := core.GetProvider().BlobRefCounts(keys)
+	if err != nil {
+		log.Printf("event=snapshot_rollback_failed codebase=%q objects=%d error=%q", codebaseName, len(keys), err.Error())
+		trackOrphanedObjects(codebaseName, keys)
+		return &RollbackError{Err: cause, Objects: sortedKeys(keys), Reason: "checking references failed: " + err.Error(), Attempts: len(keys)}
+	}
+
+	storage := core.GetStore()
+	cache := core.GetBlobCache()
+	var left, reasons []string
+	deleted, shared := 0, 0
+	for _, key := range keys {
+		if refs[key] > 0 {
+			// Another snapshot deduplicated against it meanwhile
+			shared++
+			continue
+		}
+		if err := storage.DeleteObject(key); err != nil {
+			left = append(left, key)
+			reasons = append(reasons, fmt.Sprintf("%s: %v", key, err))
+			continue
+		}
+		cache.Remove(key)
+		forgetFailedSnapshotObject(key)
+		deleted++
+	}
+	log.Printf("event=snapshot_rollback codebase=%q deleted=%d shared=%d failed=%d", codebaseName, deleted, shared, len(left))
+	if len(left) == 0 {
+		return cause
+	}
+	sort.Strings(left)
+	sort.Strings(reasons)
+	log.Printf("event=snapshot_rollback_failed codebase=%q objects=%d error=%q", codebaseName, len(left), strings.Join(reasons, "; "))
+	trackOrphanedObjects(codebaseName, left)
+	return &RollbackError{Err: cause, Objects: left, Reason: strings.Join(reasons, "; "), Attempts: len(keys)}
+}
+
+func sortedKeys(keys []string) []string {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,90 @@
+package calculate
+
+import (
+	"errors"
+	"main/core"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// failingProvider fails every CreateVersion, as a full disk does when the version is persisted.
+type failingProvider struct {
+	*core.MemoryProvider
+}
+
+var errDiskFull = errors.New("no space left on device")
+
+func (p failingProvider) CreateVersion(*core.Version, []core.File) error {
+	return errDiskFull
+}
+
+// failingDeletes refuses to delete objects.
+type failingDeletes struct {
+	*core.MemoryStorage
+}
+
+func (s failingDeletes) DeleteObject(string) error {
+	return errors.New("permission denied")
+}
+
+// storedObjects lists the names of all objects in storage.
+func storedObjects(t *testing.T, storage core.Storage) []string {
+	t.Helper()
+	var names []string
+	if err := storage.ListObjects("", func(info core.ObjectInfo) error {
+		names = append(names, info.Name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The objects a snapshot wrote are deleted when its version can't be persisted; objects it
+// deduplicated against an earlier version stay.
+func TestProcessSnapshotRollsBackObjects(t *testing.T) {
+	provider, storage := useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "rollback")
+	mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"kept.txt": "stored by v1"})
+	before := storedObjects(t, storage)
+
+	core.SetProvidersForTesting(failingProvider{provider}, storage)
+	files := snapshotFiles(map[string]string{"kept.txt": "stored by v1", "a.txt": "new in v2", "dir/b.txt": "also new"})
+	_, err := NewUploadService().ProcessSnapshot(codebase.ID, "v2", "main", "", files, nil, true, SnapshotOptions{})
+	if !errors.Is(err, errDiskFull) {
+		t.Fatalf("snapshot = %v, want the persistence error", err)
+	}
+	var rollbackErr *RollbackError
+	if errors.As(err, &rollbackErr) {
+		t.Errorf("rollback left %v behind", rollbackErr.Objects)
+	}
+	if got := storedObjects(t, storage); strings.Join(got, ",") != strings.Join(before, ",") {
+		t.Errorf("objects after the failed snapshot = %v, want only those of v1 %v", got, before)
+	}
+}
+
+// Objects that can't be deleted are reported with the error that failed the snapshot.
+func TestProcessSnapshotRollbackFailure(t *testing.T) {
+	provider, storage := useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "rollback")
+	core.SetProvidersForTesting(failingProvider{provider}, failingDeletes{storage})
+
+	files := snapshotFiles(map[string]string{"a.txt": "alpha", "b.txt": "beta"})
+	_, err := NewUploadService().ProcessSnapshot(codebase.ID, "v1", "main", "", files, nil, true, SnapshotOptions{})
+	var rollbackErr *RollbackError
+	if !errors.As(err, &rollbackErr) || !errors.Is(err, errDiskFull) {
+		t.Fatalf("snapshot = %v, want a RollbackError wrapping the persistence error", err)
+	}
+	// Content this small grows when compressed, so each file left a raw and a compressed object
+	if got := storedObjects(t, storage); len(got) != 4 || strings.Join(rollbackErr.Objects, ",") != strings.Join(got, ",") {
+		t.Errorf("rollback reports %v left, storage holds %v", rollbackErr.Objects, got)
+	}
+	if !strings.Contains(rollbackErr.Reason, "permission denied") {
+		t.Errorf("reason = %q", rollbackErr.Reason)
+	}
+	if n := countFailedSnapshotObjects(rollbackErr.Objects); n != len(rollbackErr.Objects) {
+		t.Errorf("%d of the %d objects left are tracked for garbage collection", n, len(rollbackErr.Objects))
+	}
+}
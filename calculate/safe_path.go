@@ -0,0 +1,78 @@
+package calculate
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Uploaded paths become File.Path verbatim and are joined below the restore directory when an archive is
+// built, so they must stay inside it on every platform: relative, with "\" counted as a separator the way
+// Windows does, and clean, i.e. without empty, "." or ".." segments. Unclean paths are rejected rather
+// than rewritten, so file modes, attributes and manifest entries keep matching the paths as sent.
+
+// unsafePathReason explains why a path can't be stored, or returns "" for a safe one.
+func unsafePathReason(p string) string {
+	if reason := escapingPathReason(p); reason != "" {
+		return reason
+	}
+	s := strings.ReplaceAll(filepath.ToSlash(p), `\`, "/")
+	if hasDotSegment(s) {
+		if clean := path.Clean(s); clean != "." {
+			return fmt.Sprintf("path contains empty, . or .. segments, send it as %s", clean)
+		}
+		return "path contains empty, . or .. segments"
+	}
+	return ""
+}
+
+// escapingPathReason explains why a path would leave the directory it is joined to, or returns "".
+func escapingPathReason(p string) string {
+	s := strings.ReplaceAll(filepath.ToSlash(p), `\`, "/")
+	switch {
+	case s == "":
+		return "path is empty"
+	case strings.HasPrefix(s, "/") || hasVolumeName(s):
+		return "path is absolute"
+	case path.Clean(s) == ".." || strings.HasPrefix(path.Clean(s), "../"):
+		return "path escapes the snapshot root"
+	}
+	return ""
+}
+
+// hasVolumeName reports a Windows drive letter such as "C:" in front of a slash path.
+func hasVolumeName(s string) bool {
+	return len(s) >= 2 && s[1] == ':' && ('a' <= s[0] && s[0] <= 'z' || 'A' <= s[0] && s[0] <= 'Z')
+}
+
+// checkUploadPaths rejects a snapshot whose uploaded files or manifest entries have unsafe paths.
+func checkUploadPaths(files map[string]*SnapshotFile, manifest []ManifestEntry) error {
+	var problems []string
+	for relPath := range files {
+		if reason := unsafePathReason(relPath); reason != "" {
+			problems = append(problems, fmt.Sprintf("%q: %s", relPath, reason))
+		}
+	}
+	for _, entry := range manifest {
+		if reason := unsafePathReason(entry.Path); reason != "" {
+			problems = append(problems, fmt.Sprintf("manifest entry %q: %s", entry.Path, reason))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid snapshot: unsafe paths: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// restoreName returns the slash path an indexed file is restored as, relative to the archive root.
+// Indexes written before uploaded paths were checked may hold unclean paths, which are restored cleaned,
+// or escaping ones, which are refused instead of being extracted outside the archive's directory.
+func restoreName(filePath string) (string, error) {
+	if reason := escapingPathReason(filePath); reason != "" {
+		return "", fmt.Errorf("refusing to restore %q: %s", filePath, reason)
+	}
+	return path.Clean(filepath.ToSlash(filePath)), nil
+}
@@ -0,0 +1,107 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnsafePathReason(t *testing.T) {
+	tests := []struct {
+		path string
+		want string // part of the reason, "" for a safe path
+	}{
+		{"a.txt", ""},
+		{"dir/sub/a.txt", ""},
+		{"..hidden", ""},
+		{"dir/a..b", ""},
+		{"", "empty"},
+		{"..", "escapes"},
+		{"../evil.txt", "escapes"},
+		{"a/../../evil.txt", "escapes"},
+		{`..\..\evil.txt`, "escapes"},
+		{`a\..\..\evil.txt`, "escapes"},
+		{"/etc/passwd", "absolute"},
+		{`\evil.txt`, "absolute"},
+		{`C:\evil.txt`, "absolute"},
+		{"c:foo", "absolute"},
+		{"a/../b.txt", "send it as b.txt"},
+		{`a\.\b.txt`, "send it as a/b.txt"},
+		{"a//b.txt", "segments"},
+		{"./a.txt", "segments"},
+	}
+	for _, tt := range tests {
+		got := unsafePathReason(tt.path)
+		if tt.want == "" && got != "" || tt.want != "" && !strings.Contains(got, tt.want) {
+			t.Errorf("unsafePathReason(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestProcessSnapshotRejectsUnsafePaths(t *testing.T) {
+	provider, _ := useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "paths")
+	for _, p := range []string{"../evil.txt", "/etc/passwd", `..\..\evil.txt`, `C:\evil.txt`, "a/../../evil.txt"} {
+		files := snapshotFiles(map[string]string{"ok.txt": "fine", p: "evil"})
+		_, err := NewUploadService().ProcessSnapshot(codebase.ID, "v1", "main", "", files, nil, true, SnapshotOptions{})
+		if err == nil || !strings.Contains(err.Error(), "unsafe paths") {
+			t.Errorf("snapshot with %q = %v, want it rejected", p, err)
+		}
+	}
+	if versions, _ := provider.ListVersions(codebase.ID); len(versions) != 0 {
+		t.Errorf("%d versions stored from rejected snapshots", len(versions))
+	}
+	manifest := []ManifestEntry{{Path: "../evil.txt"}}
+	if _, err := NewUploadService().ProcessSnapshot(codebase.ID, "v1", "main", "", snapshotFiles(map[string]string{"ok.txt": "fine"}), nil, true, SnapshotOptions{Manifest: manifest}); err == nil || !strings.Contains(err.Error(), "manifest entry") {
+		t.Errorf("snapshot with an unsafe manifest entry = %v, want it rejected", err)
+	}
+}
+
+// Indexes written before uploaded paths were checked may hold any path; an archive cleans the
+// unclean ones and refuses to restore one that would escape its directory.
+func TestArchiveRestoreNames(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"a/./b.txt", "a/b.txt", false},
+		{"a//b.txt", "a/b.txt", false},
+		{"a/../b.txt", "b.txt", false},
+		{"../../escape.txt", "", true},
+		{`..\..\escape.txt`, "", true},
+		{"/etc/passwd", "", true},
+		{`C:\escape.txt`, "", true},
+	}
+	provider, _ := useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "restore")
+	for i, tt := range tests {
+		v := &core.Version{
+			ID:         fmt.Sprintf("%s-v%d", codebase.ID, i+1),
+			CodebaseID: codebase.ID,
+			Version:    fmt.Sprintf("v%d", i+1),
+			Branch:     "main",
+			TreeID:     fmt.Sprintf("tree-v%d", i+1),
+			CreatedAt:  time.Now(),
+		}
+		if err := provider.CreateVersion(v, []core.File{{Path: tt.path, Hash: "h", Size: 1, StorageKey: "k"}}); err != nil {
+			t.Fatal(err)
+		}
+		archive, err := NewArchiveService().PrepareArchive(codebase.ID, "main", v.Version, "")
+		if tt.wantErr {
+			if err == nil || !strings.Contains(err.Error(), "refusing to restore") {
+				t.Errorf("archive of %q = %v, want it refused", tt.path, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("archive of %q: %v", tt.path, err)
+			continue
+		}
+		if len(archive.files) != 1 || archive.files[0].Path != tt.want {
+			t.Errorf("archive of %q holds %+v, want %s", tt.path, archive.files, tt.want)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package calculate
+
+import (
+	"context"
+	"errors"
+	"log"
+	"main/core"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultBackgroundConcurrency = 1
+
+// Background job states
+const (
+	JobStateQueued  = "queued"
+	JobStateRunning = "running"
+)
+
+// BackgroundJob describes a maintenance task known to the scheduler
+type BackgroundJob struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	State     string     `json:"state"`
+	QueuedAt  time.Time  `json:"queued_at"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+}
+
+// BackgroundStatus reports the scheduler state for the admin endpoint
+type BackgroundStatus struct {
+	Paused         bool            `json:"paused"`
+	MaxConcurrency int             `json:"max_concurrency"`
+	IORateBytes    int64           `json:"io_rate_bytes"`
+	Running        []BackgroundJob `json:"running"`
+	Queued         []BackgroundJob `json:"queued"`
+	Completed      int64           `json:"completed"`
+	Failed         int64           `json:"failed"`
+}
+
+// BackgroundScheduler arbitrates maintenance work (cache rebuilds, purges, ...) so it can't
+// starve foreground requests: jobs acquire one of a limited number of slots and report
+// their disk IO through a shared rate limiter.
+type BackgroundScheduler struct {
+	mu             sync.Mutex
+	cond           *sync.Cond
+	maxConcurrency int
+	paused         bool
+	nextID         int64
+	jobs           map[int64]*BackgroundJob
+	running        int
+	completed      int64
+	failed         int64
+	throttle       *IOThrottle
+	// closed is set by Shutdown; queued jobs are dropped and no new ones are accepted
+	closed bool
+	active sync.WaitGroup
+}
+
+// errSchedulerClosed is returned by Run once Shutdown has been called.
+var errSchedulerClosed = errors.New("background jobs are shutting down")
+
+var (
+	backgroundScheduler     *BackgroundScheduler
+	backgroundSchedulerOnce sync.Once
+)
+
+// BackgroundJobs returns the process-wide scheduler configured from AppConfig.
+func BackgroundJobs() *BackgroundScheduler {
+	backgroundSchedulerOnce.Do(func() {
+		cfg := core.GetConfig()
+		backgroundScheduler = NewBackgroundScheduler(cfg.BackgroundMaxConcurrency, cfg.BackgroundIORateBytes)
+	})
+	return backgroundScheduler
+}
+
+// NewBackgroundScheduler creates a scheduler running at most maxConcurrency jobs at once,
+// with their combined IO limited to ioRateBytes per second (zero means unlimited).
+func NewBackgroundScheduler(maxConcurrency int, ioRateBytes int64) *BackgroundScheduler {
+	if maxConcurrency <= 0 {
+		maxConcurrency = defaultBackgroundConcurrency
+	}
+	s := &BackgroundScheduler{
+		maxConcurrency: maxConcurrency,
+		jobs:           make(map[int64]*BackgroundJob),
+		throttle:       NewIOThrottle(ioRateBytes),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Run executes fn once a slot is available and blocks until it finishes.
+func (s *BackgroundScheduler) Run(name string, fn func(throttle *IOThrottle) error) error {
+	job := s.enqueue(name)
+	if job == nil || !s.acquire(job) {
+		return errSchedulerClosed
+	}
+	err := fn(s.throttle)
+	s.release(job, err)
+	return err
+}
+
+// Submit queues fn to run asynchronously once a slot is available.
+func (s *BackgroundScheduler) Submit(name string, fn func(throttle *IOThrottle) error) {
+	job := s.enqueue(name)
+	if job == nil {
+		log.Printf("Background job %s dropped: %v", name, errSchedulerClosed)
+		return
+	}
+	go func() {
+		if !s.acquire(job) {
+			return
+		}
+		err := fn(s.throttle)
+		s.release(job, err)
+	}()
+}
+
+// Shutdown drops the queued jobs and waits until the running ones finish or ctx ends. Jobs queued
+// later are refused. The work dropped this way (cache rebuilds, purges) is picked up again after the
+// next start.
+func (s *BackgroundScheduler) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Pause stops queued jobs from starting; running jobs finish normally.
+func (s *BackgroundScheduler) Pause() {
+	s.mu.Lock()
+	s.paused = true
+	s.mu.Unlock()
+	log.Println("Background jobs paused")
+}
+
+// Resume lets queued jobs start again.
+func (s *BackgroundScheduler) Resume() {
+	s.mu.Lock()
+	s.paused = false
+	s.mu.Unlock()
+	s.cond.Broadcast()
+	log.Println("Background jobs resumed")
+}
+
+// Status returns the running and queued jobs.
+func (s *BackgroundScheduler) Status() BackgroundStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := BackgroundStatus{
+		Paused:         s.paused,
+		MaxConcurrency: s.maxConcurrency,
+		IORateBytes:    s.throttle.rate,
+		Running:        []BackgroundJob{},
+		Queued:         []BackgroundJob{},
+		Completed:      s.completed,
+		Failed:         s.failed,
+	}
+	for _, job := range s.jobs {
+		if job.State == JobStateRunning {
+			status.Running = append(status.Running, *job)
+		} else {
+			status.Queued = append(status.Queued, *job)
+		}
+	}
+	sort.Slice(status.Running, func(i, j int) bool { return status.Running[i].ID < status.Running[j].ID })
+	sort.Slice(status.Queued, func(i, j int) bool { return status.Queued[i].ID < status.Queued[j].ID })
+	return status
+}
+
+// enqueue registers a job, nil once the scheduler is closed.
+func (s *BackgroundScheduler) enqueue(name string) *BackgroundJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.active.Add(1)
+	s.nextID++
+	job := &BackgroundJob{ID: s.nextID, Name: name, State: JobStateQueued, QueuedAt: time.Now()}
+	s.jobs[job.ID] = job
+	return job
+}
+
+// acquire blocks until the job may start, preserving submission order among queued jobs. It returns
+// false, dropping the job, when the scheduler is closed first.
+func (s *BackgroundScheduler) acquire(job *BackgroundJob) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.closed && (s.paused || s.running >= s.maxConcurrency || s.hasOlderQueued(job.ID)) {
+		s.cond.Wait()
+	}
+	if s.closed {
+		delete(s.jobs, job.ID)
+		s.active.Done()
+		return false
+	}
+	s.running++
+	now := time.Now()
+	job.State = JobStateRunning
+	job.StartedAt = &now
+	return true
+}
+
+func (s *BackgroundScheduler) hasOlderQueued(id int64) bool {
+	for otherID, other := range s.jobs {
+		if otherID < id && other.State == JobStateQueued {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *BackgroundScheduler) release(job *BackgroundJob, err error) {
+	s.mu.Lock()
+	s.running--
+	delete(s.jobs, job.ID)
+	if err != nil {
+		s.failed++
+		log.Printf("Background job %s failed: %v", job.Name, err)
+	} else {
+		s.completed++
+	}
+	s.mu.Unlock()
+	s.active.Done()
+	s.cond.Broadcast()
+}
+
+// IOThrottle is a token bucket limiting background IO to a number of bytes per second.
+// A nil or zero-rate throttle never blocks.
+type IOThrottle struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// NewIOThrottle creates a throttle allowing bytesPerSecond with a one second burst.
+func NewIOThrottle(bytesPerSecond int64) *IOThrottle {
+	return &IOThrottle{rate: bytesPerSecond, tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+// Wait blocks until n bytes of IO are allowed.
+func (t *IOThrottle) Wait(n int64) {
+	if t == nil || t.rate <= 0 || n <= 0 {
+		return
+	}
+	t.mu.Lock()
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * float64(t.rate)
+	if t.tokens > float64(t.rate) {
+		t.tokens = float64(t.rate)
+	}
+	t.last = now
+	t.tokens -= float64(n)
+	deficit := -t.tokens
+	t.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / float64(t.rate) * float64(time.Second)))
+	}
+}
@@ -0,0 +1,127 @@
+package calculate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Shutdown lets the running job finish, drops the queued one and refuses new ones.
+func TestBackgroundSchedulerShutdown(t *testing.T) {
+	s := NewBackgroundScheduler(1, 0)
+	started, release := make(chan struct{}), make(chan struct{})
+	var finished, queuedRan atomic.Bool
+	s.Submit("running", func(*IOThrottle) error {
+		close(started)
+		<-release
+		finished.Store(true)
+		return nil
+	})
+	<-started
+	s.Submit("queued", func(*IOThrottle) error {
+		queuedRan.Store(true)
+		return nil
+	})
+
+	shutdownDone := make(chan error, 1)
+	go func() { shutdownDone <- s.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdownDone:
+		t.Fatalf("Shutdown returned %v while a job was running", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := s.Run("late", func(*IOThrottle) error { return nil }); !errors.Is(err, errSchedulerClosed) {
+		t.Errorf("Run after Shutdown = %v, want it refused", err)
+	}
+	close(release)
+	if err := <-shutdownDone; err != nil {
+		t.Fatal(err)
+	}
+	if !finished.Load() || queuedRan.Load() {
+		t.Errorf("running job finished = %v, queued job ran = %v; want only the running one", finished.Load(), queuedRan.Load())
+	}
+	if status := s.Status(); len(status.Running)+len(status.Queued) != 0 || status.Completed != 1 {
+		t.Errorf("status after Shutdown = %+v", status)
+	}
+
+	// A job outlasting the deadline is reported
+	s = NewBackgroundScheduler(1, 0)
+	stuck, block := make(chan struct{}), make(chan struct{})
+	defer close(block)
+	s.Submit("stuck", func(*IOThrottle) error {
+		close(stuck)
+		<-block
+		return nil
+	})
+	<-stuck
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown with a stuck job = %v, want the deadline error", err)
+	}
+}
+
+// BenchmarkSnapshotUnderBackgroundLoad measures foreground snapshots, each followed by a read of the
+// version map, while background jobs rebuild the history cache of a large codebase over and over.
+// With the IO rate limit the background load must cost the foreground far less than without it.
+func BenchmarkSnapshotUnderBackgroundLoad(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, bench := range []struct {
+		name        string
+		background  bool
+		ioRateBytes int64
+	}{
+		{"idle", false, 0},
+		{"unthrottled", true, 0},
+		{"throttled", true, 1 << 20},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			useMemoryBackends(b)
+			busy := mustInitCodebase(b, "busy")
+			for i := 0; i < 300; i++ {
+				mustSnapshot(b, busy.ID, "main", fmt.Sprintf("v%d", i), map[string]string{"a.txt": fmt.Sprint(i)})
+			}
+			foreground := mustInitCodebase(b, "foreground")
+
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			if bench.background {
+				scheduler := NewBackgroundScheduler(2, bench.ioRateBytes)
+				go func() {
+					defer close(done)
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						scheduler.Run("rebuild", func(throttle *IOThrottle) error {
+							_, err := NewHistoryService().rebuildHistoryCache(busy.ID, throttle)
+							return err
+						})
+					}
+				}()
+			} else {
+				close(done)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mustSnapshot(b, foreground.ID, "main", fmt.Sprintf("v%d", i), map[string]string{"a.txt": fmt.Sprint(i)})
+				if _, err := NewHistoryService().GetVersionMap(foreground.ID); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			close(stop)
+			<-done
+		})
+	}
+}
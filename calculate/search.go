@@ -0,0 +1,265 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"path"
+	"strings"
+)
+
+// attrFilterPrefix introduces an attribute filter in a file search, e.g. "attr:license=MIT"
+const attrFilterPrefix = "attr:"
+
+// FileSearchResult lists the files of a version matching a search
+type FileSearchResult struct {
+	CodebaseID string      `json:"codebase_id"`
+	Branch     string      `json:"branch"`
+	Version    string      `json:"version"`
+	VersionID  string      `json:"version_id"`
+	Pattern    string      `json:"pattern"`
+	Count      int         `json:"count"`
+	Files      []core.File `json:"files"`
+}
+
+// attrFilter matches files whose attribute Key equals Value, or that have Key at all when Value is nil
+type attrFilter struct {
+	Key   string
+	Value *string
+}
+
+// maxGlobAlternatives limits how many patterns the brace alternatives of one pattern expand to
+const maxGlobAlternatives = 256
+
+// globPattern is a slash-separated pattern whose segments are path.Match patterns. A "**" segment
+// matches any number of segments; "**" inside a segment matches like "*", within the segment only.
+// Brace alternatives such as "*.{go,mod}" are expanded into one pattern each when it is compiled.
+type globPattern struct {
+	alternatives    [][]string // the segments of each expanded pattern
+	caseInsensitive bool
+}
+
+// compileGlob validates every segment of a pattern up front so matching can't fail later.
+func compileGlob(pattern string, caseInsensitive bool) (*globPattern, error) {
+	trimmed := strings.TrimPrefix(pattern, "/")
+	if trimmed == "" {
+		return nil, fmt.Errorf("invalid pattern %q: empty", pattern)
+	}
+	if caseInsensitive {
+		trimmed = strings.ToLower(trimmed)
+	}
+	expanded, err := expandBraces(trimmed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	g := &globPattern{caseInsensitive: caseInsensitive}
+	for _, alternative := range expanded {
+		segments := strings.Split(strings.TrimPrefix(alternative, "/"), "/")
+		for i, segment := range segments {
+			if segment == "**" {
+				continue
+			}
+			segments[i] = collapseStars(segment)
+			if _, err := path.Match(segments[i], ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+		g.alternatives = append(g.alternatives, segments)
+	}
+	return g, nil
+}
+
+// expandBraces returns the patterns that the {a,b} alternatives of pattern stand for, nested ones
+// included. Braces escaped with a backslash or inside [...] are taken literally.
+func expandBraces(pattern string) ([]string, error) {
+	open, depth := -1, 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '[':
+			for i++; i < len(pattern) && pattern[i] != ']'; i++ {
+				if pattern[i] == '\\' {
+					i++
+				}
+			}
+		case '{':
+			if depth == 0 {
+				open = i
+			}
+			depth++
+		case '}':
+			if depth == 0 {
+				return nil, fmt.Errorf("unmatched }")
+			}
+			if depth--; depth > 0 {
+				continue
+			}
+			var expanded []string
+			for _, alternative := range splitAlternatives(pattern[open+1 : i]) {
+				rest, err := expandBraces(pattern[:open] + alternative + pattern[i+1:])
+				if err != nil {
+					return nil, err
+				}
+				expanded = append(expanded, rest...)
+				if len(expanded) > maxGlobAlternatives {
+					return nil, fmt.Errorf("braces expand to more than %d patterns", maxGlobAlternatives)
+				}
+			}
+			return expanded, nil
+		}
+	}
+	if depth > 0 {
+		return nil, fmt.Errorf("unmatched {")
+	}
+	return []string{pattern}, nil
+}
+
+// splitAlternatives splits the inside of a brace pair at its commas outside nested braces.
+func splitAlternatives(inner string) []string {
+	var alternatives []string
+	start, depth := 0, 0
+	for i := 0; i < len(inner); i++ {
+		switch inner[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				alternatives = append(alternatives, inner[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(alternatives, inner[start:])
+}
+
+// collapseStars turns runs of unescaped "*" into one, so "**" inside a segment matches like "*".
+func collapseStars(segment string) string {
+	var b strings.Builder
+	star := false
+	for i := 0; i < len(segment); i++ {
+		c := segment[i]
+		if c == '*' && star {
+			continue
+		}
+		star = c == '*'
+		b.WriteByte(c)
+		if c == '\\' && i+1 < len(segment) {
+			i++
+			b.WriteByte(segment[i])
+		}
+	}
+	return b.String()
+}
+
+func (g *globPattern) match(filePath string) bool {
+	if g.caseInsensitive {
+		filePath = strings.ToLower(filePath)
+	}
+	segments := strings.Split(filePath, "/")
+	for _, alternative := range g.alternatives {
+		if matchSegments(alternative, segments) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Collapse consecutive ** and try every possible split point
+			for len(pattern) > 0 && pattern[0] == "**" {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := range segments {
+				if matchSegments(pattern, segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// parseAttrFilters parses "attr:key=value" and "attr:key" filters.
+func parseAttrFilters(filters []string) ([]attrFilter, error) {
+	parsed := make([]attrFilter, 0, len(filters))
+	for _, raw := range filters {
+		if !strings.HasPrefix(raw, attrFilterPrefix) {
+			return nil, fmt.Errorf("invalid filter %q: expected %skey=value or %skey", raw, attrFilterPrefix, attrFilterPrefix)
+		}
+		key, value, hasValue := strings.Cut(strings.TrimPrefix(raw, attrFilterPrefix), "=")
+		if key == "" {
+			return nil, fmt.Errorf("invalid filter %q: empty attribute key", raw)
+		}
+		filter := attrFilter{Key: key}
+		if hasValue {
+			filter.Value = &value
+		}
+		parsed = append(parsed, filter)
+	}
+	return parsed, nil
+}
+
+func (f attrFilter) match(file core.File) bool {
+	value, ok := file.Attrs[f.Key]
+	return ok && (f.Value == nil || value == *f.Value)
+}
+
+// SearchFiles returns the files of a version whose path matches a doublestar-style glob and that carry
+// every attribute filter. Matching is case-sensitive unless caseInsensitive is set.
+func (s *ArchiveService) SearchFiles(codebaseID, branch, version, pattern string, caseInsensitive bool, filters []string) (*FileSearchResult, error) {
+	glob, err := compileGlob(pattern, caseInsensitive)
+	if err != nil {
+		return nil, err
+	}
+	attrFilters, err := parseAttrFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := s.GetTree(codebaseID, branch, version, false)
+	if err != nil {
+		return nil, err
+	}
+	result := &FileSearchResult{
+		CodebaseID: codebaseID,
+		Branch:     tree.Branch,
+		Version:    tree.Version,
+		VersionID:  tree.VersionID,
+		Pattern:    pattern,
+		Files:      []core.File{},
+	}
+	for _, f := range tree.Files {
+		if !glob.match(f.Path) {
+			continue
+		}
+		matched := true
+		for _, filter := range attrFilters {
+			if !filter.match(f) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			result.Files = append(result.Files, f)
+		}
+	}
+	result.Count = len(result.Files)
+	return result, nil
+}
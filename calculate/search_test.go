@@ -0,0 +1,100 @@
+package calculate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "src/main.go", false},
+		{"/src/*.go", "src/main.go", true},
+		// A ** segment matches any number of directories, none included
+		{"src/**/*.go", "src/main.go", true},
+		{"src/**/*.go", "src/a/b/c.go", true},
+		{"src/**/*.go", "lib/a.go", false},
+		{"**", "a/b/c", true},
+		{"**/*.go", "main.go", true},
+		{"a/**", "a/b/c", true},
+		{"a/**", "b/a", false},
+		// ** has to backtrack when the rest of the pattern matches later again
+		{"**/a/**/b", "a/x/a/b", true},
+		{"**/a/**/b", "x/a/y/z/b", true},
+		{"**/a/**/b", "b/a", false},
+		{"a/**/a", "a/a", true},
+		{"a/**/a", "a/b/a/c", false},
+		{"**/**/x", "x", true},
+		{"**/x/**/x/**", "x/y/x", true},
+		{"**/x/**/x/**", "x/y", false},
+		// ** inside a segment matches like *, it doesn't cross directories
+		{"src/**.go", "src/main.go", true},
+		{"src/**.go", "src/a/main.go", false},
+		{"a**/b", "abc/b", true},
+		{"a**/b", "a/x/b", false},
+		{"**.go", "main.go", true},
+		// Brace alternatives, nested and with slashes
+		{"*.{go,mod}", "go.mod", true},
+		{"*.{go,mod}", "main.go", true},
+		{"*.{go,mod}", "go.sum", false},
+		{"{cmd,internal/**}/*.go", "cmd/main.go", true},
+		{"{cmd,internal/**}/*.go", "internal/a/b.go", true},
+		{"{cmd,internal/**}/*.go", "pkg/a.go", false},
+		{"a.{t{xt,ar},md}", "a.tar", true},
+		{"a.{t{xt,ar},md}", "a.txt", true},
+		{"a.{t{xt,ar},md}", "a.md", true},
+		{"a.{t{xt,ar},md}", "a.t", false},
+		{"file{,.bak}", "file", true},
+		{"file{,.bak}", "file.bak", true},
+		// Escaped and bracketed braces are literal
+		{`\{a,b\}.txt`, "{a,b}.txt", true},
+		{`\{a,b\}.txt`, "a.txt", false},
+		{"[{]*", "{x", true},
+	}
+	for _, tt := range tests {
+		g, err := compileGlob(tt.pattern, false)
+		if err != nil {
+			t.Errorf("compileGlob(%q): %v", tt.pattern, err)
+			continue
+		}
+		if got := g.match(tt.path); got != tt.want {
+			t.Errorf("%q matches %q = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestGlobCaseInsensitive(t *testing.T) {
+	g, err := compileGlob("SRC/**/*.{Go,MD}", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"src/A/Main.GO", "Src/readme.md"} {
+		if !g.match(p) {
+			t.Errorf("case-insensitive pattern doesn't match %s", p)
+		}
+	}
+}
+
+func TestCompileGlobErrors(t *testing.T) {
+	tests := []struct {
+		pattern string
+		wantErr string
+	}{
+		{"", "empty"},
+		{"/", "empty"},
+		{"[a-", "syntax error"},
+		{"a/{b,[c-]}", "syntax error"},
+		{"*.{go,mod", "unmatched {"},
+		{"*.go}", "unmatched }"},
+		{"{a,b}{a,b}{a,b}{a,b}{a,b}{a,b}{a,b}{a,b}{a,b}", "more than 256 patterns"},
+	}
+	for _, tt := range tests {
+		if _, err := compileGlob(tt.pattern, false); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("compileGlob(%q) = %v, want an error containing %q", tt.pattern, err, tt.wantErr)
+		}
+	}
+}
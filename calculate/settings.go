@@ -0,0 +1,131 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"strings"
+)
+
+// Compression policies available in codebase settings
+const (
+	CompressionZlib = "zlib"
+	CompressionNone = "none"
+)
+
+// SettingsService manages per-codebase settings
+type SettingsService struct{}
+
+func NewSettingsService() *SettingsService {
+	return &SettingsService{}
+}
+
+// validateSettings rejects settings that could not be applied.
+func validateSettings(settings *core.CodebaseSettings) error {
+	if settings == nil {
+		return nil
+	}
+	if err := validateIgnorePatterns(settings.IgnorePatterns); err != nil {
+		return err
+	}
+	for _, b := range settings.ProtectedBranches {
+		if strings.TrimSpace(b) == "" {
+			return fmt.Errorf("invalid settings: protected branch name must not be empty")
+		}
+	}
+	if settings.RetainVersions < 0 {
+		return fmt.Errorf("invalid settings: retain_versions must not be negative")
+	}
+	if settings.MaxSnapshotBytes < 0 {
+		return fmt.Errorf("invalid settings: max_snapshot_bytes must not be negative")
+	}
+	switch settings.Compression {
+	case "", CompressionZlib, CompressionNone:
+	default:
+		return fmt.Errorf("invalid settings: unknown compression %q (supported: %s, %s)", settings.Compression, CompressionZlib, CompressionNone)
+	}
+	switch settings.PathPolicy {
+	case "", PathPolicyWarn, PathPolicyReject, PathPolicySanitize:
+	default:
+		return fmt.Errorf("invalid settings: unknown path policy %q (supported: %s, %s, %s)", settings.PathPolicy, PathPolicyWarn, PathPolicyReject, PathPolicySanitize)
+	}
+	switch settings.BranchCasePolicy {
+	case "", BranchCaseSensitive, BranchCaseInsensitiveReject, BranchCaseNormalizeLower:
+	default:
+		return fmt.Errorf("invalid settings: unknown branch case policy %q (supported: %s, %s, %s)", settings.BranchCasePolicy, BranchCaseSensitive, BranchCaseInsensitiveReject, BranchCaseNormalizeLower)
+	}
+	return nil
+}
+
+// seedSettings fills fields left unspecified in settings from the server-level defaults.
+func seedSettings(settings *core.CodebaseSettings) *core.CodebaseSettings {
+	seeded := core.CodebaseSettings{}
+	if settings != nil {
+		seeded = *settings
+	}
+	defaults := core.GetConfig().DefaultCodebaseSettings
+	if defaults == nil {
+		return &seeded
+	}
+	if !seeded.ManifestRequired {
+		seeded.ManifestRequired = defaults.ManifestRequired
+	}
+	if seeded.IgnorePatterns == nil {
+		seeded.IgnorePatterns = defaults.IgnorePatterns
+	}
+	if seeded.ProtectedBranches == nil {
+		seeded.ProtectedBranches = defaults.ProtectedBranches
+	}
+	if seeded.RetainVersions == 0 {
+		seeded.RetainVersions = defaults.RetainVersions
+	}
+	if seeded.MaxSnapshotBytes == 0 {
+		seeded.MaxSnapshotBytes = defaults.MaxSnapshotBytes
+	}
+	if seeded.Compression == "" {
+		seeded.Compression = defaults.Compression
+	}
+	if seeded.PathPolicy == "" {
+		seeded.PathPolicy = defaults.PathPolicy
+	}
+	if seeded.BranchCasePolicy == "" {
+		seeded.BranchCasePolicy = defaults.BranchCasePolicy
+	}
+	return &seeded
+}
+
+// settingsFor returns the settings that apply to a codebase. Codebases created before
+// settings existed fall back to the server-level defaults.
+func settingsFor(codebase *core.Codebase) *core.CodebaseSettings {
+	if codebase.Settings != nil {
+		return codebase.Settings
+	}
+	return seedSettings(nil)
+}
+
+// GetSettings returns the effective settings of a codebase.
+func (s *SettingsService) GetSettings(codebaseID string) (*core.CodebaseSettings, error) {
+	codebase, err := getActiveCodebase(core.GetProvider(), codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	return settingsFor(codebase), nil
+}
+
+// SetSettings validates and replaces the settings of a codebase.
+func (s *SettingsService) SetSettings(codebaseID string, settings core.CodebaseSettings) (*core.CodebaseSettings, error) {
+	if err := validateSettings(&settings); err != nil {
+		return nil, err
+	}
+	provider := core.GetProvider()
+	codebase, err := getActiveCodebase(provider, codebaseID)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := *codebase
+	updated.Settings = &settings
+	if err := provider.UpdateCodebase(&updated); err != nil {
+		return nil, fmt.Errorf("failed to update settings: %w", err)
+	}
+	return &settings, nil
+}
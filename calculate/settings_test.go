@@ -0,0 +1,100 @@
+package calculate
+
+import (
+	"main/core"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Settings apply with increasing precedence: server defaults seed what a codebase leaves unspecified,
+// the settings of the codebase replace them, and a snapshot request adds ignore patterns on top.
+func TestSettingsPrecedence(t *testing.T) {
+	files := map[string]string{"a.log": "log", "b.tmp": "tmp", "c.bak": "bak", "d.txt": "0123456789"}
+	tests := []struct {
+		name          string
+		defaults      *core.CodebaseSettings
+		codebase      *core.CodebaseSettings
+		requestIgnore []string
+		wantStored    string // stored paths, or the error
+	}{
+		{"nothing set", nil, nil, nil, "a.log,b.tmp,c.bak,d.txt"},
+		{"server default", &core.CodebaseSettings{IgnorePatterns: []string{"*.log"}}, nil, nil, "b.tmp,c.bak,d.txt"},
+		{"codebase replaces the default", &core.CodebaseSettings{IgnorePatterns: []string{"*.log"}}, &core.CodebaseSettings{IgnorePatterns: []string{"*.tmp"}}, nil, "a.log,c.bak,d.txt"},
+		{"codebase clears the default", &core.CodebaseSettings{IgnorePatterns: []string{"*.log"}}, &core.CodebaseSettings{IgnorePatterns: []string{}}, nil, "a.log,b.tmp,c.bak,d.txt"},
+		{"request adds to the codebase", &core.CodebaseSettings{IgnorePatterns: []string{"*.log"}}, &core.CodebaseSettings{IgnorePatterns: []string{"*.tmp"}}, []string{"*.bak"}, "a.log,d.txt"},
+		{"request adds to the default", &core.CodebaseSettings{IgnorePatterns: []string{"*.log"}}, nil, []string{"*.bak"}, "b.tmp,d.txt"},
+		{"default limit", &core.CodebaseSettings{MaxSnapshotBytes: 10}, nil, nil, "snapshot too large"},
+		{"codebase limit over the default", &core.CodebaseSettings{MaxSnapshotBytes: 10}, &core.CodebaseSettings{MaxSnapshotBytes: 1000}, nil, "a.log,b.tmp,c.bak,d.txt"},
+		{"request ignore counts against the limit", &core.CodebaseSettings{MaxSnapshotBytes: 10}, nil, []string{"*.txt"}, "a.log,b.tmp,c.bak"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, _ := useMemoryBackends(t)
+			core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), DefaultCodebaseSettings: tt.defaults})
+			t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+			codebase, err := NewInitService().InitializeCodebase("settings", "", "main", tt.codebase, InitOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := NewUploadService().ProcessSnapshot(codebase.ID, "v1", "main", "", snapshotFiles(files), nil, true, SnapshotOptions{Ignore: tt.requestIgnore})
+			var got string
+			if err != nil {
+				got = err.Error()
+			} else {
+				v, _ := provider.GetVersionByID(resp.Version.ID)
+				stored, _ := provider.GetFileIndexesByTreeID(v.TreeID)
+				var paths []string
+				for _, f := range stored {
+					paths = append(paths, f.Path)
+				}
+				sort.Strings(paths)
+				got = strings.Join(paths, ",")
+			}
+			if !strings.Contains(got, tt.wantStored) {
+				t.Errorf("snapshot stored %s, want %s", got, tt.wantStored)
+			}
+		})
+	}
+}
+
+// Changing the server defaults later doesn't change codebases created before, their settings were
+// seeded when they were created; codebases without stored settings follow the current defaults.
+func TestSettingsSeededAtCreation(t *testing.T) {
+	provider, _ := useMemoryBackends(t)
+	useDefaults := func(defaults *core.CodebaseSettings) {
+		core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), DefaultCodebaseSettings: defaults})
+	}
+	t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+
+	useDefaults(&core.CodebaseSettings{ProtectedBranches: []string{"main"}, Compression: CompressionNone})
+	seeded, err := NewInitService().InitializeCodebase("seeded", "", "main", &core.CodebaseSettings{Compression: CompressionZlib}, InitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := &core.Codebase{ID: "legacy", Name: "legacy", Branch: "main"}
+	if err := provider.CreateCodebase(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	useDefaults(&core.CodebaseSettings{ProtectedBranches: []string{"release"}})
+	settings := NewSettingsService()
+	got, err := settings.GetSettings(seeded.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got.ProtectedBranches, ",") != "main" || got.Compression != CompressionZlib {
+		t.Errorf("settings of the seeded codebase = %+v, want main protected and its own zlib compression", got)
+	}
+	if got, err := settings.GetSettings(legacy.ID); err != nil || strings.Join(got.ProtectedBranches, ",") != "release" {
+		t.Errorf("settings of a codebase without stored settings = %+v, %v, want the current defaults", got, err)
+	}
+
+	// The delete path consults the codebase settings, not the current defaults
+	mustSnapshot(t, seeded.ID, "main", "v1", map[string]string{"a.txt": "1"})
+	if _, err := NewDeleteService().DeleteVersion(seeded.ID, "main", "v1"); err == nil || !strings.Contains(err.Error(), "protected branch main") {
+		t.Errorf("deleting the last version of main = %v, want it refused as protected", err)
+	}
+}
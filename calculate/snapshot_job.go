@@ -0,0 +1,367 @@
+package calculate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"main/core"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Snapshots uploaded with async are staged under <storage path>/snapshot_jobs/<job_id>/ and processed by
+// a background worker while the client polls the job, so no connection is held open for the minutes a
+// large tree takes. Snapshots of a server directory (codebase_path) and git imports aren't staged, their
+// job reads the directory or clones the repository. Finished jobs can be queried for
+// snapshot_job_retention_seconds and are forgotten by StartSweeper afterwards. Jobs are kept in memory: after a restart they are unknown and the staged
+// files left behind are removed.
+const (
+	snapshotJobsDir = "snapshot_jobs"
+
+	defaultSnapshotJobWorkers   = 2
+	defaultSnapshotJobRetention = time.Hour
+	snapshotJobSweepInterval    = time.Minute
+)
+
+// Snapshot job states
+const (
+	SnapshotJobPending   = "pending"
+	SnapshotJobRunning   = "running"
+	SnapshotJobSucceeded = "succeeded"
+	SnapshotJobFailed    = "failed"
+)
+
+// SnapshotJob is the state of an asynchronous snapshot. Result is set once it succeeded, Error once it failed.
+type SnapshotJob struct {
+	ID         string                 `json:"id"`
+	State      string                 `json:"state"`
+	CodebaseID string                 `json:"codebase_id"`
+	Branch     string                 `json:"branch,omitempty"`
+	Version    string                 `json:"version,omitempty"` // as requested; a generated name is in result
+	Progress   SnapshotJobProgress    `json:"progress"`
+	CreatedAt  time.Time              `json:"created_at"`
+	StartedAt  *time.Time             `json:"started_at,omitempty"`
+	FinishedAt *time.Time             `json:"finished_at,omitempty"`
+	ExpiresAt  *time.Time             `json:"expires_at,omitempty"` // when a finished job is forgotten
+	Result     *core.SnapshotResponse `json:"result,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+	// FailedFiles lists the files that failed a strict snapshot
+	FailedFiles []core.FailedFile `json:"failed_files,omitempty"`
+}
+
+// SnapshotJobProgress counts the files of a job. The totals are those of the upload until processing
+// starts, then those left after ignore patterns and the path policy.
+type SnapshotJobProgress struct {
+	ProcessedFiles int   `json:"processed_files"`
+	TotalFiles     int   `json:"total_files"`
+	ProcessedBytes int64 `json:"processed_bytes"`
+	TotalBytes     int64 `json:"total_bytes"`
+}
+
+type snapshotJob struct {
+	SnapshotJob
+	progress *SnapshotProgress // set once ProcessSnapshot processes the files
+}
+
+// snapshotJobs holds the jobs of this process; slots limits how many run at once
+var snapshotJobs = struct {
+	sync.Mutex
+	jobs    map[string]*snapshotJob
+	slots   chan struct{}
+	running sync.WaitGroup
+}{jobs: make(map[string]*snapshotJob)}
+
+var snapshotJobSlotsOnce sync.Once
+
+func snapshotJobSlots() chan struct{} {
+	snapshotJobSlotsOnce.Do(func() {
+		workers := core.GetConfig().SnapshotJobWorkers
+		if workers <= 0 {
+			workers = defaultSnapshotJobWorkers
+		}
+		snapshotJobs.slots = make(chan struct{}, workers)
+	})
+	return snapshotJobs.slots
+}
+
+func snapshotJobRetention() time.Duration {
+	if seconds := core.GetConfig().SnapshotJobRetentionSeconds; seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultSnapshotJobRetention
+}
+
+func snapshotJobsRoot() string {
+	return filepath.Join(core.GetConfig().StoragePath, snapshotJobsDir)
+}
+
+// SnapshotJobService runs snapshots in the background
+type SnapshotJobService struct {
+	uploadService *UploadService
+	gitImport     *GitImportService
+	now           func() time.Time
+}
+
+func NewSnapshotJobService() *SnapshotJobService {
+	return &SnapshotJobService{
+		uploadService: NewUploadService(),
+		gitImport:     NewGitImportService(),
+		now:           time.Now,
+	}
+}
+
+// Submit stages the files of a snapshot and queues it for ProcessSnapshot, returning the pending job.
+// Only the codebase and the paths are checked here; every other error is reported by the job.
+func (s *SnapshotJobService) Submit(codebaseID, ver, branch, message string, files map[string]*SnapshotFile, branchFrom *BranchFrom, autoLinkage bool, opts SnapshotOptions) (*SnapshotJob, error) {
+	if _, err := getActiveCodebase(core.GetProvider(), codebaseID); err != nil {
+		return nil, fmt.Errorf("invalid codebase_id: %s, error: %w", codebaseID, err)
+	}
+	if err := checkUploadPaths(files, opts.Manifest); err != nil {
+		return nil, err
+	}
+
+	jobID := uuid.NewString()
+	dir := filepath.Join(snapshotJobsRoot(), jobID)
+	staged, err := stageSnapshotFiles(dir, files)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	job := s.newJob(jobID, codebaseID, ver, branch)
+	for _, f := range staged {
+		job.Progress.TotalFiles++
+		job.Progress.TotalBytes += f.Size
+	}
+	log.Printf("Queued snapshot job: ID=%s, codebase=%s, files=%d", jobID, codebaseID, len(staged))
+	s.enqueue(job, func() (*core.SnapshotResponse, error) {
+		defer os.RemoveAll(dir)
+		return s.uploadService.ProcessSnapshot(codebaseID, ver, branch, message, staged, branchFrom, autoLinkage, s.tracked(job, opts))
+	})
+	return s.view(job), nil
+}
+
+// SubmitLocal queues a snapshot of a server directory for ProcessLocalSnapshot, returning the pending
+// job. The directory is checked here, its files are read by the job.
+func (s *SnapshotJobService) SubmitLocal(codebaseID, dir, ver, branch, message string, branchFrom *BranchFrom, autoLinkage bool, opts SnapshotOptions) (*SnapshotJob, error) {
+	if _, err := getActiveCodebase(core.GetProvider(), codebaseID); err != nil {
+		return nil, fmt.Errorf("invalid codebase_id: %s, error: %w", codebaseID, err)
+	}
+	if _, err := checkLocalSnapshot(dir, opts); err != nil {
+		return nil, err
+	}
+
+	job := s.newJob(uuid.NewString(), codebaseID, ver, branch)
+	log.Printf("Queued snapshot job: ID=%s, codebase=%s, local directory=%s", job.ID, codebaseID, dir)
+	s.enqueue(job, func() (*core.SnapshotResponse, error) {
+		return s.uploadService.ProcessLocalSnapshot(codebaseID, dir, ver, branch, message, branchFrom, autoLinkage, s.tracked(job, opts))
+	})
+	return s.view(job), nil
+}
+
+// SubmitGit queues the import of a git repository for GitImportService.Import, returning the pending
+// job. The URL is checked here, the repository is cloned by the job.
+func (s *SnapshotJobService) SubmitGit(codebaseID string, src GitImport, ver, branch, message string, branchFrom *BranchFrom, autoLinkage bool, opts SnapshotOptions) (*SnapshotJob, error) {
+	if _, err := getActiveCodebase(core.GetProvider(), codebaseID); err != nil {
+		return nil, fmt.Errorf("invalid codebase_id: %s, error: %w", codebaseID, err)
+	}
+	safeURL, err := checkGitImport(src, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	job := s.newJob(uuid.NewString(), codebaseID, ver, branch)
+	log.Printf("Queued snapshot job: ID=%s, codebase=%s, git repository=%s", job.ID, codebaseID, safeURL)
+	s.enqueue(job, func() (*core.SnapshotResponse, error) {
+		return s.gitImport.Import(codebaseID, src, ver, branch, message, branchFrom, autoLinkage, s.tracked(job, opts))
+	})
+	return s.view(job), nil
+}
+
+func (s *SnapshotJobService) newJob(jobID, codebaseID, ver, branch string) *snapshotJob {
+	return &snapshotJob{SnapshotJob: SnapshotJob{
+		ID:         jobID,
+		State:      SnapshotJobPending,
+		CodebaseID: codebaseID,
+		Branch:     branch,
+		Version:    ver,
+		CreatedAt:  s.now().UTC(),
+	}}
+}
+
+// tracked returns opts reporting the snapshot's progress counters to job.
+func (s *SnapshotJobService) tracked(job *snapshotJob, opts SnapshotOptions) SnapshotOptions {
+	opts.trackProgress = func(p *SnapshotProgress) {
+		snapshotJobs.Lock()
+		job.progress = p
+		snapshotJobs.Unlock()
+	}
+	return opts
+}
+
+// enqueue registers a job and runs it in the background once a worker slot is free.
+func (s *SnapshotJobService) enqueue(job *snapshotJob, run func() (*core.SnapshotResponse, error)) {
+	snapshotJobs.Lock()
+	snapshotJobs.jobs[job.ID] = job
+	snapshotJobs.running.Add(1)
+	snapshotJobs.Unlock()
+
+	go func() {
+		defer snapshotJobs.running.Done()
+		slots := snapshotJobSlots()
+		slots <- struct{}{}
+		defer func() { <-slots }()
+
+		s.setState(job, SnapshotJobRunning, nil, nil)
+		resp, err := run()
+		if err != nil {
+			log.Printf("Snapshot job %s failed: %v", job.ID, err)
+			s.setState(job, SnapshotJobFailed, nil, err)
+			return
+		}
+		log.Printf("Snapshot job %s succeeded: version ID=%s", job.ID, resp.Version.ID)
+		s.setState(job, SnapshotJobSucceeded, resp, nil)
+	}()
+}
+
+// stageSnapshotFiles copies the parts of a request below dir, which outlives the request, named by
+// the hash of their path like the files of an upload session.
+func stageSnapshotFiles(dir string, files map[string]*SnapshotFile) (map[string]*SnapshotFile, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to stage snapshot: %w", err)
+	}
+	staged := make(map[string]*SnapshotFile, len(files))
+	for relPath, f := range files {
+		path := filepath.Join(dir, stagedName(relPath))
+		size, err := copySnapshotFile(path, f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stage %s: %w", relPath, err)
+		}
+		staged[relPath] = &SnapshotFile{Size: size, open: func() (multipart.File, error) { return os.Open(path) }}
+	}
+	return staged, nil
+}
+
+func copySnapshotFile(path string, f *SnapshotFile) (int64, error) {
+	src, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dst, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// setState moves a job to state, recording its result or error when it finished.
+func (s *SnapshotJobService) setState(job *snapshotJob, state string, resp *core.SnapshotResponse, err error) {
+	snapshotJobs.Lock()
+	defer snapshotJobs.Unlock()
+	now := s.now().UTC()
+	job.State = state
+	switch state {
+	case SnapshotJobRunning:
+		job.StartedAt = &now
+		return
+	case SnapshotJobSucceeded:
+		job.Result = resp
+	case SnapshotJobFailed:
+		job.Error = err.Error()
+		var filesErr *SnapshotFilesError
+		if errors.As(err, &filesErr) {
+			job.FailedFiles = filesErr.Failed
+		}
+	}
+	expires := now.Add(snapshotJobRetention())
+	job.FinishedAt, job.ExpiresAt = &now, &expires
+}
+
+// Get returns the state of a job that is queued, running or finished within the retention window.
+func (s *SnapshotJobService) Get(jobID string) (*SnapshotJob, error) {
+	snapshotJobs.Lock()
+	job, ok := snapshotJobs.jobs[jobID]
+	snapshotJobs.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("snapshot job %s not found", jobID)
+	}
+	return s.view(job), nil
+}
+
+// view copies a job with its current progress.
+func (s *SnapshotJobService) view(job *snapshotJob) *SnapshotJob {
+	snapshotJobs.Lock()
+	defer snapshotJobs.Unlock()
+	view := job.SnapshotJob
+	if job.progress != nil {
+		status := job.progress.Status()
+		view.Progress = SnapshotJobProgress{
+			ProcessedFiles: status.ProcessedFiles,
+			TotalFiles:     status.DeclaredFiles,
+			ProcessedBytes: status.ProcessedBytes,
+			TotalBytes:     status.DeclaredBytes,
+		}
+	}
+	return &view
+}
+
+// PurgeExpired forgets the jobs whose retention window has passed, returning their IDs.
+func (s *SnapshotJobService) PurgeExpired() []string {
+	snapshotJobs.Lock()
+	defer snapshotJobs.Unlock()
+	var purged []string
+	for id, job := range snapshotJobs.jobs {
+		if job.ExpiresAt != nil && !s.now().Before(*job.ExpiresAt) {
+			delete(snapshotJobs.jobs, id)
+			purged = append(purged, id)
+		}
+	}
+	return purged
+}
+
+// StartSweeper removes the staged files of jobs from before a restart, then runs PurgeExpired
+// periodically in the background until stop is closed.
+func (s *SnapshotJobService) StartSweeper(stop <-chan struct{}) {
+	if err := os.RemoveAll(snapshotJobsRoot()); err != nil {
+		log.Printf("Failed to remove staged files of earlier snapshot jobs: %v", err)
+	}
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(snapshotJobSweepInterval):
+			}
+			if purged := s.PurgeExpired(); len(purged) > 0 {
+				log.Printf("Forgot %d finished snapshot jobs", len(purged))
+			}
+		}
+	}()
+}
+
+// WaitForSnapshotJobs waits until the queued and running snapshot jobs have finished or ctx ends.
+func WaitForSnapshotJobs(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		snapshotJobs.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,89 @@
+package calculate
+
+import (
+	"context"
+	"main/core"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForJobs waits for the queued snapshot jobs to finish.
+func waitForJobs(t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := WaitForSnapshotJobs(ctx); err != nil {
+		t.Fatalf("snapshot jobs didn't finish: %v", err)
+	}
+}
+
+func TestSnapshotJob(t *testing.T) {
+	_, storage := useMemoryBackends(t)
+	core.SetConfigForTesting(core.AppConfig{StoragePath: t.TempDir()})
+	t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+	codebase := mustInitCodebase(t, "async")
+	clock := &fakeClock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	jobs := &SnapshotJobService{uploadService: NewUploadService(), gitImport: NewGitImportService(), now: clock.now}
+
+	contents := map[string]string{"a.txt": "alpha", "dir/b.txt": "beta"}
+	job, err := jobs.Submit(codebase.ID, "v1", "main", "", snapshotFiles(contents), nil, true, SnapshotOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != SnapshotJobPending || job.Progress.TotalFiles != 2 || job.Progress.TotalBytes != 9 {
+		t.Errorf("submitted job = %+v, want pending with 2 files, 9 bytes", job)
+	}
+	waitForJobs(t)
+
+	done, err := jobs.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done.State != SnapshotJobSucceeded || done.Result == nil || done.StartedAt == nil || done.FinishedAt == nil {
+		t.Fatalf("finished job = %+v, want it succeeded with a result", done)
+	}
+	if want := (SnapshotJobProgress{ProcessedFiles: 2, TotalFiles: 2, ProcessedBytes: 9, TotalBytes: 9}); done.Progress != want {
+		t.Errorf("progress = %+v, want %+v", done.Progress, want)
+	}
+	if got := versionContents(t, storage, codebase.ID)[done.Result.Version.ID]; !reflect.DeepEqual(got, contents) {
+		t.Errorf("contents of the job's version = %v, want %v", got, contents)
+	}
+	if _, err := os.Stat(filepath.Join(snapshotJobsRoot(), job.ID)); !os.IsNotExist(err) {
+		t.Errorf("staged files of the finished job: %v, want them removed", err)
+	}
+
+	// Errors of the snapshot are reported by the job
+	failed, err := jobs.Submit(codebase.ID, "v1", "main", "", snapshotFiles(contents), nil, true, SnapshotOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForJobs(t)
+	if failed, _ = jobs.Get(failed.ID); failed.State != SnapshotJobFailed || !strings.Contains(failed.Error, "already exists") || failed.Result != nil {
+		t.Errorf("job for a taken version = %+v, want it failed", failed)
+	}
+
+	// The codebase and the paths are checked before anything is queued
+	if _, err := jobs.Submit("missing", "v2", "main", "", snapshotFiles(contents), nil, true, SnapshotOptions{}); err == nil || !strings.Contains(err.Error(), "invalid codebase_id") {
+		t.Errorf("job for an unknown codebase = %v", err)
+	}
+	if _, err := jobs.Submit(codebase.ID, "v2", "main", "", snapshotFiles(map[string]string{"../escape.txt": "x"}), nil, true, SnapshotOptions{}); err == nil {
+		t.Error("job with an unsafe path was queued")
+	}
+
+	// Finished jobs are forgotten once the retention window passed
+	clock.t = clock.t.Add(snapshotJobRetention() - time.Second)
+	if purged := jobs.PurgeExpired(); len(purged) != 0 {
+		t.Errorf("purged %v inside the retention window", purged)
+	}
+	clock.t = clock.t.Add(time.Second)
+	if purged := jobs.PurgeExpired(); len(purged) != 2 {
+		t.Errorf("purged %v, want both jobs", purged)
+	}
+	if _, err := jobs.Get(job.ID); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("forgotten job = %v, want not found", err)
+	}
+}
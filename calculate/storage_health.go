@@ -0,0 +1,198 @@
+package calculate
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"main/core"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultStorageProbeInterval = 30 * time.Second
+	storageProbePrefix          = ".cvcs-probe/"
+	storageBackendLocal         = "local"
+)
+
+// StorageBackendStatus is the outcome of the latest probes of a storage backend
+type StorageBackendStatus struct {
+	Name                string     `json:"name"`
+	Healthy             bool       `json:"healthy"`
+	Since               time.Time  `json:"since"` // when the backend entered its current state
+	LastCheckedAt       *time.Time `json:"last_checked_at,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+}
+
+// StorageUnavailableError is returned instead of starting work that needs a storage backend that failed its last probe
+type StorageUnavailableError struct {
+	Backend string
+	Cause   string
+}
+
+func (e *StorageUnavailableError) Error() string {
+	return fmt.Sprintf("storage backend unavailable: %s (%s)", e.Backend, e.Cause)
+}
+
+// storageProbeCounts are the counters exported by WriteMetrics
+type storageProbeCounts struct {
+	probes    uint64
+	failures  uint64
+	unhealthy uint64 // transitions to unhealthy
+	recovered uint64 // transitions back to healthy
+}
+
+// storageHealth holds the probe state, backends are assumed healthy until a probe fails
+var storageHealth = struct {
+	sync.RWMutex
+	status StorageBackendStatus
+	counts storageProbeCounts
+}{status: StorageBackendStatus{Name: storageBackendLocal, Healthy: true, Since: time.Now()}}
+
+func storageProbeInterval() time.Duration {
+	if seconds := core.GetConfig().StorageProbeIntervalSeconds; seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultStorageProbeInterval
+}
+
+// StorageHealthService probes the storage backend and gates requests on the result
+type StorageHealthService struct {
+	now func() time.Time
+}
+
+func NewStorageHealthService() *StorageHealthService {
+	return &StorageHealthService{now: time.Now}
+}
+
+// Probe writes, reads back and deletes a canary object, then records the outcome.
+// State transitions are logged and sent to the webhooks subscribed to storage.unhealthy or
+// storage.recovered; failures while already unhealthy only update the counters.
+func (s *StorageHealthService) Probe() StorageBackendStatus {
+	err := probeStorage(core.GetStore())
+	now := s.now()
+
+	storageHealth.Lock()
+	status := &storageHealth.status
+	counts := &storageHealth.counts
+	status.LastCheckedAt = &now
+	counts.probes++
+	var transition string
+	if err != nil {
+		counts.failures++
+		status.ConsecutiveFailures++
+		status.LastError = err.Error()
+		if status.Healthy {
+			status.Healthy = false
+			status.Since = now
+			counts.unhealthy++
+			transition = WebhookEventStorageUnhealthy
+			log.Printf("event=storage_unhealthy backend=%s error=%q", status.Name, status.LastError)
+		}
+	} else {
+		if !status.Healthy {
+			status.Healthy = true
+			status.Since = now
+			counts.recovered++
+			transition = WebhookEventStorageRecovered
+			log.Printf("event=storage_recovered backend=%s failed_probes=%d", status.Name, status.ConsecutiveFailures)
+		}
+		status.ConsecutiveFailures = 0
+		status.LastError = ""
+	}
+	result := *status
+	storageHealth.Unlock()
+
+	if transition != "" {
+		notifyWebhooks(WebhookEvent{Event: transition, Storage: &result})
+	}
+	return result
+}
+
+func probeStorage(storage core.Storage) error {
+	key := storageProbePrefix + uuid.NewString()
+	canary := []byte("cvcs storage probe " + key)
+	if err := storage.PutObject(key, canary); err != nil {
+		return fmt.Errorf("write failed: %w", err)
+	}
+	defer storage.DeleteObject(key)
+	data, err := storage.GetObject(key)
+	if err != nil {
+		return fmt.Errorf("read failed: %w", err)
+	}
+	if !bytes.Equal(data, canary) {
+		return fmt.Errorf("read back %d bytes that differ from the %d written", len(data), len(canary))
+	}
+	if err := storage.DeleteObject(key); err != nil {
+		return fmt.Errorf("delete failed: %w", err)
+	}
+	return nil
+}
+
+// Status returns the state of every storage backend.
+func (s *StorageHealthService) Status() []StorageBackendStatus {
+	storageHealth.RLock()
+	defer storageHealth.RUnlock()
+	return []StorageBackendStatus{storageHealth.status}
+}
+
+// Available returns a *StorageUnavailableError when the storage backend failed its last probe.
+func (s *StorageHealthService) Available() error {
+	storageHealth.RLock()
+	defer storageHealth.RUnlock()
+	if storageHealth.status.Healthy {
+		return nil
+	}
+	return &StorageUnavailableError{Backend: storageHealth.status.Name, Cause: storageHealth.status.LastError}
+}
+
+// WriteMetrics writes the probe state and counters of every storage backend in the Prometheus text format.
+func (s *StorageHealthService) WriteMetrics(w io.Writer) {
+	storageHealth.RLock()
+	status, counts := storageHealth.status, storageHealth.counts
+	storageHealth.RUnlock()
+
+	healthy := 0
+	if status.Healthy {
+		healthy = 1
+	}
+	backend := fmt.Sprintf("backend=%q", status.Name)
+	metrics := []struct {
+		name, kind, help, labels string
+		value                    interface{}
+	}{
+		{"cvcs_storage_healthy", "gauge", "Whether the last probe of the storage backend succeeded.", backend, healthy},
+		{"cvcs_storage_state_since_seconds", "gauge", "Unix time the storage backend entered its current state.", backend, status.Since.Unix()},
+		{"cvcs_storage_consecutive_failures", "gauge", "Probes of the storage backend that failed in a row.", backend, status.ConsecutiveFailures},
+		{"cvcs_storage_probes_total", "counter", "Probes of the storage backend.", backend, counts.probes},
+		{"cvcs_storage_probe_failures_total", "counter", "Failed probes of the storage backend.", backend, counts.failures},
+		{"cvcs_storage_transitions_total", "counter", "State changes of the storage backend, by the state entered.", backend + `,state="unhealthy"`, counts.unhealthy},
+		{"cvcs_storage_transitions_total", "", "", backend + `,state="healthy"`, counts.recovered},
+	}
+	for _, m := range metrics {
+		if m.help != "" {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		}
+		fmt.Fprintf(w, "%s{%s} %v\n", m.name, m.labels, m.value)
+	}
+}
+
+// StartProber probes the storage once synchronously, then periodically until stop is closed.
+// Probes run outside the background scheduler so they can't queue behind maintenance jobs.
+func (s *StorageHealthService) StartProber(stop <-chan struct{}) {
+	s.Probe()
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(storageProbeInterval()):
+			}
+			s.Probe()
+		}
+	}()
+}
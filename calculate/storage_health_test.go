@@ -0,0 +1,144 @@
+package calculate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"main/core"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyStorage fails every write while down is set, like an unmounted volume.
+type flakyStorage struct {
+	*core.MemoryStorage
+	down bool
+}
+
+func (s *flakyStorage) PutObject(name string, data []byte) error {
+	if s.down {
+		return errors.New("input/output error")
+	}
+	return s.MemoryStorage.PutObject(name, data)
+}
+
+// useFreshStorageHealth starts a test with a healthy backend and no probes counted, and puts the
+// state of the other tests back afterwards.
+func useFreshStorageHealth(t *testing.T, since time.Time) {
+	storageHealth.Lock()
+	status, counts := storageHealth.status, storageHealth.counts
+	storageHealth.status = StorageBackendStatus{Name: storageBackendLocal, Healthy: true, Since: since}
+	storageHealth.counts = storageProbeCounts{}
+	storageHealth.Unlock()
+	t.Cleanup(func() {
+		storageHealth.Lock()
+		storageHealth.status, storageHealth.counts = status, counts
+		storageHealth.Unlock()
+	})
+}
+
+func TestStorageHealthTransitions(t *testing.T) {
+	provider, memory := useMemoryBackends(t)
+	storage := &flakyStorage{MemoryStorage: memory}
+	core.SetProvidersForTesting(provider, storage)
+	clock := &fakeClock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	useFreshStorageHealth(t, clock.t)
+
+	var mu sync.Mutex
+	var events []WebhookEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	useWebhookConfig(t, core.AppConfig{WebhookHosts: []string{u.Hostname()}, WebhookAllowPrivateNetworks: true})
+	webhooks := NewWebhookService()
+	if _, err := webhooks.CreateWebhook(server.URL+"/all", "", nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	// Storage events concern the whole server and skip webhooks limited to a codebase
+	codebase := mustInitCodebase(t, "health")
+	if _, err := webhooks.CreateWebhook(server.URL+"/codebase", "", nil, codebase.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	health := &StorageHealthService{now: clock.now}
+	steps := []struct {
+		down         bool
+		wantHealthy  bool
+		wantFailures int
+		wantSince    time.Duration // after the start of the test
+	}{
+		{false, true, 0, 0},
+		{true, false, 1, 2 * time.Minute},
+		{true, false, 2, 2 * time.Minute}, // still down: no transition
+		{false, true, 0, 4 * time.Minute},
+		{false, true, 0, 4 * time.Minute},
+	}
+	start := clock.t
+	for i, step := range steps {
+		clock.t = start.Add(time.Duration(i+1) * time.Minute)
+		storage.down = step.down
+		status := health.Probe()
+		if status.Healthy != step.wantHealthy || status.ConsecutiveFailures != step.wantFailures || !status.Since.Equal(start.Add(step.wantSince)) {
+			t.Errorf("probe %d: %+v, want healthy %v with %d failures since +%s", i+1, status, step.wantHealthy, step.wantFailures, step.wantSince)
+		}
+		if err := health.Available(); (err == nil) != step.wantHealthy {
+			t.Errorf("probe %d: Available() = %v", i+1, err)
+		}
+	}
+	var unavailable *StorageUnavailableError
+	storage.down = true
+	health.Probe()
+	if err := health.Available(); !errors.As(err, &unavailable) || !strings.Contains(err.Error(), "input/output error") {
+		t.Errorf("Available() while down = %v, want a StorageUnavailableError with the probe error", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := WaitForWebhooks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	var got []string
+	for _, e := range events {
+		got = append(got, e.Event)
+		if e.Storage == nil || e.Storage.Name != storageBackendLocal || e.Storage.Healthy != (e.Event == WebhookEventStorageRecovered) {
+			t.Errorf("%s carries storage status %+v", e.Event, e.Storage)
+		}
+	}
+	if want := "storage.unhealthy,storage.recovered,storage.unhealthy"; strings.Join(got, ",") != want {
+		t.Errorf("webhook events = %v, want %s", got, want)
+	}
+
+	var metrics strings.Builder
+	health.WriteMetrics(&metrics)
+	for _, line := range []string{
+		`cvcs_storage_healthy{backend="local"} 0`,
+		`cvcs_storage_consecutive_failures{backend="local"} 1`,
+		`cvcs_storage_probes_total{backend="local"} 6`,
+		`cvcs_storage_probe_failures_total{backend="local"} 3`,
+		`cvcs_storage_transitions_total{backend="local",state="unhealthy"} 2`,
+		`cvcs_storage_transitions_total{backend="local",state="healthy"} 1`,
+		"# TYPE cvcs_storage_probes_total counter",
+	} {
+		if !strings.Contains(metrics.String(), line+"\n") {
+			t.Errorf("metrics lack %q:\n%s", line, metrics.String())
+		}
+	}
+	if n := strings.Count(metrics.String(), "# TYPE cvcs_storage_transitions_total"); n != 1 {
+		t.Errorf("cvcs_storage_transitions_total is declared %d times", n)
+	}
+}
@@ -0,0 +1,94 @@
+package calculate
+
+import (
+	"log"
+	"main/core"
+	"time"
+)
+
+// TagService manages named tags pointing at versions
+type TagService struct {
+	historyService *HistoryService
+}
+
+func NewTagService() *TagService {
+	return &TagService{
+		historyService: NewHistoryService(),
+	}
+}
+
+// TagInfo is a tag together with the branch and label of the version it points at
+type TagInfo struct {
+	*core.Tag
+	Branch  string `json:"branch"`
+	Version string `json:"version"`
+}
+
+// CreateTag names the version addressed by source. Tag names are unique per codebase, limited to the
+// characters validateTagName allows, and a tag keeps pointing at the same version when its branch moves on.
+func (s *TagService) CreateTag(codebaseID, name, message string, source VersionIdentifier) (*TagInfo, error) {
+	provider := core.GetProvider()
+	if _, err := getActiveCodebase(provider, codebaseID); err != nil {
+		return nil, err
+	}
+	if err := validateTagName(name); err != nil {
+		return nil, err
+	}
+
+	version, err := resolveVersion(provider, codebaseID, source.Branch, source.Version)
+	if err != nil {
+		return nil, err
+	}
+	tag := &core.Tag{
+		CodebaseID: codebaseID,
+		Name:       name,
+		VersionID:  version.ID,
+		Message:    message,
+		CreatedAt:  time.Now(),
+	}
+	if err := provider.CreateTag(tag); err != nil {
+		return nil, err
+	}
+	if _, err := s.historyService.RebuildHistoryCache(codebaseID); err != nil {
+		log.Printf("Failed to rebuild history cache after creating tag %s: %v", name, err)
+	}
+
+	log.Printf("Tag created: codebase=%s, tag=%s, version=%s/%s", codebaseID, name, version.Branch, version.Version)
+	return &TagInfo{Tag: tag, Branch: version.Branch, Version: version.Version}, nil
+}
+
+// DeleteTag removes a tag; the version it pointed at is untouched.
+func (s *TagService) DeleteTag(codebaseID, name string) error {
+	provider := core.GetProvider()
+	if _, err := getActiveCodebase(provider, codebaseID); err != nil {
+		return err
+	}
+	if err := provider.DeleteTag(codebaseID, name); err != nil {
+		return err
+	}
+	if _, err := s.historyService.RebuildHistoryCache(codebaseID); err != nil {
+		log.Printf("Failed to rebuild history cache after deleting tag %s: %v", name, err)
+	}
+	return nil
+}
+
+// ListTags returns the tags of a codebase sorted by name.
+func (s *TagService) ListTags(codebaseID string) ([]TagInfo, error) {
+	provider := core.GetProvider()
+	if _, err := getActiveCodebase(provider, codebaseID); err != nil {
+		return nil, err
+	}
+	tags, err := provider.ListTags(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]TagInfo, 0, len(tags))
+	for _, tag := range tags {
+		info := TagInfo{Tag: tag}
+		if v, err := provider.GetVersionByID(tag.VersionID); err == nil {
+			info.Branch, info.Version = v.Branch, v.Version
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
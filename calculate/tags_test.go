@@ -0,0 +1,114 @@
+package calculate
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateTagName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr string
+	}{
+		{"release-1.2", ""},
+		{"v1.2.3_rc1", ""},
+		{"releases/1.2", ""},
+		{"", "must not be empty"},
+		{" release", "whitespace"},
+		{"release 1.2", "may only contain"},
+		{`a"; filename=evil.sh`, "may only contain"},
+		{"a\r\nX-Injected: 1", "control characters"},
+		{"ünicode", "may only contain"},
+		{"-rc", "must start with"},
+		{".hidden", "must start with"},
+		{"a/../b", `".."`},
+		{"a//b", `"//"`},
+		{"releases/", "must not end"},
+		{"release.", "must not end"},
+		{strings.Repeat("a", maxNameLength+1), "the limit is"},
+	}
+	for _, tt := range tests {
+		err := validateTagName(tt.name)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("validateTagName(%q) = %v, want nil", tt.name, err)
+			}
+			continue
+		}
+		var nameErr *NameError
+		if !errors.As(err, &nameErr) || nameErr.Field != "tag" || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("validateTagName(%q) = %v, want a tag NameError containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTagsRefreshVersionMap(t *testing.T) {
+	useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "tags")
+	v1 := mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"a.txt": "1"})
+	versionMap(t, codebase.ID)
+
+	tags := NewTagService()
+	if _, err := tags.CreateTag(codebase.ID, "release-1.0", "", VersionIdentifier{Branch: "main", Version: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tags.CreateTag(codebase.ID, "bad tag", "", VersionIdentifier{Branch: "main", Version: "v1"}); err == nil {
+		t.Error("a tag name with a space was accepted")
+	}
+	nodes := versionMap(t, codebase.ID).Nodes
+	if len(nodes) != 1 || nodes[0].ID != v1.Version.ID || strings.Join(nodes[0].Tags, ",") != "release-1.0" {
+		t.Errorf("map nodes after CreateTag = %+v, want v1 tagged release-1.0", nodes)
+	}
+
+	if err := tags.DeleteTag(codebase.ID, "release-1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if nodes := versionMap(t, codebase.ID).Nodes; len(nodes) != 1 || nodes[0].Tags != nil {
+		t.Errorf("map nodes after DeleteTag = %+v, want no tags", nodes)
+	}
+}
+
+func TestCreateAndResolveTags(t *testing.T) {
+	useMemoryBackends(t)
+	codebase, other := mustInitCodebase(t, "tags"), mustInitCodebase(t, "other")
+	v1 := mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"a.txt": "1"})
+	mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{"a.txt": "2"})
+	mustSnapshot(t, other.ID, "main", "v1", map[string]string{"a.txt": "other"})
+
+	tags := NewTagService()
+	if _, err := tags.CreateTag(codebase.ID, "release-1.0", "first release", VersionIdentifier{Branch: "main", Version: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tags.CreateTag(codebase.ID, "release-1.0", "", VersionIdentifier{Branch: "main", Version: "v2"}); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("second tag with the same name = %v, want it refused", err)
+	}
+	// Names are unique per codebase only
+	if _, err := tags.CreateTag(other.ID, "release-1.0", "", VersionIdentifier{Branch: "main", Version: "v1"}); err != nil {
+		t.Errorf("same tag name in another codebase = %v", err)
+	}
+	if _, err := tags.CreateTag(codebase.ID, "release-2.0", "", VersionIdentifier{Branch: "main", Version: "v9"}); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("tag of a missing version = %v, want not found", err)
+	}
+
+	// A tag keeps pointing at its version when the branch moves on
+	mustSnapshot(t, codebase.ID, "main", "v3", map[string]string{"a.txt": "3"})
+	located, err := LocateVersion(codebase.ID, VersionSelector{Tag: "release-1.0"})
+	if err != nil || located != (VersionIdentifier{Branch: "main", Version: "v1"}) {
+		t.Errorf("release-1.0 locates %+v, %v, want main/v1", located, err)
+	}
+	if _, err := LocateVersion(codebase.ID, VersionSelector{Tag: "release-1.0", Branch: "main", Version: "v2"}); err == nil {
+		t.Error("a selector with both a tag and a branch and version was accepted")
+	}
+	if _, err := LocateVersion(codebase.ID, VersionSelector{Tag: "missing"}); err == nil {
+		t.Error("a missing tag was located")
+	}
+
+	list, err := tags.ListTags(codebase.ID)
+	if err != nil || len(list) != 1 || list[0].VersionID != v1.Version.ID || list[0].Version != "v1" || list[0].Message != "first release" {
+		t.Errorf("tags = %+v, %v, want release-1.0 on v1", list, err)
+	}
+	if err := tags.DeleteTag(codebase.ID, "missing"); err == nil {
+		t.Error("deleting a missing tag succeeded")
+	}
+}
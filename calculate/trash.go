@@ -0,0 +1,282 @@
+package calculate
+
+import (
+	"fmt"
+	"log"
+	"main/core"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTrashRetention     = 7 * 24 * time.Hour
+	defaultTrashPurgeInterval = time.Hour
+)
+
+// TrashService moves codebases to the trash and purges them once their retention window expires
+type TrashService struct {
+	deleteService *DeleteService
+	now           func() time.Time
+}
+
+func NewTrashService() *TrashService {
+	return &TrashService{
+		deleteService: NewDeleteService(),
+		now:           time.Now,
+	}
+}
+
+// TrashedCodebase describes a codebase waiting in the trash
+type TrashedCodebase struct {
+	Codebase    *core.Codebase `json:"codebase"`
+	PurgeAfter  time.Time      `json:"purge_after"`
+	StoredBytes int64          `json:"stored_bytes"`
+	// RetainedBy lists the locked or pinned versions that keep the codebase from being purged
+	RetainedBy []string `json:"retained_by,omitempty"`
+}
+
+// TrashReport summarizes storage used by live and trashed codebases and the purge schedule
+type TrashReport struct {
+	RetentionHours float64           `json:"retention_hours"`
+	NextPurgeAt    *time.Time        `json:"next_purge_at,omitempty"`
+	LiveBytes      int64             `json:"live_bytes"`
+	TrashedBytes   int64             `json:"trashed_bytes"`
+	Trashed        []TrashedCodebase `json:"trashed"`
+}
+
+// trashSchedule tracks the background purge scheduler shared by all service instances
+var trashSchedule struct {
+	sync.Mutex
+	nextRunAt time.Time
+	// retained holds the expired codebases a purge kept and audited, so they are audited once per
+	// process rather than on every run, mapped to the versions that kept them
+	retained map[string]string
+}
+
+func trashRetention() time.Duration {
+	if hours := core.GetConfig().TrashRetentionHours; hours > 0 {
+		return time.Duration(hours) * time.Hour
+	}
+	return defaultTrashRetention
+}
+
+func trashPurgeInterval() time.Duration {
+	if minutes := core.GetConfig().TrashPurgeIntervalMinutes; minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return defaultTrashPurgeInterval
+}
+
+// getActiveCodebase returns a codebase unless it has been moved to the trash,
+// in which case it is reported as not found like a deleted codebase.
+func getActiveCodebase(provider core.DataProvider, codebaseID string) (*core.Codebase, error) {
+	codebase, err := provider.GetCodebaseByID(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	if codebase.TrashedAt != nil {
+		return nil, fmt.Errorf("codebase %s not found (in trash)", codebaseID)
+	}
+	if codebase.Ephemeral && codebase.ExpiresAt != nil && !time.Now().Before(*codebase.ExpiresAt) {
+		return nil, fmt.Errorf("codebase %s not found (ephemeral codebase expired)", codebaseID)
+	}
+	return codebase, nil
+}
+
+// TrashCodebase marks a codebase as trashed. Its data stays on disk until purged.
+func (s *TrashService) TrashCodebase(codebaseID string) (*core.Codebase, error) {
+	provider := core.GetProvider()
+	codebase, err := getActiveCodebase(provider, codebaseID)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := *codebase
+	trashedAt := s.now()
+	updated.TrashedAt = &trashedAt
+	if err := provider.UpdateCodebase(&updated); err != nil {
+		return nil, fmt.Errorf("failed to move codebase to trash: %w", err)
+	}
+	log.Printf("Codebase moved to trash: ID=%s, purge after %s", codebaseID, trashedAt.Add(trashRetention()).Format(time.RFC3339))
+	notifyWebhooks(WebhookEvent{Event: WebhookEventCodebaseDeleted, CodebaseID: codebaseID, Trashed: true})
+	return &updated, nil
+}
+
+// RestoreCodebase takes a codebase out of the trash.
+func (s *TrashService) RestoreCodebase(codebaseID string) (*core.Codebase, error) {
+	provider := core.GetProvider()
+	codebase, err := provider.GetCodebaseByID(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	if codebase.TrashedAt == nil {
+		return nil, fmt.Errorf("codebase %s is not in trash", codebaseID)
+	}
+
+	updated := *codebase
+	updated.TrashedAt = nil
+	if err := provider.UpdateCodebase(&updated); err != nil {
+		return nil, fmt.Errorf("failed to restore codebase: %w", err)
+	}
+	return &updated, nil
+}
+
+// GetTrashReport lists trashed codebases and reports live versus trashed storage usage.
+func (s *TrashService) GetTrashReport() (*TrashReport, error) {
+	provider := core.GetProvider()
+	codebases, err := provider.ListCodebases()
+	if err != nil {
+		return nil, err
+	}
+
+	retention := trashRetention()
+	report := &TrashReport{
+		RetentionHours: retention.Hours(),
+		Trashed:        []TrashedCodebase{},
+	}
+	for _, c := range codebases {
+		bytes, err := storedBytesForCodebase(provider, c.ID)
+		if err != nil {
+			return nil, err
+		}
+		if c.TrashedAt == nil {
+			report.LiveBytes += bytes
+			continue
+		}
+		retainedBy, err := retainedVersions(provider, c.ID)
+		if err != nil {
+			return nil, err
+		}
+		report.TrashedBytes += bytes
+		report.Trashed = append(report.Trashed, TrashedCodebase{
+			Codebase:    c,
+			PurgeAfter:  c.TrashedAt.Add(retention),
+			StoredBytes: bytes,
+			RetainedBy:  retainedBy,
+		})
+	}
+
+	trashSchedule.Lock()
+	if !trashSchedule.nextRunAt.IsZero() {
+		next := trashSchedule.nextRunAt
+		report.NextPurgeAt = &next
+	}
+	trashSchedule.Unlock()
+	return report, nil
+}
+
+// PurgeExpired permanently deletes trashed codebases whose retention window has passed,
+// using the regular codebase deletion path. Codebases with a locked or pinned version are kept until
+// they are restored and released. Purges and kept codebases are recorded in the audit log. Returns
+// the IDs of purged codebases.
+func (s *TrashService) PurgeExpired() ([]string, error) {
+	return s.purgeExpired(nil)
+}
+
+func (s *TrashService) purgeExpired(throttle *IOThrottle) ([]string, error) {
+	provider := core.GetProvider()
+	codebases, err := provider.ListCodebases()
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	retention := trashRetention()
+	var purged []string
+	for _, c := range codebases {
+		if c.TrashedAt == nil || now.Before(c.TrashedAt.Add(retention)) {
+			continue
+		}
+		retainedBy, err := retainedVersions(provider, c.ID)
+		if err != nil {
+			log.Printf("Failed to check the versions of trashed codebase %s: %v", c.ID, err)
+			continue
+		}
+		if len(retainedBy) > 0 {
+			s.auditRetained(provider, c, strings.Join(retainedBy, ", "))
+			continue
+		}
+		bytes, err := storedBytesForCodebase(provider, c.ID)
+		if err != nil {
+			log.Printf("Failed to measure trashed codebase %s: %v", c.ID, err)
+		}
+		if throttle != nil {
+			throttle.Wait(bytes)
+		}
+		if err := s.deleteService.DeleteCodebase(c.ID); err != nil {
+			log.Printf("Failed to purge trashed codebase %s: %v", c.ID, err)
+			continue
+		}
+		log.Printf("Purged trashed codebase: ID=%s, name=%s, trashed at %s", c.ID, c.Name, c.TrashedAt.Format(time.RFC3339))
+		recordAudit(provider, now, AuditTrashPurge, c.ID, fmt.Sprintf("name=%s, trashed at %s, %d stored bytes",
+			c.Name, c.TrashedAt.Format(time.RFC3339), bytes))
+		purged = append(purged, c.ID)
+	}
+	return purged, nil
+}
+
+// auditRetained records that an expired codebase was kept, once per process and set of retaining versions.
+func (s *TrashService) auditRetained(provider core.DataProvider, c *core.Codebase, retainedBy string) {
+	trashSchedule.Lock()
+	if trashSchedule.retained == nil {
+		trashSchedule.retained = make(map[string]string)
+	}
+	audited := trashSchedule.retained[c.ID] == retainedBy
+	trashSchedule.retained[c.ID] = retainedBy
+	trashSchedule.Unlock()
+	if audited {
+		return
+	}
+	log.Printf("Kept expired trashed codebase %s: %s", c.ID, retainedBy)
+	recordAudit(provider, s.now(), AuditTrashPurgeSkipped, c.ID, "retained by "+retainedBy)
+}
+
+// retainedVersions lists the locked or pinned versions of a codebase as "branch/version (locked, pinned)".
+func retainedVersions(provider core.DataProvider, codebaseID string) ([]string, error) {
+	versions, err := provider.ListVersions(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	var retained []string
+	for _, v := range versions {
+		var flags []string
+		if v.Locked {
+			flags = append(flags, "locked")
+		}
+		if v.Pinned {
+			flags = append(flags, "pinned")
+		}
+		if len(flags) > 0 {
+			retained = append(retained, fmt.Sprintf("%s/%s (%s)", v.Branch, v.Version, strings.Join(flags, ", ")))
+		}
+	}
+	sort.Strings(retained)
+	return retained, nil
+}
+
+// StartTrashPurger runs PurgeExpired periodically in the background until stop is closed.
+func (s *TrashService) StartTrashPurger(stop <-chan struct{}) {
+	go func() {
+		for {
+			interval := trashPurgeInterval()
+			trashSchedule.Lock()
+			trashSchedule.nextRunAt = s.now().Add(interval)
+			trashSchedule.Unlock()
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+			err := BackgroundJobs().Run("trash-purge", func(throttle *IOThrottle) error {
+				_, err := s.purgeExpired(throttle)
+				return err
+			})
+			if err != nil {
+				log.Printf("Trash purge run failed: %v", err)
+			}
+		}
+	}()
+}
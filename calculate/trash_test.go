@@ -0,0 +1,125 @@
+package calculate
+
+import (
+	"main/core"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable now for services that take one
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+// fileKeys maps the paths of a version to the storage keys of their content.
+func fileKeys(t *testing.T, versionID string) map[string]string {
+	t.Helper()
+	provider := core.GetProvider()
+	v, err := provider.GetVersionByID(versionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := provider.GetFileIndexesByTreeID(v.TreeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[string]string, len(files))
+	for _, f := range files {
+		keys[f.Path] = f.StorageKey
+	}
+	return keys
+}
+
+func TestTrashPurgeAfterRetention(t *testing.T) {
+	core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), GlobalBlobNamespace: true, TrashRetentionHours: 24})
+	t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+	provider, storage := useMemoryBackends(t)
+
+	trashed := mustInitCodebase(t, "trashed")
+	kept := mustInitCodebase(t, "kept")
+	gone := mustSnapshot(t, trashed.ID, "main", "v1", map[string]string{"shared.txt": "shared content", "own.txt": "only in trashed"})
+	other := mustSnapshot(t, kept.ID, "main", "v1", map[string]string{"shared.txt": "shared content"})
+	keys := fileKeys(t, gone.Version.ID)
+	if fileKeys(t, other.Version.ID)["shared.txt"] != keys["shared.txt"] {
+		t.Fatal("shared.txt was not deduplicated across the codebases")
+	}
+
+	clock := &fakeClock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	trash := &TrashService{deleteService: NewDeleteService(), now: clock.now}
+	if _, err := trash.TrashCodebase(trashed.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.t = clock.t.Add(23 * time.Hour)
+	if purged, err := trash.PurgeExpired(); err != nil || len(purged) != 0 {
+		t.Fatalf("PurgeExpired inside the retention window = %v, %v", purged, err)
+	}
+
+	clock.t = clock.t.Add(2 * time.Hour)
+	purged, err := trash.PurgeExpired()
+	if err != nil || len(purged) != 1 || purged[0] != trashed.ID {
+		t.Fatalf("PurgeExpired after the retention window = %v, %v, want the trashed codebase", purged, err)
+	}
+	if _, err := provider.GetCodebaseByID(trashed.ID); err == nil {
+		t.Error("the purged codebase is still in the metadata")
+	}
+	if _, err := provider.GetVersionByID(gone.Version.ID); err == nil {
+		t.Error("a version of the purged codebase is still in the metadata")
+	}
+	if exists, _ := storage.ObjectExists(keys["own.txt"]); exists {
+		t.Errorf("object %s of the purged codebase is still stored", keys["own.txt"])
+	}
+	if exists, _ := storage.ObjectExists(keys["shared.txt"]); !exists {
+		t.Errorf("object %s shared with another codebase was deleted", keys["shared.txt"])
+	}
+	latest, err := provider.FindLatestVersionInBranch(kept.ID, "main", "")
+	if err != nil || latest == nil {
+		t.Fatalf("latest version of the other codebase = %v, %v", latest, err)
+	}
+	if got := readStoredFile(t, storage, latest.ID, "shared.txt"); got != "shared content" {
+		t.Errorf("shared.txt of the other codebase = %q", got)
+	}
+
+	entries, err := NewAuditService().List(AuditTrashPurge, trashed.ID)
+	if err != nil || len(entries) != 1 || !entries[0].Time.Equal(clock.t) {
+		t.Errorf("audit entries of the purge = %+v, %v, want one at the fake time", entries, err)
+	}
+}
+
+func TestTrashPurgeKeepsLockedAndPinnedVersions(t *testing.T) {
+	useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "pinned")
+	mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"a.txt": "1"})
+	pinned := true
+	if _, err := NewHistoryService().SetVersionFlags(codebase.ID, VersionSelector{Branch: "main", Version: "v1"}, VersionFlags{Pinned: &pinned}); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := &fakeClock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	trash := &TrashService{deleteService: NewDeleteService(), now: clock.now}
+	if _, err := trash.TrashCodebase(codebase.ID); err != nil {
+		t.Fatal(err)
+	}
+	clock.t = clock.t.Add(trashRetention() + time.Hour)
+	for run := 0; run < 2; run++ {
+		if purged, err := trash.PurgeExpired(); err != nil || len(purged) != 0 {
+			t.Fatalf("run %d purged %v, %v, want the pinned codebase kept", run, purged, err)
+		}
+	}
+	if _, err := core.GetProvider().GetCodebaseByID(codebase.ID); err != nil {
+		t.Errorf("the pinned codebase is gone: %v", err)
+	}
+
+	entries, err := NewAuditService().List(AuditTrashPurgeSkipped, codebase.ID)
+	if err != nil || len(entries) != 1 || !strings.Contains(entries[0].Detail, "main/v1 (pinned)") {
+		t.Errorf("audit entries of the kept codebase = %+v, %v, want one naming main/v1", entries, err)
+	}
+	report, err := trash.GetTrashReport()
+	if err != nil || len(report.Trashed) != 1 || len(report.Trashed[0].RetainedBy) != 1 {
+		t.Errorf("trash report = %+v, %v, want the codebase retained by main/v1", report, err)
+	}
+}
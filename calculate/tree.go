@@ -0,0 +1,189 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"path"
+	"sort"
+	"strings"
+)
+
+// TreeNode is a directory or file of a version's file tree. Directories carry rollups of everything below them.
+type TreeNode struct {
+	Name           string      `json:"name"`
+	Path           string      `json:"path"`
+	IsDir          bool        `json:"is_dir"`
+	FileCount      int         `json:"file_count"`
+	Size           int64       `json:"size"`
+	CompressedSize int64       `json:"compressed_size"`
+	File           *core.File  `json:"file,omitempty"`     // set for files
+	Children       []*TreeNode `json:"children,omitempty"` // directories first, then files, each alphabetical
+}
+
+// VersionTree is the file tree of a version, either flat or nested
+type VersionTree struct {
+	CodebaseID string      `json:"codebase_id"`
+	Branch     string      `json:"branch"`
+	Version    string      `json:"version"`
+	VersionID  string      `json:"version_id"`
+	Files      []core.File `json:"files,omitempty"`
+	Root       *TreeNode   `json:"root,omitempty"`
+}
+
+// GetTree returns the files of a version sorted by path or, with nested, as a directory hierarchy.
+func (s *ArchiveService) GetTree(codebaseID, branch, version string, nested bool) (*VersionTree, error) {
+	provider := core.GetProvider()
+	if _, err := getActiveCodebase(provider, codebaseID); err != nil {
+		return nil, err
+	}
+	v, err := resolveVersion(provider, codebaseID, branch, version)
+	if err != nil {
+		return nil, err
+	}
+	files, err := provider.GetFileIndexesByTreeID(v.TreeID)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := append([]core.File{}, files...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Path < sorted[j].Path })
+
+	tree := &VersionTree{CodebaseID: codebaseID, Branch: v.Branch, Version: v.Version, VersionID: v.ID}
+	if nested {
+		tree.Root = buildTreeNodes(sorted)
+	} else {
+		tree.Files = sorted
+	}
+	return tree, nil
+}
+
+// buildTreeNodes nests files by their slash-separated paths below an unnamed root directory.
+func buildTreeNodes(files []core.File) *TreeNode {
+	root := &TreeNode{IsDir: true}
+	dirs := map[string]*TreeNode{"": root}
+
+	var dirFor func(dir string) *TreeNode
+	dirFor = func(dir string) *TreeNode {
+		if node, ok := dirs[dir]; ok {
+			return node
+		}
+		parent := dirFor(parentDir(dir))
+		node := &TreeNode{Name: path.Base(dir), Path: dir, IsDir: true}
+		parent.Children = append(parent.Children, node)
+		dirs[dir] = node
+		return node
+	}
+
+	for i := range files {
+		f := &files[i]
+		if f.IsDir() {
+			// Directories recorded at snapshot time show up even when nothing is below them
+			dirFor(f.Path)
+			continue
+		}
+		dir := parentDir(f.Path)
+		parent := dirFor(dir)
+		parent.Children = append(parent.Children, &TreeNode{
+			Name:           path.Base(f.Path),
+			Path:           f.Path,
+			FileCount:      1,
+			Size:           f.Size,
+			CompressedSize: f.CompressedSize,
+			File:           f,
+		})
+		// Roll the file up into every directory on its path
+		for d := dir; ; d = parentDir(d) {
+			node := dirs[d]
+			node.FileCount++
+			node.Size += f.Size
+			node.CompressedSize += f.CompressedSize
+			if d == "" {
+				break
+			}
+		}
+	}
+
+	sortTreeNodes(root)
+	return root
+}
+
+// parentDir returns the directory of a slash-separated path, "" for top-level entries.
+func parentDir(p string) string {
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		return p[:i]
+	}
+	return ""
+}
+
+func sortTreeNodes(node *TreeNode) {
+	sort.Slice(node.Children, func(i, j int) bool {
+		a, b := node.Children[i], node.Children[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		return a.Name < b.Name
+	})
+	for _, child := range node.Children {
+		if child.IsDir {
+			sortTreeNodes(child)
+		}
+	}
+}
+
+// PathNotFoundError reports a path that isn't part of a version's tree
+type PathNotFoundError struct {
+	Path    string `json:"path"`
+	Branch  string `json:"branch"`
+	Version string `json:"version"`
+}
+
+func (e *PathNotFoundError) Error() string {
+	return fmt.Sprintf("file '%s' not found in version %s/%s", e.Path, e.Branch, e.Version)
+}
+
+// FileStat is the index record of a file together with the state of its stored objects
+type FileStat struct {
+	core.File
+	CodebaseID     string   `json:"codebase_id"`
+	Branch         string   `json:"branch"`
+	Version        string   `json:"version"`
+	VersionID      string   `json:"version_id"`
+	BlobExists     bool     `json:"blob_exists"`               // every object of the file is present in storage
+	MissingObjects []string `json:"missing_objects,omitempty"` // storage keys that are not present
+}
+
+// StatFile returns the index record of one path of a version without downloading its content.
+func (s *ArchiveService) StatFile(codebaseID, branch, version, filePath string) (*FileStat, error) {
+	provider := core.GetProvider()
+	if _, err := getActiveCodebase(provider, codebaseID); err != nil {
+		return nil, err
+	}
+	v, err := resolveVersion(provider, codebaseID, branch, version)
+	if err != nil {
+		return nil, err
+	}
+	files, err := provider.GetFileIndexesByTreeID(v.TreeID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		if f.Path != filePath {
+			continue
+		}
+		stat := &FileStat{File: f, CodebaseID: codebaseID, Branch: v.Branch, Version: v.Version, VersionID: v.ID, BlobExists: true}
+		storage := core.GetStore()
+		for _, key := range f.StorageKeys() {
+			exists, err := storage.ObjectExists(key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to check object %s: %w", key, err)
+			}
+			if !exists {
+				stat.BlobExists = false
+				stat.MissingObjects = append(stat.MissingObjects, key)
+			}
+		}
+		return stat, nil
+	}
+	return nil, &PathNotFoundError{Path: filePath, Branch: v.Branch, Version: v.Version}
+}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"main/core"
 	"mime/multipart"
+	"path/filepath"
+	"sort"
 	"time"
 )
 
@@ -25,16 +27,248 @@ type BranchFrom struct {
 	Version string `json:"version"`
 }
 
-func (s *UploadService) ProcessSnapshot(codebaseID, ver, branch, message string, files map[string]*multipart.FileHeader, branchFrom *BranchFrom, autoLinkage bool) (*core.SnapshotResponse, error) {
+// SnapshotOptions carries optional snapshot request parameters
+type SnapshotOptions struct {
+	// Manifest lists every file the client intended to upload; received files are checked against it
+	Manifest []ManifestEntry
+	// Attributes attaches key/value attributes to uploaded paths
+	Attributes map[string]map[string]string
+	// Modes sets the permission bits of uploaded paths as octal strings such as "755"
+	Modes map[string]string
+	// InferBranchFrom links a new branch to the branch head closest to the uploaded content
+	// instead of the default branch when no branch_from is given
+	InferBranchFrom bool
+	// AllowEmpty records a version without files, e.g. a point-in-time marker
+	AllowEmpty bool
+	// Durable writes the metadata files before returning instead of leaving it to the batched flush
+	Durable bool
+	// Overwrite replaces a version with the same branch and name instead of rejecting the snapshot
+	Overwrite bool
+	// Base makes the snapshot incremental: files not uploaded are carried forward from the base
+	// version, except the Deleted paths
+	Base    *SnapshotBase
+	Deleted []string
+	// Ignore adds gitignore-style patterns to those of the codebase for this snapshot
+	Ignore []string
+	// Directories records directories, typically empty ones, that are restored even without files
+	Directories []string
+	// FailureMode decides what a file that can't be stored does to the snapshot: "strict" (default)
+	// fails it, "partial" leaves the file out and lists it in Version.FailedFiles
+	FailureMode string
+	// Author is recorded as the author of the version, nil stores none
+	Author *core.VersionAuthor
+
+	// trackProgress receives the progress counters of the snapshot once it starts processing files
+	trackProgress func(*SnapshotProgress)
+	// source records where the files were imported from
+	source *core.VersionSource
+}
+
+// SnapshotFile is one file of a snapshot upload: a part of the multipart request, or a file staged by
+// an upload session.
+type SnapshotFile struct {
+	Size int64
+	open func() (multipart.File, error)
+}
+
+// UploadedFile wraps a file part of a multipart request.
+func UploadedFile(header *multipart.FileHeader) *SnapshotFile {
+	return &SnapshotFile{Size: header.Size, open: header.Open}
+}
+
+// Open returns the content of the file.
+func (f *SnapshotFile) Open() (multipart.File, error) {
+	return f.open()
+}
+
+// checkUploadLimits enforces the size limits of the config file and the codebase limit on the files of
+// an upload before anything is stored. Files carried forward or resolved to stored content don't count.
+func checkUploadLimits(files map[string]*SnapshotFile, codebaseMaxBytes int64) error {
+	cfg := core.GetConfig()
+	paths := make([]string, 0, len(files))
+	for relPath := range files {
+		paths = append(paths, relPath)
+	}
+	sort.Strings(paths)
+
+	var total int64
+	for _, relPath := range paths {
+		size := files[relPath].Size
+		if cfg.MaxFileBytes > 0 && size > cfg.MaxFileBytes {
+			return fmt.Errorf("snapshot too large: file %s is %d bytes, the limit is %d bytes per file", filepath.ToSlash(relPath), size, cfg.MaxFileBytes)
+		}
+		total += size
+	}
+	if cfg.MaxSnapshotBytes > 0 && total > cfg.MaxSnapshotBytes {
+		return fmt.Errorf("snapshot too large: %d bytes exceeds the server limit of %d bytes per snapshot", total, cfg.MaxSnapshotBytes)
+	}
+	if codebaseMaxBytes > 0 && total > codebaseMaxBytes {
+		return fmt.Errorf("snapshot too large: %d bytes exceeds the codebase limit of %d bytes", total, codebaseMaxBytes)
+	}
+	return nil
+}
+
+// CheckSnapshotFileCount enforces the server-wide limit on files per snapshot.
+func CheckSnapshotFileCount(received int) error {
+	limit := core.GetConfig().MaxFilesPerSnapshot
+	if limit > 0 && received > limit {
+		return fmt.Errorf("snapshot too large: received %d files, the limit is %d files per snapshot; split the tree across several snapshots", received, limit)
+	}
+	return nil
+}
+
+func (s *UploadService) ProcessSnapshot(codebaseID, ver, branch, message string, files map[string]*SnapshotFile, branchFrom *BranchFrom, autoLinkage bool, opts SnapshotOptions) (*core.SnapshotResponse, error) {
 	provider := core.GetProvider()
 	storage := core.GetStore()
 
 	// 1. Verify codebase exists
-	codebase, err := provider.GetCodebaseByID(codebaseID)
+	codebase, err := getActiveCodebase(provider, codebaseID)
 	if err != nil {
 		return nil, fmt.Errorf("invalid codebase_id: %s, error: %w", codebaseID, err)
 	}
 	codebaseInfo := *codebase
+	if branch == "" {
+		branch = defaultBranchOf(codebase)
+	}
+	if branch, err = branchForWrite(provider, codebase, branch); err != nil {
+		return nil, err
+	}
+	if branchFrom != nil {
+		if err := validateVersionRefField("branch_from.", branchFrom.Branch, branchFrom.Version); err != nil {
+			return nil, err
+		}
+		branchFrom.Branch = branchForLookup(provider, codebaseID, branchFrom.Branch)
+	}
+
+	if err := CheckSnapshotFileCount(len(files)); err != nil {
+		return nil, err
+	}
+	if err := checkUploadPaths(files, opts.Manifest); err != nil {
+		return nil, err
+	}
+	if err := validateIgnorePatterns(opts.Ignore); err != nil {
+		return nil, fmt.Errorf("invalid snapshot: %w", err)
+	}
+	if err := validateFailureMode(opts.FailureMode); err != nil {
+		return nil, err
+	}
+	if opts.Author, err = normalizeAuthor(opts.Author); err != nil {
+		return nil, err
+	}
+	// Without a name the snapshot gets the next one of its branch, held until the version is saved
+	if ver != "" {
+		if err := validateName("version", ver); err != nil {
+			return nil, err
+		}
+	} else {
+		name, release, err := reserveVersionName(provider, codebaseID, branch)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		ver = name
+	}
+	// Reject a taken name before storing anything; persistMetadata checks again for concurrent uploads
+	if existing, err := provider.GetVersion(codebaseID, branch, ver); err == nil {
+		if !opts.Overwrite {
+			return nil, &core.VersionExistsError{Branch: branch, Version: ver, VersionID: existing.ID}
+		}
+		if err := checkUnlocked("snapshot", existing); err != nil {
+			return nil, err
+		}
+	}
+	// Keep garbage collection and object deletion out until the file index referencing the new objects
+	// is persisted. Stored objects the snapshot refers to, of its base version or resolved from the
+	// manifest, must not be deleted once they are looked up either.
+	objectWriters.RLock()
+	writersLocked := true
+	defer func() {
+		if writersLocked {
+			objectWriters.RUnlock()
+		}
+	}()
+	// A missing base version of an incremental snapshot is rejected before storing anything too
+	var baseFiles []core.File
+	if opts.Base != nil {
+		if baseFiles, err = loadSnapshotBase(provider, codebaseID, branch, opts.Base, opts.Deleted, files); err != nil {
+			return nil, err
+		}
+	} else if len(opts.Deleted) > 0 {
+		return nil, fmt.Errorf("invalid snapshot: deleted paths need a base version")
+	}
+	// Manifest entries left out of the upload because the server has their content, see NegotiateSnapshot
+	var known []core.File
+	if opts.Manifest != nil {
+		known = resolveKnownFiles(newKnownContent(storage, provider, codebase), opts.Manifest, files)
+		if err := CheckSnapshotFileCount(len(files) + len(known)); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkAttributes(opts.Attributes, files, known); err != nil {
+		return nil, err
+	}
+	modes, err := parseFileModes(opts.Modes, files, known)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := normalizeDirectories(opts.Directories, files)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := settingsFor(codebase)
+
+	// Drop files matching the ignore patterns of the codebase and the request before anything else
+	// looks at them; the request's come last, so they can re-include files with "!"
+	ignorePatterns := append(append([]string(nil), settings.IgnorePatterns...), opts.Ignore...)
+	files, ignored := filterIgnoredFiles(files, ignorePatterns)
+	known, ignoredKnown := filterIgnoredKnown(known, ignorePatterns)
+	ignored += ignoredKnown
+	dirs = filterIgnoredDirectories(dirs, ignorePatterns)
+	// The manifest may list the ignored files too, they aren't expected
+	manifest := filterIgnoredManifest(opts.Manifest, ignorePatterns)
+	if len(files) == 0 && len(known) == 0 && len(dirs) == 0 && ignored > 0 && !opts.AllowEmpty && opts.Base == nil {
+		return nil, fmt.Errorf("invalid snapshot: all %d files matched the ignore patterns", ignored)
+	}
+
+	// Verify received files against the manifest before writing any blob
+	if opts.Manifest == nil && settings.ManifestRequired {
+		return nil, fmt.Errorf("codebase %s requires a manifest with every snapshot", codebaseID)
+	}
+	if opts.Manifest != nil {
+		if err := checkManifestFiles(manifest, files, known); err != nil {
+			return nil, err
+		}
+	}
+
+	// Catch paths that can't be extracted on every platform before they are stored
+	files, portabilityWarnings, renames, err := applyPathPolicy(files, settings.PathPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkUploadLimits(files, settings.MaxSnapshotBytes); err != nil {
+		return nil, err
+	}
+
+	progress := newSnapshotProgress(codebaseID, branch, ver)
+	var declaredBytes int64
+	for _, header := range files {
+		declaredBytes += header.Size
+	}
+	progress.start(len(files), declaredBytes)
+	if opts.trackProgress != nil {
+		opts.trackProgress(progress)
+	}
+
+	// Until then a failure deletes the objects this snapshot wrote, see rollbackObjects
+	var written writtenObjects
+	abort := func(err error) (*core.SnapshotResponse, error) {
+		progress.fail(err)
+		objectWriters.RUnlock()
+		writersLocked = false
+		return nil, rollbackObjects(codebaseInfo.Name, written.list(), err)
+	}
 
 	// 2. Create snapshot (pass storage interface)
 	_, versionJSON, fileTreeJSON, err := CreateSnapshot(
@@ -44,9 +278,13 @@ func (s *UploadService) ProcessSnapshot(codebaseID, ver, branch, message string,
 		branch,
 		ver,
 		message,
+		settings.Compression,
+		progress,
+		opts.FailureMode == FailureModePartial,
+		&written,
 	)
 	if err != nil {
-		log.Printf("Snapshot creation failed: %v", err)
+		progress.fail(err)
 		return nil, err
 	}
 
@@ -56,66 +294,182 @@ func (s *UploadService) ProcessSnapshot(codebaseID, ver, branch, message string,
 		fileTree core.FileTree
 	)
 	if err := json.Unmarshal(versionJSON, &version); err != nil {
-		return nil, err
+		return abort(err)
 	}
 	if err := json.Unmarshal(fileTreeJSON, &fileTree); err != nil {
-		return nil, err
+		return abort(err)
+	}
+	for i := range fileTree.Files {
+		fileTree.Files[i].OriginalPath = renames[fileTree.Files[i].Path]
+	}
+	addKnownFiles(&version, &fileTree, known)
+	applyAttributes(fileTree.Files, opts.Attributes)
+	applyFileModes(fileTree.Files, modes)
+
+	if opts.Manifest != nil {
+		if err := checkManifestHashes(manifest, fileTree.Files); err != nil {
+			return abort(err)
+		}
+	}
+
+	addDirectories(&fileTree, dirs)
+
+	if opts.Base != nil {
+		inheritFileModes(fileTree.Files, baseFiles)
+		// A file that failed isn't carried forward either, the base content would pass for the new one
+		carryForward(&version, &fileTree, baseFiles, append(failedPaths(version.FailedFiles, renames), opts.Deleted...))
+		if len(fileTree.Files) == 0 && !opts.AllowEmpty {
+			return abort(fmt.Errorf("invalid snapshot: every file of the base version was deleted (set allow_empty to record an empty snapshot)"))
+		}
 	}
 
 	// 4. Associate CodebaseID to new version
 	version.CodebaseID = codebaseID
+	version.Source = opts.source
+	version.Author = opts.Author
 
 	// 5. Persist metadata
-	if err := s.persistMetadata(provider, codebase, &version, &fileTree); err != nil {
-		return nil, err
+	replaced, err := s.persistMetadata(provider, codebase, &version, &fileTree, opts.Overwrite)
+	if err != nil {
+		return abort(err)
 	}
+	progress.finish(version.ID)
 
 	// 6. Automatically establish lineage relationships (if enabled)
-	if autoLinkage {
-		if err := s.establishLinkage(codebaseID, version.ID, branch, branchFrom); err != nil {
+	// A replacement keeps the lineage of the version it replaced
+	var linkage *core.LinkageDecision
+	if autoLinkage && replaced == "" {
+		if linkage, err = s.establishLinkage(codebaseID, version.ID, branch, branchFrom, opts.InferBranchFrom); err != nil {
 			// Lineage relationship establishment failure should not affect snapshot creation, just log the error
 			log.Printf("Failed to establish lineage relationship (version ID: %s): %v", version.ID, err)
 		}
 	}
 
-	// 7. Synchronously get updated version graph
+	// Warn when the branch no longer has a single head, e.g. after uploads without linkage
+	var warnings []core.SnapshotWarning
+	if warning := splitHeadWarning(provider, codebaseID, version.Branch); warning != nil {
+		warnings = append(warnings, *warning)
+	}
+
+	// 7. Synchronously rebuild the version graph so the cache includes the new node and edges
 	var versionMap core.VersionMapResponse
-	historyJSON, err := s.historyService.GetVersionMap(codebaseID)
+	historyMap, err := s.historyService.RebuildHistoryCache(codebaseID)
 	if err != nil {
 		// Even if getting graph fails, should not interrupt snapshot creation process, just log error
 		log.Printf("Unable to get version graph after creating snapshot (codebaseID: %s): %v", codebaseID, err)
-	} else if historyJSON != nil {
-		if err := json.Unmarshal(historyJSON, &versionMap); err != nil {
-			log.Printf("Unable to parse version graph JSON (codebaseID: %s): %v", codebaseID, err)
-		}
+	} else {
+		versionMap = *historyMap
 	}
 
 	// Update codebaseInfo's UpdatedAt field
 	codebaseInfo.UpdatedAt = time.Now()
 
+	if opts.Durable {
+		if err := provider.Flush(); err != nil {
+			return nil, fmt.Errorf("version %s was created but could not be written to disk: %w", version.ID, err)
+		}
+	}
+
+	stats := core.VersionStats(version.Stats)
+	notifyWebhooks(WebhookEvent{
+		Event:      WebhookEventSnapshotCreated,
+		CodebaseID: codebaseID,
+		Branch:     version.Branch,
+		Version:    version.Version,
+		VersionID:  version.ID,
+		Stats:      &stats,
+	})
+
 	return &core.SnapshotResponse{
-		Codebase:   &codebaseInfo,
-		Version:    &version,
-		FileTree:   &fileTree,
-		VersionMap: &versionMap,
+		Codebase:            &codebaseInfo,
+		Version:             &version,
+		FileTree:            &fileTree,
+		VersionMap:          &versionMap,
+		IgnoredFiles:        ignored,
+		PortabilityWarnings: portabilityWarnings,
+		FailedFiles:         version.FailedFiles,
+		Linkage:             linkage,
+		Warnings:            warnings,
+		ReplacedVersionID:   replaced,
+		Durable:             opts.Durable,
 	}, nil
 }
 
-func (s *UploadService) persistMetadata(provider core.DataProvider, codebase *core.Codebase, version *core.Version, fileTree *core.FileTree) error {
+// filterIgnoredFiles returns the files not matched by any ignore pattern and the number dropped.
+func filterIgnoredFiles(files map[string]*SnapshotFile, patterns []string) (map[string]*SnapshotFile, int) {
+	if len(patterns) == 0 {
+		return files, 0
+	}
+	kept := make(map[string]*SnapshotFile, len(files))
+	ignored := 0
+	for relPath, header := range files {
+		if isIgnored(patterns, filepath.ToSlash(relPath)) {
+			ignored++
+			continue
+		}
+		kept[relPath] = header
+	}
+	return kept, ignored
+}
+
+// filterIgnoredKnown is filterIgnoredFiles for manifest entries resolved to stored content.
+func filterIgnoredKnown(known []core.File, patterns []string) ([]core.File, int) {
+	if len(patterns) == 0 {
+		return known, 0
+	}
+	kept := known[:0]
+	for _, f := range known {
+		if !isIgnored(patterns, f.Path) {
+			kept = append(kept, f)
+		}
+	}
+	return kept, len(known) - len(kept)
+}
+
+// filterIgnoredManifest drops the manifest entries matched by the ignore patterns.
+func filterIgnoredManifest(manifest []ManifestEntry, patterns []string) []ManifestEntry {
+	if len(patterns) == 0 || manifest == nil {
+		return manifest
+	}
+	kept := make([]ManifestEntry, 0, len(manifest))
+	for _, entry := range manifest {
+		if !isIgnored(patterns, filepath.ToSlash(entry.Path)) {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// persistMetadata saves the version and its file indexes. With overwrite, a version with the same branch
+// and name is replaced and its ID returned.
+func (s *UploadService) persistMetadata(provider core.DataProvider, codebase *core.Codebase, version *core.Version, fileTree *core.FileTree, overwrite bool) (string, error) {
 	// Update codebase's updated_at field
 	if err := provider.UpdateCodebaseTimestamp(codebase.ID, time.Now()); err != nil {
-		return fmt.Errorf("failed to update codebase: %w", err)
+		return "", fmt.Errorf("failed to update codebase: %w", err)
+	}
+
+	if overwrite {
+		if existing, err := provider.GetVersion(codebase.ID, version.Branch, version.Version); err == nil {
+			if err := checkUnlocked("snapshot", existing); err != nil {
+				return "", err
+			}
+			if err := provider.ReplaceVersion(existing.ID, version, fileTree.Files); err != nil {
+				return "", fmt.Errorf("failed to replace version %s: %w", existing.ID, err)
+			}
+			log.Printf("Version %s/%s of codebase %s replaced: %s -> %s", version.Branch, version.Version, codebase.ID, existing.ID, version.ID)
+			return existing.ID, nil
+		}
 	}
 
 	// Save version and file indexes
 	if err := provider.CreateVersion(version, fileTree.Files); err != nil {
-		return fmt.Errorf("failed to insert version and file indexes: %w", err)
+		return "", fmt.Errorf("failed to insert version and file indexes: %w", err)
 	}
-	return nil
+	return "", nil
 }
 
-// establishLinkage establishes version lineage relationships
-func (s *UploadService) establishLinkage(codebaseID, versionID, branch string, branchFrom *BranchFrom) error {
+// establishLinkage establishes version lineage relationships and reports which parent was chosen
+func (s *UploadService) establishLinkage(codebaseID, versionID, branch string, branchFrom *BranchFrom, inferBranchFrom bool) (*core.LinkageDecision, error) {
 	if branchFrom != nil {
 		// Cross-branch lineage relationship: create from specified source version
 		log.Printf("Establishing cross-branch lineage relationship: %s/%s -> current version", branchFrom.Branch, branchFrom.Version)
@@ -128,13 +482,13 @@ func (s *UploadService) establishLinkage(codebaseID, versionID, branch string, b
 	// Automatically detect link type
 	isNew, err := s.historyService.isNewBranch(codebaseID, branch, versionID)
 	if err != nil {
-		return fmt.Errorf("failed to check if new branch: %w", err)
+		return nil, fmt.Errorf("failed to check if new branch: %w", err)
 	}
 
 	if isNew {
-		// New branch: create link from main branch
-		log.Printf("Detected new branch '%s', attempting to create link from main branch", branch)
-		return s.historyService.AutoCreateLinkForNewBranch(codebaseID, versionID, branch)
+		// New branch: create link from the default branch (or the closest branch head)
+		log.Printf("Detected new branch '%s', attempting to create link from its source branch", branch)
+		return s.historyService.AutoCreateLinkForNewBranch(codebaseID, versionID, branch, inferBranchFrom)
 	} else {
 		// Existing branch: create same-branch sequential link
 		log.Printf("Creating sequential link on existing branch '%s'", branch)
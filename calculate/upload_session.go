@@ -0,0 +1,468 @@
+package calculate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"main/core"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Upload sessions let a client send a large snapshot file by file, and large files in pieces, so a
+// dropped connection costs only the request in flight. Files are staged under
+// <storage path>/upload_sessions/<session_id>/ and the commit runs ProcessSnapshot over them like over
+// the parts of a single upload. Sessions nobody touched for their TTL are removed by StartSweeper.
+const (
+	uploadSessionsDir    = "upload_sessions"
+	uploadSessionRecord  = "session.json"
+	uploadSessionStaging = "files"
+
+	defaultUploadSessionTTL           = 24 * time.Hour
+	defaultUploadSessionSweepInterval = 10 * time.Minute
+)
+
+// UploadSession describes a session and the files staged in it so far
+type UploadSession struct {
+	ID         string              `json:"id"`
+	CodebaseID string              `json:"codebase_id"`
+	CreatedAt  time.Time           `json:"created_at"`
+	ExpiresAt  time.Time           `json:"expires_at"` // moved ahead by every upload
+	Files      []UploadSessionFile `json:"files"`      // sorted by path
+}
+
+// UploadSessionFile is a file staged in a session. Received is the offset the next piece starts at.
+type UploadSessionFile struct {
+	Path     string `json:"path"`
+	Received int64  `json:"received"`
+}
+
+// uploadSessionState is the session.json of a session; staged sizes are read from the files themselves
+type uploadSessionState struct {
+	ID         string    `json:"id"`
+	CodebaseID string    `json:"codebase_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	TTLSeconds int64     `json:"ttl_seconds"`
+	Paths      []string  `json:"paths"`
+}
+
+// UploadOffsetError rejects a piece that doesn't continue the staged part of its file
+type UploadOffsetError struct {
+	Path     string `json:"path"`
+	Offset   int64  `json:"offset"`
+	Received int64  `json:"received"`
+}
+
+func (e *UploadOffsetError) Error() string {
+	return fmt.Sprintf("upload of %s must continue at offset %d, got %d", e.Path, e.Received, e.Offset)
+}
+
+// uploadSessionLocks serializes the requests of a session; committing marks a session whose commit is running
+var uploadSessionLocks = struct {
+	sync.Mutex
+	sessions   map[string]*sync.Mutex
+	committing map[string]bool
+}{sessions: make(map[string]*sync.Mutex), committing: make(map[string]bool)}
+
+func lockUploadSession(sessionID string) func() {
+	uploadSessionLocks.Lock()
+	mu, ok := uploadSessionLocks.sessions[sessionID]
+	if !ok {
+		mu = &sync.Mutex{}
+		uploadSessionLocks.sessions[sessionID] = mu
+	}
+	uploadSessionLocks.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+// UploadSessionService manages upload sessions
+type UploadSessionService struct {
+	uploadService *UploadService
+	now           func() time.Time
+}
+
+func NewUploadSessionService() *UploadSessionService {
+	return &UploadSessionService{
+		uploadService: NewUploadService(),
+		now:           time.Now,
+	}
+}
+
+func uploadSessionTTL() time.Duration {
+	if seconds := core.GetConfig().UploadSessionTTLSeconds; seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultUploadSessionTTL
+}
+
+func uploadSessionsRoot() string {
+	return filepath.Join(core.GetConfig().StoragePath, uploadSessionsDir)
+}
+
+func uploadSessionDir(sessionID string) string {
+	return filepath.Join(uploadSessionsRoot(), sessionID)
+}
+
+// stagedPath names staged files by the hash of their path, so any snapshot path is a safe file name
+func stagedPath(sessionID, relativePath string) string {
+	return filepath.Join(uploadSessionDir(sessionID), uploadSessionStaging, stagedName(relativePath))
+}
+
+func stagedName(relativePath string) string {
+	sum := sha256.Sum256([]byte(relativePath))
+	return hex.EncodeToString(sum[:])
+}
+
+// Start opens a session for a snapshot of the codebase. A non-positive ttl uses the configured default.
+func (s *UploadSessionService) Start(codebaseID string, ttl time.Duration) (*UploadSession, error) {
+	if _, err := getActiveCodebase(core.GetProvider(), codebaseID); err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		ttl = uploadSessionTTL()
+	}
+	now := s.now().UTC()
+	state := &uploadSessionState{
+		ID:         uuid.NewString(),
+		CodebaseID: codebaseID,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(ttl),
+		TTLSeconds: int64(ttl / time.Second),
+		Paths:      []string{},
+	}
+	if err := os.MkdirAll(filepath.Join(uploadSessionDir(state.ID), uploadSessionStaging), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload session: %w", err)
+	}
+	if err := saveUploadSession(state); err != nil {
+		os.RemoveAll(uploadSessionDir(state.ID))
+		return nil, fmt.Errorf("failed to create upload session: %w", err)
+	}
+	log.Printf("Started upload session: ID=%s, codebase=%s, expires at %s", state.ID, codebaseID, state.ExpiresAt.Format(time.RFC3339))
+	return describeUploadSession(state), nil
+}
+
+// Get returns a session with the sizes of its staged files.
+func (s *UploadSessionService) Get(sessionID string) (*UploadSession, error) {
+	unlock := lockUploadSession(sessionID)
+	defer unlock()
+	state, err := s.load(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return describeUploadSession(state), nil
+}
+
+// WriteFile stages a piece of a file starting at offset, which must be the size staged so far. Offset
+// zero starts the file over. A piece doesn't have to be the last one; the commit takes the files as staged.
+func (s *UploadSessionService) WriteFile(sessionID, relativePath string, offset int64, content io.Reader) (*UploadSessionFile, error) {
+	relativePath = filepath.ToSlash(relativePath)
+	if relativePath == "" {
+		return nil, fmt.Errorf("invalid upload: path is required")
+	}
+	if reason := unsafePathReason(relativePath); reason != "" {
+		return nil, fmt.Errorf("invalid upload: %q: %s", relativePath, reason)
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid upload: negative offset %d", offset)
+	}
+	unlock := lockUploadSession(sessionID)
+	defer unlock()
+	state, err := s.load(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if isCommitting(sessionID) {
+		return nil, fmt.Errorf("upload session %s is being committed", sessionID)
+	}
+
+	path := stagedPath(sessionID, relativePath)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stage %s: %w", relativePath, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stage %s: %w", relativePath, err)
+	}
+	if offset != 0 && offset != info.Size() {
+		return nil, &UploadOffsetError{Path: relativePath, Offset: offset, Received: info.Size()}
+	}
+	if err := file.Truncate(offset); err != nil {
+		return nil, fmt.Errorf("failed to stage %s: %w", relativePath, err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to stage %s: %w", relativePath, err)
+	}
+
+	staged := false
+	for _, p := range state.Paths {
+		staged = staged || p == relativePath
+	}
+	if !staged {
+		if err := CheckSnapshotFileCount(len(state.Paths) + 1); err != nil {
+			return nil, err
+		}
+	}
+	// The upload limits apply while staging already, so a session can't fill the disk either
+	room, limited := stagingRoom(state, relativePath, offset)
+	if limited {
+		content = io.LimitReader(content, room+1)
+	}
+	written, err := io.Copy(file, content)
+	if err == nil && limited && written > room {
+		err = stagingLimitError(relativePath, offset+written)
+	}
+	if err != nil {
+		// Keep only what the client saw acknowledged, the piece is sent again
+		file.Truncate(offset)
+		if strings.Contains(err.Error(), "too large") {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to stage %s: %w", relativePath, err)
+	}
+
+	if !staged {
+		state.Paths = append(state.Paths, relativePath)
+	}
+	state.ExpiresAt = s.now().UTC().Add(time.Duration(state.TTLSeconds) * time.Second)
+	if err := saveUploadSession(state); err != nil {
+		return nil, fmt.Errorf("failed to update upload session: %w", err)
+	}
+	return &UploadSessionFile{Path: relativePath, Received: offset + written}, nil
+}
+
+// Commit creates the snapshot from the staged files with ProcessSnapshot and removes the session. A
+// failed commit keeps the session, so the client can fix the upload and commit again.
+func (s *UploadSessionService) Commit(sessionID, ver, branch, message string, branchFrom *BranchFrom, autoLinkage bool, opts SnapshotOptions) (*core.SnapshotResponse, error) {
+	unlock := lockUploadSession(sessionID)
+	state, err := s.load(sessionID)
+	if err == nil && isCommitting(sessionID) {
+		err = fmt.Errorf("upload session %s is being committed", sessionID)
+	}
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	// Pieces arriving while the snapshot is processed are refused rather than waiting for it
+	setCommitting(sessionID, true)
+	unlock()
+	defer setCommitting(sessionID, false)
+
+	files := make(map[string]*SnapshotFile, len(state.Paths))
+	for _, relativePath := range state.Paths {
+		path := stagedPath(sessionID, relativePath)
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("staged file %s: %w", relativePath, err)
+		}
+		files[relativePath] = &SnapshotFile{Size: info.Size(), open: func() (multipart.File, error) { return os.Open(path) }}
+	}
+
+	resp, err := s.uploadService.ProcessSnapshot(state.CodebaseID, ver, branch, message, files, branchFrom, autoLinkage, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.remove(sessionID); err != nil {
+		log.Printf("Failed to remove committed upload session %s: %v", sessionID, err)
+	}
+	log.Printf("Committed upload session: ID=%s, version ID=%s", sessionID, resp.Version.ID)
+	return resp, nil
+}
+
+// Abort removes a session and its staged files.
+func (s *UploadSessionService) Abort(sessionID string) error {
+	unlock := lockUploadSession(sessionID)
+	defer unlock()
+	if _, err := s.load(sessionID); err != nil {
+		return err
+	}
+	if isCommitting(sessionID) {
+		return fmt.Errorf("upload session %s is being committed", sessionID)
+	}
+	return s.remove(sessionID)
+}
+
+// PurgeExpired removes the sessions whose TTL has passed since their last upload, returning their IDs.
+func (s *UploadSessionService) PurgeExpired() ([]string, error) {
+	entries, err := os.ReadDir(uploadSessionsRoot())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var purged []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		sessionID := e.Name()
+		unlock := lockUploadSession(sessionID)
+		state, err := readUploadSession(sessionID)
+		// A directory without a readable record is the remains of a failed start
+		expired := err != nil || !s.now().Before(state.ExpiresAt)
+		if expired && !isCommitting(sessionID) {
+			if err := s.remove(sessionID); err != nil {
+				log.Printf("Failed to purge upload session %s: %v", sessionID, err)
+			} else {
+				purged = append(purged, sessionID)
+			}
+		}
+		unlock()
+	}
+	if len(purged) > 0 {
+		log.Printf("Purged %d expired upload sessions", len(purged))
+	}
+	return purged, nil
+}
+
+// StartSweeper runs PurgeExpired periodically in the background until stop is closed.
+func (s *UploadSessionService) StartSweeper(stop <-chan struct{}) {
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(defaultUploadSessionSweepInterval):
+			}
+			err := BackgroundJobs().Run("upload-session-sweep", func(throttle *IOThrottle) error {
+				_, err := s.PurgeExpired()
+				return err
+			})
+			if err != nil {
+				log.Printf("Upload session sweep failed: %v", err)
+			}
+		}
+	}()
+}
+
+// stagingRoom returns how many bytes may be staged for a file from offset on under the server-wide
+// limits, and whether there is a limit at all.
+func stagingRoom(state *uploadSessionState, relativePath string, offset int64) (int64, bool) {
+	cfg := core.GetConfig()
+	room, limited := int64(0), false
+	if cfg.MaxFileBytes > 0 {
+		room, limited = cfg.MaxFileBytes-offset, true
+	}
+	if cfg.MaxSnapshotBytes > 0 {
+		var others int64
+		for _, p := range state.Paths {
+			if p == relativePath {
+				continue
+			}
+			if info, err := os.Stat(stagedPath(state.ID, p)); err == nil {
+				others += info.Size()
+			}
+		}
+		if left := cfg.MaxSnapshotBytes - others - offset; !limited || left < room {
+			room, limited = left, true
+		}
+	}
+	return room, limited
+}
+
+// stagingLimitError names the limit a file of size bytes would exceed.
+func stagingLimitError(relativePath string, size int64) error {
+	cfg := core.GetConfig()
+	if cfg.MaxFileBytes > 0 && size > cfg.MaxFileBytes {
+		return fmt.Errorf("snapshot too large: file %s exceeds the limit of %d bytes per file", relativePath, cfg.MaxFileBytes)
+	}
+	return fmt.Errorf("snapshot too large: staging %s exceeds the server limit of %d bytes per snapshot", relativePath, cfg.MaxSnapshotBytes)
+}
+
+// load reads a live session. Callers hold the session lock.
+func (s *UploadSessionService) load(sessionID string) (*uploadSessionState, error) {
+	state, err := readUploadSession(sessionID)
+	if err != nil || !s.now().Before(state.ExpiresAt) {
+		return nil, fmt.Errorf("upload session %s not found", sessionID)
+	}
+	return state, nil
+}
+
+// remove deletes the files of a session. Callers hold the session lock.
+func (s *UploadSessionService) remove(sessionID string) error {
+	if err := os.RemoveAll(uploadSessionDir(sessionID)); err != nil {
+		return err
+	}
+	uploadSessionLocks.Lock()
+	delete(uploadSessionLocks.sessions, sessionID)
+	uploadSessionLocks.Unlock()
+	return nil
+}
+
+func isCommitting(sessionID string) bool {
+	uploadSessionLocks.Lock()
+	defer uploadSessionLocks.Unlock()
+	return uploadSessionLocks.committing[sessionID]
+}
+
+func setCommitting(sessionID string, committing bool) {
+	uploadSessionLocks.Lock()
+	defer uploadSessionLocks.Unlock()
+	if committing {
+		uploadSessionLocks.committing[sessionID] = true
+	} else {
+		delete(uploadSessionLocks.committing, sessionID)
+	}
+}
+
+func readUploadSession(sessionID string) (*uploadSessionState, error) {
+	// Session IDs come from requests; anything but a plain name can't be one of ours
+	if sessionID == "" || filepath.Base(sessionID) != sessionID || sessionID == "." || sessionID == ".." {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(filepath.Join(uploadSessionDir(sessionID), uploadSessionRecord))
+	if err != nil {
+		return nil, err
+	}
+	var state uploadSessionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func saveUploadSession(state *uploadSessionState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(uploadSessionDir(state.ID), uploadSessionRecord)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func describeUploadSession(state *uploadSessionState) *UploadSession {
+	session := &UploadSession{
+		ID:         state.ID,
+		CodebaseID: state.CodebaseID,
+		CreatedAt:  state.CreatedAt,
+		ExpiresAt:  state.ExpiresAt,
+		Files:      []UploadSessionFile{},
+	}
+	for _, relativePath := range state.Paths {
+		var received int64
+		if info, err := os.Stat(stagedPath(state.ID, relativePath)); err == nil {
+			received = info.Size()
+		}
+		session.Files = append(session.Files, UploadSessionFile{Path: relativePath, Received: received})
+	}
+	sort.Slice(session.Files, func(i, j int) bool { return session.Files[i].Path < session.Files[j].Path })
+	return session
+}
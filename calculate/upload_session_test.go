@@ -0,0 +1,165 @@
+package calculate
+
+import (
+	"errors"
+	"main/core"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useSessionStorage stages upload sessions in a directory of the test.
+func useSessionStorage(t *testing.T, cfg core.AppConfig) {
+	cfg.StoragePath = t.TempDir()
+	core.SetConfigForTesting(cfg)
+	t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+}
+
+func TestUploadSession(t *testing.T) {
+	_, storage := useMemoryBackends(t)
+	useSessionStorage(t, core.AppConfig{})
+	codebase := mustInitCodebase(t, "session")
+	sessions := &UploadSessionService{uploadService: NewUploadService(), now: time.Now}
+
+	session, err := sessions.Start(codebase.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := strings.Repeat("a large file sent in pieces ", 1000)
+	half := int64(len(big) / 2)
+	if _, err := sessions.WriteFile(session.ID, "dir/big.txt", 0, strings.NewReader(big[:half])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessions.WriteFile(session.ID, "small.txt", 0, strings.NewReader("small")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A piece has to continue where the staged part ends
+	_, err = sessions.WriteFile(session.ID, "dir/big.txt", 10, strings.NewReader(big[10:]))
+	var offsetErr *UploadOffsetError
+	if !errors.As(err, &offsetErr) || offsetErr.Received != half {
+		t.Errorf("piece at a wrong offset = %v, want an UploadOffsetError at %d", err, half)
+	}
+	if file, err := sessions.WriteFile(session.ID, "dir/big.txt", half, strings.NewReader(big[half:])); err != nil || file.Received != int64(len(big)) {
+		t.Fatalf("second piece = %+v, %v", file, err)
+	}
+	// Offset zero starts a file over
+	sessions.WriteFile(session.ID, "small.txt", 0, strings.NewReader("started over"))
+	for _, path := range []string{"", "../escape.txt"} {
+		if _, err := sessions.WriteFile(session.ID, path, 0, strings.NewReader("x")); err == nil || !strings.Contains(err.Error(), "invalid upload") {
+			t.Errorf("staging %q = %v, want it refused", path, err)
+		}
+	}
+
+	got, err := sessions.Get(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []UploadSessionFile{{Path: "dir/big.txt", Received: int64(len(big))}, {Path: "small.txt", Received: 12}}
+	if !reflect.DeepEqual(got.Files, want) {
+		t.Errorf("staged files = %+v, want %+v", got.Files, want)
+	}
+
+	mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"taken.txt": "v1 exists already"})
+	if _, err := sessions.Commit(session.ID, "v1", "main", "", nil, true, SnapshotOptions{}); err == nil {
+		t.Fatal("committing to an existing version succeeded")
+	}
+	if _, err := sessions.Get(session.ID); err != nil {
+		t.Errorf("session after the failed commit: %v, want it kept", err)
+	}
+	resp, err := sessions.Commit(session.ID, "v2", "main", "", nil, true, SnapshotOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantContents := map[string]string{"dir/big.txt": big, "small.txt": "started over"}
+	if got := versionContents(t, storage, codebase.ID)[resp.Version.ID]; !reflect.DeepEqual(got, wantContents) {
+		t.Errorf("committed contents = %v, want %v", got, wantContents)
+	}
+	if _, err := os.Stat(uploadSessionDir(session.ID)); !os.IsNotExist(err) {
+		t.Errorf("session directory after the commit: %v, want it removed", err)
+	}
+	if _, err := sessions.Get(session.ID); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("committed session = %v, want not found", err)
+	}
+
+	aborted, err := sessions.Start(codebase.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions.Abort(aborted.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessions.WriteFile(aborted.ID, "a.txt", 0, strings.NewReader("a")); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("staging in an aborted session = %v, want not found", err)
+	}
+	if _, err := sessions.Start("missing", 0); err == nil {
+		t.Error("started a session for an unknown codebase")
+	}
+}
+
+func TestUploadSessionExpires(t *testing.T) {
+	useMemoryBackends(t)
+	useSessionStorage(t, core.AppConfig{})
+	codebase := mustInitCodebase(t, "expiring")
+	clock := &fakeClock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	sessions := &UploadSessionService{uploadService: NewUploadService(), now: clock.now}
+
+	session, err := sessions.Start(codebase.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every upload moves the expiry ahead
+	clock.t = clock.t.Add(50 * time.Minute)
+	if _, err := sessions.WriteFile(session.ID, "a.txt", 0, strings.NewReader("alpha")); err != nil {
+		t.Fatal(err)
+	}
+	clock.t = clock.t.Add(50 * time.Minute)
+	if purged, err := sessions.PurgeExpired(); err != nil || len(purged) != 0 {
+		t.Fatalf("PurgeExpired before the TTL passed = %v, %v", purged, err)
+	}
+	if _, err := sessions.Get(session.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.t = clock.t.Add(10 * time.Minute)
+	if _, err := sessions.Get(session.ID); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expired session = %v, want not found", err)
+	}
+	if purged, err := sessions.PurgeExpired(); err != nil || !reflect.DeepEqual(purged, []string{session.ID}) {
+		t.Errorf("PurgeExpired = %v, %v, want the session", purged, err)
+	}
+	if _, err := os.Stat(uploadSessionDir(session.ID)); !os.IsNotExist(err) {
+		t.Errorf("purged session directory: %v, want it removed", err)
+	}
+}
+
+// The upload limits apply while staging, and a piece over them leaves the staged part as it was.
+func TestUploadSessionLimits(t *testing.T) {
+	useMemoryBackends(t)
+	useSessionStorage(t, core.AppConfig{MaxFileBytes: 10, MaxSnapshotBytes: 15})
+	codebase := mustInitCodebase(t, "limits")
+	sessions := NewUploadSessionService()
+	session, err := sessions.Start(codebase.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sessions.WriteFile(session.ID, "a.txt", 0, strings.NewReader("0123456")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessions.WriteFile(session.ID, "a.txt", 7, strings.NewReader("7890")); err == nil || !strings.Contains(err.Error(), "per file") {
+		t.Errorf("piece over the file limit = %v", err)
+	}
+	if _, err := sessions.WriteFile(session.ID, "b.txt", 0, strings.NewReader("012345678")); err == nil || !strings.Contains(err.Error(), "per snapshot") {
+		t.Errorf("file over the snapshot limit = %v", err)
+	}
+	got, err := sessions.Get(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []UploadSessionFile{{Path: "a.txt", Received: 7}}; !reflect.DeepEqual(got.Files, want) {
+		t.Errorf("staged files = %+v, want %+v", got.Files, want)
+	}
+}
@@ -0,0 +1,277 @@
+package calculate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"main/core"
+	"mime/multipart"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// The service tests run on the in-memory provider and storage, installed per test by useMemoryBackends,
+// and never touch the config file or a data directory.
+func TestMain(m *testing.M) {
+	core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()})
+	os.Exit(m.Run())
+}
+
+// useMemoryBackends installs an empty memory provider and storage for one test.
+func useMemoryBackends(t testing.TB) (*core.MemoryProvider, *core.MemoryStorage) {
+	t.Helper()
+	provider, storage := core.NewMemoryProvider(), core.NewMemoryStorage()
+	core.SetProvidersForTesting(provider, storage)
+	return provider, storage
+}
+
+// memoryFile is the content of a snapshot file held in memory
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error { return nil }
+
+// snapshotFiles turns path -> content into the files of a snapshot upload.
+func snapshotFiles(contents map[string]string) map[string]*SnapshotFile {
+	files := make(map[string]*SnapshotFile, len(contents))
+	for path, content := range contents {
+		content := content
+		files[path] = &SnapshotFile{Size: int64(len(content)), open: func() (multipart.File, error) {
+			return memoryFile{bytes.NewReader([]byte(content))}, nil
+		}}
+	}
+	return files
+}
+
+func mustInitCodebase(t testing.TB, name string) *core.Codebase {
+	t.Helper()
+	codebase, err := NewInitService().InitializeCodebase(name, "", "main", nil, InitOptions{})
+	if err != nil {
+		t.Fatalf("InitializeCodebase(%s): %v", name, err)
+	}
+	return codebase
+}
+
+func mustSnapshot(t testing.TB, codebaseID, branch, version string, contents map[string]string) *core.SnapshotResponse {
+	t.Helper()
+	resp, err := NewUploadService().ProcessSnapshot(codebaseID, version, branch, "", snapshotFiles(contents), nil, true, SnapshotOptions{})
+	if err != nil {
+		t.Fatalf("ProcessSnapshot(%s/%s): %v", branch, version, err)
+	}
+	return resp
+}
+
+// readStoredFile returns the content of path in a version, read back from storage.
+func readStoredFile(t *testing.T, storage core.Storage, versionID, path string) string {
+	t.Helper()
+	provider := core.GetProvider()
+	version, err := provider.GetVersionByID(versionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := provider.GetFileIndexesByTreeID(version.TreeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.Path != path {
+			continue
+		}
+		r, err := openFileContent(storage, f)
+		if err != nil {
+			t.Fatalf("open %s: %v", path, err)
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("read %s: %v", path, err)
+		}
+		return string(data)
+	}
+	t.Fatalf("%s is not in version %s", path, versionID)
+	return ""
+}
+
+func TestProcessSnapshotStoresAndDeduplicates(t *testing.T) {
+	_, storage := useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "upload")
+
+	first := mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{
+		"a.txt":     "alpha",
+		"dir/b.txt": "beta beta beta beta beta beta beta beta",
+	})
+	if first.Version.Stats.TotalFiles != 2 || first.Version.Stats.UploadedFiles != 2 {
+		t.Errorf("stats of the first snapshot = %+v", first.Version.Stats)
+	}
+	second := mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{
+		"a.txt":     "alpha",
+		"dir/b.txt": "changed",
+	})
+	if second.Version.Stats.ReusedFiles != 1 {
+		t.Errorf("unchanged a.txt was not reused: %+v", second.Version.Stats)
+	}
+
+	for _, check := range []struct{ versionID, path, want string }{
+		{first.Version.ID, "a.txt", "alpha"},
+		{first.Version.ID, "dir/b.txt", "beta beta beta beta beta beta beta beta"},
+		{second.Version.ID, "dir/b.txt", "changed"},
+	} {
+		if got := readStoredFile(t, storage, check.versionID, check.path); got != check.want {
+			t.Errorf("%s in %s = %q, want %q", check.path, check.versionID, got, check.want)
+		}
+	}
+
+	latest, err := core.GetProvider().FindLatestVersionInBranch(codebase.ID, "main", "")
+	if err != nil || latest == nil || latest.ID != second.Version.ID {
+		t.Errorf("latest version on main = %v, %v, want v2", latest, err)
+	}
+	if _, err := NewUploadService().ProcessSnapshot(codebase.ID, "v2", "main", "", snapshotFiles(map[string]string{"a.txt": "x"}), nil, true, SnapshotOptions{}); err == nil {
+		t.Error("a second v2 on main was accepted")
+	}
+}
+
+func TestProcessSnapshotRejectsUnknownCodebase(t *testing.T) {
+	useMemoryBackends(t)
+	if _, err := NewUploadService().ProcessSnapshot("missing", "v1", "main", "", snapshotFiles(map[string]string{"a.txt": "a"}), nil, true, SnapshotOptions{}); err == nil {
+		t.Error("snapshot of an unknown codebase was accepted")
+	}
+}
+
+// A snapshot of a branch and version that already exist is rejected unless it overwrites the old
+// version, which then goes with its tree and edges.
+func TestProcessSnapshotDuplicateVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		overwrite bool
+	}{
+		{"reject", false},
+		{"overwrite", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, storage := useMemoryBackends(t)
+			codebase := mustInitCodebase(t, "duplicate")
+			v1 := mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"a.txt": "one"})
+			old := mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{"a.txt": "two", "b.txt": "only in the old v2"})
+			oldKeys := fileKeys(t, old.Version.ID)
+
+			resp, err := NewUploadService().ProcessSnapshot(codebase.ID, "v2", "main", "", snapshotFiles(map[string]string{"a.txt": "three"}), nil, true, SnapshotOptions{Overwrite: tt.overwrite})
+			if !tt.overwrite {
+				var existsErr *core.VersionExistsError
+				if !errors.As(err, &existsErr) || existsErr.VersionID != old.Version.ID {
+					t.Fatalf("duplicate snapshot = %v, want a VersionExistsError naming %s", err, old.Version.ID)
+				}
+				if got, err := provider.GetVersion(codebase.ID, "main", "v2"); err != nil || got.ID != old.Version.ID {
+					t.Errorf("v2 after the rejected snapshot = %v, %v, want the old version", got, err)
+				}
+				if got := readStoredFile(t, storage, old.Version.ID, "b.txt"); got != "only in the old v2" {
+					t.Errorf("b.txt of the old v2 = %q", got)
+				}
+				if versions, _ := provider.ListVersions(codebase.ID); len(versions) != 2 {
+					t.Errorf("%d versions after the rejected snapshot, want 2", len(versions))
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.ReplacedVersionID != old.Version.ID {
+				t.Errorf("ReplacedVersionID = %q, want %s", resp.ReplacedVersionID, old.Version.ID)
+			}
+			if got, err := provider.GetVersion(codebase.ID, "main", "v2"); err != nil || got.ID != resp.Version.ID {
+				t.Errorf("v2 after overwriting = %v, %v, want the new version", got, err)
+			}
+			if _, err := provider.GetVersionByID(old.Version.ID); err == nil {
+				t.Error("the overwritten version is still stored")
+			}
+			if _, err := provider.GetFileIndexesByTreeID(old.Version.TreeID); err == nil {
+				t.Error("the tree of the overwritten version is still stored")
+			}
+			if counts, _ := provider.BlobRefCounts([]string{oldKeys["b.txt"]}); counts[oldKeys["b.txt"]] != 0 {
+				t.Errorf("b.txt of the overwritten version is still referenced %d times", counts[oldKeys["b.txt"]])
+			}
+			if got := readStoredFile(t, storage, resp.Version.ID, "a.txt"); got != "three" {
+				t.Errorf("a.txt of the new v2 = %q", got)
+			}
+			edges, err := provider.GetAllVersionEdgesForMap(codebase.ID)
+			if err != nil || len(edges) != 1 || edges[0].From != v1.Version.ID || edges[0].To != resp.Version.ID {
+				t.Errorf("edges after overwriting = %+v, %v, want only v1 -> the new v2", edges, err)
+			}
+		})
+	}
+}
+
+// goroutinePeak records the largest number of goroutines seen at the points sample is called from.
+type goroutinePeak struct {
+	mu   sync.Mutex
+	peak int
+}
+
+func (g *goroutinePeak) sample() {
+	n := runtime.NumGoroutine()
+	g.mu.Lock()
+	g.peak = max(g.peak, n)
+	g.mu.Unlock()
+}
+
+// samplingStorage samples the goroutines whenever an object is read
+type samplingStorage struct {
+	*core.MemoryStorage
+	peak *goroutinePeak
+}
+
+func (s *samplingStorage) GetObjectStream(name string) (io.ReadCloser, error) {
+	s.peak.sample()
+	return s.MemoryStorage.GetObjectStream(name)
+}
+
+// Thousands of tiny files are stored and archived by the worker pool, not by a goroutine each.
+func TestSnapshotAndArchiveGoroutinesBounded(t *testing.T) {
+	const workers, fileCount = 4, 3000
+	core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), FileWorkers: workers})
+	t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+	provider, memory := useMemoryBackends(t)
+	peak := &goroutinePeak{}
+	core.SetProvidersForTesting(provider, &samplingStorage{MemoryStorage: memory, peak: peak})
+	codebase := mustInitCodebase(t, "stress")
+
+	files := make(map[string]*SnapshotFile, fileCount)
+	for i := 0; i < fileCount; i++ {
+		content := []byte(fmt.Sprintf("file %d", i))
+		files[fmt.Sprintf("d%02d/f%04d.txt", i%50, i)] = &SnapshotFile{Size: int64(len(content)), open: func() (multipart.File, error) {
+			peak.sample()
+			return memoryFile{bytes.NewReader(content)}, nil
+		}}
+	}
+	// Goroutines left over from earlier tests, e.g. timers, plus a few of the snapshot itself
+	limit := runtime.NumGoroutine() + workers + 10
+
+	resp, err := NewUploadService().ProcessSnapshot(codebase.ID, "v1", "main", "", files, nil, true, SnapshotOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Version.Stats.TotalFiles != fileCount {
+		t.Fatalf("TotalFiles = %d, want %d", resp.Version.Stats.TotalFiles, fileCount)
+	}
+	if peak.peak > limit {
+		t.Errorf("the snapshot ran %d goroutines, want at most %d with %d workers", peak.peak, limit, workers)
+	}
+
+	peak.peak = 0
+	archives := NewArchiveService()
+	archive, err := archives.PrepareArchive(codebase.ID, "main", "v1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := archives.WriteArchive(io.Discard, archive, ArchiveZip, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if peak.peak == 0 || peak.peak > limit {
+		t.Errorf("the archive ran %d goroutines, want at most %d with %d workers", peak.peak, limit, workers)
+	}
+}
@@ -0,0 +1,201 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"sync"
+	"time"
+)
+
+// storedBytesForCodebase sums the stored size of every distinct object referenced by a codebase's trees.
+// Identical content shares a storage key, so each key is only counted once.
+func storedBytesForCodebase(provider core.DataProvider, codebaseID string) (int64, error) {
+	versions, err := provider.ListVersions(codebaseID)
+	if err != nil {
+		return 0, err
+	}
+	seen := make(map[string]bool)
+	var total int64
+	for _, v := range versions {
+		files, err := provider.GetFileIndexesByTreeID(v.TreeID)
+		if err != nil {
+			return 0, fmt.Errorf("file index for version %s not found: %w", v.ID, err)
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			if len(f.Chunks) > 0 {
+				for _, c := range f.Chunks {
+					if !seen[c.StorageKey] {
+						seen[c.StorageKey] = true
+						total += c.CompressedSize
+					}
+				}
+				continue
+			}
+			if seen[f.StorageKey] {
+				continue
+			}
+			seen[f.StorageKey] = true
+			total += f.CompressedSize
+		}
+	}
+	return total, nil
+}
+
+// storageKeysForCodebase returns every storage key referenced by a codebase's trees.
+func storageKeysForCodebase(provider core.DataProvider, codebaseID string) (map[string]bool, error) {
+	versions, err := provider.ListVersions(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	for _, v := range versions {
+		files, err := provider.GetFileIndexesByTreeID(v.TreeID)
+		if err != nil {
+			return nil, fmt.Errorf("file index for version %s not found: %w", v.ID, err)
+		}
+		for _, f := range files {
+			for _, key := range f.StorageKeys() {
+				keys[key] = true
+			}
+		}
+	}
+	return keys, nil
+}
+
+// UsageFigures are the storage figures of a set of versions. Objects shared between versions are counted once.
+type UsageFigures struct {
+	Versions           int   `json:"versions"`
+	FileEntries        int   `json:"file_entries"`         // files summed over every version
+	LogicalBytes       int64 `json:"logical_bytes"`        // original size summed over every version, what downloads would transfer
+	UniqueBlobs        int   `json:"unique_blobs"`         // distinct storage keys
+	UniqueLogicalBytes int64 `json:"unique_logical_bytes"` // original size of the distinct objects
+	StoredBytes        int64 `json:"stored_bytes"`         // stored size of the distinct objects, what the codebase occupies on disk
+}
+
+// CodebaseUsage is the storage usage of a codebase with a breakdown per branch
+type CodebaseUsage struct {
+	CodebaseID string                   `json:"codebase_id"`
+	Total      UsageFigures             `json:"total"`
+	Branches   map[string]*UsageFigures `json:"branches"` // objects shared by several branches count for each of them
+	ComputedAt time.Time                `json:"computed_at"`
+	Cached     bool                     `json:"cached"`
+}
+
+// usageAccumulator counts each storage key once while summing per-version figures
+type usageAccumulator struct {
+	figures UsageFigures
+	seen    map[string]bool
+}
+
+func newUsageAccumulator() *usageAccumulator {
+	return &usageAccumulator{seen: make(map[string]bool)}
+}
+
+func (a *usageAccumulator) addVersion(files []core.File) {
+	a.figures.Versions++
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		a.figures.FileEntries++
+		a.figures.LogicalBytes += f.Size
+		if len(f.Chunks) == 0 {
+			a.addObject(f.StorageKey, f.Size, f.CompressedSize)
+			continue
+		}
+		for _, c := range f.Chunks {
+			a.addObject(c.StorageKey, c.Size, c.CompressedSize)
+		}
+	}
+}
+
+func (a *usageAccumulator) addObject(key string, size, stored int64) {
+	if a.seen[key] {
+		return
+	}
+	a.seen[key] = true
+	a.figures.UniqueBlobs++
+	a.figures.StoredBytes += stored
+	a.figures.UniqueLogicalBytes += size
+}
+
+// usageCache keeps computed usage per codebase together with the version count and newest
+// version it was computed from, so stale entries are recomputed without an explicit refresh
+var usageCache = struct {
+	sync.Mutex
+	entries map[string]usageCacheEntry
+}{entries: make(map[string]usageCacheEntry)}
+
+type usageCacheEntry struct {
+	usage    CodebaseUsage
+	versions int
+	newestID string
+}
+
+// UsageService reports how much storage codebases consume
+type UsageService struct {
+	now func() time.Time
+}
+
+func NewUsageService() *UsageService {
+	return &UsageService{now: time.Now}
+}
+
+// GetCodebaseUsage walks the file indexes of every version of a codebase. Results are cached until
+// versions are added or removed; refresh forces a recomputation.
+func (s *UsageService) GetCodebaseUsage(codebaseID string, refresh bool) (*CodebaseUsage, error) {
+	provider := core.GetProvider()
+	if _, err := getActiveCodebase(provider, codebaseID); err != nil {
+		return nil, err
+	}
+	versions, err := provider.ListVersions(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	newestID := ""
+	if len(versions) > 0 {
+		newestID = versions[0].ID
+	}
+
+	usageCache.Lock()
+	entry, ok := usageCache.entries[codebaseID]
+	usageCache.Unlock()
+	if ok && !refresh && entry.versions == len(versions) && entry.newestID == newestID {
+		usage := entry.usage
+		usage.Cached = true
+		return &usage, nil
+	}
+
+	total := newUsageAccumulator()
+	branches := make(map[string]*usageAccumulator)
+	for _, v := range versions {
+		files, err := provider.GetFileIndexesByTreeID(v.TreeID)
+		if err != nil {
+			return nil, fmt.Errorf("file index for version %s not found: %w", v.ID, err)
+		}
+		total.addVersion(files)
+		if branches[v.Branch] == nil {
+			branches[v.Branch] = newUsageAccumulator()
+		}
+		branches[v.Branch].addVersion(files)
+	}
+
+	usage := CodebaseUsage{
+		CodebaseID: codebaseID,
+		Total:      total.figures,
+		Branches:   make(map[string]*UsageFigures, len(branches)),
+		ComputedAt: s.now(),
+	}
+	for branch, acc := range branches {
+		figures := acc.figures
+		usage.Branches[branch] = &figures
+	}
+
+	usageCache.Lock()
+	usageCache.entries[codebaseID] = usageCacheEntry{usage: usage, versions: len(versions), newestID: newestID}
+	usageCache.Unlock()
+	return &usage, nil
+}
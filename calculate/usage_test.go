@@ -0,0 +1,68 @@
+package calculate
+
+import (
+	"main/core"
+	"testing"
+)
+
+func TestGetCodebaseUsage(t *testing.T) {
+	_, storage := useMemoryBackends(t)
+	codebase := mustInitCodebase(t, "usage")
+	v1 := mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"shared.txt": "in every version", "own.txt": "one"})
+	v2 := mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{"shared.txt": "in every version", "own.txt": "two"})
+	mustSnapshot(t, codebase.ID, "dev", "d1", map[string]string{"shared.txt": "in every version"})
+
+	// Each distinct object counts once, however many versions reference it
+	distinct := make(map[string]bool)
+	for _, resp := range []*core.SnapshotResponse{v1, v2} {
+		for _, key := range fileKeys(t, resp.Version.ID) {
+			distinct[key] = true
+		}
+	}
+	var stored int64
+	for key := range distinct {
+		info, err := storage.StatObject(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored += info.Size
+	}
+
+	service := NewUsageService()
+	usage, err := service.GetCodebaseUsage(codebase.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := int64(len("in every version"))
+	want := UsageFigures{
+		Versions:           3,
+		FileEntries:        5,
+		LogicalBytes:       3*shared + 6,
+		UniqueBlobs:        3,
+		UniqueLogicalBytes: shared + 6,
+		StoredBytes:        stored,
+	}
+	if usage.Total != want || usage.Cached {
+		t.Errorf("total = %+v, cached %v, want %+v computed", usage.Total, usage.Cached, want)
+	}
+	if main := usage.Branches["main"]; main == nil || main.Versions != 2 || main.UniqueBlobs != 3 || main.LogicalBytes != 2*shared+6 {
+		t.Errorf("main = %+v", main)
+	}
+	if dev := usage.Branches["dev"]; dev == nil || dev.Versions != 1 || dev.UniqueBlobs != 1 || dev.UniqueLogicalBytes != shared {
+		t.Errorf("dev = %+v, want the shared object counted for dev too", dev)
+	}
+
+	if again, err := service.GetCodebaseUsage(codebase.ID, false); err != nil || !again.Cached || again.Total != want {
+		t.Errorf("second request = %+v, %v, want the cached figures", again, err)
+	}
+	if refreshed, err := service.GetCodebaseUsage(codebase.ID, true); err != nil || refreshed.Cached {
+		t.Errorf("refresh = %+v, %v, want recomputed figures", refreshed, err)
+	}
+
+	// A new version makes the cached figures stale
+	mustSnapshot(t, codebase.ID, "main", "v3", map[string]string{"shared.txt": "in every version", "own.txt": "three"})
+	usage, err = service.GetCodebaseUsage(codebase.ID, false)
+	if err != nil || usage.Cached || usage.Total.Versions != 4 || usage.Total.UniqueBlobs != 4 {
+		t.Errorf("usage after a new version = %+v, %v, want it recomputed", usage, err)
+	}
+}
@@ -0,0 +1,55 @@
+package calculate
+
+import (
+	"fmt"
+	"log"
+	"main/core"
+)
+
+// VersionFlags changes the lock and pin state of a version; nil leaves a flag as it is.
+type VersionFlags struct {
+	Locked *bool
+	Pinned *bool
+}
+
+// SetVersionFlags locks or pins the version addressed by sel and returns it with its new state. Locked
+// versions can't be deleted or overwritten, pinned versions are kept by automatic cleanup. The history
+// cache is rebuilt so the map shows the new state.
+func (s *HistoryService) SetVersionFlags(codebaseID string, sel VersionSelector, flags VersionFlags) (*core.Version, error) {
+	provider := core.GetProvider()
+	if _, err := getActiveCodebase(provider, codebaseID); err != nil {
+		return nil, err
+	}
+	v, err := locateVersion(provider, codebaseID, sel)
+	if err != nil {
+		return nil, err
+	}
+	locked, pinned := v.Locked, v.Pinned
+	if flags.Locked != nil {
+		locked = *flags.Locked
+	}
+	if flags.Pinned != nil {
+		pinned = *flags.Pinned
+	}
+	if locked == v.Locked && pinned == v.Pinned {
+		return v, nil
+	}
+	if err := provider.SetVersionFlags(v.ID, locked, pinned); err != nil {
+		return nil, err
+	}
+	v.Locked, v.Pinned = locked, pinned
+
+	if _, err := s.RebuildHistoryCache(codebaseID); err != nil {
+		log.Printf("Failed to rebuild history cache after changing the flags of version %s: %v", v.ID, err)
+	}
+	log.Printf("Version flags changed: codebase=%s, version=%s/%s, locked=%t, pinned=%t", codebaseID, v.Branch, v.Version, locked, pinned)
+	return v, nil
+}
+
+// checkUnlocked refuses to remove or replace a locked version; action prefixes the error, e.g. "delete".
+func checkUnlocked(action string, v *core.Version) error {
+	if v.Locked {
+		return fmt.Errorf("invalid %s: version %s/%s is locked", action, v.Branch, v.Version)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package calculate
+
+import (
+	"main/core"
+	"sort"
+)
+
+// VersionParent is one parent of a version in the lineage graph
+type VersionParent struct {
+	VersionID   string           `json:"version_id"`
+	Branch      string           `json:"branch"`
+	Version     string           `json:"version"`
+	LinkageType core.LinkageType `json:"linkage_type"`
+}
+
+// VersionDetails is a version record together with its parents
+type VersionDetails struct {
+	*core.Version
+	Parents []VersionParent `json:"parents"`
+}
+
+// GetVersionDetails returns the version addressed by branch and label, tag or version ID, with its parents.
+func (s *HistoryService) GetVersionDetails(codebaseID string, sel VersionSelector) (*VersionDetails, error) {
+	provider := core.GetProvider()
+	if _, err := getActiveCodebase(provider, codebaseID); err != nil {
+		return nil, err
+	}
+	v, err := locateVersion(provider, codebaseID, sel)
+	if err != nil {
+		return nil, err
+	}
+	edges, err := provider.GetAllVersionEdgesForMap(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+
+	details := &VersionDetails{Version: v, Parents: []VersionParent{}}
+	for _, e := range edges {
+		if e.To != v.ID {
+			continue
+		}
+		parent := VersionParent{VersionID: e.From, LinkageType: e.LinkageType}
+		if pv, err := provider.GetVersionByID(e.From); err == nil {
+			parent.Branch, parent.Version = pv.Branch, pv.Version
+		}
+		details.Parents = append(details.Parents, parent)
+	}
+	sort.Slice(details.Parents, func(i, j int) bool { return details.Parents[i].VersionID < details.Parents[j].VersionID })
+	return details, nil
+}
@@ -0,0 +1,63 @@
+package calculate
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestGetVersionDetails(t *testing.T) {
+	useMemoryBackends(t)
+	codebase, other := mustInitCodebase(t, "details"), mustInitCodebase(t, "other")
+	v1 := mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"a.txt": "1"})
+	f1 := mustSnapshot(t, codebase.ID, "feature", "f1", map[string]string{"a.txt": "feature"})
+	v2 := mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{"a.txt": "merged"})
+	foreign := mustSnapshot(t, other.ID, "main", "v1", map[string]string{"a.txt": "other"})
+	history := NewHistoryService()
+	if err := history.CreateVersionLink(codebase.ID, VersionIdentifier{Branch: "main", Version: "v2"}, VersionIdentifier{Branch: "feature", Version: "f1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	byID, err := history.GetVersionDetails(codebase.ID, VersionSelector{VersionID: v2.Version.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName, err := history.GetVersionDetails(codebase.ID, VersionSelector{Branch: "main", Version: "v2"})
+	if err != nil || !reflect.DeepEqual(byID, byName) {
+		t.Errorf("main/v2 = %+v, %v, want the same details as by ID %+v", byName, err, byID)
+	}
+	parents := make(map[string]string)
+	for _, p := range byID.Parents {
+		parents[p.VersionID] = p.Branch + "/" + p.Version
+	}
+	wantParents := map[string]string{v1.Version.ID: "main/v1", f1.Version.ID: "feature/f1"}
+	if byID.Version.Version != "v2" || !reflect.DeepEqual(parents, wantParents) || !sort.SliceIsSorted(byID.Parents, func(i, j int) bool {
+		return byID.Parents[i].VersionID < byID.Parents[j].VersionID
+	}) {
+		t.Errorf("details of v2 = %+v with parents %+v, want v1 and f1 sorted by ID", byID.Version, byID.Parents)
+	}
+	if root, err := history.GetVersionDetails(codebase.ID, VersionSelector{VersionID: v1.Version.ID}); err != nil || len(root.Parents) != 0 || root.Parents == nil {
+		t.Errorf("details of v1 = %+v, %v, want an empty parent list", root, err)
+	}
+
+	for _, tt := range []struct {
+		sel     VersionSelector
+		wantErr string
+	}{
+		// A version of another codebase isn't found through this one
+		{VersionSelector{VersionID: foreign.Version.ID}, "not found"},
+		{VersionSelector{VersionID: "missing"}, "not found"},
+		{VersionSelector{VersionID: v1.Version.ID, Branch: "main", Version: "v1"}, "invalid version selector"},
+		{VersionSelector{Branch: "main"}, "invalid version selector"},
+	} {
+		if _, err := history.GetVersionDetails(codebase.ID, tt.sel); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("selector %+v = %v, want an error containing %q", tt.sel, err, tt.wantErr)
+		}
+	}
+
+	// Endpoints taking branch and label accept a version ID through LocateVersion
+	if id, err := LocateVersion(codebase.ID, VersionSelector{VersionID: f1.Version.ID}); err != nil || id != (VersionIdentifier{Branch: "feature", Version: "f1"}) {
+		t.Errorf("LocateVersion by ID = %+v, %v", id, err)
+	}
+}
@@ -0,0 +1,116 @@
+package calculate
+
+import (
+	"fmt"
+	"main/core"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshots uploaded without a version name are named after the latest version of their branch: "v7"
+// is followed by "v8", an empty branch starts at "v1". The prefix is configurable with
+// version_name_prefix. When the latest name doesn't end in a number after the prefix, the name falls
+// back to the prefix followed by the UTC time, e.g. "v-20260102-150405".
+
+// defaultVersionNamePrefix precedes the number of generated version names
+const defaultVersionNamePrefix = "v"
+
+// codebaseLocks serializes work that must see a consistent codebase, such as reserving version names.
+// A lock is dropped once nobody holds or waits for it and it has no reservations left.
+var codebaseLocks = struct {
+	sync.Mutex
+	codebases map[string]*codebaseLock
+}{codebases: make(map[string]*codebaseLock)}
+
+type codebaseLock struct {
+	sync.Mutex
+	users    int             // holders and waiters, counted under codebaseLocks
+	reserved map[string]bool // generated "<branch>\x00<version>" names whose snapshot isn't saved yet
+}
+
+// lockCodebase takes the per-codebase lock and returns it with the function releasing it.
+func lockCodebase(codebaseID string) (*codebaseLock, func()) {
+	codebaseLocks.Lock()
+	l, ok := codebaseLocks.codebases[codebaseID]
+	if !ok {
+		l = &codebaseLock{reserved: make(map[string]bool)}
+		codebaseLocks.codebases[codebaseID] = l
+	}
+	l.users++
+	codebaseLocks.Unlock()
+	l.Lock()
+	return l, func() {
+		// Still holding l, so nobody can add a reservation after the check
+		codebaseLocks.Lock()
+		if l.users--; l.users == 0 && len(l.reserved) == 0 {
+			delete(codebaseLocks.codebases, codebaseID)
+		}
+		codebaseLocks.Unlock()
+		l.Unlock()
+	}
+}
+
+// reserveVersionName generates the name of a snapshot uploaded without one and keeps other snapshots of
+// the codebase from generating it until release is called, once the version is saved or has failed.
+func reserveVersionName(provider core.DataProvider, codebaseID, branch string) (string, func(), error) {
+	l, unlock := lockCodebase(codebaseID)
+	defer unlock()
+
+	latest, err := provider.FindLatestVersionInBranch(codebaseID, branch, "")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to find the latest version of branch %s: %w", branch, err)
+	}
+	taken := func(name string) bool {
+		if l.reserved[branch+"\x00"+name] {
+			return true
+		}
+		_, err := provider.GetVersion(codebaseID, branch, name)
+		return err == nil
+	}
+
+	prefix := versionNamePrefix()
+	var name string
+	if n, ok := versionNumber(latest, prefix); ok {
+		for n++; taken(prefix + strconv.Itoa(n)); n++ {
+		}
+		name = prefix + strconv.Itoa(n)
+	} else {
+		stamp := prefix + "-" + time.Now().UTC().Format("20060102-150405")
+		name = stamp
+		for i := 2; taken(name); i++ {
+			name = fmt.Sprintf("%s-%d", stamp, i)
+		}
+	}
+
+	key := branch + "\x00" + name
+	l.reserved[key] = true
+	release := func() {
+		// The lock isn't dropped while it holds the reservation, so this is l again
+		l, unlock := lockCodebase(codebaseID)
+		delete(l.reserved, key)
+		unlock()
+	}
+	return name, release, nil
+}
+
+// versionNumber returns N for a latest version named "<prefix>N", and 0 for an empty branch.
+func versionNumber(latest *core.Version, prefix string) (int, bool) {
+	if latest == nil {
+		return 0, true
+	}
+	digits, ok := strings.CutPrefix(latest.Version, prefix)
+	if !ok || digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(digits)
+	return n, err == nil
+}
+
+func versionNamePrefix() string {
+	if prefix := core.GetConfig().VersionNamePrefix; prefix != "" {
+		return prefix
+	}
+	return defaultVersionNamePrefix
+}
@@ -0,0 +1,288 @@
+package calculate
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/core"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultWarmupConcurrency = 2
+
+// Cache freshness states reported by the warm-up
+const (
+	CacheStatePending = "pending"
+	CacheStateFresh   = "fresh"
+	CacheStateStale   = "stale"
+	CacheStateMissing = "missing"
+	CacheStateRebuilt = "rebuilt"
+	CacheStateFailed  = "failed"
+)
+
+// CacheFreshness describes what the warm-up found for one codebase's history cache
+type CacheFreshness struct {
+	CodebaseID string     `json:"codebase_id"`
+	Pinned     bool       `json:"pinned,omitempty"`
+	Found      string     `json:"found,omitempty"` // state before any rebuild: fresh, stale or missing
+	State      string     `json:"state"`
+	Nodes      int        `json:"nodes"`
+	Edges      int        `json:"edges"`
+	Generation int64      `json:"generation,omitempty"`
+	CheckedAt  *time.Time `json:"checked_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// WarmupStatus reports the progress of the most recent history cache warm-up
+type WarmupStatus struct {
+	Running    bool             `json:"running"`
+	StartedAt  *time.Time       `json:"started_at,omitempty"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+	Total      int              `json:"total"`
+	Completed  int              `json:"completed"`
+	Rebuilt    int              `json:"rebuilt"`
+	Pinned     []string         `json:"pinned"`
+	Codebases  []CacheFreshness `json:"codebases"`
+}
+
+// pinnedHistory keeps the serialized history of pinned codebases in memory. Entries belong to
+// the provider they were built from and are ignored once the providers are reinitialized.
+var pinnedHistory = struct {
+	sync.RWMutex
+	provider core.DataProvider
+	entries  map[string][]byte
+}{entries: make(map[string][]byte)}
+
+// isPinned reports whether the configuration pins the codebase's history cache in memory.
+func isPinned(codebaseID string) bool {
+	for _, id := range core.GetConfig().PinnedCodebases {
+		if id == codebaseID {
+			return true
+		}
+	}
+	return false
+}
+
+// getPinnedHistory returns the in-memory history of a pinned codebase, nil if not held.
+func getPinnedHistory(provider core.DataProvider, codebaseID string) []byte {
+	pinnedHistory.RLock()
+	defer pinnedHistory.RUnlock()
+	if pinnedHistory.provider != provider {
+		return nil
+	}
+	return pinnedHistory.entries[codebaseID]
+}
+
+// storePinnedHistory records a freshly written cache if the codebase is pinned.
+func storePinnedHistory(provider core.DataProvider, codebaseID string, historyJSON []byte) {
+	if !isPinned(codebaseID) {
+		return
+	}
+	pinnedHistory.Lock()
+	defer pinnedHistory.Unlock()
+	if pinnedHistory.provider != provider {
+		pinnedHistory.provider = provider
+		pinnedHistory.entries = make(map[string][]byte)
+	}
+	pinnedHistory.entries[codebaseID] = historyJSON
+}
+
+// dropPinnedHistory forgets the in-memory history of a codebase.
+func dropPinnedHistory(codebaseID string) {
+	pinnedHistory.Lock()
+	delete(pinnedHistory.entries, codebaseID)
+	pinnedHistory.Unlock()
+}
+
+// WarmupService validates and rebuilds history caches ahead of the first map request
+type WarmupService struct {
+	historyService *HistoryService
+}
+
+func NewWarmupService() *WarmupService {
+	return &WarmupService{
+		historyService: NewHistoryService(),
+	}
+}
+
+var warmup = struct {
+	sync.Mutex
+	status WarmupStatus
+}{status: WarmupStatus{Pinned: []string{}, Codebases: []CacheFreshness{}}}
+
+// Status returns the progress of the current or last warm-up.
+func (s *WarmupService) Status() WarmupStatus {
+	warmup.Lock()
+	defer warmup.Unlock()
+	status := warmup.status
+	status.Pinned = append([]string{}, warmup.status.Pinned...)
+	status.Codebases = append([]CacheFreshness{}, warmup.status.Codebases...)
+	return status
+}
+
+// Start runs a warm-up in the background. It returns false if one is already running.
+func (s *WarmupService) Start() bool {
+	warmup.Lock()
+	if warmup.status.Running {
+		warmup.Unlock()
+		return false
+	}
+	startedAt := time.Now()
+	warmup.status = WarmupStatus{Running: true, StartedAt: &startedAt, Pinned: []string{}, Codebases: []CacheFreshness{}}
+	warmup.Unlock()
+
+	go func() {
+		if err := s.run(); err != nil {
+			log.Printf("History cache warm-up failed: %v", err)
+		}
+	}()
+	return true
+}
+
+// run checks every active codebase, pinned ones first, with bounded parallelism.
+func (s *WarmupService) run() error {
+	defer func() {
+		warmup.Lock()
+		finishedAt := time.Now()
+		warmup.status.Running = false
+		warmup.status.FinishedAt = &finishedAt
+		warmup.Unlock()
+	}()
+
+	provider := core.GetProvider()
+	codebases, err := provider.ListCodebases()
+	if err != nil {
+		return err
+	}
+
+	var entries []CacheFreshness
+	for _, c := range codebases {
+		if c.TrashedAt != nil || c.Ephemeral {
+			continue
+		}
+		entries = append(entries, CacheFreshness{CodebaseID: c.ID, Pinned: isPinned(c.ID), State: CacheStatePending})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Pinned && !entries[j].Pinned })
+
+	warmup.Lock()
+	warmup.status.Total = len(entries)
+	warmup.status.Codebases = entries
+	for _, e := range entries {
+		if e.Pinned {
+			warmup.status.Pinned = append(warmup.status.Pinned, e.CodebaseID)
+		}
+	}
+	warmup.Unlock()
+
+	concurrency := core.GetConfig().WarmupConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultWarmupConcurrency
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range entries {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, entry CacheFreshness) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			result := s.warmCodebase(provider, entry)
+
+			warmup.Lock()
+			warmup.status.Codebases[i] = result
+			warmup.status.Completed++
+			if result.State == CacheStateRebuilt {
+				warmup.status.Rebuilt++
+			}
+			warmup.Unlock()
+		}(i, entries[i])
+	}
+	wg.Wait()
+
+	status := s.Status()
+	log.Printf("History cache warm-up finished: %d codebases checked, %d rebuilt", status.Completed, status.Rebuilt)
+	return nil
+}
+
+// warmCodebase validates one cache against the current node and edge counts and rebuilds it
+// when stale. Pinned caches are always rebuilt so they can be held in memory.
+func (s *WarmupService) warmCodebase(provider core.DataProvider, entry CacheFreshness) CacheFreshness {
+	checkedAt := time.Now()
+	entry.CheckedAt = &checkedAt
+
+	found, err := checkHistoryCache(provider, entry.CodebaseID)
+	if err != nil {
+		entry.State = CacheStateFailed
+		entry.Error = err.Error()
+		return entry
+	}
+	entry.Found = found
+	if found == CacheStateFresh && !entry.Pinned {
+		entry.State = CacheStateFresh
+		s.fillCounts(provider, &entry)
+		return entry
+	}
+
+	err = BackgroundJobs().Run("warm-history-cache "+entry.CodebaseID, func(throttle *IOThrottle) error {
+		_, err := s.historyService.rebuildHistoryCache(entry.CodebaseID, throttle)
+		return err
+	})
+	if err != nil {
+		entry.State = CacheStateFailed
+		entry.Error = err.Error()
+		return entry
+	}
+	entry.State = CacheStateRebuilt
+	s.fillCounts(provider, &entry)
+	return entry
+}
+
+// fillCounts copies the node, edge and generation numbers of the stored cache into entry.
+func (s *WarmupService) fillCounts(provider core.DataProvider, entry *CacheFreshness) {
+	data, err := provider.GetHistoryCache(entry.CodebaseID)
+	if err != nil {
+		return
+	}
+	var m core.VersionMapResponse
+	if json.Unmarshal(data, &m) != nil {
+		return
+	}
+	entry.Nodes = len(m.Nodes)
+	entry.Edges = len(m.Edges)
+	entry.Generation = m.Generation
+}
+
+// checkHistoryCache compares a stored cache with the current number of versions and links and the default branch.
+func checkHistoryCache(provider core.DataProvider, codebaseID string) (string, error) {
+	data, err := provider.GetHistoryCache(codebaseID)
+	if err != nil {
+		return CacheStateMissing, nil
+	}
+	var cached core.VersionMapResponse
+	if json.Unmarshal(data, &cached) != nil {
+		return CacheStateMissing, nil
+	}
+	// Caches of an older format lack fields of the nodes
+	if cached.CacheFormat < historyCacheFormat {
+		return CacheStateStale, nil
+	}
+
+	nodes, err := provider.GetAllVersionsForMap(codebaseID)
+	if err != nil {
+		return "", fmt.Errorf("node query failed: %w", err)
+	}
+	edges, err := provider.GetAllVersionEdgesForMap(codebaseID)
+	if err != nil {
+		return "", fmt.Errorf("edge query failed: %w", err)
+	}
+	if len(cached.Nodes) != len(nodes) || len(cached.Edges) != len(edges) {
+		return CacheStateStale, nil
+	}
+	// Caches written before the default branch was recorded, or before it changed
+	if codebase, err := provider.GetCodebaseByID(codebaseID); err == nil && cached.DefaultBranch != defaultBranchOf(codebase) {
+		return CacheStateStale, nil
+	}
+	return CacheStateFresh, nil
+}
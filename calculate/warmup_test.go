@@ -0,0 +1,105 @@
+package calculate
+
+import (
+	"main/core"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// cacheCountingProvider counts history cache reads and writes per codebase
+type cacheCountingProvider struct {
+	core.DataProvider
+	mu     sync.Mutex
+	reads  map[string]int
+	writes map[string]int
+}
+
+func (p *cacheCountingProvider) GetHistoryCache(codebaseID string) ([]byte, error) {
+	p.mu.Lock()
+	p.reads[codebaseID]++
+	p.mu.Unlock()
+	return p.DataProvider.GetHistoryCache(codebaseID)
+}
+
+func (p *cacheCountingProvider) UpdateHistoryCache(codebaseID string, data []byte) error {
+	p.mu.Lock()
+	p.writes[codebaseID]++
+	p.mu.Unlock()
+	return p.DataProvider.UpdateHistoryCache(codebaseID, data)
+}
+
+// After a restart with a deleted and a stale cache file, the warm-up rebuilds both and the first map
+// requests are served from the warmed caches, pinned ones from memory.
+func TestWarmupRebuildsBeforeFirstRequest(t *testing.T) {
+	dir := t.TempDir()
+	provider := openJSONBackends(t, dir)
+	var ids = make(map[string]string)
+	for _, name := range []string{"deleted", "stale", "fresh", "pinned"} {
+		codebase := mustInitCodebase(t, name)
+		mustSnapshot(t, codebase.ID, "main", "v1", map[string]string{"a.txt": "1"})
+		mustSnapshot(t, codebase.ID, "main", "v2", map[string]string{"a.txt": "2"})
+		versionMap(t, codebase.ID)
+		ids[name] = codebase.ID
+	}
+	if err := provider.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cacheDir := filepath.Join(dir, "history_cache")
+	if err := os.Remove(filepath.Join(cacheDir, ids["deleted"]+".json")); err != nil {
+		t.Fatal(err)
+	}
+	editJSONFile(t, filepath.Join(cacheDir, ids["stale"]+".json"), func(data map[string]interface{}) {
+		data["edges"] = []interface{}{}
+	})
+
+	core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir(), PinnedCodebases: []string{ids["pinned"]}})
+	t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+	reopened := openJSONBackends(t, dir)
+	counting := &cacheCountingProvider{DataProvider: reopened, reads: make(map[string]int), writes: make(map[string]int)}
+	core.SetProvidersForTesting(counting, core.GetStore())
+
+	if err := NewWarmupService().run(); err != nil {
+		t.Fatal(err)
+	}
+	status := NewWarmupService().Status()
+	if status.Running || status.Total != 4 || status.Completed != 4 || status.Rebuilt != 3 {
+		t.Errorf("warm-up status = %+v, want 4 checked and 3 rebuilt", status)
+	}
+	if len(status.Pinned) != 1 || status.Pinned[0] != ids["pinned"] || status.Codebases[0].CodebaseID != ids["pinned"] {
+		t.Errorf("pinned = %v, first checked %s, want the pinned codebase warmed first", status.Pinned, status.Codebases[0].CodebaseID)
+	}
+	want := map[string][2]string{
+		ids["deleted"]: {CacheStateMissing, CacheStateRebuilt},
+		ids["stale"]:   {CacheStateStale, CacheStateRebuilt},
+		ids["fresh"]:   {CacheStateFresh, CacheStateFresh},
+		ids["pinned"]:  {CacheStateFresh, CacheStateRebuilt},
+	}
+	for _, c := range status.Codebases {
+		if got := [2]string{c.Found, c.State}; got != want[c.CodebaseID] || c.Nodes != 2 || c.Edges != 1 {
+			t.Errorf("codebase %s: found %s, state %s with %d nodes and %d edges, want %v with 2 nodes and 1 edge",
+				c.CodebaseID, c.Found, c.State, c.Nodes, c.Edges, want[c.CodebaseID])
+		}
+	}
+
+	counting.mu.Lock()
+	counting.reads, counting.writes = make(map[string]int), make(map[string]int)
+	counting.mu.Unlock()
+	for name, id := range ids {
+		if m := versionMap(t, id); len(m.Nodes) != 2 || len(m.Edges) != 1 {
+			t.Errorf("first map of %s has %d nodes and %d edges, want 2 and 1", name, len(m.Nodes), len(m.Edges))
+		}
+	}
+	counting.mu.Lock()
+	defer counting.mu.Unlock()
+	for name, id := range ids {
+		if counting.writes[id] != 0 {
+			t.Errorf("the first map request of %s rebuilt its cache", name)
+		}
+	}
+	if counting.reads[ids["pinned"]] != 0 {
+		t.Errorf("the pinned map was read from the provider %d times, want it served from memory", counting.reads[ids["pinned"]])
+	}
+}
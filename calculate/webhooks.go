@@ -0,0 +1,326 @@
+package calculate
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/core"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Events a webhook can subscribe to
+const (
+	WebhookEventSnapshotCreated    = "snapshot.created"
+	WebhookEventVersionLinkCreated = "version_link.created"
+	WebhookEventCodebaseDeleted    = "codebase.deleted"
+	// The storage events concern the whole server, they aren't delivered to webhooks of one codebase
+	WebhookEventStorageUnhealthy = "storage.unhealthy"
+	WebhookEventStorageRecovered = "storage.recovered"
+)
+
+var webhookEvents = []string{WebhookEventSnapshotCreated, WebhookEventVersionLinkCreated, WebhookEventCodebaseDeleted,
+	WebhookEventStorageUnhealthy, WebhookEventStorageRecovered}
+
+// webhookInitialBackoff is the wait before the first retry, doubled for each further one
+var webhookInitialBackoff = time.Second
+
+const (
+	webhookAttempts = 3
+	webhookTimeout  = 10 * time.Second
+	// WebhookSignatureHeader carries "sha256=<hex HMAC of the body keyed by the webhook secret>"
+	WebhookSignatureHeader = "X-CVCS-Signature"
+)
+
+// WebhookEvent is the JSON body posted to subscribers
+type WebhookEvent struct {
+	Event      string             `json:"event"`
+	DeliveryID string             `json:"delivery_id"`
+	OccurredAt time.Time          `json:"occurred_at"`
+	CodebaseID string             `json:"codebase_id,omitempty"`
+	Branch     string             `json:"branch,omitempty"`
+	Version    string             `json:"version,omitempty"`
+	VersionID  string             `json:"version_id,omitempty"`
+	Stats      *core.VersionStats `json:"stats,omitempty"`
+	// Parent is the parent version of a created link; Branch, Version and VersionID name the child
+	Parent *WebhookVersion `json:"parent,omitempty"`
+	// Trashed is set when the codebase was moved to the trash rather than deleted right away
+	Trashed bool `json:"trashed,omitempty"`
+	// Storage is the status of the backend that changed state, for the storage events
+	Storage *StorageBackendStatus `json:"storage,omitempty"`
+}
+
+// WebhookVersion names a version in a webhook payload
+type WebhookVersion struct {
+	Branch    string `json:"branch"`
+	Version   string `json:"version"`
+	VersionID string `json:"version_id"`
+}
+
+// WebhookService manages webhook subscriptions
+type WebhookService struct{}
+
+func NewWebhookService() *WebhookService {
+	return &WebhookService{}
+}
+
+// CreateWebhook subscribes url to events (all events when empty), optionally limited to one codebase.
+// A secret is generated when none is given; it is only returned here. The host must be in the
+// webhook_hosts of the server and, unless webhook_allow_private_networks is set, resolve to public
+// addresses only, so a webhook can't be pointed at the server itself or its internal network.
+func (s *WebhookService) CreateWebhook(rawURL, secret string, events []string, codebaseID string) (*core.Webhook, error) {
+	provider := core.GetProvider()
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook url %q: must be an absolute http or https URL", rawURL)
+	}
+	if err := checkWebhookHost(core.GetConfig(), u); err != nil {
+		return nil, err
+	}
+	if err := checkWebhookAddresses(core.GetConfig(), u.Hostname()); err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		events = webhookEvents
+	}
+	for _, e := range events {
+		if !isWebhookEvent(e) {
+			return nil, fmt.Errorf("invalid webhook event %q, expected one of %v", e, webhookEvents)
+		}
+	}
+	if codebaseID != "" {
+		if _, err := getActiveCodebase(provider, codebaseID); err != nil {
+			return nil, err
+		}
+	}
+	if secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, fmt.Errorf("failed to generate webhook secret: %w", err)
+		}
+		secret = hex.EncodeToString(buf)
+	}
+
+	hook := &core.Webhook{
+		ID:         uuid.NewString(),
+		URL:        rawURL,
+		Secret:     secret,
+		Events:     events,
+		CodebaseID: codebaseID,
+		CreatedAt:  time.Now(),
+	}
+	if err := provider.CreateWebhook(hook); err != nil {
+		return nil, err
+	}
+	log.Printf("Webhook created: id=%s, url=%s, events=%v, codebase=%s", hook.ID, hook.URL, hook.Events, codebaseID)
+	return hook, nil
+}
+
+func (s *WebhookService) DeleteWebhook(id string) error {
+	return core.GetProvider().DeleteWebhook(id)
+}
+
+// ListWebhooks returns the subscriptions without their secrets.
+func (s *WebhookService) ListWebhooks() ([]core.Webhook, error) {
+	hooks, err := core.GetProvider().ListWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]core.Webhook, 0, len(hooks))
+	for _, h := range hooks {
+		hook := *h
+		hook.Secret = ""
+		list = append(list, hook)
+	}
+	return list, nil
+}
+
+// checkWebhookHost refuses webhook URLs whose host is not in the webhook_hosts of the server.
+func checkWebhookHost(cfg core.AppConfig, u *url.URL) error {
+	for _, host := range cfg.WebhookHosts {
+		if strings.EqualFold(host, u.Hostname()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid webhook url: host %s is not in the webhook_hosts of the server", u.Hostname())
+}
+
+// checkWebhookAddresses resolves host and refuses it when any of its addresses is not public.
+func checkWebhookAddresses(cfg core.AppConfig, host string) error {
+	if cfg.WebhookAllowPrivateNetworks {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return fmt.Errorf("invalid webhook url: can't resolve %s: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if isPrivateAddress(addr.IP) {
+			return fmt.Errorf("invalid webhook url: %s resolves to %s, a loopback, private or link-local address; set webhook_allow_private_networks to allow it", host, addr.IP)
+		}
+	}
+	return nil
+}
+
+// isPrivateAddress reports addresses a webhook must not reach: loopback, private, link-local,
+// unspecified and multicast ones, IPv4 addresses mapped into IPv6 included.
+func isPrivateAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()
+}
+
+func isWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookClient checks the address of every connection it opens, since the host of a webhook may
+// resolve to another address by the time of a delivery than when it was created. It uses no proxy,
+// which would hide the address, and doesn't follow redirects, which could lead anywhere.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip != nil && isPrivateAddress(ip) && !core.GetConfig().WebhookAllowPrivateNetworks {
+					return fmt.Errorf("refusing to deliver to %s, a loopback, private or link-local address", ip)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// webhookDeliveries tracks deliveries still running, see WaitForWebhooks
+var webhookDeliveries sync.WaitGroup
+
+// notifyWebhooks posts event to every matching subscription in the background. Delivery failures are
+// retried with exponential backoff and then logged; they never reach the caller.
+func notifyWebhooks(event WebhookEvent) {
+	hooks, err := core.GetProvider().ListWebhooks()
+	if err != nil {
+		log.Printf("Failed to list webhooks for %s: %v", event.Event, err)
+		return
+	}
+	event.OccurredAt = time.Now()
+	for _, h := range hooks {
+		if !subscribes(h, event) {
+			continue
+		}
+		delivery := event
+		delivery.DeliveryID = uuid.NewString()
+		webhookDeliveries.Add(1)
+		go func(hook core.Webhook) {
+			defer webhookDeliveries.Done()
+			deliverWebhook(hook, delivery)
+		}(*h)
+	}
+}
+
+// WaitForWebhooks waits until the deliveries in progress, retries included, have finished or ctx ends.
+func WaitForWebhooks(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		webhookDeliveries.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func subscribes(hook *core.Webhook, event WebhookEvent) bool {
+	if hook.CodebaseID != "" && hook.CodebaseID != event.CodebaseID {
+		return false
+	}
+	for _, e := range hook.Events {
+		if e == event.Event {
+			return true
+		}
+	}
+	return false
+}
+
+func deliverWebhook(hook core.Webhook, event WebhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("event=webhook_failed webhook_id=%s delivery_id=%s error=%q", hook.ID, event.DeliveryID, err.Error())
+		return
+	}
+	signature := signWebhook(hook.Secret, body)
+	// The list may have changed since the webhook was created
+	if u, err := url.Parse(hook.URL); err != nil || checkWebhookHost(core.GetConfig(), u) != nil {
+		log.Printf("event=webhook_failed webhook_id=%s delivery_id=%s event_type=%s error=%q", hook.ID, event.DeliveryID, event.Event, "host is not in webhook_hosts")
+		return
+	}
+
+	backoff := webhookInitialBackoff
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		err = postWebhook(hook.URL, event, body, signature)
+		if err == nil {
+			log.Printf("event=webhook_delivered webhook_id=%s delivery_id=%s event_type=%s attempt=%d", hook.ID, event.DeliveryID, event.Event, attempt)
+			return
+		}
+		if attempt < webhookAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	log.Printf("event=webhook_failed webhook_id=%s delivery_id=%s event_type=%s attempts=%d error=%q", hook.ID, event.DeliveryID, event.Event, webhookAttempts, err.Error())
+}
+
+// signWebhook returns the WebhookSignatureHeader value of body.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhook(target string, event WebhookEvent, body []byte, signature string) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-CVCS-Event", event.Event)
+	req.Header.Set("X-CVCS-Delivery", event.DeliveryID)
+	req.Header.Set(WebhookSignatureHeader, signature)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package calculate
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"main/core"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useWebhookConfig installs cfg, with the storage path of the tests, for one test.
+func useWebhookConfig(t *testing.T, cfg core.AppConfig) {
+	t.Helper()
+	cfg.StoragePath = os.TempDir()
+	core.SetConfigForTesting(cfg)
+	t.Cleanup(func() { core.SetConfigForTesting(core.AppConfig{StoragePath: os.TempDir()}) })
+}
+
+func TestCreateWebhookChecksHost(t *testing.T) {
+	useMemoryBackends(t)
+	tests := []struct {
+		name    string
+		cfg     core.AppConfig
+		url     string
+		wantErr string
+	}{
+		{"no hosts configured", core.AppConfig{}, "https://8.8.8.8/hook", "not in the webhook_hosts"},
+		{"other host", core.AppConfig{WebhookHosts: []string{"8.8.4.4"}}, "https://8.8.8.8/hook", "not in the webhook_hosts"},
+		{"listed public address", core.AppConfig{WebhookHosts: []string{"8.8.8.8"}}, "https://8.8.8.8:8443/hook", ""},
+		{"loopback", core.AppConfig{WebhookHosts: []string{"127.0.0.1"}}, "http://127.0.0.1/hook", "loopback, private or link-local"},
+		{"localhost name", core.AppConfig{WebhookHosts: []string{"localhost"}}, "http://LOCALHOST/hook", "loopback, private or link-local"},
+		{"private network", core.AppConfig{WebhookHosts: []string{"10.1.2.3"}}, "http://10.1.2.3/hook", "loopback, private or link-local"},
+		{"cloud metadata", core.AppConfig{WebhookHosts: []string{"169.254.169.254"}}, "http://169.254.169.254/latest", "loopback, private or link-local"},
+		{"IPv6 loopback", core.AppConfig{WebhookHosts: []string{"::1"}}, "http://[::1]/hook", "loopback, private or link-local"},
+		{"mapped IPv4 loopback", core.AppConfig{WebhookHosts: []string{"::ffff:127.0.0.1"}}, "http://[::ffff:127.0.0.1]/hook", "loopback, private or link-local"},
+		{"private networks allowed", core.AppConfig{WebhookHosts: []string{"127.0.0.1"}, WebhookAllowPrivateNetworks: true}, "http://127.0.0.1/hook", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useWebhookConfig(t, tt.cfg)
+			_, err := NewWebhookService().CreateWebhook(tt.url, "", nil, "")
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("CreateWebhook(%s) = %v, want it created", tt.url, err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("CreateWebhook(%s) = %v, want an error containing %q", tt.url, err, tt.wantErr)
+			case err != nil && !strings.HasPrefix(err.Error(), "invalid webhook url"):
+				t.Errorf("CreateWebhook(%s) = %v, want a request error", tt.url, err)
+			}
+		})
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"event":"snapshot.created"}`)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	if got, want := signWebhook("s3cret", body), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("signWebhook = %s, want %s", got, want)
+	}
+	if signWebhook("other", body) == signWebhook("s3cret", body) {
+		t.Error("the signature doesn't depend on the secret")
+	}
+}
+
+// A delivery answered with an error is retried, and every attempt carries the same signed body.
+func TestWebhookDeliveryRetries(t *testing.T) {
+	useMemoryBackends(t)
+	backoff := webhookInitialBackoff
+	webhookInitialBackoff = time.Millisecond
+	t.Cleanup(func() { webhookInitialBackoff = backoff })
+
+	var mu sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get(WebhookSignatureHeader) != signWebhook("s3cret", body) {
+			t.Errorf("attempt %d: signature %q doesn't match the body", len(bodies)+1, r.Header.Get(WebhookSignatureHeader))
+		}
+		bodies = append(bodies, string(body))
+		if len(bodies) < webhookAttempts {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	useWebhookConfig(t, core.AppConfig{WebhookHosts: []string{u.Hostname()}, WebhookAllowPrivateNetworks: true})
+
+	if _, err := NewWebhookService().CreateWebhook(server.URL+"/hook", "s3cret", []string{WebhookEventSnapshotCreated}, ""); err != nil {
+		t.Fatal(err)
+	}
+	notifyWebhooks(WebhookEvent{Event: WebhookEventSnapshotCreated, CodebaseID: "cb", Version: "v1"})
+	notifyWebhooks(WebhookEvent{Event: WebhookEventCodebaseDeleted, CodebaseID: "cb"}) // not subscribed
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := WaitForWebhooks(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != webhookAttempts {
+		t.Fatalf("%d attempts, want %d", len(bodies), webhookAttempts)
+	}
+	var event WebhookEvent
+	if err := json.Unmarshal([]byte(bodies[0]), &event); err != nil || event.Version != "v1" || event.DeliveryID == "" {
+		t.Errorf("delivered event = %+v, %v", event, err)
+	}
+	for i, body := range bodies[1:] {
+		if body != bodies[0] {
+			t.Errorf("attempt %d posted %s, want the body of the first", i+2, body)
+		}
+	}
+}
+
+// A host that resolves to a private address after the webhook was created is refused when connecting.
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	var hits int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits++ }))
+	defer server.Close()
+	useWebhookConfig(t, core.AppConfig{})
+
+	err := postWebhook(server.URL, WebhookEvent{Event: WebhookEventSnapshotCreated}, []byte("{}"), "")
+	var opErr *net.OpError
+	if err == nil || !strings.Contains(err.Error(), "refusing to deliver") || !errors.As(err, &opErr) {
+		t.Errorf("post to %s = %v, want the connection refused", server.URL, err)
+	}
+	if hits != 0 {
+		t.Errorf("the server got %d requests", hits)
+	}
+}
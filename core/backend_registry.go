@@ -0,0 +1,233 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend types built into the server
+const (
+	ProviderTypeJSON   = "json"
+	ProviderTypeMemory = "memory"
+	ProviderTypeBolt   = "bolt"
+	StorageTypeLocal   = "local"
+	StorageTypeMemory  = "memory"
+)
+
+// ProviderFactory builds a DataProvider from the configuration, reading its own sub-config from cfg.ProviderConfig.
+type ProviderFactory func(cfg AppConfig) (DataProvider, error)
+
+// StorageFactory builds a Storage from the configuration, reading its own sub-config from cfg.StorageConfig.
+type StorageFactory func(cfg AppConfig) (Storage, error)
+
+var (
+	registryMu        sync.RWMutex
+	providerFactories = map[string]ProviderFactory{
+		ProviderTypeJSON:   newJSONProviderFromConfig,
+		ProviderTypeMemory: func(AppConfig) (DataProvider, error) { return NewMemoryProvider(), nil },
+		ProviderTypeBolt:   newBoltProviderFromConfig,
+	}
+	storageFactories = map[string]StorageFactory{
+		StorageTypeLocal:  newLocalStorageFromConfig,
+		StorageTypeMemory: func(AppConfig) (Storage, error) { return NewMemoryStorage(), nil },
+	}
+)
+
+// RegisterProvider makes a DataProvider backend selectable through provider_type.
+func RegisterProvider(name string, factory ProviderFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	providerFactories[name] = factory
+}
+
+// RegisterStorage makes a Storage backend selectable through storage_type.
+func RegisterStorage(name string, factory StorageFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	storageFactories[name] = factory
+}
+
+// ProviderTypes lists the registered provider_type values.
+func ProviderTypes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return sortedKeys(providerFactories)
+}
+
+// StorageTypes lists the registered storage_type values.
+func StorageTypes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return sortedKeys(storageFactories)
+}
+
+// newBackends builds the provider and storage selected by cfg. Nothing is returned unless both succeed.
+func newBackends(cfg AppConfig) (DataProvider, Storage, error) {
+	providerType, storageType := cfg.ProviderTypeOrDefault(), cfg.StorageTypeOrDefault()
+
+	registryMu.RLock()
+	newProvider, providerOK := providerFactories[providerType]
+	newStore, storageOK := storageFactories[storageType]
+	registryMu.RUnlock()
+	if !providerOK {
+		return nil, nil, fmt.Errorf("unknown provider_type %q (supported: %s)", providerType, strings.Join(ProviderTypes(), ", "))
+	}
+	if !storageOK {
+		return nil, nil, fmt.Errorf("unknown storage_type %q (supported: %s)", storageType, strings.Join(StorageTypes(), ", "))
+	}
+
+	store, err := newStore(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s storage: %w", storageType, err)
+	}
+	key, err := loadEncryptionKey(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if key != nil {
+		if store, err = NewEncryptedStorage(store, key); err != nil {
+			return nil, nil, err
+		}
+	}
+	provider, err := newProvider(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s provider: %w", providerType, err)
+	}
+	return provider, store, nil
+}
+
+// OpenProvider builds a provider of the given type outside the server, e.g. for an offline migration.
+// path is the directory of a file based provider and ignored by the others.
+func OpenProvider(providerType, path string) (DataProvider, error) {
+	registryMu.RLock()
+	newProvider, ok := providerFactories[providerType]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown provider_type %q (supported: %s)", providerType, strings.Join(ProviderTypes(), ", "))
+	}
+	cfg := AppConfig{StoragePath: defaultStoragePath, ProviderType: providerType}
+	if path != "" {
+		raw, err := json.Marshal(pathConfig{Path: path})
+		if err != nil {
+			return nil, err
+		}
+		cfg.ProviderConfig = raw
+	}
+	return newProvider(cfg)
+}
+
+// pathConfig is the sub-config of the file based backends
+type pathConfig struct {
+	// Path overrides the default location below storage_path
+	Path string `json:"path"`
+}
+
+func backendPath(raw json.RawMessage, def string) (string, error) {
+	var sub pathConfig
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &sub); err != nil {
+			return "", fmt.Errorf("invalid backend config: %w", err)
+		}
+	}
+	if sub.Path != "" {
+		return sub.Path, nil
+	}
+	return def, nil
+}
+
+// BackendPaths returns the directories the file based backends selected by cfg use, empty for a
+// backend that isn't file based.
+func BackendPaths(cfg AppConfig) (dbPath, ossPath string) {
+	switch cfg.ProviderTypeOrDefault() {
+	case ProviderTypeJSON:
+		dbPath, _ = backendPath(cfg.ProviderConfig, filepath.Join(cfg.StoragePath, "db"))
+	case ProviderTypeBolt:
+		dbPath, _ = backendPath(cfg.ProviderConfig, filepath.Join(cfg.StoragePath, "bolt"))
+	}
+	if cfg.StorageTypeOrDefault() == StorageTypeLocal {
+		ossPath, _ = backendPath(cfg.StorageConfig, filepath.Join(cfg.StoragePath, "oss"))
+	}
+	return dbPath, ossPath
+}
+
+// jsonProviderConfig is the sub-config of the json provider
+type jsonProviderConfig struct {
+	// FlushIntervalMs is how long changes are batched before being written, zero means the default
+	// (200) and a negative value writes every change at once.
+	FlushIntervalMs int `json:"flush_interval_ms"`
+	// FlushMaxPending writes the batch early once this many changes accumulated, zero means the default (100).
+	FlushMaxPending int `json:"flush_max_pending"`
+	// TreeCacheEntries is the number of file trees kept in memory, zero means the default (64) and a
+	// negative value doesn't limit the count.
+	TreeCacheEntries int `json:"tree_cache_entries"`
+	// TreeCacheBytes limits the estimated memory of the cached trees, zero doesn't limit it.
+	TreeCacheBytes int64 `json:"tree_cache_bytes"`
+	// Encoding of the version files and file trees written, "json" (the default) or "gob".
+	Encoding string `json:"encoding"`
+}
+
+func newJSONProviderFromConfig(cfg AppConfig) (DataProvider, error) {
+	path, err := backendPath(cfg.ProviderConfig, filepath.Join(cfg.StoragePath, "db"))
+	if err != nil {
+		return nil, err
+	}
+	var sub jsonProviderConfig
+	if len(cfg.ProviderConfig) > 0 {
+		if err := json.Unmarshal(cfg.ProviderConfig, &sub); err != nil {
+			return nil, fmt.Errorf("invalid backend config: %w", err)
+		}
+	}
+	if sub.Encoding != "" {
+		if err := validEncoding(sub.Encoding); err != nil {
+			return nil, err
+		}
+	}
+	p, err := NewJSONFileProvider(path)
+	if err != nil {
+		return nil, err
+	}
+	interval := defaultFlushInterval
+	if sub.FlushIntervalMs != 0 {
+		interval = time.Duration(sub.FlushIntervalMs) * time.Millisecond
+	}
+	if err := p.SetFlushPolicy(interval, sub.FlushMaxPending); err != nil {
+		p.Close()
+		return nil, err
+	}
+	p.SetTreeCacheBudget(sub.TreeCacheEntries, sub.TreeCacheBytes)
+	if err := p.SetEncoding(sub.Encoding); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func newBoltProviderFromConfig(cfg AppConfig) (DataProvider, error) {
+	path, err := backendPath(cfg.ProviderConfig, filepath.Join(cfg.StoragePath, "bolt"))
+	if err != nil {
+		return nil, err
+	}
+	return NewBoltProvider(path)
+}
+
+func newLocalStorageFromConfig(cfg AppConfig) (Storage, error) {
+	path, err := backendPath(cfg.StorageConfig, filepath.Join(cfg.StoragePath, "oss"))
+	if err != nil {
+		return nil, err
+	}
+	return NewLocalStorage(path)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,155 @@
+package core
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// BlobCache is an in-memory LRU cache of decompressed object content keyed by storage key.
+// A nil *BlobCache is valid and behaves as a disabled cache.
+type BlobCache struct {
+	mu            sync.Mutex
+	maxBytes      int64
+	maxEntryBytes int64
+	size          int64
+	ll            *list.List
+	items         map[string]*list.Element
+
+	hits        int64
+	misses      int64
+	bytesServed int64
+	evictions   int64
+}
+
+// BlobCacheStats reports cache effectiveness.
+type BlobCacheStats struct {
+	Enabled       bool  `json:"enabled"`
+	Entries       int   `json:"entries"`
+	Bytes         int64 `json:"bytes"`
+	MaxBytes      int64 `json:"max_bytes"`
+	MaxEntryBytes int64 `json:"max_entry_bytes"`
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	BytesServed   int64 `json:"bytes_served"`
+	Evictions     int64 `json:"evictions"`
+}
+
+type blobCacheEntry struct {
+	key  string
+	data []byte
+}
+
+// NewBlobCache creates a cache holding up to maxBytes of content.
+// Entries larger than maxEntryBytes are never cached; zero means a quarter of the budget.
+// Returns nil (disabled cache) when maxBytes is not positive.
+func NewBlobCache(maxBytes, maxEntryBytes int64) *BlobCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	if maxEntryBytes <= 0 || maxEntryBytes > maxBytes {
+		maxEntryBytes = maxBytes / 4
+	}
+	return &BlobCache{
+		maxBytes:      maxBytes,
+		maxEntryBytes: maxEntryBytes,
+		ll:            list.New(),
+		items:         make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached content for key. The returned slice must not be modified.
+func (c *BlobCache) Get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	data := el.Value.(*blobCacheEntry).data
+	c.hits++
+	c.bytesServed += int64(len(data))
+	return data, true
+}
+
+// Admits reports whether content of the given size would be cached.
+func (c *BlobCache) Admits(size int64) bool {
+	return c != nil && size <= c.maxEntryBytes
+}
+
+// Add stores content for key, evicting least recently used entries to stay within budget.
+func (c *BlobCache) Add(key string, data []byte) {
+	if c == nil || int64(len(data)) > c.maxEntryBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&blobCacheEntry{key: key, data: data})
+	c.size += int64(len(data))
+	for c.size > c.maxBytes {
+		c.removeElement(c.ll.Back())
+		c.evictions++
+	}
+}
+
+// Remove drops a single key from the cache.
+func (c *BlobCache) Remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// RemovePrefix drops every key starting with prefix, mirroring Storage.DeleteObjectsWithPrefix.
+func (c *BlobCache) RemovePrefix(prefix string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			c.removeElement(el)
+		}
+	}
+}
+
+// Stats returns a snapshot of cache counters.
+func (c *BlobCache) Stats() BlobCacheStats {
+	if c == nil {
+		return BlobCacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return BlobCacheStats{
+		Enabled:       true,
+		Entries:       len(c.items),
+		Bytes:         c.size,
+		MaxBytes:      c.maxBytes,
+		MaxEntryBytes: c.maxEntryBytes,
+		Hits:          c.hits,
+		Misses:        c.misses,
+		BytesServed:   c.bytesServed,
+		Evictions:     c.evictions,
+	}
+}
+
+func (c *BlobCache) removeElement(el *list.Element) {
+	entry := el.Value.(*blobCacheEntry)
+	c.ll.Remove(el)
+	delete(c.items, entry.key)
+	c.size -= int64(len(entry.data))
+}
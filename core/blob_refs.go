@@ -0,0 +1,140 @@
+package core
+
+import (
+	"sort"
+	"strings"
+)
+
+// BlobRefCounts returns how many file trees reference each of keys; unreferenced keys map to zero.
+func (p *JSONFileProvider) BlobRefCounts(keys []string) (map[string]int, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	counts := make(map[string]int, len(keys))
+	for _, key := range keys {
+		counts[key] = p.cache.BlobRefs[key]
+	}
+	return counts, nil
+}
+
+// ListBlobRefs calls fn for every referenced storage key starting with prefix, sorted by key.
+// fn runs without the provider lock held.
+func (p *JSONFileProvider) ListBlobRefs(prefix string, fn func(key string, refs int) error) error {
+	p.mu.RLock()
+	keys := make([]string, 0, len(p.cache.BlobRefs))
+	for key := range p.cache.BlobRefs {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	refs := make([]int, len(keys))
+	sort.Strings(keys)
+	for i, key := range keys {
+		refs[i] = p.cache.BlobRefs[key]
+	}
+	p.mu.RUnlock()
+
+	for i, key := range keys {
+		if err := fn(key, refs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeBlobKeys returns the distinct storage keys of a file tree; a tree counts once per key however
+// many of its files share the object.
+func treeBlobKeys(files []File) map[string]bool {
+	keys := make(map[string]bool, len(files))
+	for _, f := range files {
+		for _, key := range f.StorageKeys() {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+func addBlobRefs(refs map[string]int, files []File) {
+	for key := range treeBlobKeys(files) {
+		refs[key]++
+	}
+}
+
+func dropBlobRefs(refs map[string]int, files []File) {
+	for key := range treeBlobKeys(files) {
+		if refs[key] <= 1 {
+			delete(refs, key)
+		} else {
+			refs[key]--
+		}
+	}
+}
+
+// countBlobRefs recomputes the reference counts from the stored file trees.
+func countBlobRefs(trees *treeStore) (map[string]int, error) {
+	refs := make(map[string]int)
+	err := trees.each(func(_ string, files []File) error {
+		addBlobRefs(refs, files)
+		return nil
+	})
+	return refs, err
+}
+
+// RewriteStorageKeys replaces the storage keys of every file tree according to keys (old -> new),
+// recounting the references, and returns how many file entries changed.
+func (p *JSONFileProvider) RewriteStorageKeys(keys map[string]string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	changed := 0
+	err := p.trees.each(func(treeID string, files []File) error {
+		var rewritten []File
+		for i, f := range files {
+			updated, ok := rewriteFileKeys(f, keys)
+			if !ok {
+				continue
+			}
+			// Trees handed out by GetFileIndexesByTreeID may still be in use, so they are copied before changing them
+			if rewritten == nil {
+				rewritten = append([]File(nil), files...)
+			}
+			rewritten[i] = updated
+			changed++
+		}
+		if rewritten == nil {
+			return nil
+		}
+		return p.trees.put(treeID, rewritten)
+	})
+	if changed == 0 {
+		return 0, err
+	}
+	// Trees rewritten before a failure keep their new keys, so the counts follow them either way
+	refs, countErr := countBlobRefs(p.trees)
+	if countErr != nil {
+		return changed, countErr
+	}
+	p.cache.BlobRefs = refs
+	return changed, err
+}
+
+// rewriteFileKeys returns f with its storage keys replaced according to keys, and whether any was.
+func rewriteFileKeys(f File, keys map[string]string) (File, bool) {
+	if len(f.Chunks) == 0 {
+		key, ok := keys[f.StorageKey]
+		if ok {
+			f.StorageKey = key
+		}
+		return f, ok
+	}
+	changed := false
+	chunks := make([]FileChunk, len(f.Chunks))
+	for i, c := range f.Chunks {
+		if key, ok := keys[c.StorageKey]; ok {
+			c.StorageKey = key
+			changed = true
+		}
+		chunks[i] = c
+	}
+	f.Chunks = chunks
+	return f, changed
+}
@@ -0,0 +1,1648 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltProvider implements DataProvider on a single bbolt database file, for single-binary deployments
+// that want neither the JSON files nor an external database. Every collection has a bucket of its own
+// and a call changes them in one transaction, so a change only rewrites the pages it touches and is on
+// disk when the call returns. Readers run in read transactions of their own and see a consistent state
+// while a write is in progress. Lookups go through index buckets rather than scans: versions by
+// codebase, branch and name, and by branch or codebase in creation order.
+type BoltProvider struct {
+	path string
+	db   *bolt.DB
+	// lock keeps other processes off the directory of the database for the provider's lifetime
+	lock *DirLock
+}
+
+// boltFile is the database file in the provider directory
+const boltFile = "metadata.db"
+
+// Buckets. Keys of the index buckets join their parts with keySep, which names can't contain.
+var (
+	bucketCodebases  = []byte("codebases")  // codebase ID -> Codebase
+	bucketVersions   = []byte("versions")   // version ID -> Version
+	bucketTrees      = []byte("trees")      // tree ID -> []File
+	bucketEdges      = []byte("edges")      // edge ID -> versionMappingRecord
+	bucketRefs       = []byte("refs")       // codebase ID, branch -> BranchRef
+	bucketTags       = []byte("tags")       // codebase ID, name -> Tag
+	bucketWebhooks   = []byte("webhooks")   // webhook ID -> Webhook
+	bucketQuarantine = []byte("quarantine") // storage key -> QuarantineEntry
+	bucketIdempotent = []byte("idempotency_keys")
+	bucketHistory    = []byte("history_cache") // codebase ID -> cached version map
+	bucketBlobRefs   = []byte("blob_refs")     // storage key -> number of trees referencing it
+	bucketAudit      = []byte("audit_log")     // entry ID -> AuditEntry
+
+	// Indexes, rebuilt from the buckets above by RebuildIndexes
+	indexVersionNames    = []byte("idx_version_names")     // codebase ID, branch, version -> version ID
+	indexVersionLabels   = []byte("idx_version_labels")    // codebase ID, version, branch
+	indexBranchVersions  = []byte("idx_branch_versions")   // codebase ID, branch, created at, version ID
+	indexCodebaseVersion = []byte("idx_codebase_versions") // codebase ID, created at, version ID
+	indexTreeVersions    = []byte("idx_tree_versions")     // tree ID, version ID
+	indexCodebaseEdges   = []byte("idx_codebase_edges")    // codebase ID, edge ID
+	indexEdgePairs       = []byte("idx_edge_pairs")        // child ID, parent ID -> edge ID
+
+	boltBuckets = [][]byte{
+		bucketCodebases, bucketVersions, bucketTrees, bucketEdges, bucketRefs, bucketTags, bucketWebhooks,
+		bucketQuarantine, bucketIdempotent, bucketHistory, bucketBlobRefs, bucketAudit,
+	}
+	boltIndexes = [][]byte{
+		indexVersionNames, indexVersionLabels, indexBranchVersions, indexCodebaseVersion, indexTreeVersions,
+		indexCodebaseEdges, indexEdgePairs,
+	}
+)
+
+const keySep = 0
+
+// NewBoltProvider opens, or creates, the database in dir and locks the directory until Close.
+func NewBoltProvider(dir string) (*BoltProvider, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create database directory: %w", err)
+	}
+	lock, err := LockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	p := &BoltProvider{path: filepath.Join(dir, boltFile), lock: lock}
+	if err := p.open(); err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *BoltProvider) open() error {
+	db, err := bolt.Open(p.path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", p.path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range append(append([][]byte{}, boltBuckets...), boltIndexes...) {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("unable to initialize %s: %w", p.path, err)
+	}
+	p.db = db
+	return nil
+}
+
+// Close closes the database and releases the lock of its directory.
+func (p *BoltProvider) Close() error {
+	err := p.db.Close()
+	p.lock.Unlock()
+	return err
+}
+
+// releaseLock closes the database and lets go of its directory, so a new provider can open it.
+func (p *BoltProvider) releaseLock() error {
+	p.lock.Unlock()
+	return p.db.Close()
+}
+
+// reacquireLock opens the database again after releaseLock.
+func (p *BoltProvider) reacquireLock() error {
+	if err := p.lock.Relock(); err != nil {
+		return err
+	}
+	return p.open()
+}
+
+// --- Keys and records ---
+
+func boltKey(parts ...string) []byte {
+	var b bytes.Buffer
+	for i, part := range parts {
+		if i > 0 {
+			b.WriteByte(keySep)
+		}
+		b.WriteString(part)
+	}
+	return b.Bytes()
+}
+
+// boltPrefix returns the key prefix of the entries whose leading parts are parts.
+func boltPrefix(parts ...string) []byte {
+	return append(boltKey(parts...), keySep)
+}
+
+// timeKey orders creation times within a key; the sign bit is flipped so times before 1970 sort first
+func timeKey(t time.Time) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(t.UnixNano())^1<<63)
+	return string(b[:])
+}
+
+// lastPart returns the last part of an index key
+func lastPart(key []byte) string {
+	return string(key[bytes.LastIndexByte(key, keySep)+1:])
+}
+
+func getRecord(b *bolt.Bucket, key []byte, record interface{}) (bool, error) {
+	data := b.Get(key)
+	if data == nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, record); err != nil {
+		return false, fmt.Errorf("record %q: %w", key, err)
+	}
+	return true, nil
+}
+
+func putRecord(b *bolt.Bucket, key []byte, record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// scanPrefix calls fn for the entries of b whose key starts with prefix, in key order.
+func scanPrefix(b *bolt.Bucket, prefix []byte, fn func(k, v []byte) error) error {
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefixKeys returns the keys of b starting with prefix; entries are deleted through such a copy, a
+// bucket can't change under its cursor.
+func prefixKeys(b *bolt.Bucket, prefix []byte) [][]byte {
+	var keys [][]byte
+	scanPrefix(b, prefix, func(k, _ []byte) error {
+		keys = append(keys, append([]byte(nil), k...))
+		return nil
+	})
+	return keys
+}
+
+func deletePrefix(b *bolt.Bucket, prefix []byte) error {
+	for _, k := range prefixKeys(b, prefix) {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getVersion(tx *bolt.Tx, id string) (*Version, error) {
+	var v Version
+	ok, err := getRecord(tx.Bucket(bucketVersions), []byte(id), &v)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("version %s not found", id)
+	}
+	return &v, nil
+}
+
+func getTree(tx *bolt.Tx, treeID string) ([]File, bool, error) {
+	var files []File
+	ok, err := getRecord(tx.Bucket(bucketTrees), []byte(treeID), &files)
+	return files, ok, err
+}
+
+// versionsIn returns the versions of the index entries starting with prefix, whose last key part is
+// the version ID, newest first when the index orders by creation time.
+func versionsIn(tx *bolt.Tx, index, prefix []byte) ([]*Version, error) {
+	var versions []*Version
+	err := scanPrefix(tx.Bucket(index), prefix, func(k, _ []byte) error {
+		v, err := getVersion(tx, lastPart(k))
+		if err != nil {
+			return err
+		}
+		versions = append(versions, v)
+		return nil
+	})
+	for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+		versions[i], versions[j] = versions[j], versions[i]
+	}
+	return versions, err
+}
+
+// putVersion stores a version and its index entries.
+func putVersion(tx *bolt.Tx, v *Version) error {
+	if err := putRecord(tx.Bucket(bucketVersions), []byte(v.ID), v); err != nil {
+		return err
+	}
+	entries := []struct {
+		index []byte
+		key   []byte
+		value []byte
+	}{
+		{indexVersionNames, boltKey(v.CodebaseID, v.Branch, v.Version), []byte(v.ID)},
+		{indexVersionLabels, boltKey(v.CodebaseID, v.Version, v.Branch), nil},
+		{indexBranchVersions, boltKey(v.CodebaseID, v.Branch, timeKey(v.CreatedAt), v.ID), nil},
+		{indexCodebaseVersion, boltKey(v.CodebaseID, timeKey(v.CreatedAt), v.ID), nil},
+		{indexTreeVersions, boltKey(v.TreeID, v.ID), nil},
+	}
+	for _, e := range entries {
+		if err := tx.Bucket(e.index).Put(e.key, e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeVersion deletes a version record and its index entries; the tree is left to the caller.
+func removeVersion(tx *bolt.Tx, v *Version) error {
+	if err := tx.Bucket(bucketVersions).Delete([]byte(v.ID)); err != nil {
+		return err
+	}
+	entries := []struct{ index, key []byte }{
+		{indexVersionNames, boltKey(v.CodebaseID, v.Branch, v.Version)},
+		{indexBranchVersions, boltKey(v.CodebaseID, v.Branch, timeKey(v.CreatedAt), v.ID)},
+		{indexCodebaseVersion, boltKey(v.CodebaseID, timeKey(v.CreatedAt), v.ID)},
+		{indexTreeVersions, boltKey(v.TreeID, v.ID)},
+	}
+	for _, e := range entries {
+		if err := tx.Bucket(e.index).Delete(e.key); err != nil {
+			return err
+		}
+	}
+	// Another branch keeps the label while it has a version of that name
+	if tx.Bucket(indexVersionNames).Get(boltKey(v.CodebaseID, v.Branch, v.Version)) == nil {
+		return tx.Bucket(indexVersionLabels).Delete(boltKey(v.CodebaseID, v.Version, v.Branch))
+	}
+	return nil
+}
+
+func putEdge(tx *bolt.Tx, edge *versionMappingRecord) error {
+	if err := putRecord(tx.Bucket(bucketEdges), []byte(edge.ID), edge); err != nil {
+		return err
+	}
+	if err := tx.Bucket(indexCodebaseEdges).Put(boltKey(edge.CodebaseID, edge.ID), nil); err != nil {
+		return err
+	}
+	return tx.Bucket(indexEdgePairs).Put(boltKey(edge.ChildVersionID, edge.ParentVersionID), []byte(edge.ID))
+}
+
+func removeEdge(tx *bolt.Tx, edge *versionMappingRecord) error {
+	if err := tx.Bucket(bucketEdges).Delete([]byte(edge.ID)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(indexCodebaseEdges).Delete(boltKey(edge.CodebaseID, edge.ID)); err != nil {
+		return err
+	}
+	pair := boltKey(edge.ChildVersionID, edge.ParentVersionID)
+	if string(tx.Bucket(indexEdgePairs).Get(pair)) == edge.ID {
+		return tx.Bucket(indexEdgePairs).Delete(pair)
+	}
+	return nil
+}
+
+// edgesOfCodebase returns the lineage records of a codebase.
+func edgesOfCodebase(tx *bolt.Tx, codebaseID string) ([]*versionMappingRecord, error) {
+	var edges []*versionMappingRecord
+	err := scanPrefix(tx.Bucket(indexCodebaseEdges), boltPrefix(codebaseID), func(k, _ []byte) error {
+		var edge versionMappingRecord
+		ok, err := getRecord(tx.Bucket(bucketEdges), []byte(lastPart(k)), &edge)
+		if ok {
+			edges = append(edges, &edge)
+		}
+		return err
+	})
+	return edges, err
+}
+
+func findEdgeTx(tx *bolt.Tx, childID, parentID string) bool {
+	return tx.Bucket(indexEdgePairs).Get(boltKey(childID, parentID)) != nil
+}
+
+// listRecords decodes the values of the entries of b starting with prefix.
+func listRecords[T any](b *bolt.Bucket, prefix []byte) ([]*T, error) {
+	records := []*T{}
+	err := scanPrefix(b, prefix, func(k, v []byte) error {
+		var record T
+		if err := json.Unmarshal(v, &record); err != nil {
+			return fmt.Errorf("record %q: %w", k, err)
+		}
+		records = append(records, &record)
+		return nil
+	})
+	return records, err
+}
+
+// --- Blob references ---
+
+func changeBlobRefs(tx *bolt.Tx, files []File, delta int) error {
+	b := tx.Bucket(bucketBlobRefs)
+	for key := range treeBlobKeys(files) {
+		refs := int(blobRefCount(b, key)) + delta
+		var err error
+		if refs <= 0 {
+			err = b.Delete([]byte(key))
+		} else {
+			var count [8]byte
+			binary.BigEndian.PutUint64(count[:], uint64(refs))
+			err = b.Put([]byte(key), count[:])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func blobRefCount(b *bolt.Bucket, key string) uint64 {
+	if data := b.Get([]byte(key)); len(data) == 8 {
+		return binary.BigEndian.Uint64(data)
+	}
+	return 0
+}
+
+// putTree stores a new tree and counts its blob references.
+func putTree(tx *bolt.Tx, treeID string, files []File) error {
+	if err := putRecord(tx.Bucket(bucketTrees), []byte(treeID), files); err != nil {
+		return err
+	}
+	return changeBlobRefs(tx, files, 1)
+}
+
+// removeTree deletes a tree and drops its blob references.
+func removeTree(tx *bolt.Tx, treeID string) error {
+	files, ok, err := getTree(tx, treeID)
+	if err != nil || !ok {
+		return err
+	}
+	if err := changeBlobRefs(tx, files, -1); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketTrees).Delete([]byte(treeID))
+}
+
+// recountBlobRefs rebuilds the reference counts from the trees and returns how many changed.
+func recountBlobRefs(tx *bolt.Tx) (int, error) {
+	counted := make(map[string]int)
+	err := tx.Bucket(bucketTrees).ForEach(func(k, v []byte) error {
+		var files []File
+		if err := json.Unmarshal(v, &files); err != nil {
+			return fmt.Errorf("tree %s: %w", k, err)
+		}
+		addBlobRefs(counted, files)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	b := tx.Bucket(bucketBlobRefs)
+	repaired := 0
+	for _, k := range prefixKeys(b, nil) {
+		if _, ok := counted[string(k)]; !ok {
+			repaired++
+			if err := b.Delete(k); err != nil {
+				return 0, err
+			}
+		}
+	}
+	for key, refs := range counted {
+		if int(blobRefCount(b, key)) == refs {
+			continue
+		}
+		repaired++
+		var count [8]byte
+		binary.BigEndian.PutUint64(count[:], uint64(refs))
+		if err := b.Put([]byte(key), count[:]); err != nil {
+			return 0, err
+		}
+	}
+	return repaired, nil
+}
+
+// --- Interface Implementations ---
+
+func (p *BoltProvider) CreateCodebase(codebase *Codebase) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketCodebases)
+		if b.Get([]byte(codebase.ID)) != nil {
+			return fmt.Errorf("codebase %s already exists", codebase.ID)
+		}
+		return putRecord(b, []byte(codebase.ID), codebase)
+	})
+}
+
+func (p *BoltProvider) GetCodebaseByID(id string) (*Codebase, error) {
+	var codebase Codebase
+	err := p.db.View(func(tx *bolt.Tx) error {
+		ok, err := getRecord(tx.Bucket(bucketCodebases), []byte(id), &codebase)
+		if err == nil && !ok {
+			err = fmt.Errorf("codebase %s not found", id)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &codebase, nil
+}
+
+func (p *BoltProvider) ListCodebases() ([]*Codebase, error) {
+	var codebases []*Codebase
+	err := p.db.View(func(tx *bolt.Tx) error {
+		var err error
+		codebases, err = listRecords[Codebase](tx.Bucket(bucketCodebases), nil)
+		return err
+	})
+	sort.Slice(codebases, func(i, j int) bool {
+		return codebases[i].CreatedAt.Before(codebases[j].CreatedAt)
+	})
+	return codebases, err
+}
+
+func (p *BoltProvider) UpdateCodebase(codebase *Codebase) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketCodebases)
+		if b.Get([]byte(codebase.ID)) == nil {
+			return fmt.Errorf("codebase %s not found", codebase.ID)
+		}
+		return putRecord(b, []byte(codebase.ID), codebase)
+	})
+}
+
+func (p *BoltProvider) DeleteCodebaseByID(id string) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketCodebases).Delete([]byte(id)); err != nil {
+			return err
+		}
+		versions, err := versionsIn(tx, indexCodebaseVersion, boltPrefix(id))
+		if err != nil {
+			return err
+		}
+		trees := make(map[string]bool)
+		for _, v := range versions {
+			if err := removeVersion(tx, v); err != nil {
+				return err
+			}
+			trees[v.TreeID] = true
+		}
+		for treeID := range trees {
+			if err := removeTree(tx, treeID); err != nil {
+				return err
+			}
+		}
+		edges, err := edgesOfCodebase(tx, id)
+		if err != nil {
+			return err
+		}
+		for _, edge := range edges {
+			if err := removeEdge(tx, edge); err != nil {
+				return err
+			}
+		}
+		for _, bucket := range [][]byte{bucketRefs, bucketTags, bucketIdempotent} {
+			if err := deletePrefix(tx.Bucket(bucket), boltPrefix(id)); err != nil {
+				return err
+			}
+		}
+		quarantine := tx.Bucket(bucketQuarantine)
+		entries, err := listRecords[QuarantineEntry](quarantine, nil)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.CodebaseID == id {
+				if err := quarantine.Delete([]byte(e.StorageKey)); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Bucket(bucketHistory).Delete([]byte(id))
+	})
+}
+
+func (p *BoltProvider) UpdateCodebaseTimestamp(id string, t time.Time) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketCodebases)
+		var codebase Codebase
+		ok, err := getRecord(b, []byte(id), &codebase)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("codebase %s not found", id)
+		}
+		codebase.UpdatedAt = t
+		return putRecord(b, []byte(id), &codebase)
+	})
+}
+
+// CloneCodebase creates target and copies every version, file index, lineage record, branch ref and tag
+// of the source codebase in one transaction. Versions and trees get new IDs; file entries keep their
+// storage keys, so the clone shares the source's objects.
+func (p *BoltProvider) CloneCodebase(sourceID string, target *Codebase) (map[string]string, error) {
+	idMap := make(map[string]string)
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		codebases := tx.Bucket(bucketCodebases)
+		if codebases.Get([]byte(sourceID)) == nil {
+			return fmt.Errorf("codebase %s not found", sourceID)
+		}
+		if codebases.Get([]byte(target.ID)) != nil {
+			return fmt.Errorf("codebase %s already exists", target.ID)
+		}
+		if err := putRecord(codebases, []byte(target.ID), target); err != nil {
+			return err
+		}
+		versions, err := versionsIn(tx, indexCodebaseVersion, boltPrefix(sourceID))
+		if err != nil {
+			return err
+		}
+		for _, v := range versions {
+			idMap[v.ID] = uuid.NewString()
+		}
+		for _, v := range versions {
+			clone := *v
+			clone.ID = idMap[v.ID]
+			clone.CodebaseID = target.ID
+			clone.TreeID = uuid.NewString()
+			files, ok, err := getTree(tx, v.TreeID)
+			if err != nil {
+				return err
+			}
+			if ok {
+				if err := putTree(tx, clone.TreeID, files); err != nil {
+					return err
+				}
+			}
+			if err := putVersion(tx, &clone); err != nil {
+				return err
+			}
+		}
+		edges, err := edgesOfCodebase(tx, sourceID)
+		if err != nil {
+			return err
+		}
+		for _, edge := range edges {
+			childID, childOK := idMap[edge.ChildVersionID]
+			parentID, parentOK := idMap[edge.ParentVersionID]
+			if !childOK || !parentOK {
+				continue // edges leaving the codebase are not cloned
+			}
+			err := putEdge(tx, &versionMappingRecord{
+				ID:              uuid.NewString(),
+				CodebaseID:      target.ID,
+				Branch:          edge.Branch,
+				ChildVersionID:  childID,
+				ParentVersionID: parentID,
+				LinkageType:     edge.LinkageType,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		refs, err := listRecords[BranchRef](tx.Bucket(bucketRefs), boltPrefix(sourceID))
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			versionID, ok := idMap[ref.VersionID]
+			if !ok {
+				continue
+			}
+			clone := &BranchRef{CodebaseID: target.ID, Branch: ref.Branch, VersionID: versionID, CreatedAt: ref.CreatedAt}
+			if err := putRecord(tx.Bucket(bucketRefs), boltKey(target.ID, ref.Branch), clone); err != nil {
+				return err
+			}
+		}
+		tags, err := listRecords[Tag](tx.Bucket(bucketTags), boltPrefix(sourceID))
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			versionID, ok := idMap[tag.VersionID]
+			if !ok {
+				continue
+			}
+			clone := *tag
+			clone.CodebaseID = target.ID
+			clone.VersionID = versionID
+			if err := putRecord(tx.Bucket(bucketTags), boltKey(target.ID, tag.Name), &clone); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return idMap, nil
+}
+
+func (p *BoltProvider) CreateVersion(version *Version, files []File) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketVersions).Get([]byte(version.ID)) != nil {
+			return fmt.Errorf("version %s already exists", version.ID)
+		}
+		if existingID := tx.Bucket(indexVersionNames).Get(boltKey(version.CodebaseID, version.Branch, version.Version)); existingID != nil {
+			return &VersionExistsError{Branch: version.Branch, Version: version.Version, VersionID: string(existingID)}
+		}
+		if tx.Bucket(bucketTrees).Get([]byte(version.TreeID)) == nil {
+			if err := putTree(tx, version.TreeID, files); err != nil {
+				return err
+			}
+		}
+		return putVersion(tx, version)
+	})
+}
+
+func (p *BoltProvider) GetVersion(codebaseID, branch, version string) (*Version, error) {
+	var v *Version
+	err := p.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(indexVersionNames).Get(boltKey(codebaseID, branch, version))
+		if id == nil {
+			return fmt.Errorf("version %s/%s not found", branch, version)
+		}
+		var err error
+		if v, err = getVersion(tx, string(id)); err != nil {
+			return fmt.Errorf("data inconsistency: %w", err)
+		}
+		return nil
+	})
+	return v, err
+}
+
+// FindBranchesWithVersion returns the sorted branches of a codebase that have a version with the given label.
+func (p *BoltProvider) FindBranchesWithVersion(codebaseID, version string) ([]string, error) {
+	branches := []string{}
+	err := p.db.View(func(tx *bolt.Tx) error {
+		return scanPrefix(tx.Bucket(indexVersionLabels), boltPrefix(codebaseID, version), func(k, _ []byte) error {
+			branches = append(branches, lastPart(k))
+			return nil
+		})
+	})
+	return branches, err
+}
+
+func (p *BoltProvider) GetVersionByID(id string) (*Version, error) {
+	var v *Version
+	err := p.db.View(func(tx *bolt.Tx) error {
+		var err error
+		v, err = getVersion(tx, id)
+		return err
+	})
+	return v, err
+}
+
+// ListVersions returns all versions of a codebase, newest first.
+func (p *BoltProvider) ListVersions(codebaseID string) ([]*Version, error) {
+	var versions []*Version
+	err := p.db.View(func(tx *bolt.Tx) error {
+		var err error
+		versions, err = versionsIn(tx, indexCodebaseVersion, boltPrefix(codebaseID))
+		return err
+	})
+	if versions == nil {
+		versions = []*Version{}
+	}
+	return versions, err
+}
+
+func (p *BoltProvider) GetFileIndexesByTreeID(treeID string) ([]File, error) {
+	var files []File
+	err := p.db.View(func(tx *bolt.Tx) error {
+		var ok bool
+		var err error
+		files, ok, err = getTree(tx, treeID)
+		if err == nil && !ok {
+			err = fmt.Errorf("tree %s not found", treeID)
+		}
+		return err
+	})
+	return files, err
+}
+
+// latestInBranch returns the newest version of a branch other than excludeVersionID, nil when there is none.
+func latestInBranch(tx *bolt.Tx, codebaseID, branch, excludeVersionID string) (*Version, error) {
+	prefix := boltPrefix(codebaseID, branch)
+	c := tx.Bucket(indexBranchVersions).Cursor()
+	// Position on the first key after the branch, then walk back
+	end := append([]byte(nil), prefix...)
+	end[len(end)-1]++
+	k, _ := c.Seek(end)
+	if k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Prev() {
+		if id := lastPart(k); id != excludeVersionID {
+			return getVersion(tx, id)
+		}
+	}
+	return nil, nil
+}
+
+func (p *BoltProvider) FindLatestVersionInBranch(codebaseID, branch, excludeVersionID string) (*Version, error) {
+	var v *Version
+	err := p.db.View(func(tx *bolt.Tx) error {
+		var err error
+		v, err = latestInBranch(tx, codebaseID, branch, excludeVersionID)
+		return err
+	})
+	return v, err
+}
+
+func (p *BoltProvider) IsNewBranch(codebaseID, branch, excludeVersionID string) (bool, error) {
+	v, err := p.FindLatestVersionInBranch(codebaseID, branch, excludeVersionID)
+	return v == nil, err
+}
+
+// FindLatestVersionInDefaultBranch returns the newest version on the codebase's default branch.
+func (p *BoltProvider) FindLatestVersionInDefaultBranch(codebaseID string) (*Version, error) {
+	codebase, err := p.GetCodebaseByID(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	branch := codebase.Branch
+	if branch == "" {
+		branch = "main"
+	}
+	return p.FindLatestVersionInBranch(codebaseID, branch, "")
+}
+
+// ReplaceVersion puts version in the place of the version with the same branch and name: the old one
+// and its file tree are removed, and its lineage records, in both directions, and branch refs move to version.
+func (p *BoltProvider) ReplaceVersion(oldVersionID string, version *Version, files []File) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		old, err := getVersion(tx, oldVersionID)
+		if err != nil {
+			return err
+		}
+		if old.CodebaseID != version.CodebaseID || old.Branch != version.Branch || old.Version != version.Version {
+			return fmt.Errorf("version %s is %s/%s, not %s/%s", oldVersionID, old.Branch, old.Version, version.Branch, version.Version)
+		}
+		if tx.Bucket(bucketVersions).Get([]byte(version.ID)) != nil {
+			return fmt.Errorf("version %s already exists", version.ID)
+		}
+		if tx.Bucket(bucketTrees).Get([]byte(version.TreeID)) == nil {
+			if err := putTree(tx, version.TreeID, files); err != nil {
+				return err
+			}
+		}
+		if err := deleteVersionTx(tx, old, version.ID, version); err != nil {
+			return err
+		}
+		return putVersion(tx, version)
+	})
+}
+
+// DeleteVersion removes a version, its file tree and its own lineage record. Children and branch refs
+// pointing at it are moved to reparentTo, or removed when reparentTo is empty.
+func (p *BoltProvider) DeleteVersion(versionID, reparentTo string) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		version, err := getVersion(tx, versionID)
+		if err != nil {
+			return err
+		}
+		return deleteVersionTx(tx, version, reparentTo, nil)
+	})
+}
+
+func (p *BoltProvider) SetVersionFlags(versionID string, locked, pinned bool) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		version, err := getVersion(tx, versionID)
+		if err != nil {
+			return err
+		}
+		version.Locked, version.Pinned = locked, pinned
+		return putRecord(tx.Bucket(bucketVersions), []byte(versionID), version)
+	})
+}
+
+// deleteVersionTx removes version, see DeleteVersion. A replacement, whose ID is reparentTo, also takes
+// over the lineage records of version's own parents. The tree is kept when another version or the
+// replacement uses it.
+func deleteVersionTx(tx *bolt.Tx, version *Version, reparentTo string, replacement *Version) error {
+	if err := removeVersion(tx, version); err != nil {
+		return err
+	}
+	treeShared := replacement != nil && replacement.TreeID == version.TreeID
+	if !treeShared && len(prefixKeys(tx.Bucket(indexTreeVersions), boltPrefix(version.TreeID))) > 0 {
+		treeShared = true
+	}
+
+	edges, err := edgesOfCodebase(tx, version.CodebaseID)
+	if err != nil {
+		return err
+	}
+	for _, edge := range edges {
+		var moved *versionMappingRecord
+		switch {
+		case edge.ChildVersionID == version.ID && replacement != nil:
+			moved = edge
+			moved.ChildVersionID = replacement.ID
+		case edge.ChildVersionID == version.ID:
+		case edge.ParentVersionID != version.ID:
+			continue
+		case reparentTo == "" || findEdgeTx(tx, edge.ChildVersionID, reparentTo):
+		default:
+			moved = edge
+			moved.ParentVersionID = reparentTo
+		}
+		// The record is removed under the pair it is stored with before it is put back with the new one
+		if err := removeEdgeRecord(tx, edge.ID); err != nil {
+			return err
+		}
+		if moved != nil {
+			if err := putEdge(tx, moved); err != nil {
+				return err
+			}
+		}
+	}
+
+	refs, err := listRecords[BranchRef](tx.Bucket(bucketRefs), boltPrefix(version.CodebaseID))
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if ref.VersionID != version.ID {
+			continue
+		}
+		key := boltKey(ref.CodebaseID, ref.Branch)
+		if reparentTo == "" {
+			err = tx.Bucket(bucketRefs).Delete(key)
+		} else {
+			ref.VersionID = reparentTo
+			err = putRecord(tx.Bucket(bucketRefs), key, ref)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Tags name one exact version, so they go with it
+	tags, err := listRecords[Tag](tx.Bucket(bucketTags), boltPrefix(version.CodebaseID))
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if tag.VersionID == version.ID {
+			if err := tx.Bucket(bucketTags).Delete(boltKey(tag.CodebaseID, tag.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	if !treeShared {
+		return removeTree(tx, version.TreeID)
+	}
+	return nil
+}
+
+// removeEdgeRecord deletes an edge with its index entries as they are stored.
+func removeEdgeRecord(tx *bolt.Tx, edgeID string) error {
+	var stored versionMappingRecord
+	ok, err := getRecord(tx.Bucket(bucketEdges), []byte(edgeID), &stored)
+	if err != nil || !ok {
+		return err
+	}
+	return removeEdge(tx, &stored)
+}
+
+func (p *BoltProvider) CreateVersionLink(codebaseID, childID, parentID, branch string, linkType LinkageType) error {
+	return p.CreateVersionLinks([]VersionLink{{
+		CodebaseID:  codebaseID,
+		ChildID:     childID,
+		ParentID:    parentID,
+		Branch:      branch,
+		LinkageType: linkType,
+	}})
+}
+
+// CreateVersionLinks inserts several links in one transaction. Links that already exist are skipped.
+func (p *BoltProvider) CreateVersionLinks(links []VersionLink) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		for _, l := range links {
+			if findEdgeTx(tx, l.ChildID, l.ParentID) {
+				continue
+			}
+			err := putEdge(tx, &versionMappingRecord{
+				ID:              uuid.NewString(),
+				CodebaseID:      l.CodebaseID,
+				Branch:          l.Branch,
+				ChildVersionID:  l.ChildID,
+				ParentVersionID: l.ParentID,
+				LinkageType:     l.LinkageType,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteVersionLink removes the lineage record linking child to parent.
+func (p *BoltProvider) DeleteVersionLink(childID, parentID string) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		edgeID := tx.Bucket(indexEdgePairs).Get(boltKey(childID, parentID))
+		if edgeID == nil {
+			return fmt.Errorf("version link %s -> %s not found", parentID, childID)
+		}
+		return removeEdgeRecord(tx, string(edgeID))
+	})
+}
+
+func (p *BoltProvider) GetAllVersionsForMap(codebaseID string) ([]VersionNode, error) {
+	versions, err := p.ListVersions(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := p.ListTags(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	tagNames := tagNamesByVersion(tags)
+	var nodes []VersionNode
+	for _, v := range versions {
+		nodes = append(nodes, versionNode(v, tagNames[v.ID]))
+	}
+	return nodes, nil
+}
+
+func (p *BoltProvider) GetAllVersionEdgesForMap(codebaseID string) ([]VersionEdge, error) {
+	var edges []VersionEdge
+	err := p.db.View(func(tx *bolt.Tx) error {
+		records, err := edgesOfCodebase(tx, codebaseID)
+		for _, m := range records {
+			edges = append(edges, VersionEdge{From: m.ParentVersionID, To: m.ChildVersionID, LinkageType: m.LinkageType})
+		}
+		return err
+	})
+	return edges, err
+}
+
+func (p *BoltProvider) GetBranchHeadsForMap(codebaseID string) (map[string]string, error) {
+	heads := make(map[string]string)
+	err := p.db.View(func(tx *bolt.Tx) error {
+		versions, err := versionsIn(tx, indexCodebaseVersion, boltPrefix(codebaseID))
+		if err != nil {
+			return err
+		}
+		for _, v := range versions {
+			if _, ok := heads[v.Branch]; !ok {
+				heads[v.Branch] = v.ID
+			}
+		}
+		// Branches declared without a snapshot point at their source version
+		refs, err := listRecords[BranchRef](tx.Bucket(bucketRefs), boltPrefix(codebaseID))
+		for _, ref := range refs {
+			if _, ok := heads[ref.Branch]; !ok {
+				heads[ref.Branch] = ref.VersionID
+			}
+		}
+		return err
+	})
+	return heads, err
+}
+
+func (p *BoltProvider) CreateBranchRef(ref *BranchRef) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		key := boltKey(ref.CodebaseID, ref.Branch)
+		if tx.Bucket(bucketRefs).Get(key) != nil {
+			return fmt.Errorf("branch ref %s already exists", ref.Branch)
+		}
+		return putRecord(tx.Bucket(bucketRefs), key, ref)
+	})
+}
+
+func (p *BoltProvider) GetBranchRef(codebaseID, branch string) (*BranchRef, error) {
+	var ref BranchRef
+	var ok bool
+	err := p.db.View(func(tx *bolt.Tx) error {
+		var err error
+		ok, err = getRecord(tx.Bucket(bucketRefs), boltKey(codebaseID, branch), &ref)
+		return err
+	})
+	if err != nil || !ok {
+		return nil, err // No explicit ref
+	}
+	return &ref, nil
+}
+
+func (p *BoltProvider) DeleteBranchRef(codebaseID, branch string) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRefs).Delete(boltKey(codebaseID, branch))
+	})
+}
+
+// ListBranchRefs returns the explicit branch refs of a codebase sorted by branch.
+func (p *BoltProvider) ListBranchRefs(codebaseID string) ([]*BranchRef, error) {
+	var refs []*BranchRef
+	err := p.db.View(func(tx *bolt.Tx) error {
+		var err error
+		refs, err = listRecords[BranchRef](tx.Bucket(bucketRefs), boltPrefix(codebaseID))
+		return err
+	})
+	return refs, err
+}
+
+// RelabelBranch moves every version, lineage record and the branch ref of branch from onto branch to.
+// Version IDs and edges are untouched, so lineage is preserved. It fails without changing anything
+// when a version label exists on both branches.
+func (p *BoltProvider) RelabelBranch(codebaseID, from, to string) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		moved, err := versionsIn(tx, indexBranchVersions, boltPrefix(codebaseID, from))
+		if err != nil {
+			return err
+		}
+		for _, v := range moved {
+			if tx.Bucket(indexVersionNames).Get(boltKey(codebaseID, to, v.Version)) != nil {
+				return fmt.Errorf("version %s already exists on branch %s", v.Version, to)
+			}
+		}
+		refs := tx.Bucket(bucketRefs)
+		var ref BranchRef
+		hasRef, err := getRecord(refs, boltKey(codebaseID, from), &ref)
+		if err != nil {
+			return err
+		}
+		if len(moved) == 0 && !hasRef {
+			return fmt.Errorf("branch %s not found", from)
+		}
+
+		for _, v := range moved {
+			if err := removeVersion(tx, v); err != nil {
+				return err
+			}
+			v.Branch = to
+			if err := putVersion(tx, v); err != nil {
+				return err
+			}
+		}
+		edges, err := edgesOfCodebase(tx, codebaseID)
+		if err != nil {
+			return err
+		}
+		for _, edge := range edges {
+			if edge.Branch == from {
+				edge.Branch = to
+				if err := putRecord(tx.Bucket(bucketEdges), []byte(edge.ID), edge); err != nil {
+					return err
+				}
+			}
+		}
+		if hasRef {
+			if err := refs.Delete(boltKey(codebaseID, from)); err != nil {
+				return err
+			}
+			// A ref only matters while its branch has no versions of its own
+			if refs.Get(boltKey(codebaseID, to)) == nil && len(moved) == 0 {
+				ref.Branch = to
+				if err := putRecord(refs, boltKey(codebaseID, to), &ref); err != nil {
+					return err
+				}
+			}
+		}
+		var codebase Codebase
+		if ok, err := getRecord(tx.Bucket(bucketCodebases), []byte(codebaseID), &codebase); err != nil {
+			return err
+		} else if ok && codebase.Branch == from {
+			codebase.Branch = to
+			return putRecord(tx.Bucket(bucketCodebases), []byte(codebaseID), &codebase)
+		}
+		return nil
+	})
+}
+
+// CreateTag stores a new tag; tag names are unique per codebase.
+func (p *BoltProvider) CreateTag(tag *Tag) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		key := boltKey(tag.CodebaseID, tag.Name)
+		if tx.Bucket(bucketTags).Get(key) != nil {
+			return fmt.Errorf("tag %s already exists", tag.Name)
+		}
+		if tx.Bucket(bucketVersions).Get([]byte(tag.VersionID)) == nil {
+			return fmt.Errorf("version %s not found", tag.VersionID)
+		}
+		return putRecord(tx.Bucket(bucketTags), key, tag)
+	})
+}
+
+func (p *BoltProvider) DeleteTag(codebaseID, name string) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		key := boltKey(codebaseID, name)
+		if tx.Bucket(bucketTags).Get(key) == nil {
+			return fmt.Errorf("tag %s not found", name)
+		}
+		return tx.Bucket(bucketTags).Delete(key)
+	})
+}
+
+// ListTags returns the tags of a codebase sorted by name.
+func (p *BoltProvider) ListTags(codebaseID string) ([]*Tag, error) {
+	var tags []*Tag
+	err := p.db.View(func(tx *bolt.Tx) error {
+		var err error
+		tags, err = listRecords[Tag](tx.Bucket(bucketTags), boltPrefix(codebaseID))
+		return err
+	})
+	return tags, err
+}
+
+func (p *BoltProvider) ResolveTag(codebaseID, name string) (*Tag, error) {
+	var tag Tag
+	var ok bool
+	err := p.db.View(func(tx *bolt.Tx) error {
+		var err error
+		ok, err = getRecord(tx.Bucket(bucketTags), boltKey(codebaseID, name), &tag)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("tag %s not found", name)
+	}
+	return &tag, nil
+}
+
+// CreateWebhook stores a new webhook subscription.
+func (p *BoltProvider) CreateWebhook(hook *Webhook) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketWebhooks).Get([]byte(hook.ID)) != nil {
+			return fmt.Errorf("webhook %s already exists", hook.ID)
+		}
+		return putRecord(tx.Bucket(bucketWebhooks), []byte(hook.ID), hook)
+	})
+}
+
+func (p *BoltProvider) DeleteWebhook(id string) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketWebhooks).Get([]byte(id)) == nil {
+			return fmt.Errorf("webhook %s not found", id)
+		}
+		return tx.Bucket(bucketWebhooks).Delete([]byte(id))
+	})
+}
+
+// ListWebhooks returns all webhook subscriptions, oldest first.
+func (p *BoltProvider) ListWebhooks() ([]*Webhook, error) {
+	var hooks []*Webhook
+	err := p.db.View(func(tx *bolt.Tx) error {
+		var err error
+		hooks, err = listRecords[Webhook](tx.Bucket(bucketWebhooks), nil)
+		return err
+	})
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt.Before(hooks[j].CreatedAt) })
+	return hooks, err
+}
+
+// SaveQuarantineEntry records or replaces the quarantine entry of a storage key.
+func (p *BoltProvider) SaveQuarantineEntry(entry *QuarantineEntry) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		return putRecord(tx.Bucket(bucketQuarantine), []byte(entry.StorageKey), entry)
+	})
+}
+
+// ListQuarantineEntries returns all quarantined objects, oldest detection first.
+func (p *BoltProvider) ListQuarantineEntries() ([]*QuarantineEntry, error) {
+	var entries []*QuarantineEntry
+	err := p.db.View(func(tx *bolt.Tx) error {
+		var err error
+		entries, err = listRecords[QuarantineEntry](tx.Bucket(bucketQuarantine), nil)
+		return err
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].DetectedAt.Before(entries[j].DetectedAt) })
+	return entries, err
+}
+
+func (p *BoltProvider) DeleteQuarantineEntry(storageKey string) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketQuarantine).Get([]byte(storageKey)) == nil {
+			return fmt.Errorf("quarantine entry %s not found", storageKey)
+		}
+		return tx.Bucket(bucketQuarantine).Delete([]byte(storageKey))
+	})
+}
+
+// AppendAuditEntry adds an entry to the audit log.
+func (p *BoltProvider) AppendAuditEntry(entry *AuditEntry) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketAudit).Get([]byte(entry.ID)) != nil {
+			return fmt.Errorf("audit entry %s already exists", entry.ID)
+		}
+		return putRecord(tx.Bucket(bucketAudit), []byte(entry.ID), entry)
+	})
+}
+
+// ListAuditEntries returns the audit log, oldest entry first.
+func (p *BoltProvider) ListAuditEntries() ([]*AuditEntry, error) {
+	var entries []*AuditEntry
+	err := p.db.View(func(tx *bolt.Tx) error {
+		var err error
+		entries, err = listRecords[AuditEntry](tx.Bucket(bucketAudit), nil)
+		return err
+	})
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries, err
+}
+
+// SaveIdempotencyRecord records or replaces the result of an idempotency key.
+func (p *BoltProvider) SaveIdempotencyRecord(record *IdempotencyRecord) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		return putRecord(tx.Bucket(bucketIdempotent), boltKey(record.CodebaseID, record.Key), record)
+	})
+}
+
+func (p *BoltProvider) GetIdempotencyRecord(codebaseID, key string) (*IdempotencyRecord, error) {
+	var record IdempotencyRecord
+	var ok bool
+	err := p.db.View(func(tx *bolt.Tx) error {
+		var err error
+		ok, err = getRecord(tx.Bucket(bucketIdempotent), boltKey(codebaseID, key), &record)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("idempotency key %s not found", key)
+	}
+	return &record, nil
+}
+
+// ListIdempotencyRecords returns all recorded idempotency keys, oldest first.
+func (p *BoltProvider) ListIdempotencyRecords() ([]*IdempotencyRecord, error) {
+	var records []*IdempotencyRecord
+	err := p.db.View(func(tx *bolt.Tx) error {
+		var err error
+		records, err = listRecords[IdempotencyRecord](tx.Bucket(bucketIdempotent), nil)
+		return err
+	})
+	sort.Slice(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+	return records, err
+}
+
+func (p *BoltProvider) DeleteExpiredIdempotencyRecords(now time.Time) (int, error) {
+	expired := 0
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketIdempotent)
+		var keys [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var record IdempotencyRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("record %q: %w", k, err)
+			}
+			if record.ExpiresAt.Before(now) {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		expired = len(keys)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return expired, nil
+}
+
+func (p *BoltProvider) GetHistoryCache(codebaseID string) ([]byte, error) {
+	var data []byte
+	err := p.db.View(func(tx *bolt.Tx) error {
+		cached := tx.Bucket(bucketHistory).Get([]byte(codebaseID))
+		if cached == nil {
+			return fmt.Errorf("cache not found")
+		}
+		// Values are only valid during the transaction
+		data = append([]byte(nil), cached...)
+		return nil
+	})
+	return data, err
+}
+
+func (p *BoltProvider) UpdateHistoryCache(codebaseID string, data []byte) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketHistory).Put([]byte(codebaseID), data)
+	})
+}
+
+func (p *BoltProvider) DeleteHistoryCache(codebaseID string) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketHistory).Delete([]byte(codebaseID))
+	})
+}
+
+// ListHistoryCaches returns the codebase IDs that have a history cache.
+func (p *BoltProvider) ListHistoryCaches() ([]string, error) {
+	var ids []string
+	err := p.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketHistory).ForEach(func(k, _ []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	return ids, err
+}
+
+// BlobRefCounts returns how many file trees reference each of keys; unreferenced keys map to zero.
+func (p *BoltProvider) BlobRefCounts(keys []string) (map[string]int, error) {
+	counts := make(map[string]int, len(keys))
+	err := p.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketBlobRefs)
+		for _, key := range keys {
+			counts[key] = int(blobRefCount(b, key))
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// ListBlobRefs calls fn for every referenced storage key starting with prefix, sorted by key. fn runs
+// after the read transaction ended, so it may change the provider.
+func (p *BoltProvider) ListBlobRefs(prefix string, fn func(key string, refs int) error) error {
+	var keys []string
+	var refs []int
+	err := p.db.View(func(tx *bolt.Tx) error {
+		return scanPrefix(tx.Bucket(bucketBlobRefs), []byte(prefix), func(k, v []byte) error {
+			keys = append(keys, string(k))
+			refs = append(refs, int(binary.BigEndian.Uint64(v)))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		if err := fn(key, refs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RewriteStorageKeys replaces the storage keys of every file tree according to keys (old -> new),
+// recounting the references, and returns how many file entries changed.
+func (p *BoltProvider) RewriteStorageKeys(keys map[string]string) (int, error) {
+	changed := 0
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketTrees)
+		rewritten := make(map[string][]File)
+		err := b.ForEach(func(k, v []byte) error {
+			var files []File
+			if err := json.Unmarshal(v, &files); err != nil {
+				return fmt.Errorf("tree %s: %w", k, err)
+			}
+			treeChanged := false
+			for i, f := range files {
+				if updated, ok := rewriteFileKeys(f, keys); ok {
+					files[i] = updated
+					treeChanged = true
+					changed++
+				}
+			}
+			if treeChanged {
+				rewritten[string(k)] = files
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for treeID, files := range rewritten {
+			if err := putRecord(b, []byte(treeID), files); err != nil {
+				return err
+			}
+		}
+		_, err = recountBlobRefs(tx)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return changed, nil
+}
+
+// RebuildIndexes rebuilds the index buckets and blob reference counts from the records, removes branch
+// refs pointing at missing versions and reports the inconsistencies found.
+func (p *BoltProvider) RebuildIndexes() (*IndexRebuildReport, error) {
+	report := &IndexRebuildReport{
+		DanglingRefs:  []BranchRef{},
+		OrphanTrees:   []string{},
+		MissingTrees:  []string{},
+		DanglingEdges: []string{},
+	}
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range boltIndexes {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		versions, err := listRecords[Version](tx.Bucket(bucketVersions), nil)
+		if err != nil {
+			return err
+		}
+		usedTrees := make(map[string]bool, len(versions))
+		for _, v := range versions {
+			if err := putVersion(tx, v); err != nil {
+				return err
+			}
+			usedTrees[v.TreeID] = true
+			if tx.Bucket(bucketTrees).Get([]byte(v.TreeID)) == nil {
+				report.MissingTrees = append(report.MissingTrees, v.ID)
+			}
+		}
+		tx.Bucket(bucketTrees).ForEach(func(k, _ []byte) error {
+			if !usedTrees[string(k)] {
+				report.OrphanTrees = append(report.OrphanTrees, string(k))
+			}
+			return nil
+		})
+		edges, err := listRecords[versionMappingRecord](tx.Bucket(bucketEdges), nil)
+		if err != nil {
+			return err
+		}
+		for _, edge := range edges {
+			if err := putEdge(tx, edge); err != nil {
+				return err
+			}
+			if tx.Bucket(bucketVersions).Get([]byte(edge.ChildVersionID)) == nil || tx.Bucket(bucketVersions).Get([]byte(edge.ParentVersionID)) == nil {
+				report.DanglingEdges = append(report.DanglingEdges, edge.ID)
+			}
+		}
+		refs, err := listRecords[BranchRef](tx.Bucket(bucketRefs), nil)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			if tx.Bucket(bucketVersions).Get([]byte(ref.VersionID)) == nil {
+				report.DanglingRefs = append(report.DanglingRefs, *ref)
+				if err := tx.Bucket(bucketRefs).Delete(boltKey(ref.CodebaseID, ref.Branch)); err != nil {
+					return err
+				}
+			}
+		}
+		report.RepairedBlobRefs, err = recountBlobRefs(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(report.OrphanTrees)
+	sort.Strings(report.MissingTrees)
+	sort.Strings(report.DanglingEdges)
+	return report, nil
+}
+
+// CheckConsistency scans the records for references to records that don't exist. With repair the
+// dangling edges, branch refs and tags are removed; versions and trees are only reported.
+func (p *BoltProvider) CheckConsistency(repair bool) (*ConsistencyReport, error) {
+	report := &ConsistencyReport{
+		MissingTrees:        []string{},
+		OrphanTrees:         []string{},
+		OrphanVersions:      []string{},
+		DanglingEdges:       []string{},
+		DanglingRefs:        []BranchRef{},
+		DanglingTags:        []Tag{},
+		OrphanHistoryCaches: []string{},
+	}
+	check := func(tx *bolt.Tx) error {
+		versions := tx.Bucket(bucketVersions)
+		records, err := listRecords[Version](versions, nil)
+		if err != nil {
+			return err
+		}
+		usedTrees := make(map[string]bool, len(records))
+		for _, v := range records {
+			usedTrees[v.TreeID] = true
+			if tx.Bucket(bucketTrees).Get([]byte(v.TreeID)) == nil {
+				report.MissingTrees = append(report.MissingTrees, v.ID)
+			}
+			if tx.Bucket(bucketCodebases).Get([]byte(v.CodebaseID)) == nil {
+				report.OrphanVersions = append(report.OrphanVersions, v.ID)
+			}
+		}
+		tx.Bucket(bucketTrees).ForEach(func(k, _ []byte) error {
+			if !usedTrees[string(k)] {
+				report.OrphanTrees = append(report.OrphanTrees, string(k))
+			}
+			return nil
+		})
+
+		edges, err := listRecords[versionMappingRecord](tx.Bucket(bucketEdges), nil)
+		if err != nil {
+			return err
+		}
+		var danglingEdges []*versionMappingRecord
+		for _, edge := range edges {
+			if versions.Get([]byte(edge.ChildVersionID)) == nil || versions.Get([]byte(edge.ParentVersionID)) == nil {
+				report.DanglingEdges = append(report.DanglingEdges, edge.ID)
+				danglingEdges = append(danglingEdges, edge)
+			}
+		}
+		refs, err := listRecords[BranchRef](tx.Bucket(bucketRefs), nil)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			if versions.Get([]byte(ref.VersionID)) == nil {
+				report.DanglingRefs = append(report.DanglingRefs, *ref)
+			}
+		}
+		tags, err := listRecords[Tag](tx.Bucket(bucketTags), nil)
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			if versions.Get([]byte(tag.VersionID)) == nil {
+				report.DanglingTags = append(report.DanglingTags, *tag)
+			}
+		}
+		if !repair {
+			return nil
+		}
+		for _, edge := range danglingEdges {
+			if err := removeEdge(tx, edge); err != nil {
+				return err
+			}
+		}
+		for _, ref := range report.DanglingRefs {
+			if err := tx.Bucket(bucketRefs).Delete(boltKey(ref.CodebaseID, ref.Branch)); err != nil {
+				return err
+			}
+		}
+		for _, tag := range report.DanglingTags {
+			if err := tx.Bucket(bucketTags).Delete(boltKey(tag.CodebaseID, tag.Name)); err != nil {
+				return err
+			}
+		}
+		report.Repaired = len(danglingEdges) + len(report.DanglingRefs) + len(report.DanglingTags)
+		return nil
+	}
+	var err error
+	if repair {
+		err = p.db.Update(check)
+	} else {
+		err = p.db.View(check)
+	}
+	if err != nil {
+		if repair {
+			return nil, fmt.Errorf("repair failed: %w", err)
+		}
+		return nil, err
+	}
+
+	sort.Strings(report.MissingTrees)
+	sort.Strings(report.OrphanTrees)
+	sort.Strings(report.OrphanVersions)
+	sort.Strings(report.DanglingEdges)
+	sort.Slice(report.DanglingRefs, func(i, j int) bool {
+		a, b := report.DanglingRefs[i], report.DanglingRefs[j]
+		return a.CodebaseID < b.CodebaseID || a.CodebaseID == b.CodebaseID && a.Branch < b.Branch
+	})
+	sort.Slice(report.DanglingTags, func(i, j int) bool {
+		a, b := report.DanglingTags[i], report.DanglingTags[j]
+		return a.CodebaseID < b.CodebaseID || a.CodebaseID == b.CodebaseID && a.Name < b.Name
+	})
+	return report, nil
+}
+
+// Flush has nothing to write: every call commits its transaction, and bbolt syncs it, before returning.
+func (p *BoltProvider) Flush() error {
+	return nil
+}
+
+// MetadataRecoveries is always empty, a bbolt database isn't restored from backups.
+func (p *BoltProvider) MetadataRecoveries() ([]MetadataRecovery, error) {
+	return []MetadataRecovery{}, nil
+}
+
+// TreeCacheStats is empty, trees are read from the memory-mapped database rather than cached.
+func (p *BoltProvider) TreeCacheStats() TreeCacheStats {
+	return TreeCacheStats{}
+}
+
+// ConvertMetadataEncoding converts nothing, records in the database are always JSON.
+func (p *BoltProvider) ConvertMetadataEncoding() (*EncodingConversion, error) {
+	return &EncodingConversion{Encoding: EncodingJSON}, nil
+}
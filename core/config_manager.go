@@ -2,16 +2,179 @@ package core
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 )
 
 // AppConfig defines application configuration parameters.
 type AppConfig struct {
 	StoragePath string `json:"storage_path"`
+
+	// ProviderType selects the metadata backend, "json" (default), "bolt" or "memory"; see RegisterProvider.
+	ProviderType string `json:"provider_type,omitempty"`
+	// ProviderConfig is passed to the selected metadata backend, e.g. {"path": "..."} for "json".
+	ProviderConfig json.RawMessage `json:"provider_config,omitempty"`
+	// StorageType selects the object storage backend, "local" (default) or "memory"; see RegisterStorage.
+	StorageType string `json:"storage_type,omitempty"`
+	// StorageConfig is passed to the selected storage backend, e.g. {"path": "..."} for "local".
+	StorageConfig json.RawMessage `json:"storage_config,omitempty"`
+	// EncryptionKey enables AES-256-GCM encryption of stored objects with a 32 byte key, hex or base64.
+	EncryptionKey string `json:"encryption_key,omitempty"`
+	// EncryptionKeyFile reads the encryption key from a file instead, as hex, base64 or 32 raw bytes.
+	EncryptionKeyFile string `json:"encryption_key_file,omitempty"`
+
+	// ReadCacheBytes is the memory budget of the decompressed blob read cache, zero disables it.
+	ReadCacheBytes int64 `json:"read_cache_bytes,omitempty"`
+	// ReadCacheMaxEntryBytes caps the size of a single cached blob so huge files can't evict everything.
+	ReadCacheMaxEntryBytes int64 `json:"read_cache_max_entry_bytes,omitempty"`
+
+	// TrashRetentionHours is how long trashed codebases are kept before being purged, zero means the default.
+	TrashRetentionHours int `json:"trash_retention_hours,omitempty"`
+	// TrashPurgeIntervalMinutes is how often the purge scheduler looks for expired trash, zero means the default.
+	TrashPurgeIntervalMinutes int `json:"trash_purge_interval_minutes,omitempty"`
+
+	// BackgroundMaxConcurrency limits how many maintenance jobs run at once, zero means the default (1).
+	BackgroundMaxConcurrency int `json:"background_max_concurrency,omitempty"`
+	// BackgroundIORateBytes limits the combined disk IO of maintenance jobs per second, zero means unlimited.
+	BackgroundIORateBytes int64 `json:"background_io_rate_bytes,omitempty"`
+
+	// MaxFilesPerSnapshot caps the number of files accepted in one snapshot upload, zero means unlimited.
+	MaxFilesPerSnapshot int `json:"max_files_per_snapshot,omitempty"`
+	// MaxSnapshotBytes caps the bytes uploaded with one snapshot, zero means unlimited. Codebases can set a lower limit.
+	MaxSnapshotBytes int64 `json:"max_snapshot_bytes,omitempty"`
+	// MaxFileBytes caps the size of a single uploaded file, zero means unlimited.
+	MaxFileBytes int64 `json:"max_file_bytes,omitempty"`
+
+	// Compression selects the algorithm new compressed objects are stored with, nil means the default (zlib).
+	Compression *CompressionConfig `json:"compression,omitempty"`
+
+	// FileWorkers limits how many files a snapshot stores or an archive restores at once, zero means the default (2 per CPU).
+	FileWorkers int `json:"file_workers,omitempty"`
+	// SpoolArchives writes archives to a temporary file and sends them with a Content-Length, false streams them as they are built.
+	SpoolArchives bool `json:"spool_archives,omitempty"`
+
+	// VersionNamePrefix precedes the number of version names generated for snapshots uploaded without one, empty means the default ("v").
+	VersionNamePrefix string `json:"version_name_prefix,omitempty"`
+
+	// UploadSessionTTLSeconds is how long an upload session is kept after its last upload, zero means the default (86400).
+	UploadSessionTTLSeconds int64 `json:"upload_session_ttl_seconds,omitempty"`
+
+	// LocalSnapshotRoots lists the server directories whose subtrees a snapshot may read through codebase_path, empty disables local snapshots.
+	LocalSnapshotRoots []string `json:"local_snapshot_roots,omitempty"`
+	// GitImportEnabled allows snapshots imported from git repositories, off by default since the server clones what the request names.
+	GitImportEnabled bool `json:"git_import_enabled,omitempty"`
+	// GitImportHosts lists the hosts repositories may be imported from, e.g. "github.com"; empty refuses every import.
+	GitImportHosts []string `json:"git_import_hosts,omitempty"`
+	// WebhookHosts lists the hosts webhooks may deliver to, e.g. "ci.example.com"; empty refuses every webhook.
+	WebhookHosts []string `json:"webhook_hosts,omitempty"`
+	// WebhookAllowPrivateNetworks lets webhooks deliver to loopback, private and link-local addresses, off by default.
+	WebhookAllowPrivateNetworks bool `json:"webhook_allow_private_networks,omitempty"`
+	// ObjectAPIKeys are the keys accepted by the hash-addressed object download; empty disables the download.
+	ObjectAPIKeys []ObjectAPIKey `json:"object_api_keys,omitempty"`
+
+	// SnapshotJobWorkers limits how many asynchronous snapshots are processed at once, zero means the default (2).
+	SnapshotJobWorkers int `json:"snapshot_job_workers,omitempty"`
+	// SnapshotJobRetentionSeconds is how long a finished snapshot job can still be queried, zero means the default (3600).
+	SnapshotJobRetentionSeconds int64 `json:"snapshot_job_retention_seconds,omitempty"`
+	// IdempotencyKeyRetentionSeconds is how long the idempotency key of a snapshot replays its response, zero means the default (86400).
+	IdempotencyKeyRetentionSeconds int64 `json:"idempotency_key_retention_seconds,omitempty"`
+
+	// ChunkingThresholdBytes enables content-defined chunked storage for files larger than this size, zero disables it.
+	ChunkingThresholdBytes int64 `json:"chunking_threshold_bytes,omitempty"`
+
+	// GlobalBlobNamespace stores new objects under "blobs/<sha256>", shared by all codebases, instead of "<codebase>/<sha256>".
+	GlobalBlobNamespace bool `json:"global_blob_namespace,omitempty"`
+
+	// EphemeralSweepIntervalSeconds is how often expired ephemeral codebases are purged, zero means the default (60).
+	EphemeralSweepIntervalSeconds int `json:"ephemeral_sweep_interval_seconds,omitempty"`
+
+	// StorageProbeIntervalSeconds is how often the storage backend is probed with a canary object, zero means the default (30).
+	StorageProbeIntervalSeconds int `json:"storage_probe_interval_seconds,omitempty"`
+
+	// PinnedCodebases lists codebases whose history caches are rebuilt at startup and served from memory.
+	PinnedCodebases []string `json:"pinned_codebases,omitempty"`
+	// WarmupConcurrency limits how many history caches the startup warm-up checks at once, zero means the default (2).
+	WarmupConcurrency int `json:"warmup_concurrency,omitempty"`
+
+	// DefaultCodebaseSettings seeds the settings of every new codebase for fields the client leaves unspecified.
+	DefaultCodebaseSettings *CodebaseSettings `json:"default_codebase_settings,omitempty"`
+}
+
+// ObjectAPIKey is a key for the hash-addressed object download, sent as "Authorization: Bearer <key>".
+type ObjectAPIKey struct {
+	Key string `json:"key"`
+	// Codebases lists the IDs of the codebases content is served from with the key, empty means all of them.
+	Codebases []string `json:"codebases,omitempty"`
+}
+
+// CompressionConfig configures how new content is compressed. Files record the algorithm they were
+// stored with, so changing it leaves existing content readable.
+type CompressionConfig struct {
+	// Algorithm is "zlib" (default) or "zstd".
+	Algorithm string `json:"algorithm,omitempty"`
+	// SkipTypes lists formats stored without compression: extensions such as ".zip", or prefixes of the
+	// sniffed MIME type such as "video/". Empty means the default list of archive, media and font formats.
+	SkipTypes []string `json:"skip_types,omitempty"`
+}
+
+// Validate rejects an unknown algorithm and malformed skip types; a nil config is valid.
+func (c *CompressionConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	switch c.Algorithm {
+	case "", EncodingZlib, EncodingZstd:
+	default:
+		return fmt.Errorf("invalid config: unknown compression algorithm %q (supported: %s, %s)", c.Algorithm, EncodingZlib, EncodingZstd)
+	}
+	for _, t := range c.SkipTypes {
+		if !strings.HasPrefix(t, ".") && !strings.Contains(t, "/") {
+			return fmt.Errorf("invalid config: compression skip type %q is neither an extension (\".zip\") nor a MIME type (\"video/\")", t)
+		}
+	}
+	return nil
+}
+
+// CompressionAlgorithm returns the algorithm new compressed objects are stored with, "zlib" when unset.
+func (c AppConfig) CompressionAlgorithm() string {
+	if c.Compression == nil || c.Compression.Algorithm == "" {
+		return EncodingZlib
+	}
+	return c.Compression.Algorithm
+}
+
+// CompressionSkipTypes returns the configured formats stored without compression, nil when unset.
+func (c AppConfig) CompressionSkipTypes() []string {
+	if c.Compression == nil {
+		return nil
+	}
+	return c.Compression.SkipTypes
+}
+
+// ProviderTypeOrDefault returns the configured metadata backend, "json" when unset.
+func (c AppConfig) ProviderTypeOrDefault() string {
+	if c.ProviderType == "" {
+		return ProviderTypeJSON
+	}
+	return c.ProviderType
+}
+
+// EncryptionEnabled reports whether stored objects are encrypted.
+func (c AppConfig) EncryptionEnabled() bool {
+	return c.EncryptionKey != "" || c.EncryptionKeyFile != ""
+}
+
+// StorageTypeOrDefault returns the configured object storage backend, "local" when unset.
+func (c AppConfig) StorageTypeOrDefault() string {
+	if c.StorageType == "" {
+		return StorageTypeLocal
+	}
+	return c.StorageType
 }
 
 var (
@@ -36,6 +199,11 @@ func getConfigFilePath() (string, error) {
 	return filepath.Join(userConfigDir, configDirName, configFileName), nil
 }
 
+// ConfigFilePath returns the path of the configuration file the server reads and writes.
+func ConfigFilePath() (string, error) {
+	return getConfigFilePath()
+}
+
 // LoadConfig loads configuration from user config directory.
 // If file doesn't exist, initializes with default values and saves.
 func LoadConfig() {
@@ -101,6 +269,17 @@ func GetConfig() AppConfig {
 	return *globalConfig
 }
 
+// SetConfigForTesting installs cfg as the configuration without reading or writing the config file.
+// Use it before the first service call, together with SetProvidersForTesting.
+func SetConfigForTesting(cfg AppConfig) {
+	configOnce.Do(func() {
+		globalConfig = &AppConfig{}
+	})
+	configMu.Lock()
+	defer configMu.Unlock()
+	*globalConfig = cfg
+}
+
 // UpdateConfig updates configuration in memory and persists it to file.
 func UpdateConfig(newConfig AppConfig) error {
 	LoadConfig() // Ensure initialized
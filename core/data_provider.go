@@ -8,24 +8,102 @@ type DataProvider interface {
 	// Codebase 操作
 	CreateCodebase(codebase *Codebase) error
 	GetCodebaseByID(id string) (*Codebase, error)
+	ListCodebases() ([]*Codebase, error)
+	UpdateCodebase(codebase *Codebase) error
 	DeleteCodebaseByID(id string) error
 	UpdateCodebaseTimestamp(id string, t time.Time) error
+	// CloneCodebase 创建 target 并复制源代码库的全部版本、文件索引、血缘记录、分支引用和标签，版本与文件树使用新 ID；返回旧版本 ID 到新版本 ID 的映射
+	CloneCodebase(sourceID string, target *Codebase) (map[string]string, error)
 
 	// Version 操作
+	// CreateVersion 保存版本及其文件树；分支上已有同名版本时返回 *VersionExistsError
 	CreateVersion(version *Version, files []File) error
 	GetVersion(codebaseID, branch, version string) (*Version, error)
+	FindBranchesWithVersion(codebaseID, version string) ([]string, error)
+	GetVersionByID(id string) (*Version, error)
+	ListVersions(codebaseID string) ([]*Version, error)
 	GetFileIndexesByTreeID(treeID string) ([]File, error)
 	FindLatestVersionInBranch(codebaseID, branch, excludeVersionID string) (*Version, error)
 	IsNewBranch(codebaseID, branch, excludeVersionID string) (bool, error)
-	FindLatestVersionInMain(codebaseID string) (*Version, error)
+	FindLatestVersionInDefaultBranch(codebaseID string) (*Version, error)
+	// ReplaceVersion 用 version 替换同一分支上同名的旧版本：旧版本及其文件树被删除，其双向血缘记录和分支引用改为指向 version
+	ReplaceVersion(oldVersionID string, version *Version, files []File) error
+	// DeleteVersion 删除版本及其文件树和指向它的血缘记录；以它为父版本的子版本和分支引用改为指向 reparentTo，reparentTo 为空时一并移除
+	DeleteVersion(versionID, reparentTo string) error
+	// SetVersionFlags 设置版本的锁定和固定状态
+	SetVersionFlags(versionID string, locked, pinned bool) error
 
 	// History 和 Linkage 操作
 	CreateVersionLink(codebaseID, childID, parentID, branch string, linkType LinkageType) error
+	CreateVersionLinks(links []VersionLink) error
+	// DeleteVersionLink 删除 child 与 parent 之间的血缘记录，不存在时返回 not found
+	DeleteVersionLink(childID, parentID string) error
 	GetAllVersionsForMap(codebaseID string) ([]VersionNode, error)
 	GetAllVersionEdgesForMap(codebaseID string) ([]VersionEdge, error)
 	GetBranchHeadsForMap(codebaseID string) (map[string]string, error)
 
+	// Branch Ref 操作
+	CreateBranchRef(ref *BranchRef) error
+	GetBranchRef(codebaseID, branch string) (*BranchRef, error)
+	DeleteBranchRef(codebaseID, branch string) error
+	ListBranchRefs(codebaseID string) ([]*BranchRef, error)
+	// RelabelBranch 将一个分支的全部版本、血缘记录和分支引用改记到另一个分支名下，版本 ID 与血缘关系保持不变
+	RelabelBranch(codebaseID, from, to string) error
+
+	// Tag 操作
+	CreateTag(tag *Tag) error
+	DeleteTag(codebaseID, name string) error
+	ListTags(codebaseID string) ([]*Tag, error)
+	ResolveTag(codebaseID, name string) (*Tag, error)
+
+	// Webhook 操作
+	CreateWebhook(hook *Webhook) error
+	DeleteWebhook(id string) error
+	ListWebhooks() ([]*Webhook, error)
+
 	// History Cache 操作
 	GetHistoryCache(codebaseID string) ([]byte, error)
 	UpdateHistoryCache(codebaseID string, data []byte) error
+	DeleteHistoryCache(codebaseID string) error
+	ListHistoryCaches() ([]string, error)
+
+	// Quarantine 操作
+	SaveQuarantineEntry(entry *QuarantineEntry) error
+	ListQuarantineEntries() ([]*QuarantineEntry, error)
+	DeleteQuarantineEntry(storageKey string) error
+
+	// Audit log 操作，记录只追加不修改，删除代码库时保留
+	AppendAuditEntry(entry *AuditEntry) error
+	// ListAuditEntries 按时间顺序返回全部审计记录
+	ListAuditEntries() ([]*AuditEntry, error)
+
+	// Idempotency key 操作，键在代码库内唯一，删除代码库时一并删除
+	SaveIdempotencyRecord(record *IdempotencyRecord) error
+	// GetIdempotencyRecord 返回代码库中幂等键的记录，不存在时返回 not found（过期与否由调用方判断）
+	GetIdempotencyRecord(codebaseID, key string) (*IdempotencyRecord, error)
+	ListIdempotencyRecords() ([]*IdempotencyRecord, error)
+	// DeleteExpiredIdempotencyRecords 删除 ExpiresAt 早于 now 的记录，返回删除的数量
+	DeleteExpiredIdempotencyRecords(now time.Time) (int, error)
+
+	// 对象引用计数：每个存储对象被多少棵文件树引用，由 CreateVersion 及版本/代码库删除维护
+	BlobRefCounts(keys []string) (map[string]int, error)
+	// ListBlobRefs 按 key 顺序回调以 prefix 开头且仍被引用的存储对象及其引用数
+	ListBlobRefs(prefix string, fn func(key string, refs int) error) error
+	// RewriteStorageKeys 按 旧 key -> 新 key 替换所有文件树中的存储键并重新计数，返回修改的文件条目数
+	RewriteStorageKeys(keys map[string]string) (int, error)
+
+	// 维护操作
+	// RebuildIndexes 从原始数据重建内存索引和对象引用计数，移除指向不存在版本的分支引用，并报告发现的不一致
+	RebuildIndexes() (*IndexRebuildReport, error)
+	// CheckConsistency 扫描所有记录，报告缺失的文件树、孤立的版本和文件树以及悬空的血缘边、分支引用和标签；
+	// repair 为 true 时移除悬空的血缘边、分支引用和标签。历史缓存由调用方通过 ListHistoryCaches 检查
+	CheckConsistency(repair bool) (*ConsistencyReport, error)
+	// Flush 将尚未写入的修改立即持久化，返回时修改已落盘
+	Flush() error
+	// MetadataRecoveries 返回打开以来因损坏而从备份恢复的元数据文件
+	MetadataRecoveries() ([]MetadataRecovery, error)
+	// TreeCacheStats 返回文件树缓存的当前大小、预算以及命中和淘汰计数
+	TreeCacheStats() TreeCacheStats
+	// ConvertMetadataEncoding 将编码与当前配置不同的版本文件和文件树按配置的编码重写
+	ConvertMetadataEncoding() (*EncodingConversion, error)
 }
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// dirLockFile is created in a metadata directory by the process using it
+const dirLockFile = "cvcs.lock"
+
+// errLockHeld is returned by lockFile when another open file holds the lock
+var errLockHeld = errors.New("lock held")
+
+var (
+	stealMu         sync.Mutex
+	stealStaleLocks bool
+)
+
+// SetStealStaleLocks makes LockDir take over a lock whose recorded process is no longer running even
+// though the lock is still held, e.g. by a child process that inherited it or on a network filesystem
+// that keeps locks of crashed clients.
+func SetStealStaleLocks(steal bool) {
+	stealMu.Lock()
+	defer stealMu.Unlock()
+	stealStaleLocks = steal
+}
+
+func stealsStaleLocks() bool {
+	stealMu.Lock()
+	defer stealMu.Unlock()
+	return stealStaleLocks
+}
+
+// DirLock marks a metadata directory as in use by this process, so two servers, or a server and an
+// offline migration, never work on the same directory at once. The lock is an exclusive OS lock on
+// dirLockFile (flock on Unix, LockFileEx on Windows), which the OS drops when the process exits; the
+// file also records the holder's PID for error messages.
+type DirLock struct {
+	path string
+	f    *os.File
+}
+
+// LockDir takes the lock of dir. It fails while another process, or another DirLock of this process,
+// holds it.
+func LockDir(dir string) (*DirLock, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &DirLock{path: filepath.Join(dir, dirLockFile)}
+	err := l.lock()
+	if !errors.Is(err, errLockHeld) {
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+	holder, alive := DirLockHolder(dir)
+	if alive || !stealsStaleLocks() {
+		return nil, lockHeldError(dir, holder, alive)
+	}
+	// The holder is gone, so the lock file is replaced by a new one the old lock doesn't cover
+	if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := l.lock(); err != nil {
+		if errors.Is(err, errLockHeld) {
+			holder, alive = DirLockHolder(dir)
+			return nil, lockHeldError(dir, holder, alive)
+		}
+		return nil, err
+	}
+	return l, nil
+}
+
+func lockHeldError(dir string, holder int, alive bool) error {
+	switch {
+	case holder == 0:
+		return fmt.Errorf("%s is in use by another instance of the server or a migration", dir)
+	case alive:
+		return fmt.Errorf("%s is in use by process %d, another instance of the server or a migration; stop it first", dir, holder)
+	default:
+		return fmt.Errorf("%s is locked on behalf of process %d, which is no longer running; start with --force to take the lock over", dir, holder)
+	}
+}
+
+// lock opens the lock file, locks it and records this process in it.
+func (l *DirLock) lock() error {
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	if err != nil {
+		unlockFile(f)
+		f.Close()
+		return err
+	}
+	l.f = f
+	return nil
+}
+
+// Unlock releases the lock. The lock file stays, emptied, so a process opening it meanwhile doesn't
+// end up locking a file that was already replaced.
+func (l *DirLock) Unlock() {
+	if l == nil || l.f == nil {
+		return
+	}
+	l.f.Truncate(0)
+	unlockFile(l.f)
+	l.f.Close()
+	l.f = nil
+}
+
+// Relock takes a released lock again.
+func (l *DirLock) Relock() error {
+	if l == nil || l.f != nil {
+		return nil
+	}
+	err := l.lock()
+	if errors.Is(err, errLockHeld) {
+		dir := filepath.Dir(l.path)
+		holder, alive := DirLockHolder(dir)
+		return lockHeldError(dir, holder, alive)
+	}
+	return err
+}
+
+// DirLockHolder returns the process recorded in the lock of dir and whether that process is alive.
+func DirLockHolder(dir string) (int, bool) {
+	data, err := os.ReadFile(filepath.Join(dir, dirLockFile))
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	return pid, processAlive(pid)
+}
@@ -1,8 +1,9 @@
 package core
 
 import (
+	"fmt"
+	"io"
 	"log"
-	"path/filepath"
 	"sync"
 )
 
@@ -13,18 +14,19 @@ var (
 
 // ProviderManager holds dynamic instances of data and storage providers.
 type ProviderManager struct {
-	mu       sync.RWMutex
-	provider DataProvider
-	store    Storage
-	config   AppConfig
+	mu        sync.RWMutex
+	provider  DataProvider
+	store     Storage
+	blobCache *BlobCache
+	config    AppConfig
 }
 
 // initProviderManager initializes the global providerManager singleton.
 func initProviderManager() {
 	providerManagerOnce.Do(func() {
 		cfg := GetConfig()
-		providerManager = &ProviderManager{config: cfg}
-		if err := providerManager.reinitialize(); err != nil {
+		providerManager = &ProviderManager{}
+		if err := providerManager.reinitialize(cfg); err != nil {
 			log.Fatalf("Failed to initialize Provider Manager: %v", err)
 		}
 	})
@@ -46,34 +48,111 @@ func GetStore() Storage {
 	return providerManager.store
 }
 
-// reinitialize creates new provider instances based on current configuration.
-func (pm *ProviderManager) reinitialize() error {
-	dbPath := filepath.Join(pm.config.StoragePath, "db")
-	storagePath := filepath.Join(pm.config.StoragePath, "oss")
+// GetBlobCache returns the decompressed blob read cache, nil when disabled.
+func GetBlobCache() *BlobCache {
+	initProviderManager() // Ensure initialized
+	providerManager.mu.RLock()
+	defer providerManager.mu.RUnlock()
+	return providerManager.blobCache
+}
 
-	log.Printf("Reinitializing providers with new path: %s", pm.config.StoragePath)
+// ActiveConfig returns the configuration the current providers were created from.
+func ActiveConfig() AppConfig {
+	initProviderManager() // Ensure initialized
+	providerManager.mu.RLock()
+	defer providerManager.mu.RUnlock()
+	return providerManager.config
+}
 
-	newStore, err := NewLocalStorage(storagePath)
-	if err != nil {
-		return err
-	}
+// SetProvidersForTesting installs the given provider and storage in place of the ones built from the
+// configuration, skipping that initialization entirely, e.g. with NewMemoryProvider and NewMemoryStorage.
+// The read cache is disabled.
+func SetProvidersForTesting(p DataProvider, s Storage) {
+	providerManagerOnce.Do(func() {
+		providerManager = &ProviderManager{}
+	})
+	providerManager.mu.Lock()
+	defer providerManager.mu.Unlock()
+	providerManager.provider = p
+	providerManager.store = s
+	providerManager.blobCache = nil
+}
+
+// SetBlobCacheForTesting installs c as the read cache of the providers set by SetProvidersForTesting.
+func SetBlobCacheForTesting(c *BlobCache) {
+	providerManager.mu.Lock()
+	defer providerManager.mu.Unlock()
+	providerManager.blobCache = c
+}
+
+// reinitialize creates new provider instances based on cfg and installs them together with cfg.
+// On error the current providers stay in place.
+func (pm *ProviderManager) reinitialize(cfg AppConfig) error {
+	log.Printf("Reinitializing providers: provider_type=%s, storage_type=%s, storage_path=%s",
+		cfg.ProviderTypeOrDefault(), cfg.StorageTypeOrDefault(), cfg.StoragePath)
 
-	newProvider, err := NewJSONFileProvider(dbPath)
+	// The current provider writes its batched changes and lets go of its directory first, so a new
+	// provider on the same path loads them and can lock it
+	oldProvider := pm.provider
+	if oldProvider != nil {
+		if err := oldProvider.Flush(); err != nil {
+			return fmt.Errorf("failed to write pending metadata changes: %w", err)
+		}
+	}
+	oldLock, locked := oldProvider.(dirLocker)
+	if locked {
+		if err := oldLock.releaseLock(); err != nil {
+			log.Printf("Failed to release the metadata directory of the current provider: %v", err)
+		}
+	}
+	newProvider, newStore, err := newBackends(cfg)
 	if err != nil {
+		if locked {
+			if relockErr := oldLock.reacquireLock(); relockErr != nil {
+				log.Printf("Failed to lock the metadata directory of the current provider again: %v", relockErr)
+			}
+		}
 		return err
 	}
+	if closer, ok := oldProvider.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Failed to close the previous data provider: %v", err)
+		}
+	}
 
+	pm.config = cfg
 	pm.store = newStore
 	pm.provider = newProvider
+	// Cached content belongs to the previous storage location
+	pm.blobCache = NewBlobCache(cfg.ReadCacheBytes, cfg.ReadCacheMaxEntryBytes)
 	return nil
 }
 
+// CloseProvider writes pending metadata changes and closes the current provider, releasing the lock
+// of its metadata directory. Called on shutdown; changes made afterwards are written at once.
+func CloseProvider() error {
+	initProviderManager() // Ensure initialized
+	providerManager.mu.Lock()
+	defer providerManager.mu.Unlock()
+	if closer, ok := providerManager.provider.(io.Closer); ok {
+		return closer.Close()
+	}
+	return providerManager.provider.Flush()
+}
+
+// dirLocker is a provider holding the lock of its directory. releaseLock lets go of the directory so a
+// new provider can open it, reacquireLock takes it back when that failed.
+type dirLocker interface {
+	releaseLock() error
+	reacquireLock() error
+}
+
 // UpdateProviders reinitializes data and storage providers with new configuration.
+// The previous providers and configuration are kept when the new backends can't be created.
 func UpdateProviders(newConfig AppConfig) error {
 	initProviderManager() // Ensure initialized
 	providerManager.mu.Lock()
 	defer providerManager.mu.Unlock()
 
-	providerManager.config = newConfig
-	return providerManager.reinitialize()
+	return providerManager.reinitialize(newConfig)
 }
@@ -1,6 +1,9 @@
 package core
 
-import "sync"
+import (
+	"io"
+	"sync"
+)
 
 // DynamicStorage is a thread-safe wrapper for the Storage interface
 // that allows for hot-swapping the underlying implementation.
@@ -34,9 +37,51 @@ func (d *DynamicStorage) GetObject(objectName string) ([]byte, error) {
 	return d.store.GetObject(objectName)
 }
 
+// PutObjectStream forwards the call to the underlying implementation.
+func (d *DynamicStorage) PutObjectStream(objectName string, r io.Reader, size int64) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.store.PutObjectStream(objectName, r, size)
+}
+
+// GetObjectStream forwards the call to the underlying implementation.
+func (d *DynamicStorage) GetObjectStream(objectName string) (io.ReadCloser, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.store.GetObjectStream(objectName)
+}
+
+// ObjectExists forwards the call to the underlying implementation.
+func (d *DynamicStorage) ObjectExists(objectName string) (bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.store.ObjectExists(objectName)
+}
+
+// DeleteObject forwards the call to the underlying implementation.
+func (d *DynamicStorage) DeleteObject(objectName string) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.store.DeleteObject(objectName)
+}
+
 // DeleteObjectsWithPrefix forwards the call to the underlying implementation.
 func (d *DynamicStorage) DeleteObjectsWithPrefix(prefix string) error {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 	return d.store.DeleteObjectsWithPrefix(prefix)
 }
+
+// ListObjects forwards the call to the underlying implementation.
+func (d *DynamicStorage) ListObjects(prefix string, fn func(ObjectInfo) error) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.store.ListObjects(prefix, fn)
+}
+
+// StatObject forwards the call to the underlying implementation.
+func (d *DynamicStorage) StatObject(objectName string) (ObjectInfo, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.store.StatObject(objectName)
+}
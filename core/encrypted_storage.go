@@ -0,0 +1,415 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted objects start with encryptedMagic, the key ID and a random base nonce, followed by the content
+// in frames of encryptedFrameSize bytes, each sealed on its own with AES-256-GCM, so objects are encrypted
+// and decrypted as they stream rather than held in memory. A frame's nonce is the base nonce with the frame
+// index XORed into its last 8 bytes; its additional data is the object name, the frame index and whether it
+// is the last frame, so frames can't be moved to another object, reordered or cut off. Objects starting with
+// legacyEncryptedMagic were sealed whole by the first format and are still read. Objects without either
+// magic were written before encryption was enabled and are returned as is.
+var (
+	encryptedMagic       = []byte("CVCSENC2")
+	legacyEncryptedMagic = []byte("CVCSENC1")
+)
+
+const (
+	encryptionKeySize  = 32
+	keyIDSize          = 8
+	encryptedFrameSize = 64 << 10
+)
+
+var (
+	// ErrEncryptionKeyMismatch means an object was encrypted with a different key than the configured one
+	ErrEncryptionKeyMismatch = errors.New("object was encrypted with a different key")
+	// ErrEncryptedObjectCorrupt means an object encrypted with the configured key fails authentication
+	ErrEncryptedObjectCorrupt = errors.New("encrypted object is corrupt")
+)
+
+// EncryptedStorage encrypts objects written to the wrapped Storage and decrypts them on read.
+// The object name is authenticated with the content, so an object copied to another name won't decrypt.
+type EncryptedStorage struct {
+	inner Storage
+	aead  cipher.AEAD
+	keyID []byte
+}
+
+// NewEncryptedStorage wraps inner with AES-256-GCM encryption under a 32 byte key.
+func NewEncryptedStorage(inner Storage, key []byte) (*EncryptedStorage, error) {
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("invalid encryption key: need %d bytes, got %d", encryptionKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// The key ID tells a wrong key apart from a damaged object without revealing the key
+	sum := sha256.Sum256(append([]byte("cvcs-key-id:"), key...))
+	return &EncryptedStorage{inner: inner, aead: aead, keyID: sum[:keyIDSize]}, nil
+}
+
+// headerSize is the size of the magic, key ID and nonce in front of the ciphertext, the same in both formats.
+func (s *EncryptedStorage) headerSize() int {
+	return len(encryptedMagic) + keyIDSize + s.aead.NonceSize()
+}
+
+// encryptedSize returns the stored size of content of the given size.
+func (s *EncryptedStorage) encryptedSize(size int64) int64 {
+	frames := (size + encryptedFrameSize - 1) / encryptedFrameSize
+	if frames == 0 {
+		frames = 1 // empty content is one empty frame
+	}
+	return int64(s.headerSize()) + size + frames*int64(s.aead.Overhead())
+}
+
+// contentSize returns the size of the content of an object stored with the given size, the inverse of
+// encryptedSize. It reports false for a size no object of this format can have.
+func (s *EncryptedStorage) contentSize(stored int64) (int64, bool) {
+	overhead := int64(s.aead.Overhead())
+	body := stored - int64(s.headerSize())
+	if body < overhead {
+		return 0, false
+	}
+	full, rest := body/(encryptedFrameSize+overhead), body%(encryptedFrameSize+overhead)
+	if rest == 0 {
+		return full * encryptedFrameSize, true
+	}
+	if rest < overhead {
+		return 0, false
+	}
+	return full*encryptedFrameSize + rest - overhead, true
+}
+
+func (s *EncryptedStorage) frameNonce(base []byte, index uint64) []byte {
+	nonce := append([]byte(nil), base...)
+	tail := nonce[len(nonce)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^index)
+	return nonce
+}
+
+func frameAAD(objectName string, index uint64, last bool) []byte {
+	aad := make([]byte, 0, len(objectName)+9)
+	aad = append(aad, objectName...)
+	aad = binary.BigEndian.AppendUint64(aad, index)
+	if last {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+// encrypt returns a reader over the stored form of the content read from r.
+func (s *EncryptedStorage) encrypt(objectName string, r io.Reader) (io.Reader, error) {
+	header := make([]byte, s.headerSize())
+	copy(header, encryptedMagic)
+	copy(header[len(encryptedMagic):], s.keyID)
+	nonce := header[len(encryptedMagic)+keyIDSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return &encryptingReader{
+		s:     s,
+		name:  objectName,
+		src:   bufio.NewReaderSize(r, encryptedFrameSize),
+		nonce: nonce,
+		plain: make([]byte, encryptedFrameSize),
+		out:   header,
+	}, nil
+}
+
+func (s *EncryptedStorage) PutObject(objectName string, data []byte) error {
+	r, err := s.encrypt(objectName, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return s.inner.PutObject(objectName, sealed)
+}
+
+func (s *EncryptedStorage) GetObject(objectName string) ([]byte, error) {
+	rc, err := s.GetObjectStream(objectName)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// PutObjectStream encrypts the content frame by frame as the inner storage reads it.
+func (s *EncryptedStorage) PutObjectStream(objectName string, r io.Reader, size int64) error {
+	sealed, err := s.encrypt(objectName, r)
+	if err != nil {
+		return err
+	}
+	if size >= 0 {
+		size = s.encryptedSize(size)
+	}
+	return s.inner.PutObjectStream(objectName, sealed, size)
+}
+
+// GetObjectStream returns a reader that decrypts the object frame by frame. A frame that fails
+// authentication fails the Read with ErrEncryptedObjectCorrupt; nothing of it is returned.
+func (s *EncryptedStorage) GetObjectStream(objectName string) (io.ReadCloser, error) {
+	rc, err := s.inner.GetObjectStream(objectName)
+	if err != nil {
+		return nil, err
+	}
+	src := bufio.NewReaderSize(rc, encryptedFrameSize+s.aead.Overhead())
+	magic, _ := src.Peek(len(encryptedMagic))
+	switch {
+	case bytes.Equal(magic, legacyEncryptedMagic):
+		data, err := io.ReadAll(src)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		plain, err := s.openLegacy(objectName, data)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(plain)), nil
+	case !bytes.Equal(magic, encryptedMagic):
+		return struct {
+			io.Reader
+			io.Closer
+		}{src, rc}, nil // written before encryption was enabled
+	}
+	header := make([]byte, s.headerSize())
+	if _, err := io.ReadFull(src, header); err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("%s: %w: truncated", objectName, ErrEncryptedObjectCorrupt)
+	}
+	if !bytes.Equal(header[len(encryptedMagic):len(encryptedMagic)+keyIDSize], s.keyID) {
+		rc.Close()
+		return nil, fmt.Errorf("%s: %w", objectName, ErrEncryptionKeyMismatch)
+	}
+	return &decryptingReader{
+		s:      s,
+		name:   objectName,
+		src:    src,
+		closer: rc,
+		nonce:  header[len(encryptedMagic)+keyIDSize:],
+		frame:  make([]byte, encryptedFrameSize+s.aead.Overhead()),
+	}, nil
+}
+
+// openLegacy decrypts an object of the first format, sealed whole.
+func (s *EncryptedStorage) openLegacy(objectName string, data []byte) ([]byte, error) {
+	headerSize := s.headerSize()
+	if len(data) < headerSize+s.aead.Overhead() {
+		return nil, fmt.Errorf("%s: %w: truncated", objectName, ErrEncryptedObjectCorrupt)
+	}
+	if !bytes.Equal(data[len(legacyEncryptedMagic):len(legacyEncryptedMagic)+keyIDSize], s.keyID) {
+		return nil, fmt.Errorf("%s: %w", objectName, ErrEncryptionKeyMismatch)
+	}
+	nonce := data[len(legacyEncryptedMagic)+keyIDSize : headerSize]
+	plain, err := s.aead.Open(nil, nonce, data[headerSize:], []byte(objectName))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %v", objectName, ErrEncryptedObjectCorrupt, err)
+	}
+	return plain, nil
+}
+
+// encryptingReader reads the header, then one sealed frame at a time.
+type encryptingReader struct {
+	s     *EncryptedStorage
+	name  string
+	src   *bufio.Reader
+	nonce []byte
+	index uint64
+	plain []byte // the content of the next frame
+	frame []byte // the last sealed frame
+	out   []byte // not read yet
+	done  bool
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *encryptingReader) sealNext() error {
+	n, err := io.ReadFull(r.src, r.plain)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		r.done = true
+	case err != nil:
+		return err
+	default:
+		// A full frame is the last one when nothing follows it
+		if _, err := r.src.Peek(1); err == io.EOF {
+			r.done = true
+		} else if err != nil {
+			return err
+		}
+	}
+	r.frame = r.s.aead.Seal(r.frame[:0], r.s.frameNonce(r.nonce, r.index), r.plain[:n], frameAAD(r.name, r.index, r.done))
+	r.out = r.frame
+	r.index++
+	return nil
+}
+
+// decryptingReader opens one frame at a time, see encryptingReader.
+type decryptingReader struct {
+	s      *EncryptedStorage
+	name   string
+	src    *bufio.Reader
+	closer io.Closer
+	nonce  []byte
+	index  uint64
+	frame  []byte // room for one sealed frame
+	plain  []byte // the last opened frame
+	out    []byte // not read yet
+	done   bool
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.openNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *decryptingReader) openNext() error {
+	n, err := io.ReadFull(r.src, r.frame)
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, err := r.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	plain, err := r.s.aead.Open(r.plain[:0], r.s.frameNonce(r.nonce, r.index), r.frame[:n], frameAAD(r.name, r.index, last))
+	if err != nil {
+		return fmt.Errorf("%s: %w: frame %d: %v", r.name, ErrEncryptedObjectCorrupt, r.index, err)
+	}
+	r.plain, r.out, r.done = plain, plain, last
+	r.index++
+	return nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.closer.Close()
+}
+
+func (s *EncryptedStorage) ObjectExists(objectName string) (bool, error) {
+	return s.inner.ObjectExists(objectName)
+}
+
+func (s *EncryptedStorage) DeleteObject(objectName string) error {
+	return s.inner.DeleteObject(objectName)
+}
+
+func (s *EncryptedStorage) DeleteObjectsWithPrefix(prefix string) error {
+	return s.inner.DeleteObjectsWithPrefix(prefix)
+}
+
+// ListObjects reports the stored sizes, which include the encryption header and tag.
+func (s *EncryptedStorage) ListObjects(prefix string, fn func(ObjectInfo) error) error {
+	return s.inner.ListObjects(prefix, fn)
+}
+
+// StatObject reports the size of the content, without the encryption header and tags, which is what
+// the callers compare with the size of uploaded or compressed content.
+func (s *EncryptedStorage) StatObject(objectName string) (ObjectInfo, error) {
+	info, err := s.inner.StatObject(objectName)
+	if err != nil {
+		return info, err
+	}
+	rc, err := s.inner.GetObjectStream(objectName)
+	if err != nil {
+		return info, err
+	}
+	magic := make([]byte, len(encryptedMagic))
+	n, _ := io.ReadFull(rc, magic)
+	rc.Close()
+	switch magic = magic[:n]; {
+	case bytes.Equal(magic, encryptedMagic):
+		size, ok := s.contentSize(info.Size)
+		if !ok {
+			return info, fmt.Errorf("%s: %w: %d bytes can't hold whole frames", objectName, ErrEncryptedObjectCorrupt, info.Size)
+		}
+		info.Size = size
+	case bytes.Equal(magic, legacyEncryptedMagic):
+		info.Size -= int64(s.headerSize() + s.aead.Overhead())
+	}
+	return info, nil
+}
+
+// loadEncryptionKey returns the key configured through encryption_key or encryption_key_file,
+// nil when encryption is disabled. Keys are 32 bytes given as hex or base64; a key file may also
+// hold the 32 raw bytes.
+func loadEncryptionKey(cfg AppConfig) ([]byte, error) {
+	if cfg.EncryptionKey != "" && cfg.EncryptionKeyFile != "" {
+		return nil, fmt.Errorf("set only one of encryption_key and encryption_key_file")
+	}
+	if cfg.EncryptionKey != "" {
+		return decodeEncryptionKey(cfg.EncryptionKey)
+	}
+	if cfg.EncryptionKeyFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(cfg.EncryptionKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read encryption key file: %w", err)
+	}
+	if len(data) == encryptionKeySize {
+		return data, nil
+	}
+	return decodeEncryptionKey(string(data))
+}
+
+func decodeEncryptionKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && len(key) == encryptionKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == encryptionKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("invalid encryption key: expected %d bytes as hex or base64", encryptionKeySize)
+}
@@ -0,0 +1,130 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func testEncryptedStorage(t *testing.T, inner Storage, keyByte byte) *EncryptedStorage {
+	t.Helper()
+	s, err := NewEncryptedStorage(inner, bytes.Repeat([]byte{keyByte}, encryptionKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func readObjectStream(s Storage, name string) ([]byte, error) {
+	rc, err := s.GetObjectStream(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func TestEncryptedStorageRoundTrip(t *testing.T) {
+	inner := NewMemoryStorage()
+	s := testEncryptedStorage(t, inner, 1)
+	for _, size := range []int{0, 1, encryptedFrameSize - 1, encryptedFrameSize, encryptedFrameSize + 1, 3*encryptedFrameSize + 5} {
+		content := make([]byte, size)
+		for i := range content {
+			content[i] = byte(i * 7)
+		}
+		for _, streamed := range []bool{false, true} {
+			name := fmt.Sprintf("cb/%d-%v", size, streamed)
+			var err error
+			if streamed {
+				err = s.PutObjectStream(name, bytes.NewReader(content), int64(size))
+			} else {
+				err = s.PutObject(name, content)
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+
+			stored, _ := inner.GetObject(name)
+			if int64(len(stored)) != s.encryptedSize(int64(size)) {
+				t.Errorf("%s: stored %d bytes, want %d", name, len(stored), s.encryptedSize(int64(size)))
+			}
+			if size > 16 && bytes.Contains(stored, content[:16]) {
+				t.Errorf("%s: stored object holds the content in the clear", name)
+			}
+			if got, err := s.GetObject(name); err != nil || !bytes.Equal(got, content) {
+				t.Errorf("%s: GetObject = %d bytes, %v, want the %d bytes written", name, len(got), err, size)
+			}
+			if got, err := readObjectStream(s, name); err != nil || !bytes.Equal(got, content) {
+				t.Errorf("%s: GetObjectStream = %d bytes, %v, want the %d bytes written", name, len(got), err, size)
+			}
+			if info, err := s.StatObject(name); err != nil || info.Size != int64(size) {
+				t.Errorf("%s: StatObject = %+v, %v, want size %d", name, info, err, size)
+			}
+		}
+	}
+}
+
+func TestEncryptedStorageRejectsTampering(t *testing.T) {
+	inner := NewMemoryStorage()
+	s := testEncryptedStorage(t, inner, 1)
+	content := bytes.Repeat([]byte("frame "), encryptedFrameSize/3) // spans two frames
+	if err := s.PutObject("cb/a", content); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := inner.GetObject("cb/a")
+
+	if _, err := testEncryptedStorage(t, inner, 2).GetObject("cb/a"); !errors.Is(err, ErrEncryptionKeyMismatch) {
+		t.Errorf("read with another key = %v, want ErrEncryptionKeyMismatch", err)
+	}
+
+	header, frame := stored[:s.headerSize()], s.headerSize()+encryptedFrameSize+s.aead.Overhead()
+	flipped := append([]byte(nil), stored...)
+	flipped[len(flipped)-20] ^= 1
+	swapped := append(append(append([]byte(nil), header...), stored[frame:]...), stored[len(header):frame]...)
+	tampered := map[string][]byte{
+		"renamed":            stored,
+		"flipped byte":       flipped,
+		"frames swapped":     swapped,
+		"cut at a frame":     stored[:frame],
+		"cut inside a frame": stored[:len(stored)-1],
+		"header only":        header,
+	}
+	for name, data := range tampered {
+		target := "cb/a-" + name
+		if err := inner.PutObject(target, data); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetObject(target); !errors.Is(err, ErrEncryptedObjectCorrupt) {
+			t.Errorf("%s: GetObject = %v, want ErrEncryptedObjectCorrupt", name, err)
+		}
+		if _, err := readObjectStream(s, target); !errors.Is(err, ErrEncryptedObjectCorrupt) {
+			t.Errorf("%s: GetObjectStream = %v, want ErrEncryptedObjectCorrupt", name, err)
+		}
+	}
+}
+
+// Objects written before encryption was enabled, and by the whole-object format, are still read.
+func TestEncryptedStorageReadsOlderObjects(t *testing.T) {
+	inner := NewMemoryStorage()
+	s := testEncryptedStorage(t, inner, 1)
+	if err := inner.PutObject("cb/plain", []byte("written in the clear")); err != nil {
+		t.Fatal(err)
+	}
+	nonce := bytes.Repeat([]byte{9}, s.aead.NonceSize())
+	legacy := append(append(append([]byte(nil), legacyEncryptedMagic...), s.keyID...), nonce...)
+	legacy = s.aead.Seal(legacy, nonce, []byte("sealed whole"), []byte("cb/legacy"))
+	if err := inner.PutObject("cb/legacy", legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{"cb/plain": "written in the clear", "cb/legacy": "sealed whole"} {
+		if got, err := readObjectStream(s, name); err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v, want %q", name, got, err, want)
+		}
+		if info, err := s.StatObject(name); err != nil || info.Size != int64(len(want)) {
+			t.Errorf("%s: StatObject = %+v, %v, want size %d", name, info, err, len(want))
+		}
+	}
+}
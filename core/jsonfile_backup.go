@@ -0,0 +1,95 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// backupGenerations is the number of previous versions save keeps of each metadata file, as
+// <file>.bak (newest), <file>.bak.1 and so on.
+const backupGenerations = 3
+
+func backupPath(path string, generation int) string {
+	if generation == 0 {
+		return path + ".bak"
+	}
+	return fmt.Sprintf("%s.bak.%d", path, generation)
+}
+
+// rotateBackups shifts the backups of path by one generation, dropping the oldest, and makes the
+// current content of path the newest backup. The backup is a hard link, so it costs no copy; the
+// atomic save that follows replaces path with a new file and leaves the link on the old content.
+func rotateBackups(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	for i := backupGenerations - 1; i > 0; i-- {
+		if err := os.Rename(backupPath(path, i-1), backupPath(path, i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	newest := backupPath(path, 0)
+	if err := os.Link(path, newest); err == nil {
+		return nil
+	}
+	// Filesystems without hard links get a copy
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(newest, data, 0644)
+}
+
+// recoverMetadata is called by loadMetadata when filename can't be parsed. It loads the newest backup that
+// parses into target, keeps the corrupt file as <file>.corrupt, puts the backup in its place and
+// records the recovery. parseErr is returned when no backup parses.
+func (p *JSONFileProvider) recoverMetadata(filename string, target interface{}, parseErr error) error {
+	path := filepath.Join(p.dbPath, filename)
+	for i := 0; i < backupGenerations; i++ {
+		backup := backupPath(path, i)
+		data, err := os.ReadFile(backup)
+		if err != nil {
+			continue
+		}
+		// Decoded into a fresh value, so a failed attempt leaves nothing behind in target
+		fresh := reflect.New(reflect.TypeOf(target).Elem())
+		if err := decodeMetadata(data, fresh.Interface()); err != nil {
+			continue
+		}
+
+		corrupt := path + ".corrupt"
+		if err := os.Rename(path, corrupt); err != nil {
+			return fmt.Errorf("%w; keeping the corrupt file for recovery from %s failed: %v", parseErr, backup, err)
+		}
+		if err := writeFileAtomic(path, data, 0644); err != nil {
+			return fmt.Errorf("%w; restoring %s failed: %v", parseErr, backup, err)
+		}
+		reflect.ValueOf(target).Elem().Set(fresh.Elem())
+
+		log.Printf("WARNING: %s is corrupt (%v). Recovered it from %s; changes saved after that backup are lost. The corrupt file was kept as %s",
+			path, parseErr, backup, corrupt)
+		p.recoveries = append(p.recoveries, MetadataRecovery{
+			File:        filepath.ToSlash(filename),
+			Backup:      filepath.Base(backup),
+			Error:       parseErr.Error(),
+			CorruptCopy: filepath.Base(corrupt),
+			RecoveredAt: time.Now(),
+		})
+		return nil
+	}
+	return parseErr
+}
+
+// MetadataRecoveries returns the metadata files recovered from a backup since the provider was opened.
+func (p *JSONFileProvider) MetadataRecoveries() ([]MetadataRecovery, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	recoveries := append([]MetadataRecovery{}, p.recoveries...)
+	sort.Slice(recoveries, func(i, j int) bool { return recoveries[i].File < recoveries[j].File })
+	return recoveries, nil
+}
@@ -0,0 +1,133 @@
+package core
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Metadata encodings of the json provider. The large files, the versions.json of each codebase and the
+// file trees, can be written with gob, which is faster to write and read and smaller than indented
+// JSON. Everything else stays JSON so it can be read and fixed by hand. Gob files start with gobHeader
+// and keep their names, so files of either encoding are read whatever the setting, and changing it
+// only affects files written afterwards until ConvertMetadataEncoding rewrites the rest.
+const (
+	EncodingJSON = "json"
+	EncodingGob  = "gob"
+)
+
+var gobHeader = []byte("CVCS-GOB\n")
+
+// isGob reports whether data was written with gob.
+func isGob(data []byte) bool {
+	return bytes.HasPrefix(data, gobHeader)
+}
+
+func encodeMetadata(encoding string, v interface{}) ([]byte, error) {
+	if encoding != EncodingGob {
+		return json.MarshalIndent(v, "", "  ")
+	}
+	var buf bytes.Buffer
+	buf.Write(gobHeader)
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeMetadata decodes data written by encodeMetadata in either encoding.
+func decodeMetadata(data []byte, target interface{}) error {
+	if !isGob(data) {
+		return json.Unmarshal(data, target)
+	}
+	return gob.NewDecoder(bytes.NewReader(data[len(gobHeader):])).Decode(target)
+}
+
+func validEncoding(encoding string) error {
+	if encoding != EncodingJSON && encoding != EncodingGob {
+		return fmt.Errorf("unknown metadata encoding %q (supported: %s, %s)", encoding, EncodingJSON, EncodingGob)
+	}
+	return nil
+}
+
+// SetEncoding selects the encoding of version files and file trees written from now on. Existing
+// files are read in whichever encoding they have; see ConvertMetadataEncoding.
+func (p *JSONFileProvider) SetEncoding(encoding string) error {
+	if encoding == "" {
+		encoding = EncodingJSON
+	}
+	if err := validEncoding(encoding); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.encoding = encoding
+	p.trees.setEncoding(encoding)
+	return nil
+}
+
+// ConvertMetadataEncoding writes pending changes, then rewrites every version file and file tree that
+// isn't in the configured encoding.
+func (p *JSONFileProvider) ConvertMetadataEncoding() (*EncodingConversion, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conversion := &EncodingConversion{Encoding: p.encoding}
+	if p.encoding == "" {
+		conversion.Encoding = EncodingJSON
+	}
+	if p.dbPath == "" {
+		return conversion, nil // in-memory provider, nothing is encoded
+	}
+	if err := p.flushLocked(); err != nil {
+		return conversion, err
+	}
+	wantGob := conversion.Encoding == EncodingGob
+
+	dirs, err := os.ReadDir(filepath.Join(p.dbPath, codebasesDir))
+	if err != nil && !os.IsNotExist(err) {
+		return conversion, err
+	}
+	for _, dir := range dirs {
+		data, err := os.ReadFile(filepath.Join(p.dbPath, codebasesDir, dir.Name(), codebaseVersions))
+		if os.IsNotExist(err) || len(data) == 0 || err == nil && isGob(data) == wantGob {
+			continue
+		}
+		if err != nil {
+			return conversion, fmt.Errorf("codebase %s: %w", dir.Name(), err)
+		}
+		if err := p.writeCodebaseFiles(dir.Name(), codebaseVersions); err != nil {
+			return conversion, fmt.Errorf("codebase %s: %w", dir.Name(), err)
+		}
+		conversion.VersionFiles++
+	}
+
+	ids, err := p.trees.ids()
+	if err != nil {
+		return conversion, err
+	}
+	for _, id := range ids {
+		data, err := os.ReadFile(p.trees.path(id))
+		if err != nil {
+			return conversion, fmt.Errorf("tree %s: %w", id, err)
+		}
+		if isGob(data) == wantGob {
+			continue
+		}
+		var files []File
+		if err := decodeMetadata(data, &files); err != nil {
+			return conversion, fmt.Errorf("tree %s: %w", id, err)
+		}
+		if err := p.trees.write(id, files); err != nil {
+			return conversion, fmt.Errorf("tree %s: %w", id, err)
+		}
+		conversion.Trees++
+	}
+	if conversion.VersionFiles > 0 || conversion.Trees > 0 {
+		log.Printf("Converted %d version files and %d file trees to %s", conversion.VersionFiles, conversion.Trees, conversion.Encoding)
+	}
+	return conversion, nil
+}
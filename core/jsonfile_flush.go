@@ -0,0 +1,150 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Changes are batched: a mutation is journaled (see jsonfile_journal.go), updates the cache and marks
+// the files it changed dirty, and the dirty files are written together flushInterval after the first
+// change, or at once when flushMaxPending mutations have accumulated. Reads always see the cache, so
+// they see unwritten changes; after a crash the journal restores them. Flush writes them at once.
+const (
+	defaultFlushInterval   = 200 * time.Millisecond
+	defaultFlushMaxPending = 100
+)
+
+// Metadata files in db/ shared by all codebases
+const (
+	webhooksFile        = "webhooks.json"
+	quarantineFile      = "quarantine.json"
+	idempotencyKeysFile = "idempotency_keys.json"
+	auditLogFile        = "audit_log.json"
+)
+
+func (p *JSONFileProvider) initFlush(interval time.Duration, maxPending int) {
+	p.flushInterval = interval
+	p.flushMaxPending = maxPending
+	p.dirtyCodebases = make(map[string]map[string]bool)
+	p.dirtyShared = make(map[string]bool)
+	p.removedTrees = make(map[string]bool)
+	p.removedCodebases = make(map[string]bool)
+}
+
+// SetFlushPolicy sets how changes are batched. A non-positive interval writes every change before
+// the mutation returns; maxPending defaults to defaultFlushMaxPending.
+func (p *JSONFileProvider) SetFlushPolicy(interval time.Duration, maxPending int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if maxPending <= 0 {
+		maxPending = defaultFlushMaxPending
+	}
+	p.flushInterval = interval
+	p.flushMaxPending = maxPending
+	if interval <= 0 {
+		return p.flushLocked()
+	}
+	return nil
+}
+
+// Flush writes every batched change. It returns once they are on disk.
+func (p *JSONFileProvider) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.flushLocked()
+}
+
+// markDirty marks a file of a codebase directory for the next flush. Callers hold p.mu.
+func (p *JSONFileProvider) markDirty(codebaseID, name string) {
+	if p.dirtyCodebases[codebaseID] == nil {
+		p.dirtyCodebases[codebaseID] = make(map[string]bool)
+	}
+	p.dirtyCodebases[codebaseID][name] = true
+}
+
+func (p *JSONFileProvider) writeShared(name string) error {
+	switch name {
+	case webhooksFile:
+		return p.save(name, p.cache.Webhooks)
+	case quarantineFile:
+		return p.save(name, p.cache.Quarantine)
+	case idempotencyKeysFile:
+		return p.save(name, p.cache.IdempotencyKeys)
+	case auditLogFile:
+		return p.save(name, p.cache.AuditLog)
+	}
+	return fmt.Errorf("unknown metadata file %s", name)
+}
+
+// changed counts a batched mutation and flushes or schedules the flush. Callers hold p.mu.
+func (p *JSONFileProvider) changed() error {
+	p.pendingMutations++
+	if p.pendingMutations >= p.flushMaxPending {
+		return p.flushLocked()
+	}
+	if p.flushTimer == nil {
+		p.flushTimer = time.AfterFunc(p.flushInterval, p.flushInBackground)
+	}
+	return nil
+}
+
+func (p *JSONFileProvider) flushInBackground() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.flushTimer = nil
+	if err := p.flushLocked(); err != nil {
+		log.Printf("Failed to write metadata changes, retrying in %s: %v", p.flushInterval, err)
+		if p.flushInterval > 0 {
+			p.flushTimer = time.AfterFunc(p.flushInterval, p.flushInBackground)
+		}
+	}
+}
+
+// flushLocked writes the dirty files, then deletes the codebase directories and trees removed since the
+// last flush and truncates the journal. Files that fail stay dirty. Callers hold p.mu.
+func (p *JSONFileProvider) flushLocked() error {
+	if p.flushTimer != nil {
+		p.flushTimer.Stop()
+		p.flushTimer = nil
+	}
+	p.pendingMutations = 0
+	for id := range p.removedCodebases {
+		if err := p.removeCodebaseFiles(id); err != nil {
+			return fmt.Errorf("codebase %s: %w", id, err)
+		}
+		delete(p.dirtyCodebases, id)
+		delete(p.removedCodebases, id)
+	}
+	ids := make([]string, 0, len(p.dirtyCodebases))
+	for id := range p.dirtyCodebases {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		files := make([]string, 0, len(p.dirtyCodebases[id]))
+		for _, name := range allCodebaseFiles {
+			if p.dirtyCodebases[id][name] {
+				files = append(files, name)
+			}
+		}
+		if err := p.writeCodebaseFiles(id, files...); err != nil {
+			return fmt.Errorf("codebase %s: %w", id, err)
+		}
+		delete(p.dirtyCodebases, id)
+	}
+	for name := range p.dirtyShared {
+		if err := p.writeShared(name); err != nil {
+			return err
+		}
+		delete(p.dirtyShared, name)
+	}
+	for treeID := range p.removedTrees {
+		if err := p.trees.remove(treeID); err != nil {
+			return err
+		}
+		delete(p.removedTrees, treeID)
+	}
+	return p.truncateJournal()
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+)
+
+// CheckConsistency scans the records for references to records that don't exist. With repair the
+// dangling edges, branch refs and tags are removed; versions and trees are only reported, since
+// removing them would lose content. History caches are checked by the caller, see DataProvider.
+func (p *JSONFileProvider) CheckConsistency(repair bool) (*ConsistencyReport, error) {
+	if repair {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+	} else {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+	}
+	report := &ConsistencyReport{
+		MissingTrees:        []string{},
+		OrphanTrees:         []string{},
+		OrphanVersions:      []string{},
+		DanglingEdges:       []string{},
+		DanglingRefs:        []BranchRef{},
+		DanglingTags:        []Tag{},
+		OrphanHistoryCaches: []string{},
+	}
+
+	usedTrees := make(map[string]bool, len(p.cache.Versions))
+	for _, v := range p.cache.Versions {
+		usedTrees[v.TreeID] = true
+		if !p.trees.has(v.TreeID) {
+			report.MissingTrees = append(report.MissingTrees, v.ID)
+		}
+		if _, ok := p.cache.Codebases[v.CodebaseID]; !ok {
+			report.OrphanVersions = append(report.OrphanVersions, v.ID)
+		}
+	}
+	treeIDs, err := p.trees.ids()
+	if err != nil {
+		return nil, err
+	}
+	for _, treeID := range treeIDs {
+		if !usedTrees[treeID] && !p.removedTrees[treeID] {
+			report.OrphanTrees = append(report.OrphanTrees, treeID)
+		}
+	}
+
+	m := newMutation("CheckConsistency")
+	for edgeID, edge := range p.cache.VersionMapping {
+		_, childOK := p.cache.Versions[edge.ChildVersionID]
+		_, parentOK := p.cache.Versions[edge.ParentVersionID]
+		if !childOK || !parentOK {
+			report.DanglingEdges = append(report.DanglingEdges, edgeID)
+			m.delete(recordEdge, edgeID)
+		}
+	}
+	for key, ref := range p.cache.BranchRefs {
+		if _, ok := p.cache.Versions[ref.VersionID]; !ok {
+			report.DanglingRefs = append(report.DanglingRefs, *ref)
+			m.delete(recordRef, key)
+		}
+	}
+	for key, tag := range p.cache.Tags {
+		if _, ok := p.cache.Versions[tag.VersionID]; !ok {
+			report.DanglingTags = append(report.DanglingTags, *tag)
+			m.delete(recordTag, key)
+		}
+	}
+	if repair {
+		if err := p.commit(m); err != nil {
+			return nil, fmt.Errorf("repair failed: %w", err)
+		}
+		report.Repaired = len(m.changes)
+	}
+
+	sort.Strings(report.MissingTrees)
+	sort.Strings(report.OrphanTrees)
+	sort.Strings(report.OrphanVersions)
+	sort.Strings(report.DanglingEdges)
+	sort.Slice(report.DanglingRefs, func(i, j int) bool {
+		a, b := report.DanglingRefs[i], report.DanglingRefs[j]
+		return a.CodebaseID < b.CodebaseID || a.CodebaseID == b.CodebaseID && a.Branch < b.Branch
+	})
+	sort.Slice(report.DanglingTags, func(i, j int) bool {
+		a, b := report.DanglingTags[i], report.DanglingTags[j]
+		return a.CodebaseID < b.CodebaseID || a.CodebaseID == b.CodebaseID && a.Name < b.Name
+	})
+	return report, nil
+}
@@ -0,0 +1,323 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Every mutation is appended to db/journal.log as one line holding the records it changes and fsynced
+// before the cache is updated, so batched changes survive a crash. A flush that writes all dirty files
+// is a checkpoint and truncates the journal. At startup the entries left in the journal are applied
+// over the metadata files. Entries carry whole records rather than operations, so replaying one the
+// files already contain changes nothing, which also repairs a crash during a flush that wrote only
+// some files. Trees are not journaled: a tree file is written before the entry of its version.
+const journalFile = "journal.log"
+
+// Record kinds of journal changes
+const (
+	recordCodebase   = "codebase"
+	recordVersion    = "version"
+	recordEdge       = "edge"
+	recordRef        = "ref"
+	recordTag        = "tag"
+	recordWebhook    = "webhook"
+	recordQuarantine = "quarantine"
+	recordIdempotent = "idempotency_key"
+	recordAudit      = "audit"
+	recordTree       = "tree" // only removals, see above
+)
+
+// journalEntry is one line of the journal. Op names the provider call, for reading the journal as an audit trail.
+type journalEntry struct {
+	Seq     int64          `json:"seq"`
+	Time    time.Time      `json:"time"`
+	Op      string         `json:"op"`
+	Changes []recordChange `json:"changes"`
+}
+
+type recordChange struct {
+	Kind  string          `json:"kind"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"` // the new record, absent when it is deleted
+}
+
+// mutation collects the record changes of one provider call until commit.
+type mutation struct {
+	op      string
+	changes []recordChange
+	err     error
+}
+
+func newMutation(op string) *mutation {
+	return &mutation{op: op}
+}
+
+func (m *mutation) put(kind, key string, record interface{}) {
+	if m.err != nil {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		m.err = fmt.Errorf("%s %s: %w", kind, key, err)
+		return
+	}
+	m.changes = append(m.changes, recordChange{Kind: kind, Key: key, Value: data})
+}
+
+func (m *mutation) delete(kind, key string) {
+	m.changes = append(m.changes, recordChange{Kind: kind, Key: key})
+}
+
+// commit journals a mutation, applies it to the cache and writes or schedules the changed files.
+// Nothing changes when the journal can't be written. Callers hold p.mu.
+func (p *JSONFileProvider) commit(m *mutation) error {
+	if m.err != nil {
+		return m.err
+	}
+	if len(m.changes) == 0 {
+		return nil
+	}
+	if err := p.appendJournal(m); err != nil {
+		return err
+	}
+	if err := p.apply(m.changes); err != nil {
+		return err
+	}
+	if p.flushInterval <= 0 {
+		return p.flushLocked()
+	}
+	return p.changed()
+}
+
+func (p *JSONFileProvider) openJournal() error {
+	f, err := os.OpenFile(filepath.Join(p.dbPath, journalFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	p.journal = f
+	return nil
+}
+
+func (p *JSONFileProvider) appendJournal(m *mutation) error {
+	if p.journal == nil {
+		return nil // in-memory provider, or closed
+	}
+	p.journalSeq++
+	line, err := json.Marshal(journalEntry{Seq: p.journalSeq, Time: time.Now().UTC(), Op: m.op, Changes: m.changes})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err = p.journal.Write(line); err == nil {
+		err = p.journal.Sync()
+	}
+	if err != nil {
+		// Cut a partly written entry, so the next one starts on a line of its own
+		p.journal.Truncate(p.journalSize)
+		return fmt.Errorf("writing %s: %w", journalFile, err)
+	}
+	p.journalSize += int64(len(line))
+	return nil
+}
+
+// truncateJournal empties the journal once every change in it is in the metadata files. Callers hold p.mu.
+func (p *JSONFileProvider) truncateJournal() error {
+	if p.journal == nil || p.journalSize == 0 {
+		return nil
+	}
+	if err := p.journal.Truncate(0); err != nil {
+		return fmt.Errorf("truncating %s: %w", journalFile, err)
+	}
+	if err := p.journal.Sync(); err != nil {
+		return fmt.Errorf("truncating %s: %w", journalFile, err)
+	}
+	p.journalSize = 0
+	return nil
+}
+
+// replayJournal applies the entries left by a crash, then writes them to the metadata files.
+func (p *JSONFileProvider) replayJournal() error {
+	if p.journal == nil {
+		return nil
+	}
+	data, err := io.ReadAll(p.journal)
+	if err != nil {
+		return fmt.Errorf("%s: %w", journalFile, err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	p.journalSize = int64(len(data))
+	lines := bytes.Split(data, []byte("\n"))
+	replayed := 0
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			if i == len(lines)-1 {
+				// A crash while appending leaves the last entry without its newline; its call never returned
+				log.Printf("WARNING: ignoring incomplete last entry of %s: %v", journalFile, err)
+				break
+			}
+			return fmt.Errorf("%s: entry on line %d is damaged, move the file away to start without it: %w", journalFile, i+1, err)
+		}
+		if err := p.apply(entry.Changes); err != nil {
+			return fmt.Errorf("%s: entry %d (%s): %w", journalFile, entry.Seq, entry.Op, err)
+		}
+		// New entries continue the sequence, the replayed ones stay in the journal until the flush below
+		p.journalSeq = entry.Seq
+		replayed++
+	}
+	log.Printf("Replayed %d metadata journal entries", replayed)
+	return p.flushLocked()
+}
+
+// apply sets the records of changes in the cache and marks their files dirty. Callers hold p.mu.
+func (p *JSONFileProvider) apply(changes []recordChange) error {
+	// A single new version is added to the indexes, anything more rebuilds them
+	versions := 0
+	for _, c := range changes {
+		if c.Kind == recordVersion {
+			versions++
+		}
+	}
+	reindex := versions > 1
+	for _, c := range changes {
+		switch c.Kind {
+		case recordCodebase:
+			if c.Value == nil {
+				delete(p.cache.Codebases, c.Key)
+				p.removedCodebases[c.Key] = true
+				continue
+			}
+			var codebase Codebase
+			if err := json.Unmarshal(c.Value, &codebase); err != nil {
+				return fmt.Errorf("codebase %s: %w", c.Key, err)
+			}
+			p.cache.Codebases[c.Key] = &codebase
+			delete(p.removedCodebases, c.Key)
+			p.markDirty(c.Key, codebaseFile)
+		case recordVersion:
+			if old, ok := p.cache.Versions[c.Key]; ok {
+				delete(p.cache.Versions, c.Key)
+				p.markDirty(old.CodebaseID, codebaseVersions)
+				reindex = true
+			}
+			if c.Value == nil {
+				continue
+			}
+			var v Version
+			if err := json.Unmarshal(c.Value, &v); err != nil {
+				return fmt.Errorf("version %s: %w", c.Key, err)
+			}
+			p.cache.Versions[c.Key] = &v
+			p.markDirty(v.CodebaseID, codebaseVersions)
+			if !reindex {
+				p.indexVersion(&v)
+			}
+		case recordEdge:
+			if old, ok := p.cache.VersionMapping[c.Key]; ok {
+				delete(p.cache.VersionMapping, c.Key)
+				p.markDirty(old.CodebaseID, codebaseEdges)
+			}
+			if c.Value == nil {
+				continue
+			}
+			var m versionMappingRecord
+			if err := json.Unmarshal(c.Value, &m); err != nil {
+				return fmt.Errorf("edge %s: %w", c.Key, err)
+			}
+			p.cache.VersionMapping[c.Key] = &m
+			p.markDirty(m.CodebaseID, codebaseEdges)
+		case recordRef:
+			if old, ok := p.cache.BranchRefs[c.Key]; ok {
+				delete(p.cache.BranchRefs, c.Key)
+				p.markDirty(old.CodebaseID, codebaseRefs)
+			}
+			if c.Value == nil {
+				continue
+			}
+			var ref BranchRef
+			if err := json.Unmarshal(c.Value, &ref); err != nil {
+				return fmt.Errorf("branch ref %s: %w", c.Key, err)
+			}
+			p.cache.BranchRefs[c.Key] = &ref
+			p.markDirty(ref.CodebaseID, codebaseRefs)
+		case recordTag:
+			if old, ok := p.cache.Tags[c.Key]; ok {
+				delete(p.cache.Tags, c.Key)
+				p.markDirty(old.CodebaseID, codebaseTags)
+			}
+			if c.Value == nil {
+				continue
+			}
+			var tag Tag
+			if err := json.Unmarshal(c.Value, &tag); err != nil {
+				return fmt.Errorf("tag %s: %w", c.Key, err)
+			}
+			p.cache.Tags[c.Key] = &tag
+			p.markDirty(tag.CodebaseID, codebaseTags)
+		case recordWebhook:
+			delete(p.cache.Webhooks, c.Key)
+			p.dirtyShared[webhooksFile] = true
+			if c.Value == nil {
+				continue
+			}
+			var hook Webhook
+			if err := json.Unmarshal(c.Value, &hook); err != nil {
+				return fmt.Errorf("webhook %s: %w", c.Key, err)
+			}
+			p.cache.Webhooks[c.Key] = &hook
+		case recordQuarantine:
+			delete(p.cache.Quarantine, c.Key)
+			p.dirtyShared[quarantineFile] = true
+			if c.Value == nil {
+				continue
+			}
+			var entry QuarantineEntry
+			if err := json.Unmarshal(c.Value, &entry); err != nil {
+				return fmt.Errorf("quarantine entry %s: %w", c.Key, err)
+			}
+			p.cache.Quarantine[c.Key] = &entry
+		case recordIdempotent:
+			delete(p.cache.IdempotencyKeys, c.Key)
+			p.dirtyShared[idempotencyKeysFile] = true
+			if c.Value == nil {
+				continue
+			}
+			var record IdempotencyRecord
+			if err := json.Unmarshal(c.Value, &record); err != nil {
+				return fmt.Errorf("idempotency key %s: %w", c.Key, err)
+			}
+			p.cache.IdempotencyKeys[c.Key] = &record
+		case recordAudit:
+			delete(p.cache.AuditLog, c.Key)
+			p.dirtyShared[auditLogFile] = true
+			if c.Value == nil {
+				continue
+			}
+			var entry AuditEntry
+			if err := json.Unmarshal(c.Value, &entry); err != nil {
+				return fmt.Errorf("audit entry %s: %w", c.Key, err)
+			}
+			p.cache.AuditLog[c.Key] = &entry
+		case recordTree:
+			// Removed with the next flush, once the versions no longer referencing it are written
+			p.removedTrees[c.Key] = true
+		default:
+			return fmt.Errorf("unknown record kind %q", c.Kind)
+		}
+	}
+	if reindex {
+		p.rebuildIndexes()
+	}
+	return nil
+}
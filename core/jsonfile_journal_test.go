@@ -0,0 +1,299 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// journalWorkload is a scripted sequence of provider calls; every call changes some records.
+func journalWorkload(t *testing.T) []func(p DataProvider) {
+	ops := []func(p DataProvider){
+		func(p DataProvider) { mustCreateCodebase(t, p, "a") },
+		func(p DataProvider) { mustCreateCodebase(t, p, "b") },
+		func(p DataProvider) { mustCreateCodebase(t, p, "gone") },
+	}
+	for n := 1; n <= 6; n++ {
+		n := n
+		ops = append(ops,
+			func(p DataProvider) {
+				mustCreateVersion(t, p, "a", "main", fmt.Sprintf("v%d", n), n, fmt.Sprintf("ka%d", n))
+			},
+			func(p DataProvider) {
+				mustCreateVersion(t, p, "b", "main", fmt.Sprintf("v%d", n), n, fmt.Sprintf("kb%d", n))
+			},
+		)
+		if n > 1 {
+			ops = append(ops, func(p DataProvider) {
+				child, parent := fmt.Sprintf("a-main-v%d", n), fmt.Sprintf("a-main-v%d", n-1)
+				if err := p.CreateVersionLink("a", child, parent, "main", LinkageTypeSequential); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+		ops = append(ops, func(p DataProvider) {
+			tag := &Tag{CodebaseID: "b", Name: fmt.Sprintf("t%d", n), VersionID: fmt.Sprintf("b-main-v%d", n), CreatedAt: testEpoch}
+			if err := p.CreateTag(tag); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	ops = append(ops,
+		func(p DataProvider) {
+			if err := p.DeleteTag("b", "t3"); err != nil {
+				t.Fatal(err)
+			}
+		},
+		func(p DataProvider) {
+			if err := p.DeleteVersion("a-main-v6", ""); err != nil {
+				t.Fatal(err)
+			}
+		},
+		func(p DataProvider) {
+			if err := p.DeleteCodebaseByID("gone"); err != nil {
+				t.Fatal(err)
+			}
+		},
+		func(p DataProvider) {
+			entry := &AuditEntry{ID: "audit-1", Time: testEpoch, Action: "test", CodebaseID: "a"}
+			if err := p.AppendAuditEntry(entry); err != nil {
+				t.Fatal(err)
+			}
+		},
+	)
+	return ops
+}
+
+// providerState describes the records a provider holds, for comparing providers.
+func providerState(t *testing.T, p DataProvider) string {
+	t.Helper()
+	codebases, err := p.ListCodebases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(codebases, func(i, j int) bool { return codebases[i].ID < codebases[j].ID })
+	var b strings.Builder
+	for _, cb := range codebases {
+		versions, err := p.ListVersions(cb.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		edges, err := p.GetAllVersionEdgesForMap(cb.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var links []string
+		for _, e := range edges {
+			links = append(links, e.From+">"+e.To)
+		}
+		sort.Strings(links)
+		tags, err := p.ListTags(cb.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, tag := range tags {
+			names = append(names, tag.Name+"="+tag.VersionID)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(&b, "%s versions=%v edges=%v tags=%v\n", cb.ID, versionIDs(versions), links, names)
+	}
+	entries, err := p.ListAuditEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(&b, "audit entries=%d\n", len(entries))
+	return b.String()
+}
+
+// expectedState is the state after the first n calls of the workload, run on the memory provider.
+func expectedState(t *testing.T, n int) string {
+	p := NewMemoryProvider()
+	for _, op := range journalWorkload(t)[:n] {
+		op(p)
+	}
+	return providerState(t, p)
+}
+
+// crashJSONProvider abandons p the way a killed process does: nothing batched is flushed and the
+// directory lock goes with the process. With partialFlush some of the dirty files are written first,
+// as by a flush cut short.
+func crashJSONProvider(t *testing.T, p *JSONFileProvider, rng *rand.Rand, partialFlush bool) {
+	t.Helper()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.flushTimer != nil {
+		p.flushTimer.Stop()
+		p.flushTimer = nil
+	}
+	if partialFlush {
+		for _, id := range sortedKeys(p.dirtyCodebases) {
+			for _, name := range allCodebaseFiles {
+				if p.dirtyCodebases[id][name] && rng.Intn(2) == 0 {
+					if err := p.writeCodebaseFiles(id, name); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+		}
+		for _, name := range sortedKeys(p.dirtyShared) {
+			if rng.Intn(2) == 0 {
+				if err := p.writeShared(name); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	p.journal.Close()
+	p.journal = nil
+	p.lock.Unlock()
+}
+
+// cutLastJournalEntry truncates the journal inside its last entry, as a crash while appending it
+// does. It reports false when the journal is empty.
+func cutLastJournalEntry(t *testing.T, dir string, rng *rand.Rand) bool {
+	t.Helper()
+	path := filepath.Join(dir, journalFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 {
+		return false
+	}
+	start := bytes.LastIndexByte(data[:len(data)-1], '\n') + 1
+	// Anywhere from the start of the entry to just before its newline
+	cut := start + rng.Intn(len(data)-1-start)
+	if err := os.Truncate(path, int64(cut)); err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
+
+// TestJournalReplayAfterCrash kills the provider at random points of a scripted workload, in the
+// middle of a flush or of a journal append too, and checks that replaying the journal restores every
+// call that returned, that reopening again changes nothing, and that the rest of the workload ends
+// where a run without a crash does.
+func TestJournalReplayAfterCrash(t *testing.T) {
+	ops := journalWorkload(t)
+	want := make([]string, len(ops)+1)
+	for n := range want {
+		want[n] = expectedState(t, n)
+	}
+	for seed := int64(1); seed <= 60; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		dir := t.TempDir()
+		p, err := NewJSONFileProvider(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.SetFlushPolicy(time.Hour, 1+rng.Intn(8)); err != nil {
+			t.Fatal(err)
+		}
+		done := 1 + rng.Intn(len(ops))
+		for _, op := range ops[:done] {
+			op(p)
+		}
+		mode := rng.Intn(3)
+		crashJSONProvider(t, p, rng, mode == 1)
+		if mode == 2 && cutLastJournalEntry(t, dir, rng) {
+			done-- // its call never returned
+		}
+
+		p, err = NewJSONFileProvider(dir)
+		if err != nil {
+			t.Fatalf("seed %d: reopening after the crash: %v", seed, err)
+		}
+		if got := providerState(t, p); got != want[done] {
+			t.Errorf("seed %d (crash mode %d after %d calls): replayed state\n%s want\n%s", seed, mode, done, got, want[done])
+		}
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(filepath.Join(dir, journalFile)); err != nil || info.Size() != 0 {
+			t.Errorf("seed %d: journal after a clean close = %v, %v, want empty", seed, info, err)
+		}
+
+		p, err = NewJSONFileProvider(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := providerState(t, p); got != want[done] {
+			t.Errorf("seed %d: state after reopening again\n%s want\n%s", seed, got, want[done])
+		}
+		for _, op := range ops[done:] {
+			op(p)
+		}
+		if got := providerState(t, p); got != want[len(ops)] {
+			t.Errorf("seed %d: state after the rest of the workload\n%s want\n%s", seed, got, want[len(ops)])
+		}
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// journalSeqs returns the sequence numbers of the entries in the journal of dir.
+func journalSeqs(t *testing.T, dir string) []int64 {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, journalFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seqs []int64
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, entry.Seq)
+	}
+	return seqs
+}
+
+// Entries written after a replay continue the sequence of the replayed ones.
+func TestJournalSequenceContinuesAfterReplay(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewJSONFileProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetFlushPolicy(time.Hour, 100); err != nil {
+		t.Fatal(err)
+	}
+	mustCreateCodebase(t, p, "cb")
+	mustCreateVersion(t, p, "cb", "main", "v1", 1, "k1")
+	mustCreateVersion(t, p, "cb", "main", "v2", 2, "k2")
+	replayed := journalSeqs(t, dir)
+	if len(replayed) == 0 {
+		t.Fatal("nothing was journaled")
+	}
+	crashJSONProvider(t, p, rand.New(rand.NewSource(1)), false)
+
+	p, err = NewJSONFileProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.SetFlushPolicy(time.Hour, 100); err != nil {
+		t.Fatal(err)
+	}
+	last := replayed[len(replayed)-1]
+	if p.journalSeq != last {
+		t.Errorf("sequence after the replay = %d, want %d", p.journalSeq, last)
+	}
+	mustCreateVersion(t, p, "cb", "main", "v3", 3, "k3")
+	if seqs := journalSeqs(t, dir); len(seqs) == 0 || seqs[0] != last+1 {
+		t.Errorf("journal after the replay holds %v, want entries from %d on", seqs, last+1)
+	}
+}
@@ -0,0 +1,290 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Codebase records live in db/codebases/<codebase_id>/, one set of files per codebase, so a write only
+// serializes the codebase it changes. File trees live in db/trees/, see treeStore. Webhooks, quarantine
+// entries and the audit log span codebases and stay in db/.
+const (
+	codebasesDir = "codebases"
+	// layoutFile marks a metadata directory converted to the current layout
+	layoutFile    = "layout.json"
+	layoutVersion = 3
+)
+
+// Files of a codebase directory
+const (
+	codebaseFile     = "codebase.json"
+	codebaseVersions = "versions.json"
+	codebaseEdges    = "edges.json"
+	codebaseRefs     = "refs.json"
+	codebaseTags     = "tags.json"
+	// codebaseFileIndexes held the trees of a codebase before layout 3; it is only read for conversion
+	codebaseFileIndexes = "file_indexes.json"
+)
+
+// allCodebaseFiles lists every file of a codebase directory.
+var allCodebaseFiles = []string{codebaseFile, codebaseVersions, codebaseEdges, codebaseRefs, codebaseTags}
+
+// legacyFiles are the files of the first layout, which kept all codebases in one file per record type.
+// Reference counts were persisted too; they are now counted from the file trees at startup.
+var legacyFiles = []string{"codebases.json", "versions.json", "file_indexes.json", "version_mapping.json", "refs.json", "tags.json", "blob_refs.json"}
+
+type layoutRecord struct {
+	Version int `json:"version"`
+}
+
+// layoutVersionOnDisk returns the version recorded in the layout marker, zero when there is none.
+func (p *JSONFileProvider) layoutVersionOnDisk() (int, error) {
+	var layout layoutRecord
+	if err := p.loadMetadata(layoutFile, &layout); err != nil {
+		return 0, fmt.Errorf("%s: %w", layoutFile, err)
+	}
+	return layout.Version, nil
+}
+
+// loadCodebaseDirs reads every codebase directory into the cache. Trees found in file index files of
+// layouts before 3 are added to trees.
+func (p *JSONFileProvider) loadCodebaseDirs(trees map[string][]File) error {
+	entries, err := os.ReadDir(filepath.Join(p.dbPath, codebasesDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if err := p.loadCodebaseDir(e.Name(), trees); err != nil {
+			return fmt.Errorf("codebase %s: %w", e.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (p *JSONFileProvider) loadCodebaseDir(codebaseID string, trees map[string][]File) error {
+	dir := filepath.Join(codebasesDir, codebaseID)
+	var (
+		codebase  *Codebase
+		versions  map[string]*Version
+		fileIndex map[string][]File
+		edges     map[string]*versionMappingRecord
+		refs      map[string]*BranchRef
+		tags      map[string]*Tag
+	)
+	targets := map[string]interface{}{
+		codebaseFile:        &codebase,
+		codebaseVersions:    &versions,
+		codebaseFileIndexes: &fileIndex,
+		codebaseEdges:       &edges,
+		codebaseRefs:        &refs,
+		codebaseTags:        &tags,
+	}
+	for _, name := range append(allCodebaseFiles, codebaseFileIndexes) {
+		if err := p.loadMetadata(filepath.Join(dir, name), targets[name]); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	if codebase != nil {
+		p.cache.Codebases[codebase.ID] = codebase
+	}
+	for id, v := range versions {
+		p.cache.Versions[id] = v
+	}
+	for id, files := range fileIndex {
+		trees[id] = files
+	}
+	for id, m := range edges {
+		p.cache.VersionMapping[id] = m
+	}
+	for key, ref := range refs {
+		p.cache.BranchRefs[key] = ref
+	}
+	for key, tag := range tags {
+		p.cache.Tags[key] = tag
+	}
+	return nil
+}
+
+// loadLegacyFiles reads the metadata of the first, single-file-per-type layout into the cache and its
+// trees into trees.
+func (p *JSONFileProvider) loadLegacyFiles(trees map[string][]File) error {
+	if err := p.loadMetadata("codebases.json", &p.cache.Codebases); err != nil {
+		return err
+	}
+	if err := p.loadMetadata("versions.json", &p.cache.Versions); err != nil {
+		return err
+	}
+	if err := p.loadMetadata("file_indexes.json", &trees); err != nil {
+		return err
+	}
+	if err := p.loadMetadata("version_mapping.json", &p.cache.VersionMapping); err != nil {
+		return err
+	}
+	if err := p.loadMetadata("refs.json", &p.cache.BranchRefs); err != nil {
+		return err
+	}
+	return p.loadMetadata("tags.json", &p.cache.Tags)
+}
+
+// convertLegacyLayout writes the loaded metadata into codebase directories and the loaded trees into
+// db/trees/, removes the files they came from and then records the current layout. A conversion
+// interrupted on the way is completed on the next start: what was written so far is loaded and
+// whatever old files remain are merged over it.
+func (p *JSONFileProvider) convertLegacyLayout(trees map[string][]File) error {
+	converted := p.legacyFilesPresent()
+	for id, files := range trees {
+		if err := p.trees.put(id, files); err != nil {
+			return fmt.Errorf("tree %s: %w", id, err)
+		}
+	}
+	ids := p.codebaseIDsOnRecord()
+	for id := range ids {
+		if err := p.writeCodebaseFiles(id, allCodebaseFiles...); err != nil {
+			return fmt.Errorf("codebase %s: %w", id, err)
+		}
+	}
+	fileIndexes, err := filepath.Glob(filepath.Join(p.dbPath, codebasesDir, "*", codebaseFileIndexes))
+	if err != nil {
+		return err
+	}
+	for _, path := range fileIndexes {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, name := range legacyFiles {
+		if err := os.Remove(filepath.Join(p.dbPath, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := p.save(layoutFile, layoutRecord{Version: layoutVersion}); err != nil {
+		return err
+	}
+	if converted {
+		log.Printf("Converted metadata of %d codebases to one directory per codebase under %s", len(ids), filepath.Join(p.dbPath, codebasesDir))
+	}
+	if len(trees) > 0 {
+		log.Printf("Moved %d file trees to one file per tree under %s", len(trees), p.trees.dir)
+	}
+	return nil
+}
+
+// legacyFilesPresent reports whether any file of the previous layout exists.
+func (p *JSONFileProvider) legacyFilesPresent() bool {
+	for _, name := range legacyFiles {
+		if _, err := os.Stat(filepath.Join(p.dbPath, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// codebaseIDsOnRecord returns every codebase ID with a record in the cache, including IDs only versions,
+// edges, refs or tags still carry.
+func (p *JSONFileProvider) codebaseIDsOnRecord() map[string]bool {
+	ids := make(map[string]bool, len(p.cache.Codebases))
+	for id := range p.cache.Codebases {
+		ids[id] = true
+	}
+	for _, v := range p.cache.Versions {
+		ids[v.CodebaseID] = true
+	}
+	for _, m := range p.cache.VersionMapping {
+		ids[m.CodebaseID] = true
+	}
+	for _, ref := range p.cache.BranchRefs {
+		ids[ref.CodebaseID] = true
+	}
+	for _, tag := range p.cache.Tags {
+		ids[tag.CodebaseID] = true
+	}
+	delete(ids, "")
+	return ids
+}
+
+// writeCodebaseFiles writes the given files of a codebase directory from the cache. Callers hold p.mu.
+func (p *JSONFileProvider) writeCodebaseFiles(codebaseID string, files ...string) error {
+	if p.dbPath == "" {
+		return nil // in-memory provider, see NewMemoryProvider
+	}
+	dir := filepath.Join(codebasesDir, codebaseID)
+	if err := os.MkdirAll(filepath.Join(p.dbPath, dir), 0755); err != nil {
+		return err
+	}
+	for _, name := range files {
+		var data interface{}
+		switch name {
+		case codebaseFile:
+			codebase, ok := p.cache.Codebases[codebaseID]
+			if !ok {
+				continue // records left behind by a deleted codebase
+			}
+			data = codebase
+		case codebaseVersions:
+			data = p.codebaseVersions(codebaseID)
+		case codebaseEdges:
+			edges := make(map[string]*versionMappingRecord)
+			for id, m := range p.cache.VersionMapping {
+				if m.CodebaseID == codebaseID {
+					edges[id] = m
+				}
+			}
+			data = edges
+		case codebaseRefs:
+			refs := make(map[string]*BranchRef)
+			for key, ref := range p.cache.BranchRefs {
+				if ref.CodebaseID == codebaseID {
+					refs[key] = ref
+				}
+			}
+			data = refs
+		case codebaseTags:
+			tags := make(map[string]*Tag)
+			for key, tag := range p.cache.Tags {
+				if tag.CodebaseID == codebaseID {
+					tags[key] = tag
+				}
+			}
+			data = tags
+		default:
+			return fmt.Errorf("unknown codebase file %s", name)
+		}
+		encoding := EncodingJSON
+		if name == codebaseVersions {
+			encoding = p.encoding
+		}
+		if err := p.saveAs(filepath.Join(dir, name), data, encoding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// codebaseVersions returns the versions of a codebase keyed by ID, read from the records rather than
+// the derived indexes so it is correct while they are being rebuilt.
+func (p *JSONFileProvider) codebaseVersions(codebaseID string) map[string]*Version {
+	versions := make(map[string]*Version)
+	for id, v := range p.cache.Versions {
+		if v.CodebaseID == codebaseID {
+			versions[id] = v
+		}
+	}
+	return versions
+}
+
+// removeCodebaseFiles deletes the directory of a codebase.
+func (p *JSONFileProvider) removeCodebaseFiles(codebaseID string) error {
+	if p.dbPath == "" {
+		return nil
+	}
+	return os.RemoveAll(filepath.Join(p.dbPath, codebasesDir, codebaseID))
+}
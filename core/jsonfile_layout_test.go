@@ -0,0 +1,160 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// providerDump serializes everything a provider answers about its codebases, for comparing providers
+// loaded from different layouts.
+func providerDump(t *testing.T, p DataProvider) string {
+	t.Helper()
+	type codebaseDump struct {
+		Codebase *Codebase
+		Versions []*Version
+		Trees    map[string][]File
+		Edges    []VersionEdge
+		Heads    map[string]string
+		Refs     []*BranchRef
+		Tags     []*Tag
+	}
+	var dump struct {
+		Codebases []codebaseDump
+		BlobRefs  map[string]int
+	}
+	codebases, err := p.ListCodebases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(codebases, func(i, j int) bool { return codebases[i].ID < codebases[j].ID })
+	for _, cb := range codebases {
+		d := codebaseDump{Codebase: cb, Trees: make(map[string][]File)}
+		if d.Versions, err = p.ListVersions(cb.ID); err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(d.Versions, func(i, j int) bool { return d.Versions[i].ID < d.Versions[j].ID })
+		for _, v := range d.Versions {
+			if d.Trees[v.TreeID], err = p.GetFileIndexesByTreeID(v.TreeID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if d.Edges, err = p.GetAllVersionEdgesForMap(cb.ID); err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(d.Edges, func(i, j int) bool { return d.Edges[i].To+d.Edges[i].From < d.Edges[j].To+d.Edges[j].From })
+		if d.Heads, err = p.GetBranchHeadsForMap(cb.ID); err != nil {
+			t.Fatal(err)
+		}
+		if d.Refs, err = p.ListBranchRefs(cb.ID); err != nil {
+			t.Fatal(err)
+		}
+		if d.Tags, err = p.ListTags(cb.ID); err != nil {
+			t.Fatal(err)
+		}
+		dump.Codebases = append(dump.Codebases, d)
+	}
+	dump.BlobRefs = make(map[string]int)
+	if err := p.ListBlobRefs("", func(key string, refs int) error {
+		dump.BlobRefs[key] = refs
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// writeLegacyFile writes a metadata file of the single-file-per-type layout.
+func writeLegacyFile(t *testing.T, dir, name string, data interface{}) {
+	t.Helper()
+	raw, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Metadata written in the old single-file layout loads into the same provider state as the same
+// metadata written in the per-codebase layout, before and after it is converted.
+func TestJSONProviderLayoutsLoadIdentically(t *testing.T) {
+	current := t.TempDir()
+	p := openJSONProvider(t, current)
+	for _, id := range []string{"first", "second"} {
+		mustCreateCodebase(t, p, id)
+		v1 := mustCreateVersion(t, p, id, "main", "v1", 1, id+"/shared")
+		v2 := mustCreateVersion(t, p, id, "main", "v2", 2, id+"/v2")
+		f1 := mustCreateVersion(t, p, id, "feature", "f1", 3, id+"/shared")
+		for _, link := range []struct {
+			child, parent *Version
+			linkType      LinkageType
+		}{{v2, v1, LinkageTypeSequential}, {f1, v1, LinkageTypeBranchFrom}} {
+			if err := p.CreateVersionLink(id, link.child.ID, link.parent.ID, link.child.Branch, link.linkType); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := p.CreateBranchRef(&BranchRef{CodebaseID: id, Branch: "release", VersionID: v2.ID, CreatedAt: testEpoch}); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.CreateTag(&Tag{CodebaseID: id, Name: "1.0", VersionID: v1.ID, CreatedAt: testEpoch}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := providerDump(t, p)
+
+	// The old layout persisted the cache maps as they are, one file per record type
+	legacy := t.TempDir()
+	trees := make(map[string][]File)
+	for _, v := range p.cache.Versions {
+		files, err := p.GetFileIndexesByTreeID(v.TreeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trees[v.TreeID] = files
+	}
+	writeLegacyFile(t, legacy, "codebases.json", p.cache.Codebases)
+	writeLegacyFile(t, legacy, "versions.json", p.cache.Versions)
+	writeLegacyFile(t, legacy, "file_indexes.json", trees)
+	// Its mapping was keyed by child version and had no edge IDs
+	mapping := make(map[string]versionMappingRecord)
+	for _, m := range p.cache.VersionMapping {
+		record := *m
+		record.ID = ""
+		mapping[m.ChildVersionID] = record
+	}
+	writeLegacyFile(t, legacy, "version_mapping.json", mapping)
+	writeLegacyFile(t, legacy, "refs.json", p.cache.BranchRefs)
+	writeLegacyFile(t, legacy, "tags.json", p.cache.Tags)
+	writeLegacyFile(t, legacy, "blob_refs.json", map[string]int{"stale/count": 7})
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{current, legacy} {
+		for open := 1; open <= 2; open++ {
+			p := openJSONProvider(t, dir)
+			if got := providerDump(t, p); got != want {
+				t.Errorf("open %d of %s loads\n%s\nwant\n%s", open, filepath.Base(dir), got, want)
+			}
+			if err := p.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, name := range legacyFiles {
+		if _, err := os.Stat(filepath.Join(legacy, name)); !os.IsNotExist(err) {
+			t.Errorf("legacy file %s left after the conversion: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(legacy, codebasesDir, "first", codebaseVersions)); err != nil {
+		t.Errorf("converted codebase directory: %v", err)
+	}
+}
@@ -1,12 +1,13 @@
 package core
 
 import (
-	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,19 +18,58 @@ import (
 type JSONFileProvider struct {
 	dbPath string
 	cache  *inMemoryCache
-	mu     sync.RWMutex
+	trees  *treeStore
+	// lock keeps other processes off dbPath for the provider's lifetime
+	lock *DirLock
+	mu   sync.RWMutex
+	// recoveries lists the files load restored from a backup
+	recoveries []MetadataRecovery
+	// encoding of the version files, see jsonfile_codec.go; guarded by mu
+	encoding string
+
+	// Batched saves, see jsonfile_flush.go; guarded by mu
+	flushInterval    time.Duration
+	flushMaxPending  int
+	flushTimer       *time.Timer
+	pendingMutations int
+	dirtyCodebases   map[string]map[string]bool // codebase_id -> files to write
+	dirtyShared      map[string]bool            // shared files to write
+	removedTrees     map[string]bool            // trees to delete once the versions are written
+	removedCodebases map[string]bool            // codebase directories to delete
+	// Write-ahead journal, see jsonfile_journal.go; guarded by mu, nil without a directory
+	journal     *os.File
+	journalSeq  int64
+	journalSize int64
+	// historyLocks guard the history cache files, striped by codebase ID
+	historyLocks [historyLockStripes]sync.RWMutex
 }
 
+const historyLockStripes = 32
+
 // inMemoryCache serves as in-memory data cache to improve performance.
 type inMemoryCache struct {
 	Codebases      map[string]*Codebase             // codebase_id -> Codebase
 	Versions       map[string]*Version              // version_id -> Version
-	FileIndexes    map[string][]File                // tree_id -> []File
-	VersionMapping map[string]*versionMappingRecord // child_version_id -> mapping
+	VersionMapping map[string]*versionMappingRecord // edge_id -> mapping, a child may have several parents
+	BranchRefs     map[string]*BranchRef            // "codebaseID/branch" -> explicit branch ref
+	Quarantine     map[string]*QuarantineEntry      // storage_key -> quarantined object
+	Tags           map[string]*Tag                  // "codebaseID/name" -> tag
+	Webhooks       map[string]*Webhook              // webhook_id -> subscription
+	BlobRefs       map[string]int                   // storage_key -> number of file trees referencing it
+	// IdempotencyKeys holds the results of snapshot requests by "codebaseID/key"
+	IdempotencyKeys map[string]*IdempotencyRecord
+	AuditLog        map[string]*AuditEntry // entry_id -> audit entry
 
 	// Indexes for fast lookup
-	versionsByCodebase       map[string][]*Version // codebase_id -> sorted []*Version by time
-	versionIDByBranchAndName map[string]string     // key: "codebaseID/branch/version" -> versionID
+	versionsByCodebase       map[string][]*Version     // codebase_id -> sorted []*Version by time
+	versionIDByBranchAndName map[versionNameKey]string // codebase, branch and version label -> versionID
+	branchesByVersionLabel   map[string][]string       // key: "codebaseID/version" -> branches having that label
+}
+
+// versionNameKey indexes a version by its codebase, branch and label. A struct rather than a joined
+// string, so names containing "/" ("feat/login") can't collide with others.
+type versionNameKey struct {
+	codebaseID, branch, version string
 }
 
 // versionMappingRecord is the record structure stored in version_mapping.json.
@@ -42,55 +82,162 @@ type versionMappingRecord struct {
 	LinkageType     LinkageType `json:"linkage_type"`
 }
 
+// NewJSONFileProvider opens the metadata in dbPath and locks the directory until Close, failing while
+// another process has it open.
 func NewJSONFileProvider(dbPath string) (*JSONFileProvider, error) {
 	if err := os.MkdirAll(dbPath, 0755); err != nil {
 		return nil, fmt.Errorf("unable to create database directory: %w", err)
 	}
+	lock, err := LockDir(dbPath)
+	if err != nil {
+		return nil, err
+	}
 	p := &JSONFileProvider{
 		dbPath: dbPath,
-		cache: &inMemoryCache{
-			Codebases:                make(map[string]*Codebase),
-			Versions:                 make(map[string]*Version),
-			FileIndexes:              make(map[string][]File),
-			VersionMapping:           make(map[string]*versionMappingRecord),
-			versionsByCodebase:       make(map[string][]*Version),
-			versionIDByBranchAndName: make(map[string]string),
-		},
+		cache:  newInMemoryCache(),
+		trees:  newTreeStore(filepath.Join(dbPath, treesDir)),
+		lock:   lock,
+	}
+	p.initFlush(defaultFlushInterval, defaultFlushMaxPending)
+	if err := p.openJournal(); err != nil {
+		lock.Unlock()
+		return nil, fmt.Errorf("unable to open %s: %w", journalFile, err)
 	}
 	if err := p.load(); err != nil {
+		p.journal.Close()
+		lock.Unlock()
 		return nil, fmt.Errorf("failed to load data: %w", err)
 	}
 	p.rebuildIndexes()
 	return p, nil
 }
 
+// Close writes batched changes, closes the journal and releases the lock of the metadata directory.
+// Changes made afterwards, e.g. by requests still running, are written at once.
+func (p *JSONFileProvider) Close() error {
+	p.mu.Lock()
+	err := p.flushLocked()
+	p.flushInterval = 0
+	if err == nil && p.journal != nil {
+		err = p.journal.Close()
+		p.journal = nil
+	}
+	p.mu.Unlock()
+	p.lock.Unlock()
+	return err
+}
+
+// releaseLock lets go of the metadata directory; the cache stays loaded.
+func (p *JSONFileProvider) releaseLock() error {
+	p.lock.Unlock()
+	return nil
+}
+
+func (p *JSONFileProvider) reacquireLock() error {
+	return p.lock.Relock()
+}
+
+func newInMemoryCache() *inMemoryCache {
+	return &inMemoryCache{
+		Codebases:                make(map[string]*Codebase),
+		Versions:                 make(map[string]*Version),
+		VersionMapping:           make(map[string]*versionMappingRecord),
+		BranchRefs:               make(map[string]*BranchRef),
+		Quarantine:               make(map[string]*QuarantineEntry),
+		Tags:                     make(map[string]*Tag),
+		Webhooks:                 make(map[string]*Webhook),
+		BlobRefs:                 make(map[string]int),
+		IdempotencyKeys:          make(map[string]*IdempotencyRecord),
+		AuditLog:                 make(map[string]*AuditEntry),
+		versionsByCodebase:       make(map[string][]*Version),
+		versionIDByBranchAndName: make(map[versionNameKey]string),
+		branchesByVersionLabel:   make(map[string][]string),
+	}
+}
+
 // --- Data Loading and Saving ---
 
 func (p *JSONFileProvider) load() error {
-	if err := p.loadJSON("codebases.json", &p.cache.Codebases); err != nil {
+	version, err := p.layoutVersionOnDisk()
+	if err != nil {
+		return err
+	}
+	switch {
+	case version > layoutVersion:
+		return fmt.Errorf("metadata layout version %d is newer than this build supports (%d)", version, layoutVersion)
+	case version == layoutVersion && p.legacyFilesPresent():
+		return fmt.Errorf("%s holds metadata files of the previous layout next to the per-codebase layout, probably written by an older version; delete %s to merge them on the next start", p.dbPath, layoutFile)
+	}
+	// Trees of layouts before 3, which kept them in file index files
+	trees := make(map[string][]File)
+	if err := p.loadCodebaseDirs(trees); err != nil {
+		return err
+	}
+	if version < layoutVersion {
+		// Merged over directories a previous, interrupted conversion may have written
+		if err := p.loadLegacyFiles(trees); err != nil {
+			return err
+		}
+	}
+	// Older files keyed the mapping by child version ID, which allowed only one parent per child
+	byEdge := make(map[string]*versionMappingRecord, len(p.cache.VersionMapping))
+	for _, m := range p.cache.VersionMapping {
+		if m.ID == "" {
+			m.ID = uuid.NewString()
+		}
+		byEdge[m.ID] = m
+	}
+	p.cache.VersionMapping = byEdge
+	if err := p.loadMetadata(quarantineFile, &p.cache.Quarantine); err != nil {
+		return err
+	}
+	if err := p.loadMetadata(webhooksFile, &p.cache.Webhooks); err != nil {
 		return err
 	}
-	if err := p.loadJSON("versions.json", &p.cache.Versions); err != nil {
+	if err := p.loadMetadata(idempotencyKeysFile, &p.cache.IdempotencyKeys); err != nil {
 		return err
 	}
-	if err := p.loadJSON("file_indexes.json", &p.cache.FileIndexes); err != nil {
+	if err := p.loadMetadata(auditLogFile, &p.cache.AuditLog); err != nil {
 		return err
 	}
-	if err := p.loadJSON("version_mapping.json", &p.cache.VersionMapping); err != nil {
+
+	if version < layoutVersion || len(trees) > 0 {
+		if err := p.convertLegacyLayout(trees); err != nil {
+			return err
+		}
+	}
+	if err := p.replayJournal(); err != nil {
+		return err
+	}
+	refs, err := countBlobRefs(p.trees)
+	if err != nil {
 		return err
 	}
+	p.cache.BlobRefs = refs
 	return nil
 }
 
 func (p *JSONFileProvider) save(filename string, data interface{}) error {
-	bytes, err := json.MarshalIndent(data, "", "  ")
+	return p.saveAs(filename, data, EncodingJSON)
+}
+
+func (p *JSONFileProvider) saveAs(filename string, data interface{}, encoding string) error {
+	if p.dbPath == "" {
+		return nil // in-memory provider, see NewMemoryProvider
+	}
+	bytes, err := encodeMetadata(encoding, data)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(filepath.Join(p.dbPath, filename), bytes, 0644)
+	path := filepath.Join(p.dbPath, filename)
+	if err := rotateBackups(path); err != nil {
+		return fmt.Errorf("backing up %s: %w", filename, err)
+	}
+	return writeFileAtomic(path, bytes, 0644)
 }
 
-func (p *JSONFileProvider) loadJSON(filename string, target interface{}) error {
+// loadMetadata reads a metadata file of either encoding into target, see jsonfile_codec.go.
+func (p *JSONFileProvider) loadMetadata(filename string, target interface{}) error {
 	path := filepath.Join(p.dbPath, filename)
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return nil // File not existing is normal situation
@@ -102,14 +249,20 @@ func (p *JSONFileProvider) loadJSON(filename string, target interface{}) error {
 	if len(bytes) == 0 {
 		return nil
 	}
-	return json.Unmarshal(bytes, target)
+	if err := decodeMetadata(bytes, target); err != nil {
+		return p.recoverMetadata(filename, target, err)
+	}
+	return nil
 }
 
 func (p *JSONFileProvider) rebuildIndexes() {
+	p.cache.versionsByCodebase = make(map[string][]*Version)
+	p.cache.versionIDByBranchAndName = make(map[versionNameKey]string)
+	p.cache.branchesByVersionLabel = make(map[string][]string)
 	for _, v := range p.cache.Versions {
 		p.cache.versionsByCodebase[v.CodebaseID] = append(p.cache.versionsByCodebase[v.CodebaseID], v)
-		key := fmt.Sprintf("%s/%s/%s", v.CodebaseID, v.Branch, v.Version)
-		p.cache.versionIDByBranchAndName[key] = v.ID
+		p.cache.versionIDByBranchAndName[versionNameKey{v.CodebaseID, v.Branch, v.Version}] = v.ID
+		p.indexVersionLabel(v)
 	}
 	for cid := range p.cache.versionsByCodebase {
 		sort.Slice(p.cache.versionsByCodebase[cid], func(i, j int) bool {
@@ -118,6 +271,31 @@ func (p *JSONFileProvider) rebuildIndexes() {
 	}
 }
 
+// indexVersion adds a new version to the indexes. Callers hold p.mu.
+func (p *JSONFileProvider) indexVersion(v *Version) {
+	versions := append(p.cache.versionsByCodebase[v.CodebaseID], v)
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].CreatedAt.After(versions[j].CreatedAt)
+	})
+	p.cache.versionsByCodebase[v.CodebaseID] = versions
+	p.cache.versionIDByBranchAndName[versionNameKey{v.CodebaseID, v.Branch, v.Version}] = v.ID
+	p.indexVersionLabel(v)
+}
+
+// indexVersionLabel records the branch of a version under its label in the reverse index.
+func (p *JSONFileProvider) indexVersionLabel(v *Version) {
+	key := fmt.Sprintf("%s/%s", v.CodebaseID, v.Version)
+	branches := p.cache.branchesByVersionLabel[key]
+	i := sort.SearchStrings(branches, v.Branch)
+	if i < len(branches) && branches[i] == v.Branch {
+		return
+	}
+	branches = append(branches, "")
+	copy(branches[i+1:], branches[i:])
+	branches[i] = v.Branch
+	p.cache.branchesByVersionLabel[key] = branches
+}
+
 // --- Interface Implementations ---
 
 func (p *JSONFileProvider) CreateCodebase(codebase *Codebase) error {
@@ -126,8 +304,9 @@ func (p *JSONFileProvider) CreateCodebase(codebase *Codebase) error {
 	if _, exists := p.cache.Codebases[codebase.ID]; exists {
 		return fmt.Errorf("codebase %s already exists", codebase.ID)
 	}
-	p.cache.Codebases[codebase.ID] = codebase
-	return p.save("codebases.json", p.cache.Codebases)
+	m := newMutation("CreateCodebase")
+	m.put(recordCodebase, codebase.ID, codebase)
+	return p.commit(m)
 }
 
 func (p *JSONFileProvider) GetCodebaseByID(id string) (*Codebase, error) {
@@ -140,39 +319,91 @@ func (p *JSONFileProvider) GetCodebaseByID(id string) (*Codebase, error) {
 	return codebase, nil
 }
 
+func (p *JSONFileProvider) ListCodebases() ([]*Codebase, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	codebases := make([]*Codebase, 0, len(p.cache.Codebases))
+	for _, c := range p.cache.Codebases {
+		codebases = append(codebases, c)
+	}
+	sort.Slice(codebases, func(i, j int) bool {
+		return codebases[i].CreatedAt.Before(codebases[j].CreatedAt)
+	})
+	return codebases, nil
+}
+
+func (p *JSONFileProvider) UpdateCodebase(codebase *Codebase) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.cache.Codebases[codebase.ID]; !ok {
+		return fmt.Errorf("codebase %s not found", codebase.ID)
+	}
+	m := newMutation("UpdateCodebase")
+	m.put(recordCodebase, codebase.ID, codebase)
+	return p.commit(m)
+}
+
 func (p *JSONFileProvider) DeleteCodebaseByID(id string) error {
+	if err := p.deleteCodebase(id); err != nil {
+		return err
+	}
+	// Delete history cache file
+	return p.DeleteHistoryCache(id)
+}
+
+// deleteCodebase removes the records of a codebase. The history cache is left to DeleteCodebaseByID,
+// since a MemoryProvider keeps it elsewhere.
+func (p *JSONFileProvider) deleteCodebase(id string) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	// Delete all associated content
-	delete(p.cache.Codebases, id)
+	// Trees are read before anything changes, an unreadable one fails the deletion
 	relatedVersions := p.cache.versionsByCodebase[id]
-	for _, v := range relatedVersions {
-		delete(p.cache.Versions, v.ID)
-		delete(p.cache.FileIndexes, v.TreeID)
-		delete(p.cache.VersionMapping, v.ID)
-		delete(p.cache.versionIDByBranchAndName, fmt.Sprintf("%s/%s/%s", v.CodebaseID, v.Branch, v.Version))
+	trees := make([][]File, len(relatedVersions))
+	for i, v := range relatedVersions {
+		files, _, err := p.trees.get(v.TreeID)
+		if err != nil {
+			return err
+		}
+		trees[i] = files
 	}
-	delete(p.cache.versionsByCodebase, id)
 
-	// Save all changes
-	if err := p.save("codebases.json", p.cache.Codebases); err != nil {
-		return err
+	m := newMutation("DeleteCodebase")
+	m.delete(recordCodebase, id)
+	for _, v := range relatedVersions {
+		m.delete(recordVersion, v.ID)
+		m.delete(recordTree, v.TreeID)
 	}
-	if err := p.save("versions.json", p.cache.Versions); err != nil {
-		return err
+	for edgeID, edge := range p.cache.VersionMapping {
+		if edge.CodebaseID == id {
+			m.delete(recordEdge, edgeID)
+		}
 	}
-	if err := p.save("file_indexes.json", p.cache.FileIndexes); err != nil {
-		return err
+	for key, ref := range p.cache.BranchRefs {
+		if ref.CodebaseID == id {
+			m.delete(recordRef, key)
+		}
 	}
-	if err := p.save("version_mapping.json", p.cache.VersionMapping); err != nil {
+	for key, tag := range p.cache.Tags {
+		if tag.CodebaseID == id {
+			m.delete(recordTag, key)
+		}
+	}
+	for key, entry := range p.cache.Quarantine {
+		if entry.CodebaseID == id {
+			m.delete(recordQuarantine, key)
+		}
+	}
+	for key, record := range p.cache.IdempotencyKeys {
+		if record.CodebaseID == id {
+			m.delete(recordIdempotent, key)
+		}
+	}
+	if err := p.commit(m); err != nil {
 		return err
 	}
-
-	// Delete history cache file
-	err := os.Remove(filepath.Join(p.dbPath, "history_cache", id+".json"))
-	if err != nil && !os.IsNotExist(err) {
-		return err // Only return non-"file not found" errors
+	for _, files := range trees {
+		dropBlobRefs(p.cache.BlobRefs, files)
 	}
 	return nil
 }
@@ -184,8 +415,11 @@ func (p *JSONFileProvider) UpdateCodebaseTimestamp(id string, t time.Time) error
 	if !ok {
 		return fmt.Errorf("codebase %s not found", id)
 	}
-	codebase.UpdatedAt = t
-	return p.save("codebases.json", p.cache.Codebases)
+	updated := *codebase
+	updated.UpdatedAt = t
+	m := newMutation("UpdateCodebaseTimestamp")
+	m.put(recordCodebase, id, &updated)
+	return p.commit(m)
 }
 
 func (p *JSONFileProvider) CreateVersion(version *Version, files []File) error {
@@ -194,29 +428,28 @@ func (p *JSONFileProvider) CreateVersion(version *Version, files []File) error {
 	if _, exists := p.cache.Versions[version.ID]; exists {
 		return fmt.Errorf("version %s already exists", version.ID)
 	}
+	if existingID, exists := p.cache.versionIDByBranchAndName[versionNameKey{version.CodebaseID, version.Branch, version.Version}]; exists {
+		return &VersionExistsError{Branch: version.Branch, Version: version.Version, VersionID: existingID}
+	}
+	// The tree goes first, so a version on disk always has its tree
+	if err := p.trees.put(version.TreeID, files); err != nil {
+		return err
+	}
+	delete(p.removedTrees, version.TreeID)
 
-	p.cache.Versions[version.ID] = version
-	p.cache.FileIndexes[version.TreeID] = files
-
-	// Update indexes
-	p.cache.versionsByCodebase[version.CodebaseID] = append(p.cache.versionsByCodebase[version.CodebaseID], version)
-	sort.Slice(p.cache.versionsByCodebase[version.CodebaseID], func(i, j int) bool {
-		return p.cache.versionsByCodebase[version.CodebaseID][i].CreatedAt.After(p.cache.versionsByCodebase[version.CodebaseID][j].CreatedAt)
-	})
-	key := fmt.Sprintf("%s/%s/%s", version.CodebaseID, version.Branch, version.Version)
-	p.cache.versionIDByBranchAndName[key] = version.ID
-
-	if err := p.save("versions.json", p.cache.Versions); err != nil {
+	m := newMutation("CreateVersion")
+	m.put(recordVersion, version.ID, version)
+	if err := p.commit(m); err != nil {
 		return err
 	}
-	return p.save("file_indexes.json", p.cache.FileIndexes)
+	addBlobRefs(p.cache.BlobRefs, files)
+	return nil
 }
 
 func (p *JSONFileProvider) GetVersion(codebaseID, branch, version string) (*Version, error) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	key := fmt.Sprintf("%s/%s/%s", codebaseID, branch, version)
-	versionID, ok := p.cache.versionIDByBranchAndName[key]
+	versionID, ok := p.cache.versionIDByBranchAndName[versionNameKey{codebaseID, branch, version}]
 	if !ok {
 		return nil, fmt.Errorf("version %s/%s not found", branch, version)
 	}
@@ -227,10 +460,40 @@ func (p *JSONFileProvider) GetVersion(codebaseID, branch, version string) (*Vers
 	return v, nil
 }
 
+// FindBranchesWithVersion returns the sorted branches of a codebase that have a version with the given label.
+func (p *JSONFileProvider) FindBranchesWithVersion(codebaseID, version string) ([]string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	branches := p.cache.branchesByVersionLabel[fmt.Sprintf("%s/%s", codebaseID, version)]
+	return append([]string{}, branches...), nil
+}
+
+func (p *JSONFileProvider) GetVersionByID(id string) (*Version, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	v, ok := p.cache.Versions[id]
+	if !ok {
+		return nil, fmt.Errorf("version %s not found", id)
+	}
+	return v, nil
+}
+
+// ListVersions returns all versions of a codebase, newest first.
+func (p *JSONFileProvider) ListVersions(codebaseID string) ([]*Version, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	versions := make([]*Version, len(p.cache.versionsByCodebase[codebaseID]))
+	copy(versions, p.cache.versionsByCodebase[codebaseID])
+	return versions, nil
+}
+
 func (p *JSONFileProvider) GetFileIndexesByTreeID(treeID string) ([]File, error) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	files, ok := p.cache.FileIndexes[treeID]
+	files, ok, err := p.trees.get(treeID)
+	if err != nil {
+		return nil, err
+	}
 	if !ok {
 		return nil, fmt.Errorf("tree %s not found", treeID)
 	}
@@ -268,25 +531,219 @@ func (p *JSONFileProvider) IsNewBranch(codebaseID, branch, excludeVersionID stri
 	return count == 0, nil
 }
 
-func (p *JSONFileProvider) FindLatestVersionInMain(codebaseID string) (*Version, error) {
-	return p.FindLatestVersionInBranch(codebaseID, "main", "")
+// DeleteVersion removes a version, its file tree and its own lineage record. Children and branch refs
+// pointing at it are moved to reparentTo, or removed when reparentTo is empty.
+func (p *JSONFileProvider) DeleteVersion(versionID, reparentTo string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	version, ok := p.cache.Versions[versionID]
+	if !ok {
+		return fmt.Errorf("version %s not found", versionID)
+	}
+
+	m := newMutation("DeleteVersion")
+	files, err := p.deleteVersion(m, version, reparentTo, nil)
+	if err != nil {
+		return err
+	}
+	if err := p.commit(m); err != nil {
+		return err
+	}
+	dropBlobRefs(p.cache.BlobRefs, files)
+	return nil
+}
+
+func (p *JSONFileProvider) SetVersionFlags(versionID string, locked, pinned bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	version, ok := p.cache.Versions[versionID]
+	if !ok {
+		return fmt.Errorf("version %s not found", versionID)
+	}
+	flagged := *version
+	flagged.Locked, flagged.Pinned = locked, pinned
+	m := newMutation("SetVersionFlags")
+	m.put(recordVersion, versionID, &flagged)
+	return p.commit(m)
+}
+
+// ReplaceVersion puts version in the place of the version with the same branch and name: the old one
+// and its file tree are removed, and its lineage records, in both directions, and branch refs move to version.
+func (p *JSONFileProvider) ReplaceVersion(oldVersionID string, version *Version, files []File) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old, ok := p.cache.Versions[oldVersionID]
+	if !ok {
+		return fmt.Errorf("version %s not found", oldVersionID)
+	}
+	if old.CodebaseID != version.CodebaseID || old.Branch != version.Branch || old.Version != version.Version {
+		return fmt.Errorf("version %s is %s/%s, not %s/%s", oldVersionID, old.Branch, old.Version, version.Branch, version.Version)
+	}
+	if _, exists := p.cache.Versions[version.ID]; exists {
+		return fmt.Errorf("version %s already exists", version.ID)
+	}
+	if err := p.trees.put(version.TreeID, files); err != nil {
+		return err
+	}
+	delete(p.removedTrees, version.TreeID)
+
+	m := newMutation("ReplaceVersion")
+	oldFiles, err := p.deleteVersion(m, old, version.ID, version)
+	if err != nil {
+		return err
+	}
+	m.put(recordVersion, version.ID, version)
+	if err := p.commit(m); err != nil {
+		return err
+	}
+	dropBlobRefs(p.cache.BlobRefs, oldFiles)
+	addBlobRefs(p.cache.BlobRefs, files)
+	return nil
+}
+
+// deleteVersion adds the changes removing version to m, see DeleteVersion. A replacement, whose ID is
+// reparentTo, also takes over the lineage records of version's own parents. The tree is kept when
+// another version or the replacement uses it. It returns the files of a removed tree, whose blob
+// references the caller drops after the commit. Callers hold p.mu.
+func (p *JSONFileProvider) deleteVersion(m *mutation, version *Version, reparentTo string, replacement *Version) ([]File, error) {
+	versionID := version.ID
+	treeShared := replacement != nil && replacement.TreeID == version.TreeID
+	for _, v := range p.cache.Versions {
+		if v.TreeID == version.TreeID && v.ID != versionID {
+			treeShared = true
+			break
+		}
+	}
+	var files []File
+	if !treeShared {
+		var err error
+		if files, _, err = p.trees.get(version.TreeID); err != nil {
+			return nil, err
+		}
+	}
+
+	m.delete(recordVersion, versionID)
+	for edgeID, edge := range p.cache.VersionMapping {
+		switch {
+		case edge.ChildVersionID == versionID && replacement != nil:
+			moved := *edge
+			moved.ChildVersionID = replacement.ID
+			m.put(recordEdge, edgeID, &moved)
+		case edge.ChildVersionID == versionID:
+			m.delete(recordEdge, edgeID)
+		case edge.ParentVersionID != versionID:
+		case reparentTo == "" || p.findEdge(edge.ChildVersionID, reparentTo) != nil:
+			m.delete(recordEdge, edgeID)
+		default:
+			moved := *edge
+			moved.ParentVersionID = reparentTo
+			m.put(recordEdge, edgeID, &moved)
+		}
+	}
+	for key, ref := range p.cache.BranchRefs {
+		if ref.VersionID != versionID {
+			continue
+		}
+		if reparentTo == "" {
+			m.delete(recordRef, key)
+		} else {
+			moved := *ref
+			moved.VersionID = reparentTo
+			m.put(recordRef, key, &moved)
+		}
+	}
+	// Tags name one exact version, so they go with it
+	for key, tag := range p.cache.Tags {
+		if tag.VersionID == versionID {
+			m.delete(recordTag, key)
+		}
+	}
+	if !treeShared {
+		m.delete(recordTree, version.TreeID)
+	}
+	return files, nil
+}
+
+// FindLatestVersionInDefaultBranch returns the newest version on the codebase's default branch.
+func (p *JSONFileProvider) FindLatestVersionInDefaultBranch(codebaseID string) (*Version, error) {
+	p.mu.RLock()
+	codebase, ok := p.cache.Codebases[codebaseID]
+	p.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("codebase %s not found", codebaseID)
+	}
+	branch := codebase.Branch
+	if branch == "" {
+		branch = "main"
+	}
+	return p.FindLatestVersionInBranch(codebaseID, branch, "")
+}
+
+// findEdge returns the lineage record linking child to parent, nil when there is none. Callers hold p.mu.
+func (p *JSONFileProvider) findEdge(childID, parentID string) *versionMappingRecord {
+	for _, m := range p.cache.VersionMapping {
+		if m.ChildVersionID == childID && m.ParentVersionID == parentID {
+			return m
+		}
+	}
+	return nil
 }
 
 func (p *JSONFileProvider) CreateVersionLink(codebaseID, childID, parentID, branch string, linkType LinkageType) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if _, exists := p.cache.VersionMapping[childID]; exists {
+	if p.findEdge(childID, parentID) != nil {
 		return nil // Link already exists
 	}
-	p.cache.VersionMapping[childID] = &versionMappingRecord{
-		ID:              uuid.NewString(),
+	edgeID := uuid.NewString()
+	m := newMutation("CreateVersionLink")
+	m.put(recordEdge, edgeID, &versionMappingRecord{
+		ID:              edgeID,
 		CodebaseID:      codebaseID,
 		Branch:          branch,
 		ChildVersionID:  childID,
 		ParentVersionID: parentID,
 		LinkageType:     linkType,
+	})
+	return p.commit(m)
+}
+
+// CreateVersionLinks inserts several links with a single write. Links that already exist are skipped.
+func (p *JSONFileProvider) CreateVersionLinks(links []VersionLink) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := newMutation("CreateVersionLinks")
+	added := make(map[[2]string]bool, len(links))
+	for _, l := range links {
+		pair := [2]string{l.ChildID, l.ParentID}
+		if added[pair] || p.findEdge(l.ChildID, l.ParentID) != nil {
+			continue
+		}
+		added[pair] = true
+		edgeID := uuid.NewString()
+		m.put(recordEdge, edgeID, &versionMappingRecord{
+			ID:              edgeID,
+			CodebaseID:      l.CodebaseID,
+			Branch:          l.Branch,
+			ChildVersionID:  l.ChildID,
+			ParentVersionID: l.ParentID,
+			LinkageType:     l.LinkageType,
+		})
+	}
+	return p.commit(m)
+}
+
+// DeleteVersionLink removes the lineage record linking child to parent.
+func (p *JSONFileProvider) DeleteVersionLink(childID, parentID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	edge := p.findEdge(childID, parentID)
+	if edge == nil {
+		return fmt.Errorf("version link %s -> %s not found", parentID, childID)
 	}
-	return p.save("version_mapping.json", p.cache.VersionMapping)
+	m := newMutation("DeleteVersionLink")
+	m.delete(recordEdge, edge.ID)
+	return p.commit(m)
 }
 
 func (p *JSONFileProvider) GetAllVersionsForMap(codebaseID string) ([]VersionNode, error) {
@@ -297,15 +754,15 @@ func (p *JSONFileProvider) GetAllVersionsForMap(codebaseID string) ([]VersionNod
 	if !ok {
 		return nodes, nil
 	}
+	var tags []*Tag
+	for _, tag := range p.cache.Tags {
+		if tag.CodebaseID == codebaseID {
+			tags = append(tags, tag)
+		}
+	}
+	tagNames := tagNamesByVersion(tags)
 	for _, v := range versions {
-		nodes = append(nodes, VersionNode{
-			ID:        v.ID,
-			Version:   v.Version,
-			Branch:    v.Branch,
-			Message:   v.Message,
-			CreatedAt: v.CreatedAt,
-			Stats:     v.Stats,
-		})
+		nodes = append(nodes, versionNode(v, tagNames[v.ID]))
 	}
 	return nodes, nil
 }
@@ -339,10 +796,426 @@ func (p *JSONFileProvider) GetBranchHeadsForMap(codebaseID string) (map[string]s
 			heads[v.Branch] = v.ID
 		}
 	}
+	// Branches declared without a snapshot point at their source version
+	for _, ref := range p.cache.BranchRefs {
+		if ref.CodebaseID != codebaseID {
+			continue
+		}
+		if _, ok := heads[ref.Branch]; !ok {
+			heads[ref.Branch] = ref.VersionID
+		}
+	}
 	return heads, nil
 }
 
+func (p *JSONFileProvider) CreateBranchRef(ref *BranchRef) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := fmt.Sprintf("%s/%s", ref.CodebaseID, ref.Branch)
+	if _, exists := p.cache.BranchRefs[key]; exists {
+		return fmt.Errorf("branch ref %s already exists", ref.Branch)
+	}
+	m := newMutation("CreateBranchRef")
+	m.put(recordRef, key, ref)
+	return p.commit(m)
+}
+
+func (p *JSONFileProvider) GetBranchRef(codebaseID, branch string) (*BranchRef, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	ref, ok := p.cache.BranchRefs[fmt.Sprintf("%s/%s", codebaseID, branch)]
+	if !ok {
+		return nil, nil // No explicit ref
+	}
+	return ref, nil
+}
+
+func (p *JSONFileProvider) DeleteBranchRef(codebaseID, branch string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := fmt.Sprintf("%s/%s", codebaseID, branch)
+	if _, exists := p.cache.BranchRefs[key]; !exists {
+		return nil
+	}
+	m := newMutation("DeleteBranchRef")
+	m.delete(recordRef, key)
+	return p.commit(m)
+}
+
+// ListBranchRefs returns the explicit branch refs of a codebase sorted by branch.
+func (p *JSONFileProvider) ListBranchRefs(codebaseID string) ([]*BranchRef, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	refs := []*BranchRef{}
+	for _, ref := range p.cache.BranchRefs {
+		if ref.CodebaseID == codebaseID {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Branch < refs[j].Branch })
+	return refs, nil
+}
+
+// RelabelBranch moves every version, lineage record and the branch ref of branch from onto branch to.
+// Version IDs and edges are untouched, so lineage is preserved. It fails without changing anything
+// when a version label exists on both branches.
+func (p *JSONFileProvider) RelabelBranch(codebaseID, from, to string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var moved []*Version
+	for _, v := range p.cache.versionsByCodebase[codebaseID] {
+		if v.Branch != from {
+			continue
+		}
+		if _, taken := p.cache.versionIDByBranchAndName[versionNameKey{codebaseID, to, v.Version}]; taken {
+			return fmt.Errorf("version %s already exists on branch %s", v.Version, to)
+		}
+		moved = append(moved, v)
+	}
+	fromKey := fmt.Sprintf("%s/%s", codebaseID, from)
+	ref, hasRef := p.cache.BranchRefs[fromKey]
+	if len(moved) == 0 && !hasRef {
+		return fmt.Errorf("branch %s not found", from)
+	}
+
+	m := newMutation("RelabelBranch")
+	for _, v := range moved {
+		relabeled := *v
+		relabeled.Branch = to
+		m.put(recordVersion, v.ID, &relabeled)
+	}
+	for edgeID, edge := range p.cache.VersionMapping {
+		if edge.CodebaseID == codebaseID && edge.Branch == from {
+			relabeled := *edge
+			relabeled.Branch = to
+			m.put(recordEdge, edgeID, &relabeled)
+		}
+	}
+	if hasRef {
+		m.delete(recordRef, fromKey)
+		toKey := fmt.Sprintf("%s/%s", codebaseID, to)
+		// A ref only matters while its branch has no versions of its own
+		if _, exists := p.cache.BranchRefs[toKey]; !exists && len(moved) == 0 {
+			relabeled := *ref
+			relabeled.Branch = to
+			m.put(recordRef, toKey, &relabeled)
+		}
+	}
+	if codebase, ok := p.cache.Codebases[codebaseID]; ok && codebase.Branch == from {
+		relabeled := *codebase
+		relabeled.Branch = to
+		m.put(recordCodebase, codebaseID, &relabeled)
+	}
+	return p.commit(m)
+}
+
+// CloneCodebase creates target and copies every version, file index, lineage record, branch ref and tag of the
+// source codebase in a single pass under the write lock. Versions and trees get new IDs, edges, refs and tags are
+// remapped to them; file entries keep their storage keys, so the clone shares the source's objects.
+func (p *JSONFileProvider) CloneCodebase(sourceID string, target *Codebase) (map[string]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.cache.Codebases[sourceID]; !ok {
+		return nil, fmt.Errorf("codebase %s not found", sourceID)
+	}
+	if _, exists := p.cache.Codebases[target.ID]; exists {
+		return nil, fmt.Errorf("codebase %s already exists", target.ID)
+	}
+
+	idMap := make(map[string]string, len(p.cache.versionsByCodebase[sourceID]))
+	for _, v := range p.cache.versionsByCodebase[sourceID] {
+		idMap[v.ID] = uuid.NewString()
+	}
+	// Trees are copied before any record changes, so a failed copy leaves nothing but stray tree files
+	clones := make([]*Version, 0, len(idMap))
+	cloneTrees := make(map[string][]File, len(idMap))
+	for _, v := range p.cache.versionsByCodebase[sourceID] {
+		clone := *v
+		clone.ID = idMap[v.ID]
+		clone.CodebaseID = target.ID
+		clone.TreeID = uuid.NewString()
+		files, ok, err := p.trees.get(v.TreeID)
+		if err == nil && ok {
+			err = p.trees.put(clone.TreeID, files)
+		}
+		if err != nil {
+			for treeID := range cloneTrees {
+				p.trees.remove(treeID)
+			}
+			return nil, err
+		}
+		if ok {
+			cloneTrees[clone.TreeID] = files
+		}
+		clones = append(clones, &clone)
+	}
+	m := newMutation("CloneCodebase")
+	m.put(recordCodebase, target.ID, target)
+	for _, clone := range clones {
+		m.put(recordVersion, clone.ID, clone)
+	}
+	for _, edge := range p.cache.VersionMapping {
+		childID, childOK := idMap[edge.ChildVersionID]
+		parentID, parentOK := idMap[edge.ParentVersionID]
+		if !childOK || !parentOK {
+			continue // edges leaving the codebase are not cloned
+		}
+		edgeID := uuid.NewString()
+		m.put(recordEdge, edgeID, &versionMappingRecord{
+			ID:              edgeID,
+			CodebaseID:      target.ID,
+			Branch:          edge.Branch,
+			ChildVersionID:  childID,
+			ParentVersionID: parentID,
+			LinkageType:     edge.LinkageType,
+		})
+	}
+	for _, ref := range p.cache.BranchRefs {
+		versionID, ok := idMap[ref.VersionID]
+		if ref.CodebaseID != sourceID || !ok {
+			continue
+		}
+		m.put(recordRef, fmt.Sprintf("%s/%s", target.ID, ref.Branch), &BranchRef{
+			CodebaseID: target.ID,
+			Branch:     ref.Branch,
+			VersionID:  versionID,
+			CreatedAt:  ref.CreatedAt,
+		})
+	}
+	for _, tag := range p.cache.Tags {
+		versionID, ok := idMap[tag.VersionID]
+		if tag.CodebaseID != sourceID || !ok {
+			continue
+		}
+		clone := *tag
+		clone.CodebaseID = target.ID
+		clone.VersionID = versionID
+		m.put(recordTag, fmt.Sprintf("%s/%s", target.ID, tag.Name), &clone)
+	}
+	if err := p.commit(m); err != nil {
+		for treeID := range cloneTrees {
+			p.trees.remove(treeID)
+		}
+		return nil, err
+	}
+	for _, files := range cloneTrees {
+		addBlobRefs(p.cache.BlobRefs, files)
+	}
+	return idMap, nil
+}
+
+// CreateTag stores a new tag; tag names are unique per codebase.
+func (p *JSONFileProvider) CreateTag(tag *Tag) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := fmt.Sprintf("%s/%s", tag.CodebaseID, tag.Name)
+	if _, exists := p.cache.Tags[key]; exists {
+		return fmt.Errorf("tag %s already exists", tag.Name)
+	}
+	if _, ok := p.cache.Versions[tag.VersionID]; !ok {
+		return fmt.Errorf("version %s not found", tag.VersionID)
+	}
+	m := newMutation("CreateTag")
+	m.put(recordTag, key, tag)
+	return p.commit(m)
+}
+
+func (p *JSONFileProvider) DeleteTag(codebaseID, name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := fmt.Sprintf("%s/%s", codebaseID, name)
+	if _, exists := p.cache.Tags[key]; !exists {
+		return fmt.Errorf("tag %s not found", name)
+	}
+	m := newMutation("DeleteTag")
+	m.delete(recordTag, key)
+	return p.commit(m)
+}
+
+// ListTags returns the tags of a codebase sorted by name.
+func (p *JSONFileProvider) ListTags(codebaseID string) ([]*Tag, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	tags := []*Tag{}
+	for _, tag := range p.cache.Tags {
+		if tag.CodebaseID == codebaseID {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags, nil
+}
+
+func (p *JSONFileProvider) ResolveTag(codebaseID, name string) (*Tag, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	tag, ok := p.cache.Tags[fmt.Sprintf("%s/%s", codebaseID, name)]
+	if !ok {
+		return nil, fmt.Errorf("tag %s not found", name)
+	}
+	return tag, nil
+}
+
+// CreateWebhook stores a new webhook subscription.
+func (p *JSONFileProvider) CreateWebhook(hook *Webhook) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.cache.Webhooks[hook.ID]; exists {
+		return fmt.Errorf("webhook %s already exists", hook.ID)
+	}
+	m := newMutation("CreateWebhook")
+	m.put(recordWebhook, hook.ID, hook)
+	return p.commit(m)
+}
+
+func (p *JSONFileProvider) DeleteWebhook(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.cache.Webhooks[id]; !exists {
+		return fmt.Errorf("webhook %s not found", id)
+	}
+	m := newMutation("DeleteWebhook")
+	m.delete(recordWebhook, id)
+	return p.commit(m)
+}
+
+// ListWebhooks returns all webhook subscriptions, oldest first.
+func (p *JSONFileProvider) ListWebhooks() ([]*Webhook, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	hooks := make([]*Webhook, 0, len(p.cache.Webhooks))
+	for _, h := range p.cache.Webhooks {
+		hooks = append(hooks, h)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt.Before(hooks[j].CreatedAt) })
+	return hooks, nil
+}
+
+// SaveQuarantineEntry records or replaces the quarantine entry of a storage key.
+func (p *JSONFileProvider) SaveQuarantineEntry(entry *QuarantineEntry) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := newMutation("SaveQuarantineEntry")
+	m.put(recordQuarantine, entry.StorageKey, entry)
+	return p.commit(m)
+}
+
+// ListQuarantineEntries returns all quarantined objects, oldest detection first.
+func (p *JSONFileProvider) ListQuarantineEntries() ([]*QuarantineEntry, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	entries := make([]*QuarantineEntry, 0, len(p.cache.Quarantine))
+	for _, e := range p.cache.Quarantine {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].DetectedAt.Before(entries[j].DetectedAt) })
+	return entries, nil
+}
+
+func (p *JSONFileProvider) DeleteQuarantineEntry(storageKey string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.cache.Quarantine[storageKey]; !exists {
+		return fmt.Errorf("quarantine entry %s not found", storageKey)
+	}
+	m := newMutation("DeleteQuarantineEntry")
+	m.delete(recordQuarantine, storageKey)
+	return p.commit(m)
+}
+
+// AppendAuditEntry adds an entry to the audit log.
+func (p *JSONFileProvider) AppendAuditEntry(entry *AuditEntry) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.cache.AuditLog[entry.ID]; exists {
+		return fmt.Errorf("audit entry %s already exists", entry.ID)
+	}
+	m := newMutation("AppendAuditEntry")
+	m.put(recordAudit, entry.ID, entry)
+	return p.commit(m)
+}
+
+// ListAuditEntries returns the audit log, oldest entry first.
+func (p *JSONFileProvider) ListAuditEntries() ([]*AuditEntry, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	entries := make([]*AuditEntry, 0, len(p.cache.AuditLog))
+	for _, e := range p.cache.AuditLog {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Time.Equal(entries[j].Time) {
+			return entries[i].Time.Before(entries[j].Time)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+func idempotencyKey(codebaseID, key string) string {
+	return codebaseID + "/" + key
+}
+
+// SaveIdempotencyRecord records or replaces the result of an idempotency key.
+func (p *JSONFileProvider) SaveIdempotencyRecord(record *IdempotencyRecord) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := newMutation("SaveIdempotencyRecord")
+	m.put(recordIdempotent, idempotencyKey(record.CodebaseID, record.Key), record)
+	return p.commit(m)
+}
+
+func (p *JSONFileProvider) GetIdempotencyRecord(codebaseID, key string) (*IdempotencyRecord, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	record, ok := p.cache.IdempotencyKeys[idempotencyKey(codebaseID, key)]
+	if !ok {
+		return nil, fmt.Errorf("idempotency key %s not found", key)
+	}
+	return record, nil
+}
+
+// ListIdempotencyRecords returns all recorded idempotency keys, oldest first.
+func (p *JSONFileProvider) ListIdempotencyRecords() ([]*IdempotencyRecord, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	records := make([]*IdempotencyRecord, 0, len(p.cache.IdempotencyKeys))
+	for _, r := range p.cache.IdempotencyKeys {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+	return records, nil
+}
+
+func (p *JSONFileProvider) DeleteExpiredIdempotencyRecords(now time.Time) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := newMutation("DeleteExpiredIdempotencyRecords")
+	expired := 0
+	for key, record := range p.cache.IdempotencyKeys {
+		if record.ExpiresAt.Before(now) {
+			m.delete(recordIdempotent, key)
+			expired++
+		}
+	}
+	if err := p.commit(m); err != nil {
+		return 0, err
+	}
+	return expired, nil
+}
+
+// historyLock returns the lock guarding the history cache file of a codebase.
+func (p *JSONFileProvider) historyLock(codebaseID string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(codebaseID))
+	return &p.historyLocks[h.Sum32()%historyLockStripes]
+}
+
 func (p *JSONFileProvider) GetHistoryCache(codebaseID string) ([]byte, error) {
+	lock := p.historyLock(codebaseID)
+	lock.RLock()
+	defer lock.RUnlock()
 	path := filepath.Join(p.dbPath, "history_cache", codebaseID+".json")
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return nil, fmt.Errorf("cache not found")
@@ -350,11 +1223,129 @@ func (p *JSONFileProvider) GetHistoryCache(codebaseID string) ([]byte, error) {
 	return ioutil.ReadFile(path)
 }
 
+// UpdateHistoryCache writes the cache to a temporary file and renames it into place,
+// so a reader never observes a partially written cache.
 func (p *JSONFileProvider) UpdateHistoryCache(codebaseID string, data []byte) error {
 	dir := filepath.Join(p.dbPath, "history_cache")
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
-	path := filepath.Join(dir, codebaseID+".json")
-	return ioutil.WriteFile(path, data, 0644)
+	tmp, err := os.CreateTemp(dir, codebaseID+".json.tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	lock := p.historyLock(codebaseID)
+	lock.Lock()
+	defer lock.Unlock()
+	return os.Rename(tmp.Name(), filepath.Join(dir, codebaseID+".json"))
+}
+
+func (p *JSONFileProvider) DeleteHistoryCache(codebaseID string) error {
+	lock := p.historyLock(codebaseID)
+	lock.Lock()
+	defer lock.Unlock()
+	err := os.Remove(filepath.Join(p.dbPath, "history_cache", codebaseID+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ListHistoryCaches returns the codebase IDs that have a history cache file.
+func (p *JSONFileProvider) ListHistoryCaches() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(p.dbPath, "history_cache"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if !e.IsDir() && filepath.Ext(e.Name()) == ".json" {
+			ids = append(ids, strings.TrimSuffix(e.Name(), ".json"))
+		}
+	}
+	return ids, nil
+}
+
+func (p *JSONFileProvider) RebuildIndexes() (*IndexRebuildReport, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.rebuildIndexes()
+	report := &IndexRebuildReport{
+		DanglingRefs:  []BranchRef{},
+		OrphanTrees:   []string{},
+		MissingTrees:  []string{},
+		DanglingEdges: []string{},
+	}
+
+	usedTrees := make(map[string]bool, len(p.cache.Versions))
+	for _, v := range p.cache.Versions {
+		usedTrees[v.TreeID] = true
+		if !p.trees.has(v.TreeID) {
+			report.MissingTrees = append(report.MissingTrees, v.ID)
+		}
+	}
+	treeIDs, err := p.trees.ids()
+	if err != nil {
+		return nil, err
+	}
+	for _, treeID := range treeIDs {
+		if !usedTrees[treeID] {
+			report.OrphanTrees = append(report.OrphanTrees, treeID)
+		}
+	}
+	for _, m := range p.cache.VersionMapping {
+		_, childOK := p.cache.Versions[m.ChildVersionID]
+		_, parentOK := p.cache.Versions[m.ParentVersionID]
+		if !childOK || !parentOK {
+			report.DanglingEdges = append(report.DanglingEdges, m.ID)
+		}
+	}
+
+	m := newMutation("RebuildIndexes")
+	for key, ref := range p.cache.BranchRefs {
+		if _, ok := p.cache.Versions[ref.VersionID]; !ok {
+			report.DanglingRefs = append(report.DanglingRefs, *ref)
+			m.delete(recordRef, key)
+		}
+	}
+	if err := p.commit(m); err != nil {
+		return nil, err
+	}
+
+	counted, err := countBlobRefs(p.trees)
+	if err != nil {
+		return nil, err
+	}
+	for key, refs := range counted {
+		if p.cache.BlobRefs[key] != refs {
+			report.RepairedBlobRefs++
+		}
+	}
+	for key := range p.cache.BlobRefs {
+		if _, ok := counted[key]; !ok {
+			report.RepairedBlobRefs++
+		}
+	}
+	p.cache.BlobRefs = counted
+
+	sort.Strings(report.OrphanTrees)
+	sort.Strings(report.MissingTrees)
+	sort.Strings(report.DanglingEdges)
+	return report, nil
 }
@@ -0,0 +1,186 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openJSONProvider opens a JSON provider on dir that writes every change before the mutation returns.
+func openJSONProvider(t *testing.T, dir string) *JSONFileProvider {
+	t.Helper()
+	p, err := NewJSONFileProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetFlushPolicy(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// A crash during writeFileAtomic leaves a partly written temporary file next to the target; the
+// target itself keeps the old content, and the next open and save ignore the leftover.
+func TestWriteFileAtomicPartialWrite(t *testing.T) {
+	dir := t.TempDir()
+	p := openJSONProvider(t, dir)
+	mustCreateCodebase(t, p, "cb")
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, codebasesDir, "cb", codebaseFile)
+	old, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What writeFileAtomic has on disk when the process dies halfway through writing the new content
+	renamed := strings.Replace(string(old), `"cb"`, `"renamed"`, -1)
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmp.WriteString(renamed[:len(renamed)/2]); err != nil {
+		t.Fatal(err)
+	}
+	tmp.Close()
+
+	if got, err := os.ReadFile(path); err != nil || string(got) != string(old) {
+		t.Fatalf("%s after the partial write = %q, %v, want the old content", codebaseFile, got, err)
+	}
+	p = openJSONProvider(t, dir)
+	defer p.Close()
+	cb, err := p.GetCodebaseByID("cb")
+	if err != nil || cb.Name != "cb" {
+		t.Fatalf("codebase after reopening = %+v, %v, want the old record", cb, err)
+	}
+	if recoveries, _ := p.MetadataRecoveries(); len(recoveries) != 0 {
+		t.Errorf("reopening recovered %+v from backups, want the old file read as it is", recoveries)
+	}
+
+	cb.Name = "renamed"
+	if err := p.UpdateCodebase(cb); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(path); err != nil || !strings.Contains(string(got), `"renamed"`) {
+		t.Errorf("%s after the next save = %q, %v", codebaseFile, got, err)
+	}
+	leftovers, _ := filepath.Glob(path + ".tmp-*")
+	if len(leftovers) != 1 || leftovers[0] != tmp.Name() {
+		t.Errorf("temporary files = %v, want only the one of the crashed write", leftovers)
+	}
+}
+
+// A write that fails before the rename leaves the target as it was and removes its temporary file.
+func TestWriteFileAtomicFailedRename(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "meta.json")
+	// A non-empty directory can't be renamed over
+	if err := os.MkdirAll(filepath.Join(path, "child"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(path, []byte(`{"new":true}`), 0644); err == nil {
+		t.Fatal("writeFileAtomic over a non-empty directory succeeded")
+	}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		t.Errorf("target after the failed write = %v, %v, want the directory untouched", info, err)
+	}
+	if leftovers, _ := filepath.Glob(path + ".tmp-*"); len(leftovers) != 0 {
+		t.Errorf("the failed write left %v behind", leftovers)
+	}
+}
+
+// A metadata file damaged on disk is replaced by its newest backup that parses when the provider opens it.
+func TestJSONProviderRecoversCorruptFileFromBackup(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+	}{
+		{"first byte", func(data []byte) []byte { data[0] = 0xff; return data }},
+		{"byte in the middle", func(data []byte) []byte { data[len(data)/2] = 0; return data }},
+		{"truncated", func(data []byte) []byte { return data[:len(data)/2] }},
+		{"zeroed tail", func(data []byte) []byte {
+			for i := len(data) / 2; i < len(data); i++ {
+				data[i] = 0
+			}
+			return data
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			p := openJSONProvider(t, dir)
+			mustCreateCodebase(t, p, "cb")
+			v1 := mustCreateVersion(t, p, "cb", "main", "v1", 1, "k1")
+			v2 := mustCreateVersion(t, p, "cb", "main", "v2", 2, "k2")
+			mustCreateVersion(t, p, "cb", "main", "v3", 3, "k3")
+			if err := p.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(dir, codebasesDir, "cb", codebaseVersions)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			damaged := tt.corrupt(data)
+			if err := os.WriteFile(path, damaged, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			p = openJSONProvider(t, dir)
+			defer p.Close()
+			// The newest backup was taken before v3 was written
+			versions, err := p.ListVersions("cb")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := strings.Join(versionIDs(versions), ","), v2.ID+","+v1.ID; got != want {
+				t.Errorf("versions after recovery = %s, want %s", got, want)
+			}
+			recoveries, _ := p.MetadataRecoveries()
+			if len(recoveries) != 1 || recoveries[0].File != codebasesDir+"/cb/"+codebaseVersions || recoveries[0].Backup != codebaseVersions+".bak" {
+				t.Errorf("recoveries = %+v, want %s restored from its .bak", recoveries, codebaseVersions)
+			}
+			if kept, err := os.ReadFile(path + ".corrupt"); err != nil || string(kept) != string(damaged) {
+				t.Errorf("corrupt copy = %q, %v, want the damaged file", kept, err)
+			}
+		})
+	}
+}
+
+// When the newest backup is damaged as well, the next generation is used.
+func TestJSONProviderRecoversFromOlderBackup(t *testing.T) {
+	dir := t.TempDir()
+	p := openJSONProvider(t, dir)
+	mustCreateCodebase(t, p, "cb")
+	v1 := mustCreateVersion(t, p, "cb", "main", "v1", 1, "k1")
+	mustCreateVersion(t, p, "cb", "main", "v2", 2, "k2")
+	mustCreateVersion(t, p, "cb", "main", "v3", 3, "k3")
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, codebasesDir, "cb", codebaseVersions)
+	for _, damaged := range []string{path, backupPath(path, 0)} {
+		data, err := os.ReadFile(damaged)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A fresh file, so the hard link of the backup keeps its content
+		os.Remove(damaged)
+		if err := os.WriteFile(damaged, data[:len(data)-2], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p = openJSONProvider(t, dir)
+	defer p.Close()
+	versions, err := p.ListVersions("cb")
+	if err != nil || strings.Join(versionIDs(versions), ",") != v1.ID {
+		t.Errorf("versions after recovery = %v, %v, want only v1", versionIDs(versions), err)
+	}
+	if recoveries, _ := p.MetadataRecoveries(); len(recoveries) != 1 || recoveries[0].Backup != codebaseVersions+".bak.1" {
+		t.Errorf("recoveries = %+v, want %s restored from .bak.1", recoveries, codebaseVersions)
+	}
+}
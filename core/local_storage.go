@@ -2,6 +2,8 @@ package core
 
 import (
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -37,6 +39,61 @@ func (s *LocalStorage) GetObject(objectName string) ([]byte, error) {
 	return data, err
 }
 
+// PutObjectStream writes r to a temporary file next to the object and renames it into place, so
+// readers never see a partial object and concurrent writers of the same key don't interleave.
+func (s *LocalStorage) PutObjectStream(objectName string, r io.Reader, size int64) error {
+	path := filepath.Join(s.basePath, objectName)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	written, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size >= 0 && written != size {
+		return fmt.Errorf("short write of %s: %d of %d bytes", objectName, written, size)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// GetObjectStream opens an object for reading.
+func (s *LocalStorage) GetObjectStream(objectName string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.basePath, objectName))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("object not found: %s", objectName)
+	}
+	return f, err
+}
+
+// ObjectExists reports whether an object is present without reading it.
+func (s *LocalStorage) ObjectExists(objectName string) (bool, error) {
+	_, err := os.Stat(filepath.Join(s.basePath, objectName))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// DeleteObject removes a single object, deleting one that doesn't exist is not an error.
+func (s *LocalStorage) DeleteObject(objectName string) error {
+	err := os.Remove(filepath.Join(s.basePath, objectName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 func (s *LocalStorage) DeleteObjectsWithPrefix(prefix string) error {
 	// For safety, treat prefix as directory relative to base path
 	dirPath := filepath.Join(s.basePath, prefix)
@@ -45,3 +102,49 @@ func (s *LocalStorage) DeleteObjectsWithPrefix(prefix string) error {
 	}
 	return os.RemoveAll(dirPath)
 }
+
+// ListObjects walks the storage directory and calls fn for each object whose name starts with
+// prefix, in lexical order of the path. Names use forward slashes like the keys objects are stored under.
+func (s *LocalStorage) ListObjects(prefix string, fn func(ObjectInfo) error) error {
+	// Only the directory holding the prefix needs walking
+	root := filepath.Join(s.basePath, filepath.Dir(filepath.FromSlash(prefix)))
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // removed while walking
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.basePath, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+	})
+}
+
+// StatObject returns the size and modification time of an object without reading it.
+func (s *LocalStorage) StatObject(objectName string) (ObjectInfo, error) {
+	info, err := os.Stat(filepath.Join(s.basePath, objectName))
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return ObjectInfo{}, fmt.Errorf("object not found: %s", objectName)
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Name: objectName, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
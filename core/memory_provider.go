@@ -0,0 +1,180 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryProvider is a DataProvider that keeps all metadata in memory and never touches the
+// filesystem. It shares the record handling of JSONFileProvider, so behaviour is identical
+// apart from persistence; meant for tests and throwaway instances.
+type MemoryProvider struct {
+	*JSONFileProvider
+	historyMu sync.RWMutex
+	history   map[string][]byte // codebase_id -> history cache
+}
+
+func NewMemoryProvider() *MemoryProvider {
+	p := &JSONFileProvider{cache: newInMemoryCache(), trees: newTreeStore("")}
+	p.initFlush(0, defaultFlushMaxPending) // nothing to write
+	p.rebuildIndexes()
+	return &MemoryProvider{
+		JSONFileProvider: p,
+		history:          make(map[string][]byte),
+	}
+}
+
+// DeleteCodebaseByID removes the records of a codebase and its history cache from memory.
+func (p *MemoryProvider) DeleteCodebaseByID(id string) error {
+	if err := p.deleteCodebase(id); err != nil {
+		return err
+	}
+	return p.DeleteHistoryCache(id)
+}
+
+func (p *MemoryProvider) GetHistoryCache(codebaseID string) ([]byte, error) {
+	p.historyMu.RLock()
+	defer p.historyMu.RUnlock()
+	data, ok := p.history[codebaseID]
+	if !ok {
+		return nil, fmt.Errorf("cache not found")
+	}
+	return data, nil
+}
+
+func (p *MemoryProvider) UpdateHistoryCache(codebaseID string, data []byte) error {
+	p.historyMu.Lock()
+	defer p.historyMu.Unlock()
+	p.history[codebaseID] = append([]byte(nil), data...)
+	return nil
+}
+
+func (p *MemoryProvider) DeleteHistoryCache(codebaseID string) error {
+	p.historyMu.Lock()
+	defer p.historyMu.Unlock()
+	delete(p.history, codebaseID)
+	return nil
+}
+
+func (p *MemoryProvider) ListHistoryCaches() ([]string, error) {
+	p.historyMu.RLock()
+	defer p.historyMu.RUnlock()
+	ids := make([]string, 0, len(p.history))
+	for id := range p.history {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// MemoryStorage is a Storage keeping objects in a map, meant for tests.
+type MemoryStorage struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{objects: make(map[string]memoryObject)}
+}
+
+func (s *MemoryStorage) PutObject(objectName string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[objectName] = memoryObject{data: append([]byte(nil), data...), modTime: time.Now()}
+	return nil
+}
+
+func (s *MemoryStorage) GetObject(objectName string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obj, ok := s.objects[objectName]
+	if !ok {
+		return nil, fmt.Errorf("object not found: %s", objectName)
+	}
+	return append([]byte(nil), obj.data...), nil
+}
+
+func (s *MemoryStorage) PutObjectStream(objectName string, r io.Reader, size int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return s.PutObject(objectName, data)
+}
+
+func (s *MemoryStorage) GetObjectStream(objectName string) (io.ReadCloser, error) {
+	data, err := s.GetObject(objectName)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *MemoryStorage) ObjectExists(objectName string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.objects[objectName]
+	return ok, nil
+}
+
+// DeleteObject removes a single object, deleting one that doesn't exist is not an error.
+func (s *MemoryStorage) DeleteObject(objectName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, objectName)
+	return nil
+}
+
+func (s *MemoryStorage) DeleteObjectsWithPrefix(prefix string) error {
+	if strings.TrimSpace(prefix) == "" {
+		return fmt.Errorf("not allowed to delete root directory or use empty prefix")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			delete(s.objects, name)
+		}
+	}
+	return nil
+}
+
+// ListObjects calls fn for the objects whose name starts with prefix, sorted by name. fn runs
+// without the storage lock held, so it may modify the storage.
+func (s *MemoryStorage) ListObjects(prefix string, fn func(ObjectInfo) error) error {
+	s.mu.RLock()
+	var objects []ObjectInfo
+	for name, obj := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, ObjectInfo{Name: name, Size: int64(len(obj.data)), ModTime: obj.modTime})
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	for _, obj := range objects {
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) StatObject(objectName string) (ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obj, ok := s.objects[objectName]
+	if !ok {
+		return ObjectInfo{}, fmt.Errorf("object not found: %s", objectName)
+	}
+	return ObjectInfo{Name: objectName, Size: int64(len(obj.data)), ModTime: obj.modTime}, nil
+}
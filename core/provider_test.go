@@ -0,0 +1,556 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// providerFactoriesForTest build an empty provider of each backend; the conformance tests below run
+// against all of them, so the backends stay interchangeable.
+var providerFactoriesForTest = map[string]func(t *testing.T) DataProvider{
+	ProviderTypeJSON: func(t *testing.T) DataProvider {
+		p, err := NewJSONFileProvider(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { p.Close() })
+		return p
+	},
+	ProviderTypeMemory: func(t *testing.T) DataProvider {
+		return NewMemoryProvider()
+	},
+	ProviderTypeBolt: func(t *testing.T) DataProvider {
+		p, err := NewBoltProvider(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { p.Close() })
+		return p
+	},
+}
+
+func forEachProvider(t *testing.T, test func(t *testing.T, p DataProvider)) {
+	for _, name := range sortedKeys(providerFactoriesForTest) {
+		t.Run(name, func(t *testing.T) {
+			test(t, providerFactoriesForTest[name](t))
+		})
+	}
+}
+
+var testEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func mustCreateCodebase(t *testing.T, p DataProvider, id string) *Codebase {
+	t.Helper()
+	cb := &Codebase{ID: id, Name: id, Branch: "main", CreatedAt: testEpoch, UpdatedAt: testEpoch}
+	if err := p.CreateCodebase(cb); err != nil {
+		t.Fatalf("CreateCodebase(%s): %v", id, err)
+	}
+	return cb
+}
+
+// mustCreateVersion stores version n of a branch, created n minutes after testEpoch, with one file
+// whose storage key is key.
+func mustCreateVersion(t *testing.T, p DataProvider, codebaseID, branch, name string, n int, key string) *Version {
+	t.Helper()
+	v := &Version{
+		ID:         fmt.Sprintf("%s-%s-%s", codebaseID, branch, name),
+		CodebaseID: codebaseID,
+		Version:    name,
+		Branch:     branch,
+		TreeID:     fmt.Sprintf("tree-%s-%s-%s", codebaseID, branch, name),
+		CreatedAt:  testEpoch.Add(time.Duration(n) * time.Minute),
+	}
+	files := []File{{Path: "a.txt", Hash: key, Size: 1, StorageKey: key}}
+	if err := p.CreateVersion(v, files); err != nil {
+		t.Fatalf("CreateVersion(%s): %v", v.ID, err)
+	}
+	return v
+}
+
+func versionIDs(versions []*Version) []string {
+	ids := []string{}
+	for _, v := range versions {
+		ids = append(ids, v.ID)
+	}
+	return ids
+}
+
+func TestProviderCodebases(t *testing.T) {
+	forEachProvider(t, func(t *testing.T, p DataProvider) {
+		mustCreateCodebase(t, p, "b")
+		later := &Codebase{ID: "a", Name: "a", CreatedAt: testEpoch.Add(time.Hour)}
+		if err := p.CreateCodebase(later); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.CreateCodebase(later); err == nil {
+			t.Error("creating an existing codebase succeeded")
+		}
+		list, err := p.ListCodebases()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 2 || list[0].ID != "b" || list[1].ID != "a" {
+			t.Errorf("ListCodebases is not ordered by creation: %+v", list)
+		}
+
+		stamp := testEpoch.Add(2 * time.Hour)
+		if err := p.UpdateCodebaseTimestamp("a", stamp); err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.GetCodebaseByID("a")
+		if err != nil || !got.UpdatedAt.Equal(stamp) {
+			t.Errorf("GetCodebaseByID after UpdateCodebaseTimestamp = %+v, %v", got, err)
+		}
+		if _, err := p.GetCodebaseByID("missing"); err == nil {
+			t.Error("GetCodebaseByID of a missing codebase succeeded")
+		}
+		if err := p.UpdateCodebase(&Codebase{ID: "missing"}); err == nil {
+			t.Error("UpdateCodebase of a missing codebase succeeded")
+		}
+	})
+}
+
+func TestProviderVersionLookups(t *testing.T) {
+	forEachProvider(t, func(t *testing.T, p DataProvider) {
+		mustCreateCodebase(t, p, "cb")
+		v1 := mustCreateVersion(t, p, "cb", "main", "v1", 1, "k1")
+		v2 := mustCreateVersion(t, p, "cb", "main", "v2", 2, "k2")
+		dev := mustCreateVersion(t, p, "cb", "dev", "v1", 3, "k3")
+
+		dup := *v1
+		dup.ID = "other"
+		var exists *VersionExistsError
+		if err := p.CreateVersion(&dup, nil); !errors.As(err, &exists) || exists.VersionID != v1.ID {
+			t.Errorf("CreateVersion of an existing name = %v, want VersionExistsError for %s", err, v1.ID)
+		}
+
+		got, err := p.GetVersion("cb", "main", "v2")
+		if err != nil || got.ID != v2.ID {
+			t.Errorf("GetVersion(main, v2) = %v, %v", got, err)
+		}
+		if _, err := p.GetVersion("cb", "dev", "v2"); err == nil {
+			t.Error("GetVersion of a name on another branch succeeded")
+		}
+		branches, err := p.FindBranchesWithVersion("cb", "v1")
+		if err != nil || !reflect.DeepEqual(branches, []string{"dev", "main"}) {
+			t.Errorf("FindBranchesWithVersion(v1) = %v, %v", branches, err)
+		}
+
+		list, err := p.ListVersions("cb")
+		if want := []string{dev.ID, v2.ID, v1.ID}; err != nil || !reflect.DeepEqual(versionIDs(list), want) {
+			t.Errorf("ListVersions = %v, %v, want newest first %v", versionIDs(list), err, want)
+		}
+		latest, err := p.FindLatestVersionInBranch("cb", "main", "")
+		if err != nil || latest.ID != v2.ID {
+			t.Errorf("FindLatestVersionInBranch(main) = %v, %v", latest, err)
+		}
+		latest, err = p.FindLatestVersionInBranch("cb", "main", v2.ID)
+		if err != nil || latest.ID != v1.ID {
+			t.Errorf("FindLatestVersionInBranch(main) excluding v2 = %v, %v", latest, err)
+		}
+		if latest, err := p.FindLatestVersionInBranch("cb", "none", ""); err != nil || latest != nil {
+			t.Errorf("FindLatestVersionInBranch of a missing branch = %v, %v, want nil", latest, err)
+		}
+		if isNew, err := p.IsNewBranch("cb", "dev", dev.ID); err != nil || !isNew {
+			t.Errorf("IsNewBranch(dev) excluding its only version = %v, %v", isNew, err)
+		}
+		if latest, err := p.FindLatestVersionInDefaultBranch("cb"); err != nil || latest.ID != v2.ID {
+			t.Errorf("FindLatestVersionInDefaultBranch = %v, %v", latest, err)
+		}
+		files, err := p.GetFileIndexesByTreeID(v1.TreeID)
+		if err != nil || len(files) != 1 || files[0].StorageKey != "k1" {
+			t.Errorf("GetFileIndexesByTreeID = %+v, %v", files, err)
+		}
+	})
+}
+
+func TestProviderDeleteVersionReparents(t *testing.T) {
+	forEachProvider(t, func(t *testing.T, p DataProvider) {
+		mustCreateCodebase(t, p, "cb")
+		v1 := mustCreateVersion(t, p, "cb", "main", "v1", 1, "k1")
+		v2 := mustCreateVersion(t, p, "cb", "main", "v2", 2, "k2")
+		v3 := mustCreateVersion(t, p, "cb", "main", "v3", 3, "k3")
+		if err := p.CreateVersionLink("cb", v2.ID, v1.ID, "main", LinkageTypeSequential); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.CreateVersionLink("cb", v3.ID, v2.ID, "main", LinkageTypeSequential); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.CreateBranchRef(&BranchRef{CodebaseID: "cb", Branch: "feature", VersionID: v2.ID}); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.CreateTag(&Tag{CodebaseID: "cb", Name: "release", VersionID: v2.ID}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := p.DeleteVersion(v2.ID, v1.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.GetVersionByID(v2.ID); err == nil {
+			t.Error("deleted version is still found")
+		}
+		// The json provider removes tree files when it writes its batch
+		if err := p.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.GetFileIndexesByTreeID(v2.TreeID); err == nil {
+			t.Error("tree of the deleted version is still found")
+		}
+		edges, err := p.GetAllVersionEdgesForMap("cb")
+		if err != nil || len(edges) != 1 || edges[0].From != v1.ID || edges[0].To != v3.ID {
+			t.Errorf("edges after deleting v2 = %+v, %v, want v1 -> v3", edges, err)
+		}
+		ref, err := p.GetBranchRef("cb", "feature")
+		if err != nil || ref == nil || ref.VersionID != v1.ID {
+			t.Errorf("branch ref after deleting v2 = %+v, %v, want it moved to v1", ref, err)
+		}
+		if _, err := p.ResolveTag("cb", "release"); err == nil {
+			t.Error("tag of the deleted version is still found")
+		}
+		counts, err := p.BlobRefCounts([]string{"k1", "k2", "k3"})
+		if want := map[string]int{"k1": 1, "k2": 0, "k3": 1}; err != nil || !reflect.DeepEqual(counts, want) {
+			t.Errorf("BlobRefCounts = %v, %v, want %v", counts, err, want)
+		}
+	})
+}
+
+func TestProviderReplaceVersion(t *testing.T) {
+	forEachProvider(t, func(t *testing.T, p DataProvider) {
+		mustCreateCodebase(t, p, "cb")
+		v1 := mustCreateVersion(t, p, "cb", "main", "v1", 1, "k1")
+		v2 := mustCreateVersion(t, p, "cb", "main", "v2", 2, "k2")
+		if err := p.CreateVersionLink("cb", v2.ID, v1.ID, "main", LinkageTypeSequential); err != nil {
+			t.Fatal(err)
+		}
+		replacement := &Version{ID: "new", CodebaseID: "cb", Version: "v2", Branch: "main", TreeID: "tree-new", CreatedAt: v2.CreatedAt}
+		if err := p.ReplaceVersion(v2.ID, replacement, []File{{Path: "a.txt", StorageKey: "k4"}}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.GetVersion("cb", "main", "v2")
+		if err != nil || got.ID != "new" {
+			t.Errorf("GetVersion after ReplaceVersion = %v, %v", got, err)
+		}
+		edges, err := p.GetAllVersionEdgesForMap("cb")
+		if err != nil || len(edges) != 1 || edges[0].From != v1.ID || edges[0].To != "new" {
+			t.Errorf("edges after ReplaceVersion = %+v, %v, want v1 -> new", edges, err)
+		}
+		counts, _ := p.BlobRefCounts([]string{"k2", "k4"})
+		if counts["k2"] != 0 || counts["k4"] != 1 {
+			t.Errorf("BlobRefCounts after ReplaceVersion = %v", counts)
+		}
+	})
+}
+
+func TestProviderVersionFlagsAndMapAnnotations(t *testing.T) {
+	forEachProvider(t, func(t *testing.T, p DataProvider) {
+		mustCreateCodebase(t, p, "cb")
+		v1 := mustCreateVersion(t, p, "cb", "main", "v1", 1, "k1")
+		mustCreateVersion(t, p, "cb", "main", "v2", 2, "k2")
+		for _, name := range []string{"stable", "alpha"} {
+			if err := p.CreateTag(&Tag{CodebaseID: "cb", Name: name, VersionID: v1.ID, CreatedAt: testEpoch}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := p.SetVersionFlags(v1.ID, true, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.SetVersionFlags("missing", true, true); err == nil {
+			t.Error("SetVersionFlags of a missing version succeeded")
+		}
+		got, err := p.GetVersionByID(v1.ID)
+		if err != nil || !got.Locked || got.Pinned {
+			t.Errorf("GetVersionByID after SetVersionFlags = %+v, %v, want locked", got, err)
+		}
+		if got, err := p.GetVersion("cb", "main", "v1"); err != nil || !got.Locked {
+			t.Errorf("GetVersion after SetVersionFlags = %+v, %v, want locked", got, err)
+		}
+
+		nodes, err := p.GetAllVersionsForMap("cb")
+		if err != nil || len(nodes) != 2 {
+			t.Fatalf("GetAllVersionsForMap = %+v, %v", nodes, err)
+		}
+		for _, n := range nodes {
+			switch n.ID {
+			case v1.ID:
+				if !n.Locked || n.Pinned || strings.Join(n.Tags, ",") != "alpha,stable" {
+					t.Errorf("node of v1 = %+v, want locked with tags alpha,stable", n)
+				}
+			default:
+				if n.Locked || n.Pinned || n.Tags != nil {
+					t.Errorf("node of v2 = %+v, want no annotations", n)
+				}
+			}
+		}
+	})
+}
+
+func TestProviderAuditLog(t *testing.T) {
+	forEachProvider(t, func(t *testing.T, p DataProvider) {
+		mustCreateCodebase(t, p, "cb")
+		for i, id := range []string{"b", "a", "c"} {
+			entry := &AuditEntry{ID: id, Time: testEpoch.Add(time.Duration(i) * time.Minute), Action: "trash_purge", CodebaseID: "cb"}
+			if err := p.AppendAuditEntry(entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := p.AppendAuditEntry(&AuditEntry{ID: "a", Time: testEpoch}); err == nil {
+			t.Error("an audit entry with a taken ID was accepted")
+		}
+		// The audit log outlives the codebases it mentions
+		if err := p.DeleteCodebaseByID("cb"); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := p.ListAuditEntries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, e := range entries {
+			ids = append(ids, e.ID)
+		}
+		if strings.Join(ids, ",") != "b,a,c" {
+			t.Errorf("ListAuditEntries = %v, want b,a,c in time order", ids)
+		}
+	})
+}
+
+func TestProviderRelabelAndClone(t *testing.T) {
+	forEachProvider(t, func(t *testing.T, p DataProvider) {
+		mustCreateCodebase(t, p, "cb")
+		v1 := mustCreateVersion(t, p, "cb", "dev", "v1", 1, "k1")
+		v2 := mustCreateVersion(t, p, "cb", "dev", "v2", 2, "k2")
+		if err := p.CreateVersionLink("cb", v2.ID, v1.ID, "dev", LinkageTypeSequential); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.RelabelBranch("cb", "dev", "next"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.GetVersion("cb", "dev", "v1"); err == nil {
+			t.Error("version is still found on the old branch")
+		}
+		latest, err := p.FindLatestVersionInBranch("cb", "next", "")
+		if err != nil || latest == nil || latest.ID != v2.ID {
+			t.Errorf("FindLatestVersionInBranch(next) = %v, %v", latest, err)
+		}
+		if err := p.RelabelBranch("cb", "dev", "next"); err == nil {
+			t.Error("relabeling a missing branch succeeded")
+		}
+
+		idMap, err := p.CloneCodebase("cb", &Codebase{ID: "copy", Name: "copy", Branch: "main", CreatedAt: testEpoch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cloned, err := p.GetVersion("copy", "next", "v2")
+		if err != nil || cloned.ID != idMap[v2.ID] || cloned.TreeID == v2.TreeID {
+			t.Errorf("cloned version = %+v, %v", cloned, err)
+		}
+		edges, _ := p.GetAllVersionEdgesForMap("copy")
+		if len(edges) != 1 || edges[0].From != idMap[v1.ID] || edges[0].To != idMap[v2.ID] {
+			t.Errorf("cloned edges = %+v", edges)
+		}
+		counts, _ := p.BlobRefCounts([]string{"k1"})
+		if counts["k1"] != 2 {
+			t.Errorf("clone shares k1, reference count = %d, want 2", counts["k1"])
+		}
+	})
+}
+
+// A merge has two parents; unlinking one keeps the other.
+func TestProviderDeleteVersionLink(t *testing.T) {
+	forEachProvider(t, func(t *testing.T, p DataProvider) {
+		mustCreateCodebase(t, p, "cb")
+		base := mustCreateVersion(t, p, "cb", "main", "v1", 1, "k1")
+		feature := mustCreateVersion(t, p, "cb", "feature", "f1", 2, "k2")
+		merge := mustCreateVersion(t, p, "cb", "main", "v2", 3, "k3")
+		for _, parent := range []*Version{base, feature} {
+			if err := p.CreateVersionLink("cb", merge.ID, parent.ID, "main", LinkageTypeSequential); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if edges, _ := p.GetAllVersionEdgesForMap("cb"); len(edges) != 2 {
+			t.Fatalf("edges into the merge = %+v, want 2", edges)
+		}
+
+		if err := p.DeleteVersionLink(merge.ID, feature.ID); err != nil {
+			t.Fatal(err)
+		}
+		edges, _ := p.GetAllVersionEdgesForMap("cb")
+		if len(edges) != 1 || edges[0].From != base.ID || edges[0].To != merge.ID {
+			t.Errorf("edges after unlinking feature = %+v, want only v1 -> v2", edges)
+		}
+		if err := p.DeleteVersionLink(merge.ID, feature.ID); err == nil || !strings.Contains(err.Error(), "not found") {
+			t.Errorf("unlinking a removed edge = %v, want not found", err)
+		}
+	})
+}
+
+func TestProviderDeleteCodebase(t *testing.T) {
+	forEachProvider(t, func(t *testing.T, p DataProvider) {
+		mustCreateCodebase(t, p, "cb")
+		mustCreateCodebase(t, p, "keep")
+		v1 := mustCreateVersion(t, p, "cb", "main", "v1", 1, "shared")
+		mustCreateVersion(t, p, "keep", "main", "v1", 1, "shared")
+		if err := p.CreateTag(&Tag{CodebaseID: "cb", Name: "t", VersionID: v1.ID}); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.UpdateHistoryCache("cb", []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := p.DeleteCodebaseByID("cb"); err != nil {
+			t.Fatal(err)
+		}
+		if versions, _ := p.ListVersions("cb"); len(versions) != 0 {
+			t.Errorf("versions of the deleted codebase remain: %v", versionIDs(versions))
+		}
+		if tags, _ := p.ListTags("cb"); len(tags) != 0 {
+			t.Errorf("tags of the deleted codebase remain: %+v", tags)
+		}
+		if _, err := p.GetHistoryCache("cb"); err == nil {
+			t.Error("history cache of the deleted codebase remains")
+		}
+		if counts, _ := p.BlobRefCounts([]string{"shared"}); counts["shared"] != 1 {
+			t.Errorf("reference count of an object the other codebase uses = %d, want 1", counts["shared"])
+		}
+	})
+}
+
+func TestProviderBlobRefCounts(t *testing.T) {
+	forEachProvider(t, func(t *testing.T, p DataProvider) {
+		mustCreateCodebase(t, p, "cb")
+		v1 := &Version{ID: "v1", CodebaseID: "cb", Version: "v1", Branch: "main", TreeID: "tree-v1", CreatedAt: testEpoch}
+		// A tree counts once per object, however many of its files share it
+		files := []File{{Path: "a.txt", StorageKey: "shared"}, {Path: "b.txt", StorageKey: "shared"}, {Path: "c.txt", StorageKey: "own"}}
+		if err := p.CreateVersion(v1, files); err != nil {
+			t.Fatal(err)
+		}
+		v2 := mustCreateVersion(t, p, "cb", "main", "v2", 2, "shared")
+		if counts, _ := p.BlobRefCounts([]string{"shared", "own", "unknown"}); !reflect.DeepEqual(counts, map[string]int{"shared": 2, "own": 1, "unknown": 0}) {
+			t.Errorf("BlobRefCounts = %v", counts)
+		}
+
+		if err := p.DeleteVersion(v1.ID, ""); err != nil {
+			t.Fatal(err)
+		}
+		if counts, _ := p.BlobRefCounts([]string{"shared", "own"}); counts["shared"] != 1 || counts["own"] != 0 {
+			t.Errorf("BlobRefCounts after deleting v1 = %v, want shared=1 own=0", counts)
+		}
+		if err := p.DeleteVersion(v2.ID, ""); err != nil {
+			t.Fatal(err)
+		}
+		var left []string
+		p.ListBlobRefs("", func(key string, refs int) error {
+			left = append(left, fmt.Sprintf("%s=%d", key, refs))
+			return nil
+		})
+		if len(left) != 0 {
+			t.Errorf("references left after deleting every version: %v", left)
+		}
+	})
+}
+
+func TestProviderRewriteStorageKeys(t *testing.T) {
+	forEachProvider(t, func(t *testing.T, p DataProvider) {
+		mustCreateCodebase(t, p, "cb")
+		v1 := mustCreateVersion(t, p, "cb", "main", "v1", 1, "cb/old")
+		changed, err := p.RewriteStorageKeys(map[string]string{"cb/old": "blobs/new"})
+		if err != nil || changed != 1 {
+			t.Fatalf("RewriteStorageKeys = %d, %v", changed, err)
+		}
+		files, _ := p.GetFileIndexesByTreeID(v1.TreeID)
+		if len(files) != 1 || files[0].StorageKey != "blobs/new" {
+			t.Errorf("files after RewriteStorageKeys = %+v", files)
+		}
+		var keys []string
+		p.ListBlobRefs("", func(key string, refs int) error {
+			keys = append(keys, fmt.Sprintf("%s=%d", key, refs))
+			return nil
+		})
+		if !reflect.DeepEqual(keys, []string{"blobs/new=1"}) {
+			t.Errorf("ListBlobRefs = %v", keys)
+		}
+		report, err := p.CheckConsistency(false)
+		if err != nil || len(report.MissingTrees)+len(report.OrphanTrees)+len(report.DanglingEdges) != 0 {
+			t.Errorf("CheckConsistency = %+v, %v", report, err)
+		}
+	})
+}
+
+// TestProviderConcurrentReaders reads while versions are written; run with -race.
+func TestProviderConcurrentReaders(t *testing.T) {
+	forEachProvider(t, func(t *testing.T, p DataProvider) {
+		mustCreateCodebase(t, p, "cb")
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					versions, err := p.ListVersions("cb")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					for _, v := range versions {
+						if _, err := p.GetFileIndexesByTreeID(v.TreeID); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}
+			}()
+		}
+		for n := 0; n < 50; n++ {
+			mustCreateVersion(t, p, "cb", "main", fmt.Sprintf("v%d", n), n, fmt.Sprintf("k%d", n))
+		}
+		close(stop)
+		wg.Wait()
+		if versions, _ := p.ListVersions("cb"); len(versions) != 50 {
+			t.Errorf("ListVersions returned %d versions, want 50", len(versions))
+		}
+	})
+}
+
+func TestBoltProviderReopen(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewBoltProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustCreateCodebase(t, p, "cb")
+	v1 := mustCreateVersion(t, p, "cb", "main", "v1", 1, "k1")
+	if _, err := NewBoltProvider(dir); err == nil {
+		t.Error("a second provider opened the locked directory")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err = NewBoltProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	got, err := p.GetVersion("cb", "main", "v1")
+	if err != nil || got.ID != v1.ID {
+		t.Errorf("GetVersion after reopening = %v, %v", got, err)
+	}
+	report, err := p.RebuildIndexes()
+	if err != nil || report.RepairedBlobRefs != 0 {
+		t.Errorf("RebuildIndexes = %+v, %v", report, err)
+	}
+	if got, err := p.GetVersion("cb", "main", "v1"); err != nil || got.ID != v1.ID {
+		t.Errorf("GetVersion after RebuildIndexes = %v, %v", got, err)
+	}
+}
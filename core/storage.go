@@ -1,9 +1,32 @@
 package core
 
+import (
+	"io"
+	"time"
+)
+
 // Storage 定义了对象存储操作的接口，
 // 抽象了底层实现（例如，本地磁盘、OSS）。
 type Storage interface {
 	PutObject(objectName string, data []byte) error
 	GetObject(objectName string) ([]byte, error)
+	// PutObjectStream 从 r 读取对象内容写入存储，size 为内容字节数（未知时为 -1）
+	PutObjectStream(objectName string, r io.Reader, size int64) error
+	// GetObjectStream 返回对象内容的读取流，调用方负责关闭
+	GetObjectStream(objectName string) (io.ReadCloser, error)
+	ObjectExists(objectName string) (bool, error)
+	DeleteObject(objectName string) error
 	DeleteObjectsWithPrefix(prefix string) error
+	// ListObjects 按名称顺序逐个回调名称以 prefix 开头的对象，prefix 为空时遍历所有对象；
+	// fn 返回错误时停止遍历并返回该错误。对象不会整体加载到内存中
+	ListObjects(prefix string, fn func(ObjectInfo) error) error
+	// StatObject 返回单个对象的信息，对象不存在时返回 "object not found" 错误
+	StatObject(objectName string) (ObjectInfo, error)
+}
+
+// ObjectInfo 存储中一个对象的名称、大小和修改时间
+type ObjectInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
 }
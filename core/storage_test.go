@@ -0,0 +1,205 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// storageFactoriesForTest build an empty store of each Storage implementation; the conformance tests
+// below run against all of them.
+var storageFactoriesForTest = map[string]func(t *testing.T) Storage{
+	"local": func(t *testing.T) Storage {
+		s, err := NewLocalStorage(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	},
+	"memory": func(t *testing.T) Storage {
+		return NewMemoryStorage()
+	},
+	"encrypted": func(t *testing.T) Storage {
+		return testEncryptedStorage(t, NewMemoryStorage(), 1)
+	},
+	"dynamic": func(t *testing.T) Storage {
+		return NewDynamicStorage(NewMemoryStorage())
+	},
+}
+
+func forEachStorage(t *testing.T, test func(t *testing.T, s Storage)) {
+	for _, name := range sortedKeys(storageFactoriesForTest) {
+		t.Run(name, func(t *testing.T) {
+			test(t, storageFactoriesForTest[name](t))
+		})
+	}
+}
+
+// listedNames lists the objects below prefix by name.
+func listedNames(t *testing.T, s Storage, prefix string) []string {
+	t.Helper()
+	var names []string
+	if err := s.ListObjects(prefix, func(info ObjectInfo) error {
+		names = append(names, info.Name)
+		return nil
+	}); err != nil {
+		t.Fatalf("ListObjects(%q): %v", prefix, err)
+	}
+	return names
+}
+
+func TestStorageListObjects(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		if names := listedNames(t, s, ""); len(names) != 0 {
+			t.Errorf("empty store lists %v", names)
+		}
+		contents := map[string]string{
+			"cb1/v1/b.txt":   "bravo",
+			"cb1/v1/a.txt":   "alpha",
+			"cb1/v10/c.txt":  "charlie",
+			"cb1/v2/d/e.txt": "echo",
+			"cb2/x.txt":      "x-ray",
+			"top.txt":        "",
+		}
+		for name, content := range contents {
+			if err := s.PutObject(name, []byte(content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			prefix string
+			want   string
+		}{
+			{"", "cb1/v1/a.txt,cb1/v1/b.txt,cb1/v10/c.txt,cb1/v2/d/e.txt,cb2/x.txt,top.txt"},
+			{"cb1/", "cb1/v1/a.txt,cb1/v1/b.txt,cb1/v10/c.txt,cb1/v2/d/e.txt"},
+			{"cb1/v1", "cb1/v1/a.txt,cb1/v1/b.txt,cb1/v10/c.txt"},
+			{"cb1/v1/", "cb1/v1/a.txt,cb1/v1/b.txt"},
+			{"cb1/v1/a", "cb1/v1/a.txt"},
+			{"cb1/v2/d/e.txt", "cb1/v2/d/e.txt"},
+			{"cb3/", ""},
+			{"cb1/v3/", ""},
+		}
+		for _, tt := range tests {
+			if got := strings.Join(listedNames(t, s, tt.prefix), ","); got != tt.want {
+				t.Errorf("ListObjects(%q) = %s, want %s", tt.prefix, got, tt.want)
+			}
+		}
+
+		_, encrypted := s.(*EncryptedStorage)
+		if err := s.ListObjects("", func(info ObjectInfo) error {
+			size := int64(len(contents[info.Name]))
+			// Encrypted stores list the stored size, which includes the encryption header and tags
+			if info.Size != size && !(encrypted && info.Size > size) || info.ModTime.IsZero() {
+				t.Errorf("listed %+v for %d bytes of content", info, size)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The callback stops the walk with its error, and may delete what it is given
+		stop := errors.New("stop")
+		calls := 0
+		if err := s.ListObjects("", func(info ObjectInfo) error {
+			calls++
+			return stop
+		}); err != stop || calls != 1 {
+			t.Errorf("stopped listing = %v after %d calls, want the callback's error after 1", err, calls)
+		}
+		if err := s.ListObjects("cb1/", func(info ObjectInfo) error {
+			return s.DeleteObject(info.Name)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(listedNames(t, s, ""), ","); got != "cb2/x.txt,top.txt" {
+			t.Errorf("after deleting cb1/ while listing: %s", got)
+		}
+	})
+}
+
+func TestStorageStatObject(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		content := bytes.Repeat([]byte("0123456789"), 10000)
+		if err := s.PutObjectStream("cb/dir/big.bin", bytes.NewReader(content), int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+		info, err := s.StatObject("cb/dir/big.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name != "cb/dir/big.bin" || info.Size != int64(len(content)) || info.ModTime.IsZero() {
+			t.Errorf("StatObject = %+v, want %d bytes", info, len(content))
+		}
+		for _, name := range []string{"cb/dir/missing.bin", "cb/dir", "cb/dir/big"} {
+			if _, err := s.StatObject(name); err == nil || !strings.Contains(err.Error(), "object not found") {
+				t.Errorf("StatObject(%s) = %v, want an object not found error", name, err)
+			}
+		}
+	})
+}
+
+// failingReader returns some content and then fails, as a client connection that drops does.
+type failingReader struct {
+	content []byte
+	err     error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.content) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.content)
+	r.content = r.content[n:]
+	return n, nil
+}
+
+func TestStorageObjectStream(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		content := bytes.Repeat([]byte("streamed content "), 20000)
+		for name, size := range map[string]int64{"cb/known.bin": int64(len(content)), "cb/unknown.bin": -1} {
+			if err := s.PutObjectStream(name, bytes.NewReader(content), size); err != nil {
+				t.Fatalf("PutObjectStream(%s, %d): %v", name, size, err)
+			}
+			rc, err := s.GetObjectStream(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			streamed, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || !bytes.Equal(streamed, content) {
+				t.Errorf("GetObjectStream(%s) = %d bytes, %v, want the %d bytes written", name, len(streamed), err, len(content))
+			}
+			if whole, err := s.GetObject(name); err != nil || !bytes.Equal(whole, content) {
+				t.Errorf("GetObject(%s) = %d bytes, %v, want the %d bytes streamed in", name, len(whole), err, len(content))
+			}
+		}
+
+		// A stream replaces the object, whichever way it was written
+		if err := s.PutObject("cb/known.bin", []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutObjectStream("cb/known.bin", strings.NewReader("new"), 3); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.GetObject("cb/known.bin"); err != nil || string(got) != "new" {
+			t.Errorf("overwritten object = %q, %v", got, err)
+		}
+
+		// A stream that fails leaves nothing behind
+		broken := errors.New("connection reset")
+		err := s.PutObjectStream("cb/broken.bin", &failingReader{content: content, err: broken}, int64(len(content))*2)
+		if !errors.Is(err, broken) {
+			t.Errorf("PutObjectStream from a failing reader = %v, want its error", err)
+		}
+		if got := strings.Join(listedNames(t, s, ""), ","); got != "cb/known.bin,cb/unknown.bin" {
+			t.Errorf("objects after the failed stream: %s", got)
+		}
+
+		if _, err := s.GetObjectStream("cb/missing.bin"); err == nil || !strings.Contains(err.Error(), "object not found") {
+			t.Errorf("GetObjectStream of a missing object = %v, want an object not found error", err)
+		}
+	})
+}
@@ -0,0 +1,320 @@
+package core
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// File trees are written once to db/trees/<tree_id>.json when their version is created and read back on
+// demand, so a snapshot writes only its own tree and old trees don't stay resident.
+const (
+	treesDir = "trees"
+	// defaultTreeCacheEntries is the number of recently used trees kept in memory unless configured
+	defaultTreeCacheEntries = 64
+)
+
+// treeStore holds the file trees of versions. Without a directory (NewMemoryProvider) every tree stays
+// in memory. Writes are serialized by the provider lock; mu only guards the cache, since reads run
+// under the provider's read lock.
+type treeStore struct {
+	dir    string
+	mu     sync.Mutex
+	memory map[string][]File // tree_id -> files, only without a directory
+	ll     *list.List
+	items  map[string]*list.Element
+	// encoding of trees written from now on, see jsonfile_codec.go
+	encoding string
+
+	// Cache budget, a non-positive value doesn't limit. The most recently used tree is always kept, so
+	// a tree larger than maxBytes is still read only once while it is in use.
+	maxEntries int
+	maxBytes   int64
+	size       int64
+
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+// TreeCacheStats reports the size and effectiveness of the file tree cache.
+type TreeCacheStats struct {
+	Entries    int   `json:"entries"`
+	Bytes      int64 `json:"bytes"` // estimated
+	MaxEntries int   `json:"max_entries"`
+	MaxBytes   int64 `json:"max_bytes"`
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"` // trees read from disk
+	Evictions  int64 `json:"evictions"`
+}
+
+type treeCacheEntry struct {
+	id    string
+	files []File
+	size  int64
+}
+
+func newTreeStore(dir string) *treeStore {
+	return &treeStore{
+		dir:    dir,
+		memory: make(map[string][]File),
+		ll:     list.New(),
+		items:  make(map[string]*list.Element),
+
+		maxEntries: defaultTreeCacheEntries,
+	}
+}
+
+func (s *treeStore) path(treeID string) string {
+	return filepath.Join(s.dir, treeID+".json")
+}
+
+// get returns the files of a tree and whether it exists. The returned slice is shared and must not be modified.
+func (s *treeStore) get(treeID string) ([]File, bool, error) {
+	s.mu.Lock()
+	if s.dir == "" {
+		files, ok := s.memory[treeID]
+		s.mu.Unlock()
+		return files, ok, nil
+	}
+	if el, ok := s.items[treeID]; ok {
+		s.ll.MoveToFront(el)
+		files := el.Value.(*treeCacheEntry).files
+		s.hits++
+		s.mu.Unlock()
+		return files, true, nil
+	}
+	s.misses++
+	s.mu.Unlock()
+
+	files, err := s.read(treeID)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("tree %s: %w", treeID, err)
+	}
+	s.cache(treeID, files)
+	return files, true, nil
+}
+
+func (s *treeStore) read(treeID string) ([]File, error) {
+	data, err := os.ReadFile(s.path(treeID))
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	if err := decodeMetadata(data, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// has reports whether a tree exists without reading it.
+func (s *treeStore) has(treeID string) bool {
+	if s.dir == "" {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		_, ok := s.memory[treeID]
+		return ok
+	}
+	_, err := os.Stat(s.path(treeID))
+	return err == nil
+}
+
+// put writes a tree, replacing one with the same ID.
+func (s *treeStore) put(treeID string, files []File) error {
+	if s.dir == "" {
+		s.mu.Lock()
+		s.memory[treeID] = files
+		s.mu.Unlock()
+		return nil
+	}
+	if err := s.write(treeID, files); err != nil {
+		return err
+	}
+	s.cache(treeID, files)
+	return nil
+}
+
+// write writes a tree file in the configured encoding without caching the tree.
+func (s *treeStore) write(treeID string, files []File) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	encoding := s.encoding
+	s.mu.Unlock()
+	data, err := encodeMetadata(encoding, files)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(treeID), data, 0644)
+}
+
+func (s *treeStore) setEncoding(encoding string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.encoding = encoding
+}
+
+// remove deletes a tree; removing one that doesn't exist is not an error.
+func (s *treeStore) remove(treeID string) error {
+	s.mu.Lock()
+	delete(s.memory, treeID)
+	if el, ok := s.items[treeID]; ok {
+		s.removeElement(el)
+	}
+	s.mu.Unlock()
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.Remove(s.path(treeID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ids returns the IDs of all stored trees, sorted.
+func (s *treeStore) ids() ([]string, error) {
+	var ids []string
+	if s.dir == "" {
+		s.mu.Lock()
+		for id := range s.memory {
+			ids = append(ids, id)
+		}
+		s.mu.Unlock()
+	} else {
+		entries, err := os.ReadDir(s.dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() && filepath.Ext(e.Name()) == ".json" {
+				ids = append(ids, strings.TrimSuffix(e.Name(), ".json"))
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// each calls fn for every stored tree. Trees read from disk for it bypass the cache, so a full pass
+// doesn't evict the trees in use. fn may put or remove trees.
+func (s *treeStore) each(fn func(treeID string, files []File) error) error {
+	ids, err := s.ids()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		var files []File
+		if s.dir == "" {
+			s.mu.Lock()
+			files = s.memory[id]
+			s.mu.Unlock()
+		} else if files, err = s.read(id); err != nil {
+			return fmt.Errorf("tree %s: %w", id, err)
+		}
+		if err := fn(id, files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *treeStore) cache(treeID string, files []File) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	size := treeSize(files)
+	if el, ok := s.items[treeID]; ok {
+		entry := el.Value.(*treeCacheEntry)
+		s.size += size - entry.size
+		entry.files, entry.size = files, size
+		s.ll.MoveToFront(el)
+	} else {
+		s.items[treeID] = s.ll.PushFront(&treeCacheEntry{id: treeID, files: files, size: size})
+		s.size += size
+	}
+	s.evict()
+}
+
+// setBudget changes the cache limits and evicts down to them; see treeStore.
+func (s *treeStore) setBudget(maxEntries int, maxBytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxEntries = maxEntries
+	s.maxBytes = maxBytes
+	s.evict()
+}
+
+// evict drops the least recently used trees until the cache is within budget. Callers hold s.mu.
+func (s *treeStore) evict() {
+	for s.ll.Len() > 1 && (s.maxEntries > 0 && s.ll.Len() > s.maxEntries || s.maxBytes > 0 && s.size > s.maxBytes) {
+		s.removeElement(s.ll.Back())
+		s.evictions++
+	}
+}
+
+func (s *treeStore) removeElement(el *list.Element) {
+	entry := el.Value.(*treeCacheEntry)
+	s.ll.Remove(el)
+	delete(s.items, entry.id)
+	s.size -= entry.size
+}
+
+func (s *treeStore) stats() TreeCacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir == "" {
+		// Everything is in memory, nothing is cached
+		var size int64
+		for _, files := range s.memory {
+			size += treeSize(files)
+		}
+		return TreeCacheStats{Entries: len(s.memory), Bytes: size}
+	}
+	return TreeCacheStats{
+		Entries:    s.ll.Len(),
+		Bytes:      s.size,
+		MaxEntries: s.maxEntries,
+		MaxBytes:   s.maxBytes,
+		Hits:       s.hits,
+		Misses:     s.misses,
+		Evictions:  s.evictions,
+	}
+}
+
+// treeSize estimates the memory a tree takes: the fixed part of its entries plus their strings.
+func treeSize(files []File) int64 {
+	size := int64(len(files)) * int64(unsafe.Sizeof(File{}))
+	for _, f := range files {
+		size += int64(len(f.Path) + len(f.Hash) + len(f.StorageKey) + len(f.Type) + len(f.OriginalPath))
+		size += int64(len(f.Chunks)) * int64(unsafe.Sizeof(FileChunk{}))
+		for _, c := range f.Chunks {
+			size += int64(len(c.Hash) + len(c.StorageKey))
+		}
+		for k, v := range f.Attrs {
+			size += int64(len(k) + len(v))
+		}
+	}
+	return size
+}
+
+// SetTreeCacheBudget limits the trees kept in memory by count and by estimated bytes. Zero entries
+// means the default of 64; a negative count or a non-positive byte budget doesn't limit.
+func (p *JSONFileProvider) SetTreeCacheBudget(entries int, bytes int64) {
+	if entries == 0 {
+		entries = defaultTreeCacheEntries
+	}
+	p.trees.setBudget(entries, bytes)
+}
+
+// TreeCacheStats reports the size, budget and counters of the file tree cache.
+func (p *JSONFileProvider) TreeCacheStats() TreeCacheStats {
+	return p.trees.stats()
+}
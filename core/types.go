@@ -1,6 +1,10 @@
 package core
 
-import "time"
+import (
+	"fmt"
+	"sort"
+	"time"
+)
 
 // Codebase 代码库元数据
 type Codebase struct {
@@ -10,6 +14,24 @@ type Codebase struct {
 	Branch      string    `json:"branch"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"` // 添加这行
+	// TrashedAt 非空表示代码库已移入回收站，保留期过后会被永久清除
+	TrashedAt *time.Time        `json:"trashed_at,omitempty"`
+	Settings  *CodebaseSettings `json:"settings,omitempty"`
+	// Ephemeral 临时代码库在 ExpiresAt 之后（或被显式释放时）自动清除
+	Ephemeral bool       `json:"ephemeral,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// CodebaseSettings 代码库级别的行为配置，未指定的字段由服务器默认配置填充
+type CodebaseSettings struct {
+	ManifestRequired  bool     `json:"manifest_required,omitempty"`  // 快照请求必须携带文件清单
+	IgnorePatterns    []string `json:"ignore_patterns,omitempty"`    // 快照时忽略的路径模式，如 ".git/"、"*.log"
+	ProtectedBranches []string `json:"protected_branches,omitempty"` // 受保护、不可删除的分支
+	RetainVersions    int      `json:"retain_versions,omitempty"`    // 每个分支保留的版本数量，0 表示不限制
+	MaxSnapshotBytes  int64    `json:"max_snapshot_bytes,omitempty"` // 单次快照上传的最大字节数，0 表示不限制
+	Compression       string   `json:"compression,omitempty"`        // 压缩策略: "zlib"（默认）或 "none"
+	PathPolicy        string   `json:"path_policy,omitempty"`        // 不可移植路径的处理策略: "warn"（默认）、"reject" 或 "sanitize"
+	BranchCasePolicy  string   `json:"branch_case_policy,omitempty"` // 分支名大小写策略: "case_sensitive"（默认）、"case_insensitive_reject" 或 "normalize_lower"
 }
 
 // Version 版本快照信息
@@ -26,7 +48,49 @@ type Version struct {
 		TotalSize        int64   `json:"total_size"`
 		CompressedSize   int64   `json:"compressed_size"`
 		CompressionRatio float64 `json:"compression_ratio"`
+		ReusedFiles      int     `json:"reused_files"`
+		ReusedBytes      int64   `json:"reused_bytes"`
+		UploadedFiles    int     `json:"uploaded_files"`
+		CarriedFiles     int     `json:"carried_files"`
+		RawFiles         int     `json:"raw_files"`
 	} `json:"stats"`
+	// Source 版本内容的外部来源，目前只有从 git 仓库导入的版本记录
+	Source *VersionSource `json:"source,omitempty"`
+	// FailedFiles 以 partial 方式创建的快照中未能存储、因而不在文件树中的文件
+	FailedFiles []FailedFile `json:"failed_files,omitempty"`
+	// Author 创建版本的人或客户端，请求未提供时为空
+	Author *VersionAuthor `json:"author,omitempty"`
+	// Locked 锁定的版本不能被删除或覆盖
+	Locked bool `json:"locked,omitempty"`
+	// Pinned 固定的版本不会被回收站清理等自动清理删除
+	Pinned bool `json:"pinned,omitempty"`
+}
+
+// VersionAuthor 版本作者：姓名和邮箱，或由客户端自行定义的不透明标识，至少有一项
+type VersionAuthor struct {
+	Name     string `json:"name,omitempty"`
+	Email    string `json:"email,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+}
+
+// VersionSource 记录导入的版本来自哪个外部仓库的哪个提交
+type VersionSource struct {
+	Type    string `json:"type"` // 目前只有 "git"
+	URL     string `json:"url"`  // 不含凭据
+	Ref     string `json:"ref"`
+	Commit  string `json:"commit"`
+	Message string `json:"message,omitempty"` // 提交信息
+}
+
+// VersionExistsError 表示分支上已有同名版本，CreateVersion 拒绝创建
+type VersionExistsError struct {
+	Branch    string `json:"branch"`
+	Version   string `json:"version"`
+	VersionID string `json:"version_id"` // 已存在版本的 ID
+}
+
+func (e *VersionExistsError) Error() string {
+	return fmt.Sprintf("version %s already exists on branch %s (version ID %s)", e.Version, e.Branch, e.VersionID)
 }
 
 // VersionStats 版本统计信息
@@ -35,6 +99,11 @@ type VersionStats struct {
 	TotalSize        int64   `json:"total_size"`
 	CompressedSize   int64   `json:"compressed_size"`
 	CompressionRatio float64 `json:"compression_ratio"`
+	ReusedFiles      int     `json:"reused_files"`   // 存储中已存在、未重新压缩上传的文件数
+	ReusedBytes      int64   `json:"reused_bytes"`   // 未重新上传的原始内容字节数（含已存在的分块）
+	UploadedFiles    int     `json:"uploaded_files"` // 本次快照上传的文件数
+	CarriedFiles     int     `json:"carried_files"`  // 增量快照从基础版本沿用的未修改文件数
+	RawFiles         int     `json:"raw_files"`      // 上传的文件中因内容已压缩（格式在跳过列表中、熵过高或压缩后反而变大）而原样存储的文件数
 }
 
 // FileTree 文件树详情
@@ -52,7 +121,69 @@ type File struct {
 	Size           int64  `json:"size"`
 	CompressedSize int64  `json:"compressed_size"`
 	StorageKey     string `json:"storage_key"`
-	Type           string `json:"type"`
+	// Type 记录内容的存储方式：整文件对象为 "compressed"（压缩）或 "raw"（原样），分块文件为 "chunked"，
+	// 目录为 "dir"；旧索引中的 "image"（原样）和 "other"（zlib）照旧读取
+	Type string `json:"type"`
+	// Encoding 压缩的整文件对象使用的算法（"zlib" 或 "zstd"），为空表示 zlib（旧索引）
+	Encoding string `json:"encoding,omitempty"`
+	// Chunks 大文件按内容分块存储时的有序分块列表，此时 StorageKey 为空
+	Chunks []FileChunk `json:"chunks,omitempty"`
+	// OriginalPath 路径因不可移植被重命名时记录上传时的原始路径
+	OriginalPath string `json:"original_path,omitempty"`
+	// Attrs 快照时附加的文件属性（如审核状态、许可证分类），数量和大小受限
+	Attrs map[string]string `json:"attrs,omitempty"`
+	// Mode 上传时提供的权限位（如 0755），0 表示未记录，恢复时按 0644 处理
+	Mode uint32 `json:"mode,omitempty"`
+}
+
+// FileChunk 大文件的一个内容寻址分块，分块总是以 zlib 压缩存储
+type FileChunk struct {
+	Hash           string `json:"hash"`
+	Size           int64  `json:"size"`
+	CompressedSize int64  `json:"compressed_size"`
+	StorageKey     string `json:"storage_key"`
+}
+
+// IsDir 报告条目是否为快照时显式记录的目录（Type 为 "dir"），目录没有内容也不引用存储对象
+func (f File) IsDir() bool {
+	return f.Type == "dir"
+}
+
+// 压缩对象的编码算法
+const (
+	EncodingZlib = "zlib"
+	EncodingZstd = "zstd"
+)
+
+// Compressed 报告整文件对象是否压缩存储，由上传时记录的 Type 决定，包括旧索引中的类型
+func (f File) Compressed() bool {
+	return f.Type != "raw" && f.Type != "image"
+}
+
+// ContentEncoding 返回整文件对象的压缩算法，原样存储的对象返回空字符串，未记录算法的压缩对象为 zlib
+func (f File) ContentEncoding() string {
+	if !f.Compressed() {
+		return ""
+	}
+	if f.Encoding == "" {
+		return EncodingZlib
+	}
+	return f.Encoding
+}
+
+// StorageKeys 返回文件内容引用的全部存储对象
+func (f File) StorageKeys() []string {
+	if f.IsDir() {
+		return nil
+	}
+	if len(f.Chunks) == 0 {
+		return []string{f.StorageKey}
+	}
+	keys := make([]string, len(f.Chunks))
+	for i, c := range f.Chunks {
+		keys[i] = c.StorageKey
+	}
+	return keys
 }
 
 // SnapshotRequest API请求结构
@@ -69,6 +200,106 @@ type SnapshotResponse struct {
 	Version    *Version            `json:"version"`
 	FileTree   *FileTree           `json:"file_tree"`
 	VersionMap *VersionMapResponse `json:"version_map,omitempty"`
+	// IgnoredFiles 因匹配忽略规则而未被存储的文件数量
+	IgnoredFiles int `json:"ignored_files,omitempty"`
+	// PortabilityWarnings 在其他操作系统上无法还原的路径
+	PortabilityWarnings []PortabilityIssue `json:"portability_warnings,omitempty"`
+	// SkippedPaths 从服务端本地目录创建快照时未存储的符号链接和非普通文件
+	SkippedPaths []SkippedPath `json:"skipped_paths,omitempty"`
+	// FailedFiles 以 partial 方式创建快照时未能存储的文件，版本中同样记录
+	FailedFiles []FailedFile `json:"failed_files,omitempty"`
+	// Linkage 自动建立血缘时选择的父版本及原因
+	Linkage *LinkageDecision `json:"linkage,omitempty"`
+	// Warnings 快照已保存，但历史存在需要关注的问题（例如分支出现多个头）
+	Warnings []SnapshotWarning `json:"warnings,omitempty"`
+	// ReplacedVersionID 以 overwrite 替换的旧版本 ID
+	ReplacedVersionID string `json:"replaced_version_id,omitempty"`
+	// Durable 为 true 表示响应前元数据文件已写入；否则修改会在刷新间隔内写入，期间崩溃由日志（journal.log）恢复
+	Durable bool `json:"durable"`
+}
+
+// SnapshotWarning 快照完成后检查发现的问题
+type SnapshotWarning struct {
+	Kind    string       `json:"kind"` // 目前只有 split_heads
+	Message string       `json:"message"`
+	Branch  string       `json:"branch"`
+	Heads   []BranchHead `json:"heads"`
+}
+
+// BranchHead 分支上没有同分支子版本的版本，即分支头的候选
+type BranchHead struct {
+	VersionID string    `json:"version_id"`
+	Version   string    `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LinkageDecision 记录快照自动建立血缘时选择的父版本及原因
+type LinkageDecision struct {
+	ParentVersionID string      `json:"parent_version_id"`
+	ParentBranch    string      `json:"parent_branch"`
+	ParentVersion   string      `json:"parent_version"`
+	LinkageType     LinkageType `json:"linkage_type"`
+	Reason          string      `json:"reason"`
+}
+
+// SkippedPath 描述本地目录中未被存储或无法读取的条目
+type SkippedPath struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// FailedFile 描述快照中处理失败的文件；Stage 为 "read"（读取上传内容失败）或 "store"（压缩或写入存储失败）
+type FailedFile struct {
+	Path  string `json:"path"`
+	Stage string `json:"stage"`
+	Error string `json:"error"`
+}
+
+// PortabilityIssue 描述一个在部分操作系统上无法还原的文件路径
+type PortabilityIssue struct {
+	Path          string   `json:"path"`
+	Problems      []string `json:"problems"`
+	SanitizedPath string   `json:"sanitized_path,omitempty"` // sanitize 策略下实际存储的路径
+}
+
+// IdempotencyRecord 记录带幂等键的快照请求的结果，保留期内同一代码库的同一键重放该结果而不重新处理
+type IdempotencyRecord struct {
+	CodebaseID  string    `json:"codebase_id"`
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint"` // 请求内容的摘要，同一键用于不同请求时拒绝
+	VersionID   string    `json:"version_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	// Response 首次请求的响应，不含 file_tree 和 version_map，重放时按版本重新读取
+	Response *SnapshotResponse `json:"response"`
+}
+
+// QuarantineEntry 读取时校验失败（解压失败或内容哈希不符）而被隔离的存储对象
+type QuarantineEntry struct {
+	StorageKey string            `json:"storage_key"`
+	CodebaseID string            `json:"codebase_id"`
+	Reason     string            `json:"reason"`
+	DetectedAt time.Time         `json:"detected_at"`
+	LastSeenAt time.Time         `json:"last_seen_at"`
+	PurgedAt   *time.Time        `json:"purged_at,omitempty"` // 对象已被运维清除，受影响的文件只能以占位文件导出
+	Affected   []QuarantinedFile `json:"affected"`            // 引用该对象的版本和路径
+}
+
+// AuditEntry 审计日志中的一条记录：自动清理等不经请求发生的永久性操作，以及因保留规则而被跳过的操作
+type AuditEntry struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"` // 例如 "trash_purge"、"trash_purge_skipped"
+	CodebaseID string    `json:"codebase_id,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// QuarantinedFile 引用了被隔离对象的一个文件
+type QuarantinedFile struct {
+	VersionID string `json:"version_id"`
+	Branch    string `json:"branch"`
+	Version   string `json:"version"`
+	Path      string `json:"path"`
 }
 
 // === 版本历史图谱结构 ===
@@ -80,12 +311,52 @@ type VersionNode struct {
 	Branch    string    `json:"branch"`
 	Message   string    `json:"message"`
 	CreatedAt time.Time `json:"created_at"`
-	Stats     struct {
+	// Author 版本作者，未记录时不输出
+	Author *VersionAuthor `json:"author,omitempty"`
+	Stats  struct {
 		TotalFiles       int     `json:"total_files"`
 		TotalSize        int64   `json:"total_size"`
 		CompressedSize   int64   `json:"compressed_size"`
 		CompressionRatio float64 `json:"compression_ratio"`
+		ReusedFiles      int     `json:"reused_files"`
+		ReusedBytes      int64   `json:"reused_bytes"`
+		UploadedFiles    int     `json:"uploaded_files"`
+		CarriedFiles     int     `json:"carried_files"`
+		RawFiles         int     `json:"raw_files"`
 	} `json:"stats"`
+
+	// 版本注解，未使用对应功能时不输出，保证旧客户端看到的 JSON 不变
+	Tags   []string `json:"tags,omitempty"`
+	Locked bool     `json:"locked,omitempty"`
+	Pinned bool     `json:"pinned,omitempty"`
+}
+
+// versionNode 返回版本在图谱中的节点，tags 为指向该版本的标签名
+func versionNode(v *Version, tags []string) VersionNode {
+	return VersionNode{
+		ID:        v.ID,
+		Version:   v.Version,
+		Branch:    v.Branch,
+		Message:   v.Message,
+		CreatedAt: v.CreatedAt,
+		Author:    v.Author,
+		Stats:     v.Stats,
+		Tags:      tags,
+		Locked:    v.Locked,
+		Pinned:    v.Pinned,
+	}
+}
+
+// tagNamesByVersion 按版本 ID 分组标签名，组内按名称排序
+func tagNamesByVersion(tags []*Tag) map[string][]string {
+	names := make(map[string][]string)
+	for _, tag := range tags {
+		names[tag.VersionID] = append(names[tag.VersionID], tag.Name)
+	}
+	for _, list := range names {
+		sort.Strings(list)
+	}
+	return names
 }
 
 // === 版本血缘关系结构 ===
@@ -105,10 +376,116 @@ type VersionEdge struct {
 	LinkageType LinkageType `json:"linkage_type"` // 血缘关系类型
 }
 
+// VersionLink 待写入的一条血缘关系
+type VersionLink struct {
+	CodebaseID  string
+	ChildID     string
+	ParentID    string
+	Branch      string // 子版本所在分支
+	LinkageType LinkageType
+}
+
+// BranchRef 显式记录的分支指针，用于在没有快照的情况下预先声明分支
+type BranchRef struct {
+	CodebaseID string    `json:"codebase_id"`
+	Branch     string    `json:"branch"`
+	VersionID  string    `json:"version_id"` // 分支当前指向的源版本
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Tag 指向某个版本的具名标记，在代码库内唯一，创建后不随分支移动
+type Tag struct {
+	CodebaseID string    `json:"codebase_id"`
+	Name       string    `json:"name"`
+	VersionID  string    `json:"version_id"`
+	Message    string    `json:"message,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Webhook 订阅代码库事件的回调地址，事件发生后以 HMAC-SHA256 签名的 POST 请求通知
+type Webhook struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"`      // 签名密钥，仅在创建时返回
+	Events     []string  `json:"events"`                // 订阅的事件类型
+	CodebaseID string    `json:"codebase_id,omitempty"` // 为空表示订阅所有代码库
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// IndexRebuildReport 记录重建派生索引时发现的不一致
+type IndexRebuildReport struct {
+	DanglingRefs  []BranchRef `json:"dangling_refs"`  // 指向不存在版本的分支引用（已移除）
+	OrphanTrees   []string    `json:"orphan_trees"`   // 没有任何版本引用的文件树
+	MissingTrees  []string    `json:"missing_trees"`  // 文件树缺失的版本 ID
+	DanglingEdges []string    `json:"dangling_edges"` // 引用不存在版本的血缘边 ID
+	// 与文件树不一致、已按文件树重新计算的对象引用计数个数
+	RepairedBlobRefs int `json:"repaired_blob_refs"`
+}
+
+// ConsistencyReport 记录一致性检查发现的悬空引用；修复只移除血缘边、分支引用、标签和历史缓存，从不删除版本或文件树
+type ConsistencyReport struct {
+	MissingTrees   []string    `json:"missing_trees"`   // 文件树缺失的版本 ID
+	OrphanTrees    []string    `json:"orphan_trees"`    // 没有任何版本引用的文件树
+	OrphanVersions []string    `json:"orphan_versions"` // 所属代码库不存在的版本 ID
+	DanglingEdges  []string    `json:"dangling_edges"`  // 引用不存在版本的血缘边 ID
+	DanglingRefs   []BranchRef `json:"dangling_refs"`   // 指向不存在版本的分支引用
+	DanglingTags   []Tag       `json:"dangling_tags"`   // 指向不存在版本的标签
+	// OrphanHistoryCaches 已删除代码库的历史缓存
+	OrphanHistoryCaches []string `json:"orphan_history_caches"`
+	Repaired            int      `json:"repaired"` // 修复模式下移除的条目数
+}
+
+// Anomalies 返回发现的异常总数
+func (r *ConsistencyReport) Anomalies() int {
+	return len(r.MissingTrees) + len(r.OrphanTrees) + len(r.OrphanVersions) + len(r.DanglingEdges) +
+		len(r.DanglingRefs) + len(r.DanglingTags) + len(r.OrphanHistoryCaches)
+}
+
+// Summary 返回适合写入日志的一行摘要
+func (r *ConsistencyReport) Summary() string {
+	return fmt.Sprintf("%d versions missing trees, %d orphan trees, %d orphan versions, %d dangling edges, %d dangling refs, %d dangling tags, %d orphan history caches (%d repaired)",
+		len(r.MissingTrees), len(r.OrphanTrees), len(r.OrphanVersions), len(r.DanglingEdges),
+		len(r.DanglingRefs), len(r.DanglingTags), len(r.OrphanHistoryCaches), r.Repaired)
+}
+
+// MetadataRecovery 记录一个因损坏而从备份恢复的元数据文件，备份之后保存的修改已丢失
+type MetadataRecovery struct {
+	File        string    `json:"file"`         // 相对元数据目录的文件路径
+	Backup      string    `json:"backup"`       // 恢复所用的备份文件
+	Error       string    `json:"error"`        // 原文件的解析错误
+	CorruptCopy string    `json:"corrupt_copy"` // 损坏文件保留的文件名
+	RecoveredAt time.Time `json:"recovered_at"`
+}
+
+// EncodingConversion 报告 ConvertMetadataEncoding 重写的文件数
+type EncodingConversion struct {
+	Encoding     string `json:"encoding"`      // 转换后的编码
+	VersionFiles int    `json:"version_files"` // 重写的 versions.json 数
+	Trees        int    `json:"trees"`         // 重写的文件树数
+}
+
 // VersionMapResponse 是 /map API 的响应体
 type VersionMapResponse struct {
-	CodebaseID string            `json:"codebase_id"`
-	Nodes      []VersionNode     `json:"nodes"`
-	Edges      []VersionEdge     `json:"edges"`
-	Refs       map[string]string `json:"refs"`
+	CodebaseID    string            `json:"codebase_id"`
+	DefaultBranch string            `json:"default_branch"` // 代码库的默认分支，客户端默认展示该分支
+	Generation    int64             `json:"generation"`     // 每次重建缓存递增，用于增量刷新
+	Nodes         []VersionNode     `json:"nodes"`
+	Edges         []VersionEdge     `json:"edges"`
+	Refs          map[string]string `json:"refs"`
+	// CacheFormat 写入缓存时的格式版本，低于当前版本的缓存（例如升级前写入、节点缺少新字段）在首次读取时重建
+	CacheFormat int `json:"cache_format,omitempty"`
+}
+
+// VersionMapChanges 是 /map/changes API 的响应体，描述自某个 generation 以来图谱的增量变化
+type VersionMapChanges struct {
+	CodebaseID     string            `json:"codebase_id"`
+	DefaultBranch  string            `json:"default_branch"`
+	Generation     int64             `json:"generation"`
+	FullRefresh    bool              `json:"full_refresh"` // 无法计算增量时为 true，客户端需重新获取完整图谱
+	AddedNodes     []VersionNode     `json:"added_nodes"`
+	UpdatedNodes   []VersionNode     `json:"updated_nodes"`
+	RemovedNodeIDs []string          `json:"removed_node_ids"`
+	AddedEdges     []VersionEdge     `json:"added_edges"`
+	RemovedEdges   []VersionEdge     `json:"removed_edges"`
+	Refs           map[string]string `json:"refs"`
 }
@@ -7,6 +7,8 @@ toolchain go1.24.1
 require (
 	github.com/gin-gonic/gin v1.10.0
 	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.18.0
+	go.etcd.io/bbolt v1.4.3
 )
 
 require (
@@ -1,19 +1,70 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"log"
 	"main/api"
+	"main/calculate"
 	"main/core"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		log.SetFlags(log.LstdFlags | log.Lshortfile)
+		runMigrate(os.Args[2:])
+		return
+	}
+
+	rebuildDerived := flag.Bool("rebuild-derived", false, "rebuild indexes, branch refs and history caches from the raw metadata files at startup")
+	force := flag.Bool("force", false, "take over the lock of the metadata directory when the process holding it is no longer running")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long running requests and background jobs may take to finish on Ctrl-C or SIGTERM")
+	flag.Parse()
+	core.SetStealStaleLocks(*force)
+
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	log.Println("=== Service Starting (Dynamic Local File Mode) ===")
 
 	// 1. Load configuration from user directory (e.g., config.json)
 	core.LoadConfig()
+	if err := core.GetConfig().Compression.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	for _, root := range core.GetConfig().LocalSnapshotRoots {
+		if !filepath.IsAbs(root) {
+			log.Fatalf("local_snapshot_roots: %s is not an absolute path", root)
+		}
+	}
+	for _, host := range core.GetConfig().GitImportHosts {
+		if host == "" || strings.ContainsAny(host, "/:@") {
+			log.Fatalf("git_import_hosts: %q is not a host name", host)
+		}
+	}
+	for _, host := range core.GetConfig().WebhookHosts {
+		if host == "" || strings.ContainsAny(host, "/:@") {
+			log.Fatalf("webhook_hosts: %q is not a host name", host)
+		}
+	}
+	seenKeys := make(map[string]bool)
+	for _, key := range core.GetConfig().ObjectAPIKeys {
+		if key.Key == "" || seenKeys[key.Key] {
+			log.Fatal("object_api_keys: every key must be set and unique")
+		}
+		seenKeys[key.Key] = true
+	}
+	if cfg := core.GetConfig(); cfg.GitImportEnabled && len(cfg.GitImportHosts) == 0 {
+		log.Println("Warning: git_import_enabled is set but git_import_hosts is empty, every git import is refused")
+	}
 
 	// 2. Initialize provider manager (it will use loaded configuration)
 	//    Trigger sync.Once initialization by calling GetProvider
@@ -21,10 +72,74 @@ func main() {
 
 	log.Printf("Current storage path: %s", core.GetConfig().StoragePath)
 
+	if *rebuildDerived {
+		report, err := calculate.NewMaintenanceService().RebuildDerived()
+		if err != nil {
+			log.Fatalf("Failed to rebuild derived data: %v", err)
+		}
+		reportJSON, _ := json.MarshalIndent(report, "", "  ")
+		log.Printf("Derived data rebuild report:\n%s", reportJSON)
+	}
+
+	// Read-only consistency pass, repairs are left to /maintenance/fsck
+	if report, err := calculate.NewMaintenanceService().CheckConsistency(false); err != nil {
+		log.Printf("Consistency check failed: %v", err)
+	} else if n := report.Anomalies(); n > 0 {
+		log.Printf("Consistency check found %d anomalies: %s; see POST /api/v1/maintenance/fsck", n, report.Summary())
+	} else {
+		log.Println("Consistency check: no anomalies")
+	}
+
+	// Closed on shutdown to stop the periodic background work
+	stop := make(chan struct{})
+
+	// Probe the storage backend so requests fail fast with 503 while it is unavailable
+	calculate.NewStorageHealthService().StartProber(stop)
+
+	// Purge trashed codebases whose retention window has expired
+	calculate.NewTrashService().StartTrashPurger(stop)
+	// Purge ephemeral codebases once their TTL has passed
+	calculate.NewEphemeralService().StartSweeper(stop)
+	// Remove upload sessions abandoned for longer than their TTL
+	calculate.NewUploadSessionService().StartSweeper(stop)
+	// Forget asynchronous snapshot jobs once their retention window has passed
+	calculate.NewSnapshotJobService().StartSweeper(stop)
+	// Delete the idempotency keys of snapshots once their retention window has passed
+	calculate.NewIdempotencyService().StartSweeper(stop)
+
 	// 3. Start web service
 	gin.SetMode(gin.ReleaseMode)
 	router := api.NewRouter()
 
+	// Validate and rebuild history caches in the background so the first map requests don't stall
+	calculate.NewWarmupService().Start()
+
+	server := &http.Server{Addr: ":8080", Handler: router}
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
 	log.Println("Service ready, listening on :8080")
-	log.Fatal(router.Run(":8080"))
+
+	<-sig
+	shutdown(server, stop, *shutdownTimeout, sig)
+}
+
+// shutdown drains the server and background work through api.Shutdown. Another signal on sig exits at
+// once; the metadata journal keeps the changes made so far.
+func shutdown(server *http.Server, stop chan struct{}, timeout time.Duration, sig <-chan os.Signal) {
+	log.Printf("Shutting down, waiting up to %s for running requests and background jobs (signal again to exit at once)", timeout)
+	go func() {
+		<-sig
+		log.Println("Exiting without waiting")
+		os.Exit(1)
+	}()
+
+	if err := api.Shutdown(server, stop, timeout); err != nil {
+		log.Fatalf("Failed to close the metadata provider: %v", err)
+	}
+	log.Println("Shutdown complete")
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"main/calculate"
+	"main/core"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runMigrate implements "migrate --from <type>:<path> --to <type>:<path>", copying all metadata
+// from one provider to another while the server is stopped.
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := fs.String("from", "", "source provider as <type>:<path>, e.g. json:./cvcs_data/db")
+	to := fs.String("to", "", "target provider as <type>:<path>")
+	fs.Parse(args)
+	if *from == "" || *to == "" {
+		fmt.Fprintln(os.Stderr, "usage: migrate --from <type>:<path> --to <type>:<path>")
+		fmt.Fprintf(os.Stderr, "provider types: %s\n", strings.Join(core.ProviderTypes(), ", "))
+		os.Exit(2)
+	}
+
+	srcType, srcPath := parseProviderSpec(*from)
+	dstType, dstPath := parseProviderSpec(*to)
+	for _, spec := range []struct{ providerType, path string }{{srcType, srcPath}, {dstType, dstPath}} {
+		if dir, fileBased := providerDirs[spec.providerType]; fileBased && spec.path == "" {
+			log.Fatalf("The %s provider needs a directory, e.g. %s:./cvcs_data/%s", spec.providerType, spec.providerType, dir)
+		}
+	}
+	if srcPath != "" && srcType == dstType && sameDir(srcPath, dstPath) {
+		log.Fatalf("Source and target are the same provider: %s", *from)
+	}
+
+	// File based providers lock their directories while open, keeping the server off both until the migration is done
+	src, err := core.OpenProvider(srcType, srcPath)
+	if err != nil {
+		log.Fatalf("Failed to open source provider %s: %v", *from, err)
+	}
+	dst, err := core.OpenProvider(dstType, dstPath)
+	if err != nil {
+		log.Fatalf("Failed to open target provider %s: %v", *to, err)
+	}
+
+	log.Printf("Migrating metadata from %s to %s", *from, *to)
+	report, err := calculate.MigrateProviders(src, dst)
+	if flushErr := dst.Flush(); err == nil {
+		err = flushErr
+	}
+	reportJSON, _ := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Printf("Migration report:\n%s", reportJSON)
+		log.Fatalf("Migration failed, run it again to resume: %v", err)
+	}
+	log.Printf("Migration complete:\n%s", reportJSON)
+}
+
+// providerDirs are the default directories of the file based providers below storage_path
+var providerDirs = map[string]string{
+	core.ProviderTypeJSON: "db",
+	core.ProviderTypeBolt: "bolt",
+}
+
+// parseProviderSpec splits "<type>:<path>"; a bare type has no path.
+func parseProviderSpec(spec string) (string, string) {
+	providerType, path, _ := strings.Cut(spec, ":")
+	return providerType, path
+}
+
+func sameDir(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
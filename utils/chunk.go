@@ -0,0 +1,52 @@
+package utils
+
+// gearTable 是 Gear 滚动哈希使用的随机表，由固定种子生成以保证分块结果稳定
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x9E3779B97F4A7C15)
+	for i := range table {
+		// splitmix64
+		seed += 0x9E3779B97F4A7C15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// 纯函数：基于内容的分块（Gear 滚动哈希）
+// 返回每个分块的结束偏移量。分块边界只取决于附近的内容，
+// 因此在文件中插入或追加数据只会影响相邻的分块。
+func ChunkBoundaries(data []byte, minSize, avgSize, maxSize int) []int {
+	var boundaries []int
+	start := 0
+	for start < len(data) {
+		start += NextChunkBoundary(data[start:], minSize, avgSize, maxSize)
+		boundaries = append(boundaries, start)
+	}
+	return boundaries
+}
+
+// 纯函数：返回从 data 开头起第一个分块的长度。只读取前 maxSize 个字节，
+// 因此流式分块时缓冲 maxSize 个字节（或到内容末尾）即可得到与 ChunkBoundaries 相同的边界。
+func NextChunkBoundary(data []byte, minSize, avgSize, maxSize int) int {
+	mask := uint64(1)
+	for mask < uint64(avgSize) {
+		mask <<= 1
+	}
+	mask--
+
+	end := maxSize
+	if end > len(data) {
+		end = len(data)
+	}
+	var hash uint64
+	for i := 0; i < end; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if i+1 >= minSize && hash&mask == 0 {
+			return i + 1
+		}
+	}
+	return end
+}
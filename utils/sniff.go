@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"math"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// SniffLen 是判断存储方式时读取的文件开头样本长度
+const SniffLen = 8 << 10
+
+// 样本的熵（比特/字节）超过该值时视为已压缩或加密的内容，样本过短时熵不可靠，不参与判断
+const (
+	highEntropyBits  = 7.5
+	minEntropySample = 1 << 10
+)
+
+// DefaultIncompressibleTypes 是默认原样存储的已压缩格式（压缩包、图片、音视频、字体、PDF），再次压缩几乎没有收益。
+// 以 "." 开头的条目匹配文件扩展名（不区分大小写，".png.gz" 按 ".gz" 匹配），其余条目按前缀匹配
+// http.DetectContentType 根据内容识别出的类型
+var DefaultIncompressibleTypes = []string{
+	".zip", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".7z", ".rar", ".jar", ".war", ".apk", ".whl",
+	".docx", ".xlsx", ".pptx", ".odt", ".ods", ".odp", ".epub",
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".avif", ".heic",
+	".mp3", ".mp4", ".m4a", ".m4v", ".mkv", ".mov", ".webm", ".avi", ".ogg", ".opus", ".flac", ".aac",
+	".woff", ".woff2", ".pdf",
+	"image/jpeg", "image/png", "image/gif", "image/webp",
+	"video/", "audio/",
+	"font/woff", "application/vnd.ms-fontobject",
+	"application/zip", "application/x-gzip", "application/x-rar-compressed", "application/pdf", "application/ogg",
+}
+
+// IsCompressible 根据文件名和文件开头的样本判断内容是否值得压缩：扩展名或识别出的类型在 types 中的文件，
+// 以及熵接近随机数据的内容（加密文件、无法识别的压缩格式）原样存储
+func IsCompressible(name string, sample []byte, types []string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	contentType := http.DetectContentType(sample)
+	for _, t := range types {
+		if strings.HasPrefix(t, ".") {
+			if ext == strings.ToLower(t) {
+				return false
+			}
+		} else if strings.HasPrefix(contentType, t) {
+			return false
+		}
+	}
+	return len(sample) < minEntropySample || ByteEntropy(sample) < highEntropyBits
+}
+
+// ByteEntropy 计算数据按字节分布的香农熵，取值 0 到 8 比特/字节
+func ByteEntropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	entropy := 0.0
+	total := float64(len(data))
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / total
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}